@@ -11,6 +11,8 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -19,6 +21,7 @@ import (
 	"github.com/Debian/dcs/varz"
 	"github.com/stapelberg/godebiancontrol"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
@@ -47,8 +50,31 @@ var (
 		":21020",
 		"listen address ([host]:port)")
 
+	importerTLS = flag.Bool("importer_tls",
+		false,
+		"Talk HTTPS to the dcs-package-importer shards (see -tls_cert on the importer)")
+
+	importerCAPath = flag.String("importer_tls_ca",
+		"",
+		"If non-empty, path to a PEM-encoded CA certificate bundle used to verify the dcs-package-importer shards instead of the system roots")
+
+	tlsCertPath = flag.String("tls_cert",
+		"",
+		"Path to a PEM-encoded client certificate to present to the dcs-package-importer shards")
+
+	tlsKeyPath = flag.String("tls_key",
+		"",
+		"Path to the PEM-encoded private key for -tls_cert")
+
+	explicitCommit = flag.Bool("explicit_commit",
+		false,
+		"Send POST /import/<pkg>/commit after successfully uploading all files of a package. Only enable for importers running with -implicit_commit=false, which otherwise unpack packages on their own and reply to the commit with 404")
+
 	shards []string
 
+	// Used for all requests to the dcs-package-importer shards.
+	importerClient = http.DefaultClient
+
 	mergeStates   = make(map[string]mergeState)
 	mergeStatesMu sync.Mutex
 )
@@ -64,7 +90,7 @@ func merge() {
 			if time.Since(state.lastActivity) >= 2*time.Minute ||
 				time.Since(state.firstRequest) >= 10*time.Minute {
 				log.Printf("Calling /merge on shard %s now\n", shard)
-				resp, err := http.Get(fmt.Sprintf("http://%s/merge", shard))
+				resp, err := importerClient.Get(importerUrl(shard, "/merge"))
 				if err != nil {
 					log.Printf("/merge for shard %s failed (retry in 10s): %v\n", shard, err)
 					continue
@@ -81,6 +107,46 @@ func merge() {
 	}
 }
 
+// importerUrl returns the URL for path on the dcs-package-importer running on
+// shard, taking -importer_tls into account.
+func importerUrl(shard, path string) string {
+	if *importerTLS {
+		return "https://" + shard + path
+	}
+	return "http://" + shard + path
+}
+
+// setupImporterClient configures importerClient according to the TLS flags.
+func setupImporterClient() {
+	if !*importerTLS {
+		return
+	}
+	config := &tls.Config{}
+	if *importerCAPath != "" {
+		pem, err := ioutil.ReadFile(*importerCAPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %q\n", *importerCAPath)
+		}
+	}
+	if *tlsCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertPath, *tlsKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	importerClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+}
+
 func requestMerge(shard string) {
 	mergeStatesMu.Lock()
 	defer mergeStatesMu.Unlock()
@@ -100,39 +166,71 @@ func requestMerge(shard string) {
 // feed uploads the file to the corresponding dcs-package-importer.
 func feed(pkg, filename string, reader io.Reader) error {
 	shard := shards[shardmapping.TaskIdxForPackage(pkg, len(shards))]
-	url := fmt.Sprintf("http://%s/import/%s/%s", shard, pkg, filename)
+	url := importerUrl(shard, fmt.Sprintf("/import/%s/%s", pkg, filename))
 	request, err := http.NewRequest("PUT", url, reader)
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := importerClient.Do(request)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	log.Printf("HTTP response for %q: %q\n", url, resp.Status)
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP status %q: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
 
-	if resp.StatusCode == 200 && strings.HasSuffix(filename, ".dsc") {
+	if strings.HasSuffix(filename, ".dsc") {
 		requestMerge(shard)
 	}
 
 	return nil
 }
 
+// commit tells the corresponding dcs-package-importer that all files of pkg
+// were uploaded, if -explicit_commit is enabled. Callers only commit once all
+// files were fed successfully.
+func commit(pkg string) error {
+	if !*explicitCommit {
+		return nil
+	}
+	shard := shards[shardmapping.TaskIdxForPackage(pkg, len(shards))]
+	url := importerUrl(shard, fmt.Sprintf("/import/%s/commit", pkg))
+	resp, err := importerClient.Post(url, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	log.Printf("HTTP response for %q: %q\n", url, resp.Status)
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP status %q: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
 func feedfiles(pkg string, pkgfiles []string) {
 	for _, url := range pkgfiles {
 		resp, err := http.Get(url)
 		if err != nil {
 			log.Printf("Skipping %s: %v\n", pkg, err)
 			// Skip packages that can not be downloaded fully.
-			break
+			return
 		}
 		if resp.StatusCode != 200 {
-			log.Printf("Skipping %s: URL %q: %v\n", pkg, resp.Status)
-			break
+			log.Printf("Skipping %s: URL %q: %v\n", pkg, url, resp.Status)
+			return
 		}
 		defer resp.Body.Close()
-		feed(pkg, filepath.Base(url), resp.Body)
+		if err := feed(pkg, filepath.Base(url), resp.Body); err != nil {
+			log.Printf("Skipping %s: could not feed %q: %v\n", pkg, url, err)
+			return
+		}
+	}
+	if err := commit(pkg); err != nil {
+		log.Printf("Could not commit %s: %v\n", pkg, err)
 	}
 }
 
@@ -222,12 +320,17 @@ func lookfor(dscName string) {
 			}
 			defer resp.Body.Close()
 			if err := feed(strings.TrimSuffix(dscName, ".dsc"), parts[2], resp.Body); err != nil {
-				log.Printf("Could not feed %q: %v\n", url, err)
+				log.Printf("Could not feed %q: %v\n", fileUrl, err)
+				return
 			}
 		}
 		dscReader := bytes.NewReader(dscContents.Bytes())
 		if err := feed(strings.TrimSuffix(dscName, ".dsc"), dscName, dscReader); err != nil {
 			log.Printf("Could not feed %q: %v\n", dscName, err)
+			return
+		}
+		if err := commit(strings.TrimSuffix(dscName, ".dsc")); err != nil {
+			log.Printf("Could not commit %q: %v\n", dscName, err)
 		}
 		log.Printf("Fed %q.\n", dscName)
 		varz.Increment("successful-lookfor")
@@ -249,8 +352,8 @@ func checkSources() {
 	packages := make(map[string]map[string]pkgStatus)
 
 	for _, shard := range shards {
-		url := fmt.Sprintf("http://%s/listpkgs", shard)
-		resp, err := http.Get(url)
+		url := importerUrl(shard, "/listpkgs")
+		resp, err := importerClient.Get(url)
 		if err != nil {
 			log.Printf("Could not get list of packages from %q: %v\n", url, err)
 			continue
@@ -345,8 +448,8 @@ func checkSources() {
 			log.Printf("garbage-collecting %q on shard %s\n", p, shard)
 
 			shard := shards[shardmapping.TaskIdxForPackage(p, len(shards))]
-			url := fmt.Sprintf("http://%s/garbagecollect", shard)
-			if _, err := http.PostForm(url, net_url.Values{"package": {p}}); err != nil {
+			url := importerUrl(shard, "/garbagecollect")
+			if _, err := importerClient.PostForm(url, net_url.Values{"package": {p}}); err != nil {
 				log.Printf("Could not garbage-collect package %q on shard %s: %v\n", p, shard, err)
 				continue
 			}
@@ -360,6 +463,7 @@ func main() {
 	flag.Parse()
 
 	shards = strings.Split(*shardsStr, ",")
+	setupImporterClient()
 
 	varz.Set("failed-lookfor", 0)
 	varz.Set("successful-garbage-collect", 0)
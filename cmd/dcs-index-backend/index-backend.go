@@ -3,36 +3,68 @@ package main
 
 import (
 	"code.google.com/p/codesearch/regexp"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/Debian/dcs/feature"
 	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/lang"
+	dcsquery "github.com/Debian/dcs/query"
+	"github.com/Debian/dcs/symbols"
 	"github.com/Debian/dcs/varz"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp/syntax"
 	"runtime/pprof"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	listenAddress = flag.String("listen_address", ":28081", "listen address ([host]:port)")
-	indexPath     = flag.String("index_path", "", "path to the index shard to serve, e.g. /dcs-ssd/index.0.idx")
+	indexPath     = flag.String("index_path", "", "path to the index shard to serve, e.g. /dcs-ssd/index.0.idx, or to a directory containing a segmented index")
 	cpuProfile    = flag.String("cpuprofile", "", "write cpu profile to this file")
+	blockCache    = flag.Int64("block_cache_size", 64, "MiB of decompressed blocks of compressed indexes (see dcs-package-importer -compress_shards) to keep in memory")
+	indexKeys     = flag.String("index_keys", "env:DCS_INDEX_KEY", "where to get the keys of encrypted indexes, see dcs-package-importer -index_keys")
 
-	id      string
-	ix      *index.Index
-	ixMutex sync.Mutex
+	id string
+
+	// Identifies the index which is currently served: the time (in
+	// nanoseconds since the epoch) at which it was loaded. dcs-web drops its
+	// cached results when the generation changes. Updated atomically.
+	generation int64
 )
 
+// Records that a new index is being served.
+func newGeneration() {
+	atomic.StoreInt64(&generation, time.Now().UnixNano())
+}
+
 // Handles requests to /index by compiling the q= parameter into a regular
 // expression (codesearch/regexp), searching the index for it and returning the
-// list of matching filenames in a JSON array.
+// list of matching filenames in a JSON array. With dedup=1, the filenames are
+// grouped into arrays of files with identical contents (see
+// dcs-package-importer -dedup), so that only one file per group needs to be
+// searched. The package=, npackage=, filetype= and nfiletype= parameters (see
+// the query package) restrict the packages and languages of the returned
+// files. With modtimes=1 (which implies dedup=1), the reply is a
+// modTimesReply, which also contains the modification times of the files
+// according to the file metadata of the index.
 // TODO: This doesn’t handle file name regular expressions at all yet.
 // TODO: errors aren’t properly signaled to the requester
 func Index(w http.ResponseWriter, r *http.Request) {
+	if currentShardState() == stateDraining {
+		http.Error(w, "Shard is draining.", http.StatusServiceUnavailable)
+		return
+	}
+	atomic.AddInt64(&inFlight, 1)
+	defer atomic.AddInt64(&inFlight, -1)
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -45,26 +77,94 @@ func Index(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 	textQuery := r.Form.Get("q")
-	re, err := regexp.Compile(textQuery)
+	withModTimes := r.Form.Get("modtimes") == "1"
+	dedup := r.Form.Get("dedup") == "1" || withModTimes
+	filter := dcsquery.FromValues(r.Form)
+	expr, err := dcsquery.ParseExpr(textQuery)
 	if err != nil {
-		log.Printf("regexp.Compile: %s\n", err)
+		log.Printf("dcsquery.ParseExpr: %s\n", err)
 		return
 	}
-	query := index.RegexpQuery(re.Syntax)
+	var re *regexp.Regexp
+	var query *index.Query
+	if expr != nil {
+		query, err = expr.IndexQuery(index.RegexpQuery)
+		if err != nil {
+			log.Printf("regexp.Compile: %s\n", err)
+			return
+		}
+	} else {
+		re, err = regexp.Compile(textQuery)
+		if err != nil {
+			log.Printf("regexp.Compile: %s\n", err)
+			return
+		}
+		query = index.RegexpQuery(re.Syntax)
+	}
 	log.Printf("[%s] query: text = %s, regexp = %s\n", id, textQuery, query)
 	t0 := time.Now()
-	ixMutex.Lock()
-	post := ix.PostingQuery(query)
-	t1 := time.Now()
-	fmt.Printf("[%s] postingquery done in %v, %d results\n", id, t1.Sub(t0), len(post))
-	files := make([]string, len(post))
-	for idx, fileid := range post {
-		files[idx] = ix.Name(fileid)
+	// The source-backend cancels the request when the query is cancelled
+	// or its deadline expired, so there is no point in finishing it.
+	ctx := r.Context()
+	sh := acquireShard()
+	defer sh.release()
+	var files []string
+	var groups [][]string
+	var mtimes map[string]int64
+	if withModTimes {
+		mtimes = make(map[string]int64)
+	}
+	// Collects the files in post, which are the results in ix.
+	collect := func(ix *index.Index, post []uint32) {
+		names := make([]string, len(post))
+		for idx, fileid := range post {
+			names[idx] = ix.Name(fileid)
+		}
+		files = append(files, names...)
+		if dedup {
+			if ix.HasDuplicates() {
+				groups = append(groups, groupDuplicates(ix, post, names)...)
+			} else {
+				for _, name := range names {
+					groups = append(groups, []string{name})
+				}
+			}
+		}
+		if withModTimes {
+			for name, mtime := range modTimes(ix, post, names) {
+				mtimes[name] = mtime
+			}
+		}
+	}
+	if sh.segments != nil {
+		// Each segment is a complete index with its own format and file
+		// metadata, so the query runs on each of them separately.
+		for i := 0; i < sh.segments.NumSegments() && err == nil; i++ {
+			ix := sh.segments.Segment(i)
+			var post []uint32
+			post, err = queryIndex(ctx, ix, expr, re, filter)
+			collect(ix, sh.segments.Live(i, post))
+		}
+	} else {
+		var post []uint32
+		post, err = queryIndex(ctx, sh.ix, expr, re, filter)
+		collect(sh.ix, post)
+	}
+	if err != nil {
+		log.Printf("[%s] query %q stopped: %v\n", id, textQuery, err)
+		varz.Increment("cancelled-queries")
+		return
 	}
-	ixMutex.Unlock()
 	t2 := time.Now()
-	fmt.Printf("[%s] filenames collected in %v\n", id, t2.Sub(t1))
-	if err := json.NewEncoder(w).Encode(files); err != nil {
+	fmt.Printf("[%s] filenames collected in %v\n", id, t2.Sub(t0))
+	var reply interface{} = files
+	if dedup {
+		reply = groups
+	}
+	if withModTimes {
+		reply = &modTimesReply{Files: groups, ModTimes: mtimes}
+	}
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
 		log.Printf("%s\n", err)
 		return
 	}
@@ -72,7 +172,308 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[%s] written in %v\n", id, t3.Sub(t2))
 }
 
+// Returns the files of ix which match the query (re, or expr if it is not nil)
+// and filter. Files which cannot match according to the Bloom filters or the
+// line offsets of ix are left out, so that the source-backend does not need to
+// read them.
+func queryIndex(ctx context.Context, ix *index.Index, expr *dcsquery.Expr, re *regexp.Regexp, filter dcsquery.Query) ([]uint32, error) {
+	t0 := time.Now()
+	var query *index.Query
+	var err error
+	if expr != nil {
+		query, err = expr.IndexQuery(func(re *syntax.Regexp) *index.Query {
+			return termQuery(ix, re)
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		query = termQuery(ix, re.Syntax)
+	}
+	post, err := ix.PostingQueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	t1 := time.Now()
+	fmt.Printf("[%s] postingquery done in %v, %d results\n", id, t1.Sub(t0), len(post))
+	if filter.FiltersPackages() || filter.FiltersLanguages() {
+		post = filterFiles(ix, post, filter)
+		fmt.Printf("[%s] %d results in the requested packages and languages\n", id, len(post))
+	}
+	if ix.HasBloom() {
+		// Files which cannot contain the literals of the query do not
+		// need to be read by the source-backend.
+		n := len(post)
+		post = ix.FilterBloom(post, requiredLiterals(re, expr))
+		varz.IncrementBy("bloom-filtered-files", uint64(n-len(post)))
+		fmt.Printf("[%s] bloom filters done in %v, %d results\n", id, time.Since(t1), len(post))
+	}
+	if filter.FullLine && re != nil && ix.HasLineOffsets() {
+		// Matches of line:full queries are whole lines, so the files
+		// need to contain a line of the length a match can have.
+		n := len(post)
+		post = filterLineLength(ix, post, re)
+		varz.IncrementBy("line-length-filtered-files", uint64(n-len(post)))
+		fmt.Printf("[%s] %d results with lines of a fitting length\n", id, len(post))
+	}
+	return post, nil
+}
+
+// The reply to /index requests with modtimes=1.
+type modTimesReply struct {
+	// The filenames, grouped as with dedup=1.
+	Files [][]string
+
+	// The modification time (in seconds since the Unix epoch) of each file
+	// whose metadata contains one.
+	ModTimes map[string]int64
+}
+
+// Returns the modification times of the files in post (whose names are
+// names) according to the file metadata of the index, see modTimesReply.
+func modTimes(ix *index.Index, post []uint32, names []string) map[string]int64 {
+	mtimes := make(map[string]int64)
+	if !ix.HasFileMeta() {
+		return mtimes
+	}
+	for idx, fileid := range post {
+		if meta, ok := ix.FileMeta(fileid); ok && !meta.ModTime.IsZero() {
+			mtimes[names[idx]] = meta.ModTime.Unix()
+		}
+	}
+	return mtimes
+}
+
+// Returns the trigram query for re which fits the index, i.e. which takes
+// into account how the index normalizes or folds the case of the files.
+func termQuery(ix *index.Index, re *syntax.Regexp) *index.Query {
+	if ix.Normalizes() && index.CaseInsensitive(re) {
+		// Also finds non-ASCII letters in any case and spelling.
+		return index.NormalizedRegexpQuery(re)
+	} else if ix.FoldsCase() {
+		return index.FoldedRegexpQuery(re)
+	}
+	return index.RegexpQuery(re)
+}
+
+// Returns the literals which every file matching the query (re, or expr if
+// it is not nil) contains.
+func requiredLiterals(re *regexp.Regexp, expr *dcsquery.Expr) []string {
+	if expr == nil {
+		return index.RequiredLiterals(re.Syntax)
+	}
+	var literals []string
+	for _, term := range expr.RequiredTerms() {
+		// The terms were parsed successfully by expr.IndexQuery already.
+		if re, err := syntax.Parse(term.Regexp, syntax.Perl); err == nil {
+			literals = append(literals, index.RequiredLiterals(re)...)
+		}
+	}
+	return literals
+}
+
+// Returns the files in post which are in the packages and languages filter
+// asks for. Packages are recognized by the file name prefix, languages
+// according to the file metadata or, for indexes without it, the file names.
+func filterFiles(ix *index.Index, post []uint32, filter dcsquery.Query) []uint32 {
+	kept := post[:0]
+	for _, fileid := range post {
+		name := ix.Name(fileid)
+		if !filter.MatchesPackage(name) {
+			continue
+		}
+		if filter.FiltersLanguages() {
+			if meta, ok := ix.FileMeta(fileid); ok && meta.Language != lang.Unknown {
+				if !filter.MatchesLanguage(meta.Language) {
+					continue
+				}
+			} else if !filter.MatchesName(name) {
+				continue
+			}
+		}
+		kept = append(kept, fileid)
+	}
+	return kept
+}
+
+// Returns the files in post which have a line that a match of re (which
+// matches whole lines) fits, according to the line offsets of the index.
+func filterLineLength(ix *index.Index, post []uint32, re *regexp.Regexp) []uint32 {
+	min, max := index.MatchLength(re.Syntax)
+	kept := post[:0]
+	for _, fileid := range post {
+		if ix.HasLineOfLength(fileid, min, max) {
+			kept = append(kept, fileid)
+		}
+	}
+	return kept
+}
+
+// Groups the names of the files in post (the result of a posting query) by
+// their original file.
+func groupDuplicates(ix *index.Index, post []uint32, names []string) [][]string {
+	var groups [][]string
+	group := make(map[uint32]int)
+	for idx, fileid := range post {
+		orig := ix.Original(fileid)
+		if g, ok := group[orig]; ok {
+			groups[g] = append(groups[g], names[idx])
+			continue
+		}
+		group[orig] = len(groups)
+		groups = append(groups, []string{names[idx]})
+	}
+	return groups
+}
+
+// Handles requests to /symbols by looking up the definitions of the name=
+// parameter in the symbol index and returning them in a JSON array. At most
+// limit= definitions (default 1000) are returned.
+func Symbols(w http.ResponseWriter, r *http.Request) {
+	if currentShardState() == stateDraining {
+		http.Error(w, "Shard is draining.", http.StatusServiceUnavailable)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "No ?name= provided", http.StatusBadRequest)
+		return
+	}
+	limit := 1000
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid limit: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	sh := acquireShard()
+	defer sh.release()
+	if sh.syms == nil {
+		http.Error(w, "No symbol index loaded.", http.StatusNotFound)
+		return
+	}
+	defs, err := sh.syms.Lookup(name, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if defs == nil {
+		defs = []symbols.Symbol{}
+	}
+	if err := json.NewEncoder(w).Encode(defs); err != nil {
+		log.Printf("%s\n", err)
+	}
+}
+
+// Handles requests to /files by returning the names of the files of the
+// source package package= (all versions of it which are in the index) in a
+// JSON array, sorted by name.
+func Files(w http.ResponseWriter, r *http.Request) {
+	if currentShardState() == stateDraining {
+		http.Error(w, "Shard is draining.", http.StatusServiceUnavailable)
+		return
+	}
+	pkg := r.FormValue("package")
+	if pkg == "" || strings.ContainsAny(pkg, "_/") {
+		http.Error(w, "No valid ?package= provided", http.StatusBadRequest)
+		return
+	}
+	// The files of a package are in directories named <package>_<version>,
+	// and package names cannot contain underscores.
+	prefix := pkg + "_"
+	sh := acquireShard()
+	var names []string
+	if sh.segments != nil {
+		names = sh.segments.NamesWithPrefix(prefix)
+	} else {
+		names = sh.ix.NamesWithPrefix(prefix)
+	}
+	sh.release()
+	if names == nil {
+		names = []string{}
+	}
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		log.Printf("%s\n", err)
+	}
+}
+
+// The metadata of a file which /filemeta returns. Hash is empty and ModTime
+// is zero if the index does not record them.
+type fileMetaReply struct {
+	// Hex-encoded content hash (see index.Index.ContentHash), which dcs-web
+	// uses as the ETag of the file.
+	Hash    string `json:",omitempty"`
+	ModTime time.Time
+}
+
+// Handles requests to /filemeta by returning the content hash and metadata
+// which the index records for the file file= (e.g.
+// “i3-wm_4.7.2-1/src/main.c”) as JSON, so that dcs-web can answer
+// conditional requests for the file without fetching it.
+func FileMeta(w http.ResponseWriter, r *http.Request) {
+	if currentShardState() == stateDraining {
+		http.Error(w, "Shard is draining.", http.StatusServiceUnavailable)
+		return
+	}
+	name := r.FormValue("file")
+	if name == "" {
+		http.Error(w, "No ?file= provided", http.StatusBadRequest)
+		return
+	}
+	sh := acquireShard()
+	defer sh.release()
+	ix := sh.ix
+	fileid, ok := uint32(0), false
+	if sh.segments != nil {
+		ix, fileid, ok = sh.segments.Lookup(name)
+	} else {
+		fileid, ok = ix.FileID(name)
+	}
+	if !ok {
+		http.Error(w, "File not found in the index.", http.StatusNotFound)
+		return
+	}
+	var reply fileMetaReply
+	if hash := ix.ContentHash(fileid); hash != nil {
+		reply.Hash = fmt.Sprintf("%x", hash)
+	}
+	if meta, ok := ix.FileMeta(fileid); ok {
+		reply.ModTime = meta.ModTime
+	}
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Printf("%s\n", err)
+	}
+}
+
+// Loads the symbol index belonging to the index at path, or returns nil if
+// there is none.
+func loadSymbols(path string) *symbols.File {
+	f, err := symbols.Open(symbols.FileFor(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[%s] Could not load symbols: %v\n", id, err)
+		}
+		return nil
+	}
+	log.Printf("[%s] Loaded %d symbols\n", id, f.Len())
+	return f
+}
+
 func Replace(w http.ResponseWriter, r *http.Request) {
+	if state := currentShardState(); state != stateServing {
+		http.Error(w, fmt.Sprintf("Shard is %s.", state), http.StatusServiceUnavailable)
+		return
+	}
+
+	sh := acquireShard()
+	segmented := sh.segments != nil
+	sh.release()
+	if segmented {
+		reloadSegments(w)
+		return
+	}
+
 	r.ParseForm()
 	newShard := r.Form.Get("shard")
 
@@ -91,18 +492,31 @@ func Replace(w http.ResponseWriter, r *http.Request) {
 			newShard = filepath.Join(filepath.Dir(*indexPath), name)
 			// We verified the given argument refers to an index shard within
 			// this directory, so let’s load this shard.
-			oldIndex := ix
+			if _, err := index.ReadHeader(newShard); err != nil {
+				http.Error(w, fmt.Sprintf("Cannot load %q: %v", newShard, err), http.StatusInternalServerError)
+				return
+			}
 			log.Printf("Trying to load %q\n", newShard)
-			ixMutex.Lock()
-			ix = index.Open(newShard)
-			ixMutex.Unlock()
+			newSymbols := loadSymbols(newShard)
+			// Queries which are running keep using the old shard, which
+			// is closed once they are done.
+			serveShard(&shard{ix: index.OpenMmap(newShard), syms: newSymbols})
 			// Overwrite the old full shard with the new one. This is necessary
 			// so that the state is persistent across restarts and has the nice
 			// side-effect of cleaning up the old full shard.
 			if err := os.Rename(newShard, *indexPath); err != nil {
 				log.Fatal(err)
 			}
-			oldIndex.Close()
+			// The old symbols do not match the new shard, so they go away
+			// even if the new shard comes without symbols.
+			if newSymbols != nil {
+				err = os.Rename(symbols.FileFor(newShard), symbols.FileFor(*indexPath))
+			} else {
+				err = os.Remove(symbols.FileFor(*indexPath))
+			}
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("[%s] Could not update symbols: %v\n", id, err)
+			}
 			return
 		}
 	}
@@ -110,18 +524,61 @@ func Replace(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "No such shard.", http.StatusInternalServerError)
 }
 
+// Re-reads the manifest of the segmented index, e.g. after the importer
+// appended a segment.
+func reloadSegments(w http.ResponseWriter) {
+	newSegments, err := index.OpenSegments(*indexPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveShard(&shard{segments: newSegments})
+	log.Printf("[%s] Now serving %d segments\n", id, newSegments.NumSegments())
+}
+
 func main() {
 	flag.Parse()
 	if *indexPath == "" {
 		log.Fatal("You need to specify a non-empty -index_path")
 	}
 	fmt.Println("Debian Code Search index-backend")
+	if err := feature.Load(); err != nil {
+		log.Fatalf("Could not load feature flags: %v\n", err)
+	}
 
 	id = filepath.Base(*indexPath)
-	ix = index.Open(*indexPath)
+	index.SetBlockCacheSize(*blockCache << 20)
+	keys, err := index.ParseKeySource(*indexKeys)
+	if err != nil {
+		log.Fatalf("Invalid -index_keys: %v\n", err)
+	}
+	index.SetKeySource(keys)
+	varz.Set("shard-draining", 0)
+	varz.Set("shard-read-only", 0)
+	if info, err := os.Stat(*indexPath); err == nil && info.IsDir() {
+		segments, err := index.OpenSegments(*indexPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Serving %d segments\n", segments.NumSegments())
+		serveShard(&shard{segments: segments})
+	} else {
+		if _, err := index.ReadHeader(*indexPath); err != nil {
+			log.Fatalf("Cannot load %q: %v\n", *indexPath, err)
+		}
+		serveShard(&shard{ix: index.OpenMmap(*indexPath), syms: loadSymbols(*indexPath)})
+	}
 
 	http.HandleFunc("/index", Index)
 	http.HandleFunc("/replace", Replace)
+	http.HandleFunc("/symbols", Symbols)
+	http.HandleFunc("/files", Files)
+	http.HandleFunc("/filemeta", FileMeta)
+	http.HandleFunc("/shardstate", ShardState)
+	http.HandleFunc("/healthz", Healthz)
+	http.HandleFunc("/readyz", Readyz)
+	http.HandleFunc("/indexstats", IndexStats)
 	http.HandleFunc("/varz", varz.Varz)
+	http.HandleFunc("/featurez", feature.Featurez)
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
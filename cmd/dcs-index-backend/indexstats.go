@@ -0,0 +1,47 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Number of most frequent trigrams IndexStats reports unless top= is given.
+const defaultTopTrigrams = 50
+
+// IndexStats reports the statistics of the served index as a JSON array with
+// one entry per segment (or a single entry for an index file). The top=
+// parameter sets the number of most frequent trigrams to include.
+func IndexStats(w http.ResponseWriter, r *http.Request) {
+	top := defaultTopTrigrams
+	if value := r.FormValue("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid top= parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var stats []index.Stats
+	sh := acquireShard()
+	if sh.segments != nil {
+		stats = sh.segments.Stats(top)
+	} else {
+		stats = []index.Stats{sh.ix.Stats(top)}
+	}
+	sh.release()
+
+	jsonReply, err := json.Marshal(&stats)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("[%s] Could not send index stats: %v\n", id, err)
+	}
+}
@@ -0,0 +1,72 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/symbols"
+	"sync"
+)
+
+// The index which is served: either an index file (ix) or a segmented index
+// (segments), plus the symbol index belonging to it, if the importer created
+// one (see its -ctags flag).
+//
+// Requests hold a reference to the shard while they use it (see
+// acquireShard), so that loading a new shard does not need to wait for them:
+// new requests use the new shard right away, and the old one is closed once
+// the last request using it is done.
+type shard struct {
+	ix       *index.Index
+	segments *index.Segments
+	syms     *symbols.File
+
+	// Number of requests using the shard, plus one while it is served.
+	// Protected by shardMu.
+	refs int
+}
+
+var (
+	current *shard
+	shardMu sync.Mutex
+)
+
+// Returns the shard which is served. The caller needs to call release once
+// it is done with it.
+func acquireShard() *shard {
+	shardMu.Lock()
+	defer shardMu.Unlock()
+	current.refs++
+	return current
+}
+
+func (s *shard) release() {
+	shardMu.Lock()
+	s.refs--
+	unused := s.refs == 0
+	shardMu.Unlock()
+	if unused {
+		s.close()
+	}
+}
+
+func (s *shard) close() {
+	if s.segments != nil {
+		s.segments.Close()
+	} else {
+		s.ix.Close()
+	}
+}
+
+// Serves s instead of the current shard, which is closed once the requests
+// using it are done.
+func serveShard(s *shard) {
+	s.refs = 1
+	shardMu.Lock()
+	old := current
+	current = s
+	shardMu.Unlock()
+	newGeneration()
+	if old != nil {
+		old.release()
+	}
+}
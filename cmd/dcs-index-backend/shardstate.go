@@ -0,0 +1,107 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Administrative states of this shard, see ShardState.
+const (
+	// Queries are answered, the index can be replaced.
+	stateServing = "serving"
+
+	// Queries are answered, but /replace is rejected so that the index stays
+	// unchanged, e.g. while the unpacked sources are being copied.
+	stateReadOnly = "read-only"
+
+	// New queries are rejected (in-flight queries finish) and /replace is
+	// rejected. dcs-web stops querying draining shards, so that the host can
+	// be taken down once InFlight reached 0.
+	stateDraining = "draining"
+)
+
+var (
+	shardState   = stateServing
+	shardStateMu sync.Mutex
+
+	// Number of /index requests currently being processed.
+	inFlight int64
+)
+
+func currentShardState() string {
+	shardStateMu.Lock()
+	defer shardStateMu.Unlock()
+	return shardState
+}
+
+// ShardState reports the administrative state of this shard as JSON. A POST
+// request with state= changes it.
+func ShardState(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		newState := r.FormValue("state")
+		switch newState {
+		case stateServing, stateReadOnly, stateDraining:
+		default:
+			http.Error(w, fmt.Sprintf("Invalid state %q", newState), http.StatusBadRequest)
+			return
+		}
+		shardStateMu.Lock()
+		log.Printf("[%s] Changing state from %q to %q\n", id, shardState, newState)
+		shardState = newState
+		shardStateMu.Unlock()
+		varz.Set("shard-draining", boolToUint(newState == stateDraining))
+		varz.Set("shard-read-only", boolToUint(newState == stateReadOnly))
+	}
+
+	type ShardStateReply struct {
+		State      string
+		InFlight   int64
+		Generation int64
+	}
+
+	reply := ShardStateReply{
+		State:      currentShardState(),
+		InFlight:   atomic.LoadInt64(&inFlight),
+		Generation: atomic.LoadInt64(&generation),
+	}
+	if err := json.NewEncoder(w).Encode(&reply); err != nil {
+		log.Printf("%s\n", err)
+	}
+}
+
+// Healthz reports that the process is alive.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok\n")
+}
+
+// Readyz reports whether queries are answered, i.e. whether a shard is loaded
+// (which includes reading the parts every query needs into the page cache,
+// see index.OpenMmap) and not draining.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if currentShardState() == stateDraining {
+		http.Error(w, "Shard is draining.", http.StatusServiceUnavailable)
+		return
+	}
+	shardMu.Lock()
+	loaded := current != nil
+	shardMu.Unlock()
+	if !loaded {
+		http.Error(w, "No shard loaded.", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+func boolToUint(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+// Verifies index files (full.idx, package indexes, segments) and reports
+// every problem it finds. Arguments are index files or directories, of which
+// all *.idx files are verified. Exits with status 1 if any index is corrupt.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	verbose = flag.Bool("verbose",
+		false,
+		"Also print the indexes which are fine")
+)
+
+// Returns the number of problems found in the index at path.
+func fsck(path string) int {
+	h, err := index.ReadHeader(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return 1
+	}
+	ix := index.Open(path)
+	defer ix.Close()
+	problems := ix.Verify()
+	for _, p := range problems {
+		fmt.Printf("%s: %v\n", path, p)
+	}
+	if len(problems) == 0 && *verbose {
+		if h.KeyID != "" {
+			fmt.Printf("%s: ok (version %d, features %v, encrypted with key %q)\n", path, h.Version, h.Features, h.KeyID)
+		} else {
+			fmt.Printf("%s: ok (version %d, features %v)\n", path, h.Version, h.Features)
+		}
+	}
+	return len(problems)
+}
+
+// Returns the index files in path, which is either an index file or a
+// directory.
+func indexFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".idx") {
+			paths = append(paths, filepath.Join(path, name))
+		}
+	}
+	return paths, nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("Usage: dcs-index-fsck [-verbose] <index file or directory>...")
+	}
+
+	corrupt := 0
+	for _, arg := range flag.Args() {
+		paths, err := indexFiles(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, path := range paths {
+			if fsck(path) > 0 {
+				corrupt++
+			}
+		}
+	}
+	if corrupt > 0 {
+		log.Printf("%d corrupt index files\n", corrupt)
+		os.Exit(1)
+	}
+}
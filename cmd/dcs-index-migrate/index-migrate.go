@@ -0,0 +1,122 @@
+// Upgrades index files (full.idx, package indexes, segments) to the current
+// index format version in place. Arguments are index files or directories, of
+// which all *.idx files are upgraded, e.g.:
+//
+//	dcs-index-migrate /dcs-ssd/unpacked/ /dcs-ssd/unpacked/segments/
+//
+// Each index is rewritten into a temporary file next to it, which then
+// replaces the old index atomically, so running processes which still have
+// the old index open are not affected. The list of indexed paths is not
+// preserved, Debian Code Search does not use it. With -compress, indexes are
+// also rewritten with compressed name and posting lists.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	dryRun = flag.Bool("dry_run",
+		false,
+		"Only print the format version of each index, do not upgrade anything")
+
+	compress = flag.Bool("compress",
+		false,
+		"Also compress the name list and the posting lists of each index, see dcs-package-importer -compress_shards")
+)
+
+func migrate(path string) error {
+	h, err := index.ReadHeader(path)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%s: version %d, features %v\n", path, h.Version, h.Features)
+		return nil
+	}
+	compressIndex := *compress && h.Features&index.FeatureCompressed == 0
+	if h.Version == index.CurrentVersion && !compressIndex {
+		return nil
+	}
+
+	// Does not end in .idx, so that merges ignore it.
+	tmpPath := path + ".migrate"
+	if compressIndex {
+		// Compress also upgrades to the current version.
+		index.Compress(tmpPath, path)
+	} else {
+		index.ConcatN(tmpPath, path)
+	}
+	if _, err := index.ReadHeader(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("upgraded index is unreadable: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if compressIndex {
+		log.Printf("Compressed %s (version %d, now %d)\n", path, h.Version, index.CurrentVersion)
+	} else {
+		log.Printf("Upgraded %s from version %d to %d\n", path, h.Version, index.CurrentVersion)
+	}
+	return nil
+}
+
+// Returns the index files in path, which is either an index file or a
+// directory.
+func indexFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names, err := file.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".idx") {
+			paths = append(paths, filepath.Join(path, name))
+		}
+	}
+	return paths, nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("Usage: dcs-index-migrate [-dry_run] [-compress] <index file or directory>...")
+	}
+
+	failed := false
+	for _, arg := range flag.Args() {
+		paths, err := indexFiles(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, path := range paths {
+			if err := migrate(path); err != nil {
+				log.Printf("Could not upgrade %s: %v\n", path, err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
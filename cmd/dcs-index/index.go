@@ -0,0 +1,222 @@
+// Builds an index shard from a directory tree of unpacked source packages in
+// a single step, indexing files on all CPUs, e.g.:
+//
+//	dcs-index /dcs-ssd/unpacked/ /dcs-ssd/unpacked/full.idx.new
+//
+// This is faster than importing each package with dcs-package-importer and
+// merging the package indexes, so it is meant for bulk rebuilds (e.g. after
+// changing the ignore lists). Files are excluded using the same rules (and
+// defaults) as dcs-package-importer, but, unlike the importer, dcs-index
+// never deletes anything from the tree.
+package main
+
+import (
+	"flag"
+	"github.com/Debian/dcs/filter"
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/lang"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	workers = flag.Int("workers",
+		0,
+		"Number of files to index concurrently. 0 means one per CPU")
+
+	foldCase = flag.Bool("fold_case",
+		false,
+		"Additionally index case-folded trigrams, see dcs-package-importer -fold_case")
+
+	normalize = flag.Bool("normalize",
+		false,
+		"Also record the trigrams of the NFC-normalized, lowercased text, see dcs-package-importer -normalize")
+
+	lineOffsets = flag.Bool("line_offsets",
+		false,
+		"Record where each line of a file starts, see dcs-package-importer -line_offsets")
+
+	bloom = flag.Bool("bloom",
+		false,
+		"Record a Bloom filter of the 4-grams of each file, see dcs-package-importer -bloom")
+
+	compress = flag.Bool("compress",
+		false,
+		"Compress the name list and the posting lists of the index, see dcs-package-importer -compress_shards")
+
+	encryptionKeyID = flag.String("encryption_key_id",
+		"",
+		"If non-empty, encrypt the index with the key of this ID, see dcs-package-importer -encryption_key_id")
+
+	indexKeys = flag.String("index_keys",
+		"env:DCS_INDEX_KEY",
+		"Where to get the encryption key, see dcs-package-importer -index_keys")
+
+	dedup = flag.Bool("dedup",
+		false,
+		"Index files with identical contents only once, see dcs-package-importer -dedup")
+
+	longLines = flag.String("long_lines",
+		"skip_file",
+		"What to do with files containing very long lines, see dcs-package-importer -long_lines")
+
+	maxLineLength = flag.Int("max_line_length",
+		2000,
+		"Length (in bytes) above which a line is considered long, see -long_lines")
+
+	indexMemory = flag.Int64("index_memory",
+		128,
+		"Memory (in MiB) each worker may use for buffering trigrams before spilling them to temporary files")
+
+	ignoredDirnamesList = flag.String("ignored_dirnames",
+		".pc,po,.git,libtool.m4",
+		"(comma-separated list of) names of directories that are not indexed")
+
+	ignoredFilenamesList = flag.String("ignored_filenames",
+		"NEWS,COPYING,LICENSE,CHANGES,Makefile.in,ltmain.sh,config.guess,config.sub,depcomp,aclocal.m4,libtool.m4,.gitignore",
+		"(comma-separated list of) names of files that are not indexed")
+
+	ignoredSuffixesList = flag.String("ignored_suffixes",
+		"conf,dic,cfg,man,xml,xsl,html,sgml,pod,po,txt,tex,rtf,docbook,symbols",
+		"(comma-separated list of) suffixes of files that are not indexed")
+
+	skipBinaryFiles = flag.Bool("skip_binary_files",
+		true,
+		"Do not index files whose content does not look like text (e.g. images)")
+
+	filters filter.Pipeline
+)
+
+// Returns the first bytes of the file at path, which are enough to sniff its
+// content type and detect its language.
+func readHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
+}
+
+// Returns true for files and directories which should not be indexed. name
+// starts with the package directory.
+func skip(root string) func(name string, info os.FileInfo) bool {
+	return func(name string, info os.FileInfo) bool {
+		// Names which are not valid UTF-8 break when sending them via JSON.
+		if !utf8.ValidString(name) {
+			log.Printf("Skipping due to invalid UTF-8: %s\n", name)
+			return true
+		}
+		idx := strings.Index(name, "/")
+		if idx == -1 {
+			// Only package directories contain sources, the other entries
+			// are package indexes and the like.
+			return !info.IsDir()
+		}
+		file := &filter.File{
+			Path: name[idx+1:],
+			Info: info,
+		}
+		if info.Mode().IsRegular() {
+			file.ContentType = filter.Sniff(readHead(filepath.Join(root, name)))
+		}
+		return filters.Exclude(file) != nil
+	}
+}
+
+// Records the detected language of each file, like dcs-package-importer.
+func fileMeta(path, name string) (index.FileMeta, bool) {
+	language := lang.Detect(name, readHead(path))
+	if language == lang.Unknown {
+		language = "unknown"
+	}
+	return index.FileMeta{Language: language}, true
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatal("Usage: dcs-index [flags] <directory> <index file>")
+	}
+	root, dst := flag.Arg(0), flag.Arg(1)
+
+	filters = filter.Pipeline{
+		filter.Dirnames(filter.Set(*ignoredDirnamesList)),
+		filter.Filenames(filter.Set(*ignoredFilenamesList)),
+		filter.Changelogs{},
+		filter.Manpages{},
+		filter.Suffixes(filter.Set(*ignoredSuffixesList)),
+	}
+	if *skipBinaryFiles {
+		filters = append(filters, filter.Binary{})
+	}
+
+	longLinePolicy, err := index.ParseLongLinePolicy(*longLines)
+	if err != nil {
+		log.Fatalf("Invalid -long_lines: %v\n", err)
+	}
+	keys, err := index.ParseKeySource(*indexKeys)
+	if err != nil {
+		log.Fatalf("Invalid -index_keys: %v\n", err)
+	}
+	index.SetKeySource(keys)
+
+	opts := index.CreateOptions{
+		Workers:     *workers,
+		FoldCase:    *foldCase,
+		Normalize:   *normalize,
+		LineOffsets: *lineOffsets,
+		Bloom:       *bloom,
+		MaxMemory:   *indexMemory << 20,
+		LongLines:   longLinePolicy,
+		MaxLineLen:  *maxLineLength,
+		Dedup:       *dedup,
+		Skip:        skip(root),
+		Meta:        fileMeta,
+	}
+
+	t0 := time.Now()
+	// Does not end in .idx, so that merges ignore it.
+	tmpPath := dst + ".tmp"
+	if err := index.CreateFromDir(tmpPath, root, opts); err != nil {
+		os.Remove(tmpPath)
+		log.Fatal(err)
+	}
+	log.Printf("Indexed %s in %v\n", root, time.Since(t0))
+
+	if *compress {
+		t1 := time.Now()
+		compressedPath := dst + ".compressed"
+		index.Compress(compressedPath, tmpPath)
+		if err := os.Rename(compressedPath, tmpPath); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Compressed in %v\n", time.Since(t1))
+	}
+	if *encryptionKeyID != "" {
+		t1 := time.Now()
+		encryptedPath := dst + ".encrypted"
+		if err := index.Encrypt(encryptedPath, tmpPath, *encryptionKeyID); err != nil {
+			os.Remove(tmpPath)
+			log.Fatal(err)
+		}
+		if err := os.Rename(encryptedPath, tmpPath); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Encrypted in %v\n", time.Since(t1))
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := index.ReadHeader(dst); err != nil {
+		log.Fatalf("%s is unreadable: %v\n", dst, err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/varz"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	smallSegmentSize = flag.Int64("small_segment_size",
+		64,
+		"With -incremental_merge, segments smaller than this many MiB are small (see -segments_per_tier)")
+
+	largeSegmentSize = flag.Int64("large_segment_size",
+		1024,
+		"With -incremental_merge, segments of at least this many MiB are large (see -segments_per_tier)")
+
+	segmentsPerTier = flag.Int("segments_per_tier",
+		4,
+		"With -incremental_merge, merge this many consecutive segments of the same size tier (small, medium or large) into one in the background. 0 disables tiered compaction, leaving only the full compaction at -max_segments")
+
+	// Shards which are waiting for the compactor. Each shard is queued at
+	// most once, so compactQueue never blocks.
+	compactQueue   chan int
+	compactPending = make(map[int]bool)
+
+	compactions   = make(map[int]*compactionState)
+	compactionsMu sync.Mutex
+)
+
+// A compactionJob is a merge of consecutive segments of one shard.
+type compactionJob struct {
+	Segments []string
+	Tier     string
+	Bytes    int64
+	Started  time.Time
+}
+
+type compactionState struct {
+	Running      *compactionJob
+	Compactions  int
+	BytesWritten int64
+	LastFinished time.Time
+	LastError    string
+}
+
+func compactionPolicy() index.TieredPolicy {
+	return index.TieredPolicy{
+		SmallSize:  *smallSegmentSize << 20,
+		LargeSize:  *largeSegmentSize << 20,
+		MaxPerTier: *segmentsPerTier,
+	}
+}
+
+// Returns the compaction state of shard. Called with compactionsMu held.
+func shardCompactionState(shard int) *compactionState {
+	state, ok := compactions[shard]
+	if !ok {
+		state = &compactionState{}
+		compactions[shard] = state
+	}
+	return state
+}
+
+// Queues shard for a look by the compactor.
+func triggerCompaction(shard int) {
+	if *segmentsPerTier == 0 {
+		return
+	}
+	compactionsMu.Lock()
+	defer compactionsMu.Unlock()
+	if compactPending[shard] {
+		return
+	}
+	compactPending[shard] = true
+	compactQueue <- shard
+}
+
+// Merges segments in the background, one shard at a time, so that imports
+// never wait for a compaction.
+func compactor() {
+	for shard := range compactQueue {
+		compactionsMu.Lock()
+		delete(compactPending, shard)
+		compactionsMu.Unlock()
+		for compactTier(shard) {
+		}
+	}
+}
+
+// Merges the next run of segments of shard which the tiered policy picks.
+// Returns true if segments were merged, so that the caller can look for the
+// next run.
+func compactTier(shard int) bool {
+	dir := segmentsDir(shard)
+	policy := compactionPolicy()
+
+	manifestMu.Lock()
+	s, err := index.OpenSegments(dir)
+	manifestMu.Unlock()
+	if err != nil {
+		log.Printf("Could not open segments of shard %d: %v\n", shard, err)
+		return false
+	}
+	defer s.Close()
+	sizes := make([]int64, s.NumSegments())
+	for i := range sizes {
+		sizes[i] = s.SegmentSize(i)
+	}
+	lo, hi, ok := policy.Pick(sizes)
+	if !ok {
+		return false
+	}
+
+	job := &compactionJob{
+		Segments: s.Manifest.Segments[lo:hi],
+		Tier:     policy.Tier(sizes[lo]).String(),
+		Started:  time.Now(),
+	}
+	for _, size := range sizes[lo:hi] {
+		job.Bytes += size
+	}
+	compactionsMu.Lock()
+	shardCompactionState(shard).Running = job
+	compactionsMu.Unlock()
+
+	tmpIndex, err := ioutil.TempFile(*unpackedPath, "newshard")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmpIndex.Close()
+	// The segments stay readable even if they are replaced while merging,
+	// in which case ReplaceSegments refuses to use the result.
+	s.CompactRange(tmpIndex.Name(), lo, hi)
+	var written int64
+	if st, err := os.Stat(tmpIndex.Name()); err == nil {
+		written = st.Size()
+	}
+
+	manifestMu.Lock()
+	err = index.ReplaceSegments(dir, job.Segments, tmpIndex.Name())
+	manifestMu.Unlock()
+
+	compactionsMu.Lock()
+	state := shardCompactionState(shard)
+	state.Running = nil
+	state.LastFinished = time.Now()
+	if err != nil {
+		state.LastError = err.Error()
+	} else {
+		state.LastError = ""
+		state.Compactions++
+		state.BytesWritten += written
+	}
+	compactionsMu.Unlock()
+
+	if err != nil {
+		log.Printf("Could not compact segments of shard %d: %v\n", shard, err)
+		os.Remove(tmpIndex.Name())
+		return false
+	}
+	log.Printf("Compacted %d %s segments (%d bytes) of shard %d in %v\n",
+		hi-lo, job.Tier, job.Bytes, shard, time.Since(job.Started))
+	varz.Increment("successful-compactions")
+	reloadSegments(shard)
+	return true
+}
+
+// Reports the segments of each shard with their tiers and the state of the
+// background compaction as JSON.
+func compactionStatus(w http.ResponseWriter, r *http.Request) {
+	type Segment struct {
+		Name  string
+		Bytes int64
+		Tier  string
+	}
+	type Shard struct {
+		Shard      int
+		Segments   []Segment
+		Tombstones int
+		compactionState
+	}
+
+	policy := compactionPolicy()
+	reply := make([]Shard, *numShards)
+	for shard := range reply {
+		dir := segmentsDir(shard)
+		reply[shard].Shard = shard
+		m, err := index.ReadManifest(dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reply[shard].Tombstones = len(m.Tombstones)
+		for _, name := range m.Segments {
+			st, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				// Replaced after reading the manifest.
+				continue
+			}
+			reply[shard].Segments = append(reply[shard].Segments, Segment{
+				Name:  name,
+				Bytes: st.Size(),
+				Tier:  policy.Tier(st.Size()).String(),
+			})
+		}
+		compactionsMu.Lock()
+		if state, ok := compactions[shard]; ok {
+			reply[shard].compactionState = *state
+		}
+		compactionsMu.Unlock()
+	}
+
+	jsonReply, err := json.Marshal(&reply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("Could not send compaction reply: %v\n", err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/stapelberg/godebiancontrol"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type packageLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	implicitCommit = flag.Bool("implicit_commit",
+		true,
+		"Unpack a package as soon as its .dsc file and all files it references were uploaded. Disable once all clients call POST /import/<pkg>/commit after uploading")
+
+	packageLocks   = make(map[string]*packageLock)
+	packageLocksMu sync.Mutex
+
+	// The .dsc file (relative to tmpdir) of each package for which not all
+	// referenced files were uploaded yet.
+	pendingDsc   = make(map[string]string)
+	pendingDscMu sync.Mutex
+
+	// Packages which were enqueued for unpacking and were not cleaned up
+	// yet.
+	queuedPackages   = make(map[string]bool)
+	queuedPackagesMu sync.Mutex
+)
+
+// Serializes operations on pkg (uploading, indexing, reindexing and garbage
+// collecting it). Must be followed by unlockPackage.
+func lockPackage(pkg string) *packageLock {
+	packageLocksMu.Lock()
+	lock, ok := packageLocks[pkg]
+	if !ok {
+		lock = &packageLock{}
+		packageLocks[pkg] = lock
+	}
+	lock.refs++
+	packageLocksMu.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+func unlockPackage(pkg string, lock *packageLock) {
+	lock.Unlock()
+
+	packageLocksMu.Lock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(packageLocks, pkg)
+	}
+	packageLocksMu.Unlock()
+}
+
+func setPendingDsc(pkg, dscPath string) {
+	pendingDscMu.Lock()
+	defer pendingDscMu.Unlock()
+	pendingDsc[pkg] = dscPath
+}
+
+func forgetPendingDsc(pkg string) {
+	pendingDscMu.Lock()
+	defer pendingDscMu.Unlock()
+	delete(pendingDsc, pkg)
+}
+
+func setQueued(pkg string, queued bool) {
+	queuedPackagesMu.Lock()
+	defer queuedPackagesMu.Unlock()
+	if queued {
+		queuedPackages[pkg] = true
+	} else {
+		delete(queuedPackages, pkg)
+	}
+}
+
+// Returns whether pkg is waiting to be unpacked or to be committed, i.e.
+// whether its uploaded files are still needed.
+func queuedOrPending(pkg string) bool {
+	queuedPackagesMu.Lock()
+	queued := queuedPackages[pkg]
+	queuedPackagesMu.Unlock()
+	pendingDscMu.Lock()
+	_, pending := pendingDsc[pkg]
+	pendingDscMu.Unlock()
+	return queued || pending
+}
+
+// Returns the files (and their sizes) listed in the Files field of the .dsc
+// file at path.
+func dscFiles(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	paragraphs, err := godebiancontrol.Parse(godebiancontrol.PGPSignatureStripper(f))
+	if err != nil {
+		return nil, err
+	}
+	if len(paragraphs) != 1 {
+		return nil, fmt.Errorf("expected exactly one paragraph, got %d", len(paragraphs))
+	}
+	files := make(map[string]int64)
+	for _, line := range strings.Split(paragraphs[0]["Files"], "\n") {
+		// Each line is “<md5sum> <size> <filename>”. The field has a newline
+		// at the end, so we get one empty line.
+		parts := strings.Fields(line)
+		if len(parts) < 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in line %q", line)
+		}
+		files[parts[2]] = size
+	}
+	return files, nil
+}
+
+// Returns the files referenced by dscPath (relative to tmpdir) which were not
+// uploaded yet or do not have the expected size.
+func missingFiles(pkg, dscPath string) ([]string, error) {
+	files, err := dscFiles(filepath.Join(tmpdir, dscPath))
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for filename, size := range files {
+		info, err := os.Stat(filepath.Join(tmpdir, pkg, filename))
+		if err != nil || info.Size() != size {
+			missing = append(missing, filename)
+		}
+	}
+	return missing, nil
+}
+
+// Checks whether the .dsc file of pkg was uploaded and all the files it
+// references are present with the expected size. If so, returns the .dsc path
+// (relative to tmpdir) and forgets about pkg, so that it is enqueued exactly
+// once. The caller must hold the lock for pkg.
+func completeDsc(pkg string) string {
+	pendingDscMu.Lock()
+	dscPath, ok := pendingDsc[pkg]
+	pendingDscMu.Unlock()
+	if !ok {
+		return ""
+	}
+
+	missing, err := missingFiles(pkg, dscPath)
+	if err != nil {
+		// Let dpkg-source deal with (and report) broken .dsc files.
+		log.Printf("Could not parse %q, unpacking anyway: %v\n", dscPath, err)
+		forgetPendingDsc(pkg)
+		return dscPath
+	}
+	if len(missing) > 0 {
+		log.Printf("Package %s is not complete yet (waiting for %s)\n", pkg, strings.Join(missing, ", "))
+		return ""
+	}
+	forgetPendingDsc(pkg)
+	return dscPath
+}
+
+// Handles POST /import/<pkg>/commit, which clients send once all files of pkg
+// were uploaded. Replies with 409 Conflict if files referenced by the .dsc
+// file are missing, so that the client can upload them and retry. Returns the
+// path of the .dsc file to unpack, or "" on error.
+func commitPackage(w http.ResponseWriter, pkg string) string {
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+
+	pendingDscMu.Lock()
+	dscPath, ok := pendingDsc[pkg]
+	pendingDscMu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("No .dsc file was uploaded for package %s", pkg), http.StatusNotFound)
+		return ""
+	}
+
+	missing, err := missingFiles(pkg, dscPath)
+	if err != nil {
+		log.Printf("Could not parse %q, unpacking anyway: %v\n", dscPath, err)
+	}
+	if len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("Missing files: %s", strings.Join(missing, ", ")), http.StatusConflict)
+		return ""
+	}
+	forgetPendingDsc(pkg)
+	fmt.Fprintf(w, "Package %s enqueued for unpacking.\n", pkg)
+	return dscPath
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/lang"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+type keptFile struct {
+	Path     string
+	Size     int64
+	Language string
+}
+
+type removedFile struct {
+	Path string
+	// Total size of all files within, for directories.
+	Size   int64
+	Reason string
+}
+
+type dryRunReport struct {
+	Package      string
+	Kept         []keptFile
+	Removed      []removedFile
+	KeptBytes    int64
+	RemovedBytes int64
+
+	// Size of the .idx file which would have been created.
+	EstimatedIndexBytes int64
+}
+
+// Unpacks pkg into a scratch directory, applies all filters and indexes the
+// remaining files into a scratch index, but neither touches -unpacked_path nor
+// the uploaded files, so that the package can still be committed afterwards.
+func dryRun(pkg, dscPath string) (*dryRunReport, error) {
+	dir, err := ioutil.TempDir(tmpdir, "dryrun")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if *packageTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *packageTimeout)
+	}
+	defer cancel()
+
+	unpacked := filepath.Join(dir, pkg)
+	cmd := exec.CommandContext(ctx, "dpkg-source", "--no-copy", "--no-check", "-x",
+		filepath.Join(tmpdir, dscPath), unpacked)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("dpkg-source: %v", err)
+	}
+
+	report := &dryRunReport{Package: pkg}
+	remove := func(name string, size int64, reason string) {
+		report.Removed = append(report.Removed, removedFile{name, size, reason})
+		report.RemovedBytes += size
+	}
+	indexPath := filepath.Join(dir, "dryrun.idx")
+	ix := index.Create(indexPath)
+	ix.LongLines = longLines
+	ix.MaxLineLen = *maxLineLength
+	// Symlinks are recreated within the scratch directory as well, so that
+	// nothing ends up in -unpacked_path.
+	walker := newPackageWalker(unpacked, filepath.Join(dir, "output"),
+		func(path, name string, info os.FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if info == nil {
+				return nil
+			}
+			var head []byte
+			if info.Mode().IsRegular() {
+				head = readHead(path)
+			}
+			if f := excludedBy(info, name, head); f != nil {
+				if info.IsDir() {
+					_, size := treeStats(path)
+					remove(name, int64(size), f.Name())
+					return filepath.SkipDir
+				}
+				remove(name, info.Size(), f.Name())
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if !utf8.ValidString(name) {
+				remove(name, info.Size(), "invalid-utf8-name")
+				return nil
+			}
+			language := lang.Detect(name, head)
+			if !languageWanted(language) {
+				remove(name, info.Size(), "language")
+				return nil
+			}
+			if err := ix.AddFile(path, name); err != nil {
+				remove(name, info.Size(), quarantineReason(err))
+				return nil
+			}
+			report.Kept = append(report.Kept, keptFile{name, info.Size(), languageFlagName(language)})
+			report.KeptBytes += info.Size()
+			return nil
+		})
+	err = walker.run(pkg)
+	ix.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	report.EstimatedIndexBytes = info.Size()
+	return report, nil
+}
+
+// Handles POST /import/<pkg>/commit?dryrun=1: replies with a JSON report of
+// which files would be indexed instead of enqueuing the package. Only useful
+// with -implicit_commit=false, since complete packages are enqueued right
+// away otherwise.
+func dryRunPackage(w http.ResponseWriter, pkg string) {
+	// Hold the lock so that the uploaded files do not change while we read
+	// them.
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+
+	pendingDscMu.Lock()
+	dscPath, ok := pendingDsc[pkg]
+	pendingDscMu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("No .dsc file was uploaded for package %s", pkg), http.StatusNotFound)
+		return
+	}
+
+	report, err := dryRun(pkg, dscPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Dry run failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	jsonReply, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("Could not send dry run reply: %v\n", err)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"github.com/Debian/dcs/filter"
+	"github.com/Debian/dcs/varz"
+	"io"
 	"os"
 	"strings"
 )
@@ -21,60 +24,67 @@ var (
 		"conf,dic,cfg,man,xml,xsl,html,sgml,pod,po,txt,tex,rtf,docbook,symbols",
 		"(comma-separated list of) suffixes of files that will be deleted from packages when importing")
 
-	ignoredDirnames  = make(map[string]bool)
-	ignoredFilenames = make(map[string]bool)
-	ignoredSuffixes  = make(map[string]bool)
+	skipBinaryFiles = flag.Bool("skip_binary_files",
+		true,
+		"Delete files whose content does not look like text (e.g. images) when importing, without trying to index them")
+
+	filters filter.Pipeline
 )
 
 func setupFilters() {
-	for _, entry := range strings.Split(*ignoredDirnamesList, ",") {
-		ignoredDirnames[entry] = true
+	filters = filter.Pipeline{
+		filter.Dirnames(filter.Set(*ignoredDirnamesList)),
+		filter.Filenames(filter.Set(*ignoredFilenamesList)),
+		filter.Changelogs{},
+		filter.Manpages{},
+		filter.Suffixes(filter.Set(*ignoredSuffixesList)),
+	}
+	if *skipBinaryFiles {
+		filters = append(filters, filter.Binary{})
 	}
-	for _, entry := range strings.Split(*ignoredFilenamesList, ",") {
-		ignoredFilenames[entry] = true
+	for _, f := range filters {
+		varz.SetLabeled("filtered-files", map[string]string{"filter": f.Name()}, 0)
 	}
-	for _, entry := range strings.Split(*ignoredSuffixesList, ",") {
-		ignoredSuffixes[entry] = true
+}
+
+// Returns the first bytes of the file at path, which are enough to sniff its
+// content type and detect its language.
+func readHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
 	}
+	defer f.Close()
+	head := make([]byte, 4096)
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
 }
 
-// Returns true when the file matches .[0-9]$ (cheaper than a regular
-// expression).
-func hasManpageSuffix(filename string) bool {
-	return len(filename) > 2 &&
-		filename[len(filename)-2] == '.' &&
-		filename[len(filename)-1] >= '0' &&
-		filename[len(filename)-1] <= '9'
+// Returns the filter which excludes a file from being indexed, or nil.
+// name is the path relative to tmpdir/pkg, i.e. starting with the package.
+func excludedBy(info os.FileInfo, name string, head []byte) filter.Filter {
+	idx := strings.Index(name, "/")
+	if idx == -1 {
+		// The package directory itself.
+		return nil
+	}
+	file := &filter.File{
+		Path: name[idx+1:],
+		Info: info,
+	}
+	if !info.IsDir() {
+		file.ContentType = filter.Sniff(head)
+	}
+	return filters.Exclude(file)
 }
 
 // Returns true for files that should not be indexed for various reasons:
 // • generated files
 // • non-source (but text) files, e.g. .doc, .svg, …
-func ignored(info os.FileInfo, dir, filename string) bool {
-	if info.IsDir() {
-		if ignoredDirnames[filename] {
-			return true
-		}
-	} else {
-		// TODO: peek inside the files (we’d have to read them anyways) and
-		// check for messages that indicate that the file is generated. either
-		// by autoconf or by bison for example.
-		if ignoredFilenames[filename] ||
-			// Don’t match /debian/changelog or /debian/README, but
-			// exclude changelog and readme files generally.
-			(!strings.HasSuffix(dir, "/debian/") &&
-				strings.HasPrefix(strings.ToLower(filename), "changelog") ||
-				strings.HasPrefix(strings.ToLower(filename), "readme")) ||
-			hasManpageSuffix(filename) {
-			return true
-		}
-		idx := strings.LastIndex(filename, ".")
-		if idx > -1 {
-			if ignoredSuffixes[filename[idx+1:]] {
-				return true
-			}
-		}
+func ignored(info os.FileInfo, name string, head []byte) bool {
+	if f := excludedBy(info, name, head); f != nil {
+		varz.IncrementLabeled("filtered-files", map[string]string{"filter": f.Name()})
+		return true
 	}
-
 	return false
 }
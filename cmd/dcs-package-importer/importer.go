@@ -2,11 +2,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/Debian/dcs/goroutinez"
 	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/lang"
+	"github.com/Debian/dcs/symbols"
 	"github.com/Debian/dcs/varz"
 	"io"
 	"io/ioutil"
@@ -18,6 +23,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -36,10 +42,74 @@ var (
 		"",
 		"write cpu profile to this file")
 
+	tlsCertPath = flag.String("tls_cert",
+		"",
+		"Path to a PEM-encoded TLS certificate. If specified together with -tls_key, the importer serves HTTPS (and HTTP/2) instead of plain HTTP")
+
+	tlsKeyPath = flag.String("tls_key",
+		"",
+		"Path to the PEM-encoded private key for -tls_cert")
+
+	tlsClientCAPath = flag.String("tls_client_ca",
+		"",
+		"If non-empty, path to a PEM-encoded CA certificate bundle. Clients must present a certificate signed by one of these CAs")
+
+	packageTimeout = flag.Duration("package_timeout",
+		30*time.Minute,
+		"Maximum time for unpacking and indexing a single package. dpkg-source is killed and the package is considered failed once it is exceeded. 0 means unlimited")
+
+	foldCase = flag.Bool("fold_case",
+		false,
+		"Additionally index case-folded trigrams, which speeds up case-insensitive queries. The merged index only has them once all package indexes were built with this flag (see /reindex)")
+
+	normalize = flag.Bool("normalize",
+		false,
+		"Also record the trigrams of the NFC-normalized, lowercased text of each file, so that case-insensitive queries find non-ASCII identifiers regardless of case and Unicode spelling. Like -fold_case, the merged index only has them once all package indexes have them")
+
+	lineOffsets = flag.Bool("line_offsets",
+		false,
+		"Record where each line of a file starts in the index, so that readers can map matches to line numbers without reading the files. Like -fold_case, the merged index only has line offsets once all package indexes have them")
+
+	bloom = flag.Bool("bloom",
+		false,
+		"Record a Bloom filter of the 4-grams of each file in the index, which dcs-index-backend consults to skip files that cannot contain the literals of a query. Like -line_offsets, the merged index only has Bloom filters once all package indexes have them")
+
+	compressShards = flag.Bool("compress_shards",
+		false,
+		"Store the name list and the posting lists of merged shard indexes in zstd-compressed blocks, which makes them considerably smaller at the cost of decompressing blocks on demand in dcs-index-backend (see its -block_cache_size)")
+
+	encryptionKeyID = flag.String("encryption_key_id",
+		"",
+		"If non-empty, encrypt merged shard indexes with the key of this ID (see -index_keys), so that they can be kept on shared storage. dcs-index-backend decrypts them into memory when loading them")
+
+	indexKeys = flag.String("index_keys",
+		"env:DCS_INDEX_KEY",
+		"Where to get the keys for encrypting and decrypting shard indexes: env:NAME (hex-encoded key in an environment variable), file:PATH (hex-encoded key in a file) or exec:PATH (a program which is run with the key ID as argument and prints the hex-encoded key, e.g. to ask a key management service)")
+
+	dedup = flag.Bool("dedup",
+		false,
+		"Record a hash of the contents of each file, so that files which many packages ship (m4 macros, bundled libraries) are indexed only once per package index and per merged shard. Queries still return all copies; dcs-source-backend greps only one of them")
+
+	longLinesPolicy = flag.String("long_lines",
+		"skip_file",
+		"What to do with files containing lines longer than -max_line_length bytes (minified JavaScript, generated tables): skip_file leaves them out of the index, truncate indexes them completely (set dcs-source-backend -long_lines=truncate to keep their snippets short), skip_lines indexes only the beginning of long lines (set dcs-source-backend -long_lines=skip_lines to not report matches in them)")
+
+	maxLineLength = flag.Int("max_line_length",
+		2000,
+		"Length (in bytes) above which a line is considered long, see -long_lines")
+
+	indexMemory = flag.Int64("index_memory",
+		128,
+		"Memory (in MiB) the index writer may use for buffering trigrams of a single package before spilling them to temporary files. Lower it when importing packages with hundreds of thousands of files on small machines")
+
+	// Parsed -long_lines.
+	longLines index.LongLinePolicy
+
 	tmpdir string
 
 	indexQueue chan string
-	mergeQueue chan bool
+	// Shard numbers to merge, or -1 to merge all shards.
+	mergeQueue chan int
 )
 
 // Accepts arbitrary files for a given package and starts unpacking once a .dsc
@@ -52,8 +122,13 @@ var (
 // curl -X PUT --data-binary @i3-wm_4.7.2-1.dsc \
 //     http://localhost:21010/import/i3-wm_4.7.2-1/i3-wm_4.7.2-1.dsc
 //
-// All the files are stored in the same directory and after the .dsc is stored,
-// the package is unpacked with dpkg-source, then indexed.
+// All the files are stored in the same directory and after the .dsc and all
+// files it references are stored, the package is unpacked with dpkg-source,
+// then indexed. With -implicit_commit=false, unpacking only starts after
+//
+// curl -X POST http://localhost:21010/import/i3-wm_4.7.2-1/commit
+//
+// and ?dryrun=1 returns a report of what would be indexed instead.
 func importPackage(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -61,42 +136,123 @@ func importPackage(w http.ResponseWriter, r *http.Request) {
 	pkg := filepath.Dir(path)
 	filename := filepath.Base(path)
 
+	var dscPath string
+	if r.Method == "POST" && filename == "commit" {
+		if r.FormValue("dryrun") == "1" {
+			dryRunPackage(w, pkg)
+			return
+		}
+		dscPath = commitPackage(w, pkg)
+	} else {
+		dscPath = receiveFile(w, r, pkg, path, filename)
+	}
+	if dscPath != "" {
+		setQueued(pkg, true)
+		varz.Increment("importer-index-queue-depth")
+		indexQueue <- dscPath
+	}
+}
+
+// Stores the uploaded file and returns the path of the .dsc file to unpack if
+// the package is complete now.
+func receiveFile(w http.ResponseWriter, r *http.Request, pkg, path, filename string) string {
+	// Uploads for the same package are serialized so that the completeness
+	// check sees all files which were uploaded before.
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+
+	if *maxUploadBytes > 0 && r.ContentLength > *maxUploadBytes {
+		http.Error(w, fmt.Sprintf("File too large (limit: %d bytes)", *maxUploadBytes), http.StatusRequestEntityTooLarge)
+		varz.Increment("rejected-package-imports")
+		countFailure("upload-rejected")
+		return ""
+	}
+
+	// If the size is not known in advance, the upload is accounted once it is
+	// complete, so the limit may be exceeded slightly.
+	reserved := r.ContentLength
+	if reserved < 0 {
+		reserved = 0
+	}
+	if !reserveTmp(pkg, reserved) {
+		http.Error(w, fmt.Sprintf("Temporary storage full (limit: %d bytes)", *maxTmpBytes), http.StatusInsufficientStorage)
+		varz.Increment("rejected-package-imports")
+		countFailure("upload-rejected")
+		return ""
+	}
+
 	err := os.Mkdir(filepath.Join(tmpdir, pkg), 0755)
 	if err != nil && !os.IsExist(err) {
+		reserveTmp(pkg, -reserved)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		varz.Increment("failed-package-imports")
-		return
+		countFailure("upload")
+		return ""
 	}
 
 	file, err := os.Create(filepath.Join(tmpdir, path))
 	if err != nil {
+		reserveTmp(pkg, -reserved)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		varz.Increment("failed-package-imports")
-		return
+		countFailure("upload")
+		return ""
 	}
 	defer file.Close()
-	written, err := io.Copy(file, r.Body)
+	var body io.Reader = r.Body
+	if *maxUploadBytes > 0 {
+		body = io.LimitReader(r.Body, *maxUploadBytes+1)
+	}
+	written, err := io.Copy(file, body)
+	reserveTmp(pkg, written-reserved)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		varz.Increment("failed-package-imports")
-		return
+		countFailure("upload")
+		return ""
+	}
+	if *maxUploadBytes > 0 && written > *maxUploadBytes {
+		os.Remove(file.Name())
+		reserveTmp(pkg, -written)
+		http.Error(w, fmt.Sprintf("File too large (limit: %d bytes)", *maxUploadBytes), http.StatusRequestEntityTooLarge)
+		varz.Increment("rejected-package-imports")
+		countFailure("upload-rejected")
+		return ""
 	}
 	log.Printf("Wrote %d bytes into %s\n", written, path)
 
 	fmt.Fprintf(w, "thank you for sending file %s for package %s!\n", filename, pkg)
-	if strings.HasSuffix(filename, ".dsc") {
-		indexQueue <- path
-	}
 
 	varz.Increment("successful-package-imports")
+	varz.Increment("importer-imported-files")
+	varz.IncrementBy("importer-received-bytes", uint64(written))
+
+	if strings.HasSuffix(filename, ".dsc") {
+		setPendingDsc(pkg, path)
+	}
+	if !*implicitCommit {
+		return ""
+	}
+	return completeDsc(pkg)
 }
 
-// Tries to start a merge and errors in case one is already in progress.
+// Tries to start a merge and errors in case one is already in progress. With
+// ?shard=<n>, only the packages belonging to that shard are merged.
 func mergeOrError(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	shard := -1
+	if value := r.FormValue("shard"); value != "" {
+		var err error
+		shard, err = strconv.Atoi(value)
+		if err != nil || shard < 0 || shard >= *numShards {
+			http.Error(w, fmt.Sprintf("Invalid shard %q, must be in [0, %d)", value, *numShards), http.StatusBadRequest)
+			return
+		}
+	}
+
 	select {
-	case mergeQueue <- true:
+	case mergeQueue <- shard:
 		fmt.Fprintf(w, "Merge started.")
 	default:
 		http.Error(w, "Merge already in progress, please try again later.", http.StatusInternalServerError)
@@ -135,7 +291,7 @@ func listPackages(w http.ResponseWriter, r *http.Request) {
 	var reply ListPackageReply
 	reply.Packages = make([]string, 0, len(names))
 	for _, name := range names {
-		if strings.HasSuffix(name, ".idx") && name != "full.idx" {
+		if strings.HasSuffix(name, ".idx") && !isShardIndex(name) {
 			reply.Packages = append(reply.Packages, name[:len(name)-len(".idx")])
 		}
 	}
@@ -160,6 +316,11 @@ func garbageCollect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Waits for indexing or reindexing pkg to finish, so that they do not
+	// write its files again after they were removed.
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+
 	names := packageNames()
 	found := false
 	for _, name := range names {
@@ -188,24 +349,42 @@ func garbageCollect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Could not garbage collect package index for %q: %v", pkg, err), http.StatusInternalServerError)
 		return
 	}
+	// Only exists if the package was indexed with -ctags.
+	os.Remove(filepath.Join(*unpackedPath, pkg+".sym"))
+
+	tombstonePackage(pkg)
 
 	varz.Increment("successful-garbage-collects")
 }
 
-// Merges all packages in *unpackedPath into a big index shard.
-func mergeToShard() {
+// Merges all packages in *unpackedPath which belong to shard into a big index
+// shard.
+func mergeToShard(shard int) {
 	names := packageNames()
 	indexFiles := make([]string, 0, len(names))
 	for _, name := range names {
-		if strings.HasSuffix(name, ".idx") && name != "full.idx" {
-			indexFiles = append(indexFiles, filepath.Join(*unpackedPath, name))
+		if !strings.HasSuffix(name, ".idx") || isShardIndex(name) {
+			continue
 		}
+		if shardForPackage(strings.TrimSuffix(name, ".idx")) != shard {
+			continue
+		}
+		indexFiles = append(indexFiles, filepath.Join(*unpackedPath, name))
+	}
+
+	if *numShards == 1 {
+		varz.Set("index-files", uint64(len(indexFiles)))
+	} else {
+		varz.SetLabeled("index-files", map[string]string{"shard": strconv.Itoa(shard)}, uint64(len(indexFiles)))
 	}
 
-	varz.Set("index-files", uint64(len(indexFiles)))
+	if *incrementalMerge {
+		mergeSegments(shard, indexFiles)
+		return
+	}
 
-	log.Printf("Got %d index files\n", len(indexFiles))
-	if len(indexFiles) == 1 {
+	log.Printf("Got %d index files for shard %d\n", len(indexFiles), shard)
+	if len(indexFiles) <= 1 {
 		return
 	}
 	tmpIndexPath, err := ioutil.TempFile(*unpackedPath, "newshard")
@@ -226,7 +405,9 @@ func mergeToShard() {
 	t0 := time.Now()
 	index.ConcatN(tmpIndexPath.Name(), indexFiles...)
 	t1 := time.Now()
+	mergeDuration.ObserveSince(t0)
 	log.Printf("merged in %v\n", t1.Sub(t0))
+	mergeSymbols(tmpIndexPath.Name(), indexFiles)
 	//for i := 1; i < len(indexFiles); i++ {
 	//	log.Printf("merging %s with %s\n", indexFiles[i-1], indexFiles[i])
 	//	t0 := time.Now()
@@ -236,20 +417,44 @@ func mergeToShard() {
 	//}
 	log.Printf("merged into shard %s\n", tmpIndexPath.Name())
 
+	if *compressShards {
+		t0 := time.Now()
+		compressedPath := tmpIndexPath.Name() + ".compressed"
+		index.Compress(compressedPath, tmpIndexPath.Name())
+		if err := os.Rename(compressedPath, tmpIndexPath.Name()); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("compressed in %v\n", time.Since(t0))
+	}
+
+	if *encryptionKeyID != "" {
+		t0 := time.Now()
+		encryptedPath := tmpIndexPath.Name() + ".encrypted"
+		if err := index.Encrypt(encryptedPath, tmpIndexPath.Name(), *encryptionKeyID); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Rename(encryptedPath, tmpIndexPath.Name()); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("encrypted in %v\n", time.Since(t0))
+	}
+
 	// If full.idx does not exist (i.e. on initial deployment), just move the
 	// new index to full.idx, the dcs-index-backend will not be running anyway.
-	fullIdxPath := filepath.Join(*unpackedPath, "full.idx")
+	fullIdxPath := filepath.Join(*unpackedPath, shardIndexName(shard))
 	if _, err := os.Stat(fullIdxPath); os.IsNotExist(err) {
 		if err := os.Rename(tmpIndexPath.Name(), fullIdxPath); err != nil {
 			log.Fatal(err)
 		}
+		os.Rename(symbols.FileFor(tmpIndexPath.Name()), symbols.FileFor(fullIdxPath))
 		return
 	}
 
 	varz.Increment("successful-merges")
+	varz.Increment("importer-merges")
 
 	// Replace the current index with the newly created index.
-	resp, err := http.Get(fmt.Sprintf("http://localhost:28081/replace?shard=%s", filepath.Base(tmpIndexPath.Name())))
+	resp, err := http.Get(fmt.Sprintf("http://%s/replace?shard=%s", indexBackends[shard], filepath.Base(tmpIndexPath.Name())))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -261,7 +466,18 @@ func mergeToShard() {
 	}
 }
 
-func indexPackage(pkg string) {
+// Returned by indexPackage if indexing a package made the indexer panic.
+type indexPanic struct {
+	value interface{}
+}
+
+func (p indexPanic) Error() string {
+	return fmt.Sprintf("indexer panicked: %v", p.value)
+}
+
+// Indexing stops (between two files) with an error once ctx is done.
+func indexPackage(ctx context.Context, pkg string) (err error) {
+	defer indexDuration.ObserveSince(time.Now())
 	log.Printf("Indexing %s\n", pkg)
 	unpacked := filepath.Join(tmpdir, pkg, pkg)
 	if err := os.MkdirAll(*unpackedPath, os.FileMode(0755)); err != nil {
@@ -272,29 +488,60 @@ func indexPackage(pkg string) {
 	// time. If we don’t do that, merges will try to use incomplete index
 	// files, which are interpreted as corrupted.
 	tmpIndexPath := filepath.Join(*unpackedPath, pkg+".tmp")
+
+	// A package which makes the indexer panic should not take down the
+	// entire importer. Clean up what was written so far, the caller moves
+	// the package into the quarantine directory so that it can be looked at
+	// later.
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		os.Remove(tmpIndexPath)
+		os.RemoveAll(filepath.Join(*unpackedPath, pkg))
+		err = indexPanic{r}
+	}()
+
 	index := index.Create(tmpIndexPath)
-	// +1 because of the / that should not be included in the index.
-	stripLen := len(filepath.Join(tmpdir, pkg)) + 1
-
-	filepath.Walk(unpacked,
-		func(path string, info os.FileInfo, err error) error {
-			if dir, filename := filepath.Split(path); filename != "" {
-				skip := ignored(info, dir, filename)
-				if skip && info.IsDir() {
+	index.FoldCase = *foldCase
+	index.Normalize = *normalize
+	index.LineOffsets = *lineOffsets
+	index.Bloom = *bloom
+	index.MaxMemory = *indexMemory << 20
+	index.LongLines = longLines
+	index.MaxLineLen = *maxLineLength
+	index.Dedup = *dedup
+	languages := make(map[string]string)
+
+	// name is the path relative to tmpdir/pkg, i.e. what ends up in the index.
+	// It differs from path for files which are reached via symlinks.
+	walker := newPackageWalker(unpacked, *unpackedPath,
+		func(path, name string, info os.FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if info == nil {
+				return nil
+			}
+			var head []byte
+			if info.Mode().IsRegular() {
+				head = readHead(path)
+			}
+			if ignored(info, name, head) {
+				if info.IsDir() {
 					if err := os.RemoveAll(path); err != nil {
 						log.Fatalf("Could not remove directory %q: %v\n", path, err)
 					}
 					return filepath.SkipDir
 				}
-				if skip && !info.IsDir() {
-					if err := os.Remove(path); err != nil {
-						log.Fatalf("Could not remove file %q: %v\n", path, err)
-					}
-					return nil
+				if err := os.Remove(path); err != nil {
+					log.Fatalf("Could not remove file %q: %v\n", path, err)
 				}
+				return nil
 			}
 
-			if info == nil || !info.Mode().IsRegular() {
+			if !info.Mode().IsRegular() {
 				return nil
 			}
 
@@ -302,18 +549,31 @@ func indexPackage(pkg string) {
 			// "xblast-tnt-levels_20050106-2/reconstruct\xeeon2.xal") contain
 			// invalid UTF-8 and will break when sending them via JSON later
 			// on. Filter those out early to avoid breakage.
-			if !utf8.ValidString(path) {
+			if !utf8.ValidString(name) {
 				log.Printf("Skipping due to invalid UTF-8: %s\n", path)
 				return nil
 			}
 
-			if err := index.AddFile(path, path[stripLen:]); err != nil {
+			language := lang.Detect(name, head)
+			if !languageWanted(language) {
+				if err := os.Remove(path); err != nil {
+					log.Fatalf("Could not remove file %q: %v\n", path, err)
+				}
+				return nil
+			}
+
+			if err := index.AddFileMeta(path, name, fileMeta(language)); err != nil {
+				if quarantineFile(pkg, path, name, err) {
+					return nil
+				}
 				if err := os.Remove(path); err != nil {
 					log.Fatalf("Could not remove file %q: %v\n", path, err)
 				}
 			} else {
+				languages[name] = language
+
 				// Copy this file out of /tmp to our unpacked directory.
-				outputPath := filepath.Join(*unpackedPath, path[stripLen:])
+				outputPath := filepath.Join(*unpackedPath, name)
 				if err := os.MkdirAll(filepath.Dir(outputPath), os.FileMode(0755)); err != nil {
 					log.Fatalf("Could not create directory: %v\n", err)
 				}
@@ -333,14 +593,32 @@ func indexPackage(pkg string) {
 			}
 			return nil
 		})
+	if err := walker.run(pkg); err != nil {
+		index.Flush()
+		os.Remove(tmpIndexPath)
+		os.RemoveAll(filepath.Join(*unpackedPath, pkg))
+		return err
+	}
 
 	index.Flush()
 
+	if err := writeLanguages(pkg, languages); err != nil {
+		log.Printf("Could not write languages of %s: %v\n", pkg, err)
+	}
+	names := make([]string, 0, len(languages))
+	for name := range languages {
+		names = append(names, name)
+	}
+	writeSymbols(ctx, pkg, names)
+
 	finalIndexPath := filepath.Join(*unpackedPath, pkg+".idx")
 	if err := os.Rename(tmpIndexPath, finalIndexPath); err != nil {
 		log.Fatal(err)
 	}
 	varz.Increment("successful-package-indexes")
+	varz.Increment("importer-indexed-packages")
+	packageIndexed(pkg)
+	return nil
 }
 
 // This goroutine reads package names from the indexQueue channel, unpacks the
@@ -350,29 +628,79 @@ func indexPackage(pkg string) {
 func unpackAndIndex() {
 	for {
 		dscPath := <-indexQueue
-		pkg := filepath.Dir(dscPath)
-		log.Printf("Unpacking %s\n", pkg)
-		unpacked := filepath.Join(tmpdir, pkg, pkg)
+		varz.Decrement("importer-index-queue-depth")
+		unpackAndIndexPackage(dscPath)
+	}
+}
 
-		// Delete previous attempts, if any.
-		if err := os.RemoveAll(unpacked); err != nil {
-			log.Printf("removing unpacked dir: %v\n", err)
-		}
+// Unpacks and indexes the package of dscPath. The package is locked until its
+// uploaded files are cleaned up, so that uploads of the same package wait for
+// it instead of having their files removed.
+func unpackAndIndexPackage(dscPath string) {
+	pkg := filepath.Dir(dscPath)
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+	defer setQueued(pkg, false)
 
-		cmd := exec.Command("dpkg-source", "--no-copy", "--no-check", "-x",
-			filepath.Join(tmpdir, dscPath), unpacked)
-		// Just display dpkg-source’s stderr in our process’s stderr.
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			log.Printf("Skipping package %s: %v\n", pkg, err)
-			varz.Increment("failed-dpkg-source-extracts")
-			continue
+	log.Printf("Unpacking %s\n", pkg)
+	unpacked := filepath.Join(tmpdir, pkg, pkg)
+
+	// Delete previous attempts, if any.
+	if err := os.RemoveAll(unpacked); err != nil {
+		log.Printf("removing unpacked dir: %v\n", err)
+	}
+
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if *packageTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *packageTimeout)
+	}
+	defer cancel()
+
+	// CommandContext kills dpkg-source once ctx is done.
+	cmd := exec.CommandContext(ctx, "dpkg-source", "--no-copy", "--no-check", "-x",
+		filepath.Join(tmpdir, dscPath), unpacked)
+	// Just display dpkg-source’s stderr in our process’s stderr.
+	cmd.Stderr = os.Stderr
+	unpackStarted := time.Now()
+	err := cmd.Run()
+	unpackDuration.ObserveSince(unpackStarted)
+	if err != nil {
+		reason := "dpkg-source"
+		if ctx.Err() != nil {
+			reason = "timeout"
+			err = fmt.Errorf("unpacking did not finish within %v", *packageTimeout)
+			varz.Increment("timed-out-packages")
 		}
+		log.Printf("Skipping package %s: %v\n", pkg, err)
+		varz.Increment("failed-dpkg-source-extracts")
+		countFailure("unpack")
+		quarantinePackage(pkg, reason, err.Error())
+		return
+	}
 
-		varz.Increment("successful-dpkg-source-extracts")
-		indexPackage(pkg)
-		os.RemoveAll(filepath.Join(tmpdir, pkg))
+	varz.Increment("successful-dpkg-source-extracts")
+	err = indexPackage(ctx, pkg)
+	timedOut := ctx.Err() != nil
+	if err != nil {
+		reason, detail := "index", err.Error()
+		if p, ok := err.(indexPanic); ok {
+			reason, detail = "panic", fmt.Sprintf("%v", p.value)
+		} else if timedOut {
+			reason, detail = "timeout", fmt.Sprintf("indexing did not finish within %v", *packageTimeout)
+			varz.Increment("timed-out-packages")
+		}
+		log.Printf("Indexing %s failed, skipping: %s\n", pkg, detail)
+		varz.Increment("failed-package-indexes")
+		countFailure("index")
+		quarantinePackage(pkg, reason, detail)
+	} else {
+		if err := writeVcs(pkg, filepath.Join(tmpdir, dscPath)); err != nil {
+			log.Printf("Could not write the Vcs fields of %s: %v\n", pkg, err)
+		}
+		keepOrig(pkg)
 	}
+	os.RemoveAll(filepath.Join(tmpdir, pkg))
+	releaseTmp(pkg)
 }
 
 func main() {
@@ -383,39 +711,125 @@ func main() {
 
 	varz.Set("failed-dpkg-source-extracts", 0)
 	varz.Set("failed-package-imports", 0)
+	varz.Set("failed-package-indexes", 0)
+	varz.Set("importer-imported-files", 0)
+	varz.Set("importer-indexed-packages", 0)
+	varz.Set("importer-merges", 0)
+	varz.Set("importer-received-bytes", 0)
+	for _, stage := range failureStages {
+		varz.SetLabeled("importer-failures", map[string]string{"stage": stage}, 0)
+	}
+	varz.SetGauge("importer-index-queue-depth", 0)
+	varz.Set("failed-orig-stores", 0)
+	varz.Set("timed-out-packages", 0)
+	varz.Set("orig-store-bytes", 0)
+	varz.Set("rejected-package-imports", 0)
+	varz.Set("quarantined-files", 0)
+	varz.Set("quarantined-packages", 0)
 	varz.Set("successful-dpkg-source-extracts", 0)
+	varz.Set("successful-compactions", 0)
 	varz.Set("successful-garbage-collects", 0)
 	varz.Set("successful-merges", 0)
 	varz.Set("successful-package-imports", 0)
 	varz.Set("successful-package-indexes", 0)
+	varz.Set("tmp-janitor-reclaimed-bytes", 0)
+	varz.Set("tmp-janitor-removed-dirs", 0)
+	varz.Set("tmp-bytes-used", 0)
+	varz.Set("tmp-bytes-limit", uint64(*maxTmpBytes))
+	varz.Set("upload-bytes-limit", uint64(*maxUploadBytes))
 
+	setupShards()
 	setupFilters()
+	setupQuarantine()
+	setupLanguages()
+	switch *symlinkPolicy {
+	case "skip", "follow-within-package", "record-as-link":
+	default:
+		log.Fatalf("Invalid -symlink_policy %q\n", *symlinkPolicy)
+	}
 
 	var err error
+	if longLines, err = index.ParseLongLinePolicy(*longLinesPolicy); err != nil {
+		log.Fatalf("Invalid -long_lines: %v\n", err)
+	}
+	keys, err := index.ParseKeySource(*indexKeys)
+	if err != nil {
+		log.Fatalf("Invalid -index_keys: %v\n", err)
+	}
+	index.SetKeySource(keys)
 	tmpdir, err = ioutil.TempDir("", "dcs-importer")
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	indexQueue = make(chan string)
-	mergeQueue = make(chan bool)
+	mergeQueue = make(chan int)
+	compactQueue = make(chan int, *numShards)
 
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go unpackAndIndex()
 	}
 
+	if *tmpMaxAge > 0 {
+		go tmpJanitor()
+	}
+
+	if *incrementalMerge {
+		go compactor()
+		// Segments appended by a previous run may be due for compaction.
+		for shard := 0; shard < *numShards; shard++ {
+			triggerCompaction(shard)
+		}
+	}
+
 	go func() {
-		for _ = range mergeQueue {
-			mergeToShard()
+		for shard := range mergeQueue {
+			if shard != -1 {
+				mergeToShard(shard)
+				continue
+			}
+			for shard := 0; shard < *numShards; shard++ {
+				mergeToShard(shard)
+			}
 		}
 	}()
 
 	http.HandleFunc("/import/", importPackage)
 	http.HandleFunc("/merge", mergeOrError)
+	http.HandleFunc("/reindex", reindex)
 	http.HandleFunc("/listpkgs", listPackages)
 	http.HandleFunc("/garbagecollect", garbageCollect)
+	http.HandleFunc("/quarantine", listQuarantine)
+	http.HandleFunc("/statusz", statusz)
+	http.HandleFunc("/compaction", compactionStatus)
+	http.HandleFunc("/indexstats", indexStats)
+	http.HandleFunc("/metrics", varz.PrometheusHandler)
+	http.HandleFunc("/orig/", serveOrig)
 	http.HandleFunc("/varz", varz.Varz)
 	http.HandleFunc("/goroutinez", goroutinez.Goroutinez)
 
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	if *tlsCertPath == "" && *tlsKeyPath == "" {
+		log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	}
+	if *tlsCertPath == "" || *tlsKeyPath == "" {
+		log.Fatal("-tls_cert and -tls_key need to be specified together")
+	}
+
+	server := &http.Server{
+		Addr:      *listenAddress,
+		TLSConfig: &tls.Config{},
+	}
+	if *tlsClientCAPath != "" {
+		pem, err := ioutil.ReadFile(*tlsClientCAPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %q\n", *tlsClientCAPath)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Fatal(server.ListenAndServeTLS(*tlsCertPath, *tlsKeyPath))
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Returns the statistics of the merged index of shard: one entry per segment
+// with -incremental_merge, otherwise one entry for the shard index, or none
+// if it was not merged yet.
+func shardStats(shard, top int) ([]index.Stats, error) {
+	if *incrementalMerge {
+		manifestMu.Lock()
+		s, err := index.OpenSegments(segmentsDir(shard))
+		manifestMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		defer s.Close()
+		return s.Stats(top), nil
+	}
+
+	path := filepath.Join(*unpackedPath, shardIndexName(shard))
+	if _, err := index.ReadHeader(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ix := index.Open(path)
+	defer ix.Close()
+	return []index.Stats{ix.Stats(top)}, nil
+}
+
+// Reports the statistics (file and trigram counts, most frequent trigrams,
+// sizes of the parts) of the index of each shard as JSON. The top= parameter
+// sets the number of most frequent trigrams to include (default 50).
+func indexStats(w http.ResponseWriter, r *http.Request) {
+	top := 50
+	if value := r.FormValue("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid top= parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	type Shard struct {
+		Shard int
+		Stats []index.Stats
+	}
+	reply := make([]Shard, *numShards)
+	for shard := range reply {
+		stats, err := shardStats(shard, top)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reply[shard] = Shard{Shard: shard, Stats: stats}
+	}
+
+	jsonReply, err := json.Marshal(&reply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("Could not send index stats: %v\n", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"github.com/Debian/dcs/varz"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	tmpMaxAge = flag.Duration("tmp_max_age",
+		24*time.Hour,
+		"Per-package temporary directories (e.g. from aborted uploads or crashed unpacks) which were not modified for this long are deleted, unless the package is waiting to be unpacked or committed. 0 disables the janitor")
+
+	tmpJanitorInterval = flag.Duration("tmp_janitor_interval",
+		1*time.Hour,
+		"How often to look for stale temporary directories")
+)
+
+// Returns the most recent modification time of any file within dir and the
+// total size of all files.
+func treeStats(dir string) (newest time.Time, size uint64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return newest, size
+}
+
+// Deletes dir if nothing within it was modified for *tmpMaxAge. Returns true
+// if dir was deleted.
+func removeIfStale(dir string) bool {
+	newest, size := treeStats(dir)
+	if time.Since(newest) < *tmpMaxAge {
+		return false
+	}
+	log.Printf("Removing stale temporary directory %q (%d bytes, last modified %v)\n", dir, size, newest)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Could not remove %q: %v\n", dir, err)
+		return false
+	}
+	varz.Increment("tmp-janitor-removed-dirs")
+	varz.IncrementBy("tmp-janitor-reclaimed-bytes", size)
+	return true
+}
+
+// Removes the directory of pkg within our tmpdir if it is stale. Packages
+// which are waiting to be unpacked or committed are left alone, and the
+// package is locked so that it is not removed while it is being uploaded or
+// unpacked.
+func cleanPackageTmp(pkg string) {
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+	if queuedOrPending(pkg) {
+		return
+	}
+	if removeIfStale(filepath.Join(tmpdir, pkg)) {
+		releaseTmp(pkg)
+	}
+}
+
+// Removes stale per-package directories within our tmpdir, plus the tmpdirs
+// left behind by previous (crashed) importer processes.
+func cleanTmp() {
+	entries, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		log.Printf("Could not read %q: %v\n", tmpdir, err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			cleanPackageTmp(entry.Name())
+		}
+	}
+
+	parent := filepath.Dir(tmpdir)
+	entries, err = ioutil.ReadDir(parent)
+	if err != nil {
+		log.Printf("Could not read %q: %v\n", parent, err)
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(parent, entry.Name())
+		if !entry.IsDir() ||
+			!strings.HasPrefix(entry.Name(), "dcs-importer") ||
+			path == tmpdir {
+			continue
+		}
+		removeIfStale(path)
+	}
+}
+
+func tmpJanitor() {
+	for {
+		cleanTmp()
+		time.Sleep(*tmpJanitorInterval)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/lang"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	indexLanguagesList = flag.String("index_languages",
+		"",
+		"If non-empty, (comma-separated list of) languages to index (e.g. “c,c++,python”). Files in other languages are deleted when importing. Use “unknown” for files whose language cannot be detected")
+
+	skipLanguagesList = flag.String("skip_languages",
+		"",
+		"(comma-separated list of) languages whose files are deleted when importing. Use “unknown” for files whose language cannot be detected")
+
+	indexLanguages = make(map[string]bool)
+	skipLanguages  = make(map[string]bool)
+)
+
+// Name of the file within every unpacked package which lists the detected
+// language of each file.
+const languagesFilename = ".dcs-languages"
+
+func languageFlagName(language string) string {
+	if language == lang.Unknown {
+		return "unknown"
+	}
+	return language
+}
+
+func setupLanguages() {
+	for _, entry := range strings.Split(*indexLanguagesList, ",") {
+		if entry != "" {
+			indexLanguages[entry] = true
+		}
+	}
+	for _, entry := range strings.Split(*skipLanguagesList, ",") {
+		if entry != "" {
+			skipLanguages[entry] = true
+		}
+	}
+}
+
+// Returns true if files in language should be indexed according to
+// -index_languages and -skip_languages.
+func languageWanted(language string) bool {
+	name := languageFlagName(language)
+	if len(indexLanguages) > 0 && !indexLanguages[name] {
+		return false
+	}
+	return !skipLanguages[name]
+}
+
+// Returns the metadata to store in the index for a file in language.
+func fileMeta(language string) index.FileMeta {
+	return index.FileMeta{Language: languageFlagName(language)}
+}
+
+// Writes the detected languages (indexed by the name of each file) into the
+// unpacked package directory.
+func writeLanguages(pkg string, languages map[string]string) error {
+	names := make([]string, 0, len(languages))
+	for name := range languages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dir := filepath.Join(*unpackedPath, pkg)
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, languagesFilename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", languageFlagName(languages[name]), name)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/Debian/dcs/varz"
+)
+
+// /metrics is served by varz, which exports e.g. the counter
+// “importer-imported-files” as dcs_importer_imported_files_total. The
+// importer-* variables keep the names under which the importer exported its
+// metrics before, so that existing dashboards and alerts keep working.
+
+var (
+	// Durations, which /varz also offers percentiles of. Merges of all
+	// package indexes take much longer than the handling of a package.
+	unpackDuration = varz.NewHistogram("importer-unpack-duration-seconds", varz.DurationBuckets)
+	indexDuration  = varz.NewHistogram("importer-index-duration-seconds", varz.DurationBuckets)
+	mergeDuration  = varz.NewHistogram("importer-merge-duration-seconds", []float64{10, 30, 60, 300, 600, 1800, 3600, 7200, 14400})
+)
+
+// The stages in which dcs_importer_failures_total counts failures.
+var failureStages = []string{"upload", "upload-rejected", "unpack", "index"}
+
+// Counts a failure in the given stage (one of failureStages), exported as
+// dcs_importer_failures_total{stage="…"}.
+func countFailure(stage string) {
+	varz.IncrementLabeled("importer-failures", map[string]string{"stage": stage})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/varz"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	origStorePath = flag.String("orig_store_path",
+		"",
+		"If non-empty, the uploaded .dsc files and tarballs are kept in this directory after unpacking, named by their SHA-256 hash, so that the shard can be rebuilt without downloading from the archive. Served at /orig/<hash>")
+)
+
+// Returns the path of the object with the given hex-encoded SHA-256 hash.
+// Objects are spread over 256 directories to keep directory sizes reasonable.
+func origObjectPath(hash string) string {
+	return filepath.Join(*origStorePath, hash[:2], hash)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Moves the uploaded files of pkg (but not the unpacked sources) from tmpdir
+// into the store and writes <orig_store_path>/packages/<pkg>, which lists
+// “<hash> <filename>” for each of them. Files which are already stored (e.g.
+// an .orig.tar.gz shared between Debian revisions) are not duplicated.
+func storeOrig(pkg string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(tmpdir, pkg))
+	if os.IsNotExist(err) {
+		// The package was quarantined while indexing.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var manifest []string
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(tmpdir, pkg, entry.Name())
+		hash, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, hash+" "+entry.Name())
+
+		dst := origObjectPath(hash)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		// Move to a temporary name first so that /orig/ never serves
+		// partially copied files. The name is unique, as packages which
+		// share a file may be stored at the same time.
+		if err := os.MkdirAll(filepath.Dir(dst), os.FileMode(0755)); err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(dst), hash+".tmp")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		if err := moveAll(path, tmp.Name()); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		// Unlike renaming, linking fails if another package stored the
+		// file in the meantime.
+		err = os.Link(tmp.Name(), dst)
+		os.Remove(tmp.Name())
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		varz.IncrementBy("orig-store-bytes", uint64(entry.Size()))
+	}
+	sort.Strings(manifest)
+
+	manifestPath := filepath.Join(*origStorePath, "packages", pkg)
+	if err := os.MkdirAll(filepath.Dir(manifestPath), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestPath, []byte(strings.Join(manifest, "\n")+"\n"), 0644)
+}
+
+func isSHA256(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// Serves /orig/<hash> from the store and /orig/packages/<pkg> (the list of
+// files belonging to pkg).
+func serveOrig(w http.ResponseWriter, r *http.Request) {
+	if *origStorePath == "" {
+		http.Error(w, "Original sources are not kept, see -orig_store_path", http.StatusNotFound)
+		return
+	}
+	name := r.URL.Path[len("/orig/"):]
+	if strings.HasPrefix(name, "packages/") {
+		pkg := name[len("packages/"):]
+		if pkg == "" || strings.Contains(pkg, "/") || strings.HasPrefix(pkg, ".") {
+			http.Error(w, "Invalid package name", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, filepath.Join(*origStorePath, "packages", pkg))
+		return
+	}
+	if !isSHA256(name) {
+		http.Error(w, fmt.Sprintf("%q is not a hex-encoded SHA-256 hash", name), http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(origObjectPath(strings.ToLower(name)))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// Content never changes for a given hash.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// Logs (but otherwise ignores) errors: the package was indexed successfully,
+// so failing to keep its sources is not a reason to drop it.
+func keepOrig(pkg string) {
+	if *origStorePath == "" {
+		return
+	}
+	if err := storeOrig(pkg); err != nil {
+		log.Printf("Could not store original sources of %s: %v\n", pkg, err)
+		varz.Increment("failed-orig-stores")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/varz"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	quarantinePath = flag.String("quarantine_path",
+		"",
+		"If non-empty, files which cannot be indexed and packages which break indexing are moved into this directory instead of being deleted")
+
+	quarantineReasonsList = flag.String("quarantine_reasons",
+		"too-long,long-lines,too-many-trigrams,read-error,panic,dpkg-source,timeout,index",
+		"(comma-separated list of) reasons for which files are quarantined. invalid-utf8 is not included by default because it matches virtually every binary file")
+
+	quarantineReasons = make(map[string]bool)
+
+	// Guards the reasons.json files within *quarantinePath.
+	quarantineMu sync.Mutex
+)
+
+// A quarantineEntry describes why a file (or an entire package, in which case
+// Path is empty) was moved into the quarantine directory.
+type quarantineEntry struct {
+	Package string
+	Path    string
+	Reason  string
+	Detail  string
+	Time    time.Time
+}
+
+func setupQuarantine() {
+	for _, entry := range strings.Split(*quarantineReasonsList, ",") {
+		quarantineReasons[entry] = true
+	}
+}
+
+// Translates an error returned by index.AddFile into a machine-readable
+// reason.
+func quarantineReason(err error) string {
+	switch err {
+	case index.ErrInvalidUTF8:
+		return "invalid-utf8"
+	case index.ErrTooLong:
+		return "too-long"
+	case index.ErrLongLines:
+		return "long-lines"
+	case index.ErrTooManyTrigrams:
+		return "too-many-trigrams"
+	}
+	return "read-error"
+}
+
+// Moves src to dst, falling back to copying when src and dst are on different
+// file systems (which is the common case, as tmpdir is usually not on the SSD).
+func moveAll(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), os.FileMode(0755)); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, path[len(src):])
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		input, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		output, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+		_, err = io.Copy(output, input)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// Appends entry to <quarantine_path>/<package>/reasons.json.
+func recordQuarantine(entry quarantineEntry) error {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+
+	reasonsPath := filepath.Join(*quarantinePath, entry.Package, "reasons.json")
+	var entries []quarantineEntry
+	if contents, err := ioutil.ReadFile(reasonsPath); err == nil {
+		if err := json.Unmarshal(contents, &entries); err != nil {
+			return err
+		}
+	}
+	entries = append(entries, entry)
+	contents, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(reasonsPath), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reasonsPath, contents, 0644)
+}
+
+// Moves a single file which could not be indexed into the quarantine
+// directory. Returns false if the file should just be deleted instead, i.e.
+// when quarantining is disabled for this reason.
+func quarantineFile(pkg, path, relPath string, indexErr error) bool {
+	reason := quarantineReason(indexErr)
+	if *quarantinePath == "" || !quarantineReasons[reason] {
+		return false
+	}
+	dst := filepath.Join(*quarantinePath, pkg, "src", relPath)
+	if err := moveAll(path, dst); err != nil {
+		log.Printf("Could not quarantine %q: %v\n", path, err)
+		return false
+	}
+	if err := recordQuarantine(quarantineEntry{
+		Package: pkg,
+		Path:    relPath,
+		Reason:  reason,
+		Detail:  indexErr.Error(),
+		Time:    time.Now(),
+	}); err != nil {
+		log.Printf("Could not record quarantine reason for %q: %v\n", path, err)
+	}
+	varz.Increment("quarantined-files")
+	return true
+}
+
+// Moves everything that was uploaded for pkg (the .dsc, the tarballs and what
+// was unpacked so far) into the quarantine directory. Any previously
+// quarantined files of pkg are superseded.
+func quarantinePackage(pkg, reason, detail string) {
+	if *quarantinePath == "" || !quarantineReasons[reason] {
+		return
+	}
+	dst := filepath.Join(*quarantinePath, pkg, "src")
+	if err := os.RemoveAll(dst); err != nil {
+		log.Printf("Could not remove %q: %v\n", dst, err)
+		return
+	}
+	if err := moveAll(filepath.Join(tmpdir, pkg), dst); err != nil {
+		log.Printf("Could not quarantine package %q: %v\n", pkg, err)
+		return
+	}
+	releaseTmp(pkg)
+	if err := recordQuarantine(quarantineEntry{
+		Package: pkg,
+		Reason:  reason,
+		Detail:  detail,
+		Time:    time.Now(),
+	}); err != nil {
+		log.Printf("Could not record quarantine reason for %q: %v\n", pkg, err)
+	}
+	varz.Increment("quarantined-packages")
+}
+
+// Lists all quarantined files and packages as JSON, optionally restricted to
+// a single package via ?package=.
+func listQuarantine(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	type ListQuarantineReply struct {
+		Entries []quarantineEntry
+	}
+
+	reply := ListQuarantineReply{Entries: []quarantineEntry{}}
+	if *quarantinePath == "" {
+		http.Error(w, "Quarantine is disabled, see -quarantine_path", http.StatusNotFound)
+		return
+	}
+
+	var names []string
+	if pkg := r.FormValue("package"); pkg != "" {
+		names = []string{filepath.Base(pkg)}
+	} else {
+		dir, err := os.Open(*quarantinePath)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			defer dir.Close()
+			names, err = dir.Readdirnames(-1)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	quarantineMu.Lock()
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(filepath.Join(*quarantinePath, name, "reasons.json"))
+		if err != nil {
+			continue
+		}
+		var entries []quarantineEntry
+		if err := json.Unmarshal(contents, &entries); err != nil {
+			log.Printf("Skipping corrupt quarantine record for %q: %v\n", name, err)
+			continue
+		}
+		reply.Entries = append(reply.Entries, entries...)
+	}
+	quarantineMu.Unlock()
+
+	jsonReply, err := json.Marshal(&reply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("Could not send listQuarantine reply: %v\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var (
+	maxUploadBytes = flag.Int64("max_upload_bytes",
+		4*1024*1024*1024,
+		"Maximum size of a single uploaded file in bytes. 0 means unlimited")
+
+	maxTmpBytes = flag.Int64("max_tmp_bytes",
+		64*1024*1024*1024,
+		"Maximum number of uploaded bytes kept in the temporary directory at any time. New uploads are rejected while the limit is exceeded. 0 means unlimited")
+
+	// Bytes of uploaded files per package which are currently stored in
+	// tmpdir. Entries are removed once the package directory is deleted.
+	tmpUsage   = make(map[string]int64)
+	tmpBytes   int64
+	tmpUsageMu sync.Mutex
+)
+
+// Accounts n (possibly negative) bytes to pkg. Returns false and does not
+// account anything if that would exceed -max_tmp_bytes.
+func reserveTmp(pkg string, n int64) bool {
+	tmpUsageMu.Lock()
+	defer tmpUsageMu.Unlock()
+	if n > 0 && *maxTmpBytes > 0 && tmpBytes+n > *maxTmpBytes {
+		return false
+	}
+	tmpUsage[pkg] += n
+	tmpBytes += n
+	varz.Set("tmp-bytes-used", uint64(tmpBytes))
+	return true
+}
+
+// Releases all bytes accounted to pkg. To be called when tmpdir/pkg is deleted.
+func releaseTmp(pkg string) {
+	tmpUsageMu.Lock()
+	defer tmpUsageMu.Unlock()
+	tmpBytes -= tmpUsage[pkg]
+	delete(tmpUsage, pkg)
+	varz.Set("tmp-bytes-used", uint64(tmpBytes))
+
+	// A .dsc which was waiting for the remaining files is gone now, too.
+	forgetPendingDsc(pkg)
+}
+
+// Reports the current temporary storage usage and the configured limits as
+// JSON.
+func statusz(w http.ResponseWriter, r *http.Request) {
+	type StatusReply struct {
+		TmpBytesUsed   int64
+		TmpPackages    int
+		MaxTmpBytes    int64
+		MaxUploadBytes int64
+	}
+
+	tmpUsageMu.Lock()
+	reply := StatusReply{
+		TmpBytesUsed:   tmpBytes,
+		TmpPackages:    len(tmpUsage),
+		MaxTmpBytes:    *maxTmpBytes,
+		MaxUploadBytes: *maxUploadBytes,
+	}
+	tmpUsageMu.Unlock()
+
+	jsonReply, err := json.Marshal(&reply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("Could not send statusz reply: %v\n", err)
+	}
+}
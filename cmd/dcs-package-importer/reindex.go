@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"github.com/Debian/dcs/lang"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	reindexParallelism = flag.Int("reindex_parallelism",
+		runtime.NumCPU(),
+		"Number of packages which /reindex processes concurrently")
+
+	// Set while a reindex is running, there can only be one at a time.
+	reindexing   bool
+	reindexingMu sync.Mutex
+)
+
+// Rebuilds the index of pkg from the sources in -unpacked_path, applying the
+// current filters. Files which are now excluded are deleted, just like when
+// importing.
+func reindexPackage(pkg string) error {
+	lock := lockPackage(pkg)
+	defer unlockPackage(pkg, lock)
+
+	dir := filepath.Join(*unpackedPath, pkg)
+	// Does not end in .idx, so that merges ignore it.
+	tmpIndexPath := dir + ".idx.reindex"
+	ix := index.Create(tmpIndexPath)
+	ix.FoldCase = *foldCase
+	ix.Normalize = *normalize
+	ix.LineOffsets = *lineOffsets
+	ix.Bloom = *bloom
+	ix.MaxMemory = *indexMemory << 20
+	ix.LongLines = longLines
+	ix.MaxLineLen = *maxLineLength
+	ix.Dedup = *dedup
+	languages := make(map[string]string)
+
+	walker := newPackageWalker(dir, *unpackedPath,
+		func(path, name string, info os.FileInfo) error {
+			if info == nil || name == pkg+"/"+languagesFilename || name == pkg+"/"+vcsFilename {
+				return nil
+			}
+			var head []byte
+			if info.Mode().IsRegular() {
+				head = readHead(path)
+			}
+			if ignored(info, name, head) {
+				if info.IsDir() {
+					if err := os.RemoveAll(path); err != nil {
+						log.Printf("Could not remove directory %q: %v\n", path, err)
+					}
+					return filepath.SkipDir
+				}
+				if err := os.Remove(path); err != nil {
+					log.Printf("Could not remove file %q: %v\n", path, err)
+				}
+				return nil
+			}
+
+			if !info.Mode().IsRegular() || !utf8.ValidString(name) {
+				return nil
+			}
+
+			language := lang.Detect(name, head)
+			if !languageWanted(language) {
+				if err := os.Remove(path); err != nil {
+					log.Printf("Could not remove file %q: %v\n", path, err)
+				}
+				return nil
+			}
+
+			if err := ix.AddFileMeta(path, name, fileMeta(language)); err != nil {
+				if quarantineFile(pkg, path, name, err) {
+					return nil
+				}
+				if err := os.Remove(path); err != nil {
+					log.Printf("Could not remove file %q: %v\n", path, err)
+				}
+				return nil
+			}
+			languages[name] = language
+			return nil
+		})
+	err := walker.run(pkg)
+	ix.Flush()
+	if err == nil {
+		// The package was garbage collected after it was listed for
+		// reindexing, its index must not come back.
+		_, err = os.Stat(dir)
+	}
+	if err != nil {
+		os.Remove(tmpIndexPath)
+		return err
+	}
+
+	if err := writeLanguages(pkg, languages); err != nil {
+		log.Printf("Could not write languages of %s: %v\n", pkg, err)
+	}
+	names := make([]string, 0, len(languages))
+	for name := range languages {
+		names = append(names, name)
+	}
+	writeSymbols(context.Background(), pkg, names)
+	if err := os.Rename(tmpIndexPath, dir+".idx"); err != nil {
+		return err
+	}
+	packageIndexed(pkg)
+	return nil
+}
+
+// Returns the names of all unpacked packages.
+func unpackedPackages() []string {
+	var pkgs []string
+	for _, name := range packageNames() {
+		if strings.HasSuffix(name, ".idx") || strings.Contains(name, ".idx.") ||
+			strings.HasPrefix(name, "newshard") || isSegmentsDir(name) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(*unpackedPath, name)); err == nil && info.IsDir() {
+			pkgs = append(pkgs, name)
+		}
+	}
+	return pkgs
+}
+
+func reindexAll(pkgs []string) {
+	defer func() {
+		reindexingMu.Lock()
+		reindexing = false
+		reindexingMu.Unlock()
+	}()
+
+	log.Printf("Reindexing %d packages\n", len(pkgs))
+	varz.Set("reindex-packages-total", uint64(len(pkgs)))
+	varz.Set("reindex-packages-done", 0)
+	varz.Set("reindex-packages-failed", 0)
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < *reindexParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkg := range work {
+				if err := reindexPackage(pkg); err != nil {
+					log.Printf("Could not reindex %s: %v\n", pkg, err)
+					varz.Increment("reindex-packages-failed")
+				}
+				varz.Increment("reindex-packages-done")
+			}
+		}()
+	}
+	for _, pkg := range pkgs {
+		work <- pkg
+	}
+	close(work)
+	wg.Wait()
+	log.Printf("Reindexing done\n")
+}
+
+// Starts rebuilding the indexes of all unpacked packages (or only the one
+// specified by ?package=) in the background. A merge is required afterwards
+// for the changes to be served. Progress is reported in /varz.
+func reindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pkgs := unpackedPackages()
+	if pkg := r.FormValue("package"); pkg != "" {
+		found := false
+		for _, name := range pkgs {
+			if name == pkg {
+				found = true
+				break
+			}
+		}
+		if !found {
+			http.Error(w, "No such package", http.StatusNotFound)
+			return
+		}
+		pkgs = []string{pkg}
+	}
+
+	reindexingMu.Lock()
+	defer reindexingMu.Unlock()
+	if reindexing {
+		http.Error(w, "Reindex already in progress, please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	reindexing = true
+	go reindexAll(pkgs)
+	fmt.Fprintf(w, "Reindexing %d packages.\n", len(pkgs))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	incrementalMerge = flag.Bool("incremental_merge",
+		false,
+		"Instead of merging all package indexes into full.idx, append the packages indexed since the last merge as a new segment to the segmented index in -unpacked_path/segments (or segments.<n> with -shards). dcs-index-backend must be started with -index_path pointing to that directory")
+
+	maxSegments = flag.Int("max_segments",
+		16,
+		"With -incremental_merge, compact all segments of a shard into a single one once it has this many segments")
+
+	// Packages indexed since the last merge, per shard.
+	newPackages   = make(map[int]map[string]bool)
+	newPackagesMu sync.Mutex
+
+	// Shards for which a full merge happened since this process started.
+	// Packages indexed before are not in newPackages, so the first merge
+	// needs to be a full one.
+	fullyMerged = make(map[int]bool)
+
+	// Serializes manifest updates, so that tombstones which are added while
+	// segments are appended or compacted do not get lost.
+	manifestMu sync.Mutex
+)
+
+func segmentsDir(shard int) string {
+	if *numShards == 1 {
+		return filepath.Join(*unpackedPath, "segments")
+	}
+	return filepath.Join(*unpackedPath, fmt.Sprintf("segments.%d", shard))
+}
+
+// Returns true if name is the directory of a segmented index.
+func isSegmentsDir(name string) bool {
+	return name == "segments" || strings.HasPrefix(name, "segments.")
+}
+
+// Records that the index of pkg was (re-)built, so that the next incremental
+// merge picks it up.
+func packageIndexed(pkg string) {
+	if !*incrementalMerge {
+		return
+	}
+	shard := shardForPackage(pkg)
+	newPackagesMu.Lock()
+	defer newPackagesMu.Unlock()
+	if newPackages[shard] == nil {
+		newPackages[shard] = make(map[string]bool)
+	}
+	newPackages[shard][pkg] = true
+}
+
+// Removes and returns the packages of shard which were indexed since the last
+// merge.
+func takeNewPackages(shard int) []string {
+	newPackagesMu.Lock()
+	defer newPackagesMu.Unlock()
+	var pkgs []string
+	for pkg := range newPackages[shard] {
+		pkgs = append(pkgs, pkg)
+	}
+	delete(newPackages, shard)
+	return pkgs
+}
+
+// Tells the dcs-index-backend of shard to reload its segmented index.
+func reloadSegments(shard int) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/replace", indexBackends[shard]))
+	if err != nil {
+		log.Printf("Could not reload segments of shard %d: %v\n", shard, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Printf("dcs-index-backend /replace response: %+v (body: %s)\n", resp, body)
+	}
+}
+
+// Appends the packages indexed since the last merge as a new segment, or
+// merges indexFiles (all package indexes of shard) into a single segment on
+// the first merge. New segments are merged with their neighbours by the
+// compactor in the background. Should there still be too many segments, they
+// are compacted into a single one right away.
+func mergeSegments(shard int, indexFiles []string) {
+	dir := segmentsDir(shard)
+	pkgs := takeNewPackages(shard)
+	newPackagesMu.Lock()
+	full := !fullyMerged[shard]
+	newPackagesMu.Unlock()
+
+	sources := indexFiles
+	var replaces []string
+	if full {
+		// Packages which were indexed after indexFiles was listed need to go
+		// into the next segment.
+		merged := make(map[string]bool)
+		for _, path := range indexFiles {
+			merged[path] = true
+		}
+		for _, pkg := range pkgs {
+			if !merged[filepath.Join(*unpackedPath, pkg+".idx")] {
+				packageIndexed(pkg)
+			}
+		}
+	} else {
+		sources = nil
+		for _, pkg := range pkgs {
+			path := filepath.Join(*unpackedPath, pkg+".idx")
+			// The package may have been garbage collected in the meantime.
+			if _, err := os.Stat(path); err == nil {
+				sources = append(sources, path)
+			}
+			replaces = append(replaces, pkg+"/")
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	tmpIndex, err := ioutil.TempFile(*unpackedPath, "newshard")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmpIndex.Close()
+	index.ConcatN(tmpIndex.Name(), sources...)
+
+	manifestMu.Lock()
+	if full {
+		log.Printf("Merged %d packages into a single segment for shard %d\n", len(sources), shard)
+		err = index.ResetSegments(dir, tmpIndex.Name())
+	} else {
+		log.Printf("Appending segment with %d packages to shard %d\n", len(sources), shard)
+		err = index.AppendSegment(dir, tmpIndex.Name(), replaces)
+	}
+	if err != nil {
+		manifestMu.Unlock()
+		log.Printf("Could not update segments of shard %d: %v\n", shard, err)
+		os.Remove(tmpIndex.Name())
+		// Try again with the next merge.
+		for _, pkg := range pkgs {
+			packageIndexed(pkg)
+		}
+		return
+	}
+	if !full {
+		compactSegments(shard)
+	}
+	manifestMu.Unlock()
+	if full {
+		newPackagesMu.Lock()
+		fullyMerged[shard] = true
+		newPackagesMu.Unlock()
+	}
+	reloadSegments(shard)
+	if !full {
+		triggerCompaction(shard)
+	}
+}
+
+// Replaces the segments of shard with a single one without the tombstoned
+// files if there are -max_segments or more.
+func compactSegments(shard int) {
+	// Called with manifestMu held.
+	dir := segmentsDir(shard)
+	s, err := index.OpenSegments(dir)
+	if err != nil {
+		log.Printf("Could not open segments of shard %d: %v\n", shard, err)
+		return
+	}
+	defer s.Close()
+	if s.NumSegments() < *maxSegments {
+		return
+	}
+
+	tmpIndex, err := ioutil.TempFile(*unpackedPath, "newshard")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmpIndex.Close()
+	s.Compact(tmpIndex.Name())
+	log.Printf("Compacted %d segments of shard %d\n", s.NumSegments(), shard)
+	if err := index.ResetSegments(dir, tmpIndex.Name()); err != nil {
+		log.Printf("Could not update segments of shard %d: %v\n", shard, err)
+		os.Remove(tmpIndex.Name())
+	}
+}
+
+// Hides pkg in the segmented index of its shard.
+func tombstonePackage(pkg string) {
+	if !*incrementalMerge {
+		return
+	}
+	shard := shardForPackage(pkg)
+	manifestMu.Lock()
+	err := index.AddTombstones(segmentsDir(shard), pkg+"/")
+	manifestMu.Unlock()
+	if err != nil {
+		log.Printf("Could not tombstone %s: %v\n", pkg, err)
+		return
+	}
+	reloadSegments(shard)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/shardmapping"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var (
+	numShards = flag.Int("shards",
+		1,
+		"Number of index shards to merge the package indexes into. Each package goes into the shard chosen by hashing its name (the same way dcs-feeder distributes packages), so that the shards are balanced and can be served by separate dcs-index-backend processes")
+
+	indexBackendsList = flag.String("index_backends",
+		"localhost:28081",
+		"(comma-separated list of) dcs-index-backend addresses which serve the shards, in shard order. Needs one entry per shard")
+
+	indexBackends []string
+
+	shardIndexRe = regexp.MustCompile(`^full(\.[0-9]+)?\.idx$`)
+)
+
+func setupShards() {
+	if *numShards < 1 {
+		log.Fatalf("-shards must be at least 1\n")
+	}
+	indexBackends = strings.Split(*indexBackendsList, ",")
+	if len(indexBackends) != *numShards {
+		log.Fatalf("-index_backends lists %d addresses, but -shards is %d\n", len(indexBackends), *numShards)
+	}
+}
+
+// Returns the file name (within -unpacked_path) of the merged index for
+// shard. With only one shard, that is full.idx, as before sharding.
+func shardIndexName(shard int) string {
+	if *numShards == 1 {
+		return "full.idx"
+	}
+	return fmt.Sprintf("full.%d.idx", shard)
+}
+
+// Returns true if name is a merged index rather than a package index.
+func isShardIndex(name string) bool {
+	return shardIndexRe.MatchString(name)
+}
+
+// Returns the shard into which the index of pkg is merged.
+func shardForPackage(pkg string) int {
+	return shardmapping.TaskIdxForPackage(pkg, *numShards)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/Debian/dcs/symbols"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	ctagsPath = flag.String("ctags",
+		"",
+		"If non-empty, path to the universal-ctags binary. Symbol definitions found by ctags are stored in a symbol index next to each index (e.g. full.sym next to full.idx), which dcs-index-backend serves under /symbols. Not supported with -incremental_merge yet")
+)
+
+// Runs ctags on the indexed files of pkg (names relative to -unpacked_path)
+// and writes the symbols next to the package index. Failures are logged, the
+// package is then served without symbols.
+func writeSymbols(ctx context.Context, pkg string, names []string) {
+	if *ctagsPath == "" {
+		return
+	}
+	symPath := filepath.Join(*unpackedPath, pkg+".sym")
+	sort.Strings(names)
+	syms, err := symbols.Extract(ctx, *ctagsPath, *unpackedPath, names)
+	if err == nil {
+		err = symbols.Write(symPath, syms)
+	}
+	if err != nil {
+		log.Printf("Could not extract symbols of %s: %v\n", pkg, err)
+		varz.Increment("failed-symbol-extractions")
+		os.Remove(symPath)
+	}
+}
+
+// Merges the symbol files belonging to indexFiles into the symbol file of
+// the shard index at shardPath.
+func mergeSymbols(shardPath string, indexFiles []string) {
+	if *ctagsPath == "" {
+		return
+	}
+	sources := make([]string, len(indexFiles))
+	for i, path := range indexFiles {
+		sources[i] = symbols.FileFor(path)
+	}
+	if err := symbols.Merge(symbols.FileFor(shardPath), sources...); err != nil {
+		log.Printf("Could not merge symbols into %s: %v\n", symbols.FileFor(shardPath), err)
+		os.Remove(symbols.FileFor(shardPath))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the file within every unpacked package which holds the Vcs-Git and
+// Vcs-Browser fields of its .dsc file, so that dcs-web can link to the
+// packaging repository (see /vcs).
+const vcsFilename = ".dcs-vcs"
+
+// The fields of the .dsc file which are copied into vcsFilename.
+var vcsFields = []string{"Vcs-Browser", "Vcs-Git"}
+
+// Returns the fields of vcsFields found in the .dsc file contents, as
+// “Field: value” lines. Field names are case-insensitive in .dsc files and
+// are written in their canonical form.
+func dscVcsFields(contents []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// The PGP signature (if any) follows the fields.
+		if strings.HasPrefix(line, "-----BEGIN PGP SIGNATURE") {
+			break
+		}
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		for _, field := range vcsFields {
+			if strings.EqualFold(line[:colon], field) {
+				lines = append(lines, field+": "+strings.TrimSpace(line[colon+1:]))
+			}
+		}
+	}
+	return lines
+}
+
+// Copies the Vcs-* fields of the .dsc file at dscPath into the unpacked
+// package directory of pkg. Packages without such fields get no file.
+func writeVcs(pkg, dscPath string) error {
+	contents, err := ioutil.ReadFile(dscPath)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*unpackedPath, pkg, vcsFilename)
+	lines := dscVcsFields(contents)
+	if len(lines) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	symlinkPolicy = flag.String("symlink_policy",
+		"skip",
+		"How to handle symlinks within packages: “skip” ignores them, “follow-within-package” indexes their target (only if it is within the same package and was not indexed already), “record-as-link” recreates the symlink in -unpacked_path (or the scratch directory of a dry run) without indexing it")
+)
+
+type fileID struct {
+	dev, ino uint64
+}
+
+func idOf(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+// packageWalker walks an unpacked package and calls visit for every directory
+// and regular file. Depending on -symlink_policy, symlinks are followed, in
+// which case every directory and every file (identified by its inode, so that
+// hardlinks count as well) is visited at most once. This also terminates
+// symlink cycles.
+type packageWalker struct {
+	root string
+	// Directory in which -symlink_policy=record-as-link recreates the
+	// symlinks, usually -unpacked_path.
+	output string
+	visit  func(path, name string, info os.FileInfo) error
+	dirs   map[string]bool
+	files  map[fileID]bool
+
+	// Symlinks are only followed after the rest of the package was walked,
+	// so that files are indexed under their real name whenever possible.
+	pending []pendingLink
+}
+
+type pendingLink struct {
+	path, name string
+}
+
+func newPackageWalker(root, output string, visit func(path, name string, info os.FileInfo) error) *packageWalker {
+	// Resolve the root so that the targets returned by filepath.EvalSymlinks
+	// can be compared against it.
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	return &packageWalker{
+		root:   root,
+		output: output,
+		visit:  visit,
+		dirs:   make(map[string]bool),
+		files:  make(map[fileID]bool),
+	}
+}
+
+func (w *packageWalker) within(path string) bool {
+	return path == w.root || strings.HasPrefix(path, w.root+"/")
+}
+
+// Returns true if the file was already visited (under a different name).
+func (w *packageWalker) seen(info os.FileInfo) bool {
+	if *symlinkPolicy != "follow-within-package" {
+		return false
+	}
+	id, ok := idOf(info)
+	if !ok {
+		return false
+	}
+	if w.files[id] {
+		return true
+	}
+	w.files[id] = true
+	return false
+}
+
+// run walks the entire package, reporting the files within it as name/….
+// Walking stops at the first error returned by visit.
+func (w *packageWalker) run(name string) error {
+	if err := w.walk(w.root, name); err != nil {
+		return err
+	}
+	for len(w.pending) > 0 {
+		link := w.pending[0]
+		w.pending = w.pending[1:]
+		if err := w.symlink(link.path, link.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk walks dir, reporting the files within it as name/….
+func (w *packageWalker) walk(dir, name string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil {
+			return nil
+		}
+		relName := name + path[len(dir):]
+		if info.IsDir() {
+			if w.dirs[path] {
+				return filepath.SkipDir
+			}
+			w.dirs[path] = true
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if *symlinkPolicy == "follow-within-package" {
+				w.pending = append(w.pending, pendingLink{path, relName})
+				return nil
+			}
+			return w.symlink(path, relName)
+		}
+		if info.Mode().IsRegular() && w.seen(info) {
+			return nil
+		}
+		return w.visit(path, relName, info)
+	})
+}
+
+func (w *packageWalker) symlink(path, name string) error {
+	if *symlinkPolicy == "skip" {
+		return nil
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil || !w.within(target) {
+		return nil
+	}
+
+	if *symlinkPolicy == "record-as-link" {
+		dest, err := os.Readlink(path)
+		if err != nil {
+			return nil
+		}
+		outputPath := filepath.Join(w.output, name)
+		if err := os.MkdirAll(filepath.Dir(outputPath), os.FileMode(0755)); err != nil {
+			log.Fatalf("Could not create directory: %v\n", err)
+		}
+		os.Remove(outputPath)
+		if err := os.Symlink(dest, outputPath); err != nil {
+			log.Printf("Could not create symlink %q: %v\n", outputPath, err)
+		}
+		return nil
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		if w.dirs[target] {
+			return nil
+		}
+		return w.walk(target, name)
+	}
+	if !info.Mode().IsRegular() || w.seen(info) {
+		return nil
+	}
+	return w.visit(target, name, info)
+}
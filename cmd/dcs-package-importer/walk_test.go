@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordAsLinkWritesToOutput(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dcs-walk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	defer func(policy, unpacked string) {
+		*symlinkPolicy = policy
+		*unpackedPath = unpacked
+	}(*symlinkPolicy, *unpackedPath)
+	*symlinkPolicy = "record-as-link"
+	*unpackedPath = filepath.Join(tmp, "unpacked")
+	if err := os.Mkdir(*unpackedPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := filepath.Join(tmp, "scratch", "i3-wm_4.5.1-2")
+	if err := os.MkdirAll(pkg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pkg, "main.c"), []byte("int main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("main.c", filepath.Join(pkg, "link.c")); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(tmp, "output")
+	var visited []string
+	walker := newPackageWalker(pkg, output, func(path, name string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			visited = append(visited, name)
+		}
+		return nil
+	})
+	if err := walker.run("i3-wm_4.5.1-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"i3-wm_4.5.1-2/main.c"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("visited %v, want %v", visited, want)
+	}
+	dest, err := os.Readlink(filepath.Join(output, "i3-wm_4.5.1-2", "link.c"))
+	if err != nil || dest != "main.c" {
+		t.Errorf("recorded link: got %q (%v), want %q", dest, err, "main.c")
+	}
+	names, err := ioutil.ReadDir(*unpackedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("walker wrote %d entries into -unpacked_path, want none", len(names))
+	}
+}
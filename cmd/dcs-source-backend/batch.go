@@ -0,0 +1,218 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/proto"
+	dcsquery "github.com/Debian/dcs/query"
+	"github.com/Debian/dcs/ranking"
+	"github.com/Debian/dcs/regexp"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+var maxBatchQueries = flag.Int("max_batch_queries",
+	1000,
+	"Maximum number of queries per BatchSearch call. 0 means no limit")
+
+// One query of a BatchSearch call.
+type batchQuery struct {
+	query    string
+	budget   *queryBudget
+	ctx      context.Context // see queryBudget.start
+	template regexp.Grep
+	perFile  int
+	files    int
+
+	mu      sync.Mutex
+	matches []regexp.Match
+}
+
+// Prepares req for searching and returns the files which it may match.
+func newBatchQuery(ctx context.Context, req proto.SearchRequest) (*batchQuery, []string, error) {
+	q := &batchQuery{
+		query:  req.Query(),
+		budget: newQueryBudget(req),
+	}
+	rewritten, err := url.Parse(req.Url())
+	if err != nil {
+		return nil, nil, err
+	}
+	if expr, err := dcsquery.ParseExpr(q.query); err != nil || expr != nil {
+		return nil, nil, fmt.Errorf("%q: AND, OR and NOT are not supported in batch queries", q.query)
+	}
+	re, err := regexp.Compile(q.query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%q: compiling regexp: %v", q.query, err)
+	}
+	q.template = regexp.Grep{
+		Regexp:        re,
+		MaxLineLen:    *maxLineLength,
+		SkipLongLines: *longLines == "skip_lines",
+		ContextLines:  contextLines(rewritten.Query()),
+	}
+	q.perFile = *matchesPerFile
+	if dcsquery.FromValues(rewritten.Query()).AllMatches {
+		q.perFile = 0
+	}
+
+	var groups [][]string
+	if paths := req.Files(); paths.Len() > 0 {
+		groups = givenFiles(paths.ToArray(), rewritten.Query())
+	} else if groups, err = queryIndexBackend(ctx, q.query, rewritten.Query()); err != nil {
+		return nil, nil, fmt.Errorf("%q: querying index backend: %v", q.query, err)
+	}
+	var files []ranking.ResultPath
+	for _, filenames := range groups {
+		for _, filename := range filenames {
+			files = append(files, ranking.ResultPath{Path: filename})
+		}
+	}
+	files = filterByKeywords(rewritten, files)
+	if q.budget.maxFiles > 0 && uint64(len(files)) > q.budget.maxFiles {
+		files = files[:q.budget.maxFiles]
+		q.budget.record("files")
+	}
+	q.files = len(files)
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Path
+	}
+	return q, names, nil
+}
+
+// Searches the contents of the file name (below -unpacked_path) for q.
+func (q *batchQuery) grep(grep *regexp.Grep, name string, contents []byte) {
+	if q.ctx.Err() != nil {
+		return
+	}
+	q.budget.addBytes(len(contents))
+	matches := grep.Reader(bytes.NewReader(contents), name)
+	if len(matches) == 0 {
+		return
+	}
+	if grep.ContextLines > 0 {
+		if err := grep.AddContext(bytes.NewReader(contents), matches); err != nil {
+			log.Printf("%s: %v\n", name, err)
+		}
+	}
+	if q.perFile > 0 && len(matches) > q.perFile {
+		total := len(matches)
+		matches = matches[:q.perFile]
+		for i := range matches {
+			matches[i].FileMatches = total
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, match := range matches {
+		if !q.budget.takeMatch() {
+			break
+		}
+		q.matches = append(q.matches, match)
+	}
+}
+
+// Evaluates all queries of req in one pass: each file which any of them may
+// match is read once and searched for all queries which may match it. This
+// saves tools which check many patterns (e.g. the code of known
+// vulnerabilities) from reading the same files over and over.
+func (s *sourceBackend) BatchSearch(ctx context.Context, req proto.BatchSearchRequest) (proto.BatchSearchReply, error) {
+	logprefix := logPrefix(ctx)
+	requests := req.Queries().ToArray()
+	if *maxBatchQueries > 0 && len(requests) > *maxBatchQueries {
+		return proto.BatchSearchReply{}, fmt.Errorf("too many queries (%d), at most %d are allowed", len(requests), *maxBatchQueries)
+	}
+
+	queries := make([]*batchQuery, len(requests))
+	// The queries (by their index) which may match each file.
+	fileQueries := make(map[string][]int)
+	for i, r := range requests {
+		q, files, err := newBatchQuery(ctx, r)
+		if err != nil {
+			return proto.BatchSearchReply{}, err
+		}
+		q.ctx = q.budget.start(ctx)
+		defer q.budget.stop()
+		queries[i] = q
+		for _, file := range files {
+			fileQueries[file] = append(fileQueries[file], i)
+		}
+	}
+	files := make([]string, 0, len(fileQueries))
+	for file := range fileQueries {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	log.Printf("%s batch of %d queries, %d possible files\n", logprefix, len(queries), len(files))
+
+	work := make(chan string)
+	go func() {
+		defer close(work)
+		for _, file := range files {
+			select {
+			case work <- file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker needs its own Grep (and regexp, see search).
+			greps := make([]regexp.Grep, len(queries))
+			for j, q := range queries {
+				greps[j] = q.template
+				greps[j].Regexp, _ = regexp.Compile(q.query)
+				greps[j].Done = q.ctx.Done()
+			}
+			for file := range work {
+				name := path.Join(*unpackedPath, file)
+				contents, err := ioutil.ReadFile(name)
+				if err != nil {
+					log.Printf("%s %v\n", logprefix, err)
+					continue
+				}
+				for _, j := range fileQueries[file] {
+					queries[j].grep(&greps[j], name, contents)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return proto.BatchSearchReply{}, err
+	}
+
+	seg := capn.NewBuffer(nil)
+	reply := proto.NewRootBatchSearchReply(seg)
+	replies := proto.NewSearchReplyList(seg, len(queries))
+	for i, q := range queries {
+		r := replies.At(i)
+		r.SetFilestotal(uint64(q.files))
+		if hit := q.budget.limitsHit(q.ctx); hit != "" {
+			r.SetLimitshit(hit)
+		}
+		list := proto.NewMatchList(seg, len(q.matches))
+		for j, match := range q.matches {
+			setMatch(list.At(j), match)
+		}
+		r.SetMatches(list)
+	}
+	reply.SetReplies(replies)
+	return reply, nil
+}
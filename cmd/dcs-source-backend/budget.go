@@ -0,0 +1,156 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/proto"
+	"github.com/Debian/dcs/regexp"
+	"github.com/Debian/dcs/varz"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxFiles = flag.Uint64("max_files",
+		1000000,
+		"Maximum number of (possibly matching) files to search per query. The best-ranked files are searched. 0 means no limit")
+	maxBytes = flag.Uint64("max_bytes",
+		16<<30,
+		"Maximum number of bytes to read per query. 0 means no limit")
+	maxMatches = flag.Uint64("max_matches",
+		1000000,
+		"Maximum number of matches to return per query. 0 means no limit")
+	maxQueryTime = flag.Duration("max_query_time",
+		5*time.Minute,
+		"Maximum time to spend on a query. 0 means no limit")
+)
+
+// The limits of a single query. Once one of them is exceeded, the query stops
+// and the results found so far are returned, along with which limit was hit.
+type queryBudget struct {
+	maxFiles   uint64
+	maxBytes   uint64
+	maxMatches uint64
+	timeout    time.Duration
+
+	bytes   uint64 // updated atomically
+	matches uint64 // updated atomically
+
+	mu     sync.Mutex
+	hit    string
+	parent context.Context
+	stop   context.CancelFunc
+}
+
+// Returns requested if it is lower than configured.
+func lowerLimit(configured, requested uint64) uint64 {
+	if requested != 0 && (configured == 0 || requested < configured) {
+		return requested
+	}
+	return configured
+}
+
+// Returns the budget for req: the configured limits, lowered by those set in
+// req.
+func newQueryBudget(req proto.SearchRequest) *queryBudget {
+	timeout := time.Duration(lowerLimit(uint64(*maxQueryTime/time.Millisecond), req.Timeoutms())) * time.Millisecond
+	return &queryBudget{
+		maxFiles:   lowerLimit(*maxFiles, req.Maxfiles()),
+		maxBytes:   lowerLimit(*maxBytes, req.Maxbytes()),
+		maxMatches: lowerLimit(*maxMatches, req.Maxmatches()),
+		timeout:    timeout,
+	}
+}
+
+// Returns a context which is done when ctx is done or once the budget is
+// exceeded.
+func (b *queryBudget) start(ctx context.Context) context.Context {
+	b.parent = ctx
+	var budgetCtx context.Context
+	if b.timeout > 0 {
+		budgetCtx, b.stop = context.WithTimeout(ctx, b.timeout)
+	} else {
+		budgetCtx, b.stop = context.WithCancel(ctx)
+	}
+	return budgetCtx
+}
+
+// Records that limit was hit. The first limit which is hit is reported.
+func (b *queryBudget) record(limit string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hit == "" {
+		b.hit = limit
+		varz.IncrementLabeled("query-limits-hit", map[string]string{"limit": limit})
+	}
+}
+
+// Records that limit was hit and stops the query.
+func (b *queryBudget) exceed(limit string) {
+	b.record(limit)
+	b.stop()
+}
+
+// Returns which limit was hit, if any. budgetCtx is the context returned by
+// start.
+func (b *queryBudget) limitsHit(budgetCtx context.Context) string {
+	if budgetCtx.Err() == context.DeadlineExceeded && b.parent.Err() == nil {
+		b.record("time")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hit
+}
+
+func (b *queryBudget) addBytes(n int) {
+	if b.maxBytes > 0 && atomic.AddUint64(&b.bytes, uint64(n)) > b.maxBytes {
+		b.exceed("bytes")
+	}
+}
+
+// Returns false if the match must not be sent because the query already
+// returned the maximum number of matches.
+func (b *queryBudget) takeMatch() bool {
+	if b.maxMatches > 0 && atomic.AddUint64(&b.matches, 1) > b.maxMatches {
+		b.exceed("matches")
+		return false
+	}
+	return true
+}
+
+type countingReader struct {
+	r      io.Reader
+	budget *queryBudget
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.budget.addBytes(n)
+	return n, err
+}
+
+// Like grep.File, but counts the bytes read against budget.
+func grepFile(grep *regexp.Grep, name string, budget *queryBudget) []regexp.Match {
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(grep.Stderr, "%s\n", err)
+		return []regexp.Match{}
+	}
+	defer f.Close()
+	matches := grep.Reader(countingReader{f, budget}, name)
+	if grep.ContextLines > 0 && len(matches) > 0 {
+		// Finding the lines around the matches requires reading the file
+		// again (mostly from the page cache).
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			if err := grep.AddContext(countingReader{f, budget}, matches); err != nil {
+				fmt.Fprintf(grep.Stderr, "%s: %v\n", name, err)
+			}
+		}
+	}
+	return matches
+}
@@ -0,0 +1,60 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	dcsquery "github.com/Debian/dcs/query"
+	"github.com/Debian/dcs/regexp"
+	"sort"
+)
+
+// Returns one Grep per term of expr, or a single one for query if expr is
+// nil, each configured like template.
+func newGreps(query string, expr *dcsquery.Expr, template regexp.Grep) ([]regexp.Grep, error) {
+	patterns := []string{query}
+	if expr != nil {
+		patterns = patterns[:0]
+		for _, term := range expr.Terms() {
+			patterns = append(patterns, term.Regexp)
+		}
+	}
+	greps := make([]regexp.Grep, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		greps[i] = template
+		greps[i].Regexp = re
+	}
+	return greps, nil
+}
+
+// Searches the file name for all terms of expr (greps contains one Grep per
+// term, see newGreps) and returns the matches of its non-negated terms if
+// the file matches expr. Lines which match multiple terms are returned once.
+func grepExpr(greps []regexp.Grep, expr *dcsquery.Expr, name string, budget *queryBudget) []regexp.Match {
+	found := make([]bool, len(greps))
+	termMatches := make([][]regexp.Match, len(greps))
+	for i := range greps {
+		termMatches[i] = grepFile(&greps[i], name, budget)
+		found[i] = len(termMatches[i]) > 0
+	}
+	if !expr.Eval(found) {
+		return []regexp.Match{}
+	}
+	matches := []regexp.Match{}
+	lines := make(map[int]bool)
+	for _, term := range expr.PositiveTerms() {
+		for _, match := range termMatches[term.Term] {
+			if lines[match.Line] {
+				continue
+			}
+			lines[match.Line] = true
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Line < matches[j].Line
+	})
+	return matches
+}
@@ -0,0 +1,103 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"github.com/Debian/dcs/lang"
+	"github.com/Debian/dcs/proto"
+	"github.com/Debian/dcs/regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var maxFacetValues = flag.Int("max_facet_values",
+	50,
+	"Maximum number of values per facet (e.g. packages) which are sent with each progress update, the ones with the most matches first")
+
+// Counts the matches of a query per package, language and top-level
+// directory (e.g. “debian”) while searching. The counts are sent with every
+// progress update and dcs-web adds up the counts of all source backends, so
+// that clients can offer to narrow down the query. Safe for concurrent use.
+type facetCounts struct {
+	mu     sync.Mutex
+	counts map[string]map[string]uint64 // kind → value → matches
+}
+
+func newFacetCounts() *facetCounts {
+	return &facetCounts{
+		counts: map[string]map[string]uint64{
+			"package":   make(map[string]uint64),
+			"language":  make(map[string]uint64),
+			"directory": make(map[string]uint64),
+		},
+	}
+}
+
+// add counts the matches of a file (below -unpacked_path), which were cut
+// down to -matches_per_file (see Match.FileMatches).
+func (f *facetCounts) add(matches []regexp.Match) {
+	if len(matches) == 0 {
+		return
+	}
+	n := len(matches)
+	if matches[0].FileMatches > n {
+		n = matches[0].FileMatches
+	}
+	path := matches[0].Path[len(*unpackedPath):]
+	slash := strings.Index(path, "/")
+	pkg, rest := path[:slash], path[slash+1:]
+	if underscore := strings.Index(pkg, "_"); underscore > -1 {
+		pkg = pkg[:underscore]
+	}
+	// The contents are not at hand anymore, so the language is detected by
+	// the file name only.
+	language := lang.Detect(path, nil)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts["package"][pkg] += uint64(n)
+	if language != lang.Unknown {
+		f.counts["language"][language] += uint64(n)
+	}
+	// Files in the top-level directory of the package are not counted.
+	if slash := strings.Index(rest, "/"); slash > -1 {
+		f.counts["directory"][rest[:slash]] += uint64(n)
+	}
+}
+
+// Sets the facets of p to (at most max values per kind of) the counts.
+func (f *facetCounts) set(p proto.ProgressUpdate, max int) {
+	type count struct {
+		kind, value string
+		matches     uint64
+	}
+	var counts []count
+	f.mu.Lock()
+	for kind, values := range f.counts {
+		var kindCounts []count
+		for value, matches := range values {
+			kindCounts = append(kindCounts, count{kind, value, matches})
+		}
+		sort.Slice(kindCounts, func(i, j int) bool {
+			if kindCounts[i].matches == kindCounts[j].matches {
+				return kindCounts[i].value < kindCounts[j].value
+			}
+			return kindCounts[i].matches > kindCounts[j].matches
+		})
+		if max > 0 && len(kindCounts) > max {
+			kindCounts = kindCounts[:max]
+		}
+		counts = append(counts, kindCounts...)
+	}
+	f.mu.Unlock()
+
+	facets := proto.NewFacetList(p.Segment, len(counts))
+	for i, c := range counts {
+		facet := facets.At(i)
+		facet.SetKind(c.kind)
+		facet.SetValue(c.value)
+		facet.SetCount(c.matches)
+	}
+	p.SetFacets(facets)
+}
@@ -0,0 +1,114 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"github.com/Debian/dcs/regexp"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var maxGroupFiles = flag.Int("max_group_files",
+	10,
+	"Maximum number of files per source package which clients may request with the groupfiles= parameter when grouping results by package")
+
+// Returns the number of files per source package which the query asks for
+// with group=package (and groupfiles=<n>, by default 2, capped at
+// -max_group_files), or 0 if the results are not grouped.
+func groupFiles(query url.Values) int {
+	if query.Get("group") != "package" {
+		return 0
+	}
+	n, err := strconv.Atoi(query.Get("groupfiles"))
+	if err != nil || n < 1 {
+		n = 2
+	}
+	if n > *maxGroupFiles {
+		n = *maxGroupFiles
+	}
+	return n
+}
+
+// The matches of a source package, when grouping results by package.
+type packageGroup struct {
+	matches int
+	files   int
+
+	// The best match of each of the best files (by the ranking of that
+	// match).
+	best matchHeap
+}
+
+// Aggregates the matches of a query per source package, so that only the best
+// files of each package need to be sent (and stored by dcs-web), no matter how
+// many matches a query has. Safe for concurrent use.
+type packageGroups struct {
+	mu     sync.Mutex
+	files  int
+	groups map[string]*packageGroup
+}
+
+func newPackageGroups(files int) *packageGroups {
+	return &packageGroups{
+		files:  files,
+		groups: make(map[string]*packageGroup),
+	}
+}
+
+// add records the matches of a file (below -unpacked_path), after they were
+// ranked (and cut down to -matches_per_file, see Match.FileMatches).
+func (g *packageGroups) add(matches []regexp.Match) {
+	if len(matches) == 0 {
+		return
+	}
+	best := matches[0]
+	for _, match := range matches[1:] {
+		if match.Ranking > best.Ranking {
+			best = match
+		}
+	}
+	n := len(matches)
+	if best.FileMatches > n {
+		n = best.FileMatches
+	}
+	path := best.Path[len(*unpackedPath):]
+	pkg := path[:strings.Index(path, "/")]
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	group, ok := g.groups[pkg]
+	if !ok {
+		group = &packageGroup{}
+		g.groups[pkg] = group
+	}
+	group.matches += n
+	group.files++
+	if len(group.best) < g.files {
+		heap.Push(&group.best, best)
+	} else if best.Ranking > group.best[0].Ranking {
+		group.best[0] = best
+		heap.Fix(&group.best, 0)
+	}
+}
+
+// Returns the best match of the best files of each package, with
+// PackageMatches and PackageFiles set.
+func (g *packageGroups) matches() []regexp.Match {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var matches []regexp.Match
+	for _, group := range g.groups {
+		best := append([]regexp.Match(nil), group.best...)
+		sort.Slice(best, func(i, j int) bool { return best[i].Ranking > best[j].Ranking })
+		for _, match := range best {
+			match.PackageMatches = group.matches
+			match.PackageFiles = group.files
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,240 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/varz"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	manifestPath = flag.String("manifest_path",
+		"",
+		"If non-empty, path to the last known-good manifest of the package trees in -unpacked_path (e.g. /dcs-ssd/source-backend.manifest), which they are checked against at startup. The check walks all of -unpacked_path, so it is disabled by default. The manifest is refreshed whenever a new index is served")
+
+	manifestMaxDiscrepancy = flag.Float64("manifest_max_discrepancy",
+		0.05,
+		"Fraction of packages from the last known-good manifest which may be missing or changed before the startup check fails")
+
+	manifestStrict = flag.Bool("manifest_strict",
+		false,
+		"Refuse to start when the startup check fails instead of serving (degraded) with a warning")
+)
+
+var (
+	// Set to 1 (atomically) if the startup check failed and we are serving
+	// degraded results, until the manifest is refreshed.
+	manifestDegraded int32
+
+	// Serializes refreshManifest.
+	manifestMu sync.Mutex
+)
+
+// Returns whether the startup check failed, see checkManifest.
+func degraded() bool {
+	return atomic.LoadInt32(&manifestDegraded) == 1
+}
+
+// Describes a single package tree within -unpacked_path.
+type packageSummary struct {
+	Files int
+	Bytes int64
+
+	// FNV-64a over the relative path, size and modification time of every
+	// file, so that changes are detected without reading file contents.
+	Hash string
+}
+
+type manifest struct {
+	Created  time.Time
+	Packages map[string]packageSummary
+}
+
+func summarizePackage(dir string) packageSummary {
+	var paths []string
+	infos := make(map[string]os.FileInfo)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel := path[len(dir):]
+		paths = append(paths, rel)
+		infos[rel] = info
+		return nil
+	})
+	sort.Strings(paths)
+
+	var summary packageSummary
+	h := fnv.New64a()
+	for _, path := range paths {
+		info := infos[path]
+		summary.Files++
+		summary.Bytes += info.Size()
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().Unix())
+	}
+	summary.Hash = fmt.Sprintf("%x", h.Sum64())
+	return summary
+}
+
+func buildManifest(root string) (*manifest, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{
+		Created:  time.Now(),
+		Packages: make(map[string]packageSummary),
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		m.Packages[entry.Name()] = summarizePackage(filepath.Join(root, entry.Name()))
+	}
+	return m, nil
+}
+
+func loadManifest(path string) (*manifest, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *manifest) save(path string) error {
+	contents, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns the packages of old which are absent from, respectively differ in,
+// m. Packages which are new in m are fine.
+func (m *manifest) compare(old *manifest) (missing, changed []string) {
+	for pkg, summary := range old.Packages {
+		current, ok := m.Packages[pkg]
+		if !ok {
+			missing = append(missing, pkg)
+		} else if current != summary {
+			changed = append(changed, pkg)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(changed)
+	return missing, changed
+}
+
+// checkManifest compares the package trees in *unpackedPath against the last
+// known-good manifest. If they match closely enough, the current state becomes
+// the new known-good manifest. Otherwise, we either exit (-manifest_strict) or
+// continue serving with “manifest-degraded” set in /varz and reported by
+// /readyz.
+func checkManifest() {
+	varz.Set("manifest-degraded", 0)
+	if *manifestPath == "" {
+		return
+	}
+
+	t0 := time.Now()
+	current, err := buildManifest(*unpackedPath)
+	if err != nil {
+		log.Fatalf("Could not build manifest of %q: %v\n", *unpackedPath, err)
+	}
+	log.Printf("Built manifest of %d packages in %v\n", len(current.Packages), time.Since(t0))
+	varz.Set("manifest-packages", uint64(len(current.Packages)))
+
+	old, err := loadManifest(*manifestPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not load manifest %q, not comparing: %v\n", *manifestPath, err)
+	}
+	if old != nil {
+		missing, changed := current.compare(old)
+		varz.Set("manifest-missing-packages", uint64(len(missing)))
+		varz.Set("manifest-changed-packages", uint64(len(changed)))
+		log.Printf("Compared to the manifest from %v: %d packages missing, %d changed\n",
+			old.Created, len(missing), len(changed))
+		discrepancy := 0.0
+		if len(old.Packages) > 0 {
+			discrepancy = float64(len(missing)+len(changed)) / float64(len(old.Packages))
+		}
+		if discrepancy > *manifestMaxDiscrepancy {
+			for i, pkg := range missing {
+				if i == 10 {
+					log.Printf("  (and %d more missing)\n", len(missing)-i)
+					break
+				}
+				log.Printf("  missing: %s\n", pkg)
+			}
+			if *manifestStrict {
+				log.Fatalf("%.1f%% of packages are missing or changed, refusing to serve incomplete results\n", discrepancy*100)
+			}
+			log.Printf("WARNING: %.1f%% of packages are missing or changed, serving degraded results\n", discrepancy*100)
+			varz.Set("manifest-degraded", 1)
+			atomic.StoreInt32(&manifestDegraded, 1)
+			return
+		}
+	}
+
+	if err := current.save(*manifestPath); err != nil {
+		log.Printf("Could not save manifest %q: %v\n", *manifestPath, err)
+	}
+}
+
+// refreshManifest makes the current package trees the known-good manifest,
+// e.g. after a new index was loaded, so that the manifest does not drift
+// away from the package trees as the archive changes. This also ends serving
+// degraded results.
+func refreshManifest() {
+	if *manifestPath == "" {
+		return
+	}
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	current, err := buildManifest(*unpackedPath)
+	if err != nil {
+		log.Printf("Could not build manifest of %q: %v\n", *unpackedPath, err)
+		return
+	}
+	if err := current.save(*manifestPath); err != nil {
+		log.Printf("Could not save manifest %q: %v\n", *manifestPath, err)
+		return
+	}
+	varz.Set("manifest-packages", uint64(len(current.Packages)))
+	varz.Set("manifest-missing-packages", 0)
+	varz.Set("manifest-changed-packages", 0)
+	varz.Set("manifest-degraded", 0)
+	atomic.StoreInt32(&manifestDegraded, 0)
+	log.Printf("Refreshed the manifest of %d packages\n", len(current.Packages))
+}
+
+// Generation of the index which the manifest was last refreshed for.
+var manifestGeneration int64 = -1
+
+// Refreshes the manifest in the background when the index backend serves a
+// new index generation, i.e. after packages were imported.
+func maybeRefreshManifest(generation int64) {
+	old := atomic.SwapInt64(&manifestGeneration, generation)
+	if old != -1 && old != generation {
+		go refreshManifest()
+	}
+}
@@ -0,0 +1,214 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/proto"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	capn "github.com/glycerine/go-capnproto"
+	"google.golang.org/grpc/peer"
+)
+
+// Implements the SourceBackend gRPC service, see proto/service.go.
+type sourceBackend struct{}
+
+func logPrefix(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return fmt.Sprintf("[%s]", p.Addr)
+	}
+	return "[unknown]"
+}
+
+func (s *sourceBackend) Stream(req proto.SearchRequest, stream proto.SourceBackend_StreamServer) error {
+	return search(stream.Context(), logPrefix(stream.Context()), req, stream.Send)
+}
+
+func (s *sourceBackend) Search(ctx context.Context, req proto.SearchRequest) (proto.SearchReply, error) {
+	var (
+		matches    []proto.Match
+		filesTotal uint64
+		limitsHit  string
+	)
+	err := search(ctx, logPrefix(ctx), req, func(z proto.Z) error {
+		if z.Which() == proto.Z_PROGRESSUPDATE {
+			filesTotal = z.Progressupdate().Filestotal()
+			limitsHit = z.Progressupdate().Limitshit()
+		} else {
+			matches = append(matches, z.Match())
+		}
+		return nil
+	})
+	if err != nil {
+		return proto.SearchReply{}, err
+	}
+	seg := capn.NewBuffer(nil)
+	reply := proto.NewRootSearchReply(seg)
+	reply.SetFilestotal(filesTotal)
+	if limitsHit != "" {
+		reply.SetLimitshit(limitsHit)
+	}
+	list := proto.NewMatchList(seg, len(matches))
+	for i, m := range matches {
+		copyMatch(list.At(i), m)
+	}
+	reply.SetMatches(list)
+	return reply, nil
+}
+
+func copyMatch(dst, src proto.Match) {
+	dst.SetPath(src.Path())
+	dst.SetLine(src.Line())
+	dst.SetPackage(src.Package())
+	dst.SetCtxp2(src.Ctxp2())
+	dst.SetCtxp1(src.Ctxp1())
+	dst.SetContext(src.Context())
+	dst.SetCtxn1(src.Ctxn1())
+	dst.SetCtxn2(src.Ctxn2())
+	dst.SetPathrank(src.Pathrank())
+	dst.SetRanking(src.Ranking())
+	dst.SetWholeword(src.Wholeword())
+	dst.SetFilematches(src.Filematches())
+	dst.SetPackagematches(src.Packagematches())
+	dst.SetPackagefiles(src.Packagefiles())
+	dst.SetPopularity(src.Popularity())
+	dst.SetModtime(src.Modtime())
+	if src.Before().Len() > 0 {
+		dst.SetBefore(textList(dst.Segment, src.Before().ToArray()))
+	}
+	if src.After().Len() > 0 {
+		dst.SetAfter(textList(dst.Segment, src.After().ToArray()))
+	}
+	if n := src.Offsets().Len(); n > 0 {
+		offsets := proto.NewOffsetList(dst.Segment, n)
+		for i, o := range src.Offsets().ToArray() {
+			offsets.At(i).SetStart(o.Start())
+			offsets.At(i).SetEnd(o.End())
+			offsets.At(i).SetColumn(o.Column())
+			offsets.At(i).SetContextstart(o.Contextstart())
+			offsets.At(i).SetContextend(o.Contextend())
+		}
+		dst.SetOffsets(offsets)
+	}
+}
+
+// Returns the administrative state and the generation of the local index
+// backend.
+func indexBackendShardState(ctx context.Context) (string, int64, error) {
+	req, err := http.NewRequest("GET", "http://localhost:28081/shardstate", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	var reply struct {
+		State      string
+		Generation int64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return "", 0, err
+	}
+	return reply.State, reply.Generation, nil
+}
+
+// Reports this backend as healthy when its index backend answers. A failed
+// manifest check (see checkManifest) is mentioned in the status, but results
+// are still served.
+func (s *sourceBackend) Health(ctx context.Context, req proto.HealthRequest) (proto.HealthReply, error) {
+	seg := capn.NewBuffer(nil)
+	reply := proto.NewRootHealthReply(seg)
+	state, generation, err := indexBackendShardState(ctx)
+	if err != nil {
+		reply.SetStatus(fmt.Sprintf("index backend unavailable: %v", err))
+		return reply, nil
+	}
+	reply.SetHealthy(true)
+	reply.SetShardstate(state)
+	reply.SetGeneration(uint64(generation))
+	maybeRefreshManifest(generation)
+	if degraded() {
+		reply.SetStatus("serving degraded results, package trees do not match the manifest")
+	} else {
+		reply.SetStatus("ok")
+	}
+	return reply, nil
+}
+
+// Passes the request on to /replace of the local index backend.
+func (s *sourceBackend) ReloadShard(ctx context.Context, req proto.ReloadShardRequest) (proto.ReloadShardReply, error) {
+	u, err := url.Parse("http://localhost:28081/replace")
+	if err != nil {
+		return proto.ReloadShardReply{}, err
+	}
+	if shard := req.Shard(); shard != "" {
+		u.RawQuery = url.Values{"shard": []string{shard}}.Encode()
+	}
+	r, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return proto.ReloadShardReply{}, err
+	}
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return proto.ReloadShardReply{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return proto.ReloadShardReply{}, fmt.Errorf("index backend /replace: %s: %s", resp.Status, body)
+	}
+	go refreshManifest()
+	return proto.NewRootReloadShardReply(capn.NewBuffer(nil)), nil
+}
+
+// Handles /reload?shard=<name> like ReloadShard, for deploying a new shard
+// without dcs-web. Queries which are running finish on the old shard.
+func Reload(w http.ResponseWriter, r *http.Request) {
+	req := proto.NewRootReloadShardRequest(capn.NewBuffer(nil))
+	req.SetShard(r.FormValue("shard"))
+	if _, err := (&sourceBackend{}).ReloadShard(r.Context(), req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Healthz reports that the process is alive.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok\n")
+}
+
+// Readyz reports whether queries are answered, which requires the local index
+// backend to be ready. Serving degraded results (see checkManifest) is
+// reported, but does not make the backend unready.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequest("GET", "http://localhost:28081/readyz", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("index backend unavailable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		http.Error(w, fmt.Sprintf("index backend not ready: %s", body), http.StatusServiceUnavailable)
+		return
+	}
+	if degraded() {
+		fmt.Fprintf(w, "degraded: package trees do not match the manifest\n")
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
@@ -2,10 +2,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/Debian/dcs/feature"
 	"github.com/Debian/dcs/proto"
+	dcsquery "github.com/Debian/dcs/query"
 	"github.com/Debian/dcs/ranking"
 	"github.com/Debian/dcs/regexp"
 	"github.com/Debian/dcs/varz"
@@ -18,21 +21,57 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	capn "github.com/glycerine/go-capnproto"
+	"google.golang.org/grpc"
 )
 
 var (
 	listenAddress          = flag.String("listen_address", ":28082", "listen address ([host]:port)")
-	listenAddressStreaming = flag.String("listen_address_streaming", ":26082", "listen address for streaming queries using capnproto ([host]:port)")
+	listenAddressStreaming = flag.String("listen_address_streaming", ":26082", "listen address for the SourceBackend gRPC service ([host]:port)")
 	unpackedPath           = flag.String("unpacked_path",
 		"/dcs-ssd/unpacked/",
 		"Path to the unpacked sources")
+	longLines = flag.String("long_lines",
+		"truncate",
+		"How to show matches in lines longer than -max_line_length bytes, matching dcs-package-importer -long_lines: truncate cuts their snippets down to -max_line_length bytes around the match, skip_lines does not report them at all")
+	maxLineLength = flag.Int("max_line_length",
+		2000,
+		"Length (in bytes) above which a line is considered long, see -long_lines")
+	maxContextLines = flag.Int("max_context_lines",
+		10,
+		"Maximum number of lines before and after each match which clients may request with the context= parameter")
+	matchesPerFile = flag.Int("matches_per_file",
+		10,
+		"Maximum number of matches to return per file (along with the number of matches in the file), so that e.g. a generated file cannot flood the results. Queries with the matches:all keyword get all matches. 0 means no limit")
 )
 
+// Returns the number of lines before and after each match which the query
+// asks for with context=, capped at -max_context_lines. 0 means the default
+// of two lines (Ctxp2 to Ctxn2).
+func contextLines(query url.Values) int {
+	n, err := strconv.Atoi(query.Get("context"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	if n > *maxContextLines {
+		return *maxContextLines
+	}
+	return n
+}
+
+func textList(seg *capn.Segment, lines []string) capn.TextList {
+	list := seg.NewTextList(len(lines))
+	for i, line := range lines {
+		list.Set(i, line)
+	}
+	return list
+}
+
 type SourceReply struct {
 	// The number of the last used filename, needed for pagination
 	LastUsedFilename int
@@ -64,48 +103,15 @@ func File(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, file)
 }
 
+// Filters files according to the path: and -path: keywords. The package:,
+// -package:, filetype: and -filetype: keywords are handled by the index
+// backend already, see queryIndexBackend.
 func filterByKeywords(rewritten *url.URL, files []ranking.ResultPath) []ranking.ResultPath {
-	// The "package:" keyword, if specified.
-	pkg := rewritten.Query().Get("package")
-	// The "-package:" keywords, if specified.
-	npkgs := rewritten.Query()["npackage"]
 	// The "path:" keywords, if specified.
 	paths := rewritten.Query()["path"]
 	// The "-path" keywords, if specified.
 	npaths := rewritten.Query()["npath"]
 
-	// Filter the filenames if the "package:" keyword was specified.
-	if pkg != "" {
-		fmt.Printf("Filtering for package %q\n", pkg)
-		filtered := make(ranking.ResultPaths, 0, len(files))
-		for _, file := range files {
-			// XXX: Do we want this to be a regular expression match, too?
-			if file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]] != pkg {
-				continue
-			}
-
-			filtered = append(filtered, file)
-		}
-
-		files = filtered
-	}
-
-	// Filter the filenames if the "-package:" keyword was specified.
-	for _, npkg := range npkgs {
-		fmt.Printf("Excluding matches for package %q\n", npkg)
-		filtered := make(ranking.ResultPaths, 0, len(files))
-		for _, file := range files {
-			// XXX: Do we want this to be a regular expression match, too?
-			if file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]] == npkg {
-				continue
-			}
-
-			filtered = append(filtered, file)
-		}
-
-		files = filtered
-	}
-
 	for _, path := range paths {
 		fmt.Printf("Filtering for path %q\n", path)
 		pathRegexp, err := regexp.Compile(path)
@@ -165,86 +171,255 @@ func filterByKeywords(rewritten *url.URL, files []ranking.ResultPath) []ranking.
 	return files
 }
 
-func queryIndexBackend(query string) ([]string, error) {
-	var filenames []string
+// Returns the files which possibly match query and are in the packages and
+// languages requested in rewritten (see the query package) and, for line:full
+// queries, have lines of a fitting length, grouped into files
+// with identical contents (see dcs-package-importer -dedup).
+func queryIndexBackend(ctx context.Context, query string, rewritten url.Values) ([][]string, error) {
+	var filenames [][]string
+	err := requestIndexBackend(ctx, query, rewritten, nil, &filenames)
+	return filenames, err
+}
+
+// Like queryIndexBackend, but also returns the modification times of the
+// files (in seconds since the Unix epoch) according to the file metadata of
+// the index, as far as it has them.
+func queryIndexBackendModTimes(ctx context.Context, query string, rewritten url.Values) ([][]string, map[string]int64, error) {
+	var reply struct {
+		Files    [][]string
+		ModTimes map[string]int64
+	}
+	err := requestIndexBackend(ctx, query, rewritten, url.Values{"modtimes": []string{"1"}}, &reply)
+	return reply.Files, reply.ModTimes, err
+}
+
+// Sends query (with the keywords of rewritten and params) to the local index
+// backend and decodes its JSON reply into reply.
+func requestIndexBackend(ctx context.Context, query string, rewritten, params url.Values, reply interface{}) error {
 	u, err := url.Parse("http://localhost:28081/index")
 	if err != nil {
-		return filenames, err
+		return err
 	}
 	q := u.Query()
 	q.Set("q", query)
+	q.Set("dedup", "1")
+	for _, key := range []string{"package", "npackage", "filetype", "nfiletype", "line"} {
+		q[key] = rewritten[key]
+	}
+	for key, values := range params {
+		q[key] = values
+	}
 	u.RawQuery = q.Encode()
-	resp, err := http.Get(u.String())
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return filenames, err
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
 	}
 
 	if resp.StatusCode != 200 {
-		return filenames, fmt.Errorf("Expected HTTP 200, got %q", resp.Status)
+		return fmt.Errorf("Expected HTTP 200, got %q", resp.Status)
 	}
 	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(&filenames); err != nil {
-		return filenames, err
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// Returns the modification time of the file (below -unpacked_path) in seconds
+// since the Unix epoch, from modTimes (see queryIndexBackendModTimes) or, for
+// files which the index has no metadata of, from the file system.
+func modTime(modTimes map[string]int64, file string) int64 {
+	if mtime, ok := modTimes[file]; ok {
+		return mtime
+	}
+	fi, err := os.Stat(path.Join(*unpackedPath, file))
+	if err != nil {
+		return 0
+	}
+	return fi.ModTime().Unix()
+}
+
+// Returns the given paths in the packages and languages requested in
+// rewritten, in the same format as queryIndexBackend. Duplicates are not
+// known, so each file is its own group.
+func givenFiles(paths []string, rewritten url.Values) [][]string {
+	q := dcsquery.FromValues(rewritten)
+	groups := make([][]string, 0, len(paths))
+	for _, path := range paths {
+		if !q.MatchesPackage(path) {
+			continue
+		}
+		if q.FiltersLanguages() && !q.MatchesName(path) {
+			continue
+		}
+		groups = append(groups, []string{path})
 	}
+	return groups
+}
+
+// Passes requests to /indexstats on to the local index backend, so that the
+// statistics of all shards can be collected from the source-backends.
+func IndexStats(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse("http://localhost:28081/indexstats")
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.RawQuery = r.URL.RawQuery
+	resp, err := http.Get(u.String())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not query index backend: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Splits files (sorted by rank) into the files which need to be searched and
+// their duplicates, i.e. the files which have the same contents according to
+// group, keyed by the path of the file which is searched instead.
+func splitDuplicates(files ranking.ResultPaths, group map[string]int) (ranking.ResultPaths, map[string]ranking.ResultPaths) {
+	searched := make(map[int]string)
+	duplicates := make(map[string]ranking.ResultPaths)
+	unique := files[:0]
+	for _, file := range files {
+		g := group[file.Path]
+		if first, ok := searched[g]; ok {
+			duplicates[first] = append(duplicates[first], file)
+			continue
+		}
+		searched[g] = file.Path
+		unique = append(unique, file)
+	}
+	return unique, duplicates
+}
+
+// Stores match (of a file below -unpacked_path) in m.
+func setMatch(m proto.Match, match regexp.Match) {
+	m.SetPath(match.Path[len(*unpackedPath):])
+	m.SetLine(uint32(match.Line))
+	m.SetPackage(m.Path()[:strings.Index(m.Path(), "/")])
+	m.SetCtxp2(match.Ctxp2)
+	m.SetCtxp1(match.Ctxp1)
+	m.SetContext(match.Context)
+	m.SetCtxn1(match.Ctxn1)
+	m.SetCtxn2(match.Ctxn2)
+	m.SetPathrank(match.PathRank)
+	m.SetRanking(match.Ranking)
+	m.SetWholeword(match.WholeWord)
+	if len(match.Before) > 0 {
+		m.SetBefore(textList(m.Segment, match.Before))
+	}
+	if len(match.After) > 0 {
+		m.SetAfter(textList(m.Segment, match.After))
+	}
+	m.SetFilematches(uint32(match.FileMatches))
+	m.SetPackagematches(uint32(match.PackageMatches))
+	m.SetPackagefiles(uint32(match.PackageFiles))
+	m.SetPopularity(match.Popularity)
+	m.SetModtime(uint64(match.ModTime))
+	if len(match.Offsets) > 0 {
+		offsets := proto.NewOffsetList(m.Segment, len(match.Offsets))
+		for i, o := range match.Offsets {
+			dst := offsets.At(i)
+			dst.SetStart(uint32(o.Start))
+			dst.SetEnd(uint32(o.End))
+			dst.SetColumn(uint32(o.Column))
+			dst.SetContextstart(uint32(o.ContextStart))
+			dst.SetContextend(uint32(o.ContextEnd))
+		}
+		m.SetOffsets(offsets)
+	}
+}
 
-	return filenames, nil
+// Sends match (of a file below -unpacked_path) as a result.
+func sendMatch(send func(proto.Z) error, sendMu *sync.Mutex, match regexp.Match) error {
+	// TODO: ideally, we’d get capn buffers from grep.File(), let’s do that after profiling the decoding performance
+	seg := capn.NewBuffer(nil)
+	z := proto.NewRootZ(seg)
+	m := proto.NewMatch(seg)
+	setMatch(m, match)
+	z.SetMatch(m)
+	sendMu.Lock()
+	defer sendMu.Unlock()
+	return send(z)
 }
 
-func sendProgressUpdate(conn net.Conn, connMu *sync.Mutex, filesProcessed, filesTotal int) (int64, error) {
+// Sends a progress update, including the facets found so far unless facets
+// is nil.
+func sendProgressUpdate(send func(proto.Z) error, sendMu *sync.Mutex, filesProcessed, filesTotal int, limitsHit string, facets *facetCounts) error {
 	seg := capn.NewBuffer(nil)
 	z := proto.NewRootZ(seg)
 	p := proto.NewProgressUpdate(seg)
 	p.SetFilesprocessed(uint64(filesProcessed))
 	p.SetFilestotal(uint64(filesTotal))
-	z.SetProgressupdate(p)
-	connMu.Lock()
-	defer connMu.Unlock()
-	return seg.WriteToPacked(conn)
-}
-
-// Reads a single JSON request from the TCP connection, performs the search and
-// sends results back over the TCP connection as they appear.
-func streamingQuery(conn net.Conn) {
-	defer conn.Close()
-	connMu := new(sync.Mutex)
-	logprefix := fmt.Sprintf("[%s]", conn.RemoteAddr().String())
-
-	type sourceRequest struct {
-		Query string
-		// Rewritten URL (after RewriteQuery()) with all the parameters that
-		// are relevant for ranking.
-		URL string
+	if limitsHit != "" {
+		p.SetLimitshit(limitsHit)
 	}
-
-	var r sourceRequest
-	if err := json.NewDecoder(conn).Decode(&r); err != nil {
-		log.Printf("%s Could not parse JSON request: %v\n", logprefix, err)
-		return
+	if facets != nil {
+		facets.set(p, *maxFacetValues)
 	}
+	z.SetProgressupdate(p)
+	sendMu.Lock()
+	defer sendMu.Unlock()
+	return send(z)
+}
 
-	logprefix = fmt.Sprintf("%s [%q]", logprefix, r.Query)
+// Performs the search described by req and passes progress updates and
+// results to send as they appear. send is not called concurrently. The search
+// stops early when ctx is done, e.g. because dcs-web cancelled the query, or
+// when it exceeds its budget (see queryBudget), in which case the last
+// progress update says which limit was hit.
+func search(ctx context.Context, logprefix string, req proto.SearchRequest, send func(proto.Z) error) error {
+	sendMu := new(sync.Mutex)
+	query := req.Query()
+	logprefix = fmt.Sprintf("%s [%q]", logprefix, query)
+	budget := newQueryBudget(req)
+	parentCtx := ctx
+	ctx = budget.start(parentCtx)
+	defer budget.stop()
 
-	// Ask the local index backend for all the filenames.
-	filenames, err := queryIndexBackend(r.Query)
+	// Parse the (rewritten) URL to extract all ranking options/keywords.
+	rewritten, err := url.Parse(req.Url())
 	if err != nil {
-		log.Printf("%s Error querying index backend for query %q: %v\n", logprefix, r.Query, err)
-		return
+		return err
 	}
 
-	// Parse the (rewritten) URL to extract all ranking options/keywords.
-	rewritten, err := url.Parse(r.URL)
-	if err != nil {
-		log.Fatal(err)
+	// Ask the local index backend for all the filenames, unless dcs-web
+	// already knows which files to search (when narrowing down the results
+	// of an earlier query).
+	// Results sorted by modification time need the modification times from
+	// the file metadata of the index (see modTime).
+	order := dcsquery.FromValues(rewritten.Query()).Sort
+	var groups [][]string
+	var modTimes map[string]int64
+	if paths := req.Files(); paths.Len() > 0 {
+		groups = givenFiles(paths.ToArray(), rewritten.Query())
+	} else if order == dcsquery.SortModTime {
+		groups, modTimes, err = queryIndexBackendModTimes(ctx, query, rewritten.Query())
+		if err != nil {
+			return fmt.Errorf("querying index backend: %v", err)
+		}
+	} else {
+		groups, err = queryIndexBackend(ctx, query, rewritten.Query())
+		if err != nil {
+			return fmt.Errorf("querying index backend: %v", err)
+		}
 	}
 	rankingopts := ranking.RankingOptsFromQuery(rewritten.Query())
 
 	// Rank all the paths.
-	files := make(ranking.ResultPaths, 0, len(filenames))
-	for _, filename := range filenames {
-		result := ranking.ResultPath{Path: filename}
-		result.Rank(&rankingopts)
-		if result.Ranking > -1 {
-			files = append(files, result)
+	files := make(ranking.ResultPaths, 0, len(groups))
+	group := make(map[string]int)
+	for idx, filenames := range groups {
+		for _, filename := range filenames {
+			result := ranking.ResultPath{Path: filename}
+			result.Rank(&rankingopts)
+			if result.Ranking > -1 {
+				files = append(files, result)
+				group[filename] = idx
+			}
 		}
 	}
 
@@ -256,24 +431,37 @@ func streamingQuery(conn net.Conn) {
 	// sorting the list of potential files first.
 	sort.Sort(files)
 
-	re, err := regexp.Compile(r.Query)
+	// Files with identical contents only need to be searched once. Their
+	// matches are sent for each of them.
+	files, duplicates := splitDuplicates(files, group)
+
+	if budget.maxFiles > 0 && uint64(len(files)) > budget.maxFiles {
+		log.Printf("%s searching only the best %d of %d files\n", logprefix, budget.maxFiles, len(files))
+		files = files[:budget.maxFiles]
+		budget.record("files")
+	}
+
+	// Queries which combine terms with AND, OR and NOT need to be searched
+	// for each term.
+	expr, err := dcsquery.ParseExpr(query)
 	if err != nil {
-		log.Printf("%s Could not compile regexp: %v\n", logprefix, err)
-		return
+		return fmt.Errorf("parsing query: %v", err)
+	}
+	if _, err := newGreps(query, expr, regexp.Grep{}); err != nil {
+		return fmt.Errorf("compiling regexp: %v", err)
 	}
 
-	log.Printf("%s regexp = %q, %d possible files\n", logprefix, re, len(files))
+	log.Printf("%s regexp = %q, %d possible files\n", logprefix, query, len(files))
 
 	// Send the first progress update so that clients know how many files are
 	// going to be searched.
-	if _, err := sendProgressUpdate(conn, connMu, 0, len(files)); err != nil {
-		log.Printf("%s %v\n", logprefix, err)
-		return
+	if err := sendProgressUpdate(send, sendMu, 0, len(files), "", nil); err != nil {
+		return err
 	}
 
 	// The tricky part here is “flow control”: if we just start grepping like
 	// crazy, we will eventually run out of memory because all our writes are
-	// blocked on the connection (and the goroutines need to keep the write
+	// blocked on the stream (and the goroutines need to keep the write
 	// buffer in memory until the write is done).
 	//
 	// So instead, we start 1000 worker goroutines and feed them work through a
@@ -282,10 +470,25 @@ func streamingQuery(conn net.Conn) {
 	work := make(chan ranking.ResultPath)
 	progress := make(chan int)
 
+	// Queries which only need the best matches get them in the end, instead
+	// of all matches as they are found.
+	var top *topMatches
+	if k := topK(rewritten.Query()); k > 0 {
+		top = newTopMatches(k)
+	}
+	// Likewise for queries whose results are grouped by package, which get
+	// the best files of each package.
+	var byPackage *packageGroups
+	if n := groupFiles(rewritten.Query()); n > 0 {
+		byPackage = newPackageGroups(n)
+		top = nil
+	}
+	facets := newFacetCounts()
+
 	var wg sync.WaitGroup
 	// We add the additional 1 for the progress updater goroutine. It also
 	// needs to be done before we can return, otherwise it will try to use the
-	// (already closed) network connection, which is a fatal error.
+	// (already finished) stream.
 	wg.Add(len(files) + 1)
 
 	go func() {
@@ -305,7 +508,7 @@ func streamingQuery(conn net.Conn) {
 			cnt += add
 
 			if time.Since(lastProgressUpdate) > progressInterval {
-				if _, err := sendProgressUpdate(conn, connMu, cnt, len(files)); err != nil {
+				if err := sendProgressUpdate(send, sendMu, cnt, len(files), "", facets); err != nil {
 					if !errorShown {
 						log.Printf("%s %v\n", logprefix, err)
 						// We need to read the 'progress' channel, so we cannot
@@ -318,7 +521,22 @@ func streamingQuery(conn net.Conn) {
 			}
 		}
 
-		if _, err := sendProgressUpdate(conn, connMu, len(files), len(files)); err != nil {
+		// The best matches need to be sent before the last progress update,
+		// after which dcs-web considers this backend done.
+		var best []regexp.Match
+		if top != nil {
+			best = top.sorted()
+		} else if byPackage != nil {
+			best = byPackage.matches()
+		}
+		for _, match := range best {
+			if err := sendMatch(send, sendMu, match); err != nil {
+				log.Printf("%s %v\n", logprefix, err)
+				break
+			}
+		}
+
+		if err := sendProgressUpdate(send, sendMu, len(files), len(files), budget.limitsHit(ctx), facets); err != nil {
 			log.Printf("%s %v\n", logprefix, err)
 		}
 		close(progress)
@@ -326,7 +544,49 @@ func streamingQuery(conn net.Conn) {
 		wg.Done()
 	}()
 
-	querystr := ranking.NewQueryStr(r.Query)
+	querystr := ranking.NewQueryStr(query)
+	perFile := *matchesPerFile
+	if dcsquery.FromValues(rewritten.Query()).AllMatches {
+		perFile = 0
+	}
+
+	// Adds the ranking signals which depend on the query to file.
+	rankPath := func(file *ranking.ResultPath) {
+		sourcePkgName := file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]]
+		if rankingopts.Pathmatch {
+			file.Ranking += querystr.Match(&file.Path)
+		}
+		if rankingopts.Sourcepkgmatch {
+			file.Ranking += querystr.Match(&sourcePkgName)
+		}
+		if rankingopts.Weighted {
+			file.Ranking += 0.1460 * querystr.Match(&file.Path)
+			file.Ranking += 0.0008 * querystr.Match(&sourcePkgName)
+		}
+	}
+
+	// The best file is searched first. Its ranking scales the signals of
+	// the lines (see ranking.NewRanker), which makes them comparable across
+	// queries.
+	var bestPathRank float32
+	if len(files) > 0 {
+		best := files[0]
+		rankPath(&best)
+		bestPathRank = best.Ranking
+	}
+	ranker := ranking.NewRanker(rankingopts, &querystr, bestPathRank)
+	rank := func(file *ranking.ResultPath, match *regexp.Match) {
+		match.PathRank = file.Ranking
+		match.WholeWord = querystr.WholeWord(match.Context)
+		match.Ranking = ranker.Rank(&ranking.Candidate{File: file, Match: match})
+		// dcs-web sorts the results of all source backends by these.
+		switch order {
+		case dcsquery.SortPopularity:
+			match.Popularity = ranking.Popularity(file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]])
+		case dcsquery.SortModTime:
+			match.ModTime = modTime(modTimes, file.Path)
+		}
+	}
 
 	numWorkers := 1000
 	if len(files) < 1000 {
@@ -334,69 +594,81 @@ func streamingQuery(conn net.Conn) {
 	}
 	for i := 0; i < numWorkers; i++ {
 		go func() {
-			re, err := regexp.Compile(r.Query)
+			greps, err := newGreps(query, expr, regexp.Grep{
+				Stdout:        os.Stdout,
+				Stderr:        os.Stderr,
+				MaxLineLen:    *maxLineLength,
+				SkipLongLines: *longLines == "skip_lines",
+				Done:          ctx.Done(),
+				ContextLines:  contextLines(rewritten.Query()),
+			})
 			if err != nil {
 				log.Printf("%s\n", err)
 				return
 			}
 
-			grep := regexp.Grep{
-				Regexp: re,
-				Stdout: os.Stdout,
-				Stderr: os.Stderr,
-			}
-
 			for file := range work {
-				sourcePkgName := file.Path[file.SourcePkgIdx[0]:file.SourcePkgIdx[1]]
-				if rankingopts.Pathmatch {
-					file.Ranking += querystr.Match(&file.Path)
-				}
-				if rankingopts.Sourcepkgmatch {
-					file.Ranking += querystr.Match(&sourcePkgName)
-				}
-				if rankingopts.Weighted {
-					file.Ranking += 0.1460 * querystr.Match(&file.Path)
-					file.Ranking += 0.0008 * querystr.Match(&sourcePkgName)
+				// Once the query is cancelled (or sending failed, which
+				// also ends the call), the remaining files are only
+				// counted so that all goroutines exit cleanly.
+				if ctx.Err() != nil {
+					progress <- 1
+					wg.Done()
+					continue
 				}
+				rankPath(&file)
 
 				// TODO: figure out how to safely clone a dcs/regexp
-				matches := grep.File(path.Join(*unpackedPath, file.Path))
+				var matches []regexp.Match
+				if expr != nil {
+					matches = grepExpr(greps, expr, path.Join(*unpackedPath, file.Path), budget)
+				} else {
+					matches = grepFile(&greps[0], path.Join(*unpackedPath, file.Path), budget)
+				}
+				if perFile > 0 && len(matches) > perFile {
+					total := len(matches)
+					matches = matches[:perFile]
+					for i := range matches {
+						matches[i].FileMatches = total
+					}
+				}
+				for i := range matches {
+					rank(&file, &matches[i])
+				}
+				n := len(matches)
+				for _, dup := range duplicates[file.Path] {
+					rankPath(&dup)
+					for _, match := range matches[:n] {
+						match.Path = path.Join(*unpackedPath, dup.Path)
+						rank(&dup, &match)
+						matches = append(matches, match)
+					}
+				}
+				if n > 0 {
+					for i := 0; i < len(matches); i += n {
+						facets.add(matches[i : i+n])
+					}
+				}
+				if byPackage != nil && n > 0 {
+					// The matches of each file (see above) are only sent
+					// in the end.
+					for i := 0; i < len(matches); i += n {
+						byPackage.add(matches[i : i+n])
+					}
+					matches = nil
+				}
 				for _, match := range matches {
-					match.Ranking = ranking.PostRank(rankingopts, &match, &querystr)
-					match.PathRank = file.Ranking
-					//match.Path = match.Path[len(*unpackedPath):]
-					// NB: populating match.Ranking happens in
-					// cmd/dcs-web/querymanager because it depends on at least
-					// one other result.
-
-					// TODO: ideally, we’d get capn buffers from grep.File(), let’s do that after profiling the decoding performance
-					seg := capn.NewBuffer(nil)
-					z := proto.NewRootZ(seg)
-					m := proto.NewMatch(seg)
-					m.SetPath(match.Path[len(*unpackedPath):])
-					m.SetLine(uint32(match.Line))
-					m.SetPackage(m.Path()[:strings.Index(m.Path(), "/")])
-					m.SetCtxp2(match.Ctxp2)
-					m.SetCtxp1(match.Ctxp1)
-					m.SetContext(match.Context)
-					m.SetCtxn1(match.Ctxn1)
-					m.SetCtxn2(match.Ctxn2)
-					m.SetPathrank(match.PathRank)
-					m.SetRanking(match.Ranking)
-					z.SetMatch(m)
-
-					connMu.Lock()
-					if _, err := seg.WriteToPacked(conn); err != nil {
-						connMu.Unlock()
+					if !budget.takeMatch() {
+						break
+					}
+					if top != nil {
+						top.add(match)
+						continue
+					}
+					if err := sendMatch(send, sendMu, match); err != nil {
 						log.Printf("%s %v\n", logprefix, err)
-						// Drain the work channel, but without doing any work.
-						// This effectively exits the worker goroutine(s)
-						// cleanly.
-						for _ = range work {
-						}
 						break
 					}
-					connMu.Unlock()
 				}
 
 				progress <- 1
@@ -408,31 +680,51 @@ func streamingQuery(conn net.Conn) {
 
 	wg.Wait()
 
+	if err := parentCtx.Err(); err != nil {
+		log.Printf("%s Stopped: %v\n", logprefix, err)
+		return err
+	}
+	if hit := budget.limitsHit(ctx); hit != "" {
+		log.Printf("%s Sent partial results, exceeded the %s limit.\n", logprefix, hit)
+		return nil
+	}
 	log.Printf("%s Sent all results.\n", logprefix)
+	return nil
 }
 
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
+	if err := feature.Load(); err != nil {
+		log.Fatalf("Could not load feature flags: %v\n", err)
+	}
 	fmt.Println("Debian Code Search source-backend")
 
+	switch *longLines {
+	case "truncate", "skip_lines":
+	default:
+		log.Fatalf("Invalid -long_lines %q\n", *longLines)
+	}
+
+	checkManifest()
+
 	listener, err := net.Listen("tcp", *listenAddressStreaming)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	server := grpc.NewServer()
+	proto.RegisterSourceBackendServer(server, &sourceBackend{})
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Fatalf("Error accepting session: %v", err)
-			}
-
-			go streamingQuery(conn)
-		}
+		log.Fatal(server.Serve(listener))
 	}()
 
 	http.HandleFunc("/file", File)
+	http.HandleFunc("/indexstats", IndexStats)
+	http.HandleFunc("/reload", Reload)
+	http.HandleFunc("/healthz", Healthz)
+	http.HandleFunc("/readyz", Readyz)
 	http.HandleFunc("/varz", varz.Varz)
+	http.HandleFunc("/featurez", feature.Featurez)
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
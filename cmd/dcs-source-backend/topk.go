@@ -0,0 +1,69 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"container/heap"
+	"github.com/Debian/dcs/regexp"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Returns the number of best matches which the query asks for with topk=, or
+// 0 if it wants all of them.
+func topK(query url.Values) int {
+	k, err := strconv.Atoi(query.Get("topk"))
+	if err != nil || k < 0 {
+		return 0
+	}
+	return k
+}
+
+// A min-heap of matches by ranking, so that the worst match is removed first.
+type matchHeap []regexp.Match
+
+func (h matchHeap) Len() int            { return len(h) }
+func (h matchHeap) Less(i, j int) bool  { return h[i].Ranking < h[j].Ranking }
+func (h matchHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *matchHeap) Push(x interface{}) { *h = append(*h, x.(regexp.Match)) }
+func (h *matchHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Keeps the k best-ranked matches which are added to it. Safe for concurrent
+// use.
+type topMatches struct {
+	mu      sync.Mutex
+	k       int
+	matches matchHeap
+}
+
+func newTopMatches(k int) *topMatches {
+	return &topMatches{k: k}
+}
+
+func (t *topMatches) add(match regexp.Match) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.matches) < t.k {
+		heap.Push(&t.matches, match)
+		return
+	}
+	if match.Ranking > t.matches[0].Ranking {
+		t.matches[0] = match
+		heap.Fix(&t.matches, 0)
+	}
+}
+
+// Returns the matches, best first.
+func (t *topMatches) sorted() []regexp.Match {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sorted := append([]regexp.Match(nil), t.matches...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Ranking > sorted[j].Ranking })
+	return sorted
+}
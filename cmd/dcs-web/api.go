@@ -0,0 +1,527 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	dcsquery "github.com/Debian/dcs/query"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /api/v1/search is the supported way for programs to search, as opposed to
+// scraping /search or following the events of /instantws, whose format
+// changes along with the web interface. The schema of the v1 responses only
+// ever gets new fields; incompatible changes need a new version, served under
+// a new path and media type.
+
+// The media type of v1 responses. Clients which send it in their Accept
+// header get it back in the Content-Type, otherwise application/json is used.
+const apiV1MediaType = "application/vnd.dcs.v1+json"
+
+// Maximum number of results per page (see the page_size parameter).
+const maxAPIPageSize = 100
+
+// Names of JSONP callbacks (see the callback parameter), which are written
+// into the response as they are. The “_” parameter which jQuery adds to JSONP
+// requests against caching is ignored.
+var jsonpCallbackRe = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$.]{0,63}$`)
+
+// The echo of the query which a response belongs to.
+type apiQuery struct {
+	// The search term and keywords, as sent by the client.
+	Q string
+
+	// The regular expression which is searched for, i.e. Q without the
+	// keywords (and modified according to them, e.g. by case:no).
+	Regexp string
+
+	// The identifier of the query, as used by within: and in the URLs of
+	// the web interface.
+	QueryId string
+
+	// The (0-based) page of results in this response, i.e. the number of
+	// pages before it. With page_size, pages can have different sizes, so
+	// it is rounded up.
+	Page int
+
+	// The order of the results: “ranking” (the default), “path”,
+	// “popularity” or “modtime”, as requested with the sort parameter.
+	Sort string
+}
+
+// The position of a match within its line.
+type apiMatch struct {
+	// Byte offsets of the beginning and the end of the match within the line
+	// as it is in the file.
+	Start, End int
+
+	// Column (1-based, counting characters) at which the match begins.
+	Column int
+}
+
+type apiResult struct {
+	// The source package, e.g. “i3-wm”, and its version, e.g. “4.7-1”.
+	Package string
+	Version string
+
+	// The path of the file within the source package, e.g. “src/main.c”.
+	Path string
+
+	// The line (1-based) containing the match and the column (1-based,
+	// counting characters) at which its first match begins, or 0 if unknown.
+	Line   int
+	Column int
+
+	// The line containing the match and the lines around it, as plain text.
+	// Long lines are shortened around the match, with “…” marking what was
+	// cut off.
+	Context string
+	Before  []string
+	After   []string
+
+	// All matches within the line (at most 64), which Column is the first
+	// of.
+	Matches []apiMatch `json:",omitempty"`
+
+	// Number of matches in the file, if only some of them are in the
+	// results (see the matches:all keyword).
+	FileMatches int `json:",omitempty"`
+
+	// Results with a higher ranking are better. The values are only
+	// comparable within a query.
+	Ranking float32
+
+	// The popularity of the source package (with sort=popularity) and the
+	// modification time of the file in seconds since the Unix epoch (with
+	// sort=modtime), which the results are sorted by.
+	Popularity float32 `json:",omitempty"`
+	ModTime    int64   `json:",omitempty"`
+
+	// The label of the federated instance which found the result (see
+	// Federated), empty for results of this instance.
+	Origin string `json:",omitempty"`
+}
+
+type apiStats struct {
+	// Number of results, packages with results and pages of results.
+	Results  int
+	Packages int
+	Pages    int
+
+	// Number of files which were searched.
+	FilesSearched int
+
+	// How long the query took, in milliseconds.
+	DurationMillis int64
+
+	// Limits which the query exceeded on the source backends, if any, in
+	// which case the results are incomplete.
+	LimitsHit []string `json:",omitempty"`
+}
+
+type apiSearchResponse struct {
+	// Always 1 for /api/v1.
+	Version int
+
+	Query   apiQuery
+	Results []apiResult
+
+	// Fetches the next page of results when passed as page_token, along
+	// with the same q. Empty on the last page. The token is a cursor: the
+	// next page starts after the last result of this one, even if the
+	// results changed in the meantime (e.g. because the index was updated).
+	NextPageToken string `json:",omitempty"`
+
+	Stats apiStats
+
+	// Number of matches per “package”, “language” and “directory”
+	// (top-level directory within the package), the most frequent values
+	// first. Add the Keyword of a value to q to narrow the query down to it.
+	Facets map[string][]Facet `json:",omitempty"`
+
+	// Queries similar to q which might have results, when q has none (e.g.
+	// with a misspelled identifier or package name corrected).
+	DidYouMean []string `json:",omitempty"`
+
+	// How the other deployments of Debian Code Search which this one
+	// federates to answered the query. Up to half of the first page are
+	// their results (see mergeFederated), the rest are available from them
+	// directly. Stats and the pagination only cover the results of this
+	// deployment.
+	Federated []apiFederatedStatus `json:",omitempty"`
+}
+
+type apiErrorResponse struct {
+	Version int
+
+	// One of “invalidquery”, “invalidpagetoken”, “notacceptable”,
+	// “quotaexceeded” (the API key got all the results it may get today) or
+	// “failed”.
+	Error string
+
+	// Human-readable explanation.
+	Message string
+}
+
+// Returns the media types (lower-case, without parameters) which the Accept
+// header of r lists, except for the ones it refuses with q=0.
+func acceptedMediaTypes(r *http.Request) []string {
+	var names []string
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		refused := false
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				refused = err == nil && q == 0
+			}
+		}
+		if name != "" && !refused {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the media type to respond with according to the Accept header of
+// r, or "" if the client accepts none of them.
+func apiMediaType(r *http.Request) string {
+	if r.Header.Get("Accept") == "" {
+		return "application/json"
+	}
+	mediaType := ""
+	for _, name := range acceptedMediaTypes(r) {
+		switch name {
+		case apiV1MediaType:
+			return apiV1MediaType
+		case "application/json", "application/*", "*/*":
+			mediaType = "application/json"
+		}
+	}
+	return mediaType
+}
+
+func newAPIResult(result Result) apiResult {
+	unescape := func(lines []string) []string {
+		unescaped := make([]string, 0, len(lines))
+		for _, line := range lines {
+			unescaped = append(unescaped, html.UnescapeString(line))
+		}
+		return unescaped
+	}
+	before := []string{result.Ctxp2, result.Ctxp1}
+	after := []string{result.Ctxn1, result.Ctxn2}
+	if len(result.Before) > 0 || len(result.After) > 0 {
+		before, after = result.Before, result.After
+	}
+	pkg, path := result.Path, ""
+	if slash := strings.Index(pkg, "/"); slash > -1 {
+		pkg, path = pkg[:slash], pkg[slash+1:]
+	}
+	version := ""
+	if underscore := strings.Index(pkg, "_"); underscore > -1 {
+		pkg, version = pkg[:underscore], pkg[underscore+1:]
+	}
+	r := apiResult{
+		Package:     pkg,
+		Version:     version,
+		Path:        path,
+		Line:        result.Line,
+		Context:     html.UnescapeString(result.Context),
+		Before:      unescape(before),
+		After:       unescape(after),
+		FileMatches: result.FileMatches,
+		Ranking:     result.Ranking,
+		Popularity:  result.Popularity,
+		ModTime:     result.ModTime,
+	}
+	for _, o := range result.Offsets {
+		r.Matches = append(r.Matches, apiMatch{Start: o.Start, End: o.End, Column: o.Column})
+	}
+	if len(r.Matches) > 0 {
+		r.Column = r.Matches[0].Column
+	}
+	return r
+}
+
+// Returns whether the query failed and the limits it exceeded, as sent to its
+// clients as events.
+func queryErrors(queryid string) (failed bool, limitsHit []string) {
+	stateMu.Lock()
+	events := state[queryid].events
+	stateMu.Unlock()
+	return eventErrors(events)
+}
+
+// Like queryErrors, but for the given events of a query.
+func eventErrors(events []event) (failed bool, limitsHit []string) {
+	for _, event := range events {
+		if !bytes.HasPrefix(event.data, []byte(`{"Type":"error"`)) {
+			continue
+		}
+		var e Error
+		if err := json.Unmarshal(event.data, &e); err != nil {
+			continue
+		}
+		switch e.ErrorType {
+		case "failed":
+			failed = true
+		case "limitshit":
+			// Each source backend reports the limits it exceeded.
+			seen := false
+			for _, limit := range limitsHit {
+				seen = seen || limit == e.Message
+			}
+			if !seen {
+				limitsHit = append(limitsHit, e.Message)
+			}
+		}
+	}
+	return failed, limitsHit
+}
+
+// Starts the query (unless its results are cached) and waits until all
+// source backends are done with it. Returns false if ctx (e.g. the context of
+// the client’s request) is done first.
+func awaitQuery(ctx context.Context, src, path, query string) (queryid string, ok bool) {
+	queryid = queryIdentifier(query)
+
+	cached := maybeStartQuery(queryid, src, query)
+	logAccess(src, path, query, cached)
+	stop := make(chan bool)
+	waited := make(chan error, 1)
+	go func() {
+		waited <- streamEvents(queryid, func([]byte) error { return nil }, stop)
+	}()
+	select {
+	case <-waited:
+		return queryid, true
+	case <-ctx.Done():
+		close(stop)
+		return queryid, false
+	}
+}
+
+// Reads the results which pointers point to from the temporary files of the
+// query.
+func readResults(queryid string, pointers []resultPointer) ([]Result, error) {
+	var buffer bytes.Buffer
+	if err := writeFromPointers(queryid, &buffer, pointers); err != nil {
+		return nil, fmt.Errorf("could not read results: %v", err)
+	}
+	var results []Result
+	if err := json.NewDecoder(&buffer).Decode(&results); err != nil {
+		return nil, fmt.Errorf("could not parse results from disk: %v", err)
+	}
+	return results, nil
+}
+
+// APISearchHandler handles
+// /api/v1/search?q=<query>[&page_token=<token>][&page_size=<n>] by running
+// the query (or using its cached results) and responding with one page of
+// (by default 10) results as an apiSearchResponse, once all source backends
+// are done. With callback=<name>, the response is JSONP, i.e. a call of the
+// named function. Other parameters (e.g. context= or sort=) are passed on as
+// for /stream.
+func APISearchHandler(w http.ResponseWriter, r *http.Request) {
+	callback := r.URL.Query().Get("callback")
+	if callback != "" && !jsonpCallbackRe.MatchString(callback) {
+		http.Error(w, "Invalid callback name", http.StatusBadRequest)
+		return
+	}
+	writeJSON := func(mediaType string, status int, data interface{}) {
+		w.Header().Add("Vary", "Accept")
+		if callback != "" {
+			// Browsers do not run scripts of error responses, so JSONP
+			// callers always get status 200 and check the Error field.
+			// The comment keeps the response from starting with
+			// attacker-chosen bytes.
+			w.Header().Set("Content-Type", "application/javascript")
+			fmt.Fprintf(w, "/**/%s(", callback)
+			if err := json.NewEncoder(w).Encode(data); err != nil {
+				log.Printf("Could not write API response: %v\n", err)
+			}
+			fmt.Fprintf(w, ");\n")
+			return
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			log.Printf("Could not write API response: %v\n", err)
+		}
+	}
+	mediaType := apiMediaType(r)
+	if mediaType == "" {
+		writeJSON("application/json", http.StatusNotAcceptable, &apiErrorResponse{
+			Version: 1,
+			Error:   "notacceptable",
+			Message: "responses are available as application/json or " + apiV1MediaType,
+		})
+		return
+	}
+	writeError := func(status int, errorType, message string) {
+		writeJSON(mediaType, status, &apiErrorResponse{
+			Version: 1,
+			Error:   errorType,
+			Message: message,
+		})
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(http.StatusBadRequest, "invalidquery", "could not parse form data")
+		return
+	}
+	params := url.Values{}
+	for key, values := range r.Form {
+		if key != "page_token" && key != "page_size" && key != "callback" && key != "_" {
+			params[key] = values
+		}
+	}
+	query := params.Encode()
+	src := clientAddress(r)
+	if strings.TrimSpace(params.Get("q")) == "" {
+		writeError(http.StatusBadRequest, "invalidquery", "the q parameter is missing")
+		return
+	}
+	if err := validateQuery("?" + query); err != nil {
+		log.Printf("[%s] Query %q failed validation: %v\n", src, query, err)
+		writeError(http.StatusBadRequest, "invalidquery", err.Error())
+		return
+	}
+
+	pageSize := resultsPerPage
+	if size := r.Form.Get("page_size"); size != "" {
+		var err error
+		if pageSize, err = strconv.Atoi(size); err != nil || pageSize < 1 || pageSize > maxAPIPageSize {
+			writeError(http.StatusBadRequest, "invalidquery", fmt.Sprintf("page_size must be between 1 and %d", maxAPIPageSize))
+			return
+		}
+	}
+	queryHash := cursorQueryHash(query)
+	var cursor *resultCursor
+	if token := r.Form.Get("page_token"); token != "" {
+		c, err := parseCursor(token)
+		if err != nil {
+			writeError(http.StatusBadRequest, "invalidpagetoken", err.Error())
+			return
+		}
+		if c.queryHash != queryHash {
+			writeError(http.StatusBadRequest, "invalidpagetoken", "the page token belongs to a different query")
+			return
+		}
+		cursor = &c
+	}
+
+	recordResults, ok := checkQuota(r)
+	if !ok {
+		writeError(http.StatusTooManyRequests, "quotaexceeded", "the API key got all the results it may get today")
+		return
+	}
+
+	// Federated instances are queried at the same time as the source
+	// backends.
+	type federated struct {
+		results  []apiResult
+		statuses []apiFederatedStatus
+	}
+	federatedDone := make(chan federated, 1)
+	if cursor == nil {
+		go func() {
+			results, statuses := searchFederated(r, params, pageSize)
+			federatedDone <- federated{results, statuses}
+		}()
+	} else {
+		federatedDone <- federated{}
+	}
+
+	queryid, ok := awaitQuery(r.Context(), src, "/api/v1/search", query)
+	if !ok {
+		return
+	}
+
+	failed, limitsHit := queryErrors(queryid)
+	if failed {
+		writeError(http.StatusBadGateway, "failed", "the query failed on the source backends, please try again")
+		return
+	}
+
+	stateMu.Lock()
+	s := state[queryid]
+	stateMu.Unlock()
+	start := 0
+	if cursor != nil {
+		start = cursor.position(s.resultPointers)
+	}
+	end := start + pageSize
+	if end > len(s.resultPointers) {
+		end = len(s.resultPointers)
+	}
+	results, err := readResults(queryid, s.resultPointers[start:end])
+	if err != nil {
+		writeError(http.StatusInternalServerError, "failed", err.Error())
+		return
+	}
+
+	filesSearched := 0
+	s.filesMu.Lock()
+	for _, total := range s.filesTotal {
+		filesSearched += total
+	}
+	s.filesMu.Unlock()
+	response := apiSearchResponse{
+		Version: 1,
+		Query: apiQuery{
+			Q:       params.Get("q"),
+			Regexp:  dcsquery.Parse(params.Get("q")).Regexp,
+			QueryId: queryid,
+			Page:    (start + pageSize - 1) / pageSize,
+			Sort:    dcsquery.SortRanking,
+		},
+		Results: make([]apiResult, len(results)),
+		Stats: apiStats{
+			Results:        len(s.resultPointers),
+			Packages:       len(s.allPackagesSorted),
+			Pages:          (len(s.resultPointers) + pageSize - 1) / pageSize,
+			FilesSearched:  filesSearched,
+			DurationMillis: int64(s.ended.Sub(s.started) / time.Millisecond),
+			LimitsHit:      limitsHit,
+		},
+		Facets: mergedFacets(s),
+	}
+	if s.order != "" {
+		response.Query.Sort = s.order
+	}
+	for i, result := range results {
+		response.Results[i] = newAPIResult(result)
+	}
+	if f := <-federatedDone; len(f.statuses) > 0 {
+		response.Results = mergeFederated(response.Results, f.results, pageSize, response.Query.Sort)
+		// Results of this instance which no longer fit on the first page
+		// start the next one instead.
+		end = start
+		for _, result := range response.Results {
+			if result.Origin == "" {
+				end++
+			}
+		}
+		response.Federated = f.statuses
+	}
+	if len(s.resultPointers) == 0 {
+		response.DidYouMean = didYouMean(params.Get("q"))
+	}
+	if end < len(s.resultPointers) {
+		response.NextPageToken = cursorAfter(queryHash, s.order, s.resultPointers, end).String()
+	}
+	recordResults(len(response.Results))
+	writeJSON(mediaType, http.StatusOK, &response)
+}
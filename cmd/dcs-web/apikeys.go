@@ -0,0 +1,124 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/apikeys"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Records a request of the API key which r carries (if any). Returns false if
+// the daily result quota of the key is used up, in which case the request
+// must be refused. Otherwise, the returned function records how many results
+// the request got.
+func checkQuota(r *http.Request) (func(results int), bool) {
+	k, ok := requestAPIKey(r)
+	if !ok {
+		return func(int) {}, true
+	}
+	if !apiKeyStore.Request(k.Token) {
+		varz.Increment("quota-exceeded-api-key")
+		return nil, false
+	}
+	return func(results int) {
+		apiKeyStore.Results(k.Token, results)
+	}, true
+}
+
+// Parses the quotas of the form of /apikeys into k.
+func parseQuotas(r *http.Request, k *apikeys.Key) error {
+	k.Owner = strings.TrimSpace(r.PostFormValue("owner"))
+	if k.Owner == "" {
+		return fmt.Errorf("the owner is missing")
+	}
+	var err error
+	if rate := r.PostFormValue("rate"); rate != "" {
+		if k.Rate, err = strconv.ParseFloat(rate, 64); err != nil || k.Rate < 0 {
+			return fmt.Errorf("invalid rate %q", rate)
+		}
+	}
+	if burst := r.PostFormValue("burst"); burst != "" {
+		if k.Burst, err = strconv.Atoi(burst); err != nil || k.Burst < 0 {
+			return fmt.Errorf("invalid burst %q", burst)
+		}
+	}
+	if results := r.PostFormValue("daily_results"); results != "" {
+		if k.DailyResults, err = strconv.Atoi(results); err != nil || k.DailyResults < 0 {
+			return fmt.Errorf("invalid number of daily results %q", results)
+		}
+	}
+	k.Disabled = r.PostFormValue("disabled") != ""
+	return nil
+}
+
+// APIKeysHandler handles /apikeys by listing the API keys along with their
+// quotas and their usage today, and by issuing, updating and revoking keys
+// when an operator posts the forms of the page.
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if apiKeyStore == nil {
+		http.Error(w, "API keys are not enabled, see -api_keys_path", http.StatusNotFound)
+		return
+	}
+	issued := ""
+	if r.Method == "POST" {
+		var err error
+		switch action := r.PostFormValue("action"); action {
+		case "issue":
+			var k apikeys.Key
+			if err = parseQuotas(r, &k); err == nil {
+				if k, err = apiKeyStore.Issue(k); err == nil {
+					log.Printf("Issued API key %s… to %q\n", k.Token[:8], k.Owner)
+					issued = k.Token
+				}
+			}
+		case "update":
+			k := apikeys.Key{Token: r.PostFormValue("key")}
+			if err = parseQuotas(r, &k); err == nil {
+				err = apiKeyStore.Update(k)
+			}
+		case "revoke":
+			err = apiKeyStore.Revoke(r.PostFormValue("key"))
+		default:
+			err = fmt.Errorf("unknown action %q", action)
+		}
+		if err == apikeys.ErrNoSuchKey {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not %s the API key: %v", r.PostFormValue("action"), err), http.StatusBadRequest)
+			return
+		}
+		if issued == "" {
+			http.Redirect(w, r, "/apikeys", http.StatusFound)
+			return
+		}
+	}
+
+	type keyUsage struct {
+		apikeys.Key
+		Usage apikeys.Usage
+	}
+	keys := apiKeyStore.List()
+	usages := make([]keyUsage, len(keys))
+	for idx, k := range keys {
+		usages[idx] = keyUsage{k, apiKeyStore.Usage(k.Token)}
+	}
+	// The page contains all keys.
+	w.Header().Set("Cache-Control", "no-store")
+	if err := common.ExecuteTemplate(w, r, "apikeys.html", map[string]interface{}{
+		"keys":         usages,
+		"issued":       issued,
+		"defaultrate":  *apiKeyRateLimit,
+		"defaultburst": *apiKeyRateLimitBurst,
+		"csrftoken":    csrfToken(w, r),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,240 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// API keys, which identify heavy programmatic users of /api/v1 so that they
+// can be given their own rate limits and quotas instead of being blocked.
+package apikeys
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchKey = errors.New("no such API key")
+
+// An API key and the quotas of the client it was issued to. Zero quotas mean
+// the defaults of dcs-web (see -api_key_rate_limit).
+type Key struct {
+	// The key itself, which clients send in the X-Api-Key header.
+	Token string
+
+	// Who the key was issued to, e.g. “Jane Doe <jane@example.org>” or the
+	// name of a project, so that they can be contacted.
+	Owner string
+
+	Created time.Time
+
+	// Number of requests per second which the client may send on average,
+	// and at once.
+	Rate  float64
+	Burst int
+
+	// Number of results which the client may get per day (UTC). 0 means no
+	// limit.
+	DailyResults int
+
+	// Disabled keys are treated like requests without a key.
+	Disabled bool
+}
+
+// The usage of a key on one day. Usage is only kept in memory, so it starts
+// from scratch when dcs-web restarts.
+type Usage struct {
+	// The day (UTC) in the format 2006-01-02.
+	Day      string
+	Requests int
+	Results  int
+}
+
+// API keys, stored as a JSON file.
+type Store struct {
+	path string
+
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	keys  map[string]*Key
+	usage map[string]*Usage
+}
+
+// Opens the API keys stored in path. The file is created when the first key
+// is issued. Files which list one key per line (the format of earlier
+// versions) are read as well, their keys get the default quotas.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		now:   time.Now,
+		keys:  make(map[string]*Key),
+		usage: make(map[string]*Usage),
+	}
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(contents, &s.keys); err != nil {
+			return nil, fmt.Errorf("could not parse %q: %v", path, err)
+		}
+		return s, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		s.keys[key] = &Key{Token: key}
+	}
+	return s, scanner.Err()
+}
+
+// Writes all keys to a temporary file, which then replaces the file, so that
+// a crash does not leave a truncated file behind. The file contains secrets,
+// so only its owner may read it. Must be called with s.mu held.
+func (s *Store) save() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(s.keys); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Issues a new key with the given owner and quotas (Token and Created are
+// ignored) and returns it.
+func (s *Store) Issue(k Key) (Key, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return Key{}, err
+	}
+	k.Token = hex.EncodeToString(random[:])
+	k.Created = s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.Token] = &k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.Token)
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// Replaces the owner, quotas and Disabled of the key k.Token.
+func (s *Store) Update(k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.keys[k.Token]
+	if !ok {
+		return ErrNoSuchKey
+	}
+	old := *existing
+	k.Created = existing.Created
+	*existing = k
+	if err := s.save(); err != nil {
+		*existing = old
+		return err
+	}
+	return nil
+}
+
+// Revokes the key, i.e. deletes it.
+func (s *Store) Revoke(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[key]
+	if !ok {
+		return ErrNoSuchKey
+	}
+	delete(s.keys, key)
+	if err := s.save(); err != nil {
+		s.keys[key] = k
+		return err
+	}
+	delete(s.usage, key)
+	return nil
+}
+
+// Returns the key, unless it does not exist or is disabled.
+func (s *Store) Get(key string) (Key, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[key]
+	if !ok || k.Disabled {
+		return Key{}, false
+	}
+	return *k, true
+}
+
+// Returns all keys, the oldest first.
+func (s *Store) List() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].Token < keys[j].Token
+	})
+	return keys
+}
+
+// Returns the usage of key today. Must be called with s.mu held.
+func (s *Store) today(key string) *Usage {
+	day := s.now().UTC().Format("2006-01-02")
+	u, ok := s.usage[key]
+	if !ok || u.Day != day {
+		u = &Usage{Day: day}
+		s.usage[key] = u
+	}
+	return u
+}
+
+// Returns the usage of key today.
+func (s *Store) Usage(key string) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.today(key)
+}
+
+// Records a request of key and returns whether the client may get more
+// results today. Requests which are refused are recorded as well.
+func (s *Store) Request(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.today(key)
+	u.Requests++
+	k, ok := s.keys[key]
+	return !ok || k.DailyResults == 0 || u.Results < k.DailyResults
+}
+
+// Records that key got n results.
+func (s *Store) Results(key string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.today(key).Results += n
+}
@@ -0,0 +1,115 @@
+// vim:ts=4:sw=4:noexpandtab
+package apikeys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "apikeys.json")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := s.Issue(Key{Owner: "Jane Doe <jane@example.org>", DailyResults: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k.Token) != 32 || k.Created.IsZero() {
+		t.Fatalf("Issue returned %+v, want a key and its creation time", k)
+	}
+
+	// Keys survive restarts.
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := s.Get(k.Token)
+	if !ok || got.Owner != k.Owner || got.DailyResults != 15 {
+		t.Fatalf("Get(%q) = %+v, %v, want %+v", k.Token, got, ok, k)
+	}
+
+	k.Disabled = true
+	if err := s.Update(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(k.Token); ok {
+		t.Errorf("Get returned the disabled key %q", k.Token)
+	}
+	if err := s.Revoke(k.Token); err != nil {
+		t.Fatal(err)
+	}
+	if keys := s.List(); len(keys) != 0 {
+		t.Errorf("List = %+v after revoking the only key, want none", keys)
+	}
+	if err := s.Revoke(k.Token); err != ErrNoSuchKey {
+		t.Errorf("Revoke of a revoked key = %v, want ErrNoSuchKey", err)
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	f, err := ioutil.TempFile("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("# keys\nabc\n\ndef\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	s, err := Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"abc", "def"} {
+		if _, ok := s.Get(key); !ok {
+			t.Errorf("Get(%q) = false, want the key listed in the file", key)
+		}
+	}
+}
+
+func TestDailyResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open(filepath.Join(dir, "apikeys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2014, 1, 19, 23, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	k, err := s.Issue(Key{Owner: "Jane", DailyResults: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if !s.Request(k.Token) {
+			t.Fatalf("request %d refused, want it allowed", i)
+		}
+		s.Results(k.Token, 10)
+	}
+	if s.Request(k.Token) {
+		t.Errorf("request allowed after getting 20 results, want it refused")
+	}
+	if u := s.Usage(k.Token); u.Requests != 3 || u.Results != 20 {
+		t.Errorf("Usage = %+v, want 3 requests and 20 results", u)
+	}
+
+	// The quota starts over the next day.
+	now = now.Add(2 * time.Hour)
+	if !s.Request(k.Token) {
+		t.Errorf("request refused on the next day, want it allowed")
+	}
+}
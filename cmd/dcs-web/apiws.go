@@ -0,0 +1,141 @@
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"github.com/Debian/dcs/feature"
+	"log"
+	"sync"
+)
+
+// A command sent by clients of /apiws.
+type apiCommand struct {
+	// One of “query”, “refine” or “cancel”.
+	Command string
+
+	// The query, in the same format that /instantws expects, e.g. “q=foo”.
+	Query string
+}
+
+// Sent to /apiws clients when the results of a query are complete (“done”)
+// or when the query was cancelled/replaced (“cancelled”).
+type apiQueryEnd struct {
+	Type    string
+	QueryId string
+}
+
+// APIServer implements a bidirectional WebSocket API for interactive clients
+// (e.g. editor integrations). In contrast to /instantws, the client can send
+// commands at any time, even while results are still being streamed:
+//
+//	{"Command": "query", "Query": "q=foo"}    starts a query
+//	{"Command": "refine", "Query": "q=foob"}  replaces the running query
+//	{"Command": "cancel"}                     stops the running query
+//
+// The server sends the same events as /instantws (progress, result,
+// pagination, error), followed by an apiQueryEnd.
+//
+// Queries are shared between all clients which send the same query, so
+// cancelling stops sending events to this client, but the backends only stop
+// searching when no other client is waiting for the query (see
+// detachClient).
+func APIServer(ws *websocket.Conn) {
+	src := clientAddress(ws.Request())
+	if !feature.EnabledFor("websocket-api", src) {
+		ws.Write([]byte(`{"Type":"error", "ErrorType":"disabled"}`))
+		return
+	}
+	log.Printf("Accepted API websocket connection from %q\n", src)
+
+	var writeMu sync.Mutex
+	write := func(data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeMessage(ws, data)
+	}
+	writeMarshal := func(data interface{}) {
+		bytes, err := json.Marshal(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		write(bytes)
+	}
+
+	commands := make(chan apiCommand)
+	go func() {
+		defer close(commands)
+		decoder := json.NewDecoder(ws)
+		for {
+			var cmd apiCommand
+			if err := decoder.Decode(&cmd); err != nil {
+				log.Printf("[%s] error reading command: %v\n", src, err)
+				return
+			}
+			commands <- cmd
+		}
+	}()
+
+	var (
+		stop    chan bool
+		done    chan bool
+		queryid string
+	)
+	cancel := func() {
+		if stop == nil {
+			return
+		}
+		select {
+		case <-done:
+			// The query already finished, nothing to cancel.
+			stop = nil
+			return
+		default:
+		}
+		close(stop)
+		stop = nil
+		writeMarshal(&apiQueryEnd{Type: "cancelled", QueryId: queryid})
+	}
+
+	for cmd := range commands {
+		log.Printf("[%s] Received command %v\n", src, cmd)
+		switch cmd.Command {
+		case "cancel":
+			cancel()
+
+		case "query", "refine":
+			cancel()
+			if err := validateQuery("?" + cmd.Query); err != nil {
+				log.Printf("[%s] Query %q failed validation: %v\n", src, cmd.Query, err)
+				write(invalidQueryMessage(err))
+				continue
+			}
+
+			queryid = queryIdentifier(cmd.Query)
+			cached := maybeStartQuery(queryid, src, cmd.Query)
+			logAccess(src, "/apiws", cmd.Query, cached)
+
+			stop = make(chan bool)
+			done = make(chan bool)
+			go func(queryid string, stop, done chan bool) {
+				defer close(done)
+				if err := streamEvents(queryid, write, stop); err != nil {
+					log.Printf("[%s] Error writing to websocket, closing: %v\n", src, err)
+					ws.Close()
+					return
+				}
+				select {
+				case <-stop:
+				default:
+					writeMarshal(&apiQueryEnd{Type: "done", QueryId: queryid})
+				}
+			}(queryid, stop, done)
+
+		default:
+			write([]byte(`{"Type":"error", "ErrorType":"unknowncommand"}`))
+		}
+	}
+
+	if stop != nil {
+		close(stop)
+	}
+}
@@ -0,0 +1,240 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/proto"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	queryTimeout = flag.Duration("query_timeout",
+		5*time.Minute,
+		"Deadline for querying the source-backends. Backends which are not done by then are cancelled and treated as unavailable")
+	backendIdleTimeout = flag.Duration("backend_idle_timeout",
+		10*time.Second,
+		"Cancel querying a source-backend which did not send anything (not even a progress update) for this long")
+	hedgePercentile = flag.Float64("hedge_percentile",
+		95,
+		"When the first reply of a shard takes longer than this percentile of its recent first replies, the query is also sent to the next replica of the shard (see -source_backends) and the first replica to reply is used. 0 disables hedging")
+	hedgeMinDelay = flag.Duration("hedge_min_delay",
+		100*time.Millisecond,
+		"Never send a hedged query before the first replica had this long to reply, see -hedge_percentile")
+	backendRetries = flag.Int("backend_retries",
+		2,
+		"How often to retry querying a shard (on the next replica, if any) when it is unavailable before sending its first reply")
+)
+
+// Number of first reply latencies which are kept per shard, and how many of
+// them need to be known before hedging starts.
+const (
+	latencySamples    = 100
+	minLatencySamples = 20
+)
+
+// How much longer to wait before each retry, see openStream.
+const retryBackoff = 100 * time.Millisecond
+
+// One client of the SourceBackend gRPC service per replica of each entry of
+// -source_backends, in the same order. Each of them keeps its connection open
+// for all queries.
+var sourceBackends [][]proto.SourceBackendClient
+
+// The most recent latencies of the first replies of each shard, see
+// hedgeDelay.
+var firstReplyLatencies []*latencies
+
+func dialSourceBackends() {
+	for _, replicas := range common.SourceBackendReplicas() {
+		var clients []proto.SourceBackendClient
+		for _, backend := range replicas {
+			// TODO: switch in the config
+			addr := strings.Replace(backend, "28082", "26082", -1)
+			client, err := proto.DialSourceBackend(addr)
+			if err != nil {
+				log.Fatalf("Could not create client for source backend %s: %v\n", addr, err)
+			}
+			clients = append(clients, client)
+		}
+		sourceBackends = append(sourceBackends, clients)
+		firstReplyLatencies = append(firstReplyLatencies, &latencies{})
+	}
+}
+
+// A ring buffer of durations.
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+// Returns the p-th percentile of the samples, or false if there are too few
+// of them to tell.
+func (l *latencies) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	l.mu.Unlock()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(p / 100 * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx], true
+}
+
+// Returns how long to wait for the first reply of the shard with the given
+// index before sending a hedged query, or false if no hedged query should be
+// sent.
+func hedgeDelay(backendidx int) (time.Duration, bool) {
+	if *hedgePercentile <= 0 || len(sourceBackends[backendidx]) < 2 {
+		return 0, false
+	}
+	delay, ok := firstReplyLatencies[backendidx].percentile(*hedgePercentile)
+	if !ok {
+		return 0, false
+	}
+	if delay < *hedgeMinDelay {
+		delay = *hedgeMinDelay
+	}
+	return delay, true
+}
+
+// Returns whether err is worth retrying, i.e. whether another attempt (on
+// the same or another replica) may succeed.
+func transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// The stream of one replica and its first reply.
+type streamAttempt struct {
+	n       int // index into the cancel functions of openStream
+	replica int
+	stream  proto.SourceBackend_StreamClient
+	first   proto.Z
+	cancel  context.CancelFunc
+	err     error
+}
+
+// Sends request to the shard with the given index and returns the stream of
+// results and its first reply. Cancelling ctx stops the query.
+//
+// When the first reply takes longer than usual (see hedgeDelay), the query is
+// also sent to the next replica, and the stream of whichever replica replies
+// first is used, the other one is cancelled. Queries which fail before the
+// first reply because the replica is unavailable are retried on the next
+// replica (see -backend_retries). Once results are flowing, failures are not
+// retried, as the results would be duplicated.
+func openStream(ctx context.Context, queryid string, backendidx int, request proto.SearchRequest) (proto.SourceBackend_StreamClient, proto.Z, error) {
+	replicas := sourceBackends[backendidx]
+	results := make(chan streamAttempt)
+	var cancels []context.CancelFunc
+	start := func(wait time.Duration) {
+		n := len(cancels)
+		replica := n % len(replicas)
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			attempt := streamAttempt{n: n, replica: replica, cancel: cancel}
+			select {
+			case <-time.After(wait):
+			case <-attemptCtx.Done():
+				attempt.err = attemptCtx.Err()
+				results <- attempt
+				return
+			}
+			started := time.Now()
+			attempt.stream, attempt.err = replicas[replica].Stream(attemptCtx, request)
+			if attempt.err == nil {
+				attempt.first, attempt.err = attempt.stream.Recv()
+			}
+			if attempt.err == nil {
+				firstReplyLatencies[backendidx].add(time.Since(started))
+			}
+			results <- attempt
+		}()
+	}
+
+	start(0)
+	running := 1
+	var hedge <-chan time.Time
+	delay, hedging := hedgeDelay(backendidx)
+	if hedging {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	retries := *backendRetries
+	var winner *streamAttempt
+	var err error
+	for running > 0 {
+		select {
+		case <-hedge:
+			hedge = nil
+			log.Printf("[%s] [src:%d] no reply after %v, also querying replica %d\n", queryid, backendidx, delay, len(cancels)%len(replicas))
+			varz.Increment("backend-hedged-requests")
+			start(0)
+			running++
+
+		case attempt := <-results:
+			running--
+			if attempt.err != nil {
+				attempt.cancel()
+				err = attempt.err
+				if transient(attempt.err) && retries > 0 && ctx.Err() == nil {
+					retries--
+					log.Printf("[%s] [src:%d] replica %d failed, retrying: %v\n", queryid, backendidx, attempt.replica, attempt.err)
+					varz.Increment("backend-retries")
+					// Give a single replica a moment to recover.
+					start(time.Duration(*backendRetries-retries) * retryBackoff)
+					running++
+				}
+				continue
+			}
+			winner = &attempt
+			// Stop the other replicas, whose results are not needed.
+			for n, cancel := range cancels {
+				if n != attempt.n {
+					cancel()
+				}
+			}
+			for ; running > 0; running-- {
+				<-results
+			}
+		}
+	}
+	if winner == nil {
+		return nil, proto.Z{}, err
+	}
+	if winner.replica > 0 {
+		varz.Increment("backend-replica-replies")
+	}
+	return winner.stream, winner.first, nil
+}
@@ -0,0 +1,148 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/browse"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Asks the index-backend behind backend for the names of the files of the
+// source package pkg.
+func fetchPackageFiles(backend, pkg string) ([]string, error) {
+	// The index-backend runs on the same host as the source-backend.
+	u := url.URL{
+		Scheme:   "http",
+		Host:     strings.Replace(backend, "28082", "28081", -1),
+		Path:     "/files",
+		RawQuery: url.Values{"package": []string{pkg}}.Encode(),
+	}
+	resp, err := routingClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	var names []string
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Handles /package/<name>/<directory> by listing the directory of the source
+// package, according to the names of the files in the index of all shards
+// (the web node has no access to the files themselves). If several versions
+// of the package are in the index, version= selects one, the last one by
+// default.
+func PackageHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/package/")
+	pkg, dir := rest, ""
+	if idx := strings.Index(rest, "/"); idx > -1 {
+		pkg, dir = rest[:idx], strings.Trim(rest[idx+1:], "/")
+	}
+	if pkg == "" || strings.Contains(pkg, "_") {
+		http.Error(w, "No valid package name provided, use /package/<name>", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		names  []string
+		failed int
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for idx, backend := range common.Shards() {
+		if !backendServing(idx) {
+			continue
+		}
+		wg.Add(1)
+		go func(backend string) {
+			defer wg.Done()
+			result, err := fetchPackageFiles(backend, pkg)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Could not get the files of %q from %s: %v\n", pkg, backend, err)
+				failed++
+				return
+			}
+			names = append(names, result...)
+		}(backend)
+	}
+	wg.Wait()
+	sort.Strings(names)
+
+	versions := browse.Versions(names)
+	if len(versions) == 0 {
+		if failed > 0 {
+			http.Error(w, "Could not list the files of the package, please try again", http.StatusBadGateway)
+		} else {
+			http.Error(w, "No such package in the index", http.StatusNotFound)
+		}
+		return
+	}
+	tree := versions[len(versions)-1]
+	if version := r.FormValue("version"); version != "" {
+		tree = pkg + "_" + version
+	}
+	entries, ok := browse.List(names, tree, dir)
+	if !ok {
+		http.Error(w, "No such directory in the package", http.StatusNotFound)
+		return
+	}
+
+	type crumb struct {
+		Name string
+		URL  string
+	}
+	versionParam := "?" + url.Values{"version": []string{strings.TrimPrefix(tree, pkg+"_")}}.Encode()
+	crumbs := []crumb{{pkg, "/package/" + pkg + "/" + versionParam}}
+	if dir != "" {
+		parts := strings.Split(dir, "/")
+		for idx, part := range parts {
+			crumbs = append(crumbs, crumb{part, "/package/" + pkg + "/" + strings.Join(parts[:idx+1], "/") + "/" + versionParam})
+		}
+	}
+	type link struct {
+		browse.Entry
+		URL string
+	}
+	links := make([]link, len(entries))
+	for idx, entry := range entries {
+		if entry.Dir {
+			links[idx] = link{entry, "/package/" + pkg + "/" + entry.Path + "/" + versionParam}
+		} else {
+			links[idx] = link{entry, "/show?" + url.Values{"file": []string{tree + "/" + entry.Path}}.Encode()}
+		}
+	}
+	var otherVersions []crumb
+	for _, v := range versions {
+		if v != tree {
+			version := strings.TrimPrefix(v, pkg+"_")
+			otherVersions = append(otherVersions, crumb{version, "/package/" + pkg + "/?" + url.Values{"version": []string{version}}.Encode()})
+		}
+	}
+
+	if err := common.ExecuteTemplate(w, r, "package.html", map[string]interface{}{
+		"package":  pkg,
+		"version":  common.Version,
+		"tree":     tree,
+		"crumbs":   crumbs,
+		"entries":  links,
+		"versions": otherVersions,
+		"failed":   failed,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,78 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Directory listings of the source packages in the index, built from the
+// names of the indexed files (see /package).
+package browse
+
+import (
+	"sort"
+	"strings"
+)
+
+// A file or directory within a listed directory.
+type Entry struct {
+	// The name within the listed directory.
+	Name string
+
+	// The path relative to the package tree, e.g. “src/main.c”.
+	Path string
+
+	Dir bool
+
+	// The number of files within the directory (recursively), for
+	// directories.
+	Files int
+}
+
+// Returns the package trees (“<package>_<version>”) of the files called names,
+// in lexical order.
+func Versions(names []string) []string {
+	seen := make(map[string]bool)
+	var versions []string
+	for _, name := range names {
+		idx := strings.Index(name, "/")
+		if idx == -1 || seen[name[:idx]] {
+			continue
+		}
+		seen[name[:idx]] = true
+		versions = append(versions, name[:idx])
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Returns the entries of the directory dir (relative to the package tree
+// tree, "" for its root) given the names of all files of the package:
+// directories first, then files, each in lexical order. ok is false if there
+// is no such directory.
+func List(names []string, tree, dir string) (entries []Entry, ok bool) {
+	prefix := tree + "/"
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		prefix += dir + "/"
+	}
+	dirs := make(map[string]int)
+	var files []Entry
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		ok = true
+		rel := name[len(prefix):]
+		if idx := strings.Index(rel, "/"); idx > -1 {
+			dirs[rel[:idx]]++
+			continue
+		}
+		files = append(files, Entry{Name: rel, Path: name[len(tree)+1:]})
+	}
+	for name, count := range dirs {
+		entries = append(entries, Entry{
+			Name:  name,
+			Path:  strings.TrimPrefix(prefix[len(tree)+1:]+name, "/"),
+			Dir:   true,
+			Files: count,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return append(entries, files...), ok
+}
@@ -0,0 +1,48 @@
+// vim:ts=4:sw=4:noexpandtab
+package browse
+
+import (
+	"reflect"
+	"testing"
+)
+
+var names = []string{
+	"i3-wm_4.7/Makefile",
+	"i3-wm_4.7/src/main.c",
+	"i3-wm_4.7/src/x/xcb.c",
+	"i3-wm_4.7/include/all.h",
+	"i3-wm_4.8/Makefile",
+}
+
+func TestVersions(t *testing.T) {
+	if got, want := Versions(names), []string{"i3-wm_4.7", "i3-wm_4.8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Versions = %v, want %v", got, want)
+	}
+}
+
+func TestList(t *testing.T) {
+	for _, test := range []struct {
+		dir  string
+		want []Entry
+		ok   bool
+	}{
+		{"", []Entry{
+			{Name: "include", Path: "include", Dir: true, Files: 1},
+			{Name: "src", Path: "src", Dir: true, Files: 2},
+			{Name: "Makefile", Path: "Makefile"},
+		}, true},
+		{"src/", []Entry{
+			{Name: "x", Path: "src/x", Dir: true, Files: 1},
+			{Name: "main.c", Path: "src/main.c"},
+		}, true},
+		{"/src/x", []Entry{
+			{Name: "xcb.c", Path: "src/x/xcb.c"},
+		}, true},
+		{"doc", nil, false},
+	} {
+		got, ok := List(names, "i3-wm_4.7", test.dir)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("List(%q) = %v, %v, want %v, %v", test.dir, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Finished queries are kept in state (and their results on disk) so that
+// repeated queries are answered from there. Their identifiers include the
+// generation of the results (see queryIdentifier), which changes whenever a
+// source-backend reports that its index-backend loaded a new index, so that
+// results of outdated indexes are never served.
+var resultCacheSize = flag.Int("result_cache_size",
+	10,
+	"Number of finished queries whose results are kept for answering repeated queries. The least recently used ones are dropped first")
+
+// Changed whenever the index generation of any backend changes, see
+// updateResultsGeneration. Accessed atomically.
+var resultsGeneration uint64
+
+// Updates the index generation of the backend with the given index, which
+// must be called with shardStatesMu held.
+func updateResultsGeneration(backendidx int, generation uint64) {
+	if shardGenerations[backendidx] == generation {
+		return
+	}
+	old := shardGenerations[backendidx]
+	shardGenerations[backendidx] = generation
+	if old == 0 {
+		// We did not know the generation yet (e.g. after starting up), so
+		// there cannot be any results of an older one.
+		return
+	}
+	log.Printf("Backend %d loaded a new index (generation %d), dropping cached results\n", backendidx, generation)
+	atomic.AddUint64(&resultsGeneration, 1)
+	invalidateResults()
+	notifySavedSearches()
+	go loadPackageNames()
+}
+
+// Drops all finished queries, whose results might be outdated now.
+func invalidateResults() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for queryid, s := range state {
+		if s.done {
+			dropQuery(queryid)
+		}
+	}
+}
+
+// Marks the query as used just now, so that it is evicted last. Must be
+// called with stateMu held.
+func touchQuery(queryid string) {
+	s := state[queryid]
+	s.lastUsed = time.Now()
+	state[queryid] = s
+}
+
+// Drops the least recently used finished queries until there is room for a
+// new query. Must be called with stateMu held.
+func evictResults() {
+	if len(state) < *resultCacheSize {
+		return
+	}
+	var done []string
+	for queryid, s := range state {
+		if s.done {
+			done = append(done, queryid)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool {
+		return state[done[i]].lastUsed.Before(state[done[j]].lastUsed)
+	})
+	for _, queryid := range done {
+		if len(state) < *resultCacheSize {
+			break
+		}
+		dropQuery(queryid)
+	}
+	log.Printf("Evicted cached results, %d queries remaining\n", len(state))
+}
+
+// Must be called with stateMu held.
+func dropQuery(queryid string) {
+	for _, s := range state[queryid].perBackend {
+		if s != nil {
+			s.tempFile.Close()
+		}
+	}
+	delete(state, queryid)
+}
@@ -5,9 +5,17 @@ package common
 
 import (
 	"flag"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/i18n"
 	"html/template"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 var Version string = "unknown"
@@ -16,15 +24,82 @@ var templatePattern = flag.String("template_pattern",
 	"Pattern matching the HTML templates (./templates/* by default)")
 var SourceBackends = flag.String("source_backends",
 	"localhost:28082",
-	"host:port (multiple values are comma-separated) of the source-backend(s)")
+	"host:port (multiple values are comma-separated) of the source-backend(s). Replicas serving the same shard are separated by |, e.g. a:28082|b:28082,c:28082")
 var UseSourcesDebianNet = flag.Bool("use_sources_debian_net",
 	false,
 	"Redirect to sources.debian.net instead of handling /show on our own.")
-var Templates *template.Template
+var theme = flag.String("theme",
+	"",
+	"Name of the theme, i.e. of the directory within -themes_path, whose templates replace the ones of the same name matched by -template_pattern")
+var themesPath = flag.String("themes_path",
+	"themes",
+	"Directory containing one directory of templates per theme (see -theme)")
+var reloadTemplates = flag.Bool("reload_templates",
+	false,
+	"Reload the templates (including the ones of the -theme) and the translations when they change, without restarting")
+var translationsPath = flag.String("translations_path",
+	"translations",
+	"Directory containing the translations of the templates, one <language>.json file per language (see the i18n package)")
 
-func LoadTemplates() {
-	var err error
-	Templates = template.New("foo").Funcs(template.FuncMap{
+// The templates and translations, which are replaced when reloading them
+// (see watchTemplates).
+var (
+	templates       *template.Template
+	translations    *i18n.Catalog
+	templatesLoaded time.Time
+	templatesMu     sync.RWMutex
+)
+
+// Returns when the templates and translations were last loaded, which is
+// when pages rendered from them may have last changed.
+func TemplatesLoaded() time.Time {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	return templatesLoaded
+}
+
+// Returns the host:port of all replicas of each shard, as configured by
+// -source_backends.
+func SourceBackendReplicas() [][]string {
+	var shards [][]string
+	for _, shard := range strings.Split(*SourceBackends, ",") {
+		shards = append(shards, strings.Split(shard, "|"))
+	}
+	return shards
+}
+
+// Returns the host:port of the first replica of each shard, which is the one
+// queried unless it is slow or unavailable.
+func Shards() []string {
+	var shards []string
+	for _, replicas := range SourceBackendReplicas() {
+		shards = append(shards, replicas[0])
+	}
+	return shards
+}
+
+// Returns the scheme and host under which the request reached us, for
+// building absolute URLs which are used outside of our own pages.
+func BaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// Parses the templates matching pattern and then the ones matching
+// themePattern (if not empty), which replace the templates of the same name.
+func parseTemplates(pattern, themePattern string) (*template.Template, error) {
+	t, err := template.New("foo").Funcs(template.FuncMap{
+		// Translates a message into the language of the page, e.g.
+		// {{T $.lang "Search results for %q" $.q}}.
+		"T": func(lang, msg string, args ...interface{}) string {
+			templatesMu.RLock()
+			c := translations
+			templatesMu.RUnlock()
+			return c.Translate(lang, msg, args...)
+		},
 		"eq": func(args ...interface{}) bool {
 			if len(args) == 0 {
 				return false
@@ -47,9 +122,108 @@ func LoadTemplates() {
 			}
 			return false
 		},
-	})
-	Templates, err = Templates.ParseGlob(*templatePattern)
+	}).ParseGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if themePattern == "" {
+		return t, nil
+	}
+	if matches, _ := filepath.Glob(themePattern); len(matches) == 0 {
+		return nil, fmt.Errorf("theme pattern %q matches no files", themePattern)
+	}
+	return t.ParseGlob(themePattern)
+}
+
+// Returns the pattern matching the templates of the -theme, or "" if no theme
+// is selected.
+func themePattern() string {
+	if *theme == "" {
+		return ""
+	}
+	return filepath.Join(*themesPath, *theme, "*")
+}
+
+// Returns the latest modification time of the files matching the patterns.
+func lastModified(patterns ...string) time.Time {
+	var latest time.Time
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			if fi, err := os.Stat(match); err == nil && fi.ModTime().After(latest) {
+				latest = fi.ModTime()
+			}
+		}
+	}
+	return latest
+}
+
+// Loads the templates of -template_pattern and of the -theme, exiting if
+// they cannot be parsed. With -reload_templates, they are reloaded whenever
+// one of them changes.
+func LoadTemplates() {
+	t, err := parseTemplates(*templatePattern, themePattern())
 	if err != nil {
 		log.Fatalf(`Could not load templates from "%s": %v`, *templatePattern, err)
 	}
+	c, err := i18n.Load(*translationsPath)
+	if err != nil {
+		log.Fatalf(`Could not load translations from "%s": %v`, *translationsPath, err)
+	}
+	templatesMu.Lock()
+	templates = t
+	translations = c
+	templatesLoaded = time.Now()
+	templatesMu.Unlock()
+	if *reloadTemplates {
+		go watchTemplates(*templatePattern, themePattern(), 2*time.Second)
+	}
+}
+
+// Reloads the templates whenever a file matching one of the patterns changed,
+// checking every interval. Templates which cannot be parsed are logged and
+// the previous ones are kept, so that a typo does not take down the site.
+func watchTemplates(pattern, themePattern string, interval time.Duration) {
+	translationsPattern := filepath.Join(*translationsPath, "*.json")
+	loaded := lastModified(pattern, themePattern, translationsPattern)
+	for range time.Tick(interval) {
+		modified := lastModified(pattern, themePattern, translationsPattern)
+		if !modified.After(loaded) {
+			continue
+		}
+		loaded = modified
+		t, err := parseTemplates(pattern, themePattern)
+		if err != nil {
+			log.Printf("Could not reload templates, keeping the old ones: %v\n", err)
+			continue
+		}
+		c, err := i18n.Load(*translationsPath)
+		if err != nil {
+			log.Printf("Could not reload translations, keeping the old ones: %v\n", err)
+			continue
+		}
+		templatesMu.Lock()
+		templates = t
+		translations = c
+		templatesLoaded = time.Now()
+		templatesMu.Unlock()
+		log.Printf("Reloaded templates\n")
+	}
+}
+
+// Renders the template with the given name (see html/template) in the
+// language which fits the Accept-Language header of r best. The language is
+// available to the template as “lang”, for translating its messages with T.
+func ExecuteTemplate(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) error {
+	templatesMu.RLock()
+	t, c := templates, translations
+	templatesMu.RUnlock()
+	lang := c.Negotiate(r.Header.Get("Accept-Language"))
+	data["lang"] = lang
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	return t.ExecuteTemplate(w, name, data)
 }
@@ -0,0 +1,75 @@
+// vim:ts=4:sw=4:noexpandtab
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTemplate(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTemplate(t, filepath.Join(dir, "templates", "page.html"), `<p>{{template "footer.html"}}</p>`)
+	writeTemplate(t, filepath.Join(dir, "templates", "footer.html"), `default footer`)
+	writeTemplate(t, filepath.Join(dir, "themes", "dark", "footer.html"), `dark footer`)
+
+	pattern := filepath.Join(dir, "templates", "*")
+	for _, test := range []struct {
+		themePattern string
+		want         string
+	}{
+		{"", "<p>default footer</p>"},
+		{filepath.Join(dir, "themes", "dark", "*"), "<p>dark footer</p>"},
+	} {
+		tmpl, err := parseTemplates(pattern, test.themePattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, "page.html", nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("with theme %q: got %q, want %q", test.themePattern, got, test.want)
+		}
+	}
+
+	if _, err := parseTemplates(pattern, filepath.Join(dir, "themes", "missing", "*")); err == nil {
+		t.Errorf("parseTemplates with a missing theme unexpectedly succeeded")
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "page.html")
+	writeTemplate(t, path, "old")
+	before := lastModified(filepath.Join(dir, "*"), "")
+
+	later := before.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastModified(filepath.Join(dir, "*"), ""); !got.Equal(later) {
+		t.Errorf("lastModified = %v, want %v", got, later)
+	}
+}
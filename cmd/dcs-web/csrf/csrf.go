@@ -0,0 +1,124 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Protection of state-changing requests against cross-site request forgery.
+//
+// Each browser gets a random identifier in a cookie. Forms which change state
+// carry a token derived from that identifier, which other sites cannot know,
+// and the protected handlers refuse requests whose token does not match the
+// cookie they come with.
+package csrf
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// Name of the cookie holding the identifier of the browser.
+	CookieName = "dcs_csrf"
+
+	// Name of the form field carrying the token.
+	FieldName = "csrf_token"
+
+	// Name of the header carrying the token, for requests sent by scripts.
+	HeaderName = "X-Csrf-Token"
+)
+
+// Length of the identifiers in the cookies, in bytes.
+const idLength = 32
+
+var encoding = base64.RawURLEncoding
+
+type Protector struct {
+	key []byte
+}
+
+// Returns a Protector deriving tokens with key, which must be kept secret.
+// When key is empty, a random key is used, so tokens become invalid when the
+// process restarts.
+func New(key []byte) (*Protector, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Protector{key: key}, nil
+}
+
+func (p *Protector) token(id string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(id))
+	return encoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the identifier in the cookie of r, or "" if there is none.
+func browserId(r *http.Request) string {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return ""
+	}
+	if id, err := encoding.DecodeString(cookie.Value); err != nil || len(id) != idLength {
+		return ""
+	}
+	return cookie.Value
+}
+
+// Returns the token which forms rendered for r must carry in FieldName. If
+// the browser has no identifier yet, a cookie with a new one is set on w, so
+// Token must be called before the response is written.
+//
+// As the token differs per browser, responses containing it must not be
+// stored in shared caches.
+func (p *Protector) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if id := browserId(r); id != "" {
+		return p.token(id), nil
+	}
+	b := make([]byte, idLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := encoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return p.token(id), nil
+}
+
+// Reports whether r carries the token matching its cookie, in the form field
+// FieldName or in the header HeaderName.
+func (p *Protector) Valid(r *http.Request) bool {
+	id := browserId(r)
+	if id == "" {
+		return false
+	}
+	got := r.Header.Get(HeaderName)
+	if got == "" {
+		got = r.PostFormValue(FieldName)
+	}
+	return hmac.Equal([]byte(got), []byte(p.token(id)))
+}
+
+// Wraps handler, refusing requests which may change state (i.e. all but GET,
+// HEAD and OPTIONS requests) with status 403 unless they carry a valid token.
+func (p *Protector) Protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if !p.Valid(r) {
+				http.Error(w, "Invalid or missing CSRF token, please reload the page and try again", http.StatusForbidden)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+// vim:ts=4:sw=4:noexpandtab
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProtect(t *testing.T) {
+	p, err := New([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rendering a form sets the cookie the token belongs to.
+	rec := httptest.NewRecorder()
+	token, err := p.Token(rec, httptest.NewRequest("GET", "/save?q=foo", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CookieName {
+		t.Fatalf("Token set cookies %v, want one %s cookie", cookies, CookieName)
+	}
+	cookie := cookies[0]
+
+	// With the cookie, the token stays the same and no new cookie is set.
+	r := httptest.NewRequest("GET", "/save?q=foo", nil)
+	r.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	if again, _ := p.Token(rec, r); again != token {
+		t.Errorf("Token = %q for the same cookie, want %q", again, token)
+	}
+	if got := rec.Result().Cookies(); len(got) != 0 {
+		t.Errorf("Token set cookies %v although the request had one", got)
+	}
+
+	handler := p.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	post := func(token string, cookie *http.Cookie, header bool) int {
+		form := url.Values{"q": []string{"foo"}}
+		if token != "" && !header {
+			form.Set(FieldName, token)
+		}
+		r := httptest.NewRequest("POST", "/save", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header {
+			r.Header.Set(HeaderName, token)
+		}
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	other := &http.Cookie{Name: CookieName, Value: encoding.EncodeToString(make([]byte, idLength))}
+	for _, test := range []struct {
+		desc   string
+		token  string
+		cookie *http.Cookie
+		header bool
+		want   int
+	}{
+		{"valid token", token, cookie, false, http.StatusOK},
+		{"valid token in header", token, cookie, true, http.StatusOK},
+		{"missing token", "", cookie, false, http.StatusForbidden},
+		{"missing cookie", token, nil, false, http.StatusForbidden},
+		{"token of another cookie", token, other, false, http.StatusForbidden},
+		{"invalid token", "x" + token, cookie, false, http.StatusForbidden},
+	} {
+		if got := post(test.token, test.cookie, test.header); got != test.want {
+			t.Errorf("%s: status %d, want %d", test.desc, got, test.want)
+		}
+	}
+
+	// Requests which do not change state need no token.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/save?q=foo", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET request: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
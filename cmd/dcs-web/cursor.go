@@ -0,0 +1,121 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	dcsquery "github.com/Debian/dcs/query"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+)
+
+// A resultCursor is the position after the last result of a page, which the
+// next page starts at. Instead of the number of results before it, it stores
+// the sort key (see pointerByRanking) of the last result, so that fetching the
+// next page is a binary search in the sorted results, and so that the next
+// page continues where the last one ended even if the query was run again in
+// the meantime (e.g. because its results were evicted from the cache, or
+// because a source backend loaded a new index). Results which are sorted by
+// something else than their ranking (see sortPointers) are paginated by the
+// number of results before the next page instead.
+type resultCursor struct {
+	// Identifies the query (see cursorQueryHash), so that cursors cannot be
+	// used for other queries by mistake.
+	queryHash uint64
+
+	// The sort key of the last result.
+	ranking  float32
+	pathHash uint64
+
+	// Number of results with this sort key up to (and including) the last
+	// result, e.g. several matches in the same file with the same ranking.
+	skip int
+
+	// The number of results before the next page, if they are not sorted
+	// by ranking (in which case the other fields apart from queryHash are
+	// not used).
+	offset int
+}
+
+// Returns the hash of query (as passed to maybeStartQuery) which cursors
+// store. Unlike queryIdentifier, it does not change when an index changes.
+func cursorQueryHash(query string) uint64 {
+	h := fnv.New64()
+	io.WriteString(h, normalizeQuery(query))
+	return h.Sum64()
+}
+
+// Returns the cursor after the first n of the pointers, which are sorted by
+// order.
+func cursorAfter(queryHash uint64, order string, pointers []resultPointer, n int) resultCursor {
+	if order != "" && order != dcsquery.SortRanking {
+		return resultCursor{queryHash: queryHash, offset: n}
+	}
+	last := pointers[n-1]
+	c := resultCursor{
+		queryHash: queryHash,
+		ranking:   last.ranking,
+		pathHash:  last.pathHash,
+	}
+	for i := n - 1; i >= 0 && pointers[i].ranking == c.ranking && pointers[i].pathHash == c.pathHash; i-- {
+		c.skip++
+	}
+	return c
+}
+
+// Returns the index of the first of the sorted pointers after c.
+func (c resultCursor) position(pointers []resultPointer) int {
+	if c.offset > 0 {
+		if c.offset > len(pointers) {
+			return len(pointers)
+		}
+		return c.offset
+	}
+	// The first pointer with the sort key of c (or after it, if there is
+	// none).
+	first := sort.Search(len(pointers), func(i int) bool {
+		p := pointers[i]
+		return p.ranking < c.ranking || p.ranking == c.ranking && p.pathHash <= c.pathHash
+	})
+	pos := first
+	for pos < len(pointers) && pos-first < c.skip &&
+		pointers[pos].ranking == c.ranking && pointers[pos].pathHash == c.pathHash {
+		pos++
+	}
+	return pos
+}
+
+// String returns the cursor in the opaque form which is handed out to
+// clients.
+func (c resultCursor) String() string {
+	if c.offset > 0 {
+		return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("c2:%x:%d", c.queryHash, c.offset)))
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("c1:%x:%x:%x:%d",
+		c.queryHash, math.Float32bits(c.ranking), c.pathHash, c.skip)))
+}
+
+func parseCursor(s string) (resultCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return resultCursor{}, fmt.Errorf("malformed cursor")
+	}
+	var (
+		c       resultCursor
+		ranking uint32
+	)
+	if bytes.HasPrefix(b, []byte("c2:")) {
+		if _, err := fmt.Sscanf(string(b), "c2:%x:%d", &c.queryHash, &c.offset); err != nil || c.offset < 1 {
+			return resultCursor{}, fmt.Errorf("malformed cursor")
+		}
+		return c, nil
+	}
+	if _, err := fmt.Sscanf(string(b), "c1:%x:%x:%x:%d", &c.queryHash, &ranking, &c.pathHash, &c.skip); err != nil || c.skip < 1 {
+		return resultCursor{}, fmt.Errorf("malformed cursor")
+	}
+	c.ranking = math.Float32frombits(ranking)
+	return c, nil
+}
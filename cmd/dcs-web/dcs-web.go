@@ -10,8 +10,10 @@ import (
 	"github.com/Debian/dcs/cmd/dcs-web/health"
 	"github.com/Debian/dcs/cmd/dcs-web/search"
 	"github.com/Debian/dcs/cmd/dcs-web/show"
+	"github.com/Debian/dcs/feature"
 	"github.com/Debian/dcs/goroutinez"
 	"github.com/Debian/dcs/index"
+	dcsquery "github.com/Debian/dcs/query"
 	dcsregexp "github.com/Debian/dcs/regexp"
 	"github.com/Debian/dcs/varz"
 	"hash/fnv"
@@ -26,6 +28,7 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,6 +40,9 @@ var (
 	staticPath = flag.String("static_path",
 		"./static/",
 		"Path to static assets such as *.css")
+	staticCacheMaxAge = flag.Duration("static_cache_max_age",
+		0,
+		"How long clients may cache static assets without revalidating them (Cache-Control max-age). With 0, they revalidate them on every use, which is cheap as they are served with Last-Modified")
 	accessLogPath = flag.String("access_log_path",
 		"",
 		"Where to write access.log entries (in Apache Common Log Format). Disabled if empty.")
@@ -56,28 +62,155 @@ func validateQuery(query string) error {
 	}
 	rewritten := search.RewriteQuery(*fakeUrl)
 	log.Printf("rewritten query = %q\n", rewritten.String())
-	re, err := dcsregexp.Compile(rewritten.Query().Get("q"))
+	if order := rewritten.Query().Get("sort"); !dcsquery.ValidSort(order) {
+		return fmt.Errorf("unknown sort order %q, use one of %s", order, strings.Join(dcsquery.SortOrders, ", "))
+	}
+	q := rewritten.Query().Get("q")
+	expr, err := dcsquery.ParseExpr(q)
 	if err != nil {
 		return err
 	}
-	indexQuery := index.RegexpQuery(re.Syntax)
+	var indexQuery *index.Query
+	if expr != nil {
+		if indexQuery, err = expr.IndexQuery(index.RegexpQuery); err != nil {
+			return err
+		}
+	} else {
+		re, err := dcsregexp.Compile(q)
+		if err != nil {
+			return err
+		}
+		indexQuery = index.RegexpQuery(re.Syntax)
+	}
 	log.Printf("trigram = %v, sub = %v", indexQuery.Trigram, indexQuery.Sub)
-	if len(indexQuery.Trigram) == 0 && len(indexQuery.Sub) == 0 {
-		return fmt.Errorf("Empty index query")
+	// Refuse queries which would need to search (almost) every file, as they
+	// would keep all source backends busy for minutes. When narrowing down
+	// the results of another query, only its files are searched.
+	err = index.CheckQuery(indexQuery)
+	if within := rewritten.Query().Get("within"); within != "" {
+		if err == index.ErrQueryMatchesAll {
+			err = nil
+		}
+		if err == nil {
+			stateMu.Lock()
+			err = checkRefinable(within)
+			stateMu.Unlock()
+		}
 	}
-	return nil
+	return err
 }
 
-func InstantServer(ws *websocket.Conn) {
+// Returns the error message which is sent to clients whose query was refused
+// by validateQuery.
+func invalidQueryMessage(err error) []byte {
+	b, _ := json.Marshal(&Error{
+		Type:      "error",
+		ErrorType: "invalidquery",
+		Message:   err.Error(),
+	})
+	return b
+}
+
+// Returns the address of the client which sent r, taking into account the
+// X-Forwarded-For header set by our reverse proxy.
+func clientAddress(r *http.Request) string {
 	// The additional ":" at the end is necessary so that we don’t need to
 	// distinguish between the two cases (X-Forwarded-For, without a port, and
 	// RemoteAddr, with a part) in the code below.
-	src := ws.Request().Header.Get("X-Forwarded-For") + ":"
-	remoteaddr := ws.Request().RemoteAddr
+	src := r.Header.Get("X-Forwarded-For") + ":"
+	remoteaddr := r.RemoteAddr
 	if src == ":" || (!strings.HasPrefix(remoteaddr, "[::1]:") &&
 		!strings.HasPrefix(remoteaddr, "127.0.0.1:")) {
 		src = remoteaddr
 	}
+	return src
+}
+
+// Uniquely (well, good enough) identify this query for as long as we want to
+// cache results. The query is normalized first, so that e.g. the order of
+// parameters does not matter, and the identifier changes when any backend
+// loads a new index (see resultsGeneration).
+func queryIdentifier(query string) string {
+	h := fnv.New64()
+	io.WriteString(h, normalizeQuery(query))
+	fmt.Fprintf(h, "\x00%d", atomic.LoadUint64(&resultsGeneration))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// Sorts the parameters of query and strips whitespace around the search
+// term. Queries which cannot be parsed are returned unmodified.
+func normalizeQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+	if q, ok := values["q"]; ok {
+		for i := range q {
+			q[i] = strings.TrimSpace(q[i])
+		}
+	}
+	return values.Encode()
+}
+
+// Create an apache common log format entry.
+func logAccess(src, path, query string, cached bool) {
+	if accessLog == nil {
+		return
+	}
+	responseCode := 200
+	if cached {
+		responseCode = 304
+	}
+	remoteIP := src
+	if idx := strings.LastIndex(remoteIP, ":"); idx > -1 {
+		remoteIP = remoteIP[:idx]
+	}
+	fmt.Fprintf(accessLog, "%s - - [%s] \"GET %s?%s HTTP/1.1\" %d -\n",
+		remoteIP, time.Now().Format("02/Jan/2006:15:04:05 -0700"), path, query, responseCode)
+}
+
+// Sends all events of the specified query to the client using write, until
+// the query is done or stop is closed. The client counts as waiting for the
+// query until then, see detachClient.
+func streamEvents(identifier string, write func([]byte) error, stop chan bool) error {
+	defer attachClient(identifier)()
+	lastseen := -1
+	for {
+		message, sequence := getEvent(identifier, lastseen)
+		lastseen = sequence
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		// This message was obsoleted by a more recent one, e.g. a more
+		// recent progress update obsoletes all earlier progress updates.
+		if *message.obsolete {
+			continue
+		}
+		if len(message.data) == 0 {
+			return nil
+		}
+		if err := write(message.data); err != nil {
+			return err
+		}
+	}
+}
+
+// Writes data to ws as a single message.
+func writeMessage(ws *websocket.Conn, data []byte) error {
+	written, err := ws.Write(data)
+	if err != nil {
+		return err
+	}
+	if written != len(data) {
+		return fmt.Errorf("could only write %d of %d bytes", written, len(data))
+	}
+	return nil
+}
+
+func InstantServer(ws *websocket.Conn) {
+	src := clientAddress(ws.Request())
 	log.Printf("Accepted websocket connection from %q\n", src)
 
 	type Query struct {
@@ -93,56 +226,22 @@ func InstantServer(ws *websocket.Conn) {
 		log.Printf("[%s] Received query %v\n", src, q)
 		if err := validateQuery("?" + q.Query); err != nil {
 			log.Printf("[%s] Query %q failed validation: %v\n", src, q.Query, err)
-			ws.Write([]byte(`{"Type":"error", "ErrorType":"invalidquery"}`))
+			ws.Write(invalidQueryMessage(err))
 			continue
 		}
 
-		// Uniquely (well, good enough) identify this query for a couple of minutes
-		// (as long as we want to cache results). We could try to normalize the
-		// query before hashing it, but that seems hardly worth the complexity.
-		h := fnv.New64()
-		io.WriteString(h, q.Query)
-		identifier := fmt.Sprintf("%x", h.Sum64())
-
+		identifier := queryIdentifier(q.Query)
 		cached := maybeStartQuery(identifier, src, q.Query)
+		logAccess(src, "/instantws", q.Query, cached)
 
-		// Create an apache common log format entry.
-		if accessLog != nil {
-			responseCode := 200
-			if cached {
-				responseCode = 304
-			}
-			remoteIP := src
-			if idx := strings.LastIndex(remoteIP, ":"); idx > -1 {
-				remoteIP = remoteIP[:idx]
-			}
-			fmt.Fprintf(accessLog, "%s - - [%s] \"GET /instantws?%s HTTP/1.1\" %d -\n",
-				remoteIP, time.Now().Format("02/Jan/2006:15:04:05 -0700"), q.Query, responseCode)
+		write := func(data []byte) error {
+			return writeMessage(ws, data)
 		}
-
-		lastseen := -1
-		for {
-			message, sequence := getEvent(identifier, lastseen)
-			lastseen = sequence
-			// This message was obsoleted by a more recent one, e.g. a more
-			// recent progress update obsoletes all earlier progress updates.
-			if *message.obsolete {
-				continue
-			}
-			if len(message.data) == 0 {
-				// TODO: tell the client that a new query can be sent
-				break
-			}
-			written, err := ws.Write(message.data)
-			if err != nil {
-				log.Printf("[%s] Error writing to websocket, closing: %v\n", src, err)
-				return
-			}
-			if written != len(message.data) {
-				log.Printf("[%s] Could only write %d of %d bytes to websocket, closing.\n", src, written, len(message.data))
-				return
-			}
+		if err := streamEvents(identifier, write, nil); err != nil {
+			log.Printf("[%s] Error writing to websocket, closing: %v\n", src, err)
+			return
 		}
+		// TODO: tell the client that a new query can be sent
 		log.Printf("[%s] query done. waiting for a new one\n", src)
 	}
 }
@@ -208,6 +307,14 @@ func ResultsHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	flag.Parse()
 	common.LoadTemplates()
+	// Features which are rolled out, but can be turned off via /featurez.
+	feature.Register("streaming", 100)
+	feature.Register("facets", 100)
+	feature.Register("definitions", 100)
+	feature.Register("federation", 100)
+	if err := feature.Load(); err != nil {
+		log.Fatalf("Could not load feature flags: %v\n", err)
+	}
 	if *accessLogPath != "" {
 		var err error
 		accessLog, err = os.OpenFile(*accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
@@ -222,8 +329,21 @@ func main() {
 	fmt.Println("Debian Code Search webapp")
 
 	health.StartChecking()
+	dialSourceBackends()
+	go pollShardStates()
+	startSavedSearches()
+	loadRateLimits()
+	openQueryLog()
+	loadCSRFKey()
+	loadPackageNames()
+	loadIdentifiers()
+	loadFederation()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if *staticCacheMaxAge > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(staticCacheMaxAge.Seconds())))
+		}
+
 		// Check if a static file was requested with full name
 		name := filepath.Join(*staticPath, r.URL.Path)
 		if _, err := os.Stat(name); err == nil {
@@ -243,8 +363,22 @@ func main() {
 	http.HandleFunc("/favicon.ico", http.NotFound)
 	http.HandleFunc("/varz", varz.Varz)
 	http.HandleFunc("/goroutinez", goroutinez.Goroutinez)
-	http.HandleFunc("/search", Search)
-	http.HandleFunc("/show", show.Show)
+	http.HandleFunc("/featurez", feature.Featurez)
+	http.Handle("/search", throttled(http.HandlerFunc(Search)))
+	http.Handle("/stream", throttled(http.HandlerFunc(StreamHandler)))
+	http.Handle("/api/v1/search", corsEnabled(throttled(http.HandlerFunc(APISearchHandler))))
+	http.Handle("/download", corsEnabled(throttled(http.HandlerFunc(DownloadHandler))))
+	http.HandleFunc("/opensearch.xml", OpenSearchHandler)
+	http.HandleFunc("/suggest", SuggestHandler)
+	http.Handle("/save", throttled(csrfProtected(http.HandlerFunc(SaveHandler))))
+	http.HandleFunc("/feed/", FeedHandler)
+	http.Handle("/show", throttled(http.HandlerFunc(show.Show)))
+	http.Handle("/raw/", throttled(http.HandlerFunc(show.Raw)))
+	http.HandleFunc("/embed", show.Embed)
+	http.HandleFunc("/oembed", show.OEmbed)
+	http.HandleFunc("/packageinfo", show.PackageInfo)
+	http.HandleFunc("/vcs", show.Vcs)
+	http.Handle("/apikeys", adminOnly(csrfProtected(http.HandlerFunc(APIKeysHandler))))
 	http.HandleFunc("/memprof", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("writing memprof")
 		if *memprofile != "" {
@@ -260,9 +394,13 @@ func main() {
 
 	http.HandleFunc("/results/", ResultsHandler)
 	http.HandleFunc("/perpackage-results/", PerPackageResultsHandler)
-	http.HandleFunc("/queryz", QueryzHandler)
+	http.Handle("/queryz", csrfProtected(http.HandlerFunc(QueryzHandler)))
+	http.HandleFunc("/routingz", RoutingzHandler)
+	http.HandleFunc("/definitions", DefinitionsHandler)
+	http.Handle("/package/", throttled(http.HandlerFunc(PackageHandler)))
 
-	http.Handle("/instantws", websocket.Handler(InstantServer))
+	http.Handle("/instantws", throttled(websocket.Handler(InstantServer)))
+	http.Handle("/apiws", throttled(websocket.Handler(APIServer)))
 
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	log.Fatal(http.ListenAndServe(*listenAddress, secured(http.DefaultServeMux)))
 }
@@ -0,0 +1,131 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/feature"
+	"github.com/Debian/dcs/symbols"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Maximum number of definitions shown for a single name.
+const maxDefinitions = 1000
+
+type byPath []symbols.Symbol
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Asks the index-backend behind backend for the definitions of name.
+func fetchDefinitions(backend, name string) ([]symbols.Symbol, error) {
+	// The index-backend runs on the same host as the source-backend.
+	u := url.URL{
+		Scheme: "http",
+		Host:   strings.Replace(backend, "28082", "28081", -1),
+		Path:   "/symbols",
+		RawQuery: url.Values{
+			"name":  []string{name},
+			"limit": []string{fmt.Sprint(maxDefinitions)},
+		}.Encode(),
+	}
+	resp, err := routingClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// The shard was built without symbols.
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	var defs []symbols.Symbol
+	if err := json.NewDecoder(resp.Body).Decode(&defs); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// Handles /definitions?q=<name> by collecting the definitions of name from
+// the symbol indexes of all shards. With &from=<path> (the file in which name
+// is used, e.g. when jumping to the definition from /show), the definitions
+// most closely related to that file come first (see
+// symbols.SortByRelatedness), otherwise they are sorted by path. With
+// &format=json, the definitions are returned as a JSON array instead of an
+// HTML page.
+func DefinitionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !feature.EnabledFor("definitions", clientAddress(r)) {
+		http.Error(w, "Looking up definitions is disabled.", http.StatusServiceUnavailable)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("q"))
+	if name == "" {
+		http.Error(w, "No ?q= provided", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		defs   []symbols.Symbol
+		failed int
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for idx, backend := range common.Shards() {
+		if !backendServing(idx) {
+			continue
+		}
+		wg.Add(1)
+		go func(backend string) {
+			defer wg.Done()
+			result, err := fetchDefinitions(backend, name)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Could not get definitions of %q from %s: %v\n", name, backend, err)
+				failed++
+				return
+			}
+			defs = append(defs, result...)
+		}(backend)
+	}
+	wg.Wait()
+	sort.Sort(byPath(defs))
+	if from := r.FormValue("from"); from != "" {
+		symbols.SortByRelatedness(defs, from)
+	}
+	if len(defs) > maxDefinitions {
+		defs = defs[:maxDefinitions]
+	}
+
+	if r.FormValue("format") == "json" {
+		if defs == nil {
+			defs = []symbols.Symbol{}
+		}
+		b, err := json.Marshal(defs)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+
+	if err := common.ExecuteTemplate(w, r, "definitions.html", map[string]interface{}{
+		"q":           name,
+		"definitions": defs,
+		"failed":      failed,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
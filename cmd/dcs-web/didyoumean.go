@@ -0,0 +1,35 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/suggest"
+	"log"
+)
+
+var identifiersPath = flag.String("identifiers_path",
+	"",
+	"Path to a file listing frequent identifiers of the indexed source code, one per line and the most frequent first, with which the terms of queries without results are corrected. If empty, only package names are corrected")
+
+// Number of corrections offered for queries without results.
+const correctionsShown = 3
+
+// The frequent identifiers of -identifiers_path, see suggest.DidYouMean.
+var identifiers []string
+
+func loadIdentifiers() {
+	if *identifiersPath == "" {
+		return
+	}
+	var err error
+	if identifiers, err = suggest.LoadDictionary(*identifiersPath); err != nil {
+		log.Fatalf("Could not load identifiers: %v\n", err)
+	}
+	log.Printf("Loaded %d identifiers for corrections\n", len(identifiers))
+}
+
+// Returns queries similar to q (the q= parameter) which might be what the
+// user meant, for queries without results.
+func didYouMean(q string) []string {
+	return suggest.DidYouMean(q, packageNames, identifiers, correctionsShown)
+}
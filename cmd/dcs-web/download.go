@@ -0,0 +1,119 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The columns of downloads in CSV format, see writeCSV.
+var csvHeader = []string{"package", "version", "path", "line", "column", "context", "ranking"}
+
+// Writes results as CSV with a header line. Unlike in JSON downloads, only
+// the matching line itself is included, not the lines around it.
+func writeCSV(w io.Writer, results []apiResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if err := cw.Write([]string{
+			result.Package,
+			result.Version,
+			result.Path,
+			strconv.Itoa(result.Line),
+			strconv.Itoa(result.Column),
+			result.Context,
+			strconv.FormatFloat(float64(result.Ranking), 'g', -1, 32),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// DownloadHandler handles /download?q=<query>[&format=json|csv] by running
+// the query like /api/v1/search does and responding with all of its results
+// at once, as a file to save: in JSON (the default), as an array of the
+// results of /api/v1/search, or in CSV (see writeCSV). Other parameters (e.g.
+// sort=) are passed on as for /stream.
+func DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form data", http.StatusBadRequest)
+		return
+	}
+	format := r.Form.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, fmt.Sprintf("Unknown format %q, use json or csv", format), http.StatusBadRequest)
+		return
+	}
+	params := url.Values{}
+	for key, values := range r.Form {
+		if key != "format" {
+			params[key] = values
+		}
+	}
+	query := params.Encode()
+	src := clientAddress(r)
+	if strings.TrimSpace(params.Get("q")) == "" {
+		http.Error(w, "Empty query", http.StatusBadRequest)
+		return
+	}
+	if err := validateQuery("?" + query); err != nil {
+		log.Printf("[%s] Query %q failed validation: %v\n", src, query, err)
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	recordResults, ok := checkQuota(r)
+	if !ok {
+		http.Error(w, "The API key got all the results it may get today", http.StatusTooManyRequests)
+		return
+	}
+
+	queryid, ok := awaitQuery(r.Context(), src, "/download", query)
+	if !ok {
+		return
+	}
+	if failed, _ := queryErrors(queryid); failed {
+		http.Error(w, "The query failed on the source backends, please try again", http.StatusBadGateway)
+		return
+	}
+
+	stateMu.Lock()
+	s := state[queryid]
+	stateMu.Unlock()
+	results, err := readResults(queryid, s.resultPointers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	apiResults := make([]apiResult, len(results))
+	for i, result := range results {
+		apiResults[i] = newAPIResult(result)
+	}
+	recordResults(len(apiResults))
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dcs-%s.%s\"", queryid, format))
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeCSV(w, apiResults)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(apiResults)
+	}
+	if err != nil {
+		log.Printf("[%s] Could not write download: %v\n", queryid, err)
+	}
+}
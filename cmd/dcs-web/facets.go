@@ -0,0 +1,104 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"github.com/Debian/dcs/feature"
+	"github.com/Debian/dcs/proto"
+	"regexp"
+	"sort"
+)
+
+// Number of values per facet which are sent to clients.
+const facetValuesShown = 10
+
+// The number of matches of a query for one value of a facet, e.g. for one
+// source package.
+type Facet struct {
+	Value string
+	Count int
+
+	// The keyword which narrows the query down to this value, e.g.
+	// “package:i3-wm”.
+	Keyword string
+}
+
+// A facet count as sent by a source backend.
+type backendFacet struct {
+	kind, value string
+	count       int
+}
+
+// Returns the facets of a progress update.
+func backendFacets(progress proto.ProgressUpdate) []backendFacet {
+	list := progress.Facets()
+	facets := make([]backendFacet, list.Len())
+	for i := range facets {
+		f := list.At(i)
+		facets[i] = backendFacet{f.Kind(), f.Value(), int(f.Count())}
+	}
+	return facets
+}
+
+// Returns the keyword which narrows a query down to the given value of a
+// facet (see facetCounts in dcs-source-backend).
+func facetKeyword(kind, value string) string {
+	switch kind {
+	case "package":
+		return "package:" + value
+	case "language":
+		return "filetype:" + value
+	case "directory":
+		return "path:^[^/]+/" + regexp.QuoteMeta(value) + "/"
+	}
+	return ""
+}
+
+// Returns the facets of the query (by kind, e.g. “package”), adding up the
+// latest counts of all source backends. Each source backend only sends the
+// values with the most matches, so the counts of rare values may be too low.
+// Without the “facets” feature, there are no facets.
+func mergedFacets(s queryState) map[string][]Facet {
+	if !feature.Enabled("facets") {
+		return nil
+	}
+	counts := make(map[string]map[string]int)
+	s.filesMu.Lock()
+	for _, bstate := range s.perBackend {
+		if bstate == nil {
+			continue
+		}
+		for _, f := range bstate.facets {
+			if counts[f.kind] == nil {
+				counts[f.kind] = make(map[string]int)
+			}
+			counts[f.kind][f.value] += f.count
+		}
+	}
+	s.filesMu.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+	merged := make(map[string][]Facet)
+	for kind, values := range counts {
+		facets := make([]Facet, 0, len(values))
+		for value, count := range values {
+			facets = append(facets, Facet{
+				Value:   value,
+				Count:   count,
+				Keyword: facetKeyword(kind, value),
+			})
+		}
+		sort.Slice(facets, func(i, j int) bool {
+			if facets[i].Count == facets[j].Count {
+				return facets[i].Value < facets[j].Value
+			}
+			return facets[i].Count > facets[j].Count
+		})
+		if len(facets) > facetValuesShown {
+			facets = facets[:facetValuesShown]
+		}
+		merged[kind] = facets
+	}
+	return merged
+}
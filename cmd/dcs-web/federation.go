@@ -0,0 +1,138 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/federation"
+	"github.com/Debian/dcs/feature"
+	dcsquery "github.com/Debian/dcs/query"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	federatedInstancesSpec = flag.String("federated_instances",
+		"",
+		"Comma-separated list of other Debian Code Search deployments in the form label=URL (e.g. “ubuntu=https://codesearch.example.org”), which /api/v1/search queries along with the source backends. Up to half of the first page of results are theirs, labeled with their Origin")
+	federationTimeout = flag.Duration("federation_timeout",
+		30*time.Second,
+		"How long to wait for the results of federated instances (see -federated_instances) before leaving them out")
+)
+
+var (
+	federatedInstances []federation.Instance
+	federationClient   = &http.Client{}
+)
+
+// Parses -federated_instances.
+func loadFederation() {
+	var err error
+	if federatedInstances, err = federation.ParseInstances(*federatedInstancesSpec); err != nil {
+		log.Fatalf("Invalid -federated_instances: %v\n", err)
+	}
+	for _, instance := range federatedInstances {
+		log.Printf("Federating queries to %q (%s)\n", instance.Label, instance.URL)
+	}
+	varz.Set("failed-federated-queries", 0)
+}
+
+// How a federated instance answered a query.
+type apiFederatedStatus struct {
+	// The label of the instance, as in the Origin of its results, and its
+	// base URL, under which e.g. /show displays its results.
+	Origin string
+	URL    string
+
+	// Number of results of the instance, of which up to half of page_size
+	// are merged into the first page.
+	Results int
+
+	// Why the instance has no results, if it failed.
+	Error string `json:",omitempty"`
+}
+
+// Runs the query with the given parameters on all federated instances and
+// returns up to pageSize results of each, labeled with the instance. Requests
+// which are themselves federated are not passed on, so that instances which
+// federate to each other do not loop.
+func searchFederated(r *http.Request, params url.Values, pageSize int) ([]apiResult, []apiFederatedStatus) {
+	if len(federatedInstances) == 0 || r.Header.Get(federation.Header) != "" ||
+		!feature.EnabledFor("federation", clientAddress(r)) {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *federationTimeout)
+	defer cancel()
+	remote := url.Values{}
+	for key, values := range params {
+		remote[key] = values
+	}
+	remote.Set("page_size", strconv.Itoa(pageSize))
+
+	var (
+		results  []apiResult
+		statuses = make([]apiFederatedStatus, len(federatedInstances))
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+	for idx, instance := range federatedInstances {
+		wg.Add(1)
+		go func(idx int, instance federation.Instance) {
+			defer wg.Done()
+			var reply apiSearchResponse
+			err := federation.Search(ctx, federationClient, instance, remote, &reply)
+			mu.Lock()
+			defer mu.Unlock()
+			statuses[idx].Origin = instance.Label
+			statuses[idx].URL = instance.URL
+			if err != nil {
+				log.Printf("Could not query federated instance %q: %v\n", instance.Label, err)
+				varz.Increment("failed-federated-queries")
+				statuses[idx].Error = err.Error()
+				return
+			}
+			statuses[idx].Results = reply.Stats.Results
+			for _, result := range reply.Results {
+				result.Origin = instance.Label
+				results = append(results, result)
+			}
+		}(idx, instance)
+	}
+	wg.Wait()
+	return results, statuses
+}
+
+// Merges the federated results into the first page of local results, which
+// are sorted by order, so that the page still has at most pageSize results.
+// Federated results take up at most half of the page, so that the page always
+// contains some local results to continue with on the next page. When
+// sorting by ranking, the best of all results make it onto the page, the
+// local ones which do not fit are left for the next page. Otherwise, the
+// federated results only fill up the page.
+func mergeFederated(local, federated []apiResult, pageSize int, order string) []apiResult {
+	if order == dcsquery.SortRanking {
+		federated = append([]apiResult{}, federated...)
+		sort.SliceStable(federated, func(i, j int) bool {
+			return federated[i].Ranking > federated[j].Ranking
+		})
+	}
+	if max := pageSize / 2; len(federated) > max {
+		federated = federated[:max]
+	}
+	merged := append(append([]apiResult{}, local...), federated...)
+	if order == dcsquery.SortRanking {
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].Ranking > merged[j].Ranking
+		})
+	}
+	if len(merged) > pageSize {
+		merged = merged[:pageSize]
+	}
+	return merged
+}
@@ -0,0 +1,92 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Federation with other Debian Code Search deployments (e.g. one indexing
+// Ubuntu or internal code), which are queried via their /api/v1/search.
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Requests to federated instances carry this header, so that they do not
+// query their own federated instances in turn (which could loop forever).
+const Header = "X-Dcs-Federated"
+
+// Labels of instances, which clients see as the origin of results.
+var labelRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Another deployment of Debian Code Search.
+type Instance struct {
+	// Identifies the instance in the results, e.g. “ubuntu”.
+	Label string
+
+	// The base URL of the instance, e.g. “https://codesearch.example.org”.
+	URL string
+}
+
+// Parses a comma-separated list of instances in the form label=URL, e.g.
+// “ubuntu=https://codesearch.example.org,internal=http://dcs.internal:28080”.
+func ParseInstances(spec string) ([]Instance, error) {
+	var instances []Instance
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !labelRe.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid instance %q, use label=URL", entry)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL of instance %q: %q", parts[0], parts[1])
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("duplicate instance %q", parts[0])
+		}
+		seen[parts[0]] = true
+		instances = append(instances, Instance{
+			Label: parts[0],
+			URL:   strings.TrimSuffix(parts[1], "/"),
+		})
+	}
+	return instances, nil
+}
+
+// Runs the query with the given parameters (e.g. q and page_size) on the
+// instance and decodes its response into v. Responses other than status 200
+// are returned as errors, with the message of the instance if there is one.
+func Search(ctx context.Context, client *http.Client, instance Instance, params url.Values, v interface{}) error {
+	req, err := http.NewRequest("GET", instance.URL+"/api/v1/search?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/vnd.dcs.v1+json")
+	req.Header.Set(Header, "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var reply struct {
+			Message string
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if err := json.Unmarshal(body, &reply); err == nil && reply.Message != "" {
+			return fmt.Errorf("HTTP status %d: %s", resp.StatusCode, reply.Message)
+		}
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,70 @@
+// vim:ts=4:sw=4:noexpandtab
+package federation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseInstances(t *testing.T) {
+	instances, err := ParseInstances("ubuntu=https://codesearch.example.org/, internal=http://dcs.internal:28080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Instance{
+		{"ubuntu", "https://codesearch.example.org"},
+		{"internal", "http://dcs.internal:28080"},
+	}
+	if !reflect.DeepEqual(instances, want) {
+		t.Errorf("ParseInstances = %+v, want %+v", instances, want)
+	}
+
+	for _, spec := range []string{
+		"https://codesearch.example.org",
+		"ubuntu=codesearch.example.org",
+		"a b=https://codesearch.example.org",
+		"ubuntu=https://a.example.org,ubuntu=https://b.example.org",
+	} {
+		if _, err := ParseInstances(spec); err == nil {
+			t.Errorf("ParseInstances(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(Header) == "" {
+			t.Errorf("request without the %s header", Header)
+		}
+		if r.FormValue("q") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"Version":1,"Error":"invalidquery","Message":"the q parameter is missing"}`))
+			return
+		}
+		w.Write([]byte(`{"Version":1,"Results":[{"Package":"i3-wm","Line":42}]}`))
+	}))
+	defer srv.Close()
+	instance := Instance{"test", srv.URL}
+
+	var reply struct {
+		Results []struct {
+			Package string
+			Line    int
+		}
+	}
+	if err := Search(context.Background(), srv.Client(), instance, url.Values{"q": []string{"main"}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Results) != 1 || reply.Results[0].Package != "i3-wm" || reply.Results[0].Line != 42 {
+		t.Errorf("Search decoded %+v, want the result of the instance", reply)
+	}
+
+	err := Search(context.Background(), srv.Client(), instance, url.Values{}, &reply)
+	if err == nil || err.Error() != "HTTP status 400: the q parameter is missing" {
+		t.Errorf("Search without q = %v, want the message of the instance", err)
+	}
+}
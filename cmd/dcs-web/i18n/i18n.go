@@ -0,0 +1,123 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Translations of the messages of the dcs-web templates. A catalog is a
+// directory of JSON files, one per language (e.g. “de.json” or
+// “pt-br.json”), each mapping the English messages to their translation.
+// Messages may contain fmt verbs, which apply to the translations as well.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The language of the messages in the templates themselves.
+const DefaultLanguage = "en"
+
+type Catalog struct {
+	// Translations by language and English message.
+	messages map[string]map[string]string
+}
+
+// Loads the catalog in dir. A missing dir results in an empty catalog, i.e.
+// all messages are shown in English.
+func Load(dir string) (*Catalog, error) {
+	c := &Catalog{messages: make(map[string]map[string]string)}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(b, &messages); err != nil {
+			return nil, fmt.Errorf("could not parse %q: %v", file, err)
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		c.messages[lang] = messages
+	}
+	return c, nil
+}
+
+// Returns the languages which the catalog contains translations for.
+func (c *Catalog) Languages() []string {
+	var langs []string
+	for lang := range c.messages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Returns the language out of the catalog (or DefaultLanguage) which fits the
+// Accept-Language header best, e.g. “de” for “de-AT,en;q=0.5”.
+func (c *Catalog) Negotiate(acceptLanguage string) string {
+	if c == nil {
+		return DefaultLanguage
+	}
+	type preference struct {
+		lang string
+		q    float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(params[0]))
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			preferences = append(preferences, preference{lang, q})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].q > preferences[j].q
+	})
+	for _, p := range preferences {
+		if p.lang == DefaultLanguage || strings.HasPrefix(p.lang, DefaultLanguage+"-") {
+			return DefaultLanguage
+		}
+		if _, ok := c.messages[p.lang]; ok {
+			return p.lang
+		}
+		// A more specific language (e.g. de-AT) falls back to the general
+		// one (de).
+		if idx := strings.Index(p.lang, "-"); idx > -1 {
+			if _, ok := c.messages[p.lang[:idx]]; ok {
+				return p.lang[:idx]
+			}
+		}
+	}
+	return DefaultLanguage
+}
+
+// Returns the translation of msg into lang, or msg itself if there is none,
+// formatted with args (if any) like fmt.Sprintf.
+func (c *Catalog) Translate(lang, msg string, args ...interface{}) string {
+	if c != nil {
+		if translated, ok := c.messages[lang][msg]; ok && translated != "" {
+			msg = translated
+		}
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
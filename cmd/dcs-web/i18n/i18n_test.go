@@ -0,0 +1,80 @@
+// vim:ts=4:sw=4:noexpandtab
+package i18n
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testCatalog(t *testing.T) *Catalog {
+	dir, err := ioutil.TempDir("", "dcs-i18n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, contents := range map[string]string{
+		"de.json":    `{"Search": "Suchen", "Search results for %q": "Suchergebnisse für %q", "FAQ": ""}`,
+		"pt-BR.json": `{"Search": "Pesquisar"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNegotiate(t *testing.T) {
+	c := testCatalog(t)
+	if got, want := c.Languages(), []string{"de", "pt-br"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Languages() = %v, want %v", got, want)
+	}
+	for _, test := range []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"de-AT,en;q=0.5", "de"},
+		{"en-US,de;q=0.8", "en"},
+		{"fr;q=0.9, pt-BR", "pt-br"},
+		{"pt", "en"},
+		{"de;q=0.1, fr, en;q=0.5", "en"},
+		{"de;q=0", "en"},
+	} {
+		if got := c.Negotiate(test.acceptLanguage); got != test.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", test.acceptLanguage, got, test.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	c := testCatalog(t)
+	for _, test := range []struct {
+		lang, msg string
+		args      []interface{}
+		want      string
+	}{
+		{"de", "Search", nil, "Suchen"},
+		{"en", "Search", nil, "Search"},
+		{"de", "Search results for %q", []interface{}{"foo"}, `Suchergebnisse für "foo"`},
+		{"en", "Search results for %q", []interface{}{"foo"}, `Search results for "foo"`},
+		// Empty translations are not used.
+		{"de", "FAQ", nil, "FAQ"},
+		{"de", "Untranslated", nil, "Untranslated"},
+	} {
+		if got := c.Translate(test.lang, test.msg, test.args...); got != test.want {
+			t.Errorf("Translate(%q, %q) = %q, want %q", test.lang, test.msg, got, test.want)
+		}
+	}
+	var nilCatalog *Catalog
+	if got := nilCatalog.Translate("de", "Search"); got != "Search" {
+		t.Errorf("Translate without a catalog = %q, want %q", got, "Search")
+	}
+}
@@ -0,0 +1,131 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/suggest"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var packageManifestPaths = flag.String("package_manifest_paths",
+	"",
+	"Comma-separated list of paths to the manifests of the source backends (see -manifest_path of dcs-source-backend), whose package names /suggest completes. If empty, only popular search terms are suggested")
+
+// Number of suggestions returned by /suggest.
+const suggestionsShown = 10
+
+// How often search terms are searched for, see suggest.Popular.
+var popularQueries = suggest.NewPopular(10000)
+
+// The names of the packages in the index, see loadPackageNames.
+var packageNames = &suggest.Packages{}
+
+// Counts the search term of query (as passed to maybeStartQuery) for the
+// suggestions of /suggest.
+func countPopularQuery(query string) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return
+	}
+	popularQueries.Add(values.Get("q"))
+}
+
+// Reads the package names for /suggest from the manifests of
+// -package_manifest_paths. Called on startup and whenever a backend loaded a
+// new index, which may contain new packages.
+func loadPackageNames() {
+	if *packageManifestPaths == "" {
+		return
+	}
+	var names []string
+	for _, path := range strings.Split(*packageManifestPaths, ",") {
+		manifestNames, err := suggest.LoadManifest(path)
+		if err != nil {
+			log.Printf("Could not load package names from %q: %v\n", path, err)
+			continue
+		}
+		names = append(names, manifestNames...)
+	}
+	packageNames.Set(names)
+	log.Printf("Loaded %d package names for suggestions\n", len(names))
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchImage struct {
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+	Type   string `xml:"type,attr"`
+	URL    string `xml:",chardata"`
+}
+
+type openSearchQuery struct {
+	Role        string `xml:"role,attr"`
+	SearchTerms string `xml:"searchTerms,attr"`
+}
+
+// See http://www.opensearch.org/Specifications/OpenSearch/1.1
+type openSearchDescription struct {
+	XMLName       xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string
+	Description   string
+	InputEncoding string
+	Image         openSearchImage
+	URLs          []openSearchURL `xml:"Url"`
+	Query         openSearchQuery
+}
+
+// OpenSearchHandler serves the OpenSearch description document, with which
+// browsers offer Debian Code Search as a search engine (see the
+// <link rel="search"> of our pages). The URLs in it point to the host under
+// which the document was requested.
+func OpenSearchHandler(w http.ResponseWriter, r *http.Request) {
+	base := common.BaseUrl(r)
+	description := openSearchDescription{
+		ShortName:     "Debian Code Search",
+		Description:   "Search the source code of all Debian packages",
+		InputEncoding: "UTF-8",
+		Image: openSearchImage{
+			Width:  16,
+			Height: 16,
+			Type:   "image/vnd.microsoft.icon",
+			URL:    base + "/favicon.ico",
+		},
+		URLs: []openSearchURL{
+			{"text/html", "get", base + "/search?q={searchTerms}"},
+			{"application/x-suggestions+json", "get", base + "/suggest?q={searchTerms}"},
+		},
+		Query: openSearchQuery{"example", "xcb_create_window"},
+	}
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", " ")
+	if err := encoder.Encode(&description); err != nil {
+		log.Printf("Could not write OpenSearch description: %v\n", err)
+	}
+}
+
+// SuggestHandler handles /suggest?q=<prefix> by responding with completions
+// of prefix (popular search terms and package names, see suggest.Complete),
+// in the format of OpenSearch suggestions: ["<prefix>", ["<term>", …]].
+func SuggestHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("q")
+	suggestions := suggest.Complete(prefix, popularQueries, packageNames, suggestionsShown)
+	w.Header().Set("Content-Type", "application/x-suggestions+json")
+	if err := json.NewEncoder(w).Encode([]interface{}{prefix, suggestions}); err != nil {
+		log.Printf("Could not write suggestions: %v\n", err)
+	}
+}
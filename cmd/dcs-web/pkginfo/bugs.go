@@ -0,0 +1,148 @@
+// vim:ts=4:sw=4:noexpandtab
+package pkginfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// When more packages than this are cached, the expired ones are dropped.
+const maxCachedPackages = 10000
+
+// The get_bugs call of the SOAP interface of debbugs, asking for the open bugs
+// of a source package (%s).
+const getBugsRequest = `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:soapenc="http://schemas.xmlsoap.org/soap/encoding/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:xsd="http://www.w3.org/2001/XMLSchema" soap:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<soap:Body>
+<debbugs:get_bugs xmlns:debbugs="Debbugs/SOAP">
+<keyvalue soapenc:arrayType="xsd:anyType[4]" xsi:type="soapenc:Array">
+<item xsi:type="xsd:string">src</item>
+<item xsi:type="xsd:string">%s</item>
+<item xsi:type="xsd:string">status</item>
+<item xsi:type="xsd:string">open</item>
+</keyvalue>
+</debbugs:get_bugs>
+</soap:Body>
+</soap:Envelope>
+`
+
+type bugCount struct {
+	count   int
+	fetched time.Time
+}
+
+// Counts the open bugs of source packages using the SOAP interface of
+// debbugs. The counts are cached for a while, so that popular packages do
+// not lead to a request to debbugs for every reader.
+type BugCounter struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]bugCount
+}
+
+// Returns a BugCounter which sends its requests to url (e.g.
+// https://bugs.debian.org/cgi-bin/soap.cgi) and caches counts for ttl.
+func NewBugCounter(url string, ttl time.Duration) *BugCounter {
+	return &BugCounter{
+		url:    url,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+		cache:  make(map[string]bugCount),
+	}
+}
+
+// Returns the number of open bugs of the source package pkg.
+func (b *BugCounter) OpenBugs(ctx context.Context, pkg string) (int, error) {
+	b.mu.Lock()
+	cached, ok := b.cache[pkg]
+	b.mu.Unlock()
+	if ok && b.now().Sub(cached.fetched) < b.ttl {
+		return cached.count, nil
+	}
+
+	count, err := b.fetch(ctx, pkg)
+	if err != nil {
+		return 0, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if len(b.cache) >= maxCachedPackages {
+		for p, c := range b.cache {
+			if now.Sub(c.fetched) >= b.ttl {
+				delete(b.cache, p)
+			}
+		}
+	}
+	b.cache[pkg] = bugCount{count, now}
+	return count, nil
+}
+
+func (b *BugCounter) fetch(ctx context.Context, pkg string) (int, error) {
+	var escaped bytes.Buffer
+	if err := xml.EscapeText(&escaped, []byte(pkg)); err != nil {
+		return 0, err
+	}
+	body := fmt.Sprintf(getBugsRequest, escaped.String())
+	req, err := http.NewRequest("POST", b.url, bytes.NewBufferString(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", `"Debbugs/SOAP#get_bugs"`)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	return countBugs(resp.Body)
+}
+
+// Returns the number of bugs in a get_bugs response, which lists one bug
+// number per item element of the get_bugsResponse element.
+func countBugs(r io.Reader) (int, error) {
+	decoder := xml.NewDecoder(r)
+	inResponse := false
+	count := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == "get_bugsResponse" {
+			inResponse = true
+		} else if inResponse && start.Name.Local == "item" {
+			count++
+		} else if start.Name.Local == "Fault" {
+			return 0, fmt.Errorf("debbugs returned a SOAP fault")
+		}
+	}
+	if !inResponse {
+		return 0, fmt.Errorf("no get_bugsResponse element in the reply")
+	}
+	return count, nil
+}
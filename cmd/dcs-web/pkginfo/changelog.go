@@ -0,0 +1,73 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Maintenance context of source packages: their changelog, their open bugs
+// and their packaging repository, for readers of their code (see
+// /packageinfo and /vcs).
+package pkginfo
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// An entry of debian/changelog.
+type ChangelogEntry struct {
+	Version      string
+	Distribution string
+	Urgency      string
+
+	// The description of the changes, without the indentation.
+	Changes string
+
+	// Who made the changes, e.g. “Jane Doe <jane@example.org>”.
+	Maintainer string
+
+	// When the changes were made, in RFC 2822 format.
+	Date string
+}
+
+var (
+	// e.g. “i3-wm (4.7.2-1) unstable; urgency=medium”
+	headerRe = regexp.MustCompile(`^(\S+) \(([^)]+)\) ([^;]+);.*\burgency=(\S+)`)
+
+	// e.g. “ -- Jane Doe <jane@example.org>  Sun, 19 Jan 2014 17:11:00 +0100”
+	trailerRe = regexp.MustCompile(`^ -- (.+?)  (.+)$`)
+)
+
+// Parses up to max entries (the most recent ones) of the debian/changelog
+// file read from r. Lines which do not belong to an entry are skipped, so
+// that old entries in obsolete formats do not matter.
+func ParseChangelog(r io.Reader, max int) ([]ChangelogEntry, error) {
+	var (
+		entries []ChangelogEntry
+		current *ChangelogEntry
+		changes []string
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() && len(entries) < max {
+		line := scanner.Text()
+		if current == nil {
+			if m := headerRe.FindStringSubmatch(line); m != nil {
+				current = &ChangelogEntry{
+					Version:      m[2],
+					Distribution: m[3],
+					Urgency:      m[4],
+				}
+				changes = nil
+			}
+			continue
+		}
+		if m := trailerRe.FindStringSubmatch(line); m != nil {
+			current.Maintainer = m[1]
+			current.Date = m[2]
+			current.Changes = strings.Trim(strings.Join(changes, "\n"), "\n")
+			entries = append(entries, *current)
+			current = nil
+			continue
+		}
+		changes = append(changes, strings.TrimPrefix(line, "  "))
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,129 @@
+// vim:ts=4:sw=4:noexpandtab
+package pkginfo
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const changelog = `i3-wm (4.7.2-1) unstable; urgency=medium
+
+  * New upstream release.
+    - Fixes a crash.
+
+ -- Jane Doe <jane@example.org>  Sun, 19 Jan 2014 17:11:00 +0100
+
+i3-wm (4.7.1-1) unstable; urgency=low
+
+  * New upstream release.
+
+ -- Jane Doe <jane@example.org>  Sat, 28 Dec 2013 13:32:00 +0100
+
+i3-wm (4.7-1) experimental; urgency=low
+
+  * Initial release.
+
+ -- Jane Doe <jane@example.org>  Mon, 16 Dec 2013 22:04:00 +0100
+`
+
+func TestParseChangelog(t *testing.T) {
+	entries, err := ParseChangelog(strings.NewReader(changelog), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChangelogEntry{
+		{
+			Version:      "4.7.2-1",
+			Distribution: "unstable",
+			Urgency:      "medium",
+			Changes:      "* New upstream release.\n  - Fixes a crash.",
+			Maintainer:   "Jane Doe <jane@example.org>",
+			Date:         "Sun, 19 Jan 2014 17:11:00 +0100",
+		},
+		{
+			Version:      "4.7.1-1",
+			Distribution: "unstable",
+			Urgency:      "low",
+			Changes:      "* New upstream release.",
+			Maintainer:   "Jane Doe <jane@example.org>",
+			Date:         "Sat, 28 Dec 2013 13:32:00 +0100",
+		},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseChangelog = %+v, want %+v", entries, want)
+	}
+}
+
+func TestOpenBugs(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(body), "<item xsi:type=\"xsd:string\">i3-wm</item>") {
+			t.Errorf("request does not ask for i3-wm: %s", body)
+		}
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` +
+			`<get_bugsResponse xmlns="Debbugs/SOAP"><soapenc:Array xmlns:soapenc="http://schemas.xmlsoap.org/soap/encoding/">` +
+			`<item>700001</item><item>700002</item><item>700003</item></soapenc:Array></get_bugsResponse></soap:Body></soap:Envelope>`))
+	}))
+	defer server.Close()
+
+	now := time.Unix(0, 0)
+	b := NewBugCounter(server.URL, time.Hour)
+	b.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		count, err := b.OpenBugs(context.Background(), "i3-wm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Errorf("OpenBugs = %d, want 3", count)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("%d requests to debbugs, want 1 as the count is cached", requests)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := b.OpenBugs(context.Background(), "i3-wm"); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("%d requests to debbugs, want 2 as the cached count expired", requests)
+	}
+}
+
+func TestVcsFileURL(t *testing.T) {
+	vcs, err := ParseVcs(strings.NewReader("Vcs-Browser: https://salsa.debian.org/debian/i3-wm/\nVcs-Git: https://salsa.debian.org/debian/i3-wm.git -b debian/sid\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		vcs  Vcs
+		want string
+	}{
+		{vcs, "https://salsa.debian.org/debian/i3-wm/-/blob/debian/sid/src/main%20loop.c#L42"},
+		{Vcs{Git: "https://github.com/i3/i3.git"}, "https://github.com/i3/i3/blob/HEAD/src/main%20loop.c#L42"},
+		{Vcs{Browser: "https://git.example.org/i3"}, "https://git.example.org/i3"},
+		{Vcs{Git: "git://git.example.org/i3.git"}, ""},
+		{Vcs{}, ""},
+	} {
+		if got := entry.vcs.FileURL("src/main loop.c", 42); got != entry.want {
+			t.Errorf("%+v.FileURL = %q, want %q", entry.vcs, got, entry.want)
+		}
+	}
+}
+
+func TestSourcesURL(t *testing.T) {
+	if got, want := SourcesURL("i3-wm_4.7-1/src/main.c", 42), "https://sources.debian.org/src/i3-wm/4.7-1/src/main.c/#L42"; got != want {
+		t.Errorf("SourcesURL = %q, want %q", got, want)
+	}
+	if got := SourcesURL("main.c", 42); got != "" {
+		t.Errorf("SourcesURL of a file outside of a package tree = %q, want \"\"", got)
+	}
+}
@@ -0,0 +1,112 @@
+// vim:ts=4:sw=4:noexpandtab
+package pkginfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Name of the file within every unpacked package which holds the Vcs-* fields
+// of its .dsc file, written by dcs-package-importer.
+const VcsFilename = ".dcs-vcs"
+
+// The packaging repository of a source package, as declared in its .dsc file.
+type Vcs struct {
+	// The Vcs-Git field, e.g.
+	// “https://salsa.debian.org/debian/i3-wm.git -b debian/sid”.
+	Git string
+
+	// The Vcs-Browser field, e.g. “https://salsa.debian.org/debian/i3-wm”.
+	Browser string
+}
+
+// Parses the “Field: value” lines of a VcsFilename file read from r.
+func ParseVcs(r io.Reader) (Vcs, error) {
+	var vcs Vcs
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(line[:colon]) {
+		case "vcs-git":
+			vcs.Git = value
+		case "vcs-browser":
+			vcs.Browser = value
+		}
+	}
+	return vcs, scanner.Err()
+}
+
+// Returns the web interface of the repository and the branch named in the
+// Vcs-Git field, if any. Without Vcs-Browser, the web interface is derived
+// from an HTTPS Vcs-Git URL.
+func (v Vcs) web() (base, branch string) {
+	fields := strings.Fields(v.Git)
+	for idx, field := range fields {
+		if field == "-b" && idx+1 < len(fields) {
+			branch = fields[idx+1]
+		}
+	}
+	base = v.Browser
+	if base == "" && len(fields) > 0 && strings.HasPrefix(fields[0], "https://") {
+		base = fields[0]
+	}
+	base = strings.TrimSuffix(strings.TrimSuffix(base, "/"), ".git")
+	return base, branch
+}
+
+// Returns the URL of line in the file at path (relative to the package tree)
+// in the web interface of the repository, or of the repository itself if its
+// hosting service is not known. Returns "" if there is no web interface.
+func (v Vcs) FileURL(path string, line int) string {
+	base, branch := v.web()
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return ""
+	}
+	if branch == "" {
+		branch = "HEAD"
+	}
+	var blob string
+	switch {
+	case u.Host == "salsa.debian.org" || strings.HasPrefix(u.Host, "gitlab."):
+		blob = "/-/blob/"
+	case u.Host == "github.com":
+		blob = "/blob/"
+	default:
+		return base
+	}
+	return fmt.Sprintf("%s%s%s/%s#L%d", base, blob, branch, escapePath(path), line)
+}
+
+// Returns the URL of line in filename (e.g. “i3-wm_4.7/src/main.c”) on
+// sources.debian.org, or "" if filename is not within a package tree.
+func SourcesURL(filename string, line int) string {
+	slash := strings.Index(filename, "/")
+	if slash == -1 {
+		return ""
+	}
+	tree := filename[:slash]
+	underscore := strings.Index(tree, "_")
+	if underscore == -1 {
+		return ""
+	}
+	return fmt.Sprintf("https://sources.debian.org/src/%s/%s/%s/#L%d",
+		tree[:underscore], tree[underscore+1:], escapePath(filename[slash+1:]), line)
+}
+
+// Escapes each of the slash-separated components of path.
+func escapePath(path string) string {
+	parts := strings.Split(path, "/")
+	for idx, part := range parts {
+		parts[idx] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,82 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Returns whether r asks /search for its results as plain text, either with
+// format=txt or by accepting text/plain but not HTML (e.g. curl -H
+// 'Accept: text/plain').
+func wantsPlainText(r *http.Request) bool {
+	if r.Form.Get("format") == "txt" {
+		return true
+	}
+	plain, html := false, false
+	for _, name := range acceptedMediaTypes(r) {
+		switch name {
+		case "text/plain":
+			plain = true
+		case "text/html", "application/xhtml+xml":
+			html = true
+		}
+	}
+	return plain && !html
+}
+
+// Writes results like grep -n, one line per result in the form
+// “package_version/path:line: matching line”.
+func writePlainText(w io.Writer, results []Result) error {
+	bw := bufio.NewWriter(w)
+	for _, result := range results {
+		// Matching lines are single lines, but files may use carriage
+		// returns, which would garble the output on terminals.
+		context := strings.Replace(result.Context, "\r", "", -1)
+		fmt.Fprintf(bw, "%s:%d: %s\n", result.Path, result.Line, context)
+	}
+	return bw.Flush()
+}
+
+// Responds to /search with page of the results of the query q as plain text
+// (see writePlainText). Unlike the HTML page, which shows the progress of
+// queries which take long, this waits for the query to finish, which is what
+// shell scripts want.
+func renderPlainText(w http.ResponseWriter, r *http.Request, src, q string, page int) {
+	queryid, ok := awaitQuery(r.Context(), src, "/search", q)
+	if !ok {
+		return
+	}
+	if failed, _ := queryErrors(queryid); failed {
+		http.Error(w, "The query failed on the source backends, please try again", http.StatusBadGateway)
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := writeResults(queryid, page, &buffer, w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if buffer.Len() == 0 {
+		// writeResults already replied that there is no such page.
+		return
+	}
+	var results []Result
+	if err := json.NewDecoder(&buffer).Decode(&results); err != nil {
+		http.Error(w,
+			fmt.Sprintf("Could not parse results from disk: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := writePlainText(w, results); err != nil {
+		log.Printf("[%s] Could not write plain text results: %v\n", queryid, err)
+	}
+}
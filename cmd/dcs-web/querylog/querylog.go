@@ -0,0 +1,153 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// A log of queries as JSON lines, for improving the ranking and for capacity
+// planning. Client addresses are anonymized according to the configured
+// ClientMode before they are written.
+package querylog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How client addresses are logged.
+const (
+	// Not at all.
+	ClientNone = "none"
+
+	// As a salted hash, so that the queries of one client can be told apart
+	// from the others, but the client cannot be identified.
+	ClientHash = "hash"
+
+	// As their network prefix (/24 for IPv4, /48 for IPv6).
+	ClientPrefix = "prefix"
+)
+
+// How the query went on one source backend (shard).
+type Backend struct {
+	Backend string
+
+	// How long the backend took to search, or 0 if it did not finish.
+	DurationMillis int64
+
+	FilesSearched int
+
+	// The limit which the backend exceeded, if any, in which case its
+	// results are incomplete.
+	LimitHit string `json:",omitempty"`
+
+	// Whether the backend could not be queried or went away.
+	Failed bool `json:",omitempty"`
+}
+
+type Entry struct {
+	Started time.Time
+	QueryId string
+
+	// The search term (q= parameter) and the keywords in it, as passed to
+	// the source backends (e.g. {"filetype": ["c"]}).
+	Query   string
+	Filters map[string][]string `json:",omitempty"`
+
+	// The anonymized client address, see ClientMode.
+	Client string `json:",omitempty"`
+
+	// One of “done”, “failed” or “cancelled”.
+	Status string
+
+	DurationMillis int64
+	Backends       []Backend
+
+	// Number of results and of packages with results.
+	Results  int
+	Packages int
+
+	// Number of packages of which only some matches are on the result
+	// pages (see -matches_per_package of dcs-web).
+	TruncatedPackages int `json:",omitempty"`
+}
+
+type Logger struct {
+	clientMode string
+	salt       []byte
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Opens the query log at path for appending. With ClientHash, client
+// addresses are hashed with salt, or with a random salt (which changes
+// whenever the log is opened, so that clients cannot be followed across
+// restarts) if salt is empty.
+func Open(path, clientMode, salt string) (*Logger, error) {
+	if clientMode != ClientNone && clientMode != ClientHash && clientMode != ClientPrefix {
+		return nil, fmt.Errorf("unknown client mode %q, use one of %s, %s or %s", clientMode, ClientNone, ClientHash, ClientPrefix)
+	}
+	l := &Logger{
+		clientMode: clientMode,
+		salt:       []byte(salt),
+	}
+	if salt == "" {
+		l.salt = make([]byte, 32)
+		if _, err := rand.Read(l.salt); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+// Returns client (as returned by clientAddress in dcs-web, e.g.
+// “192.0.2.1:4711”) anonymized according to the client mode.
+func (l *Logger) anonymize(client string) string {
+	if l.clientMode == ClientNone || client == "" {
+		return ""
+	}
+	host := client
+	if h, _, err := net.SplitHostPort(client); err == nil {
+		host = h
+	}
+	// X-Forwarded-For may contain multiple addresses. Only the last one,
+	// which the proxy appended, is trustworthy (see ratelimit.ClientIP).
+	entries := strings.Split(host, ",")
+	host = strings.TrimSpace(entries[len(entries)-1])
+	if l.clientMode == ClientHash {
+		h := sha256.New()
+		h.Write(l.salt)
+		h.Write([]byte(host))
+		return fmt.Sprintf("%x", h.Sum(nil)[:8])
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// Writes entry as one line of JSON, with client (see anonymize) as its
+// Client.
+func (l *Logger) Log(entry Entry, client string) error {
+	entry.Client = l.anonymize(client)
+	b, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.f.Write(append(b, '\n'))
+	return err
+}
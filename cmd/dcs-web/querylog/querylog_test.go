@@ -0,0 +1,80 @@
+// vim:ts=4:sw=4:noexpandtab
+package querylog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnonymize(t *testing.T) {
+	for _, test := range []struct {
+		mode   string
+		client string
+		want   string
+	}{
+		{ClientNone, "192.0.2.17:4711", ""},
+		{ClientPrefix, "192.0.2.17:4711", "192.0.2.0/24"},
+		{ClientPrefix, "192.0.2.17, 198.51.100.1:", "198.51.100.0/24"},
+		{ClientPrefix, "[2001:db8:1234:5678::1]:4711", "2001:db8:1234::/48"},
+		{ClientPrefix, "garbage", ""},
+	} {
+		l := &Logger{clientMode: test.mode}
+		if got := l.anonymize(test.client); got != test.want {
+			t.Errorf("anonymize(%q) with %s = %q, want %q", test.client, test.mode, got, test.want)
+		}
+	}
+
+	l := &Logger{clientMode: ClientHash, salt: []byte("salt")}
+	a, b := l.anonymize("192.0.2.17:4711"), l.anonymize("192.0.2.17:1234")
+	if a != b || a == "" || strings.Contains(a, "192") {
+		t.Errorf("hashes of the same address differ or reveal it: %q, %q", a, b)
+	}
+	if c := l.anonymize("192.0.2.18:4711"); c == a {
+		t.Errorf("hashes of different addresses are the same: %q", c)
+	}
+	other := &Logger{clientMode: ClientHash, salt: []byte("other salt")}
+	if c := other.anonymize("192.0.2.17:4711"); c == a {
+		t.Errorf("hashes with different salts are the same: %q", c)
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.log")
+
+	if _, err := Open(path, "everything", ""); err == nil {
+		t.Errorf("Open with an unknown client mode unexpectedly succeeded")
+	}
+	l, err := Open(path, ClientPrefix, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"foo", "bar"} {
+		if err := l.Log(Entry{Query: q, Status: "done"}, "192.0.2.17:4711"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), contents)
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Query != "bar" || entry.Client != "192.0.2.0/24" {
+		t.Errorf("second entry = %+v, want query bar from 192.0.2.0/24", entry)
+	}
+}
@@ -0,0 +1,94 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/querylog"
+	"github.com/Debian/dcs/cmd/dcs-web/search"
+	"log"
+	"net/url"
+	"time"
+)
+
+var (
+	queryLogPath = flag.String("query_log_path",
+		"",
+		"Path to a file to which finished queries are appended as JSON lines (see the querylog package). If empty, queries are not logged")
+	queryLogClient = flag.String("query_log_client",
+		querylog.ClientNone,
+		"How to log client addresses in the query log: none, hash (salted, see -query_log_salt) or prefix (/24 for IPv4, /48 for IPv6)")
+	queryLogSalt = flag.String("query_log_salt",
+		"",
+		"Salt for hashing client addresses in the query log. If empty, a random salt is used, so that the hashes change whenever dcs-web is restarted")
+)
+
+// The query log, or nil if -query_log_path is not set.
+var queryLog *querylog.Logger
+
+func openQueryLog() {
+	if *queryLogPath == "" {
+		return
+	}
+	var err error
+	if queryLog, err = querylog.Open(*queryLogPath, *queryLogClient, *queryLogSalt); err != nil {
+		log.Fatalf("Could not open query log: %v\n", err)
+	}
+}
+
+// Appends the finished query to the query log, if enabled. Queries which were
+// answered from the cache are not logged, as they were not run.
+func logQuery(queryid string) {
+	if queryLog == nil {
+		return
+	}
+	stateMu.Lock()
+	s := state[queryid]
+	stateMu.Unlock()
+
+	entry := querylog.Entry{
+		Started:           s.started,
+		QueryId:           queryid,
+		Status:            "done",
+		DurationMillis:    int64(s.ended.Sub(s.started) / time.Millisecond),
+		Results:           len(s.resultPointers),
+		Packages:          len(s.allPackagesSorted),
+		TruncatedPackages: len(s.truncatedPackages),
+	}
+	if values, err := url.ParseQuery(s.query); err == nil {
+		entry.Query = values.Get("q")
+		rewritten := search.RewriteQuery(url.URL{RawQuery: s.query})
+		filters := rewritten.Query()
+		filters.Del("q")
+		if len(filters) > 0 {
+			entry.Filters = filters
+		}
+	}
+	if failed, _ := queryErrors(queryid); failed {
+		entry.Status = "failed"
+	} else if s.cancelled {
+		entry.Status = "cancelled"
+	}
+
+	backends := common.Shards()
+	s.filesMu.Lock()
+	for idx, bstate := range s.perBackend {
+		backend := querylog.Backend{Backend: backends[idx]}
+		if idx < len(s.filesProcessed) {
+			backend.FilesSearched = s.filesProcessed[idx]
+		}
+		if bstate != nil {
+			if !bstate.done.IsZero() {
+				backend.DurationMillis = int64(bstate.done.Sub(s.started) / time.Millisecond)
+			}
+			backend.LimitHit = bstate.limitHit
+			backend.Failed = bstate.failed
+		}
+		entry.Backends = append(entry.Backends, backend)
+	}
+	s.filesMu.Unlock()
+
+	if err := queryLog.Log(entry, s.src); err != nil {
+		log.Printf("[%s] Could not write to the query log: %v\n", queryid, err)
+	}
+}
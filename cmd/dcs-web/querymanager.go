@@ -3,13 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/Debian/dcs/cmd/dcs-web/common"
 	"github.com/Debian/dcs/cmd/dcs-web/search"
 	"github.com/Debian/dcs/dpkgversion"
 	"github.com/Debian/dcs/proto"
+	dcsquery "github.com/Debian/dcs/query"
 	dcsregexp "github.com/Debian/dcs/regexp"
 	"github.com/Debian/dcs/stringpool"
 	"github.com/Debian/dcs/varz"
@@ -18,7 +19,6 @@ import (
 	"io"
 	"log"
 	"math"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -50,6 +51,9 @@ var (
 	influxDBPassword = flag.String("influx_db_password",
 		"root",
 		"InfluxDB password")
+	matchesPerPackage = flag.Int("matches_per_package",
+		100,
+		"Maximum number of matches per source package on the result pages (the best-ranked ones are shown, along with the number of matches in the package). Queries with the matches:all keyword get all matches. 0 means no limit")
 
 	perPackagePathRe = regexp.MustCompile(`^/perpackage-results/([^/]+)/` +
 		strconv.Itoa(resultsPerPackage) + `/page_([0-9]+).json$`)
@@ -86,6 +90,9 @@ type Error struct {
 
 	// Currently only “backendunavailable”
 	ErrorType string
+
+	// Human-readable explanation, e.g. why an “invalidquery” was refused.
+	Message string `json:",omitempty"`
 }
 
 type ProgressUpdate struct {
@@ -94,6 +101,18 @@ type ProgressUpdate struct {
 	FilesProcessed int
 	FilesTotal     int
 	Results        int
+
+	// Number of source backends (shards) which have finished searching,
+	// out of BackendsTotal.
+	BackendsDone  int
+	BackendsTotal int
+
+	// Number of source packages with results so far.
+	Packages int
+
+	// Number of matches so far per package, language and top-level
+	// directory (see mergedFacets), for narrowing down the query.
+	Facets map[string][]Facet `json:",omitempty"`
 }
 
 func (p *ProgressUpdate) EventType() string {
@@ -137,6 +156,12 @@ type resultPointer struct {
 
 	// Used for per-package results. Points into a stringpool.StringPool
 	packageName *string
+
+	// What the results are sorted by (see sortPointers) instead of the
+	// ranking, if the query asks for it: the popularity or modification time
+	// of the match, or its path.
+	sortKey float64
+	path    string
 }
 
 type pointerByRanking []resultPointer
@@ -166,16 +191,51 @@ type perBackendState struct {
 	packagePool    *stringpool.StringPool
 	resultPointers []resultPointer
 	allPackages    map[string]bool
+
+	// The facets of the latest progress update of this backend, guarded by
+	// queryState.filesMu.
+	facets []backendFacet
+
+	// When the backend finished searching, the limit it exceeded (if any)
+	// and whether it failed, for the query log. Guarded by
+	// queryState.filesMu.
+	done     time.Time
+	limitHit string
+	failed   bool
 }
 
 type queryState struct {
 	started  time.Time
 	ended    time.Time
+	lastUsed time.Time
 	events   []event
 	newEvent *sync.Cond
 	done     bool
 	query    string
 
+	// The client which started the query, for the query log.
+	src string
+
+	// The sort= parameter of the query, see sortPointers.
+	order string
+
+	// Cancels the requests to the source backends, see finishQuery.
+	cancel context.CancelFunc
+
+	// Number of clients waiting for events, see attachClient. Updated
+	// atomically.
+	clients *int32
+
+	// Whether the query was cancelled because all of its clients went away,
+	// in which case it is started again when requested the next time.
+	cancelled bool
+
+	// Clients of /stream which receive every result.
+	subscribers *resultSubscribers
+
+	// Number of source packages with results, updated atomically.
+	numPackages *int64
+
 	results [10]resultPointer
 
 	filesTotal     []int
@@ -191,9 +251,104 @@ type queryState struct {
 	resultPointers      []resultPointer
 	resultPointersByPkg map[string][]resultPointer
 
+	// Packages of which only some matches are on the result pages, see
+	// -matches_per_package.
+	truncatedPackages []truncatedPackage
+
 	allPackagesSorted []string
+}
+
+// Returns whether the query is done and failed or some source backend was
+// unavailable. Its results are incomplete, so it is started again when
+// requested the next time instead of being served from the cache. The caller
+// must hold stateMu.
+func (s queryState) failed() bool {
+	if !s.done {
+		return false
+	}
+	if failed, _ := eventErrors(s.events); failed {
+		return true
+	}
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	for _, backend := range s.perBackend {
+		if backend != nil && backend.failed {
+			return true
+		}
+	}
+	return false
+}
+
+// A package with more matches than -matches_per_package.
+type truncatedPackage struct {
+	Package string
+	Matches int
+}
+
+// Keeps only the first limit pointers (which are sorted by ranking) of each
+// source package and returns the remaining pointers and the packages which
+// had more, ordered by their number of matches.
+func limitPerPackage(pointers []resultPointer, limit int) ([]resultPointer, []truncatedPackage) {
+	matches := make(map[string]int)
+	kept := pointers[:0]
+	for _, pointer := range pointers {
+		pkg := *pointer.packageName
+		if underscore := strings.Index(pkg, "_"); underscore >= 0 {
+			pkg = pkg[:underscore]
+		}
+		matches[pkg]++
+		if matches[pkg] <= limit {
+			kept = append(kept, pointer)
+		}
+	}
+	var truncated []truncatedPackage
+	for pkg, n := range matches {
+		if n > limit {
+			truncated = append(truncated, truncatedPackage{Package: pkg, Matches: n})
+		}
+	}
+	sort.Slice(truncated, func(i, j int) bool {
+		if truncated[i].Matches != truncated[j].Matches {
+			return truncated[i].Matches > truncated[j].Matches
+		}
+		return truncated[i].Package < truncated[j].Package
+	})
+	return kept, truncated
+}
+
+// Returns the sort= parameter of query (as passed to maybeStartQuery).
+func sortOrder(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ""
+	}
+	return dcsquery.FromValues(values).Sort
+}
 
-	FirstPathRank float32
+// Sorts the pointers (which are sorted by ranking) by order, see
+// dcsquery.SortOrders. Results which are equal in that order stay sorted by
+// ranking.
+func sortPointers(pointers []resultPointer, order string) {
+	var less func(a, b *resultPointer) bool
+	switch order {
+	case dcsquery.SortPath:
+		less = func(a, b *resultPointer) bool { return a.path < b.path }
+	case dcsquery.SortPopularity, dcsquery.SortModTime:
+		less = func(a, b *resultPointer) bool { return a.sortKey > b.sortKey }
+	default:
+		return
+	}
+	sort.SliceStable(pointers, func(i, j int) bool { return less(&pointers[i], &pointers[j]) })
+}
+
+// Returns whether query (as passed to maybeStartQuery) contains the
+// matches:all keyword.
+func allMatches(query string) bool {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return false
+	}
+	return dcsquery.Parse(values.Get("q")).AllMatches
 }
 
 func (qs *queryState) numResults() int {
@@ -204,16 +359,52 @@ func (qs *queryState) numResults() int {
 	return result
 }
 
+// Returns the progress of the query so far, like the progress messages sent
+// to its clients. Backends which did not report how many files they search
+// yet are not counted.
+func queryProgress(queryid string) ProgressUpdate {
+	stateMu.Lock()
+	s := state[queryid]
+	stateMu.Unlock()
+	p := ProgressUpdate{
+		Type:          "progress",
+		QueryId:       queryid,
+		BackendsTotal: len(s.filesTotal),
+		Results:       s.numResults(),
+		Packages:      int(atomic.LoadInt64(s.numPackages)),
+	}
+	s.filesMu.Lock()
+	defer s.filesMu.Unlock()
+	for i, total := range s.filesTotal {
+		if total == -1 {
+			continue
+		}
+		p.FilesTotal += total
+		p.FilesProcessed += s.filesProcessed[i]
+		if s.filesProcessed[i] == total {
+			p.BackendsDone++
+		}
+	}
+	return p
+}
+
 var (
 	state   = make(map[string]queryState)
 	stateMu sync.Mutex
 )
 
-func queryBackend(queryid string, backend string, backendidx int, sourceQuery []byte) {
+// Queries the source backend with the given index. If files is not nil, only
+// these files are searched (see refineFiles).
+func queryBackend(ctx context.Context, queryid string, backend string, backendidx int, query, rewrittenURL string, files []string) {
 	// When exiting this function, check that all results were processed. If
 	// not, the backend query must have failed for some reason. Send a progress
 	// update to prevent the query from running forever.
 	defer func() {
+		if ctx.Err() == context.Canceled {
+			// The query was cancelled (see detachClient) or is done.
+			return
+		}
+
 		filesTotal := state[queryid].filesTotal[backendidx]
 
 		if state[queryid].filesProcessed[backendidx] == filesTotal {
@@ -224,6 +415,11 @@ func queryBackend(queryid string, backend string, backendidx int, sourceQuery []
 			filesTotal = 0
 		}
 
+		s := state[queryid]
+		s.filesMu.Lock()
+		s.perBackend[backendidx].failed = true
+		s.filesMu.Unlock()
+
 		seg := capn.NewBuffer(nil)
 		p := proto.NewProgressUpdate(seg)
 		p.SetFilesprocessed(uint64(filesTotal))
@@ -236,75 +432,120 @@ func queryBackend(queryid string, backend string, backendidx int, sourceQuery []
 		})
 	}()
 
-	// TODO: switch in the config
-	log.Printf("[%s] [src:%s] connecting...\n", queryid, backend)
-	conn, err := net.DialTimeout("tcp", strings.Replace(backend, "28082", "26082", -1), 5*time.Second)
-	if err != nil {
-		log.Printf("[%s] [src:%s] Connection failed: %v\n", queryid, backend, err)
+	if !backendServing(backendidx) {
+		// Draining is planned, so the shard is skipped without an error:
+		// reporting it as done with no files keeps the deferred function
+		// from sending a “backendunavailable” event.
+		log.Printf("[%s] [src:%s] skipping, shard is draining\n", queryid, backend)
+		seg := capn.NewBuffer(nil)
+		storeProgress(queryid, backendidx, proto.NewProgressUpdate(seg))
 		return
 	}
-	defer conn.Close()
-	if _, err := conn.Write(sourceQuery); err != nil {
-		log.Printf("[%s] [src:%s] could not send query: %v\n", queryid, backend, err)
+	if !backendHealthy(backendidx) {
+		log.Printf("[%s] [src:%s] skipping, shard is unhealthy\n", queryid, backend)
+		varz.Increment("skipped-unhealthy-backends")
 		return
 	}
 
-	bufferedReader := bufio.NewReaderSize(conn, 65536)
-	var capnbuf bytes.Buffer
+	if files != nil && len(files) == 0 {
+		// None of the results being narrowed down are on this shard.
+		seg := capn.NewBuffer(nil)
+		storeProgress(queryid, backendidx, proto.NewProgressUpdate(seg))
+		return
+	}
+
+	// Returning cancels the call, so that the backend stops searching in
+	// case we gave up on it.
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(*backendIdleTimeout, cancel)
+	defer idle.Stop()
+
+	seg := capn.NewBuffer(nil)
+	request := proto.NewRootSearchRequest(seg)
+	request.SetQuery(query)
+	request.SetUrl(rewrittenURL)
+	if len(files) > 0 {
+		list := seg.NewTextList(len(files))
+		for i, file := range files {
+			list.Set(i, file)
+		}
+		request.SetFiles(list)
+	}
+	stream, z, err := openStream(callCtx, queryid, backendidx, request)
+	if err != nil {
+		if err == io.EOF {
+			log.Printf("[%s] [src:%s] EOF\n", queryid, backend)
+		} else {
+			log.Printf("[%s] [src:%s] could not send query: %v\n", queryid, backend, err)
+			if transient(err) {
+				markUnhealthy(backendidx)
+			}
+		}
+		return
+	}
 
 	for !state[queryid].done {
-		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		idle.Reset(*backendIdleTimeout)
+
+		if z.Which() == proto.Z_PROGRESSUPDATE {
+			storeProgress(queryid, backendidx, z.Progressupdate())
+		} else {
+			storeResult(queryid, backendidx, z.Match())
+		}
 
-		seg, err := capn.ReadFromPackedStream(bufferedReader, &capnbuf)
+		z, err = stream.Recv()
 		if err != nil {
 			if err == io.EOF {
 				log.Printf("[%s] [src:%s] EOF\n", queryid, backend)
 				return
 			} else {
-				log.Printf("[%s] [src:%s] Error decoding result stream: %v\n", queryid, backend, err)
+				log.Printf("[%s] [src:%s] Error receiving results: %v\n", queryid, backend, err)
 				return
 			}
 		}
-
-		z := proto.ReadRootZ(seg)
-		if z.Which() == proto.Z_PROGRESSUPDATE {
-			storeProgress(queryid, backendidx, z.Progressupdate())
-		} else {
-			storeResult(queryid, backendidx, z.Match())
-		}
 	}
 	log.Printf("[%s] [src:%s] query done, disconnecting\n", queryid, backend)
 }
 
 func maybeStartQuery(queryid, src, query string) bool {
+	return maybeStartQuerySubscribed(queryid, src, query, nil)
+}
+
+// Like maybeStartQuery, but if a new query is started and sub is not nil,
+// sub receives all of its results (see StreamHandler).
+func maybeStartQuerySubscribed(queryid, src, query string, sub *resultSubscriber) bool {
+	countPopularQuery(query)
+
 	stateMu.Lock()
 	defer stateMu.Unlock()
 	querystate, running := state[queryid]
 	// XXX: Starting a new query while there may still be clients reading that
 	// query is not a great idea. Best fix may be to make getEvent() use a
 	// querystate instead of the string identifier.
-	if !running || time.Since(querystate.started) > 30*time.Minute {
-		// See if we can garbage-collect old queries.
-		if !running && len(state) >= 10 {
-			log.Printf("Trying to garbage collect queries (currently %d)\n", len(state))
-			for queryid, s := range state {
-				if len(state) < 10 {
-					break
-				}
-				if !s.done {
-					continue
-				}
-				for _, state := range s.perBackend {
-					state.tempFile.Close()
-				}
-				delete(state, queryid)
+	if !running || querystate.cancelled || querystate.failed() || time.Since(querystate.started) > 30*time.Minute {
+		if running {
+			querystate.cancel()
+			querystate.subscribers.close()
+			for _, state := range querystate.perBackend {
+				state.tempFile.Close()
 			}
-			log.Printf("Garbage collection done. %d queries remaining", len(state))
 		}
-		backends := strings.Split(*common.SourceBackends, ",")
+		if !running {
+			evictResults()
+		}
+		backends := common.Shards()
+		ctx, cancel := context.WithTimeout(context.Background(), *queryTimeout)
 		state[queryid] = queryState{
+			cancel:         cancel,
+			subscribers:    &resultSubscribers{},
+			clients:        new(int32),
+			numPackages:    new(int64),
 			started:        time.Now(),
+			lastUsed:       time.Now(),
 			query:          query,
+			src:            src,
+			order:          sortOrder(query),
 			newEvent:       sync.NewCond(&sync.Mutex{}),
 			filesTotal:     make([]int, len(backends)),
 			filesProcessed: make([]int, len(backends)),
@@ -344,6 +585,9 @@ func maybeStartQuery(queryid, src, query string) bool {
 			}
 		}
 		log.Printf("initial results = %v\n", state[queryid])
+		if sub != nil {
+			state[queryid].subscribers.add(sub)
+		}
 
 		// Rewrite the query into a query for source backends.
 		fakeUrl, err := url.Parse("?" + query)
@@ -351,26 +595,31 @@ func maybeStartQuery(queryid, src, query string) bool {
 			log.Fatal(err)
 		}
 		rewritten := search.RewriteQuery(*fakeUrl)
-		type streamingRequest struct {
-			Query string
-			URL   string
-		}
-		request := streamingRequest{
-			Query: rewritten.Query().Get("q"),
-			URL:   rewritten.String(),
-		}
-		log.Printf("[%s] querying for %q\n", queryid, request.Query)
-		sourceQuery, err := json.Marshal(&request)
-		if err != nil {
-			log.Fatal(err)
+		sourceQuery := rewritten.Query().Get("q")
+		log.Printf("[%s] querying for %q\n", queryid, sourceQuery)
+
+		var files [][]string
+		if within := rewritten.Query().Get("within"); within != "" {
+			if files, err = refineFiles(within); err != nil {
+				log.Printf("[%s] cannot narrow down the results of %s: %v\n", queryid, within, err)
+				failQuery(queryid)
+				return false
+			}
+			varz.Increment("refined-queries")
 		}
 
 		for idx, backend := range backends {
-			go queryBackend(queryid, backend, idx, sourceQuery)
+			var shardFiles []string
+			if files != nil {
+				shardFiles = files[idx]
+			}
+			go queryBackend(ctx, queryid, backend, idx, sourceQuery, rewritten.String(), shardFiles)
 		}
 		return false
 	}
 
+	touchQuery(queryid)
+	varz.Increment("result-cache-hits")
 	return true
 }
 
@@ -443,8 +692,9 @@ func QueryzHandler(w http.ResponseWriter, r *http.Request) {
 
 	sort.Sort(byStarted(stats))
 
-	if err := common.Templates.ExecuteTemplate(w, "queryz.html", map[string]interface{}{
-		"queries": stats,
+	if err := common.ExecuteTemplate(w, r, "queryz.html", map[string]interface{}{
+		"queries":   stats,
+		"csrftoken": csrfToken(w, r),
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -458,13 +708,19 @@ func sendPaginationUpdate(queryid string, s queryState) {
 		Type        string
 		QueryId     string
 		ResultPages int
+
+		// Packages of which only the best matches are on the result
+		// pages, with their total number of matches. Searching with
+		// “package:<name> matches:all” returns all of them.
+		TruncatedPackages []truncatedPackage `json:",omitempty"`
 	}
 
 	if s.resultPages > 0 {
 		addEventMarshal(queryid, &Pagination{
-			Type:        "pagination",
-			QueryId:     queryid,
-			ResultPages: s.resultPages,
+			Type:              "pagination",
+			QueryId:           queryid,
+			ResultPages:       s.resultPages,
+			TruncatedPackages: s.truncatedPackages,
 		})
 	}
 }
@@ -485,25 +741,6 @@ func storeResult(queryid string, backendidx int, result proto.Match) {
 	// for the top 10 at all.
 	s := state[queryid]
 
-	if s.FirstPathRank > 0 {
-		// Now store the combined ranking of PathRanking (pre) and Ranking (post).
-		// We add the values because they are both percentages.
-		// To make the Ranking (post) less significant, we multiply it with
-		// 1/10 * FirstPathRank. We used to use maxPathRanking here, but
-		// requiring that means delaying the search until all results are
-		// there. Instead, FirstPathRank is a good enough approximation (but
-		// different enough for each query that we can’t hardcode it).
-		result.SetRanking(result.Pathrank() + ((s.FirstPathRank * 0.1) * result.Ranking()))
-	} else {
-		// This code path (and lock acquisition) gets executed only on the
-		// first result.
-		stateMu.Lock()
-		s = state[queryid]
-		s.FirstPathRank = result.Pathrank()
-		state[queryid] = s
-		stateMu.Unlock()
-	}
-
 	h := fnv.New64()
 	io.WriteString(h, result.Path())
 
@@ -536,23 +773,85 @@ func storeResult(queryid string, backendidx int, result proto.Match) {
 	}
 
 	var written int64
+	var streamed bytes.Buffer
 	w := io.MultiWriter(s.perBackend[backendidx].tempFileWriter, countingWriter{&written})
+	if s.subscribers.active() {
+		w = io.MultiWriter(w, &streamed)
+	}
 	if err := result.WriteJSON(w); err != nil {
 		log.Printf("[%s] could not write %v: %v\n", queryid, result, err)
 		failQuery(queryid)
 		return
 	}
+	if streamed.Len() > 0 {
+		s.subscribers.send(streamed.Bytes())
+	}
 
 	bstate := s.perBackend[backendidx]
-	bstate.resultPointers = append(bstate.resultPointers, resultPointer{
+	pointer := resultPointer{
 		backendidx:  backendidx,
 		ranking:     result.Ranking(),
 		offset:      bstate.tempFileOffset,
 		length:      written,
 		pathHash:    h.Sum64(),
-		packageName: bstate.packagePool.Get(result.Package())})
+		packageName: bstate.packagePool.Get(result.Package())}
+	switch s.order {
+	case dcsquery.SortPath:
+		pointer.path = result.Path()
+	case dcsquery.SortPopularity:
+		pointer.sortKey = float64(result.Popularity())
+	case dcsquery.SortModTime:
+		pointer.sortKey = float64(result.Modtime())
+	}
+	bstate.resultPointers = append(bstate.resultPointers, pointer)
 	bstate.tempFileOffset += written
-	bstate.allPackages[result.Package()] = true
+	if !bstate.allPackages[result.Package()] {
+		bstate.allPackages[result.Package()] = true
+		atomic.AddInt64(s.numPackages, 1)
+	}
+}
+
+// Registers a client which waits for the events of the query and returns the
+// function which unregisters it again, see detachClient. Queries which are not
+// running (e.g. because they were evicted from the cache in the meantime)
+// cannot be cancelled, so there is nothing to register.
+func attachClient(queryid string) func() {
+	stateMu.Lock()
+	s, ok := state[queryid]
+	stateMu.Unlock()
+	if !ok {
+		return func() {}
+	}
+	atomic.AddInt32(s.clients, 1)
+	return func() { detachClient(queryid, s.clients) }
+}
+
+// Unregisters a client of the query. When the last client of a query which is
+// not done yet goes away (e.g. because the browser tab was closed), nobody is
+// going to look at the results, so the query is cancelled: the source
+// backends stop searching and the query is started again when it is
+// requested the next time. clients is the client counter of the query the
+// client was attached to, which only is the current one if the query was not
+// started again since.
+func detachClient(queryid string, clients *int32) {
+	remaining := atomic.AddInt32(clients, -1)
+	stateMu.Lock()
+	s, ok := state[queryid]
+	if !ok || s.clients != clients || remaining > 0 || s.done {
+		stateMu.Unlock()
+		return
+	}
+	s.cancelled = true
+	state[queryid] = s
+	stateMu.Unlock()
+
+	log.Printf("[%s] all clients went away, cancelling\n", queryid)
+	varz.Increment("cancelled-queries")
+	addEventMarshal(queryid, &Error{
+		Type:      "error",
+		ErrorType: "cancelled",
+	})
+	finishQuery(queryid)
 }
 
 func failQuery(queryid string) {
@@ -567,6 +866,13 @@ func failQuery(queryid string) {
 func finishQuery(queryid string) {
 	log.Printf("[%s] done, closing all client channels.\n", queryid)
 	addEvent(queryid, []byte{}, nil)
+	if cancel := state[queryid].cancel; cancel != nil {
+		cancel()
+	}
+	if subscribers := state[queryid].subscribers; subscribers != nil {
+		subscribers.close()
+	}
+	logQuery(queryid)
 
 	if *influxDBHost != "" {
 		go func() {
@@ -707,7 +1013,6 @@ func writeToDisk(queryid string) error {
 		stateMu.Unlock()
 		return nil
 	}
-	idx := 0
 
 	// For each full package (i3-wm_4.8-1), store only the newest version.
 	packageVersions := make(map[string]dpkgversion.Version)
@@ -731,21 +1036,37 @@ func writeToDisk(queryid string) error {
 		}
 	}
 
-	packages := make([]string, len(packageVersions))
-	for pkg, _ := range packageVersions {
-		packages[idx] = pkg
-		idx++
-	}
-	// TODO: sort by ranking as soon as we store the best ranking with each package. (at the moment it’s first result, first stored)
-	s.allPackagesSorted = packages
-	state[queryid] = s
 	stateMu.Unlock()
 
-	log.Printf("[%s] sorting, %d results, %d packages.\n", queryid, len(pointers), len(packages))
+	log.Printf("[%s] sorting, %d results, %d packages.\n", queryid, len(pointers), len(packageVersions))
 	pointerSortingStarted := time.Now()
 	sort.Sort(pointerByRanking(pointers))
 	log.Printf("[%s] pointer sorting done (%v).\n", queryid, time.Since(pointerSortingStarted))
 
+	// Keep packages with lots of matches (e.g. generated files) from
+	// flooding the result pages.
+	var truncated []truncatedPackage
+	if *matchesPerPackage > 0 && !allMatches(s.query) {
+		pointers, truncated = limitPerPackage(pointers, *matchesPerPackage)
+	}
+
+	// The best matches of each package (see above) are sorted as requested.
+	sortPointers(pointers, s.order)
+
+	// Order the packages by their first result, so that the per-package
+	// results (e.g. grouped by the source backends, see group=package)
+	// start with the best package.
+	packages := make([]string, 0, len(packageVersions))
+	seen := make(map[string]bool, len(packageVersions))
+	for _, pointer := range pointers {
+		pkg := *pointer.packageName
+		name := pkg[:strings.Index(pkg, "_")]
+		if !seen[name] && packageVersions[name].String() == pkg[len(name)+1:] {
+			seen[name] = true
+			packages = append(packages, name)
+		}
+	}
+
 	// TODO: it’d be so much better if we would correctly handle ESPACE errors
 	// in the code below (and above), but for that we need to carefully test it.
 	ensureEnoughSpaceAvailable()
@@ -774,9 +1095,11 @@ func writeToDisk(queryid string) error {
 
 	stateMu.Lock()
 	s = state[queryid]
+	s.allPackagesSorted = packages
 	s.resultPointers = pointers
 	s.resultPointersByPkg = bypkg
 	s.resultPages = pages
+	s.truncatedPackages = truncated
 	state[queryid] = s
 	stateMu.Unlock()
 
@@ -785,11 +1108,30 @@ func writeToDisk(queryid string) error {
 }
 
 func storeProgress(queryid string, backendidx int, progress proto.ProgressUpdate) {
-	backends := strings.Split(*common.SourceBackends, ",")
+	backends := common.Shards()
+	if limit := progress.Limitshit(); limit != "" {
+		// The backend returned partial results, see the -max_* flags of
+		// dcs-source-backend.
+		log.Printf("[%s] [src:%d] exceeded the %s limit\n", queryid, backendidx, limit)
+		addEventMarshal(queryid, &Error{
+			Type:      "error",
+			ErrorType: "limitshit",
+			Message:   limit,
+		})
+	}
 	s := state[queryid]
 	s.filesMu.Lock()
 	s.filesTotal[backendidx] = int(progress.Filestotal())
 	s.filesProcessed[backendidx] = int(progress.Filesprocessed())
+	if progress.Facets().Len() > 0 {
+		s.perBackend[backendidx].facets = backendFacets(progress)
+	}
+	if progress.Limitshit() != "" {
+		s.perBackend[backendidx].limitHit = progress.Limitshit()
+	}
+	if s.filesProcessed[backendidx] == s.filesTotal[backendidx] && s.perBackend[backendidx].done.IsZero() {
+		s.perBackend[backendidx].done = time.Now()
+	}
 	s.filesMu.Unlock()
 	allSet := true
 	for i := 0; i < len(backends); i++ {
@@ -805,8 +1147,12 @@ func storeProgress(queryid string, backendidx int, progress proto.ProgressUpdate
 		filesProcessed += processed
 	}
 	filesTotal := 0
-	for _, total := range s.filesTotal {
+	backendsDone := 0
+	for i, total := range s.filesTotal {
 		filesTotal += total
+		if total != -1 && s.filesProcessed[i] == total {
+			backendsDone++
+		}
 	}
 
 	if allSet && filesProcessed == filesTotal {
@@ -825,6 +1171,10 @@ func storeProgress(queryid string, backendidx int, progress proto.ProgressUpdate
 			FilesProcessed: filesProcessed,
 			FilesTotal:     filesTotal,
 			Results:        s.numResults(),
+			BackendsDone:   backendsDone,
+			BackendsTotal:  len(backends),
+			Packages:       int(atomic.LoadInt64(s.numPackages)),
+			Facets:         mergedFacets(s),
 		})
 		if filesProcessed == filesTotal {
 			finishQuery(queryid)
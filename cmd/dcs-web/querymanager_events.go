@@ -24,6 +24,10 @@ import (
 // ProgressUpdate event deletes older ProgressUpdates, since only the very
 // latest progress is interesting for clients that “join” in on the query.
 
+// How long queries take until all source backends are done with them, so
+// that /varz offers percentiles of the query latency.
+var queryDuration = varz.NewHistogram("query-duration-seconds", varz.DurationBuckets)
+
 type obsoletableEvent interface {
 	ObsoletedBy(newEvent *obsoletableEvent) bool
 	EventType() string
@@ -52,6 +56,7 @@ func addEvent(queryid string, data []byte, origdata interface{}) {
 		s.done = true
 		s.ended = time.Now()
 		varz.Decrement("active-queries")
+		queryDuration.ObserveDuration(s.ended.Sub(s.started))
 	}
 	state[queryid] = s
 
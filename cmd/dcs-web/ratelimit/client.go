@@ -0,0 +1,35 @@
+// vim:ts=4:sw=4:noexpandtab
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP address of the client which sent r, by which it is
+// rate-limited. Requests from localhost come from the reverse proxy (see
+// nginx.example), which appends the address of its client to
+// X-Forwarded-For. Only that last entry is used: the ones before it are
+// whatever the client sent, so a client could pick a new one for every
+// request. Other requests are identified by their RemoteAddr.
+func ClientIP(r *http.Request) string {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	xff := r.Header.Get("X-Forwarded-For")
+	if ip == nil || !ip.IsLoopback() || xff == "" {
+		return host
+	}
+	entries := strings.Split(xff, ",")
+	last := strings.TrimSpace(entries[len(entries)-1])
+	if h, _, err := net.SplitHostPort(last); err == nil {
+		last = h
+	}
+	if proxied := net.ParseIP(last); proxied != nil {
+		return proxied.String()
+	}
+	return host
+}
@@ -0,0 +1,51 @@
+// vim:ts=4:sw=4:noexpandtab
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, test := range []struct {
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"192.0.2.17:4711", "", "192.0.2.17"},
+		// Only the proxy on localhost is trusted to set X-Forwarded-For.
+		{"192.0.2.17:4711", "198.51.100.1", "192.0.2.17"},
+		{"127.0.0.1:4711", "198.51.100.1", "198.51.100.1"},
+		{"[::1]:4711", "2001:db8::1", "2001:db8::1"},
+		// Entries before the one the proxy appended are spoofable.
+		{"127.0.0.1:4711", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:4711", "203.0.113.10,198.51.100.1", "198.51.100.1"},
+		{"127.0.0.1:4711", "garbage", "127.0.0.1"},
+		{"127.0.0.1:4711", "", "127.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/search", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if got := ClientIP(r); got != test.want {
+			t.Errorf("ClientIP(%q, X-Forwarded-For %q) = %q, want %q", test.remoteAddr, test.xff, got, test.want)
+		}
+	}
+}
+
+func TestSpoofedForwardedForIsLimited(t *testing.T) {
+	l := New(1, 2)
+	allowed := 0
+	for _, spoofed := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3", "203.0.113.4"} {
+		r := httptest.NewRequest("GET", "/search", nil)
+		r.RemoteAddr = "127.0.0.1:4711"
+		r.Header.Set("X-Forwarded-For", spoofed+", 198.51.100.1")
+		if ok, _ := l.Allow(ClientIP(r)); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("%d requests with different spoofed X-Forwarded-For entries allowed, want the burst of 2", allowed)
+	}
+}
@@ -0,0 +1,78 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Token bucket rate limiting of requests per client.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// How often buckets which are full again are dropped, so that clients which
+// are gone do not use memory forever.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limits the requests of each client (identified by a key, e.g. its IP
+// address) to rate per second on average, allowing bursts of up to burst
+// requests.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Takes a token from the bucket of key. If the bucket is empty, the request
+// must be refused and the returned duration is how long the client needs to
+// wait until the next request will be allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Drops the buckets which are full again. Must be called with l.mu held.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,60 @@
+// vim:ts=4:sw=4:noexpandtab
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	// The burst is allowed right away.
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d of the burst was refused", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatalf("request exceeding the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want %v", wait, 500*time.Millisecond)
+	}
+
+	// Other clients have their own bucket.
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("request of another client was refused")
+	}
+
+	// After waiting, a request is allowed again.
+	now = now.Add(wait)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("request after waiting was refused")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Errorf("second request after waiting was allowed")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 2)
+	l.now = func() time.Time { return now }
+	l.Allow("gone")
+	l.Allow("busy")
+	l.Allow("busy")
+
+	now = now.Add(sweepInterval + time.Second)
+	l.buckets["busy"].last = now
+	l.Allow("new")
+	if _, ok := l.buckets["gone"]; ok {
+		t.Errorf("full bucket was not dropped")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Errorf("bucket which is not full was dropped")
+	}
+}
@@ -0,0 +1,90 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Queries with the within: keyword narrow down the results of an earlier
+// query: only the files which have results of that query are searched (see
+// SearchRequest.files), instead of asking the index for all files which may
+// match. The files are read from the unsorted results of the earlier query,
+// which stay on disk after it was evicted from the cache (until
+// ensureEnoughSpaceAvailable deletes them).
+
+// Maximum number of files per shard whose results can be narrowed down, as
+// all of them are sent to the source-backend in a single request.
+const maxRefineFiles = 50000
+
+var queryIdRe = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// Returns an error if the results of the query with the given identifier
+// cannot be narrowed down (yet). Must be called with stateMu held.
+func checkRefinable(within string) error {
+	if !queryIdRe.MatchString(within) {
+		return fmt.Errorf("within: needs the identifier of an earlier query")
+	}
+	if s, ok := state[within]; ok && !s.done {
+		return fmt.Errorf("the query to narrow down is still running")
+	}
+	if _, err := os.Stat(filepath.Join(*queryResultsPath, within)); err != nil {
+		return fmt.Errorf("the results to narrow down are no longer available, please search again")
+	}
+	return nil
+}
+
+// Returns the files with results of the query with the given identifier, one
+// list per shard (in the order of -source_backends). Must be called with
+// stateMu held.
+func refineFiles(within string) ([][]string, error) {
+	if err := checkRefinable(within); err != nil {
+		return nil, err
+	}
+	files := make([][]string, len(common.Shards()))
+	for i := range files {
+		var err error
+		path := filepath.Join(*queryResultsPath, within, fmt.Sprintf("unsorted_%d.json", i))
+		if files[i], err = resultFiles(path); err != nil {
+			return nil, err
+		}
+		if len(files[i]) > maxRefineFiles {
+			return nil, fmt.Errorf("the results have too many files (more than %d) to narrow them down, please search again with a more specific query", maxRefineFiles)
+		}
+	}
+	return files, nil
+}
+
+// Returns the distinct paths of the results in the given unsorted results
+// file (see storeResult), in the order in which they were found. The result
+// is not nil even if there are no results, see queryBackend.
+func resultFiles(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files := []string{}
+	seen := make(map[string]bool)
+	dec := json.NewDecoder(f)
+	for {
+		var result struct {
+			Path string
+		}
+		if err := dec.Decode(&result); err != nil {
+			if err == io.EOF {
+				return files, nil
+			}
+			return nil, fmt.Errorf("reading %q: %v", path, err)
+		}
+		if !seen[result.Path] {
+			seen[result.Path] = true
+			files = append(files, result.Path)
+		}
+	}
+}
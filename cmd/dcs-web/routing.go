@@ -0,0 +1,155 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/proto"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	capn "github.com/glycerine/go-capnproto"
+)
+
+// The routing table: the administrative state of the index-backend behind
+// each source-backend, as reported by the Health call of the source-backend.
+// Shards in state “draining” are not queried, so that their host can be taken
+// down. shardGenerations contains the generation of the index each
+// index-backend has loaded, see updateResultsGeneration. shardUnhealthy is set
+// for shards which did not answer the last Health call (or a query), which
+// are skipped until they answer again.
+var (
+	shardStates      []string
+	shardGenerations []uint64
+	shardUnhealthy   []bool
+	shardStatesMu    sync.RWMutex
+)
+
+var routingClient = &http.Client{Timeout: 5 * time.Second}
+
+func fetchShardState(backendidx int) (string, uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// All replicas of a shard serve the same index, so the first one which
+	// answers tells.
+	var reply proto.HealthReply
+	var err error
+	for _, replica := range sourceBackends[backendidx] {
+		reply, err = replica.Health(ctx, proto.NewRootHealthRequest(capn.NewBuffer(nil)))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if !reply.Healthy() {
+		return "", 0, fmt.Errorf("unhealthy: %s", reply.Status())
+	}
+	return reply.Shardstate(), reply.Generation(), nil
+}
+
+func updateShardStates(backends []string) {
+	for idx, backend := range backends {
+		state, generation, err := fetchShardState(idx)
+		if err != nil {
+			// Keep the last known state, but skip the shard when querying
+			// until it answers again.
+			log.Printf("Could not get shard state of %s: %v\n", backend, err)
+			markUnhealthy(idx)
+			continue
+		}
+		shardStatesMu.Lock()
+		if shardStates[idx] != state {
+			log.Printf("Shard %s is now %q\n", backend, state)
+		}
+		if shardUnhealthy[idx] {
+			log.Printf("Shard %s is healthy again\n", backend)
+			shardUnhealthy[idx] = false
+		}
+		shardStates[idx] = state
+		updateResultsGeneration(idx, generation)
+		shardStatesMu.Unlock()
+	}
+}
+
+// Polls the shard state of all backends every 10 seconds, run within a
+// goroutine.
+func pollShardStates() {
+	backends := common.Shards()
+	shardStatesMu.Lock()
+	shardStates = make([]string, len(backends))
+	shardGenerations = make([]uint64, len(backends))
+	shardUnhealthy = make([]bool, len(backends))
+	shardStatesMu.Unlock()
+	for {
+		updateShardStates(backends)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// Returns whether new queries should be sent to the backend with the given
+// index. Read-only shards still answer queries.
+func backendServing(backendidx int) bool {
+	shardStatesMu.RLock()
+	defer shardStatesMu.RUnlock()
+	if backendidx >= len(shardStates) {
+		return true
+	}
+	return shardStates[backendidx] != "draining"
+}
+
+// Returns whether the backend with the given index answered the last Health
+// call (and all queries since). Unhealthy backends are skipped, so that
+// queries return the results of the other shards right away instead of
+// waiting for the unhealthy one to time out.
+func backendHealthy(backendidx int) bool {
+	shardStatesMu.RLock()
+	defer shardStatesMu.RUnlock()
+	if backendidx >= len(shardUnhealthy) {
+		return true
+	}
+	return !shardUnhealthy[backendidx]
+}
+
+// Skips the backend with the given index until it answers the next Health
+// call, see pollShardStates.
+func markUnhealthy(backendidx int) {
+	shardStatesMu.Lock()
+	defer shardStatesMu.Unlock()
+	if backendidx < len(shardUnhealthy) {
+		shardUnhealthy[backendidx] = true
+	}
+}
+
+// Reports the routing table as JSON.
+func RoutingzHandler(w http.ResponseWriter, r *http.Request) {
+	type shard struct {
+		Backend string
+		State   string
+		Healthy bool
+	}
+	var reply []shard
+	shardStatesMu.RLock()
+	for idx, backend := range common.Shards() {
+		state := "unknown"
+		if idx < len(shardStates) && shardStates[idx] != "" {
+			state = shardStates[idx]
+		}
+		healthy := idx >= len(shardUnhealthy) || !shardUnhealthy[idx]
+		reply = append(reply, shard{Backend: backend, State: state, Healthy: healthy})
+	}
+	shardStatesMu.RUnlock()
+
+	jsonReply, err := json.Marshal(&reply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonReply)
+}
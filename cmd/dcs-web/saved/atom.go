@@ -0,0 +1,84 @@
+// vim:ts=4:sw=4:noexpandtab
+package saved
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// See RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// Writes the Atom feed of the new matches of search. base is the URL under
+// which dcs-web is reachable (e.g. “https://codesearch.debian.net”), which
+// the links and identifiers of the feed are built from.
+func WriteAtom(w io.Writer, search Search, base string) error {
+	updated := search.Updated
+	if updated.IsZero() {
+		updated = search.Created
+	}
+	feed := atomFeed{
+		Id:      base + "/feed/" + search.Id,
+		Title:   fmt.Sprintf("Debian Code Search: new matches for %q", search.Query),
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{"Debian Code Search"},
+		Links: []atomLink{
+			{Rel: "self", Href: base + "/feed/" + search.Id},
+			{Rel: "alternate", Href: base + "/search?" + url.Values{"q": []string{search.Query}}.Encode()},
+		},
+	}
+	for _, entry := range search.Entries {
+		file := entry.Package + "_" + entry.Version + "/" + entry.Path
+		show := base + "/show?" + url.Values{
+			"file": []string{file},
+			"line": []string{fmt.Sprint(entry.Line)},
+			"q":    []string{search.Query},
+		}.Encode() + fmt.Sprintf("#L%d", entry.Line)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Id:      fmt.Sprintf("%s/feed/%s/%s/%d", base, search.Id, entry.key(), entry.Found.Unix()),
+			Title:   fmt.Sprintf("%s:%d", file, entry.Line),
+			Updated: entry.Found.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: show},
+			Content: atomContent{"text", entry.Context},
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", " ")
+	return encoder.Encode(&feed)
+}
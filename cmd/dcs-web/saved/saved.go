@@ -0,0 +1,216 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Saved searches, which are re-run whenever the index is updated so that
+// their feeds (see WriteAtom) list the matches which were not found before.
+package saved
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of new matches which the feed of a saved search lists. Older ones
+// are dropped.
+const maxEntries = 100
+
+// Number of searches which can be saved, as each of them is re-run after
+// every index update.
+const maxSearches = 1000
+
+var ErrTooManySearches = errors.New("too many saved searches")
+
+// A match of a saved search.
+type Match struct {
+	// The source package, e.g. “i3-wm”, and its version, e.g. “4.7-1”.
+	Package string
+	Version string
+
+	// The path of the file within the source package, e.g. “src/main.c”.
+	Path string
+	Line int
+
+	// The matching line.
+	Context string
+}
+
+// Identifies the match across versions of its package: a match is new if it
+// was not found in any version before, so that each upload of a package
+// does not make all of its matches new. The line number is ignored as well,
+// as it changes whenever lines are added further up.
+func (m Match) key() string {
+	h := fnv.New64a()
+	io.WriteString(h, m.Package+"\x00"+m.Path+"\x00"+strings.TrimSpace(m.Context))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// A new match, as listed in the feed.
+type Entry struct {
+	Match
+
+	// When the match was found, i.e. when the saved search was re-run after
+	// the index update which added it.
+	Found time.Time
+}
+
+type Search struct {
+	Id string
+
+	// The search term, i.e. the q= parameter.
+	Query string
+
+	Created time.Time
+
+	// When the search was last re-run, or the zero time if it was not run
+	// yet. The matches of the first run are not new, they establish what
+	// later runs are compared to.
+	Updated time.Time
+
+	// The keys of all matches found so far.
+	Seen map[string]bool
+
+	// The new matches, the newest first.
+	Entries []Entry
+}
+
+// Returns the identifier of the saved search for query, which is the same
+// for all users saving the same query.
+func Id(query string) string {
+	h := fnv.New64a()
+	io.WriteString(h, strings.TrimSpace(query))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// Saved searches, stored as a JSON file.
+type Store struct {
+	path string
+
+	mu       sync.Mutex
+	searches map[string]*Search
+}
+
+// Opens the saved searches stored in path. The file is created when the
+// first search is saved.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:     path,
+		searches: make(map[string]*Search),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&s.searches); err != nil {
+		return nil, fmt.Errorf("could not parse %q: %v", path, err)
+	}
+	return s, nil
+}
+
+// Writes all saved searches to a temporary file, which then replaces the
+// file, so that a crash does not leave a truncated file behind. Must be
+// called with s.mu held.
+func (s *Store) save() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(s.searches); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Saves a search for query unless it is saved already, and returns its
+// identifier.
+func (s *Store) Add(query string, now time.Time) (string, error) {
+	id := Id(query)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.searches[id]; ok {
+		return id, nil
+	}
+	if len(s.searches) >= maxSearches {
+		return "", ErrTooManySearches
+	}
+	s.searches[id] = &Search{
+		Id:      id,
+		Query:   strings.TrimSpace(query),
+		Created: now,
+		Seen:    make(map[string]bool),
+	}
+	return id, s.save()
+}
+
+// Returns a copy of the saved search with the given identifier, without its
+// Seen keys.
+func (s *Store) Get(id string) (Search, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	search, ok := s.searches[id]
+	if !ok {
+		return Search{}, false
+	}
+	result := *search
+	result.Seen = nil
+	result.Entries = append([]Entry(nil), search.Entries...)
+	return result, true
+}
+
+// Returns the queries of all saved searches by identifier.
+func (s *Store) Queries() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queries := make(map[string]string, len(s.searches))
+	for id, search := range s.searches {
+		queries[id] = search.Query
+	}
+	return queries
+}
+
+// Records the matches of a run of the saved search with the given identifier
+// and returns how many of them are new.
+func (s *Store) Update(id string, matches []Match, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	search, ok := s.searches[id]
+	if !ok {
+		return 0, fmt.Errorf("no saved search %q", id)
+	}
+	first := search.Updated.IsZero()
+	var entries []Entry
+	for _, match := range matches {
+		key := match.key()
+		if search.Seen[key] {
+			continue
+		}
+		search.Seen[key] = true
+		if !first {
+			entries = append(entries, Entry{match, now})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Package < entries[j].Package
+	})
+	search.Entries = append(entries, search.Entries...)
+	if len(search.Entries) > maxEntries {
+		search.Entries = search.Entries[:maxEntries]
+	}
+	search.Updated = now
+	return len(entries), s.save()
+}
@@ -0,0 +1,73 @@
+// vim:ts=4:sw=4:noexpandtab
+package saved
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "saved.json")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := store.Add("xcb_create_window", time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.Add(" xcb_create_window ", time.Unix(2, 0)); again != id {
+		t.Errorf("saving the same query again returned %q, want %q", again, id)
+	}
+
+	old := Match{"i3-wm", "4.7-1", "src/main.c", 10, "xcb_create_window(conn,"}
+	if n, err := store.Update(id, []Match{old}, time.Unix(3, 0)); err != nil || n != 0 {
+		t.Errorf("first run: %d new matches (err %v), want 0", n, err)
+	}
+
+	// A new version of a package moves the match, which does not make it new.
+	moved := Match{"i3-wm", "4.8-1", "src/main.c", 12, "xcb_create_window(conn,"}
+	added := Match{"awesome", "3.4-1", "draw.c", 5, "xcb_create_window(c,"}
+	if n, err := store.Update(id, []Match{moved, added}, time.Unix(4, 0)); err != nil || n != 1 {
+		t.Errorf("second run: %d new matches (err %v), want 1", n, err)
+	}
+
+	// The saved searches survive reopening the store.
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search, ok := store.Get(id)
+	if !ok {
+		t.Fatalf("saved search %q not found after reopening", id)
+	}
+	if len(search.Entries) != 1 || search.Entries[0].Match != added {
+		t.Fatalf("entries = %+v, want only %+v", search.Entries, added)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteAtom(&buf, search, "https://codesearch.debian.net"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom">`,
+		`<title>awesome_3.4-1/draw.c:5</title>`,
+		`href="https://codesearch.debian.net/show?file=awesome_3.4-1%2Fdraw.c&amp;line=5&amp;q=xcb_create_window#L5"`,
+		`<updated>1970-01-01T00:00:04Z</updated>`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("feed does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
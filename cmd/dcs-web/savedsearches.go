@@ -0,0 +1,179 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"github.com/Debian/dcs/cmd/dcs-web/saved"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	savedSearchesPath = flag.String("saved_searches_path",
+		"",
+		"Path to the file in which saved searches (see /save) are stored. If empty, searches cannot be saved")
+	savedSearchesDelay = flag.Duration("saved_searches_delay",
+		5*time.Minute,
+		"How long to wait after a backend loaded a new index before re-running the saved searches, so that the updates of all backends are covered by one run")
+)
+
+// The saved searches, or nil if -saved_searches_path is not set.
+var savedSearches *saved.Store
+
+// Receives a value whenever a backend loaded a new index, see
+// notifySavedSearches. Buffered, so that updates which happen while the saved
+// searches are running result in one more run.
+var indexUpdated = make(chan bool, 1)
+
+// Opens the saved searches and starts re-running them after index updates.
+func startSavedSearches() {
+	if *savedSearchesPath == "" {
+		return
+	}
+	var err error
+	if savedSearches, err = saved.Open(*savedSearchesPath); err != nil {
+		log.Fatalf("Could not open saved searches: %v\n", err)
+	}
+	go func() {
+		for range indexUpdated {
+			time.Sleep(*savedSearchesDelay)
+			for id, q := range savedSearches.Queries() {
+				runSavedSearch(id, q)
+			}
+		}
+	}()
+}
+
+// Makes the saved searches re-run, see updateResultsGeneration.
+func notifySavedSearches() {
+	select {
+	case indexUpdated <- true:
+	default:
+	}
+}
+
+// Runs the saved search with the given identifier and records its matches,
+// so that its feed lists the ones which the index did not contain before.
+// Instead of searching only the packages which were added with the new index,
+// the whole index is searched, as the source backends cannot restrict queries
+// to a list of packages.
+func runSavedSearch(id, q string) {
+	query := url.Values{"q": []string{q}}.Encode()
+	if err := validateQuery("?" + query); err != nil {
+		log.Printf("Saved search %s (%q) is invalid: %v\n", id, q, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2**queryTimeout)
+	defer cancel()
+	queryid, ok := awaitQuery(ctx, "saved-search", "/save", query)
+	if !ok {
+		log.Printf("Saved search %s (%q) timed out\n", id, q)
+		return
+	}
+	if failed, _ := queryErrors(queryid); failed {
+		log.Printf("Saved search %s (%q) failed\n", id, q)
+		return
+	}
+	stateMu.Lock()
+	s := state[queryid]
+	stateMu.Unlock()
+	results, err := readResults(queryid, s.resultPointers)
+	if err != nil {
+		log.Printf("Saved search %s (%q): %v\n", id, q, err)
+		return
+	}
+	matches := make([]saved.Match, len(results))
+	for i, result := range results {
+		r := newAPIResult(result)
+		matches[i] = saved.Match{
+			Package: r.Package,
+			Version: r.Version,
+			Path:    r.Path,
+			Line:    r.Line,
+			Context: r.Context,
+		}
+	}
+	n, err := savedSearches.Update(id, matches, time.Now())
+	if err != nil {
+		log.Printf("Could not record the matches of saved search %s (%q): %v\n", id, q, err)
+		return
+	}
+	log.Printf("Saved search %s (%q): %d matches, %d new\n", id, q, len(matches), n)
+}
+
+// SaveHandler handles requests to /save?q=<query>. GET requests show a form
+// confirming that the search should be saved, which carries the CSRF token
+// (see csrfProtected) so that the results pages stay cacheable. POST requests
+// save the search and redirect to its feed (see FeedHandler). The search is
+// run right away, so that the feed only lists matches which are added to the
+// index afterwards.
+func SaveHandler(w http.ResponseWriter, r *http.Request) {
+	if savedSearches == nil {
+		http.Error(w, "Saving searches is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Searches are saved with POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+	q := strings.TrimSpace(r.FormValue("q"))
+	if q == "" {
+		http.Error(w, "Empty query", http.StatusBadRequest)
+		return
+	}
+	if err := validateQuery("?" + url.Values{"q": []string{q}}.Encode()); err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == "GET" {
+		// The token differs per browser.
+		w.Header().Set("Cache-Control", "private")
+		err := common.ExecuteTemplate(w, r, "save.html", map[string]interface{}{
+			"q":         q,
+			"csrftoken": csrfToken(w, r),
+			"version":   common.Version,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	id, err := savedSearches.Add(q, time.Now())
+	if err == saved.ErrTooManySearches {
+		http.Error(w, "No more searches can be saved", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not save search %q: %v\n", q, err)
+		http.Error(w, "Could not save search", http.StatusInternalServerError)
+		return
+	}
+	if search, _ := savedSearches.Get(id); search.Updated.IsZero() {
+		go runSavedSearch(id, q)
+	}
+	http.Redirect(w, r, "/feed/"+id, http.StatusSeeOther)
+}
+
+// FeedHandler handles /feed/<id>, serving the Atom feed of the saved search
+// with the given identifier.
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	if savedSearches == nil {
+		http.Error(w, "Saving searches is not enabled", http.StatusNotFound)
+		return
+	}
+	search, ok := savedSearches.Get(strings.TrimPrefix(r.URL.Path, "/feed/"))
+	if !ok {
+		http.Error(w, "No such saved search", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml")
+	if err := saved.WriteAtom(w, search, common.BaseUrl(r)); err != nil {
+		log.Printf("Could not write feed of saved search %s: %v\n", search.Id, err)
+	}
+}
@@ -2,44 +2,23 @@
 package search
 
 import (
-	"fmt"
+	"github.com/Debian/dcs/query"
 	"net/url"
-	"strings"
 )
 
 // Parses the querystring (q= parameter) and moves special tokens such as
-// "lang:c" from the querystring into separate arguments.
+// "lang:c" from the querystring into separate arguments (see query.Parse).
+// The case= parameter (e.g. from the checkbox of the search form) is used
+// unless the querystring contains a case: keyword.
 func RewriteQuery(u url.URL) url.URL {
-	// query is a copy which we will modify using Set() and use in the result
-	query := u.Query()
-
-	querystr := query.Get("q")
-	queryWords := []string{}
-	for _, word := range strings.Split(querystr, " ") {
-		fmt.Printf("word = %v\n", word)
-		lower := strings.ToLower(word)
-		if strings.HasPrefix(lower, "filetype:") {
-			query.Add("filetype", strings.ToLower(word[len("filetype:"):]))
-		} else if strings.HasPrefix(lower, "-filetype:") {
-			query.Add("nfiletype", strings.ToLower(word[len("-filetype:"):]))
-		} else if strings.HasPrefix(lower, "package:") {
-			query.Set("package", word[len("package:"):])
-		} else if strings.HasPrefix(lower, "pkg:") {
-			query.Set("package", word[len("pkg:"):])
-		} else if strings.HasPrefix(lower, "-package:") {
-			query.Add("npackage", word[len("-package:"):])
-		} else if strings.HasPrefix(lower, "-pkg:") {
-			query.Add("npackage", word[len("-pkg:"):])
-		} else if strings.HasPrefix(lower, "path:") || strings.HasPrefix(lower, "file:") {
-			query.Add("path", word[len("path:"):])
-		} else if strings.HasPrefix(lower, "-path:") || strings.HasPrefix(lower, "-file:") {
-			query.Add("npath", word[len("-path:"):])
-		} else {
-			queryWords = append(queryWords, word)
-		}
+	// values is a copy which we will modify and use in the result
+	values := u.Query()
+	defaultCase := values.Get("case")
+	if defaultCase == "" {
+		defaultCase = query.CaseSensitive
 	}
-	query.Set("q", strings.Join(queryWords, " "))
-	u.RawQuery = query.Encode()
+	query.ParseDefaultCase(values.Get("q"), defaultCase).Encode(values)
+	u.RawQuery = values.Encode()
 
 	return u
 }
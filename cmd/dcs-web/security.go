@@ -0,0 +1,185 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/csrf"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	securityHeaders = flag.Bool("security_headers",
+		true,
+		"Send the Content-Security-Policy, X-Content-Type-Options, Referrer-Policy and X-Frame-Options headers with every response")
+	contentSecurityPolicy = flag.String("content_security_policy",
+		"default-src 'self'; script-src 'self' 'unsafe-inline' yandex.st; style-src 'self' 'unsafe-inline' yandex.st; img-src 'self' data:; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self'; form-action 'self'",
+		"Content-Security-Policy header of all responses. The frame-ancestors directive is added depending on whether the page may be embedded")
+	referrerPolicy = flag.String("referrer_policy",
+		"strict-origin-when-cross-origin",
+		"Referrer-Policy header of all responses")
+	csrfProtection = flag.Bool("csrf_protection",
+		true,
+		"Refuse state-changing requests (e.g. saving searches) which do not carry a CSRF token")
+	csrfKeyPath = flag.String("csrf_key_path",
+		"",
+		"Path to a file containing the secret key from which CSRF tokens are derived. If empty, a random key is used, so tokens become invalid when dcs-web restarts")
+	corsAllowedOrigins = flag.String("cors_allowed_origins",
+		"*",
+		"Comma-separated list of origins (e.g. “https://tracker.debian.org”) whose pages may call the API endpoints (e.g. /api/v1/search) from the browser, or * for all. Empty disables CORS")
+	corsAllowedMethods = flag.String("cors_allowed_methods",
+		"GET, HEAD",
+		"Comma-separated list of the HTTP methods which pages of other origins may use for the API endpoints")
+	corsMaxAge = flag.Duration("cors_max_age",
+		10*time.Minute,
+		"How long browsers may cache the answers to CORS preflight requests")
+)
+
+// Pages which third-party sites may embed in frames.
+var embeddablePaths = map[string]bool{
+	"/embed": true,
+}
+
+var csrfProtector *csrf.Protector
+
+// Sets up the CSRF protection according to the flags, see csrfProtected.
+func loadCSRFKey() {
+	if !*csrfProtection {
+		return
+	}
+	var key []byte
+	if *csrfKeyPath != "" {
+		contents, err := ioutil.ReadFile(*csrfKeyPath)
+		if err != nil {
+			log.Fatalf("Could not load CSRF key: %v\n", err)
+		}
+		key = []byte(strings.TrimSpace(string(contents)))
+	}
+	var err error
+	if csrfProtector, err = csrf.New(key); err != nil {
+		log.Fatalf("Could not set up CSRF protection: %v\n", err)
+	}
+}
+
+// Wraps the handlers of state-changing requests, refusing POST requests with
+// status 403 unless they carry the token returned by csrfToken.
+func csrfProtected(handler http.Handler) http.Handler {
+	if csrfProtector == nil {
+		return handler
+	}
+	return csrfProtector.Protect(handler)
+}
+
+// Returns the CSRF token which forms posting to csrfProtected handlers need
+// to carry in a csrf_token field. Must be called before the response is
+// written, see csrf.Protector.Token.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if csrfProtector == nil {
+		return ""
+	}
+	token, err := csrfProtector.Token(w, r)
+	if err != nil {
+		log.Printf("Could not create CSRF token: %v\n", err)
+	}
+	return token
+}
+
+// Wraps the handlers of administrative pages (e.g. /apikeys), refusing
+// requests which do not come directly from the local host, i.e. which come
+// through the reverse proxy or from elsewhere. Operators reach these pages via
+// an SSH tunnel, for example.
+func adminOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := strings.HasPrefix(r.RemoteAddr, "127.0.0.1:") || strings.HasPrefix(r.RemoteAddr, "[::1]:")
+		if !local || r.Header.Get("X-Forwarded-For") != "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// The request headers which pages of other origins may send to the API
+// endpoints, besides the ones which are always allowed (e.g. Accept).
+const corsAllowedHeaders = "X-Api-Key"
+
+// Returns the value of the Access-Control-Allow-Origin header for requests
+// from origin, or "" if its pages may not read the response.
+func corsOrigin(origin string) string {
+	for _, allowed := range strings.Split(*corsAllowedOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			return "*"
+		}
+		if allowed != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// Wraps the handlers of API endpoints, allowing pages of the origins of
+// -cors_allowed_origins to call them (Cross-Origin Resource Sharing). The
+// API uses no cookies, so there is nothing to protect from other origins
+// besides the rate limits, which apply to them as well.
+func corsEnabled(handler http.Handler) http.Handler {
+	if *corsAllowedOrigins == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := corsOrigin(origin)
+		header := w.Header()
+		if allowed != "*" {
+			// Responses differ between origins, so caches must not mix
+			// them up.
+			header.Add("Vary", "Origin")
+		}
+		if origin == "" || allowed == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		header.Set("Access-Control-Allow-Origin", allowed)
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			// A preflight request, which the handler does not need to see.
+			header.Set("Access-Control-Allow-Methods", *corsAllowedMethods)
+			header.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Lets clients see how long to wait when they are rate limited.
+		header.Set("Access-Control-Expose-Headers", "Retry-After")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Wraps the handler of all requests, adding the security headers configured
+// by the flags. Handlers may override them, e.g. to sandbox a page.
+func secured(handler http.Handler) http.Handler {
+	if !*securityHeaders {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := *contentSecurityPolicy
+		if policy != "" {
+			policy += "; "
+		}
+		header := w.Header()
+		if embeddablePaths[r.URL.Path] {
+			header.Set("Content-Security-Policy", policy+"frame-ancestors *")
+		} else {
+			header.Set("Content-Security-Policy", policy+"frame-ancestors 'none'")
+			header.Set("X-Frame-Options", "DENY")
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+		if *referrerPolicy != "" {
+			header.Set("Referrer-Policy", *referrerPolicy)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
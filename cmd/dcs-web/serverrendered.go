@@ -8,19 +8,30 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/Debian/dcs/cmd/dcs-web/common"
-	"hash/fnv"
+	"github.com/Debian/dcs/cmd/dcs-web/pkginfo"
+	dcsquery "github.com/Debian/dcs/query"
 	"html/template"
-	"io"
 	"log"
 	"math"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// The orders which the search form offers, see dcsquery.SortOrders.
+var sortOrderNames = []struct{ Value, Name string }{
+	{"", "best match"},
+	{dcsquery.SortPath, "path"},
+	{dcsquery.SortPopularity, "package popularity"},
+	{dcsquery.SortModTime, "modification time"},
+}
+
 // XXX: Using a dcsregexp.Match anonymous struct member doesn’t work,
 // because we need to assign to the members to get the data from Result
 // over into halfRenderedResult.
@@ -32,6 +43,74 @@ type halfRenderedResult struct {
 	SourcePackage string
 	RelativePath  string
 	Context       template.HTML
+	WholeWord     bool
+
+	// Set when only some matches of the file are shown, see
+	// dcs-source-backend -matches_per_file.
+	FileMatches   int
+	AllMatchesURL string
+
+	// Outbound links to the matching line, see resultLinks.
+	SourcesURL string
+	VcsURL     string
+}
+
+// Sets the links of result to the matching line on sources.debian.org and in
+// the packaging repository of the package, which are offered regardless of
+// -use_sources_debian_net.
+func resultLinks(result *halfRenderedResult) {
+	result.SourcesURL = pkginfo.SourcesURL(result.Path, result.Line)
+	result.VcsURL = "/vcs?" + url.Values{
+		"file": []string{result.Path},
+		"line": []string{strconv.Itoa(result.Line)},
+	}.Encode()
+}
+
+// Returns the URL of a search for all matches (see the matches:all keyword)
+// of the query q which also have the given keywords, e.g. “package:i3-wm”.
+func allMatchesURL(q, keywords string) string {
+	return "/search?" + url.Values{"q": []string{q + " " + keywords + " matches:all"}}.Encode()
+}
+
+// Returns the keyword which restricts a query to the file at path.
+func fileKeyword(path string) string {
+	return "path:^" + regexp.QuoteMeta(path) + "$"
+}
+
+// Returns the lines of result to display: the matching line (highlighted)
+// and the lines around it, i.e. Before and After if the query asked for more
+// context lines than the default two.
+func renderContext(result Result) []string {
+	before := []string{result.Ctxp2, result.Ctxp1}
+	after := []string{result.Ctxn1, result.Ctxn2}
+	if len(result.Before) > 0 || len(result.After) > 0 {
+		before, after = result.Before, result.After
+	}
+	var context []string
+	for _, line := range before {
+		context = maybeAppendContext(context, line)
+	}
+	context = append(context, "<strong>"+markMatches(result)+"</strong>")
+	for _, line := range after {
+		context = maybeAppendContext(context, line)
+	}
+	return context
+}
+
+// Returns the (HTML-escaped) context of result with the matches within it
+// wrapped in <mark>, see regexp.Offset.
+func markMatches(result Result) string {
+	context := result.Context
+	var marked []string
+	last := 0
+	for _, o := range result.Offsets {
+		if o.ContextStart >= o.ContextEnd || o.ContextStart < last || o.ContextEnd > len(context) {
+			continue
+		}
+		marked = append(marked, context[last:o.ContextStart], "<mark>", context[o.ContextStart:o.ContextEnd], "</mark>")
+		last = o.ContextEnd
+	}
+	return strings.Join(append(marked, context[last:]), "")
 }
 
 func maybeAppendContext(context []string, line string) []string {
@@ -127,6 +206,12 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 		Package    string
 		RawResults []Result `json:"Results"`
 		Results    []halfRenderedResult
+
+		// Number of matches and files in the package, and the search for
+		// all of them.
+		Matches int
+		Files   int
+		AllURL  string
 	}
 
 	var results []perPackageResults
@@ -140,12 +225,7 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 	for idx, pp := range results {
 		halfrendered := make([]halfRenderedResult, len(pp.RawResults))
 		for idx, result := range pp.RawResults {
-			var context []string
-			context = maybeAppendContext(context, result.Ctxp2)
-			context = maybeAppendContext(context, result.Ctxp1)
-			context = append(context, "<strong>"+result.Context+"</strong>")
-			context = maybeAppendContext(context, result.Ctxn1)
-			context = maybeAppendContext(context, result.Ctxn2)
+			context := renderContext(result)
 
 			sourcePackage, relativePath := splitPath(result.Path)
 
@@ -157,12 +237,23 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 				SourcePackage: sourcePackage,
 				RelativePath:  relativePath,
 				Context:       template.HTML(strings.Join(context, "<br>")),
+				WholeWord:     result.WholeWord,
+				FileMatches:   result.FileMatches,
+			}
+			resultLinks(&halfrendered[idx])
+			if result.FileMatches > 0 {
+				halfrendered[idx].AllMatchesURL = allMatchesURL(r.Form.Get("q"), fileKeyword(result.Path))
 			}
 		}
 		results[idx] = perPackageResults{
 			Package: pp.Package,
 			Results: halfrendered,
 		}
+		if len(pp.RawResults) > 0 && pp.RawResults[0].PackageFiles > 0 {
+			results[idx].Matches = pp.RawResults[0].PackageMatches
+			results[idx].Files = pp.RawResults[0].PackageFiles
+			results[idx].AllURL = "/search?" + url.Values{"q": []string{r.Form.Get("q") + " package:" + pp.Package}}.Encode()
+		}
 	}
 
 	packages := readPackagesFile(queryid)
@@ -179,12 +270,13 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 	baseurl.RawQuery = basequery.Encode()
 	filterurl := baseurl.String()
 
-	if err := common.Templates.ExecuteTemplate(w, "perpackage-results.html", map[string]interface{}{
+	if err := common.ExecuteTemplate(w, r, "perpackage-results.html", map[string]interface{}{
 		"results":    results,
 		"filterurl":  filterurl,
 		"packages":   packages,
 		"pagination": template.HTML(pagination),
 		"q":          r.Form.Get("q"),
+		"queryid":    queryid,
 		"page":       page,
 		"version":    common.Version,
 	}); err != nil {
@@ -193,14 +285,27 @@ func renderPerPackage(w http.ResponseWriter, r *http.Request, queryid string, pa
 	}
 }
 
+var progressPageDelay = flag.Duration("progress_page_delay",
+	2*time.Second,
+	"How long /search waits for a query to finish before it shows a page with the progress of the query instead of the results")
+
 // q= search term
 // page= page number
-// perpkg= per-package grouping
+// perpkg= per-package grouping, in which case the source backends only send
+// the best files of each package (see group=package)
+// within= identifier of a query whose results are narrowed down (the same as
+// the within: keyword)
+// format=txt plain text results like grep -n, as with “Accept: text/plain”
+// (see wantsPlainText)
 func Search(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Could not parse form data", http.StatusInternalServerError)
 		return
 	}
+	if within := r.Form.Get("within"); within != "" && r.Form.Get("q") != "" {
+		r.Form.Set("q", r.Form.Get("q")+" within:"+within)
+		r.Form.Del("within")
+	}
 
 	src := r.RemoteAddr
 	if r.Form.Get("q") == "" {
@@ -208,8 +313,27 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// We encode a URL that contains _only_ the q parameter.
-	q := url.Values{"q": []string{r.Form.Get("q")}}.Encode()
+	// We encode a URL that contains _only_ the q parameter (and the case
+	// parameter of the search form's checkbox, the grouping and the order).
+	values := url.Values{"q": []string{r.Form.Get("q")}}
+	if c := r.Form.Get("case"); c != "" {
+		values.Set("case", c)
+	}
+	if r.Form.Get("perpkg") == "1" {
+		values.Set("group", "package")
+	}
+	order := r.Form.Get("sort")
+	if !dcsquery.ValidSort(order) {
+		http.Error(w, "Invalid sort parameter", http.StatusBadRequest)
+		return
+	}
+	if order == dcsquery.SortRanking {
+		order = ""
+	}
+	if order != "" {
+		values.Set("sort", order)
+	}
+	q := values.Encode()
 
 	pageStr := r.Form.Get("page")
 	if pageStr == "" {
@@ -221,24 +345,36 @@ func Search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Uniquely (well, good enough) identify this query for a couple of minutes
-	// (as long as we want to cache results). We could try to normalize the
-	// query before hashing it, but that seems hardly worth the complexity.
-	h := fnv.New64()
-	io.WriteString(h, q)
-	queryid := fmt.Sprintf("%x", h.Sum64())
+	// Scripts get the results as plain text instead, see plaintext.go.
+	w.Header().Add("Vary", "Accept")
+	if wantsPlainText(r) {
+		renderPlainText(w, r, src, q, page)
+		return
+	}
+
+	queryid := queryIdentifier(q)
 
 	log.Printf("server-render(%q, %q, %q)\n", queryid, src, q)
 
 	maybeStartQuery(queryid, src, q)
+	// Most queries are done quickly, in which case the results are shown
+	// right away instead of the progress page.
+	for deadline := time.Now().Add(*progressPageDelay); !queryCompleted(queryid) && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
 	if !queryCompleted(queryid) {
-		// Prevent caching, as the placeholder is temporary.
+		// Prevent caching, as the progress page is temporary.
 		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
-		if err := common.Templates.ExecuteTemplate(w, "placeholder.html", map[string]interface{}{
-			"q":       r.Form.Get("q"),
-			"version": common.Version,
+		stateMu.Lock()
+		started := state[queryid].started
+		stateMu.Unlock()
+		if err := common.ExecuteTemplate(w, r, "placeholder.html", map[string]interface{}{
+			"q":        r.Form.Get("q"),
+			"progress": queryProgress(queryid),
+			"elapsed":  int(time.Since(started) / time.Second),
+			"version":  common.Version,
 		}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -269,12 +405,7 @@ func Search(w http.ResponseWriter, r *http.Request) {
 
 	halfrendered := make([]halfRenderedResult, len(results))
 	for idx, result := range results {
-		var context []string
-		context = maybeAppendContext(context, result.Ctxp2)
-		context = maybeAppendContext(context, result.Ctxp1)
-		context = append(context, "<strong>"+result.Context+"</strong>")
-		context = maybeAppendContext(context, result.Ctxn1)
-		context = maybeAppendContext(context, result.Ctxn2)
+		context := renderContext(result)
 
 		sourcePackage, relativePath := splitPath(result.Path)
 
@@ -286,6 +417,12 @@ func Search(w http.ResponseWriter, r *http.Request) {
 			SourcePackage: sourcePackage,
 			RelativePath:  relativePath,
 			Context:       template.HTML(strings.Join(context, "<br>")),
+			WholeWord:     result.WholeWord,
+			FileMatches:   result.FileMatches,
+		}
+		resultLinks(&halfrendered[idx])
+		if result.FileMatches > 0 {
+			halfrendered[idx].AllMatchesURL = allMatchesURL(r.Form.Get("q"), fileKeyword(result.Path))
 		}
 	}
 
@@ -306,13 +443,64 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	baseurl.RawQuery = basequery.Encode()
 	filterurl := baseurl.String()
 
-	if err := common.Templates.ExecuteTemplate(w, "results.html", map[string]interface{}{
+	type truncatedLink struct {
+		truncatedPackage
+		URL string
+	}
+	var truncated []truncatedLink
+	for _, pkg := range state[queryid].truncatedPackages {
+		truncated = append(truncated, truncatedLink{pkg, allMatchesURL(r.Form.Get("q"), "package:"+pkg.Package)})
+	}
+
+	type facetLink struct {
+		Facet
+		URL string
+	}
+	type facetLinks struct {
+		Kind  string
+		Links []facetLink
+	}
+	var facets []facetLinks
+	merged := mergedFacets(state[queryid])
+	for _, kind := range []string{"package", "language", "directory"} {
+		if len(merged[kind]) < 2 {
+			// Nothing to narrow down.
+			continue
+		}
+		links := facetLinks{Kind: kind}
+		for _, facet := range merged[kind] {
+			q := r.Form.Get("q") + " " + facet.Keyword
+			links.Links = append(links.Links, facetLink{facet, "/search?" + url.Values{"q": []string{q}}.Encode()})
+		}
+		facets = append(facets, links)
+	}
+
+	type correctionLink struct {
+		Query string
+		URL   string
+	}
+	var corrections []correctionLink
+	if len(state[queryid].resultPointers) == 0 {
+		for _, corrected := range didYouMean(r.Form.Get("q")) {
+			corrections = append(corrections, correctionLink{corrected, "/search?" + url.Values{"q": []string{corrected}}.Encode()})
+		}
+	}
+
+	if err := common.ExecuteTemplate(w, r, "results.html", map[string]interface{}{
+		"noresults":  len(state[queryid].resultPointers) == 0,
+		"didyoumean": corrections,
+		"facets":     facets,
+		"download":   "/download?" + q,
+		"cansave":    savedSearches != nil,
+		"truncated":  truncated,
 		"perpkgurl":  perpkgurl,
 		"filterurl":  filterurl,
 		"results":    halfrendered,
 		"packages":   packages,
 		"pagination": template.HTML(pagination),
 		"q":          r.Form.Get("q"),
+		"sort":       order,
+		"sortorders": sortOrderNames,
 		"page":       page,
 		"version":    common.Version,
 	}); err != nil {
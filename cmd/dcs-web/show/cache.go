@@ -0,0 +1,125 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Files of a package version never change, so the ETag of a file is derived
+// from the hash of its contents: the first 16 bytes of its SHA-256, which is
+// what the index records as the content hash of the file (see
+// index.Index.ContentHash). Conditional requests are checked against the
+// hash which the index-backend looks up before the file is fetched from the
+// source backend, so that clients which have the current version get 304 Not
+// Modified without the file being transferred at all.
+
+// The metadata of a file, see /filemeta of the index-backend.
+type fileMeta struct {
+	// Empty if the index does not record content hashes.
+	Hash string
+
+	// Zero if the index does not record metadata.
+	ModTime time.Time
+}
+
+// Looking up the metadata of a file must not hold up /show for long, since
+// it is fetched from the source backend anyway.
+var metaClient = &http.Client{Timeout: 2 * time.Second}
+
+// Asks the index-backend responsible for filename for its metadata. Returns
+// the zero fileMeta if the metadata could not be fetched, in which case the
+// file is served without it.
+func fetchMeta(filename string) fileMeta {
+	shard, err := shardFor(filename)
+	if err != nil {
+		return fileMeta{}
+	}
+	// The index-backend runs on the same host as the source-backend.
+	u := url.URL{
+		Scheme:   "http",
+		Host:     strings.Replace(shard, "28082", "28081", -1),
+		Path:     "/filemeta",
+		RawQuery: url.Values{"file": []string{filename}}.Encode(),
+	}
+	resp, err := metaClient.Get(u.String())
+	if err != nil {
+		log.Printf("Could not fetch the metadata of %s: %v\n", filename, err)
+		return fileMeta{}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fileMeta{}
+	}
+	var meta fileMeta
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		log.Printf("Could not decode the metadata of %s: %v\n", filename, err)
+		return fileMeta{}
+	}
+	return meta
+}
+
+// Returns the content hash of a file with the given contents, in the format
+// of fileMeta.Hash.
+func contentHash(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// Returns the ETag of /show for the file with the given content hash. The
+// page also depends on the parameters (e.g. the query whose matches are
+// emphasized), on the language it is rendered in and on the templates, so
+// they are part of the ETag.
+func showETag(hash string, r *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%d",
+		hash,
+		r.URL.RawQuery,
+		r.Header.Get("Accept-Language"),
+		common.Version,
+		common.TemplatesLoaded().UnixNano())
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+}
+
+// Returns true if the client which sent r already has the version of the
+// response with the given ETag and modification time (which may be zero if
+// unknown), so that it can be answered with 304 Not Modified. As in RFC 7232,
+// If-Modified-Since is only considered if there is no If-None-Match.
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if modtime.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modtime.Truncate(time.Second).After(since)
+}
+
+// Sets the ETag and (unless modtime is zero) the Last-Modified header of the
+// response.
+func setValidators(w http.ResponseWriter, etag string, modtime time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modtime.IsZero() {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,187 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Embedded excerpts are limited to this many lines so that embedding does not
+// turn into a way to mirror whole files.
+const maxEmbedLines = 200
+
+// Parses the from and to parameters (1-based, inclusive). If only line is
+// given, a few lines of context around it are used. The range is clamped to
+// start at line 1 and to span at most maxEmbedLines lines, ranges which end
+// before line 1 are rejected.
+func lineRange(query url.Values) (from, to int, err error) {
+	if line := query.Get("line"); line != "" && query.Get("from") == "" {
+		l, err := strconv.Atoi(line)
+		if err != nil {
+			return 0, 0, err
+		}
+		from, to = l-5, l+5
+	} else {
+		if from, err = strconv.Atoi(query.Get("from")); err != nil {
+			return 0, 0, err
+		}
+		if to, err = strconv.Atoi(query.Get("to")); err != nil {
+			return 0, 0, err
+		}
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("to (%d) is smaller than from (%d)", to, from)
+	}
+	if to < 1 {
+		return 0, 0, fmt.Errorf("the range ends before line 1")
+	}
+	if from < 1 {
+		from = 1
+	}
+	if to-from+1 > maxEmbedLines {
+		to = from + maxEmbedLines - 1
+	}
+	return from, to, nil
+}
+
+// Embed renders lines from–to of a file as a standalone, syntax-highlighted
+// HTML page suitable for an <iframe>, with attribution and a link back to the
+// full file. Without file=, it renders a search box instead, see
+// searchWidget.
+func Embed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filename := query.Get("file")
+	if filename == "" {
+		searchWidget(w, r)
+		return
+	}
+	from, to, err := lineRange(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid line range: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	contents, ok := fetchFile(w, filename)
+	if !ok {
+		return
+	}
+
+	// NB: contents is untrusted, see Show. html/template escapes it.
+	lines := strings.Split(string(contents), "\n")
+	if from > len(lines) {
+		http.Error(w, fmt.Sprintf("File only has %d lines", len(lines)), http.StatusBadRequest)
+		return
+	}
+	if to > len(lines) {
+		to = len(lines)
+	}
+
+	lineNumbers := make([]int, to-from+1)
+	for idx := range lineNumbers {
+		lineNumbers[idx] = from + idx
+	}
+
+	pkg := filename[:strings.Index(filename, "/")]
+	permalink := fmt.Sprintf("%s/show?file=%s&line=%d#L%d",
+		common.BaseUrl(r), url.QueryEscape(filename), from, from)
+
+	// Embedding in third-party pages is the whole point.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err = common.ExecuteTemplate(w, r, "embed.html", map[string]interface{}{
+		"lines":     lines[from-1 : to],
+		"numbers":   lineNumbers,
+		"lnrwidth":  len(strconv.Itoa(to)),
+		"filename":  filename,
+		"path":      filename[len(pkg)+1:],
+		"package":   pkg,
+		"from":      from,
+		"to":        to,
+		"permalink": permalink,
+		"base":      common.BaseUrl(r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// OEmbed implements the oEmbed protocol (http://oembed.com/) for /show and
+// /embed URLs, so that wiki and blog software can turn a pasted Debian Code
+// Search link into an embedded excerpt.
+func OEmbed(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		http.Error(w, "Only format=json is supported", http.StatusNotImplemented)
+		return
+	}
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || (target.Path != "/show" && target.Path != "/embed") {
+		http.Error(w, "url must point to /show or /embed", http.StatusNotFound)
+		return
+	}
+	targetQuery := target.Query()
+	filename := targetQuery.Get("file")
+	if strings.Index(filename, "/") == -1 {
+		http.Error(w, "Filename does not contain a package", http.StatusNotFound)
+		return
+	}
+	from, to, err := lineRange(targetQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid line range: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	width := 700
+	if maxWidth, err := strconv.Atoi(query.Get("maxwidth")); err == nil && maxWidth < width {
+		width = maxWidth
+	}
+	// Roughly the height of the lines plus the attribution.
+	height := (to-from+1)*18 + 40
+	if maxHeight, err := strconv.Atoi(query.Get("maxheight")); err == nil && maxHeight < height {
+		height = maxHeight
+	}
+
+	embedUrl := fmt.Sprintf("%s/embed?%s", common.BaseUrl(r), url.Values{
+		"file": []string{filename},
+		"from": []string{strconv.Itoa(from)},
+		"to":   []string{strconv.Itoa(to)},
+	}.Encode())
+
+	type oEmbedReply struct {
+		Type         string `json:"type"`
+		Version      string `json:"version"`
+		Title        string `json:"title"`
+		ProviderName string `json:"provider_name"`
+		ProviderUrl  string `json:"provider_url"`
+		Html         string `json:"html"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+	}
+	reply := oEmbedReply{
+		Type:         "rich",
+		Version:      "1.0",
+		Title:        fmt.Sprintf("%s, lines %d–%d", filename, from, to),
+		ProviderName: "Debian Code Search",
+		ProviderUrl:  common.BaseUrl(r) + "/",
+		Html: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0"></iframe>`,
+			strings.Replace(embedUrl, "&", "&amp;", -1), width, height),
+		Width:  width,
+		Height: height,
+	}
+
+	jsonReply, err := json.Marshal(&reply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Serialization error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if _, err := w.Write(jsonReply); err != nil {
+		log.Printf("Could not send oEmbed reply: %v\n", err)
+	}
+}
@@ -0,0 +1,167 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"bytes"
+	"github.com/Debian/dcs/lang"
+	dcsquery "github.com/Debian/dcs/query"
+	"html"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// Files larger than this are shown without syntax highlighting, as
+// tokenizing them takes too long.
+const maxHighlightSize = 1 << 20
+
+// Lexers for languages (see the lang package) which chroma does not know by
+// the same name. Lex and yacc files mostly consist of C.
+var chromaLexers = map[string]string{
+	"lex":  "c",
+	"yacc": "c",
+}
+
+var (
+	highlightCSSOnce sync.Once
+	highlightCSS     template.CSS
+)
+
+// Returns the stylesheet for the classes of the highlighted lines.
+func highlightStyle() template.CSS {
+	highlightCSSOnce.Do(func() {
+		var buf bytes.Buffer
+		if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(&buf, styles.Get("github")); err != nil {
+			log.Printf("Could not generate highlighting stylesheet: %v\n", err)
+		}
+		highlightCSS = template.CSS(buf.String())
+	})
+	return highlightCSS
+}
+
+// Returns the lexer for filename according to its language, as detected by
+// the lang package, or according to chroma’s own rules if lang does not know
+// the language or chroma does not know the lang name.
+func lexerFor(filename string, contents []byte) chroma.Lexer {
+	if language := lang.Detect(filename, contents); language != lang.Unknown {
+		name := language
+		if n, ok := chromaLexers[language]; ok {
+			name = n
+		}
+		if lexer := lexers.Get(name); lexer != nil {
+			return lexer
+		}
+	}
+	if lexer := lexers.Match(filename); lexer != nil {
+		return lexer
+	}
+	return lexers.Fallback
+}
+
+// Returns the CSS class of tokens of type t in the stylesheet returned by
+// highlightStyle (the one of the closest parent type which has one).
+func tokenClass(t chroma.TokenType) string {
+	for ; t != 0; t = t.Parent() {
+		if class, ok := chroma.StandardTypes[t]; ok {
+			return class
+		}
+	}
+	return chroma.StandardTypes[t]
+}
+
+// Returns the lines of contents as HTML, with the tokens in spans of the
+// classes of highlightStyle. The lines are escaped without highlighting if
+// contents is too large or cannot be tokenized.
+func highlightLines(filename string, contents []byte) []template.HTML {
+	plain := func() []template.HTML {
+		lines := strings.Split(string(contents), "\n")
+		result := make([]template.HTML, len(lines))
+		for idx, line := range lines {
+			result[idx] = template.HTML(html.EscapeString(line))
+		}
+		return result
+	}
+	if len(contents) > maxHighlightSize {
+		return plain()
+	}
+	lexer := chroma.Coalesce(lexerFor(filename, contents))
+	iterator, err := lexer.Tokenise(nil, string(contents))
+	if err != nil {
+		log.Printf("Could not tokenize %s: %v\n", filename, err)
+		return plain()
+	}
+	var result []template.HTML
+	for _, tokens := range chroma.SplitTokensIntoLines(iterator.Tokens()) {
+		var line bytes.Buffer
+		for _, token := range tokens {
+			value := html.EscapeString(strings.TrimSuffix(token.Value, "\n"))
+			if value == "" {
+				continue
+			}
+			if class := tokenClass(token.Type); class != "" {
+				line.WriteString(`<span class="` + class + `">` + value + `</span>`)
+			} else {
+				line.WriteString(value)
+			}
+		}
+		result = append(result, template.HTML(line.String()))
+	}
+	// The line numbers are based on strings.Split, which returns an empty
+	// last line for a trailing newline, whereas lexers may add a trailing
+	// newline or strip the empty last line.
+	n := bytes.Count(contents, []byte("\n")) + 1
+	for len(result) < n {
+		result = append(result, "")
+	}
+	return result[:n]
+}
+
+// Returns the (1-based) numbers of the lines of contents which the query q
+// (as entered in the search form) matches, as far as its regular expression
+// is understood by the standard library’s regexp package. For queries which
+// combine terms (see dcsquery.ParseExpr), the lines matching any term which
+// is not negated are returned.
+func matchedLines(q string, contents []byte) map[int]bool {
+	if strings.TrimSpace(q) == "" {
+		return nil
+	}
+	query := dcsquery.Parse(q).Regexp
+	var patterns []string
+	if expr, err := dcsquery.ParseExpr(query); err != nil {
+		return nil
+	} else if expr != nil {
+		for _, term := range expr.PositiveTerms() {
+			patterns = append(patterns, term.Regexp)
+		}
+	} else {
+		patterns = []string{query}
+	}
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			continue
+		}
+		res = append(res, re)
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	matched := make(map[int]bool)
+	for idx, line := range bytes.Split(contents, []byte("\n")) {
+		for _, re := range res {
+			if re.Match(line) {
+				matched[idx+1] = true
+				break
+			}
+		}
+	}
+	return matched
+}
@@ -0,0 +1,48 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHighlightLines(t *testing.T) {
+	for _, contents := range []string{
+		"int main() {\n\treturn 0;\n}\n",
+		"int main() {\n\treturn 0;\n}",
+		"/* a comment\n   spanning lines */\n",
+		"",
+	} {
+		lines := highlightLines("i3-wm_4.7/src/main.c", []byte(contents))
+		if got, want := len(lines), len(strings.Split(contents, "\n")); got != want {
+			t.Errorf("highlightLines(%q) returned %d lines, want %d", contents, got, want)
+		}
+	}
+
+	lines := highlightLines("i3-wm_4.7/src/main.c", []byte("if (a < b) {\n"))
+	if strings.Contains(string(lines[0]), "<b") {
+		t.Errorf("highlightLines did not escape the contents: %q", lines[0])
+	}
+	if !strings.Contains(string(lines[0]), `<span class="k">if</span>`) {
+		t.Errorf("highlightLines did not highlight the keyword: %q", lines[0])
+	}
+}
+
+func TestMatchedLines(t *testing.T) {
+	contents := []byte("int main() {\n\tprintf(\"hello\");\n\treturn 0;\n}\n")
+	for _, test := range []struct {
+		q    string
+		want map[int]bool
+	}{
+		{"printf", map[int]bool{2: true}},
+		{"PRINTF case:no filetype:c", map[int]bool{2: true}},
+		{"printf OR return", map[int]bool{2: true, 3: true}},
+		{"nomatch", map[int]bool{}},
+		{"", nil},
+	} {
+		if got := matchedLines(test.q, contents); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("matchedLines(%q) = %v, want %v", test.q, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/Debian/dcs/cmd/dcs-web/pkginfo"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	debbugsUrl = flag.String("debbugs_url",
+		"https://bugs.debian.org/cgi-bin/soap.cgi",
+		"URL of the SOAP interface of debbugs, which /packageinfo asks for the number of open bugs of packages. Empty disables bug counts")
+	bugCountsTTL = flag.Duration("bug_counts_ttl",
+		time.Hour,
+		"How long the number of open bugs of a package is cached")
+)
+
+// Number of changelog entries returned by /packageinfo.
+const changelogEntriesShown = 5
+
+var (
+	bugCounterOnce sync.Once
+	bugCounter     *pkginfo.BugCounter
+)
+
+// Returns the BugCounter configured by the flags, or nil if bug counts are
+// disabled.
+func bugs() *pkginfo.BugCounter {
+	bugCounterOnce.Do(func() {
+		if *debbugsUrl != "" {
+			bugCounter = pkginfo.NewBugCounter(*debbugsUrl, *bugCountsTTL)
+		}
+	})
+	return bugCounter
+}
+
+type packageInfo struct {
+	Package string
+
+	// The most recent entries of debian/changelog.
+	Changelog    []pkginfo.ChangelogEntry
+	ChangelogURL string
+
+	// The number of open bugs, absent if it could not be determined.
+	OpenBugs *int `json:",omitempty"`
+	BugsURL  string
+}
+
+// PackageInfo handles /packageinfo?tree=<package>_<version> by returning the
+// maintenance context of the package as JSON (see packageInfo), which
+// show.html displays next to the source code.
+func PackageInfo(w http.ResponseWriter, r *http.Request) {
+	tree := r.FormValue("tree")
+	idx := strings.Index(tree, "_")
+	if idx < 1 || strings.Contains(tree, "/") {
+		http.Error(w, "No valid ?tree= provided, use <package>_<version>", http.StatusBadRequest)
+		return
+	}
+	pkg := tree[:idx]
+	info := packageInfo{
+		Package:      pkg,
+		Changelog:    []pkginfo.ChangelogEntry{},
+		ChangelogURL: "/show?" + url.Values{"file": []string{tree + "/debian/changelog"}}.Encode(),
+		BugsURL:      "https://bugs.debian.org/src:" + url.PathEscape(pkg),
+	}
+
+	contents, status, err := fetch(tree + "/debian/changelog")
+	if err != nil || status != http.StatusOK {
+		log.Printf("Could not fetch the changelog of %s: %v (HTTP status %d)\n", tree, err, status)
+	} else if entries, err := pkginfo.ParseChangelog(bytes.NewReader(contents), changelogEntriesShown); err != nil {
+		log.Printf("Could not parse the changelog of %s: %v\n", tree, err)
+	} else {
+		info.Changelog = entries
+	}
+
+	if b := bugs(); b != nil {
+		if count, err := b.OpenBugs(r.Context(), pkg); err != nil {
+			log.Printf("Could not count the open bugs of %s: %v\n", pkg, err)
+		} else {
+			info.OpenBugs = &count
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&info); err != nil {
+		log.Printf("Could not write package info: %v\n", err)
+	}
+}
@@ -0,0 +1,62 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Returns the Content-Type under which /raw serves contents. Text is always
+// served as text/plain: files of Debian packages are untrusted, and serving
+// e.g. HTML or SVG as such would run their scripts on our origin.
+func rawContentType(contents []byte) string {
+	ctype := http.DetectContentType(contents)
+	if strings.HasPrefix(ctype, "text/") {
+		return "text/plain; charset=utf-8"
+	}
+	return ctype
+}
+
+// Returns the ETag of a file with the given content hash (see cache.go).
+func rawETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// Raw handles /raw/<package>/<path> (e.g. /raw/i3-wm_4.7-1/src/main.c) by
+// serving the file verbatim, for scripts and for saving files. Since the
+// files of a package version never change, clients may cache them, and
+// conditional (If-None-Match, If-Modified-Since) and range requests are
+// supported. Conditional requests are answered from the content hash in the
+// index where possible, without fetching the file.
+func Raw(w http.ResponseWriter, r *http.Request) {
+	filename := strings.TrimPrefix(r.URL.Path, "/raw/")
+	if filename == "" {
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Serving raw file %s\n", filename)
+
+	meta := fetchMeta(filename)
+	if meta.Hash != "" && notModified(r, rawETag(meta.Hash), meta.ModTime) {
+		setValidators(w, rawETag(meta.Hash), meta.ModTime)
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	contents, ok := fetchFile(w, filename)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", rawContentType(contents))
+	w.Header().Set("ETag", rawETag(contentHash(contents)))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	// ServeContent handles conditional requests which the index could not
+	// answer, and sets Last-Modified.
+	http.ServeContent(w, r, filename, meta.ModTime, bytes.NewReader(contents))
+}
@@ -6,89 +6,242 @@ import (
 	"github.com/Debian/dcs/cmd/dcs-web/common"
 	"github.com/Debian/dcs/cmd/dcs-web/health"
 	"github.com/Debian/dcs/shardmapping"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
 )
 
-func Show(w http.ResponseWriter, r *http.Request) {
-	query := r.URL
-	filename := query.Query().Get("file")
-	line64, err := strconv.ParseInt(query.Query().Get("line"), 10, 0)
+// Returns the source backend responsible for the package of filename (e.g.
+// “i3-wm_4.5.1-2/src/main.c”).
+func shardFor(filename string) (string, error) {
+	idx := strings.Index(filename, "/")
+	if idx == -1 {
+		return "", fmt.Errorf("Filename does not contain a package")
+	}
+	pkg := filename[:idx]
+	shards := common.Shards()
+	return shards[shardmapping.TaskIdxForPackage(pkg, len(shards))], nil
+}
+
+// Fetches filename (e.g. “i3-wm_4.5.1-2/src/main.c”) from the source backend
+// responsible for its package. Returns the reply of the source backend and
+// its HTTP status, or an error if the source backend could not be asked.
+func fetch(filename string) ([]byte, int, error) {
+	shard, err := shardFor(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	backendUrl := url.URL{
+		Scheme:   "http",
+		Host:     shard,
+		Path:     "/file",
+		RawQuery: url.Values{"file": []string{filename}}.Encode(),
+	}
+
+	log.Printf("Asking source backend: %s\n", backendUrl.String())
+	resp, err := http.Get(backendUrl.String())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contents, resp.StatusCode, nil
+}
+
+// Like fetch, but on error, an error reply is sent to w and false is
+// returned.
+func fetchFile(w http.ResponseWriter, filename string) ([]byte, bool) {
+	contents, status, err := fetch(filename)
 	if err != nil {
 		log.Printf("%v\n", err)
-		return
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
 	}
-	line := int(line64)
-	log.Printf("Showing file %s, line %d\n", filename, line)
 
-	if *common.UseSourcesDebianNet && health.IsHealthy("sources.debian.net") {
-		destination := fmt.Sprintf("http://sources.debian.net/src/%s?hl=%d#L%d",
-			strings.Replace(filename, "_", "/", 1), line, line)
-		log.Printf("SDN is healthy. Redirecting to %s\n", destination)
-		http.Redirect(w, r, destination, 302)
-		return
+	if status != 200 {
+		// relay the source backend error
+		http.Error(w, string(contents), status)
+		return nil, false
 	}
+	return contents, true
+}
+
+// A line of the file shown by Show.
+type showLine struct {
+	Number int
+
+	// The syntax-highlighted contents of the line.
+	HTML template.HTML
+
+	// Whether the query (see the q= parameter of Show) matches the line.
+	Matched bool
 
+	// Whether the line is within the requested range.
+	Current bool
+}
+
+// Parses the line parameter of Show, which is either a single line number
+// (e.g. “123”) or an inclusive range of lines (e.g. “10-25”), optionally
+// written like the anchors of the line numbers (e.g. “L10-L25”).
+func parseLines(param string) (from, to int, err error) {
+	param = strings.Replace(param, "L", "", -1)
+	if idx := strings.Index(param, "-"); idx > -1 {
+		if from, err = strconv.Atoi(param[:idx]); err != nil {
+			return 0, 0, err
+		}
+		if to, err = strconv.Atoi(param[idx+1:]); err != nil {
+			return 0, 0, err
+		}
+	} else {
+		if from, err = strconv.Atoi(param); err != nil {
+			return 0, 0, err
+		}
+		to = from
+	}
+	if from < 1 {
+		return 0, 0, fmt.Errorf("line %d is smaller than 1", from)
+	}
+	if to < from {
+		return 0, 0, fmt.Errorf("line %d is smaller than line %d", to, from)
+	}
+	return from, to, nil
+}
+
+// Returns the fragment of the URL of /show which scrolls to lines from–to,
+// e.g. “L10-L25”. The JavaScript in show.html understands the same format.
+func linesAnchor(from, to int) string {
+	if from == to {
+		return fmt.Sprintf("L%d", from)
+	}
+	return fmt.Sprintf("L%d-L%d", from, to)
+}
+
+// Returns the URL of the listing of the directory which contains filename
+// (e.g. “i3-wm_4.7/src/main.c”), see /package, or "" if filename is not
+// within a package tree.
+func browseURL(filename string) string {
 	idx := strings.Index(filename, "/")
 	if idx == -1 {
-		http.Error(w, "Filename does not contain a package", http.StatusInternalServerError)
-		return
+		return ""
 	}
-	pkg := filename[:idx]
-	shards := strings.Split(*common.SourceBackends, ",")
-	shard := shards[shardmapping.TaskIdxForPackage(pkg, len(shards))]
-
-	queryCopy := query
-	queryCopy.Scheme = "http"
-	queryCopy.Host = shard
-	queryCopy.Path = "/file"
+	tree, dir := filename[:idx], path.Dir(filename[idx+1:])
+	underscore := strings.Index(tree, "_")
+	if underscore == -1 {
+		return ""
+	}
+	u := "/package/" + tree[:underscore] + "/"
+	if dir != "." {
+		u += dir + "/"
+	}
+	return u + "?" + url.Values{"version": []string{tree[underscore+1:]}}.Encode()
+}
 
-	log.Printf("Asking source backend: %s\n", queryCopy.String())
-	resp, err := http.Get(queryCopy.String())
+// Show handles /show?file=<path>&line=<n>[&q=<query>] by rendering the file
+// with syntax highlighting, line n emphasized and scrolled to, and the lines
+// which the query matches emphasized. Instead of a single line, line can be a
+// range such as “10-25” (see parseLines). Pages have an ETag and, if the index
+// records it, the modification time of the file as Last-Modified, see
+// cache.go.
+func Show(w http.ResponseWriter, r *http.Request) {
+	query := r.URL
+	filename := query.Query().Get("file")
+	from, to, err := parseLines(query.Query().Get("line"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Invalid line: %v", err), http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
+	log.Printf("Showing file %s, lines %d-%d\n", filename, from, to)
 
-	contents, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("%v\n", err)
+	if *common.UseSourcesDebianNet && health.IsHealthy("sources.debian.net") {
+		destination := fmt.Sprintf("http://sources.debian.net/src/%s?hl=%d:%d#L%d",
+			strings.Replace(filename, "_", "/", 1), from, to, from)
+		log.Printf("SDN is healthy. Redirecting to %s\n", destination)
+		http.Redirect(w, r, destination, 302)
 		return
 	}
 
-	if resp.StatusCode != 200 {
-		// relay the source backend error
-		http.Error(w, string(contents), resp.StatusCode)
+	// The page is revalidated on every view, since it changes along with
+	// the templates.
+	w.Header().Set("Cache-Control", "no-cache")
+	meta := fetchMeta(filename)
+	lastModified := meta.ModTime
+	if !lastModified.IsZero() && common.TemplatesLoaded().After(lastModified) {
+		lastModified = common.TemplatesLoaded()
+	}
+	// Unless the client has the current version according to the content
+	// hash in the index, the file is fetched, and its contents are
+	// authoritative in case the index does not record content hashes.
+	var contents []byte
+	etag := ""
+	if meta.Hash != "" {
+		etag = showETag(meta.Hash, r)
+	}
+	if etag == "" || !notModified(r, etag, lastModified) {
+		var ok bool
+		if contents, ok = fetchFile(w, filename); !ok {
+			return
+		}
+		etag = showETag(contentHash(contents), r)
+	}
+	setValidators(w, etag, lastModified)
+	if notModified(r, etag, lastModified) {
+		w.Header().Add("Vary", "Accept-Language")
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	// NB: contents is untrusted as it can contain the contents of any file
-	// within any Debian package. Converting it to string is not a problem,
-	// though, see http://golang.org/ref/spec#Conversions, "Conversions to and
-	// from a string type": "Converting a slice of bytes to a string type
-	// yields a string whose successive bytes are the elements of the slice.".
-	// We don’t iterate over this string, we just pass it directly to the
-	// user’s browser, which can then deal with the bytes :-).
-	lines := strings.Split(string(contents), "\n")
-	highestLineNr := fmt.Sprintf("%d", len(lines))
+	// within any Debian package. highlightLines escapes it.
+	highlighted := highlightLines(filename, contents)
+	highestLineNr := fmt.Sprintf("%d", len(highlighted))
+
+	// The lines which the query (if any) matches are emphasized, like the
+	// requested line.
+	matched := matchedLines(query.Query().Get("q"), contents)
 
 	// Since Go templates don’t offer any way to use {{$idx+1}}, we need to
 	// pre-calculate line numbers starting from 1 here.
-	lineNumbers := make([]int, len(lines))
-	for idx, _ := range lines {
-		lineNumbers[idx] = idx + 1
+	lines := make([]showLine, len(highlighted))
+	for idx, h := range highlighted {
+		lines[idx] = showLine{
+			Number:  idx + 1,
+			HTML:    h,
+			Matched: matched[idx+1],
+			Current: idx+1 >= from && idx+1 <= to,
+		}
 	}
 
-	err = common.Templates.ExecuteTemplate(w, "show.html", map[string]interface{}{
-		"line":     line,
+	// The line parameter of the permalink, e.g. “10-25”.
+	anchor := linesAnchor(from, to)
+	lineParam := strings.Replace(anchor, "L", "", -1)
+	// A single line is embedded with some context around it.
+	embed := fmt.Sprintf("/embed?file=%s&line=%d", url.QueryEscape(filename), from)
+	if from != to {
+		embed = fmt.Sprintf("/embed?file=%s&from=%d&to=%d", url.QueryEscape(filename), from, to)
+	}
+	err = common.ExecuteTemplate(w, r, "show.html", map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"anchor":   anchor,
 		"lines":    lines,
-		"numbers":  lineNumbers,
+		"style":    highlightStyle(),
 		"lnrwidth": len(highestLineNr),
 		"filename": filename,
+		"permalink": fmt.Sprintf("%s/show?file=%s&line=%s#%s",
+			common.BaseUrl(r), url.QueryEscape(filename), lineParam, anchor),
+		"embed":  embed,
+		"raw":    "/raw/" + filename,
+		"browse": browseURL(filename),
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,166 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseLines(t *testing.T) {
+	for _, test := range []struct {
+		param    string
+		from, to int
+	}{
+		{"123", 123, 123},
+		{"10-25", 10, 25},
+		{"L10-L25", 10, 25},
+		{"7-7", 7, 7},
+	} {
+		from, to, err := parseLines(test.param)
+		if err != nil {
+			t.Errorf("parseLines(%q): %v", test.param, err)
+			continue
+		}
+		if from != test.from || to != test.to {
+			t.Errorf("parseLines(%q) = %d, %d, want %d, %d", test.param, from, to, test.from, test.to)
+		}
+		// The anchor of the lines must be understood, too.
+		anchor := linesAnchor(from, to)
+		if f, t2, err := parseLines(anchor); err != nil || f != from || t2 != to {
+			t.Errorf("parseLines(%q) = %d, %d, %v, want %d, %d", anchor, f, t2, err, from, to)
+		}
+	}
+
+	for _, param := range []string{"", "abc", "0", "25-10", "10-", "-10"} {
+		if _, _, err := parseLines(param); err == nil {
+			t.Errorf("parseLines(%q) unexpectedly succeeded", param)
+		}
+	}
+}
+
+func TestRawContentType(t *testing.T) {
+	for _, test := range []struct {
+		contents string
+		want     string
+	}{
+		{"int main() {}\n", "text/plain; charset=utf-8"},
+		{"<html><script>alert(1)</script></html>", "text/plain; charset=utf-8"},
+		{"<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>", "text/plain; charset=utf-8"},
+		{"\x89PNG\x0d\x0a\x1a\x0a", "image/png"},
+		{"\x00\x01\x02\x03", "application/octet-stream"},
+	} {
+		if got := rawContentType([]byte(test.contents)); got != test.want {
+			t.Errorf("rawContentType(%q) = %q, want %q", test.contents, got, test.want)
+		}
+	}
+}
+
+func TestBrowseURL(t *testing.T) {
+	for _, test := range []struct {
+		filename string
+		want     string
+	}{
+		{"i3-wm_4.7-1/src/main.c", "/package/i3-wm/src/?version=4.7-1"},
+		{"i3-wm_4.7-1/Makefile", "/package/i3-wm/?version=4.7-1"},
+		{"i3-wm_1:4.7+b1/a/b/c.h", "/package/i3-wm/a/b/?version=1%3A4.7%2Bb1"},
+		{"noversion/main.c", ""},
+		{"main.c", ""},
+	} {
+		if got := browseURL(test.filename); got != test.want {
+			t.Errorf("browseURL(%q) = %q, want %q", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestSearchWidget(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		status   int
+		location string
+	}{
+		{"package=i3-wm&q=main", http.StatusFound, "/search?q=main+package%3Ai3-wm"},
+		{"q=main", http.StatusFound, "/search?q=main"},
+		{"package=i3-wm%22%3E&q=main", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		Embed(w, httptest.NewRequest("GET", "/embed?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("/embed?%s: status %d, want %d", test.query, w.Code, test.status)
+		}
+		if got := w.Header().Get("Location"); got != test.location {
+			t.Errorf("/embed?%s: Location %q, want %q", test.query, got, test.location)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modtime := time.Date(2014, 1, 19, 12, 0, 0, 0, time.UTC)
+	etag := rawETag(contentHash([]byte("int main() {}\n")))
+	for _, test := range []struct {
+		header, value string
+		want          bool
+	}{
+		{"", "", false},
+		{"If-None-Match", etag, true},
+		{"If-None-Match", `"abc", ` + etag, true},
+		{"If-None-Match", "W/" + etag, true},
+		{"If-None-Match", "*", true},
+		{"If-None-Match", `"abc"`, false},
+		{"If-Modified-Since", modtime.Format(http.TimeFormat), true},
+		{"If-Modified-Since", modtime.Add(-time.Hour).Format(http.TimeFormat), false},
+		{"If-Modified-Since", "yesterday", false},
+	} {
+		r := httptest.NewRequest("GET", "/raw/i3-wm_4.7-1/src/main.c", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if got := notModified(r, etag, modtime); got != test.want {
+			t.Errorf("notModified with %s: %q = %v, want %v", test.header, test.value, got, test.want)
+		}
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	r := httptest.NewRequest("GET", "/raw/i3-wm_4.7-1/src/main.c", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	r.Header.Set("If-Modified-Since", modtime.Format(http.TimeFormat))
+	if notModified(r, etag, modtime) {
+		t.Errorf("notModified = true for a different ETag, want false")
+	}
+}
+
+func TestLineRange(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		from, to int
+	}{
+		{"line=20", 15, 25},
+		{"line=3", 1, 8},
+		{"line=0", 1, 5},
+		{"line=-4", 1, 1},
+		{"from=10&to=12", 10, 12},
+		{"from=-10&to=5", 1, 5},
+		{"from=0&to=0", 0, 0},
+		{"from=-10&to=-5", 0, 0},
+		{"line=-100", 0, 0},
+		{"from=5&to=1", 0, 0},
+		{"from=1&to=1000", 1, maxEmbedLines},
+	} {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, to, err := lineRange(query)
+		if test.from == 0 {
+			if err == nil {
+				t.Errorf("lineRange(%q) = %d, %d, want an error", test.query, from, to)
+			}
+			continue
+		}
+		if err != nil || from != test.from || to != test.to {
+			t.Errorf("lineRange(%q) = %d, %d, %v, want %d, %d", test.query, from, to, err, test.from, test.to)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/pkginfo"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Vcs handles /vcs?file=<path>&line=<n> by redirecting to line n of the file
+// in the packaging repository of its package (see the Vcs-Git field of the
+// .dsc file, which dcs-package-importer stores in every unpacked package).
+// The repository is looked up on demand, so that result pages can link here
+// without asking the source backends first.
+func Vcs(w http.ResponseWriter, r *http.Request) {
+	filename := r.FormValue("file")
+	idx := strings.Index(filename, "/")
+	if idx < 1 {
+		http.Error(w, "No valid ?file= provided", http.StatusBadRequest)
+		return
+	}
+	line, err := strconv.Atoi(r.FormValue("line"))
+	if err != nil || line < 1 {
+		line = 1
+	}
+	tree := filename[:idx]
+	contents, status, err := fetch(tree + "/" + pkginfo.VcsFilename)
+	if err != nil {
+		log.Printf("Could not fetch the Vcs fields of %s: %v\n", tree, err)
+		http.Error(w, "Could not look up the repository of the package, please try again", http.StatusBadGateway)
+		return
+	}
+	var destination string
+	if status == http.StatusOK {
+		vcs, err := pkginfo.ParseVcs(bytes.NewReader(contents))
+		if err != nil {
+			log.Printf("Could not parse the Vcs fields of %s: %v\n", tree, err)
+		}
+		destination = vcs.FileURL(filename[idx+1:], line)
+	}
+	if destination == "" {
+		http.Error(w, fmt.Sprintf("The package %s does not declare a repository with a web interface", tree), http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, destination, http.StatusFound)
+}
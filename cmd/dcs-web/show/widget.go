@@ -0,0 +1,42 @@
+// vim:ts=4:sw=4:noexpandtab
+package show
+
+import (
+	"github.com/Debian/dcs/cmd/dcs-web/common"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Source package names, see Debian Policy 5.6.1.
+var packageNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+$`)
+
+// searchWidget handles /embed?package=<name> (i.e. /embed without file=) by
+// rendering a search box for the source package, suitable for an <iframe> on
+// third-party pages such as the wiki or the package tracker. The page uses no
+// JavaScript, so it works with any Content-Security-Policy of the embedding
+// page. The form submits to /embed?package=<name>&q=<query>, which redirects
+// to the results of the query restricted to the package in a new window.
+func searchWidget(w http.ResponseWriter, r *http.Request) {
+	pkg := r.FormValue("package")
+	if pkg != "" && !packageNameRe.MatchString(pkg) {
+		http.Error(w, "No valid ?package= provided", http.StatusBadRequest)
+		return
+	}
+	if q := strings.TrimSpace(r.FormValue("q")); q != "" {
+		if pkg != "" {
+			q += " package:" + pkg
+		}
+		http.Redirect(w, r, "/search?"+url.Values{"q": []string{q}}.Encode(), http.StatusFound)
+		return
+	}
+
+	err := common.ExecuteTemplate(w, r, "searchwidget.html", map[string]interface{}{
+		"package": pkg,
+		"base":    common.BaseUrl(r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,253 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Debian/dcs/feature"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Number of results which are buffered for a streaming client before it is
+// considered too slow, see resultSubscribers.send.
+const streamBufferSize = 1000
+
+// A client of /stream which receives every result of a query.
+type resultSubscriber struct {
+	results chan []byte
+
+	// Set before results is closed if the client did not keep up.
+	overflowed bool
+}
+
+// The clients which receive every result of a query as soon as a backend
+// sends it (as opposed to only the top 10 results, which are sent to all
+// clients as events).
+type resultSubscribers struct {
+	mu     sync.Mutex
+	subs   []*resultSubscriber
+	closed bool
+}
+
+func (rs *resultSubscribers) add(sub *resultSubscriber) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		close(sub.results)
+		return
+	}
+	rs.subs = append(rs.subs, sub)
+}
+
+func (rs *resultSubscribers) remove(sub *resultSubscriber) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for i, s := range rs.subs {
+		if s == sub {
+			rs.subs = append(rs.subs[:i], rs.subs[i+1:]...)
+			close(sub.results)
+			return
+		}
+	}
+}
+
+func (rs *resultSubscribers) active() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.subs) > 0
+}
+
+// Passes result on to all subscribers without blocking, so that a slow client
+// cannot slow down the query for everyone else. Subscribers whose buffer is
+// full are dropped.
+func (rs *resultSubscribers) send(result []byte) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	kept := rs.subs[:0]
+	for _, sub := range rs.subs {
+		select {
+		case sub.results <- result:
+			kept = append(kept, sub)
+		default:
+			sub.overflowed = true
+			close(sub.results)
+		}
+	}
+	rs.subs = kept
+}
+
+// Closes all subscribers, called when the query is done.
+func (rs *resultSubscribers) close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, sub := range rs.subs {
+		close(sub.results)
+	}
+	rs.subs = nil
+	rs.closed = true
+}
+
+// The first message of a /stream response.
+type streamStart struct {
+	// Set to “stream”.
+	Type    string
+	QueryId string
+
+	// “live” when every result is sent as soon as it is found. “pages” when
+	// the query was already running or done, in which case only the top
+	// results are sent and all results need to be fetched from
+	// /results/<QueryId>/page_<n>.json after the “pagination” message.
+	Results string
+}
+
+// StreamHandler handles /stream?q=<query>[&format=json] by sending progress
+// updates and results as the source backends produce them, so that clients
+// can render results before the slowest shard is done. The messages are the
+// same as on /instantws, plus a streamStart message in the beginning and an
+// apiQueryEnd message in the end. With context=<n>, results contain the n
+// lines before and after each match (up to dcs-source-backend
+// -max_context_lines) in Before and After. With topk=<n>, each source backend
+// only sends its n best results, all at once when it is done. With
+// group=package (and groupfiles=<n>), it only sends the best match of the n
+// best files of each source package, along with the number of matches and
+// files in the package (PackageMatches and PackageFiles). Progress messages
+// contain the number of matches so far per package, language and top-level
+// directory in Facets.
+//
+// By default, the response consists of server-sent events (one message per
+// “data:” line, for use with EventSource). With format=json, it consists of
+// one JSON message per line instead.
+func StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if !feature.EnabledFor("streaming", clientAddress(r)) {
+		http.Error(w, "Streaming results is disabled.", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form data", http.StatusBadRequest)
+		return
+	}
+	sse := r.Form.Get("format") != "json"
+	params := url.Values{}
+	for key, values := range r.Form {
+		if key != "format" {
+			params[key] = values
+		}
+	}
+	query := params.Encode()
+	src := clientAddress(r)
+	if err := validateQuery("?" + query); err != nil {
+		log.Printf("[%s] Query %q failed validation: %v\n", src, query, err)
+		http.Error(w, string(invalidQueryMessage(err)), http.StatusBadRequest)
+		return
+	}
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var writeMu sync.Mutex
+	write := func(data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		var err error
+		if sse {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		}
+		flusher.Flush()
+		return err
+	}
+	writeMarshal := func(data interface{}) error {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return write(b)
+	}
+
+	queryid := queryIdentifier(query)
+	sub := &resultSubscriber{results: make(chan []byte, streamBufferSize)}
+	cached := maybeStartQuerySubscribed(queryid, src, query, sub)
+	logAccess(src, "/stream", query, cached)
+	start := streamStart{Type: "stream", QueryId: queryid, Results: "live"}
+	if cached {
+		start.Results = "pages"
+		sub = nil
+	}
+	if err := writeMarshal(&start); err != nil {
+		log.Printf("[%s] Error writing to stream: %v\n", src, err)
+		if sub != nil {
+			state[queryid].subscribers.remove(sub)
+		}
+		return
+	}
+
+	stop := make(chan bool)
+	eventsDone := make(chan error, 1)
+	go func() {
+		eventsDone <- streamEvents(queryid, func(data []byte) error {
+			// Live clients get all results through sub instead.
+			if sub != nil && bytes.HasPrefix(data, []byte(`{"Type":"result"`)) {
+				return nil
+			}
+			return write(data)
+		}, stop)
+	}()
+
+	var results <-chan []byte
+	if sub != nil {
+		results = sub.results
+	}
+	closed := r.Context().Done()
+	for results != nil || eventsDone != nil {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				results = nil
+				if sub.overflowed {
+					log.Printf("[%s] [%s] stream client too slow, dropping results\n", queryid, src)
+					writeMarshal(&Error{Type: "error", ErrorType: "streamoverflow"})
+				}
+				continue
+			}
+			if err := write(result); err != nil {
+				log.Printf("[%s] Error writing to stream: %v\n", src, err)
+				state[queryid].subscribers.remove(sub)
+				close(stop)
+				return
+			}
+
+		case err := <-eventsDone:
+			eventsDone = nil
+			if err != nil {
+				log.Printf("[%s] Error writing to stream: %v\n", src, err)
+				if sub != nil {
+					state[queryid].subscribers.remove(sub)
+				}
+				return
+			}
+
+		case <-closed:
+			log.Printf("[%s] stream client went away\n", src)
+			if sub != nil {
+				state[queryid].subscribers.remove(sub)
+			}
+			close(stop)
+			return
+		}
+	}
+	writeMarshal(&apiQueryEnd{Type: "done", QueryId: queryid})
+}
@@ -0,0 +1,169 @@
+// vim:ts=4:sw=4:noexpandtab
+package suggest
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// Terms which look like identifiers are corrected with the dictionary.
+	identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// Values of package keywords which look like package names are corrected
+	// with the package names.
+	packageNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+.-]+$`)
+)
+
+// Returns the edit (Levenshtein) distance between a and b, ignoring case, or
+// max+1 if it is larger than max.
+func distance(a, b string, max int) int {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	if prev[len(rb)] > max {
+		return max + 1
+	}
+	return prev[len(rb)]
+}
+
+// How many edits a correction of term may make: short terms would have too
+// many unrelated corrections otherwise.
+func maxDistance(term string) int {
+	if len(term) <= 4 {
+		return 1
+	}
+	return 2
+}
+
+type correction struct {
+	word     string
+	distance int
+}
+
+// Returns the words which are near term, the nearest first, or none if term
+// is one of words, i.e. needs no correction. Words with the same distance
+// keep their order, so the more frequent ones come first if words are sorted
+// by frequency.
+func nearby(term string, words []string) []correction {
+	max := maxDistance(term)
+	var nearby []correction
+	for _, word := range words {
+		if word == term {
+			return nil
+		}
+		if d := distance(term, word, max); d <= max {
+			nearby = append(nearby, correction{word, d})
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool {
+		return nearby[i].distance < nearby[j].distance
+	})
+	return nearby
+}
+
+// Returns the identifiers listed in the file at path, one per line and
+// optionally followed by whitespace and further columns (e.g. a count), which
+// are ignored. The file should list the most frequent identifiers first.
+func LoadDictionary(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		words = append(words, fields[0])
+	}
+	return words, scanner.Err()
+}
+
+// Returns up to n queries which are near q, for suggesting them when q has no
+// results. Each one differs from q in one term: either a term which looks
+// like an identifier is replaced by a similar word of dictionary, or the
+// value of a package keyword by a similar package name. Terms which use
+// regular expression syntax are left alone.
+func DidYouMean(q string, packages *Packages, dictionary []string, n int) []string {
+	var names []string
+	if packages != nil {
+		packages.mu.RLock()
+		names = packages.names
+		packages.mu.RUnlock()
+	}
+	fields := strings.Fields(q)
+	type candidate struct {
+		query    string
+		distance int
+	}
+	var candidates []candidate
+	for idx, field := range fields {
+		replace := func(corrections []correction, prefix string) {
+			for _, c := range corrections {
+				corrected := make([]string, len(fields))
+				copy(corrected, fields)
+				corrected[idx] = prefix + c.word
+				candidates = append(candidates, candidate{strings.Join(corrected, " "), c.distance})
+			}
+		}
+		if identifierRe.MatchString(field) {
+			replace(nearby(field, dictionary), "")
+			continue
+		}
+		for _, keyword := range packageKeywords {
+			if value := strings.TrimPrefix(field, keyword); value != field && packageNameRe.MatchString(value) {
+				replace(nearby(value, names), keyword)
+				break
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+	queries := []string{}
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if len(queries) < n && !seen[c.query] {
+			seen[c.query] = true
+			queries = append(queries, c.query)
+		}
+	}
+	return queries
+}
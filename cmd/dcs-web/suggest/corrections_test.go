@@ -0,0 +1,49 @@
+// vim:ts=4:sw=4:noexpandtab
+package suggest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 2, 3},
+		{"XCreateWindow", "xcreatewindow", 2, 0},
+		{"malloc", "mallco", 2, 2},
+		{"", "abc", 5, 3},
+		{"a", "abcdef", 2, 3},
+	} {
+		if got := distance(test.a, test.b, test.max); got != test.want {
+			t.Errorf("distance(%q, %q, %d) = %d, want %d", test.a, test.b, test.max, got, test.want)
+		}
+	}
+}
+
+func TestDidYouMean(t *testing.T) {
+	packages := &Packages{}
+	packages.Set([]string{"i3-wm", "i3lock", "linux", "xcb"})
+	dictionary := []string{"malloc", "calloc", "XCreateWindow", "realloc"}
+
+	for _, test := range []struct {
+		q    string
+		want []string
+	}{
+		{"maloc", []string{"malloc", "calloc"}},
+		{"xcreatewindow", []string{"XCreateWindow"}},
+		{"malloc package:i3-vm", []string{"malloc package:i3-wm"}},
+		{"maloc pkg:linx", []string{"malloc pkg:linx", "maloc pkg:linux", "calloc pkg:linx"}},
+		{"mal+oc", []string{}},
+		{"malloc", []string{}},
+		{"something", []string{}},
+	} {
+		if got := DidYouMean(test.q, packages, dictionary, 3); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("DidYouMean(%q) = %v, want %v", test.q, got, test.want)
+		}
+	}
+}
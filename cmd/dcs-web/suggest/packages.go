@@ -0,0 +1,129 @@
+// vim:ts=4:sw=4:noexpandtab
+package suggest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Keywords restricting a query to (or excluding) a source package, whose
+// values are completed with package names.
+var packageKeywords = []string{"package:", "-package:", "pkg:", "-pkg:"}
+
+// Package names are only suggested for bare terms of at least this many
+// characters, as shorter ones match too many packages to be useful.
+const minPackagePrefix = 2
+
+// The names of the source packages in the index.
+type Packages struct {
+	mu    sync.RWMutex
+	names []string
+}
+
+// Replaces the package names.
+func (p *Packages) Set(names []string) {
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Strings(sorted)
+	unique := sorted[:0]
+	for i, name := range sorted {
+		if i == 0 || name != sorted[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.names = unique
+}
+
+// Returns up to n package names which start with prefix, in alphabetical
+// order. Package names are lower case.
+func (p *Packages) Complete(prefix string, n int) []string {
+	prefix = strings.ToLower(prefix)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := []string{}
+	for idx := sort.SearchStrings(p.names, prefix); idx < len(p.names) && len(names) < n; idx++ {
+		if !strings.HasPrefix(p.names[idx], prefix) {
+			break
+		}
+		names = append(names, p.names[idx])
+	}
+	return names
+}
+
+// Returns the names of the source packages listed in the manifest which
+// dcs-source-backend writes (see -manifest_path), whose package trees are
+// named <package>_<version>.
+func LoadManifest(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Packages map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(manifest.Packages))
+	for tree := range manifest.Packages {
+		if idx := strings.Index(tree, "_"); idx > 0 {
+			tree = tree[:idx]
+		}
+		names = append(names, tree)
+	}
+	return names, nil
+}
+
+// Returns up to n completions of the partially typed query q: first popular
+// search terms, then the query with its last term completed to a package
+// name if that term is a package keyword (e.g. “pkg:i3” becomes
+// “pkg:i3-wm”), or package keywords for the packages whose name starts with
+// q if q is a single bare term.
+func Complete(q string, popular *Popular, packages *Packages, n int) []string {
+	completions := []string{}
+	if strings.TrimSpace(q) == "" {
+		return completions
+	}
+	seen := make(map[string]bool)
+	add := func(candidates []string) {
+		for _, c := range candidates {
+			if len(completions) < n && !seen[c] {
+				seen[c] = true
+				completions = append(completions, c)
+			}
+		}
+	}
+	if popular != nil {
+		add(popular.Complete(q, n))
+	}
+	if packages == nil || len(completions) >= n || strings.HasSuffix(q, " ") {
+		return completions
+	}
+	fields := strings.Fields(q)
+	last := fields[len(fields)-1]
+	rest := q[:strings.LastIndex(q, last)]
+	for _, keyword := range packageKeywords {
+		if !strings.HasPrefix(last, keyword) {
+			continue
+		}
+		var candidates []string
+		for _, name := range packages.Complete(last[len(keyword):], n) {
+			candidates = append(candidates, rest+keyword+name)
+		}
+		add(candidates)
+		return completions
+	}
+	if len(fields) == 1 && len(last) >= minPackagePrefix && !strings.Contains(last, ":") {
+		var candidates []string
+		for _, name := range packages.Complete(last, n) {
+			candidates = append(candidates, "package:"+name)
+		}
+		add(candidates)
+	}
+	return completions
+}
@@ -0,0 +1,62 @@
+// vim:ts=4:sw=4:noexpandtab
+package suggest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcs-suggest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "source-backend.manifest")
+	manifest := `{"Created":"2014-01-01T00:00:00Z","Packages":{` +
+		`"i3-wm_4.7":{"Files":1,"Bytes":2,"Hash":"a"},` +
+		`"i3lock_2.5":{"Files":1,"Bytes":2,"Hash":"b"}}}`
+	if err := ioutil.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := LoadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if want := []string{"i3-wm", "i3lock"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("LoadManifest = %v, want %v", names, want)
+	}
+}
+
+func TestCompletePackages(t *testing.T) {
+	packages := &Packages{}
+	packages.Set([]string{"i3lock", "i3-wm", "i3status", "i3-wm", "xcb"})
+	popular := NewPopular(100)
+	addTimes(popular, "i3_connect", minPopularCount)
+
+	for _, test := range []struct {
+		q    string
+		n    int
+		want []string
+	}{
+		{"i3", 10, []string{"i3_connect", "package:i3-wm", "package:i3lock", "package:i3status"}},
+		{"i3", 2, []string{"i3_connect", "package:i3-wm"}},
+		{"i", 10, []string{"i3_connect"}},
+		{"i3_", 10, []string{"i3_connect"}},
+		{"foo pkg:i3", 10, []string{"foo pkg:i3-wm", "foo pkg:i3lock", "foo pkg:i3status"}},
+		{"foo -package:I3l", 10, []string{"foo -package:i3lock"}},
+		{"foo i3", 10, []string{}},
+		{"i3 ", 10, []string{}},
+		{"filetype:c", 10, []string{}},
+		{"", 10, []string{}},
+	} {
+		if got := Complete(test.q, popular, packages, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Complete(%q, %d) = %v, want %v", test.q, test.n, got, test.want)
+		}
+	}
+}
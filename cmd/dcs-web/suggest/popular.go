@@ -0,0 +1,87 @@
+// vim:ts=4:sw=4:noexpandtab
+
+// Completions of partially typed search terms, for the search box and for
+// browsers (see /suggest).
+package suggest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Search terms which were searched for fewer times are not suggested, so that
+// the suggestions do not reveal what individual users search for.
+const minPopularCount = 3
+
+// Counts how often search terms are searched for. When more than max terms
+// are tracked, all counts are halved and the terms whose count drops to 0 are
+// forgotten, so that terms which are no longer popular make room for new
+// ones.
+type Popular struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+func NewPopular(max int) *Popular {
+	return &Popular{
+		max:    max,
+		counts: make(map[string]int),
+	}
+}
+
+// Counts a search for term (the q= parameter, including keywords).
+func (p *Popular) Add(term string) {
+	term = strings.TrimSpace(term)
+	// within: refers to the results of another query, which are only cached
+	// for a while.
+	if term == "" || strings.Contains(term, "within:") {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[term]++
+	if len(p.counts) <= p.max {
+		return
+	}
+	for t, count := range p.counts {
+		if count/2 == 0 {
+			delete(p.counts, t)
+		} else {
+			p.counts[t] = count / 2
+		}
+	}
+}
+
+// Returns up to n popular search terms which start with prefix (ignoring
+// case), the most popular first.
+func (p *Popular) Complete(prefix string, n int) []string {
+	prefix = strings.ToLower(prefix)
+	type popular struct {
+		term  string
+		count int
+	}
+	var matching []popular
+	p.mu.Lock()
+	for term, count := range p.counts {
+		if count >= minPopularCount && strings.HasPrefix(strings.ToLower(term), prefix) {
+			matching = append(matching, popular{term, count})
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].count == matching[j].count {
+			return matching[i].term < matching[j].term
+		}
+		return matching[i].count > matching[j].count
+	})
+	if len(matching) > n {
+		matching = matching[:n]
+	}
+	terms := make([]string, len(matching))
+	for i, m := range matching {
+		terms[i] = m.term
+	}
+	return terms
+}
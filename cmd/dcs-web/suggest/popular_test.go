@@ -0,0 +1,53 @@
+// vim:ts=4:sw=4:noexpandtab
+package suggest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func addTimes(p *Popular, term string, times int) {
+	for i := 0; i < times; i++ {
+		p.Add(term)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	p := NewPopular(100)
+	addTimes(p, "XCreateWindow", 5)
+	addTimes(p, "xcb_create_window", 7)
+	addTimes(p, "xcb_connect", 3)
+	addTimes(p, "xcb_secret", minPopularCount-1)
+	addTimes(p, "xcb_create_window within:abcdef", 10)
+	addTimes(p, "  ", 10)
+
+	for _, test := range []struct {
+		prefix string
+		n      int
+		want   []string
+	}{
+		{"xc", 10, []string{"xcb_create_window", "XCreateWindow", "xcb_connect"}},
+		{"xc", 2, []string{"xcb_create_window", "XCreateWindow"}},
+		{"xcb_c", 10, []string{"xcb_create_window", "xcb_connect"}},
+		{"xcb_s", 10, []string{}},
+		{"foo", 10, []string{}},
+	} {
+		if got := p.Complete(test.prefix, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Complete(%q, %d) = %v, want %v", test.prefix, test.n, got, test.want)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	p := NewPopular(2)
+	addTimes(p, "popular", 8)
+	addTimes(p, "rare", 1)
+	// The third term exceeds the maximum, so the counts are halved.
+	addTimes(p, "new", 1)
+	if _, ok := p.counts["rare"]; ok {
+		t.Errorf("rare search term was not forgotten")
+	}
+	if got, want := p.counts["popular"], 4; got != want {
+		t.Errorf("count of popular search term = %d, want %d", got, want)
+	}
+}
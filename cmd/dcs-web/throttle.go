@@ -0,0 +1,121 @@
+// vim:ts=4:sw=4:noexpandtab
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Debian/dcs/cmd/dcs-web/apikeys"
+	"github.com/Debian/dcs/cmd/dcs-web/ratelimit"
+	"github.com/Debian/dcs/varz"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+)
+
+var (
+	rateLimit = flag.Float64("rate_limit",
+		1,
+		"Number of queries per second which each client IP address may send on average. 0 disables rate limiting")
+	rateLimitBurst = flag.Int("rate_limit_burst",
+		10,
+		"Number of queries which each client IP address may send at once before being rate limited")
+	apiKeyRateLimit = flag.Float64("api_key_rate_limit",
+		10,
+		"Like -rate_limit, but for clients sending one of the API keys of -api_keys_path which has no rate limit of its own")
+	apiKeyRateLimitBurst = flag.Int("api_key_rate_limit_burst",
+		50,
+		"Like -rate_limit_burst, but for clients sending one of the API keys of -api_keys_path which has no rate limit of its own")
+	apiKeysPath = flag.String("api_keys_path",
+		"",
+		"Path to the file in which the API keys (see /apikeys) are stored, along with their quotas. Clients send them in the X-Api-Key header. A file listing one key per line is read as well")
+)
+
+var (
+	ipLimiter *ratelimit.Limiter
+
+	// The API keys, or nil if -api_keys_path is not set.
+	apiKeyStore *apikeys.Store
+
+	// The limiters of the rate limits of API keys, each of which is shared
+	// by all keys with the same limit.
+	apiKeyLimitersMu sync.Mutex
+	apiKeyLimiters   = make(map[apiKeyRate]*ratelimit.Limiter)
+)
+
+type apiKeyRate struct {
+	rate  float64
+	burst int
+}
+
+// Sets up the rate limiters according to the flags, see throttled.
+func loadRateLimits() {
+	if *apiKeysPath != "" {
+		var err error
+		if apiKeyStore, err = apikeys.Open(*apiKeysPath); err != nil {
+			log.Fatalf("Could not load API keys: %v\n", err)
+		}
+		log.Printf("Loaded %d API keys\n", len(apiKeyStore.List()))
+		varz.Set("quota-exceeded-api-key", 0)
+	}
+	if *rateLimit <= 0 {
+		return
+	}
+	ipLimiter = ratelimit.New(*rateLimit, *rateLimitBurst)
+	varz.Set("throttled-requests", 0)
+	varz.Set("throttled-requests-api-key", 0)
+}
+
+// Returns the API key which r carries, if it is a registered one.
+func requestAPIKey(r *http.Request) (apikeys.Key, bool) {
+	if apiKeyStore == nil {
+		return apikeys.Key{}, false
+	}
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		return apikeys.Key{}, false
+	}
+	return apiKeyStore.Get(key)
+}
+
+// Returns the limiter for the rate limit of k.
+func apiKeyLimiter(k apikeys.Key) *ratelimit.Limiter {
+	limit := apiKeyRate{k.Rate, k.Burst}
+	if limit.rate <= 0 {
+		limit.rate = *apiKeyRateLimit
+	}
+	if limit.burst <= 0 {
+		limit.burst = *apiKeyRateLimitBurst
+	}
+	apiKeyLimitersMu.Lock()
+	defer apiKeyLimitersMu.Unlock()
+	limiter, ok := apiKeyLimiters[limit]
+	if !ok {
+		limiter = ratelimit.New(limit.rate, limit.burst)
+		apiKeyLimiters[limit] = limiter
+	}
+	return limiter
+}
+
+// Wraps handlers of expensive requests (i.e. queries), refusing requests with
+// status 429 when the client exceeds its rate limit. Clients are identified
+// by their API key, if they send a registered one, or by their IP address.
+func throttled(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ipLimiter == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		limiter, key, counter := ipLimiter, ratelimit.ClientIP(r), "throttled-requests"
+		if apiKey, ok := requestAPIKey(r); ok {
+			limiter, key, counter = apiKeyLimiter(apiKey), apiKey.Token, "throttled-requests-api-key"
+		}
+		if ok, wait := limiter.Allow(key); !ok {
+			varz.Increment(counter)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, please slow down", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
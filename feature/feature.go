@@ -0,0 +1,162 @@
+// Gates experimental capabilities per instance or per percentage of traffic.
+//
+// Flags are read from a JSON file mapping flag names to the percentage (0 to
+// 100) of requests for which they are enabled, e.g.:
+//
+//	{"facets": 100, "symbols": 10}
+//
+// Flags which are not mentioned are disabled, unless they were registered
+// with a default (see Register). The current state can be inspected and
+// changed at runtime via /featurez.
+package feature
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	configPath = flag.String("feature_flags",
+		"",
+		"Path to a JSON file mapping feature flag names to the percentage of traffic they are enabled for. Re-read when POSTing reload=1 to /featurez")
+
+	flagsMu sync.RWMutex
+	flags   = make(map[string]int)
+
+	// The percentages of the registered flags, see Register.
+	defaults = make(map[string]int)
+)
+
+// Register declares the flag name, which is enabled for the given percentage
+// of traffic unless the configuration file or /featurez say otherwise. This is
+// how features which are rolled out already can still be turned off.
+func Register(name string, percent int) {
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	defaults[name] = percent
+	if _, ok := flags[name]; !ok {
+		flags[name] = percent
+	}
+}
+
+// Load (re-)reads the feature flag configuration file specified by
+// -feature_flags, replacing all flags which were set at runtime. Registered
+// flags which it does not mention get their default again. It does nothing if
+// -feature_flags is empty.
+func Load() error {
+	if *configPath == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]int)
+	if err := json.Unmarshal(contents, &loaded); err != nil {
+		return fmt.Errorf("%s: %v", *configPath, err)
+	}
+	for name, percent := range loaded {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("%s: flag %q: percentage %d out of range [0, 100]", *configPath, name, percent)
+		}
+	}
+	flagsMu.Lock()
+	for name, percent := range defaults {
+		if _, ok := loaded[name]; !ok {
+			loaded[name] = percent
+		}
+	}
+	flags = loaded
+	flagsMu.Unlock()
+	return nil
+}
+
+// Set enables name for the given percentage of traffic. 0 disables it.
+func Set(name string, percent int) {
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	if percent <= 0 {
+		if _, ok := defaults[name]; ok {
+			// Stays listed in /featurez, as registered flags are.
+			flags[name] = 0
+		} else {
+			delete(flags, name)
+		}
+		return
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	flags[name] = percent
+}
+
+// Enabled returns true if name is enabled for all traffic on this instance.
+func Enabled(name string) bool {
+	flagsMu.RLock()
+	defer flagsMu.RUnlock()
+	return flags[name] == 100
+}
+
+// EnabledFor returns true if name is enabled for key, which should identify
+// the unit of traffic (e.g. the query or the client address). The decision is
+// stable: the same key always ends up in the same bucket.
+func EnabledFor(name, key string) bool {
+	flagsMu.RLock()
+	percent := flags[name]
+	flagsMu.RUnlock()
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return int(h.Sum32()%100) < percent
+}
+
+// Featurez lists all enabled and all registered flags, one “name percentage”
+// pair per line. A
+// POST request with name= and percent= changes a flag, reload=1 re-reads the
+// configuration file.
+func Featurez(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		if r.FormValue("reload") != "" {
+			if err := Load(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if name := r.FormValue("name"); name != "" {
+			percent, err := strconv.Atoi(r.FormValue("percent"))
+			if err != nil {
+				http.Error(w, "Invalid percent parameter", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Setting feature flag %q to %d%%\n", name, percent)
+			Set(name, percent)
+		}
+	}
+
+	flagsMu.RLock()
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s %d\n", name, flags[name])
+	}
+	flagsMu.RUnlock()
+}
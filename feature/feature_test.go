@@ -0,0 +1,47 @@
+package feature
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEnabledFor(t *testing.T) {
+	Set("test", 0)
+	if Enabled("test") || EnabledFor("test", "foo") {
+		t.Fatalf("flag enabled after setting it to 0%%")
+	}
+
+	Set("test", 100)
+	if !Enabled("test") || !EnabledFor("test", "foo") {
+		t.Fatalf("flag disabled after setting it to 100%%")
+	}
+
+	Set("test", 30)
+	if Enabled("test") {
+		t.Fatalf("flag enabled for all traffic when set to 30%%")
+	}
+	enabled := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if EnabledFor("test", key) != EnabledFor("test", key) {
+			t.Fatalf("EnabledFor(%q) not stable", key)
+		}
+		if EnabledFor("test", key) {
+			enabled++
+		}
+	}
+	if enabled < 2500 || enabled > 3500 {
+		t.Fatalf("flag enabled for %d of 10000 keys, want approx. 3000", enabled)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("test-registered", 100)
+	if !Enabled("test-registered") {
+		t.Fatalf("registered flag not enabled by default")
+	}
+	Set("test-registered", 0)
+	if EnabledFor("test-registered", "foo") {
+		t.Fatalf("registered flag enabled after setting it to 0%%")
+	}
+}
@@ -0,0 +1,138 @@
+// Decides which files of a source package are not indexed.
+//
+// Each exclusion rule is a small type implementing Filter. A Pipeline runs
+// the rules in order and reports the first one which excludes a file.
+package filter
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// File is what a Filter looks at.
+type File struct {
+	// Path relative to the package root, e.g. “src/main.c”.
+	Path string
+
+	Info os.FileInfo
+
+	// Content type as sniffed by http.DetectContentType from the first bytes
+	// of the file, e.g. “text/plain; charset=utf-8”. Empty for directories.
+	ContentType string
+}
+
+// A Filter is one exclusion rule.
+type Filter interface {
+	// Name identifies the filter in logs and statistics.
+	Name() string
+
+	// Exclude returns true if f should not be indexed. For a directory, this
+	// excludes everything below it.
+	Exclude(f *File) bool
+}
+
+// A Pipeline is a list of filters, applied in order.
+type Pipeline []Filter
+
+// Exclude returns the first filter which excludes f, or nil if f should be
+// indexed.
+func (p Pipeline) Exclude(f *File) Filter {
+	for _, filter := range p {
+		if filter.Exclude(f) {
+			return filter
+		}
+	}
+	return nil
+}
+
+// Sniff returns the content type of a file starting with head, which should
+// contain the first 512 bytes of the file (or all of it if it is shorter).
+func Sniff(head []byte) string {
+	return http.DetectContentType(head)
+}
+
+// Set turns a comma-separated list (as used in command line flags) into a
+// set. Empty entries are ignored.
+func Set(list string) map[string]bool {
+	result := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		if entry != "" {
+			result[entry] = true
+		}
+	}
+	return result
+}
+
+// Dirnames excludes directories with any of the given names, e.g. “.git”.
+type Dirnames map[string]bool
+
+func (Dirnames) Name() string { return "dirname" }
+
+func (d Dirnames) Exclude(f *File) bool {
+	return f.Info.IsDir() && d[path.Base(f.Path)]
+}
+
+// Filenames excludes files with any of the given names, e.g. “COPYING”.
+type Filenames map[string]bool
+
+func (Filenames) Name() string { return "filename" }
+
+func (n Filenames) Exclude(f *File) bool {
+	return !f.Info.IsDir() && n[path.Base(f.Path)]
+}
+
+// Suffixes excludes files whose extension (without the dot) is any of the
+// given suffixes, e.g. “html”.
+type Suffixes map[string]bool
+
+func (Suffixes) Name() string { return "suffix" }
+
+func (s Suffixes) Exclude(f *File) bool {
+	if f.Info.IsDir() {
+		return false
+	}
+	ext := path.Ext(f.Path)
+	return ext != "" && s[ext[1:]]
+}
+
+// Changelogs excludes changelog and readme files, except for those in debian/
+// directories (e.g. debian/changelog), which are interesting for Debian
+// developers.
+type Changelogs struct{}
+
+func (Changelogs) Name() string { return "changelog" }
+
+func (Changelogs) Exclude(f *File) bool {
+	if f.Info.IsDir() || path.Base(path.Dir(f.Path)) == "debian" {
+		return false
+	}
+	base := strings.ToLower(path.Base(f.Path))
+	return strings.HasPrefix(base, "changelog") || strings.HasPrefix(base, "readme")
+}
+
+// Manpages excludes files ending in .[0-9], e.g. “ls.1”.
+type Manpages struct{}
+
+func (Manpages) Name() string { return "manpage" }
+
+func (Manpages) Exclude(f *File) bool {
+	// Cheaper than a regular expression.
+	p := f.Path
+	return !f.Info.IsDir() &&
+		len(p) > 2 &&
+		p[len(p)-2] == '.' &&
+		p[len(p)-1] >= '0' &&
+		p[len(p)-1] <= '9'
+}
+
+// Binary excludes files whose content type is not text/*. Index.Add rejects
+// most binary files anyway, but only after reading them completely.
+type Binary struct{}
+
+func (Binary) Name() string { return "binary" }
+
+func (Binary) Exclude(f *File) bool {
+	return !f.Info.IsDir() && f.ContentType != "" && !strings.HasPrefix(f.ContentType, "text/")
+}
@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Implements os.FileInfo without touching the file system.
+type fakeInfo struct {
+	dir bool
+}
+
+func (i fakeInfo) Name() string       { return "" }
+func (i fakeInfo) Size() int64        { return 0 }
+func (i fakeInfo) Mode() os.FileMode  { return 0644 }
+func (i fakeInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeInfo) IsDir() bool        { return i.dir }
+func (i fakeInfo) Sys() interface{}   { return nil }
+
+func file(path string) *File {
+	return &File{Path: path, Info: fakeInfo{}, ContentType: "text/plain; charset=utf-8"}
+}
+
+func dir(path string) *File {
+	return &File{Path: path, Info: fakeInfo{dir: true}}
+}
+
+func TestFilters(t *testing.T) {
+	for _, entry := range []struct {
+		filter  Filter
+		file    *File
+		exclude bool
+	}{
+		{Dirnames(Set(".git,po")), dir("po"), true},
+		{Dirnames(Set(".git,po")), dir("src/.git"), true},
+		{Dirnames(Set(".git,po")), file("po"), false},
+		{Dirnames(Set(".git,po")), dir("src"), false},
+
+		{Filenames(Set("COPYING")), file("COPYING"), true},
+		{Filenames(Set("COPYING")), file("doc/COPYING"), true},
+		{Filenames(Set("COPYING")), dir("COPYING"), false},
+		{Filenames(Set("COPYING")), file("COPYING.c"), false},
+
+		{Suffixes(Set("html,txt")), file("doc/index.html"), true},
+		{Suffixes(Set("html,txt")), file("html"), false},
+		{Suffixes(Set("html,txt")), file("main.c"), false},
+
+		{Changelogs{}, file("ChangeLog"), true},
+		{Changelogs{}, file("src/README.md"), true},
+		{Changelogs{}, file("debian/changelog"), false},
+		{Changelogs{}, file("debian/README.Debian"), false},
+		{Changelogs{}, file("changes.c"), false},
+
+		{Manpages{}, file("doc/ls.1"), true},
+		{Manpages{}, file("doc/ls.1.in"), false},
+		{Manpages{}, file("1"), false},
+
+		{Binary{}, &File{Path: "a.png", Info: fakeInfo{}, ContentType: "image/png"}, true},
+		{Binary{}, file("main.c"), false},
+		{Binary{}, dir("src"), false},
+	} {
+		if got := entry.filter.Exclude(entry.file); got != entry.exclude {
+			t.Errorf("%s filter: Exclude(%q) = %v, want %v",
+				entry.filter.Name(), entry.file.Path, got, entry.exclude)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	pipeline := Pipeline{Filenames(Set("Makefile.in")), Manpages{}}
+	if filter := pipeline.Exclude(file("doc/ls.1")); filter == nil || filter.Name() != "manpage" {
+		t.Errorf("Exclude(doc/ls.1) = %v, want the manpage filter", filter)
+	}
+	if filter := pipeline.Exclude(file("src/main.c")); filter != nil {
+		t.Errorf("Exclude(src/main.c) = %v, want nil", filter)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	if got := Sniff([]byte("int main() {}\n")); got != "text/plain; charset=utf-8" {
+		t.Errorf("Sniff(C source) = %q", got)
+	}
+	if got := Sniff([]byte("\x89PNG\r\n\x1a\n")); got != "image/png" {
+		t.Errorf("Sniff(PNG) = %q", got)
+	}
+}
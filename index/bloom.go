@@ -0,0 +1,223 @@
+package index
+
+// Bloom filters.
+//
+// A file containing all trigrams of a literal does not necessarily contain
+// the literal itself: "foobar" has the trigrams of "foo bar" and "oobarf".
+// Reading such files only to find no match is the most expensive part of a
+// query with rare literals. An IndexWriter with Bloom set therefore records a
+// Bloom filter of the 4-grams (sequences of 4 bytes) of each file, which is
+// stored in the SectionBloom section of a version 2 or 3 index:
+//
+//	file index [8]...
+//	filters
+//
+// The file index is laid out like the one of the line offsets (see lines.go).
+// Each filter is a bit set of a power of two bytes between minBloomBytes and
+// maxBloomBytes, sized for bloomBitsPerGram bits per distinct 4-gram. A
+// 4-gram is recorded by setting bloomHashes bits, see bloomBits. Files with
+// too many distinct 4-grams for maxBloomBytes get an empty filter, which
+// matches everything.
+//
+// The filters are built from the raw bytes of the files, i.e. they can only
+// be consulted for case-sensitive literals.
+
+import (
+	"math"
+	"os"
+	"regexp/syntax"
+)
+
+// SectionBloom holds the 4-gram Bloom filters of all files.
+const SectionBloom SectionID = 4
+
+const (
+	minBloomBytes = 64
+	maxBloomBytes = 8192
+
+	// With 8 bits per 4-gram and 4 hashes, about 2.4% of the 4-grams which
+	// are not in a file pass its filter.
+	bloomBitsPerGram = 8
+	bloomHashes      = 4
+)
+
+// bloomBits calls f with the bit positions of gram in a filter of size
+// bytes, which must be a power of two.
+func bloomBits(gram uint32, size int, f func(bit uint32)) {
+	// The finalizer of MurmurHash3, so that all bits of gram influence the
+	// low bits used as positions.
+	h := gram
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	h1, h2 := h, (h>>16|h<<16)|1
+	mask := uint32(size*8 - 1)
+	for i := uint32(0); i < bloomHashes; i++ {
+		f((h1 + i*h2) & mask)
+	}
+}
+
+// bloomWriter collects the Bloom filters while an index is written.
+type bloomWriter struct {
+	index *bufWriter // temp file holding the file index
+	data  *bufWriter // temp file holding the filters
+
+	// filter of the current file, at the largest size. A smaller filter is
+	// obtained by OR-ing the halves, since positions only depend on the low
+	// bits of the hashes.
+	filter [maxBloomBytes]byte
+}
+
+func newBloomWriter() *bloomWriter {
+	return &bloomWriter{
+		index: bufCreate(""),
+		data:  bufCreate(""),
+	}
+}
+
+func (w *bloomWriter) reset() {
+	w.filter = [maxBloomBytes]byte{}
+}
+
+func (w *bloomWriter) add(gram uint32) {
+	bloomBits(gram, maxBloomBytes, func(bit uint32) {
+		w.filter[bit/8] |= 1 << (bit % 8)
+	})
+}
+
+// size returns the size of the filter of the current file, or 0 if it has
+// too many 4-grams.
+func (w *bloomWriter) size() int {
+	set := 0
+	for _, b := range w.filter {
+		for ; b != 0; b &= b - 1 {
+			set++
+		}
+	}
+	const m = maxBloomBytes * 8
+	if set == m {
+		return 0
+	}
+	// Estimate the number of distinct 4-grams from the fraction of set bits.
+	grams := -m / bloomHashes * math.Log(1-float64(set)/m)
+	size := minBloomBytes
+	for float64(size*8) < grams*bloomBitsPerGram {
+		if size *= 2; size > maxBloomBytes {
+			return 0
+		}
+	}
+	return size
+}
+
+// addFile writes the filter of the current file.
+func (w *bloomWriter) addFile() {
+	w.index.writeUint64(w.data.offset())
+	size := w.size()
+	if size == 0 {
+		return
+	}
+	filter := w.filter[:]
+	for len(filter) > size {
+		half := len(filter) / 2
+		for i := range filter[:half] {
+			filter[i] |= filter[half+i]
+		}
+		filter = filter[:half]
+	}
+	w.data.write(filter)
+}
+
+// flush writes the section to out and removes the temporary files.
+func (w *bloomWriter) flush(out *bufWriter, t *trailer) {
+	w.index.writeUint64(w.data.offset())
+	t.beginSection(out, SectionBloom)
+	copyFile(out, w.index)
+	copyFile(out, w.data)
+	t.endSection(out)
+	os.Remove(w.index.name)
+	os.Remove(w.data.name)
+}
+
+// HasBloom returns true if the index contains Bloom filters.
+func (ix *Index) HasBloom() bool {
+	return ix.Section(SectionBloom) != nil
+}
+
+// MayContain returns false if the given file certainly does not contain
+// literal. It returns true if the file might contain it, if literal is
+// shorter than 4 bytes or if the index has no Bloom filters.
+func (ix *Index) MayContain(fileid uint32, literal string) bool {
+	s := ix.Section(SectionBloom)
+	if s == nil || len(literal) < 4 {
+		return true
+	}
+	filter := ix.fileData(s, fileid)
+	if len(filter) == 0 {
+		return true
+	}
+	if len(filter)&(len(filter)-1) != 0 {
+		corrupt(ix.File)
+	}
+	for i := 0; i+4 <= len(literal); i++ {
+		gram := uint32(literal[i])<<24 | uint32(literal[i+1])<<16 | uint32(literal[i+2])<<8 | uint32(literal[i+3])
+		found := true
+		bloomBits(gram, len(filter), func(bit uint32) {
+			if filter[bit/8]&(1<<(bit%8)) == 0 {
+				found = false
+			}
+		})
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterBloom returns the files of post which may contain all of literals.
+// post is modified in place.
+func (ix *Index) FilterBloom(post []uint32, literals []string) []uint32 {
+	if !ix.HasBloom() || len(literals) == 0 {
+		return post
+	}
+	filtered := post[:0]
+	for _, fileid := range post {
+		ok := true
+		for _, literal := range literals {
+			if !ix.MayContain(fileid, literal) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			filtered = append(filtered, fileid)
+		}
+	}
+	return filtered
+}
+
+// RequiredLiterals returns case-sensitive literals of at least 4 bytes which
+// every match of re contains, for use with FilterBloom.
+func RequiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 || len(string(re.Rune)) < 4 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return RequiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return RequiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var literals []string
+		for _, sub := range re.Sub {
+			literals = append(literals, RequiredLiterals(sub)...)
+		}
+		return literals
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-bloom-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var large []string
+	for i := 0; i < 20000; i++ {
+		large = append(large, fmt.Sprintf("%05d", i))
+	}
+	files := map[string]string{
+		// a and b contain the trigrams of foobar, but not foobar.
+		"a": "foob obar\n",
+		"b": "oobarfoo\n",
+		"c": "x := foobar()\n",
+		// Too many 4-grams for a filter.
+		"d": strings.Join(large, "\n") + "\nfoob\nobar\n",
+	}
+	first := filepath.Join(dir, "first.idx")
+	ix := Create(first)
+	ix.Bloom = true
+	for _, name := range []string{"a", "b"} {
+		ix.Add(name, strings.NewReader(files[name]))
+	}
+	ix.Flush()
+	second := filepath.Join(dir, "second.idx")
+	ix = Create(second)
+	ix.Bloom = true
+	for _, name := range []string{"c", "d"} {
+		ix.Add(name, strings.NewReader(files[name]))
+	}
+	ix.Flush()
+	all := filepath.Join(dir, "all.idx")
+	ConcatN(all, first, second)
+
+	ix2 := Open(all)
+	defer ix2.Close()
+	if !ix2.HasBloom() {
+		t.Fatalf("HasBloom() = false, want true")
+	}
+	if got := len(ix2.fileData(ix2.Section(SectionBloom), 3)); got != 0 {
+		t.Errorf("filter of d has %d bytes, want 0", got)
+	}
+	post := ix2.PostingQuery(RegexpQuery(mustParse(t, "foobar")))
+	if want := []uint32{0, 1, 2, 3}; !reflect.DeepEqual(post, want) {
+		t.Fatalf("PostingQuery(foobar) = %v, want %v", post, want)
+	}
+	if got, want := ix2.FilterBloom(post, []string{"foobar"}), []uint32{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterBloom(foobar) = %v, want %v", got, want)
+	}
+	for _, literal := range []string{"foob", "x := foobar()", "foo"} {
+		for fileid := uint32(0); fileid < 4; fileid++ {
+			if name := ix2.Name(fileid); strings.Contains(files[name], literal) && !ix2.MayContain(fileid, literal) {
+				t.Errorf("MayContain(%s, %q) = false, want true", name, literal)
+			}
+		}
+	}
+
+	// Without Bloom filters, nothing is filtered.
+	buildIndex(first, nil, files)
+	ix3 := Open(first)
+	defer ix3.Close()
+	if got, want := ix3.FilterBloom([]uint32{0, 1, 2, 3}, []string{"foobar"}), []uint32{0, 1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterBloom(foobar) without filters = %v, want %v", got, want)
+	}
+}
+
+func mustParse(t *testing.T, expr string) *syntax.Regexp {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re
+}
+
+func TestRequiredLiterals(t *testing.T) {
+	for _, test := range []struct {
+		expr string
+		want []string
+	}{
+		{"foobar", []string{"foobar"}},
+		{"foo", nil},
+		{"(?i)foobar", nil},
+		{"foobar.*baz(quux[0-9]+)+", []string{"foobar", "quux"}},
+		{"open(at)?\\(", []string{"open"}},
+		{"fopen|fclose", nil},
+		{"func (\\w+Handler)\\(w http", []string{"func ", "Handler", "(w http"}},
+	} {
+		got := RequiredLiterals(mustParse(t, test.expr))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RequiredLiterals(%q) = %q, want %q", test.expr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package index
+
+// Size-tiered compaction.
+//
+// Every import appends a small segment, so without compaction the number of
+// segments (and thus the number of indexes each query needs to look at) keeps
+// growing. Merging all segments each time would make imports as expensive as
+// a full merge, though. TieredPolicy sorts segments into small, medium and
+// large ones by size and only merges runs of consecutive segments of the same
+// tier: many small segments become a medium one, many medium segments become
+// a large one. Each byte is thus only rewritten about once per tier.
+//
+// Only consecutive segments can be merged, since tombstones apply to the
+// segments that existed when they were added.
+
+// Tier is the size class of a segment.
+type Tier int
+
+const (
+	TierSmall Tier = iota
+	TierMedium
+	TierLarge
+)
+
+func (t Tier) String() string {
+	switch t {
+	case TierSmall:
+		return "small"
+	case TierMedium:
+		return "medium"
+	case TierLarge:
+		return "large"
+	}
+	return "unknown"
+}
+
+// TieredPolicy decides which segments to merge.
+type TieredPolicy struct {
+	// Segments smaller than SmallSize bytes are small, those smaller than
+	// LargeSize bytes are medium, all others are large.
+	SmallSize int64
+	LargeSize int64
+
+	// A run of this many consecutive segments of the same tier is merged
+	// into a single segment. Values below 2 are treated as 2.
+	MaxPerTier int
+}
+
+// Tier returns the tier of a segment of size bytes.
+func (p TieredPolicy) Tier(size int64) Tier {
+	switch {
+	case size < p.SmallSize:
+		return TierSmall
+	case size < p.LargeSize:
+		return TierMedium
+	}
+	return TierLarge
+}
+
+// Pick returns the segments lo to hi-1 which should be merged next, given the
+// sizes of all segments (oldest first). ok is false if nothing needs to be
+// merged. Smaller tiers are merged first, as that is cheap and reduces the
+// number of segments the most. Within a tier, the oldest run is merged first.
+func (p TieredPolicy) Pick(sizes []int64) (lo, hi int, ok bool) {
+	n := p.MaxPerTier
+	if n < 2 {
+		n = 2
+	}
+	for tier := TierSmall; tier <= TierLarge; tier++ {
+		run := 0
+		for i, size := range sizes {
+			if p.Tier(size) != tier {
+				run = 0
+				continue
+			}
+			run++
+			if run == n {
+				return i + 1 - n, i + 1, true
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,28 @@
+package index
+
+import "testing"
+
+func TestTieredPolicy(t *testing.T) {
+	p := TieredPolicy{SmallSize: 10, LargeSize: 100, MaxPerTier: 3}
+	for _, test := range []struct {
+		sizes  []int64
+		lo, hi int
+		ok     bool
+	}{
+		{nil, 0, 0, false},
+		{[]int64{1, 2}, 0, 0, false},
+		{[]int64{1, 2, 3}, 0, 3, true},
+		// The small segments are not consecutive.
+		{[]int64{1, 50, 2, 3}, 0, 0, false},
+		{[]int64{1, 50, 2, 3, 4}, 2, 5, true},
+		// Small segments are merged before medium ones.
+		{[]int64{50, 60, 70, 1, 2, 3}, 3, 6, true},
+		{[]int64{500, 50, 60, 70, 1}, 1, 4, true},
+		{[]int64{500, 600, 700, 1}, 0, 3, true},
+	} {
+		lo, hi, ok := p.Pick(test.sizes)
+		if lo != test.lo || hi != test.hi || ok != test.ok {
+			t.Errorf("Pick(%v) = %d, %d, %v, want %d, %d, %v", test.sizes, lo, hi, ok, test.lo, test.hi, test.ok)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxQueryTrigrams is the maximum number of trigrams a Query may contain (see
+// CheckQuery). Each of them requires reading a posting list, so a regexp
+// like (a|b|c)(d|e|f)(g|h|i) becomes expensive before a single file has been
+// searched.
+var MaxQueryTrigrams = 1000
+
+var (
+	// ErrQueryMatchesAll is returned by CheckQuery for queries which cannot
+	// be used to narrow down the files to search, e.g. for the regexps .*,
+	// "ab" or a.b: every file would need to be searched.
+	ErrQueryMatchesAll = errors.New("the query does not contain three consecutive characters which every match needs to contain, so it would need to search every file")
+
+	// ErrQueryMatchesNone is returned by CheckQuery for queries which can
+	// never match, e.g. for the regexp [^\s\S].
+	ErrQueryMatchesNone = errors.New("the query cannot match anything")
+)
+
+// CheckQuery returns an error explaining why q (see RegexpQuery) is too
+// expensive to be answered using the trigram index, or nil if it is fine.
+func CheckQuery(q *Query) error {
+	switch q.Op {
+	case QAll:
+		return ErrQueryMatchesAll
+	case QNone:
+		return ErrQueryMatchesNone
+	}
+	if n := q.numTrigrams(); n > MaxQueryTrigrams {
+		return fmt.Errorf("the query has too many alternatives (%d trigrams, at most %d are allowed), try to make it more specific", n, MaxQueryTrigrams)
+	}
+	return nil
+}
+
+// numTrigrams returns the number of trigrams in q, including all
+// subqueries.
+func (q *Query) numTrigrams() int {
+	n := len(q.Trigram)
+	for _, sub := range q.Sub {
+		n += sub.numTrigrams()
+	}
+	return n
+}
@@ -0,0 +1,43 @@
+package index
+
+import (
+	"regexp/syntax"
+	"testing"
+)
+
+func TestCheckQuery(t *testing.T) {
+	for _, test := range []struct {
+		re   string
+		want error
+	}{
+		{`Abcdef`, nil},
+		{`abc.*(def|ghi)`, nil},
+		{`.*`, ErrQueryMatchesAll},
+		{`a`, ErrQueryMatchesAll},
+		{`ab.f`, ErrQueryMatchesAll},
+		{`abc|.`, ErrQueryMatchesAll},
+		{`[^\s\S]`, ErrQueryMatchesNone},
+	} {
+		re, err := syntax.Parse(test.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := CheckQuery(RegexpQuery(re)); got != test.want {
+			t.Errorf("CheckQuery(%q) = %v, want %v", test.re, got, test.want)
+		}
+	}
+}
+
+func TestCheckQueryTooManyTrigrams(t *testing.T) {
+	old := MaxQueryTrigrams
+	defer func() { MaxQueryTrigrams = old }()
+	MaxQueryTrigrams = 4
+
+	re, err := syntax.Parse(`ab[cde]f`, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckQuery(RegexpQuery(re)); err == nil {
+		t.Errorf("CheckQuery(%q) = nil, want an error", `ab[cde]f`)
+	}
+}
@@ -0,0 +1,405 @@
+package index
+
+// Compressed blocks.
+//
+// The name list and the posting lists make up most of a shard, and both
+// compress well: names share long directory prefixes, posting lists of
+// related trigrams look alike. Compress rewrites an index so that both are
+// stored as zstd-compressed blocks of compressBlockSize bytes of the original
+// data. Indexes written this way have FeatureCompressed set in their trailer.
+//
+// The name index and the posting list index keep referring to offsets in the
+// uncompressed data, so that a name or posting list is found by decompressing
+// the block(s) containing it. The SectionBlocks section maps blocks to their
+// compressed data:
+//
+//	block size [4]
+//	number of name list blocks [4]
+//	offset [8]... (one more than there are blocks)
+//	number of posting list blocks [4]
+//	offset [8]...
+//
+// Offsets are relative to the start of the name list and the posting lists.
+// Decompressed blocks are kept in a least recently used cache shared by all
+// indexes, see SetBlockCacheSize.
+//
+// The writers (IndexWriter, ConcatN, Merge) always write uncompressed
+// indexes, but read compressed ones.
+
+import (
+	"container/list"
+	"encoding/binary"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SectionBlocks holds the block tables of compressed indexes.
+const SectionBlocks SectionID = 5
+
+// compressBlockSize is the size of the blocks of uncompressed data. Larger
+// blocks compress better, but make looking up a single name slower.
+const compressBlockSize = 64 << 10
+
+// Regions of an index which are compressed.
+const (
+	regionNames = iota
+	regionPostings
+)
+
+// A blockTable describes the compressed blocks of one region.
+type blockTable struct {
+	start     uint64 // offset of the region in the file
+	blockSize uint64
+	n         uint64 // number of blocks
+	offsets   []byte // n+1 offsets [8]
+}
+
+func (t *blockTable) offset(i uint64) uint64 {
+	return binary.BigEndian.Uint64(t.offsets[8*i:])
+}
+
+// initBlocks reads the block tables of a compressed index.
+func (ix *Index) initBlocks() {
+	s := ix.Section(SectionBlocks)
+	if len(s) < 4 {
+		corrupt(ix.File)
+	}
+	blockSize := uint64(binary.BigEndian.Uint32(s))
+	s = s[4:]
+	ends := [2]uint64{ix.postData, ix.postListsEnd()}
+	ix.blocks = make([]blockTable, 2)
+	for r, start := range []uint64{ix.nameData, ix.postData} {
+		if len(s) < 4 || blockSize == 0 {
+			corrupt(ix.File)
+		}
+		n := uint64(binary.BigEndian.Uint32(s))
+		s = s[4:]
+		if uint64(len(s)) < 8*(n+1) {
+			corrupt(ix.File)
+		}
+		t := blockTable{start: start, blockSize: blockSize, n: n, offsets: s[:8*(n+1)]}
+		for i := uint64(1); i <= n; i++ {
+			if t.offset(i) < t.offset(i-1) {
+				corrupt(ix.File)
+			}
+		}
+		if start+t.offset(n) > ends[r] {
+			corrupt(ix.File)
+		}
+		ix.blocks[r] = t
+		s = s[8*(n+1):]
+	}
+}
+
+// postListsEnd returns the end of the posting lists, i.e. the offset of the
+// first section following them or of the name index.
+func (ix *Index) postListsEnd() uint64 {
+	end := ix.nameIndex
+	for _, s := range ix.sectionEntries() {
+		if s.off >= ix.postData && s.off < end {
+			end = s.off
+		}
+	}
+	return end
+}
+
+// Compressed returns true if the name list and posting lists of the index
+// are compressed, i.e. if it was written by Compress.
+func (ix *Index) Compressed() bool {
+	return ix.features&FeatureCompressed != 0
+}
+
+var (
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+)
+
+// decompress decompresses a block, which is safe for concurrent use.
+func decompress(src []byte, sizeHint uint64) ([]byte, error) {
+	decoderOnce.Do(func() {
+		var err error
+		if decoder, err = zstd.NewReader(nil); err != nil {
+			log.Fatal(err)
+		}
+	})
+	return decoder.DecodeAll(src, make([]byte, 0, sizeHint))
+}
+
+// block returns the i-th decompressed block of region r.
+func (ix *Index) block(r int, i uint64) []byte {
+	key := blockKey{ix, r, i}
+	if d, ok := blocks.get(key); ok {
+		return d
+	}
+	t := &ix.blocks[r]
+	lo, hi := t.offset(i), t.offset(i+1)
+	d, err := decompress(ix.slice(t.start+lo, int(hi-lo)), t.blockSize)
+	if err != nil || uint64(len(d)) > t.blockSize || i+1 < t.n && uint64(len(d)) != t.blockSize {
+		corrupt(ix.File)
+	}
+	blocks.add(key, d)
+	return d
+}
+
+// uncompressed returns the uncompressed data of region r starting at off.
+// Blocks are decompressed until complete returns true for the data, which
+// grows by one block at a time.
+func (ix *Index) uncompressed(r int, off uint64, complete func(d []byte) bool) []byte {
+	t := &ix.blocks[r]
+	i := off / t.blockSize
+	if i >= t.n {
+		corrupt(ix.File)
+	}
+	d := ix.block(r, i)
+	if off-i*t.blockSize > uint64(len(d)) {
+		corrupt(ix.File)
+	}
+	d = d[off-i*t.blockSize:]
+	for !complete(d) {
+		if i++; i >= t.n {
+			corrupt(ix.File)
+		}
+		// Cached blocks must not be modified, so the first append copies.
+		d = append(d[:len(d):len(d)], ix.block(r, i)...)
+	}
+	return d
+}
+
+// nameAt returns the name at offset off of the name list.
+func (ix *Index) nameAt(off uint64) []byte {
+	if ix.blocks == nil {
+		return ix.str(ix.nameData + off)
+	}
+	checked := 0
+	d := ix.uncompressed(regionNames, off, func(d []byte) bool {
+		for ; checked < len(d); checked++ {
+			if d[checked] == 0 {
+				return true
+			}
+		}
+		return false
+	})
+	return d[:checked]
+}
+
+// postingData returns the posting list of count entries at offset off of the
+// posting lists, starting after its trigram.
+func (ix *Index) postingData(off uint64, count uint32) []byte {
+	if ix.blocks == nil {
+		return ix.slice(ix.postData+off+3, -1)
+	}
+	// The list has count deltas and a terminating 0.
+	need, pos := int(count)+1, 0
+	return ix.uncompressed(regionPostings, off+3, func(d []byte) bool {
+		for ; need > 0; need-- {
+			_, n := binary.Uvarint(d[pos:])
+			if n == 0 {
+				return false
+			}
+			if n < 0 {
+				// Reported as corrupt by the caller.
+				return true
+			}
+			pos += n
+		}
+		return true
+	})
+}
+
+// A blockKey identifies a decompressed block in the cache.
+type blockKey struct {
+	ix     *Index
+	region int
+	block  uint64
+}
+
+type blockEntry struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is a least recently used cache of decompressed blocks.
+type blockCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // of *blockEntry, most recently used first
+	entries map[blockKey]*list.Element
+}
+
+var blocks = &blockCache{
+	max:     64 << 20,
+	lru:     list.New(),
+	entries: make(map[blockKey]*list.Element),
+}
+
+// SetBlockCacheSize sets the number of bytes of decompressed blocks of
+// compressed indexes which are kept in memory. The default is 64 MiB.
+func SetBlockCacheSize(bytes int64) {
+	blocks.mu.Lock()
+	defer blocks.mu.Unlock()
+	blocks.max = bytes
+	blocks.evict()
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockEntry).data, true
+}
+
+func (c *blockCache) add(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		// Decompressed concurrently by another goroutine.
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&blockEntry{key, data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// evict removes the least recently used blocks until the cache fits into
+// its size. Called with mu held.
+func (c *blockCache) evict() {
+	for c.size > c.max && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *blockCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*blockEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+// drop removes the blocks of ix, which is being closed.
+func (c *blockCache) drop(ix *Index) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*blockEntry).key.ix == ix {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// compressRegion writes data as compressed blocks to out and returns the
+// block table entries for it.
+func compressRegion(out *bufWriter, enc *zstd.Encoder, data []byte) []byte {
+	start := out.offset()
+	var table []byte
+	var buf [8]byte
+	var compressed []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > compressBlockSize {
+			n = compressBlockSize
+		}
+		binary.BigEndian.PutUint64(buf[:], out.offset()-start)
+		table = append(table, buf[:]...)
+		compressed = enc.EncodeAll(data[:n], compressed[:0])
+		out.write(compressed)
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint64(buf[:], out.offset()-start)
+	table = append(table, buf[:]...)
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(table)/8-1))
+	return append(count[:], table...)
+}
+
+// Compress writes a copy of the uncompressed index src to dst, in which the
+// name list and the posting lists are compressed. All other parts are copied
+// unmodified.
+func Compress(dst, src string) {
+	ix := Open(src)
+	defer ix.Close()
+	if ix.Compressed() {
+		log.Fatalf("%s is already compressed", src)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer enc.Close()
+
+	out := bufCreate(dst)
+	out.writeString(magicV3)
+	out.write(ix.slice(ix.pathData, int(ix.nameData-ix.pathData)))
+
+	var table [4]byte
+	binary.BigEndian.PutUint32(table[:], compressBlockSize)
+	blockSection := table[:]
+
+	nameData := out.offset()
+	blockSection = append(blockSection, compressRegion(out, enc, ix.slice(ix.nameData, int(ix.postData-ix.nameData)))...)
+	postData := out.offset()
+	postEnd := ix.postListsEnd()
+	blockSection = append(blockSection, compressRegion(out, enc, ix.slice(ix.postData, int(postEnd-ix.postData)))...)
+
+	t := trailer{features: ix.features | FeatureCompressed}
+	for _, s := range ix.sectionEntries() {
+		if s.id == SectionChecksums || s.id == SectionBlocks {
+			continue
+		}
+		t.beginSection(out, s.id)
+		out.write(ix.slice(s.off, int(s.length)))
+		t.endSection(out)
+	}
+	t.beginSection(out, SectionBlocks)
+	out.write(blockSection)
+	t.endSection(out)
+
+	// The indexes are rewritten with 64-bit offsets in case src uses an
+	// older version.
+	nameIndex := out.offset()
+	for i := 0; i <= ix.numName; i++ {
+		out.writeUint64(ix.offset(ix.nameIndex + ix.offSize*uint64(i)))
+	}
+	postIndex := out.offset()
+	for i := 0; i < ix.numPost; i++ {
+		trigram, count, offset := ix.listAt(i)
+		out.writeTrigram(trigram)
+		out.writeUint32(count)
+		out.writeUint64(offset)
+	}
+
+	t.off = [5]uint64{uint64(len(magicV3)), nameData, postData, nameIndex, postIndex}
+	t.write(out)
+	out.flush()
+}
+
+// compressedRegions returns the names and the posting lists of a compressed
+// index for verification, or nil for a region which cannot be decompressed.
+func (v *verifier) compressedRegions() (names, posts []byte) {
+	ix := v.ix
+	var regions [2][]byte
+	for r := range ix.blocks {
+		t := &ix.blocks[r]
+		d := []byte{}
+		for i := uint64(0); i < t.n; i++ {
+			lo, hi := t.start+t.offset(i), t.start+t.offset(i+1)
+			block, err := decompress(v.d[lo:hi], t.blockSize)
+			if err != nil {
+				v.problem(lo, "%s: block %d cannot be decompressed: %v", v.part(lo), i, err)
+				d = nil
+				break
+			}
+			d = append(d, block...)
+		}
+		regions[r] = d
+	}
+	return regions[regionNames], regions[regionPostings]
+}
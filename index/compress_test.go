@@ -0,0 +1,146 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough files for the name list and the posting lists to span several
+	// blocks.
+	var names []string
+	for i := 0; i < 5000; i++ {
+		names = append(names, fmt.Sprintf("pkg%04d/some/rather/long/directory/file%d.c", i/10, i))
+	}
+	out := filepath.Join(dir, "plain.idx")
+	ix := Create(out)
+	ix.LineOffsets = true
+	ix.Bloom = true
+	for i, name := range names {
+		ix.Add(name, strings.NewReader(fmt.Sprintf("int f%d() { return %d; }\n", i, i*7919)))
+	}
+	ix.Flush()
+	compressed := filepath.Join(dir, "compressed.idx")
+	Compress(compressed, out)
+
+	plainInfo, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedInfo, err := os.Stat(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressedInfo.Size() >= plainInfo.Size() {
+		t.Errorf("compressed index has %d bytes, uncompressed %d", compressedInfo.Size(), plainInfo.Size())
+	}
+
+	// Force blocks to be evicted and decompressed again.
+	SetBlockCacheSize(2 * compressBlockSize)
+	defer SetBlockCacheSize(64 << 20)
+
+	plain, cix := Open(out), Open(compressed)
+	if plain.Compressed() || !cix.Compressed() {
+		t.Fatalf("Compressed() = %v and %v, want false and true", plain.Compressed(), cix.Compressed())
+	}
+	if n := cix.blocks[regionNames].n; n < 2 {
+		t.Errorf("name list has %d blocks, want more than one", n)
+	}
+	if problems := cix.Verify(); len(problems) > 0 {
+		t.Errorf("Verify() = %v", problems)
+	}
+	if got, want := cix.NumFiles(), len(names); got != want {
+		t.Fatalf("NumFiles() = %d, want %d", got, want)
+	}
+	for i := cix.NumFiles() - 1; i >= 0; i-- {
+		if got, want := cix.Name(uint32(i)), plain.Name(uint32(i)); got != want {
+			t.Errorf("Name(%d) = %q, want %q", i, got, want)
+		}
+	}
+	var got, want []string
+	for it := cix.Files(); it.Next(); {
+		got = append(got, it.Name())
+	}
+	for it := plain.Files(); it.Next(); {
+		want = append(want, it.Name())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Files() returned %d names, want %d", len(got), len(want))
+	}
+	for it := plain.Trigrams(); it.Next(); {
+		if got, want := cix.PostingList(it.Trigram()), plain.PostingList(it.Trigram()); !equalList(got, want) {
+			t.Errorf("trigram %#06x: PostingList() = %v, want %v", it.Trigram(), got, want)
+		}
+	}
+	if got, want := cix.LineOffsets(1), plain.LineOffsets(1); !reflect.DeepEqual(got, want) {
+		t.Errorf("LineOffsets(1) = %v, want %v", got, want)
+	}
+	plain.Close()
+	cix.Close()
+
+	// Indexes are combined uncompressed.
+	fromPlain := filepath.Join(dir, "from-plain.idx")
+	ConcatN(fromPlain, out)
+	fromCompressed := filepath.Join(dir, "from-compressed.idx")
+	ConcatN(fromCompressed, compressed)
+	plainData, err := ioutil.ReadFile(fromPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedData, err := ioutil.ReadFile(fromCompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(compressedData, plainData) {
+		t.Errorf("ConcatN of the compressed index differs from ConcatN of the uncompressed index")
+	}
+}
+
+func TestCompressCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-compress-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "plain.idx")
+	buildIndex(out, nil, postFiles)
+	compressed := filepath.Join(dir, "compressed.idx")
+	Compress(compressed, out)
+
+	data, err := ioutil.ReadFile(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix := Open(compressed)
+	off := ix.postData + 4
+	ix.Close()
+	data[off] ^= 0xff
+	if err := ioutil.WriteFile(compressed, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ix = Open(compressed)
+	defer ix.Close()
+	problems := ix.Verify()
+	var found bool
+	for _, p := range problems {
+		if strings.Contains(p.Description, "cannot be decompressed") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Verify() = %v, want a block which cannot be decompressed", problems)
+	}
+}
@@ -5,7 +5,10 @@ import (
 	// TODO: use container/vector as base for concatHeap
 	// TODO: or maybe we can use an in-place heap? in pprof top10, one can see memmove and garbage collection from push/pull to be major factors
 	//"container/vector"
+	"log"
 	"os"
+	"sort"
+	"strings"
 )
 
 type concatHeap []postMapReader
@@ -42,16 +45,57 @@ func (h *concatHeap) Push(v interface{}) {
 //	return h.At(i).(postMapReader).trigram < h.At(j).(postMapReader).trigram
 //}
 
+// ConcatN writes an index containing all files of sources, in that order, to
+// dst.
 func ConcatN(dst string, sources ...string) {
+	concatN(dst, nil, sources)
+}
+
+// ConcatNExcluding is like ConcatN, but drops all files whose names start
+// with any of excluded (e.g. "i3-wm_4.7.2-1/"), so that removed or replaced
+// packages can be left out without rebuilding the source indexes.
+func ConcatNExcluding(dst string, excluded []string, sources ...string) {
+	sorted := make([]string, len(excluded))
+	copy(sorted, excluded)
+	sort.Strings(sorted)
+	perSource := make([][]string, len(sources))
+	for i := range perSource {
+		perSource[i] = sorted
+	}
+	concatN(dst, perSource, sources)
+}
+
+// hasPrefixIn returns true if name starts with any of the sorted prefixes,
+// which must not be prefixes of each other (like package directories).
+func hasPrefixIn(prefixes []string, name string) bool {
+	// The only prefix name can start with is the largest one which is not
+	// larger than name.
+	idx := sort.SearchStrings(prefixes, name)
+	if idx < len(prefixes) && prefixes[idx] == name {
+		return true
+	}
+	return idx > 0 && strings.HasPrefix(name, prefixes[idx-1])
+}
+
+// concatN concatenates sources into dst, leaving out the files of sources[i]
+// whose names start with any of the sorted prefixes excluded[i].
+func concatN(dst string, excluded [][]string, sources []string) {
 	//offsets := make([]uint32, len(sources))
 	ixes := make([]*Index, len(sources))
 	readers := make([]postMapReader, len(sources))
+	idmaps := make([][]idrange, len(sources))
+	var numFiles uint64
 	for i, source := range sources {
 		ixes[i] = Open(source)
+		numFiles += uint64(ixes[i].numName)
+	}
+	// File IDs are stored as uint32 in the posting lists.
+	if numFiles > 1<<32-1 {
+		log.Fatalf("%s: %d files exceed the maximum of %d files per index", dst, numFiles, uint32(1<<32-1))
 	}
 
 	out := bufCreate(dst)
-	out.writeString(magic)
+	out.writeString(magicV3)
 
 	// Merged list of paths.
 	pathData := out.offset()
@@ -62,22 +106,41 @@ func ConcatN(dst string, sources ...string) {
 	nameIndexFile := bufCreate("")
 	var offset uint32
 	for i, _ := range sources {
-		readers[i].init(ixes[i], []idrange{{
-			lo:  0,
-			hi:  uint32(ixes[i].numName),
-			new: offset}})
-		offset += uint32(ixes[i].numName)
-		// TODO: we can just memcpy the blocks of names, but we still need to
-		// fix up all the nameIndexFile numbers (i.e. write out.offset() + num
-		// instead of num). That could be faster than the following code, though:
-		for j := 0; j < ixes[i].numName; j++ {
-			nameIndexFile.writeUint32(out.offset() - nameData)
-			out.writeString(ixes[i].Name(uint32(j)))
-			out.writeString("\x00")
+		if excluded == nil || len(excluded[i]) == 0 {
+			idmaps[i] = []idrange{{
+				lo:  0,
+				hi:  uint32(ixes[i].numName),
+				new: offset}}
+			offset += uint32(ixes[i].numName)
+			// TODO: we can just memcpy the blocks of names, but we still need to
+			// fix up all the nameIndexFile numbers (i.e. write out.offset() + num
+			// instead of num). That could be faster than the following code, though:
+			for j := 0; j < ixes[i].numName; j++ {
+				nameIndexFile.writeUint64(out.offset() - nameData)
+				out.writeString(ixes[i].Name(uint32(j)))
+				out.writeString("\x00")
+			}
+		} else {
+			for j := 0; j < ixes[i].numName; j++ {
+				name := ixes[i].Name(uint32(j))
+				if hasPrefixIn(excluded[i], name) {
+					continue
+				}
+				if n := len(idmaps[i]); n > 0 && idmaps[i][n-1].hi == uint32(j) {
+					idmaps[i][n-1].hi++
+				} else {
+					idmaps[i] = append(idmaps[i], idrange{lo: uint32(j), hi: uint32(j + 1), new: offset})
+				}
+				offset++
+				nameIndexFile.writeUint64(out.offset() - nameData)
+				out.writeString(name)
+				out.writeString("\x00")
+			}
 		}
+		readers[i].init(ixes[i], idmaps[i])
 	}
 
-	nameIndexFile.writeUint32(out.offset())
+	nameIndexFile.writeUint64(out.offset())
 
 	// Merged list of posting lists.
 	postData := out.offset()
@@ -85,12 +148,22 @@ func ConcatN(dst string, sources ...string) {
 
 	w.init(out)
 
+	postmaps, dups := dedupSources(ixes, idmaps)
+	for i, postmap := range postmaps {
+		readers[i].postmap = postmap
+	}
+
 	h := new(concatHeap)
 	lastTrigram := ^uint32(0)
+	var ids []uint32
 	for i, _ := range sources {
-		heap.Push(h, readers[i])
+		// Sources whose files are all excluded do not contribute any
+		// postings.
+		if len(idmaps[i]) > 0 {
+			heap.Push(h, readers[i])
+		}
 	}
-	for {
+	for h.Len() > 0 {
 		reader := heap.Pop(h).(postMapReader)
 		nextTrigram := reader.trigram
 
@@ -105,12 +178,40 @@ func ConcatN(dst string, sources ...string) {
 			w.trigram(nextTrigram)
 		}
 
-		reader.writePostingList(&w)
+		if reader.identity() {
+			reader.writePostingList(&w)
+		} else if reader.postmap != nil {
+			ids = ids[:0]
+			for reader.nextId() {
+				ids = append(ids, reader.fileid)
+			}
+			sort.Sort(fileIDs(ids))
+			for _, id := range ids {
+				w.fileid(id)
+			}
+		} else {
+			for reader.nextId() {
+				w.fileid(reader.fileid)
+			}
+		}
 		reader.nextTrigram()
 		heap.Push(h, reader)
 
 		lastTrigram = nextTrigram
 	}
+	// Sources written by ConcatN do not end with the empty list for trigram
+	// 0xffffff, so the last list still needs to be finished.
+	if lastTrigram != ^uint32(0) {
+		w.endTrigram()
+	}
+
+	t := trailer{features: commonFeatures(ixes...)}
+	concatFileData(out, &t, SectionLineOffsets, ixes, idmaps)
+	concatFileData(out, &t, SectionBloom, ixes, idmaps)
+	concatMeta(out, &t, ixes, idmaps)
+	concatLongLines(out, &t, ixes, idmaps)
+	concatContentHashes(out, &t, ixes, idmaps)
+	writeDuplicates(out, &t, dups)
 
 	// Name index
 	nameIndex := out.offset()
@@ -120,12 +221,8 @@ func ConcatN(dst string, sources ...string) {
 	postIndex := out.offset()
 	copyFile(out, w.postIndexFile)
 
-	out.writeUint32(pathData)
-	out.writeUint32(nameData)
-	out.writeUint32(postData)
-	out.writeUint32(nameIndex)
-	out.writeUint32(postIndex)
-	out.writeString(trailerMagic)
+	t.off = [5]uint64{pathData, nameData, postData, nameIndex, postIndex}
+	t.write(out)
 	out.flush()
 
 	os.Remove(nameIndexFile.name)
@@ -7,6 +7,8 @@ package index
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -118,3 +120,62 @@ func TestConcatN(t *testing.T) {
 	check(ix4, "ZZZ", 10)
 	check(ix4, "aaa", 11)
 }
+
+func TestConcatNExcluding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-concatn-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.idx")
+	buildIndex(first, nil, map[string]string{
+		"a_1/x": "hello world",
+		"b_1/x": "hello zzz",
+		"b_1/y": "world",
+	})
+	second := filepath.Join(dir, "second.idx")
+	buildIndex(second, nil, map[string]string{
+		"b_2/x": "hello zzz",
+		"c_1/x": "world zzz",
+	})
+	third := filepath.Join(dir, "third.idx")
+	buildIndex(third, nil, map[string]string{
+		"b_1/z": "zzz",
+	})
+
+	out := filepath.Join(dir, "out.idx")
+	ConcatNExcluding(out, []string{"b_1/"}, first, second, third)
+	// Concatenating the result again must not lose the last posting list,
+	// even though ConcatN does not write an end marker.
+	again := filepath.Join(dir, "again.idx")
+	ConcatN(again, out)
+
+	for _, path := range []string{out, again} {
+		ix := Open(path)
+		var names []string
+		for i := 0; i < ix.numName; i++ {
+			names = append(names, ix.Name(uint32(i)))
+		}
+		if want := []string{"a_1/x", "b_2/x", "c_1/x"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: names = %v, want %v", path, names, want)
+		}
+		for _, test := range []struct {
+			trigram string
+			want    []uint32
+		}{
+			{"hel", []uint32{0, 1}},
+			{"wor", []uint32{0, 2}},
+			{"zzz", []uint32{1, 2}},
+		} {
+			l := ix.PostingList(tri(test.trigram[0], test.trigram[1], test.trigram[2]))
+			if !equalList(l, test.want) {
+				t.Errorf("%s: PostingList(%s) = %v, want %v", path, test.trigram, l, test.want)
+			}
+		}
+		if problems := ix.Verify(); len(problems) > 0 {
+			t.Errorf("%s: Verify() = %v", path, problems)
+		}
+		ix.Close()
+	}
+}
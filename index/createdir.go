@@ -0,0 +1,215 @@
+package index
+
+// Building an index from a directory tree.
+//
+// Rebuilding a shard used to mean indexing every package on its own and
+// concatenating the package indexes with ConcatN. CreateFromDir does the same
+// in one step: it splits the sorted list of files into contiguous chunks of
+// similar size, indexes the chunks concurrently into temporary indexes next
+// to the destination and concatenates those. Since the chunks are contiguous,
+// the result is the same as indexing all files with a single IndexWriter.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// CreateOptions configures CreateFromDir.
+type CreateOptions struct {
+	// Number of chunks which are indexed concurrently. 0 means
+	// runtime.NumCPU().
+	Workers int
+
+	// See the fields of IndexWriter with the same names. MaxMemory applies to
+	// each worker.
+	FoldCase    bool
+	Normalize   bool
+	LineOffsets bool
+	Bloom       bool
+	MaxMemory   int64
+	LogSkip     bool
+	LongLines   LongLinePolicy
+	MaxLineLen  int
+	Dedup       bool
+
+	// Skip, if non-nil, is called for every file and directory below the
+	// root. name is the path relative to the root, using slashes. Returning
+	// true leaves out the file, or everything below the directory.
+	Skip func(name string, info os.FileInfo) bool
+
+	// Meta, if non-nil, returns the metadata to record for the file at path,
+	// see AddFileMeta. Returning false leaves out the file. It is called
+	// concurrently by the workers.
+	Meta func(path, name string) (FileMeta, bool)
+}
+
+// chunksPerWorker is the number of chunks per worker, so that a worker which
+// got a chunk of quickly indexed files picks up another one.
+const chunksPerWorker = 4
+
+type dirFile struct {
+	name string
+	size int64
+}
+
+// listFiles returns the regular files below root, sorted by name.
+func listFiles(root string, skip func(string, os.FileInfo) bool) ([]dirFile, error) {
+	var files []dirFile
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if skip != nil && skip(name, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, dirFile{name, info.Size()})
+		}
+		return nil
+	})
+	// Walk visits "a/b" before "a.c", but names in an index are sorted.
+	sort.Sort(dirFilesByName(files))
+	return files, err
+}
+
+type dirFilesByName []dirFile
+
+func (f dirFilesByName) Len() int           { return len(f) }
+func (f dirFilesByName) Less(i, j int) bool { return f[i].name < f[j].name }
+func (f dirFilesByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// splitFiles splits files into at most n contiguous chunks of similar total
+// size.
+func splitFiles(files []dirFile, n int) [][]dirFile {
+	var total int64
+	for _, f := range files {
+		total += f.size + 1
+	}
+	var chunks [][]dirFile
+	var size int64
+	start := 0
+	for i, f := range files {
+		size += f.size + 1
+		if size*int64(n) >= total*int64(len(chunks)+1) || i == len(files)-1 {
+			chunks = append(chunks, files[start:i+1])
+			start = i + 1
+		}
+	}
+	return chunks
+}
+
+// indexChunk writes the index of files to dst and returns the number of
+// files it contains.
+func indexChunk(dst, root string, files []dirFile, opts CreateOptions) int {
+	ix := Create(dst)
+	ix.FoldCase = opts.FoldCase
+	ix.Normalize = opts.Normalize
+	ix.LineOffsets = opts.LineOffsets
+	ix.Bloom = opts.Bloom
+	ix.MaxMemory = opts.MaxMemory
+	ix.LogSkip = opts.LogSkip
+	ix.LongLines = opts.LongLines
+	ix.MaxLineLen = opts.MaxLineLen
+	ix.Dedup = opts.Dedup
+	added := 0
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.name))
+		var err error
+		if opts.Meta == nil {
+			err = ix.AddFile(path, f.name)
+		} else if meta, ok := opts.Meta(path, f.name); ok {
+			err = ix.AddFileMeta(path, f.name, meta)
+		} else {
+			continue
+		}
+		if err == nil {
+			added++
+		}
+	}
+	ix.Flush()
+	return added
+}
+
+// CreateFromDir writes an index of all regular files below root to dst. The
+// files are indexed under their path relative to root, e.g. a tree of
+// unpacked packages results in names like "i3-wm_4.7.2-1/src/main.c".
+// Symbolic links are not followed. Files which IndexWriter skips (e.g.
+// because they do not look like text) are left out.
+func CreateFromDir(dst, root string, opts CreateOptions) error {
+	files, err := listFiles(root, opts.Skip)
+	if err != nil {
+		return err
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	chunks := splitFiles(files, workers*chunksPerWorker)
+	if len(chunks) <= 1 {
+		var files []dirFile
+		if len(chunks) == 1 {
+			files = chunks[0]
+		}
+		indexChunk(dst, root, files, opts)
+		return nil
+	}
+
+	// The temporary indexes do not end in .idx, so that merges ignore them.
+	parts := make([]string, len(chunks))
+	for i := range parts {
+		parts[i] = fmt.Sprintf("%s.part%d", dst, i)
+	}
+	defer func() {
+		for _, part := range parts {
+			os.Remove(part)
+		}
+	}()
+
+	added := make([]int, len(chunks))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				added[i] = indexChunk(parts[i], root, chunks[i], opts)
+			}
+		}()
+	}
+	for i := range chunks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	// Chunks without any files lack the optional sections, which would make
+	// ConcatN leave them out entirely.
+	var sources []string
+	for i, part := range parts {
+		if added[i] > 0 {
+			sources = append(sources, part)
+		}
+	}
+	if len(sources) == 0 {
+		Create(dst).Flush()
+		return nil
+	}
+	ConcatN(dst, sources...)
+	return nil
+}
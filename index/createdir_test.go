@@ -0,0 +1,103 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-createdir-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "unpacked")
+	files := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		// "pkg.c" sorts before "pkg/…", although Walk visits it later.
+		files[fmt.Sprintf("pkg%d/src/main.c", i)] = fmt.Sprintf("int main() { return %d; }\n", i)
+		files[fmt.Sprintf("pkg%d.c", i)] = strings.Repeat(fmt.Sprintf("line %d\n", i), i)
+		files[fmt.Sprintf("pkg%d/.git/HEAD", i)] = "ref: refs/heads/master\n"
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(dir, "parallel.idx")
+	opts := CreateOptions{
+		Workers:     3,
+		LineOffsets: true,
+		Skip: func(name string, info os.FileInfo) bool {
+			return info.IsDir() && info.Name() == ".git"
+		},
+	}
+	if err := CreateFromDir(out, root, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same files indexed by a single IndexWriter.
+	single := filepath.Join(dir, "single.idx")
+	buildIndex(single, nil, files)
+	ix := Open(single)
+	var want []string
+	for it := ix.Files(); it.Next(); {
+		if !strings.Contains(it.Name(), ".git") {
+			want = append(want, it.Name())
+		}
+	}
+	ix.Close()
+
+	ix = Open(out)
+	defer ix.Close()
+	var got []string
+	for it := ix.Files(); it.Next(); {
+		got = append(got, it.Name())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files() = %v, want %v", got, want)
+	}
+	if !ix.HasLineOffsets() {
+		t.Errorf("HasLineOffsets() = false, want true")
+	}
+	if problems := ix.Verify(); len(problems) > 0 {
+		t.Errorf("Verify() = %v", problems)
+	}
+
+	// Concatenating the chunks results in the same index as concatenating
+	// an index of all files at once.
+	sequential := filepath.Join(dir, "sequential.idx")
+	opts.Workers = 1
+	if err := CreateFromDir(sequential, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	concat := filepath.Join(dir, "concat.idx")
+	ConcatN(concat, sequential)
+	a, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(concat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("index built by 3 workers differs from the index built by 1 worker")
+	}
+
+	if leftover, _ := filepath.Glob(out + ".part*"); len(leftover) > 0 {
+		t.Errorf("temporary indexes were not removed: %v", leftover)
+	}
+}
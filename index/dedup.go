@@ -0,0 +1,293 @@
+package index
+
+// Deduplication of identical files.
+//
+// Many packages ship identical files, e.g. the same m4 macros or bundled
+// copies of a library. An IndexWriter with Dedup set records a hash of the
+// contents of every file and only writes the posting entries of the first
+// file with any given contents. Later files with the same contents (their
+// duplicates) are still part of the index, with names, metadata, line offsets
+// and so on, but posting queries find them through the duplicates section
+// instead of their own posting entries. The hashes are stored in the
+// SectionContentHashes section:
+//
+//	hash [16]
+//	...
+//
+// with one hash (the first 16 bytes of the SHA-256 of the contents) per file
+// in file ID order. The SectionDuplicates section lists the duplicates:
+//
+//	number of duplicates [4]
+//	original [4], duplicate [4]
+//	...
+//
+// sorted by original and duplicate. The original always has a smaller file ID
+// than its duplicates.
+//
+// ConcatN deduplicates files across its sources, as long as they record
+// content hashes, so that a shard which is merged from package indexes
+// contains each file only once, no matter how many packages ship it. Files
+// whose original is left out (see ConcatNExcluding) take over its posting
+// entries.
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// SectionContentHashes holds the content hashes of all files.
+const SectionContentHashes SectionID = 7
+
+// SectionDuplicates maps files to their duplicates.
+const SectionDuplicates SectionID = 8
+
+const contentHashSize = 16
+
+type contentHash [contentHashSize]byte
+
+// A duplicate records that the file with ID dup has the same contents as the
+// file with ID orig.
+type duplicate struct {
+	orig, dup uint32
+}
+
+type duplicatesByOrig []duplicate
+
+func (d duplicatesByOrig) Len() int { return len(d) }
+func (d duplicatesByOrig) Less(i, j int) bool {
+	return d[i].orig < d[j].orig || d[i].orig == d[j].orig && d[i].dup < d[j].dup
+}
+func (d duplicatesByOrig) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+type fileIDs []uint32
+
+func (f fileIDs) Len() int           { return len(f) }
+func (f fileIDs) Less(i, j int) bool { return f[i] < f[j] }
+func (f fileIDs) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// duplicate records the content hash sum of the file which was just added
+// and returns true if an earlier file has the same contents, in which case
+// the file must not get any posting entries.
+func (ix *IndexWriter) duplicate(fileid uint32, sum []byte) bool {
+	var h contentHash
+	copy(h[:], sum)
+	ix.hashes = append(ix.hashes, h[:]...)
+	if ix.hashOwner == nil {
+		ix.hashOwner = make(map[contentHash]uint32)
+	}
+	if orig, ok := ix.hashOwner[h]; ok {
+		ix.dups = append(ix.dups, duplicate{orig, fileid})
+		return true
+	}
+	ix.hashOwner[h] = fileid
+	return false
+}
+
+// writeDedup writes the content hashes and the duplicates if Dedup is set.
+func (ix *IndexWriter) writeDedup(t *trailer) {
+	if !ix.Dedup {
+		return
+	}
+	t.beginSection(ix.main, SectionContentHashes)
+	ix.main.write(ix.hashes)
+	t.endSection(ix.main)
+	writeDuplicates(ix.main, t, ix.dups)
+}
+
+// writeDuplicates sorts dups and writes them as the duplicates section,
+// unless there are none.
+func writeDuplicates(out *bufWriter, t *trailer, dups []duplicate) {
+	if len(dups) == 0 {
+		return
+	}
+	sort.Sort(duplicatesByOrig(dups))
+	t.beginSection(out, SectionDuplicates)
+	out.writeUint32(uint32(len(dups)))
+	for _, d := range dups {
+		out.writeUint32(d.orig)
+		out.writeUint32(d.dup)
+	}
+	t.endSection(out)
+}
+
+// contentHashes returns the content hashes section, or nil.
+func (ix *Index) contentHashes() []byte {
+	s := ix.Section(SectionContentHashes)
+	if s != nil && len(s) != ix.numName*contentHashSize {
+		corrupt(ix.File)
+	}
+	return s
+}
+
+// ContentHash returns the content hash of the given file (the first 16 bytes
+// of the SHA-256 of its contents), or nil if the index was written without
+// Dedup.
+func (ix *Index) ContentHash(fileid uint32) []byte {
+	hashes := ix.contentHashes()
+	if hashes == nil {
+		return nil
+	}
+	if int(fileid) >= ix.numName {
+		corrupt(ix.File)
+	}
+	return hashes[int(fileid)*contentHashSize : (int(fileid)+1)*contentHashSize]
+}
+
+// duplicates returns the records of the duplicates section.
+func (ix *Index) duplicates() []byte {
+	s := ix.Section(SectionDuplicates)
+	if s == nil {
+		return nil
+	}
+	if len(s) < 4 || uint64(len(s)) != 4+8*uint64(binary.BigEndian.Uint32(s)) {
+		corrupt(ix.File)
+	}
+	return s[4:]
+}
+
+// HasDuplicates returns true if some files of the index are duplicates of
+// other files.
+func (ix *Index) HasDuplicates() bool {
+	return ix.Section(SectionDuplicates) != nil
+}
+
+// Duplicates returns the files which have the same contents as the given
+// file and were therefore not indexed on their own, see dedup.go.
+func (ix *Index) Duplicates(fileid uint32) []uint32 {
+	d := ix.duplicates()
+	n := len(d) / 8
+	i := sort.Search(n, func(i int) bool { return binary.BigEndian.Uint32(d[8*i:]) >= fileid })
+	var dups []uint32
+	for ; i < n && binary.BigEndian.Uint32(d[8*i:]) == fileid; i++ {
+		dups = append(dups, binary.BigEndian.Uint32(d[8*i+4:]))
+	}
+	return dups
+}
+
+// Original returns the file whose posting entries stand in for the contents
+// of the given file, which is the file itself unless it is a duplicate.
+func (ix *Index) Original(fileid uint32) uint32 {
+	ix.dupOnce.Do(func() {
+		d := ix.duplicates()
+		if d == nil {
+			return
+		}
+		ix.originals = make(map[uint32]uint32, len(d)/8)
+		for ; len(d) > 0; d = d[8:] {
+			ix.originals[binary.BigEndian.Uint32(d[4:])] = binary.BigEndian.Uint32(d)
+		}
+	})
+	if orig, ok := ix.originals[fileid]; ok {
+		return orig
+	}
+	return fileid
+}
+
+// withDuplicates adds the duplicates of the files in list.
+func (ix *Index) withDuplicates(list []uint32) []uint32 {
+	if !ix.HasDuplicates() {
+		return list
+	}
+	var dups []uint32
+	for _, fileid := range list {
+		dups = append(dups, ix.Duplicates(fileid)...)
+	}
+	if len(dups) == 0 {
+		return list
+	}
+	sort.Sort(fileIDs(dups))
+	return PostingOr(list, dups)
+}
+
+// dedupSources determines which files of ixes (restricted to idmaps, see
+// concatN) are duplicates in the concatenated index. It returns the
+// duplicates and, for each source whose posting entries cannot simply be
+// renumbered with idmaps, a map from old to new file IDs, with ^uint32(0)
+// for files whose posting entries are dropped.
+func dedupSources(ixes []*Index, idmaps [][]idrange) ([][]uint32, []duplicate) {
+	var dedup bool
+	for _, ix := range ixes {
+		if ix.contentHashes() != nil || ix.HasDuplicates() {
+			dedup = true
+		}
+	}
+	if !dedup {
+		return nil, nil
+	}
+	var dups []duplicate
+	postmaps := make([][]uint32, len(ixes))
+	// The new ID of the first file with the given contents.
+	seen := make(map[contentHash]uint32)
+	for i, ix := range ixes {
+		hashes := ix.contentHashes()
+		orig := make(map[uint32]uint32)
+		for d := ix.duplicates(); len(d) > 0; d = d[8:] {
+			orig[binary.BigEndian.Uint32(d[4:])] = binary.BigEndian.Uint32(d)
+		}
+		if hashes == nil && len(orig) == 0 {
+			continue
+		}
+		postmap := make([]uint32, ix.numName)
+		for j := range postmap {
+			postmap[j] = ^uint32(0)
+		}
+		changed := false
+		// The new ID which the contents of an original of this source
+		// ended up with.
+		owner := make(map[uint32]uint32)
+		for _, r := range idmaps[i] {
+			for j := r.lo; j < r.hi; j++ {
+				newid := r.new + j - r.lo
+				o, ok := orig[j]
+				if !ok {
+					o = j
+				}
+				if k, ok := owner[o]; ok {
+					dups = append(dups, duplicate{k, newid})
+					continue
+				}
+				var h contentHash
+				if hashes != nil {
+					copy(h[:], hashes[int(j)*contentHashSize:])
+					if k, ok := seen[h]; ok {
+						// Already indexed by an earlier source.
+						owner[o] = k
+						dups = append(dups, duplicate{k, newid})
+						changed = true
+						continue
+					}
+					seen[h] = newid
+				}
+				owner[o] = newid
+				postmap[o] = newid
+				if o != j {
+					// The original was left out, so this file takes over
+					// its posting entries.
+					changed = true
+				}
+			}
+		}
+		if changed {
+			postmaps[i] = postmap
+		}
+	}
+	return postmaps, dups
+}
+
+// concatContentHashes writes the content hashes of the files of ixes which
+// are covered by idmaps to out if all of ixes have content hashes.
+func concatContentHashes(out *bufWriter, t *trailer, ixes []*Index, idmaps [][]idrange) {
+	for _, ix := range ixes {
+		if ix.contentHashes() == nil {
+			return
+		}
+	}
+	t.beginSection(out, SectionContentHashes)
+	for i, ix := range ixes {
+		hashes := ix.contentHashes()
+		for _, r := range idmaps[i] {
+			out.write(hashes[int(r.lo)*contentHashSize : int(r.hi)*contentHashSize])
+		}
+	}
+	t.endSection(out)
+}
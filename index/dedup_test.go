@@ -0,0 +1,206 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// buildDedupIndex writes an index of files (name, contents, name, contents,
+// ...) with Dedup set and returns its path.
+func buildDedupIndex(t *testing.T, dir, name string, files ...string) string {
+	path := filepath.Join(dir, name)
+	ix := Create(path)
+	ix.Dedup = true
+	for i := 0; i < len(files); i += 2 {
+		if err := ix.Add(files[i], strings.NewReader(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix.Flush()
+	return path
+}
+
+// queryNames returns the names of the files containing all of trigrams.
+func queryNames(ix *Index, trigrams ...string) []string {
+	var names []string
+	for _, fileid := range ix.PostingQuery(&Query{Op: QAnd, Trigram: trigrams}) {
+		names = append(names, ix.Name(fileid))
+	}
+	return names
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const (
+		macro = "AC_DEFUN([AX_CHECK], [check])\n"
+		other = "int main() {}\n"
+	)
+	path := buildDedupIndex(t, dir, "single.idx",
+		"a/ax_check.m4", macro,
+		"a/main.c", other,
+		"b/ax_check.m4", macro,
+		"c/m4/ax_check.m4", macro)
+	ix := Open(path)
+	if got, want := ix.PostingList(tri('D', 'E', 'F')), []uint32{0}; !equalList(got, want) {
+		t.Errorf("PostingList() = %v, want %v", got, want)
+	}
+	if got, want := queryNames(ix, "DEF"), []string{"a/ax_check.m4", "b/ax_check.m4", "c/m4/ax_check.m4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PostingQuery() = %v, want %v", got, want)
+	}
+	if got, want := ix.Duplicates(0), []uint32{2, 3}; !equalList(got, want) {
+		t.Errorf("Duplicates(0) = %v, want %v", got, want)
+	}
+	if got := ix.Duplicates(1); len(got) != 0 {
+		t.Errorf("Duplicates(1) = %v, want none", got)
+	}
+	for fileid, want := range []uint32{0, 1, 0, 0} {
+		if got := ix.Original(uint32(fileid)); got != want {
+			t.Errorf("Original(%d) = %d, want %d", fileid, got, want)
+		}
+	}
+	ix.Close()
+
+	// Identical files in different sources are only indexed once.
+	first := buildDedupIndex(t, dir, "first.idx",
+		"a/ax_check.m4", macro,
+		"a/main.c", other)
+	second := buildDedupIndex(t, dir, "second.idx",
+		"b/ax_check.m4", macro,
+		"b/m4/ax_check.m4", macro,
+		"b/util.c", "void util() {}\n")
+	all := filepath.Join(dir, "all.idx")
+	ConcatN(all, first, second)
+	ix = Open(all)
+	if got, want := ix.PostingList(tri('D', 'E', 'F')), []uint32{0}; !equalList(got, want) {
+		t.Errorf("concatenated: PostingList() = %v, want %v", got, want)
+	}
+	if got, want := queryNames(ix, "DEF"), []string{"a/ax_check.m4", "b/ax_check.m4", "b/m4/ax_check.m4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("concatenated: PostingQuery() = %v, want %v", got, want)
+	}
+	if got, want := queryNames(ix, "uti"), []string{"b/util.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("concatenated: PostingQuery() = %v, want %v", got, want)
+	}
+	ix.Close()
+
+	// When the original is left out, the first remaining duplicate takes
+	// over its posting entries, no matter whether the original was in the
+	// same source or not.
+	for _, excluded := range [][]string{{"a/"}, {"a/", "b/ax_check.m4"}} {
+		dst := filepath.Join(dir, "excluded.idx")
+		ConcatNExcluding(dst, excluded, all)
+		ix = Open(dst)
+		got := queryNames(ix, "DEF")
+		want := []string{"b/m4/ax_check.m4"}
+		if len(excluded) == 1 {
+			want = []string{"b/ax_check.m4", "b/m4/ax_check.m4"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("excluding %v: PostingQuery() = %v, want %v", excluded, got, want)
+		}
+		if got := ix.PostingList(tri('D', 'E', 'F')); len(got) != 1 || ix.Name(got[0]) != want[0] {
+			t.Errorf("excluding %v: PostingList() = %v, want the ID of %s", excluded, got, want[0])
+		}
+		ix.Close()
+	}
+}
+
+func TestDedupMatchesPlain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []string{"hello world\n", "hello there\n", "goodbye world\n"}
+	var sources, plainSources []string
+	for pkg := 0; pkg < 4; pkg++ {
+		var files []string
+		plain := make(map[string]string)
+		for i := 0; i < 5; i++ {
+			name := string('a'+rune(pkg)) + "/" + string('0'+rune(i))
+			files = append(files, name, contents[(pkg+i)%len(contents)])
+			plain[name] = contents[(pkg+i)%len(contents)]
+		}
+		sources = append(sources, buildDedupIndex(t, dir, string('a'+rune(pkg))+".idx", files...))
+		plainPath := filepath.Join(dir, string('a'+rune(pkg))+".plain.idx")
+		buildIndex(plainPath, nil, plain)
+		plainSources = append(plainSources, plainPath)
+	}
+	dedup := filepath.Join(dir, "dedup.idx")
+	ConcatNExcluding(dedup, []string{"b/"}, sources...)
+	plain := filepath.Join(dir, "plain.idx")
+	ConcatNExcluding(plain, []string{"b/"}, plainSources...)
+
+	dix, pix := Open(dedup), Open(plain)
+	defer dix.Close()
+	defer pix.Close()
+	for _, trigram := range []string{"hel", "wor", "the", "goo", "ld\n"} {
+		got, want := queryNames(dix, trigram), queryNames(pix, trigram)
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: PostingQuery() = %v, want %v", trigram, got, want)
+		}
+	}
+
+	// Each of the contents is indexed once.
+	unique := make(map[string]string)
+	for i, c := range contents {
+		unique[string('0'+rune(i))] = c
+	}
+	uniquePath := filepath.Join(dir, "unique.idx")
+	buildIndex(uniquePath, nil, unique)
+	uix := Open(uniquePath)
+	defer uix.Close()
+	if got, want := postingEntries(dix), postingEntries(uix); got != want {
+		t.Errorf("deduplicated index has %d posting entries, want %d", got, want)
+	}
+}
+
+func postingEntries(ix *Index) int {
+	var entries int
+	for it := ix.Trigrams(); it.Next(); {
+		entries += len(ix.PostingList(it.Trigram()))
+	}
+	return entries
+}
+
+func TestContentHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-dedup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := buildDedupIndex(t, dir, "hashes.idx",
+		"a/main.c", "int main() {}\n",
+		"b/util.c", "void util() {}\n")
+	ix := Open(path)
+	defer ix.Close()
+	for fileid, contents := range []string{"int main() {}\n", "void util() {}\n"} {
+		sum := sha256.Sum256([]byte(contents))
+		if got := ix.ContentHash(uint32(fileid)); !bytes.Equal(got, sum[:contentHashSize]) {
+			t.Errorf("ContentHash(%d) = %x, want %x", fileid, got, sum[:contentHashSize])
+		}
+	}
+
+	plain := filepath.Join(dir, "plain.idx")
+	buildIndex(plain, nil, map[string]string{"a/main.c": "int main() {}\n"})
+	pix := Open(plain)
+	defer pix.Close()
+	if got := pix.ContentHash(0); got != nil {
+		t.Errorf("ContentHash(0) = %x without Dedup, want nil", got)
+	}
+}
@@ -0,0 +1,286 @@
+package index
+
+// Encryption at rest.
+//
+// Encrypt wraps an index into an envelope which is encrypted with
+// AES-256-GCM, for indexes of code which must not be readable by everyone
+// with access to the storage they are kept on:
+//
+//	"csearch crypt 1\n"
+//	key ID, NUL-terminated
+//	nonce [12]
+//	size of the index [8]
+//	chunks
+//
+// The index is split into chunks of encryptChunkSize bytes (the last one may
+// be shorter), which are sealed one by one. Each chunk uses the nonce with
+// the chunk number XORed into its last 8 bytes and has the envelope header,
+// i.e. everything up to the first chunk, as additional data, so that
+// modifying the header or reordering, dropping or truncating chunks makes
+// decryption fail.
+//
+// Open decrypts the whole index into memory, so an encrypted index occupies
+// as much memory as its size instead of being mapped from the page cache.
+// Compressing it first (see Compress) keeps that down. The key ID is passed
+// to the KeySource (see SetKeySource) to get the key, which allows rotating
+// keys without re-encrypting all indexes at once.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	magicEncrypted   = "csearch crypt 1\n"
+	encryptKeySize   = 32
+	encryptNonceSize = 12
+	encryptChunkSize = 1 << 20
+)
+
+var (
+	ErrNoKey   = errors.New("index is encrypted, but no key is available")
+	ErrDecrypt = errors.New("index cannot be decrypted (wrong key or modified file)")
+)
+
+// A KeySource returns the AES-256 key with the given ID.
+type KeySource func(id string) ([]byte, error)
+
+var (
+	keySourceMu sync.Mutex
+	keySource   KeySource = mustParseKeySource("env:DCS_INDEX_KEY")
+)
+
+// SetKeySource sets the source of the keys for encrypting and decrypting
+// indexes. The default is "env:DCS_INDEX_KEY", see ParseKeySource.
+func SetKeySource(s KeySource) {
+	keySourceMu.Lock()
+	defer keySourceMu.Unlock()
+	keySource = s
+}
+
+func key(id string) ([]byte, error) {
+	keySourceMu.Lock()
+	s := keySource
+	keySourceMu.Unlock()
+	key, err := s(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != encryptKeySize {
+		return nil, fmt.Errorf("key %q has %d bytes, want %d", id, len(key), encryptKeySize)
+	}
+	return key, nil
+}
+
+// ParseKeySource returns the key source described by spec, which is one of:
+//
+//	env:NAME   the hex-encoded key is in the environment variable NAME
+//	file:PATH  the hex-encoded key is in the file PATH
+//	exec:PATH  PATH is run with the key ID as its only argument and prints
+//	           the hex-encoded key, e.g. after asking a key management
+//	           service for it
+//
+// The env and file sources ignore the key ID.
+func ParseKeySource(spec string) (KeySource, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid key source %q, want env:NAME, file:PATH or exec:PATH", spec)
+	}
+	kind, arg := spec[:i], spec[i+1:]
+	switch kind {
+	case "env":
+		return func(id string) ([]byte, error) {
+			value := os.Getenv(arg)
+			if value == "" {
+				return nil, ErrNoKey
+			}
+			return decodeKey(value)
+		}, nil
+	case "file":
+		return func(id string) ([]byte, error) {
+			value, err := ioutil.ReadFile(arg)
+			if err != nil {
+				return nil, err
+			}
+			return decodeKey(string(value))
+		}, nil
+	case "exec":
+		return func(id string) ([]byte, error) {
+			value, err := exec.Command(arg, id).Output()
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", arg, id, err)
+			}
+			return decodeKey(string(value))
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid key source %q, want env:NAME, file:PATH or exec:PATH", spec)
+}
+
+func mustParseKeySource(spec string) KeySource {
+	s, err := ParseKeySource(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func decodeKey(value string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimSpace(value))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk i.
+func chunkNonce(nonce []byte, i uint64) []byte {
+	n := make([]byte, encryptNonceSize)
+	copy(n, nonce)
+	binary.BigEndian.PutUint64(n[4:], binary.BigEndian.Uint64(n[4:])^i)
+	return n
+}
+
+// Encrypt writes the index in src, encrypted with the key keyID, to dst. If
+// src is encrypted already, it is re-encrypted with the given key.
+func Encrypt(dst, src, keyID string) error {
+	if keyID == "" || strings.Contains(keyID, "\x00") {
+		return fmt.Errorf("invalid key ID %q", keyID)
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if encrypted(data) {
+		if data, _, err = decryptIndex(data); err != nil {
+			return err
+		}
+	}
+	k, err := key(keyID)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(k)
+	if err != nil {
+		return err
+	}
+	var header bytes.Buffer
+	header.WriteString(magicEncrypted)
+	header.WriteString(keyID)
+	header.WriteByte(0)
+	nonce := make([]byte, encryptNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header.Write(nonce)
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+	header.Write(size[:])
+
+	out := bufCreate(dst)
+	out.write(header.Bytes())
+	sealed := make([]byte, 0, encryptChunkSize+gcm.Overhead())
+	for i := uint64(0); len(data) > 0; i++ {
+		n := len(data)
+		if n > encryptChunkSize {
+			n = encryptChunkSize
+		}
+		sealed = gcm.Seal(sealed[:0], chunkNonce(nonce, i), data[:n], header.Bytes())
+		out.write(sealed)
+		data = data[n:]
+	}
+	out.flush()
+	return out.file.Close()
+}
+
+// encrypted returns true if d starts like an encrypted index.
+func encrypted(d []byte) bool {
+	return len(d) >= len(magicEncrypted) && string(d[:len(magicEncrypted)]) == magicEncrypted
+}
+
+// decryptIndex decrypts the encrypted index in d and returns it and the ID
+// of its key.
+func decryptIndex(d []byte) ([]byte, string, error) {
+	rest := d[len(magicEncrypted):]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 || len(rest) < end+1+encryptNonceSize+8 {
+		return nil, "", ErrCorrupt
+	}
+	keyID := string(rest[:end])
+	rest = rest[end+1:]
+	nonce := rest[:encryptNonceSize]
+	size := binary.BigEndian.Uint64(rest[encryptNonceSize:])
+	header := d[:len(d)-len(rest)+encryptNonceSize+8]
+	rest = rest[encryptNonceSize+8:]
+
+	k, err := key(keyID)
+	if err != nil {
+		return nil, keyID, err
+	}
+	gcm, err := newGCM(k)
+	if err != nil {
+		return nil, keyID, err
+	}
+	chunks := (size + encryptChunkSize - 1) / encryptChunkSize
+	if uint64(len(rest)) != size+chunks*uint64(gcm.Overhead()) {
+		return nil, keyID, ErrCorrupt
+	}
+	plain := make([]byte, 0, size)
+	for i := uint64(0); len(rest) > 0; i++ {
+		n := encryptChunkSize + gcm.Overhead()
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if plain, err = gcm.Open(plain, chunkNonce(nonce, i), rest[:n], header); err != nil {
+			return nil, keyID, ErrDecrypt
+		}
+		rest = rest[n:]
+	}
+	return plain, keyID, nil
+}
+
+// readEncryptedHeader decrypts the encrypted index read from r to read its
+// header.
+func readEncryptedHeader(r io.Reader) (*Header, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	plain, keyID, err := decryptIndex(data)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseHeader(int64(len(plain)), plain, tail(plain))
+	if h != nil {
+		h.KeyID = keyID
+	}
+	return h, err
+}
+
+// tail returns the part of d which contains the trailer.
+func tail(d []byte) []byte {
+	if len(d) > maxTrailerSize {
+		return d[len(d)-maxTrailerSize:]
+	}
+	return d
+}
+
+// Encrypted returns true if the index file is encrypted.
+func (ix *Index) Encrypted() bool {
+	return ix.keyID != ""
+}
@@ -0,0 +1,162 @@
+package index
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-encrypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := map[string][]byte{
+		"2016": bytes.Repeat([]byte{0x16}, encryptKeySize),
+		"2017": bytes.Repeat([]byte{0x17}, encryptKeySize),
+	}
+	SetKeySource(func(id string) ([]byte, error) {
+		if key, ok := keys[id]; ok {
+			return key, nil
+		}
+		return nil, ErrNoKey
+	})
+	defer SetKeySource(mustParseKeySource("env:DCS_INDEX_KEY"))
+
+	plain := filepath.Join(dir, "plain.idx")
+	files := make(map[string]string)
+	for _, name := range []string{"a", "b", "c"} {
+		files[name] = "func " + name + "() {}\n"
+	}
+	buildIndex(plain, nil, files)
+	encrypted := filepath.Join(dir, "encrypted.idx")
+	if err := Encrypt(encrypted, plain, "2016"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("func")) {
+		t.Errorf("encrypted index contains plain text")
+	}
+
+	h, err := ReadHeader(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.KeyID != "2016" || h.Version != CurrentVersion {
+		t.Errorf("ReadHeader() = %+v, want key 2016 and version %d", h, CurrentVersion)
+	}
+	pix, eix := Open(plain), Open(encrypted)
+	if pix.Encrypted() || !eix.Encrypted() {
+		t.Errorf("Encrypted() = %v and %v, want false and true", pix.Encrypted(), eix.Encrypted())
+	}
+	if !bytes.Equal(eix.data.d, pix.data.d) {
+		t.Errorf("decrypted index differs from the original")
+	}
+	if got, want := eix.PostingList(tri('f', 'u', 'n')), []uint32{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PostingList() = %v, want %v", got, want)
+	}
+	pix.Close()
+	eix.Close()
+
+	// Re-encrypting with another key.
+	rotated := filepath.Join(dir, "rotated.idx")
+	if err := Encrypt(rotated, encrypted, "2017"); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := ReadHeader(rotated); err != nil || h.KeyID != "2017" {
+		t.Errorf("ReadHeader() = %+v, %v, want key 2017", h, err)
+	}
+	if err := Encrypt(rotated, encrypted, "2018"); err != ErrNoKey {
+		t.Errorf("Encrypt() with an unknown key = %v, want ErrNoKey", err)
+	}
+
+	// Modifications are detected.
+	for _, off := range []int{len(magicEncrypted) + 6, len(data) / 2, len(data) - 1} {
+		modified := append([]byte(nil), data...)
+		modified[off] ^= 1
+		if err := ioutil.WriteFile(encrypted, modified, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadHeader(encrypted); err != ErrDecrypt {
+			t.Errorf("ReadHeader() of a modified index (byte %d) = %v, want ErrDecrypt", off, err)
+		}
+	}
+	if err := ioutil.WriteFile(encrypted, data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadHeader(encrypted); err != ErrCorrupt {
+		t.Errorf("ReadHeader() of a truncated index = %v, want ErrCorrupt", err)
+	}
+
+	// Data spanning several chunks, which Encrypt does not interpret.
+	big := make([]byte, 2*encryptChunkSize+100)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	if err := ioutil.WriteFile(plain, big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Encrypt(encrypted, plain, "2017"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = ioutil.ReadFile(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := decryptIndex(data); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("decryptIndex() = %d bytes, %v, want the original %d bytes", len(got), err, len(big))
+	}
+	// Swapping two chunks.
+	start := len(data) - (len(big) + 3*16)
+	n := encryptChunkSize + 16
+	swapped := append([]byte(nil), data[:start]...)
+	swapped = append(swapped, data[start+n:start+2*n]...)
+	swapped = append(swapped, data[start:start+n]...)
+	swapped = append(swapped, data[start+2*n:]...)
+	if _, _, err := decryptIndex(swapped); err != ErrDecrypt {
+		t.Errorf("decryptIndex() of swapped chunks = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestParseKeySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-encrypt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := bytes.Repeat([]byte{0xab}, encryptKeySize)
+	path := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(want)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("DCS_TEST_INDEX_KEY", hex.EncodeToString(want))
+	defer os.Unsetenv("DCS_TEST_INDEX_KEY")
+	for _, spec := range []string{"env:DCS_TEST_INDEX_KEY", "file:" + path} {
+		source, err := ParseKeySource(spec)
+		if err != nil {
+			t.Fatalf("ParseKeySource(%q): %v", spec, err)
+		}
+		if got, err := source("any"); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("ParseKeySource(%q)() = %x, %v, want %x", spec, got, err, want)
+		}
+	}
+	source, err := ParseKeySource("env:DCS_TEST_INDEX_KEY_UNSET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source("any"); err != ErrNoKey {
+		t.Errorf("key from an unset variable: got %v, want ErrNoKey", err)
+	}
+	if _, err := ParseKeySource("kms"); err == nil {
+		t.Errorf("ParseKeySource(%q) succeeded", "kms")
+	}
+}
@@ -0,0 +1,102 @@
+package index
+
+// Case-folded trigrams.
+//
+// Case-insensitive regexps like (?i)foobar expand into an alternation of all
+// case variants of each trigram, which makes for slow queries. An IndexWriter
+// with FoldCase set additionally records the trigram with all ASCII letters
+// lowercased for every trigram of a file, so that such queries can look up
+// the lowercased trigrams only (see FoldedRegexpQuery).
+//
+// Since the original trigrams are still recorded, the index can also be used
+// for case-sensitive queries, and indexes with and without folded trigrams can
+// be read by the same code. Only the looked up trigrams differ.
+
+import (
+	"regexp/syntax"
+	"unicode"
+)
+
+// foldTrigram returns trigram with all ASCII letters lowercased.
+func foldTrigram(trigram uint32) uint32 {
+	for shift := uint(0); shift < 24; shift += 8 {
+		if c := byte(trigram >> shift); 'A' <= c && c <= 'Z' {
+			trigram += uint32('a'-'A') << shift
+		}
+	}
+	return trigram
+}
+
+// FoldsCase returns true if the index contains case-folded trigrams, i.e. if
+// it was written with FoldCase set.
+func (ix *Index) FoldsCase() bool {
+	return ix.features&FeatureFoldCase != 0
+}
+
+// FoldedRegexpQuery is like RegexpQuery, but looks up lowercased trigrams for
+// the case-insensitive parts of re. The returned query must only be used with
+// indexes for which FoldsCase returns true.
+func FoldedRegexpQuery(re *syntax.Regexp) *Query {
+	return RegexpQuery(foldRegexp(re))
+}
+
+// foldRegexp returns a copy of re in which the case-insensitive parts only
+// match lowercase ASCII letters. Non-ASCII letters keep all their case
+// variants, since the index only folds ASCII.
+func foldRegexp(re *syntax.Regexp) *syntax.Regexp {
+	re1 := *re
+	switch {
+	case re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase != 0:
+		// Turn each letter into a character class of its folded variants.
+		re1 = syntax.Regexp{Op: syntax.OpConcat, Flags: re.Flags &^ syntax.FoldCase}
+		for _, r := range re.Rune {
+			class := &syntax.Regexp{Op: syntax.OpCharClass}
+			class.Rune = foldRanges([]rune{r, r})
+			for r1 := unicode.SimpleFold(r); r1 != r; r1 = unicode.SimpleFold(r1) {
+				class.Rune = append(class.Rune, foldRanges([]rune{r1, r1})...)
+			}
+			re1.Sub = append(re1.Sub, class)
+		}
+		return &re1
+
+	case re.Op == syntax.OpCharClass && re.Flags&syntax.FoldCase != 0:
+		re1.Rune = foldRanges(re.Rune)
+		return &re1
+	}
+
+	if len(re.Sub) > 0 {
+		re1.Sub = make([]*syntax.Regexp, len(re.Sub))
+		for i, sub := range re.Sub {
+			re1.Sub[i] = foldRegexp(sub)
+		}
+	}
+	return &re1
+}
+
+// foldRanges maps the uppercase ASCII letters in the character class ranges
+// to lowercase.
+func foldRanges(ranges []rune) []rune {
+	var folded []rune
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if hi < 'A' || lo > 'Z' {
+			folded = append(folded, lo, hi)
+			continue
+		}
+		if lo < 'A' {
+			folded = append(folded, lo, 'A'-1)
+		}
+		if hi > 'Z' {
+			folded = append(folded, 'Z'+1, hi)
+		}
+		ulo, uhi := lo, hi
+		if ulo < 'A' {
+			ulo = 'A'
+		}
+		if uhi > 'Z' {
+			uhi = 'Z'
+		}
+		folded = append(folded, ulo+'a'-'A', uhi+'a'-'A')
+	}
+	return folded
+}
@@ -0,0 +1,68 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+var foldFiles = map[string]string{
+	"file0": "func NewReader()",
+	"file1": "newreader := 1",
+	"file2": "NEWREADER",
+	"file3": "new writer",
+}
+
+func foldedQuery(t *testing.T, expr string) *Query {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FoldedRegexpQuery(re)
+}
+
+func TestFoldedRegexpQuery(t *testing.T) {
+	for _, test := range []struct {
+		expr string
+		want string
+	}{
+		{"(?i)abcd", `"abc" "bcd"`},
+		{"(?i)[a-c]bc", `("abc"|"bbc"|"cbc")`},
+		// Only the case-insensitive part is folded.
+		{"ABC(?i)de", `"ABC" "BCd" "Cde"`},
+		// Non-ASCII letters keep their case variants.
+		{"(?i)äbc", `("\x84bc" "Äb")|("\xa4bc" "äb")`},
+	} {
+		if got := foldedQuery(t, test.expr).String(); got != test.want {
+			t.Errorf("FoldedRegexpQuery(%s) = %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+
+	ix := Create(out)
+	ix.FoldCase = true
+	for _, name := range []string{"file0", "file1", "file2", "file3"} {
+		ix.Add(name, strings.NewReader(foldFiles[name]))
+	}
+	ix.Flush()
+
+	r := Open(out)
+	defer r.Close()
+	if !r.FoldsCase() {
+		t.Fatalf("FoldsCase() = false, want true")
+	}
+	if l := r.PostingQuery(foldedQuery(t, "(?i)newreader")); !equalList(l, []uint32{0, 1, 2}) {
+		t.Errorf("PostingQuery((?i)newreader) = %v, want [0 1 2]", l)
+	}
+	// The original trigrams are still there for case-sensitive queries.
+	if l := r.PostingQuery(foldedQuery(t, "NewReader")); !equalList(l, []uint32{0}) {
+		t.Errorf("PostingQuery(NewReader) = %v, want [0]", l)
+	}
+}
@@ -0,0 +1,157 @@
+package index
+
+// Iterators.
+//
+// The types in this file give external tools (analytics, deduplication,
+// custom mergers) streaming access to everything stored in an index without
+// materializing posting lists or name lists in memory:
+//
+//	for it := ix.Trigrams(); it.Next(); {
+//		for p := it.Postings(); p.Next(); {
+//			use(it.Trigram(), p.FileID())
+//		}
+//	}
+//
+// Iterators are not safe for concurrent use, but any number of them can be
+// used on the same Index at the same time. Like the other methods of Index,
+// they exit the program when encountering corrupt data; use Verify to check
+// an index beforehand.
+
+// NumFiles returns the number of files in the index. File IDs range from 0
+// to NumFiles()-1.
+func (ix *Index) NumFiles() int {
+	return ix.numName
+}
+
+// NumTrigrams returns the number of trigrams which have a posting list.
+func (ix *Index) NumTrigrams() int {
+	n := ix.numPost
+	if n > 0 {
+		if trigram, count, _ := ix.listAt(n - 1); trigram == 1<<24-1 && count == 0 {
+			n--
+		}
+	}
+	return n
+}
+
+// Size returns the size of the index file in bytes.
+func (ix *Index) Size() int64 {
+	return int64(len(ix.data.d))
+}
+
+// A TrigramIter iterates over the trigrams of an index in ascending order.
+type TrigramIter struct {
+	ix      *Index
+	i       int
+	n       int
+	trigram uint32
+	count   uint32
+	offset  uint64
+}
+
+// Trigrams returns an iterator over all trigrams which have a posting list.
+func (ix *Index) Trigrams() *TrigramIter {
+	return &TrigramIter{ix: ix, i: -1, n: ix.NumTrigrams()}
+}
+
+// Next advances to the next trigram. It returns false when there are no more
+// trigrams.
+func (it *TrigramIter) Next() bool {
+	if it.i+1 >= it.n {
+		it.i = it.n
+		return false
+	}
+	it.i++
+	it.trigram, it.count, it.offset = it.ix.listAt(it.i)
+	return true
+}
+
+// Trigram returns the current trigram.
+func (it *TrigramIter) Trigram() uint32 {
+	return it.trigram
+}
+
+// Count returns the number of files containing the current trigram.
+func (it *TrigramIter) Count() int {
+	return int(it.count)
+}
+
+// Postings returns an iterator over the posting list of the current trigram.
+func (it *TrigramIter) Postings() *PostingIter {
+	p := &PostingIter{}
+	p.r.initAt(it.ix, it.count, it.offset)
+	return p
+}
+
+// A PostingIter iterates over the IDs of the files containing a trigram, in
+// ascending order.
+type PostingIter struct {
+	r postReader
+}
+
+// Postings returns an iterator over the posting list of trigram, which is
+// empty if the index does not contain the trigram.
+func (ix *Index) Postings(trigram uint32) *PostingIter {
+	p := &PostingIter{}
+	p.r.init(ix, trigram, nil)
+	return p
+}
+
+// Next advances to the next file ID. It returns false at the end of the list.
+func (p *PostingIter) Next() bool {
+	return p.r.next()
+}
+
+// FileID returns the current file ID.
+func (p *PostingIter) FileID() uint32 {
+	return p.r.fileid
+}
+
+// Len returns the number of file IDs which Next has not returned yet.
+func (p *PostingIter) Len() int {
+	return p.r.max()
+}
+
+// A FileIter iterates over the files of an index in file ID order, which is
+// also the lexical order of their names.
+type FileIter struct {
+	ix     *Index
+	fileid uint32
+	off    uint64
+	name   []byte
+}
+
+// Files returns an iterator over all files in the index.
+func (ix *Index) Files() *FileIter {
+	return &FileIter{ix: ix, fileid: ^uint32(0)}
+}
+
+// Next advances to the next file. It returns false when there are no more
+// files.
+func (it *FileIter) Next() bool {
+	if it.fileid+1 >= uint32(it.ix.numName) {
+		it.fileid = uint32(it.ix.numName)
+		it.name = nil
+		return false
+	}
+	it.fileid++
+	it.name = it.ix.nameAt(it.off)
+	it.off += uint64(len(it.name)) + 1
+	return true
+}
+
+// ID returns the ID of the current file.
+func (it *FileIter) ID() uint32 {
+	return it.fileid
+}
+
+// NameBytes returns the name of the current file. The slice points into the
+// index and must not be modified.
+func (it *FileIter) NameBytes() []byte {
+	return it.name
+}
+
+// Name returns the name of the current file.
+func (it *FileIter) Name() string {
+	return string(it.name)
+}
@@ -0,0 +1,77 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIterators(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "post.idx")
+	buildIndex(out, nil, postFiles)
+	concat := filepath.Join(dir, "concat.idx")
+	ConcatN(concat, out)
+
+	// IndexWriter ends the posting lists with a marker, ConcatN does not. The
+	// iterators must behave the same for both.
+	for _, path := range []string{out, concat} {
+		ix := Open(path)
+		if got, want := ix.NumFiles(), len(postFiles); got != want {
+			t.Errorf("%s: NumFiles() = %d, want %d", path, got, want)
+		}
+
+		var names []string
+		for it := ix.Files(); it.Next(); {
+			if got, want := it.Name(), ix.Name(it.ID()); got != want {
+				t.Errorf("%s: file %d: Name() = %q, want %q", path, it.ID(), got, want)
+			}
+			names = append(names, it.Name())
+		}
+		if want := []string{"file0", "file1", "file2", "file3"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: Files() = %v, want %v", path, names, want)
+		}
+
+		trigrams := 0
+		last := int64(-1)
+		for it := ix.Trigrams(); it.Next(); {
+			trigrams++
+			if int64(it.Trigram()) <= last {
+				t.Errorf("%s: trigram %#06x is out of order", path, it.Trigram())
+			}
+			last = int64(it.Trigram())
+			var list []uint32
+			p := it.Postings()
+			if p.Len() != it.Count() {
+				t.Errorf("%s: trigram %#06x: Len() = %d, Count() = %d", path, it.Trigram(), p.Len(), it.Count())
+			}
+			for p.Next() {
+				list = append(list, p.FileID())
+			}
+			if want := ix.PostingList(it.Trigram()); !equalList(list, want) {
+				t.Errorf("%s: trigram %#06x: Postings() = %v, want %v", path, it.Trigram(), list, want)
+			}
+		}
+		if trigrams != ix.NumTrigrams() {
+			t.Errorf("%s: Trigrams() returned %d trigrams, NumTrigrams() = %d", path, trigrams, ix.NumTrigrams())
+		}
+
+		var list []uint32
+		for p := ix.Postings(tri('S', 'e', 'a')); p.Next(); {
+			list = append(list, p.FileID())
+		}
+		if !equalList(list, []uint32{1, 3}) {
+			t.Errorf("%s: Postings(Sea) = %v, want [1 3]", path, list)
+		}
+		if ix.Postings(tri('x', 'y', 'z')).Next() {
+			t.Errorf("%s: Postings(xyz) is not empty", path)
+		}
+		ix.Close()
+	}
+}
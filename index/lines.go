@@ -0,0 +1,249 @@
+package index
+
+// Line offsets.
+//
+// An IndexWriter with LineOffsets set records where the lines of each file
+// start, so that readers can map byte offsets to line numbers (and back)
+// without reading the file up to the match. The data is stored in the
+// SectionLineOffsets section of a version 2 or 3 index:
+//
+//	file index [8]...
+//	line data
+//
+// The file index has one entry per file plus a final entry, each giving the
+// offset of the file's data relative to the start of the line data. Like all
+// other offsets, the entries are only 4 bytes wide in version 2 indexes. The
+// data of a file is a sequence of varint-encoded deltas between the offsets
+// of consecutive line starts. The first line always starts at offset 0 and is
+// not recorded; each following entry is the offset right after a newline.
+
+import (
+	"encoding/binary"
+	"os"
+	"regexp/syntax"
+	"sort"
+	"unicode/utf8"
+)
+
+// SectionLineOffsets holds the line offsets of all files.
+const SectionLineOffsets SectionID = 1
+
+// lineOffsetsWriter collects the line offsets while an index is written.
+type lineOffsetsWriter struct {
+	index *bufWriter // temp file holding the file index
+	data  *bufWriter // temp file holding the line data
+	lines []uint32   // line starts of the current file
+}
+
+func newLineOffsetsWriter() *lineOffsetsWriter {
+	return &lineOffsetsWriter{
+		index: bufCreate(""),
+		data:  bufCreate(""),
+	}
+}
+
+// addFile writes the line starts collected in w.lines as the next file.
+func (w *lineOffsetsWriter) addFile() {
+	w.index.writeUint64(w.data.offset())
+	last := uint32(0)
+	for _, off := range w.lines {
+		w.data.writeUvarint(off - last)
+		last = off
+	}
+	w.lines = w.lines[:0]
+}
+
+// flush writes the section to out and removes the temporary files.
+func (w *lineOffsetsWriter) flush(out *bufWriter, t *trailer) {
+	w.index.writeUint64(w.data.offset())
+	t.beginSection(out, SectionLineOffsets)
+	copyFile(out, w.index)
+	copyFile(out, w.data)
+	t.endSection(out)
+	os.Remove(w.index.name)
+	os.Remove(w.data.name)
+}
+
+// concatFileData writes the section id of the files of ixes which are
+// covered by idmaps (see concatN) to out if all of ixes have that section.
+// The section must be laid out like SectionLineOffsets: a file index followed
+// by the data of all files.
+func concatFileData(out *bufWriter, t *trailer, id SectionID, ixes []*Index, idmaps [][]idrange) {
+	sections := make([][]byte, len(ixes))
+	for i, ix := range ixes {
+		if sections[i] = ix.Section(id); sections[i] == nil {
+			return
+		}
+	}
+	// fileData returns the data of file j of source i.
+	fileData := func(i int, j uint32) []byte {
+		return ixes[i].fileData(sections[i], j)
+	}
+	t.beginSection(out, id)
+	base := uint64(0)
+	for i := range ixes {
+		for _, r := range idmaps[i] {
+			for j := r.lo; j < r.hi; j++ {
+				out.writeUint64(base)
+				base += uint64(len(fileData(i, j)))
+			}
+		}
+	}
+	out.writeUint64(base)
+	for i := range ixes {
+		for _, r := range idmaps[i] {
+			for j := r.lo; j < r.hi; j++ {
+				out.write(fileData(i, j))
+			}
+		}
+	}
+	t.endSection(out)
+}
+
+// HasLineOffsets returns true if the index contains line offsets.
+func (ix *Index) HasLineOffsets() bool {
+	return ix.Section(SectionLineOffsets) != nil
+}
+
+// LineOffsets returns the byte offsets at which the lines of the given file
+// start, i.e. line n (counting from 1) starts at offset LineOffsets()[n-1].
+// It returns nil if the index does not contain line offsets.
+func (ix *Index) LineOffsets(fileid uint32) []uint32 {
+	s := ix.Section(SectionLineOffsets)
+	if s == nil {
+		return nil
+	}
+	data := ix.fileData(s, fileid)
+	offsets := []uint32{0}
+	last := uint32(0)
+	for len(data) > 0 {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 {
+			corrupt(ix.File)
+		}
+		last += uint32(delta)
+		offsets = append(offsets, last)
+		data = data[n:]
+	}
+	return offsets
+}
+
+// fileData returns the data of the given file from the section s, which
+// starts with a file index like the line offsets section.
+func (ix *Index) fileData(s []byte, fileid uint32) []byte {
+	dataStart := ix.offSize * uint64(ix.numName+1)
+	if int(fileid) >= ix.numName || uint64(len(s)) < dataStart {
+		corrupt(ix.File)
+	}
+	e := ix.offSize * uint64(fileid)
+	start := dataStart + getOffset(s[e:], ix.offSize)
+	end := dataStart + getOffset(s[e+ix.offSize:], ix.offSize)
+	if start > end || end > uint64(len(s)) {
+		corrupt(ix.File)
+	}
+	return s[start:end]
+}
+
+// LineForOffset returns the line number (counting from 1) of the line which
+// contains the byte at off, given the result of LineOffsets.
+func LineForOffset(offsets []uint32, off uint32) int {
+	return sort.Search(len(offsets), func(i int) bool { return offsets[i] > off })
+}
+
+// MatchLength returns the smallest and the largest number of bytes a match of
+// re can have. max is -1 if there is no limit.
+func MatchLength(re *syntax.Regexp) (min, max int) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			// Other cases of a letter can be longer, e.g. the Kelvin sign
+			// for k.
+			return len(re.Rune), len(re.Rune) * utf8.UTFMax
+		}
+		for _, r := range re.Rune {
+			min += utf8.RuneLen(r)
+		}
+		return min, min
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return 0, 0
+		}
+		return 1, utf8.RuneLen(re.Rune[len(re.Rune)-1])
+	case syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return 1, utf8.UTFMax
+	case syntax.OpCapture:
+		return MatchLength(re.Sub[0])
+	case syntax.OpStar:
+		return 0, -1
+	case syntax.OpPlus:
+		min, _ = MatchLength(re.Sub[0])
+		return min, -1
+	case syntax.OpQuest:
+		_, max = MatchLength(re.Sub[0])
+		return 0, max
+	case syntax.OpRepeat:
+		min, max = MatchLength(re.Sub[0])
+		min *= re.Min
+		if re.Max == -1 || max == -1 {
+			return min, -1
+		}
+		return min, max * re.Max
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			subMin, subMax := MatchLength(sub)
+			min += subMin
+			if max != -1 {
+				if subMax == -1 {
+					max = -1
+				} else {
+					max += subMax
+				}
+			}
+		}
+		return min, max
+	case syntax.OpAlternate:
+		for i, sub := range re.Sub {
+			subMin, subMax := MatchLength(sub)
+			if i == 0 || subMin < min {
+				min = subMin
+			}
+			if i == 0 || max != -1 && (subMax == -1 || subMax > max) {
+				max = subMax
+			}
+		}
+		return min, max
+	}
+	// Empty-width assertions like ^ or \b, and the empty string.
+	return 0, 0
+}
+
+// HasLineOfLength returns false if the given file certainly does not have a
+// line whose length (without the newline) is between min and max (-1 meaning
+// no limit), e.g. because a query needs to match whole lines (see
+// MatchLength). It returns true if the index does not contain line offsets.
+func (ix *Index) HasLineOfLength(fileid uint32, min, max int) bool {
+	offsets := ix.LineOffsets(fileid)
+	if offsets == nil {
+		return true
+	}
+	size := int64(-1)
+	if meta, ok := ix.FileMeta(fileid); ok {
+		size = meta.Size
+	}
+	return hasLineOfLength(offsets, size, min, max)
+}
+
+// hasLineOfLength is HasLineOfLength for a file with the given line offsets
+// and size (-1 if unknown, in which case the last line might have any
+// length).
+func hasLineOfLength(offsets []uint32, size int64, min, max int) bool {
+	inRange := func(length int64) bool {
+		return length >= int64(min) && (max == -1 || length <= int64(max))
+	}
+	for i := 1; i < len(offsets); i++ {
+		if inRange(int64(offsets[i]-offsets[i-1]) - 1) {
+			return true
+		}
+	}
+	return size == -1 || inRange(size-int64(offsets[len(offsets)-1]))
+}
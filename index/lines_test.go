@@ -0,0 +1,126 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+func buildLineOffsetsIndex(out string, fileData map[string]string, names ...string) {
+	ix := Create(out)
+	ix.LineOffsets = true
+	for _, name := range names {
+		ix.Add(name, strings.NewReader(fileData[name]))
+	}
+	ix.Flush()
+}
+
+func TestLineOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-lines-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a": "first\nsecond\n\nfourth",
+		"b": "no newline",
+		"c": "x\ny\n",
+	}
+	first := filepath.Join(dir, "first.idx")
+	buildLineOffsetsIndex(first, files, "a", "b")
+	second := filepath.Join(dir, "second.idx")
+	buildLineOffsetsIndex(second, files, "c")
+	all := filepath.Join(dir, "all.idx")
+	ConcatN(all, first, second)
+
+	want := map[string][]uint32{
+		"a": {0, 6, 13, 14},
+		"b": {0},
+		"c": {0, 2, 4},
+	}
+	for _, path := range []string{first, second, all} {
+		ix := Open(path)
+		if !ix.HasLineOffsets() {
+			t.Errorf("%s: HasLineOffsets() = false, want true", path)
+		}
+		for i := 0; i < ix.numName; i++ {
+			name := ix.Name(uint32(i))
+			if got := ix.LineOffsets(uint32(i)); !reflect.DeepEqual(got, want[name]) {
+				t.Errorf("%s: LineOffsets(%s) = %v, want %v", path, name, got, want[name])
+			}
+		}
+		ix.Close()
+	}
+
+	for _, test := range []struct {
+		off  uint32
+		want int
+	}{
+		{0, 1}, {5, 1}, {6, 2}, {13, 3}, {14, 4}, {100, 4},
+	} {
+		if got := LineForOffset(want["a"], test.off); got != test.want {
+			t.Errorf("LineForOffset(%d) = %d, want %d", test.off, got, test.want)
+		}
+	}
+
+	// Indexes written without LineOffsets do not have a section.
+	plain := filepath.Join(dir, "plain.idx")
+	buildIndex(plain, nil, files)
+	ix := Open(plain)
+	defer ix.Close()
+	if ix.HasLineOffsets() || ix.LineOffsets(0) != nil {
+		t.Errorf("index without line offsets claims to have them")
+	}
+}
+
+func TestMatchLength(t *testing.T) {
+	for _, test := range []struct {
+		re       string
+		min, max int
+	}{
+		{`#define FOO 1`, 13, 13},
+		{`(?m)^foo\r?$`, 3, 4},
+		{`(?i)foo`, 3, 12},
+		{`a[bc]?d`, 2, 3},
+		{`foo|barbaz`, 3, 6},
+		{`x.y`, 3, 6},
+		{`a{2,3}`, 2, 3},
+		{`a+b`, 2, -1},
+		{`\bfoo.*`, 3, -1},
+		{`ü`, 2, 2},
+	} {
+		re, err := syntax.Parse(test.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if min, max := MatchLength(re); min != test.min || max != test.max {
+			t.Errorf("MatchLength(%q) = %d, %d, want %d, %d", test.re, min, max, test.min, test.max)
+		}
+	}
+}
+
+func TestHasLineOfLength(t *testing.T) {
+	// "first\nsecond\n\nfourth"
+	offsets := []uint32{0, 6, 13, 14}
+	for _, test := range []struct {
+		size     int64
+		min, max int
+		want     bool
+	}{
+		{20, 5, 5, true},
+		{20, 0, 0, true},
+		{20, 3, 4, false},
+		{20, 7, -1, false},
+		{20, 6, 6, true},
+		{-1, 7, -1, true},
+	} {
+		if got := hasLineOfLength(offsets, test.size, test.min, test.max); got != test.want {
+			t.Errorf("hasLineOfLength(%v, %d, %d, %d) = %v, want %v", offsets, test.size, test.min, test.max, got, test.want)
+		}
+	}
+}
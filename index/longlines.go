@@ -0,0 +1,177 @@
+package index
+
+// Long lines.
+//
+// Files with very long lines (minified JavaScript, generated tables, data
+// embedded in headers) are mostly noise in search results, but they are not
+// necessarily useless. IndexWriter.LongLines decides what happens to them,
+// see LongLinePolicy. Files which are indexed despite their long lines are
+// recorded in the SectionLongLines section:
+//
+//	number of files [4]
+//	file ID [4], longest line [4], policy [4]
+//	...
+//
+// The records are sorted by file ID. Files without long lines have no
+// record, and the section is left out if no file has one.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// SectionLongLines holds the files which contain long lines.
+const SectionLongLines SectionID = 6
+
+const longLineRecordSize = 4 + 4 + 4
+
+// LongLinePolicy decides how files containing lines longer than
+// IndexWriter.MaxLineLen are handled.
+type LongLinePolicy uint32
+
+const (
+	// LongLinesSkipFile leaves out the whole file (Add returns
+	// ErrLongLines). This is the default.
+	LongLinesSkipFile LongLinePolicy = iota
+
+	// LongLinesIndex indexes the file completely. Matchers are expected to
+	// truncate the snippets of long lines.
+	LongLinesIndex
+
+	// LongLinesSkipLines indexes the file, but only the beginning of each
+	// long line. Matchers are expected to skip long lines.
+	LongLinesSkipLines
+)
+
+var longLinePolicyNames = []string{
+	LongLinesSkipFile:  "skip_file",
+	LongLinesIndex:     "truncate",
+	LongLinesSkipLines: "skip_lines",
+}
+
+func (p LongLinePolicy) String() string {
+	if int(p) < len(longLinePolicyNames) {
+		return longLinePolicyNames[p]
+	}
+	return fmt.Sprintf("LongLinePolicy(%d)", uint32(p))
+}
+
+// ParseLongLinePolicy returns the policy with the given name, as returned by
+// LongLinePolicy.String, for use in command line flags.
+func ParseLongLinePolicy(name string) (LongLinePolicy, error) {
+	for p, n := range longLinePolicyNames {
+		if n == name {
+			return LongLinePolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown long line policy %q (want one of %v)", name, longLinePolicyNames)
+}
+
+// LongLines describes the long lines of an indexed file.
+type LongLines struct {
+	Longest int            // length of the longest line in bytes
+	Policy  LongLinePolicy // the policy the file was indexed with
+}
+
+type longLineRecord struct {
+	fileid uint32
+	LongLines
+}
+
+// writeLongLines writes the long lines section if any file has long lines.
+func (ix *IndexWriter) writeLongLines(t *trailer) {
+	if len(ix.longLines) == 0 {
+		return
+	}
+	t.beginSection(ix.main, SectionLongLines)
+	writeLongLineRecords(ix.main, ix.longLines)
+	t.endSection(ix.main)
+}
+
+func writeLongLineRecords(out *bufWriter, records []longLineRecord) {
+	out.writeUint32(uint32(len(records)))
+	for _, r := range records {
+		out.writeUint32(r.fileid)
+		out.writeUint32(uint32(r.Longest))
+		out.writeUint32(uint32(r.Policy))
+	}
+}
+
+// concatLongLines writes the long line records of the files of ixes which
+// are covered by idmaps (see concatN) to out, renumbering the files like
+// concatN does.
+func concatLongLines(out *bufWriter, t *trailer, ixes []*Index, idmaps [][]idrange) {
+	var records []longLineRecord
+	next := uint32(0)
+	for i, ix := range ixes {
+		old := ix.longLineRecords()
+		for _, r := range idmaps[i] {
+			k := sort.Search(len(old), func(k int) bool { return old[k].fileid >= r.lo })
+			for ; k < len(old) && old[k].fileid < r.hi; k++ {
+				records = append(records, longLineRecord{
+					fileid:    next + old[k].fileid - r.lo,
+					LongLines: old[k].LongLines,
+				})
+			}
+			next += r.hi - r.lo
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	t.beginSection(out, SectionLongLines)
+	writeLongLineRecords(out, records)
+	t.endSection(out)
+}
+
+// longLineRecords decodes the long lines section.
+func (ix *Index) longLineRecords() []longLineRecord {
+	s := ix.Section(SectionLongLines)
+	if s == nil {
+		return nil
+	}
+	if len(s) < 4 {
+		corrupt(ix.File)
+	}
+	n := int(binary.BigEndian.Uint32(s))
+	if len(s) < 4+n*longLineRecordSize {
+		corrupt(ix.File)
+	}
+	records := make([]longLineRecord, n)
+	for i := range records {
+		r := s[4+i*longLineRecordSize:]
+		records[i] = longLineRecord{
+			fileid: binary.BigEndian.Uint32(r),
+			LongLines: LongLines{
+				Longest: int(binary.BigEndian.Uint32(r[4:])),
+				Policy:  LongLinePolicy(binary.BigEndian.Uint32(r[8:])),
+			},
+		}
+	}
+	return records
+}
+
+// LongLines returns how the long lines of the given file were handled. The
+// second return value is false if the file has no long lines (or the index
+// predates SectionLongLines).
+func (ix *Index) LongLines(fileid uint32) (LongLines, bool) {
+	s := ix.Section(SectionLongLines)
+	if len(s) < 4 {
+		return LongLines{}, false
+	}
+	n := int(binary.BigEndian.Uint32(s))
+	if len(s) < 4+n*longLineRecordSize {
+		corrupt(ix.File)
+	}
+	record := func(i int) []byte { return s[4+i*longLineRecordSize:] }
+	i := sort.Search(n, func(i int) bool { return binary.BigEndian.Uint32(record(i)) >= fileid })
+	if i == n || binary.BigEndian.Uint32(record(i)) != fileid {
+		return LongLines{}, false
+	}
+	r := record(i)
+	return LongLines{
+		Longest: int(binary.BigEndian.Uint32(r[4:])),
+		Policy:  LongLinePolicy(binary.BigEndian.Uint32(r[8:])),
+	}, true
+}
@@ -0,0 +1,99 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-longlines-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	long := "var a=1;" + strings.Repeat("x", 100) + "needle;\n"
+	build := func(name string, policy LongLinePolicy) string {
+		path := filepath.Join(dir, name)
+		ix := Create(path)
+		ix.LongLines = policy
+		ix.MaxLineLen = 50
+		if err := ix.Add(name+"/a.c", strings.NewReader("int a;\n")); err != nil {
+			t.Fatal(err)
+		}
+		err := ix.Add(name+"/b.min.js", strings.NewReader(long))
+		if policy == LongLinesSkipFile {
+			if err != ErrLongLines {
+				t.Errorf("%v: Add() = %v, want ErrLongLines", policy, err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ix.Flush()
+		return path
+	}
+	skipFile := build("skipfile", LongLinesSkipFile)
+	truncate := build("truncate", LongLinesIndex)
+	skipLines := build("skiplines", LongLinesSkipLines)
+
+	for _, test := range []struct {
+		path   string
+		files  int
+		want   LongLines
+		needle bool
+	}{
+		{skipFile, 1, LongLines{}, false},
+		{truncate, 2, LongLines{Longest: len(long), Policy: LongLinesIndex}, true},
+		{skipLines, 2, LongLines{Longest: len(long), Policy: LongLinesSkipLines}, false},
+	} {
+		ix := Open(test.path)
+		if got := ix.NumFiles(); got != test.files {
+			t.Errorf("%s: NumFiles() = %d, want %d", test.path, got, test.files)
+		}
+		if _, ok := ix.LongLines(0); ok {
+			t.Errorf("%s: file without long lines has a record", test.path)
+		}
+		got, ok := ix.LongLines(1)
+		if ok != (test.files == 2) || got != test.want {
+			t.Errorf("%s: LongLines(1) = %+v, %v, want %+v", test.path, got, ok, test.want)
+		}
+		// Only the beginning of long lines is indexed when skipping them.
+		found := len(ix.PostingList(tri('d', 'l', 'e'))) > 0
+		if found != test.needle {
+			t.Errorf("%s: trigram of the end of the long line indexed: %v, want %v", test.path, found, test.needle)
+		}
+		if len(ix.PostingList(tri('v', 'a', 'r'))) != test.files-1 {
+			t.Errorf("%s: trigram of the beginning of the long line not indexed", test.path)
+		}
+		ix.Close()
+	}
+
+	// The records follow their files when combining indexes.
+	all := filepath.Join(dir, "all.idx")
+	ConcatNExcluding(all, []string{"skiplines/b.min.js"}, skipFile, truncate, skipLines)
+	ix := Open(all)
+	defer ix.Close()
+	want := map[string]LongLines{
+		"truncate/b.min.js": {Longest: len(long), Policy: LongLinesIndex},
+	}
+	for i := 0; i < ix.NumFiles(); i++ {
+		got, ok := ix.LongLines(uint32(i))
+		if w, found := want[ix.Name(uint32(i))]; ok != found || got != w {
+			t.Errorf("LongLines(%s) = %+v, %v, want %+v, %v", ix.Name(uint32(i)), got, ok, w, found)
+		}
+	}
+}
+
+func TestParseLongLinePolicy(t *testing.T) {
+	for _, p := range []LongLinePolicy{LongLinesSkipFile, LongLinesIndex, LongLinesSkipLines} {
+		if got, err := ParseLongLinePolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseLongLinePolicy(%q) = %v, %v, want %v", p.String(), got, err, p)
+		}
+	}
+	if _, err := ParseLongLinePolicy("ignore"); err == nil {
+		t.Errorf("ParseLongLinePolicy(%q) succeeded", "ignore")
+	}
+}
@@ -41,12 +41,6 @@ type idrange struct {
 	lo, hi, new uint32
 }
 
-type postIndex struct {
-	tri    uint32
-	count  uint32
-	offset uint32
-}
-
 // Merge creates a new index in the file dst that corresponds to merging
 // the two indices src1 and src2.  If both src1 and src2 claim responsibility
 // for a path, src2 is assumed to be newer and is given preference.
@@ -105,7 +99,7 @@ func Merge(dst, src1, src2 string) {
 	numName := new
 
 	ix3 := bufCreate(dst)
-	ix3.writeString(magic)
+	ix3.writeString(magicV3)
 
 	// Merged list of paths.
 	pathData := ix3.offset()
@@ -140,7 +134,7 @@ func Merge(dst, src1, src2 string) {
 		if mi1 < len(map1) && map1[mi1].new == new {
 			for i := map1[mi1].lo; i < map1[mi1].hi; i++ {
 				name := ix1.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
+				nameIndexFile.writeUint64(ix3.offset() - nameData)
 				ix3.writeString(name)
 				ix3.writeString("\x00")
 				new++
@@ -149,7 +143,7 @@ func Merge(dst, src1, src2 string) {
 		} else if mi2 < len(map2) && map2[mi2].new == new {
 			for i := map2[mi2].lo; i < map2[mi2].hi; i++ {
 				name := ix2.Name(i)
-				nameIndexFile.writeUint32(ix3.offset() - nameData)
+				nameIndexFile.writeUint64(ix3.offset() - nameData)
 				ix3.writeString(name)
 				ix3.writeString("\x00")
 				new++
@@ -159,10 +153,10 @@ func Merge(dst, src1, src2 string) {
 			panic("merge: inconsistent index")
 		}
 	}
-	if new*4 != nameIndexFile.offset() {
+	if uint64(new)*8 != nameIndexFile.offset() {
 		panic("merge: inconsistent index")
 	}
-	nameIndexFile.writeUint32(ix3.offset())
+	nameIndexFile.writeUint64(ix3.offset())
 
 	// Merged list of posting lists.
 	postData := ix3.offset()
@@ -219,12 +213,11 @@ func Merge(dst, src1, src2 string) {
 	postIndex := ix3.offset()
 	copyFile(ix3, w.postIndexFile)
 
-	ix3.writeUint32(pathData)
-	ix3.writeUint32(nameData)
-	ix3.writeUint32(postData)
-	ix3.writeUint32(nameIndex)
-	ix3.writeUint32(postIndex)
-	ix3.writeString(trailerMagic)
+	t := trailer{
+		off:      [5]uint64{pathData, nameData, postData, nameIndex, postIndex},
+		features: commonFeatures(ix1, ix2),
+	}
+	t.write(ix3)
 	ix3.flush()
 
 	os.Remove(nameIndexFile.name)
@@ -238,7 +231,7 @@ func Concat(dst, src1, src2 string) {
 	ix2 := Open(src2)
 
 	ix3 := bufCreate(dst)
-	ix3.writeString(magic)
+	ix3.writeString(magicV3)
 
 	// Merged list of paths.
 	pathData := ix3.offset()
@@ -248,17 +241,17 @@ func Concat(dst, src1, src2 string) {
 	nameData := ix3.offset()
 	nameIndexFile := bufCreate("")
 	for i := 0; i < ix1.numName; i++ {
-		nameIndexFile.writeUint32(ix3.offset() - nameData)
+		nameIndexFile.writeUint64(ix3.offset() - nameData)
 		ix3.writeString(ix1.Name(uint32(i)))
 		ix3.writeString("\x00")
 	}
 	for i := 0; i < ix2.numName; i++ {
-		nameIndexFile.writeUint32(ix3.offset() - nameData)
+		nameIndexFile.writeUint64(ix3.offset() - nameData)
 		ix3.writeString(ix2.Name(uint32(i)))
 		ix3.writeString("\x00")
 	}
 
-	nameIndexFile.writeUint32(ix3.offset())
+	nameIndexFile.writeUint64(ix3.offset())
 
 	// Merged list of posting lists.
 	postData := ix3.offset()
@@ -309,12 +302,11 @@ func Concat(dst, src1, src2 string) {
 	postIndex := ix3.offset()
 	copyFile(ix3, w.postIndexFile)
 
-	ix3.writeUint32(pathData)
-	ix3.writeUint32(nameData)
-	ix3.writeUint32(postData)
-	ix3.writeUint32(nameIndex)
-	ix3.writeUint32(postIndex)
-	ix3.writeString(trailerMagic)
+	t := trailer{
+		off:      [5]uint64{pathData, nameData, postData, nameIndex, postIndex},
+		features: commonFeatures(ix1, ix2),
+	}
+	t.write(ix3)
 	ix3.flush()
 
 	os.Remove(nameIndexFile.name)
@@ -327,11 +319,15 @@ type postMapReader struct {
 	triNum  uint32
 	trigram uint32
 	count   uint32
-	offset  uint32
+	offset  uint64
 	d       []byte
 	oldid   uint32
 	fileid  uint32
 	i       int
+
+	// If non-nil, maps old to new file IDs instead of idmap, see
+	// dedupSources. The new IDs are not necessarily ascending.
+	postmap []uint32
 }
 
 func (r *postMapReader) init(ix *Index, idmap []idrange) {
@@ -353,12 +349,12 @@ func (r *postMapReader) load() {
 		r.fileid = ^uint32(0)
 		return
 	}
-	r.trigram, r.count, r.offset = r.ix.listAt(r.triNum * postEntrySize)
+	r.trigram, r.count, r.offset = r.ix.listAt(int(r.triNum))
 	if r.count == 0 {
 		r.fileid = ^uint32(0)
 		return
 	}
-	r.d = r.ix.slice(r.ix.postData+r.offset+3, -1)
+	r.d = r.ix.postingData(r.offset, r.count)
 	r.oldid = ^uint32(0)
 	r.i = 0
 }
@@ -373,6 +369,15 @@ func (r *postMapReader) nextId() bool {
 		}
 		r.d = r.d[n:]
 		r.oldid += delta
+		if r.postmap != nil {
+			if int(r.oldid) >= len(r.postmap) {
+				corrupt(r.ix.File)
+			}
+			if r.fileid = r.postmap[r.oldid]; r.fileid != ^uint32(0) {
+				return true
+			}
+			continue
+		}
 		for r.i < len(r.idmap) && r.idmap[r.i].hi <= r.oldid {
 			r.i++
 		}
@@ -391,6 +396,12 @@ func (r *postMapReader) nextId() bool {
 	return false
 }
 
+// identity returns true if r maps all file IDs of its index to consecutive
+// new IDs, which is required for writePostingList.
+func (r *postMapReader) identity() bool {
+	return r.postmap == nil && len(r.idmap) == 1 && r.idmap[0].lo == 0 && r.idmap[0].hi == uint32(r.ix.numName)
+}
+
 // Directly writes the entire posting list to w.
 // Useful to avoid function call overhead, and also expects to be called from
 // ConcatN only (i.e. takes shortcuts that may break usage of idmap other than
@@ -435,8 +446,9 @@ type postDataWriter struct {
 	out           *bufWriter
 	postIndexFile *bufWriter
 	buf           [10]byte
-	base          uint32
-	count, offset uint32
+	base          uint64
+	offset        uint64
+	count         uint32
 	last          uint32
 	t             uint32
 }
@@ -470,5 +482,5 @@ func (w *postDataWriter) endTrigram() {
 	w.out.writeUvarint(0)
 	w.postIndexFile.writeTrigram(w.t)
 	w.postIndexFile.writeUint32(w.count)
-	w.postIndexFile.writeUint32(w.offset - w.base)
+	w.postIndexFile.writeUint64(w.offset - w.base)
 }
@@ -0,0 +1,269 @@
+package index
+
+// File metadata.
+//
+// Files added with IndexWriter.AddFileMeta get metadata which readers can
+// look up without touching the indexed files. It is stored in the
+// SectionFileMeta section of a version 2 index:
+//
+//	number of files [4]
+//	size [4], mtime [4], package [4], language [2], depth [2]
+//	...
+//	number of packages [4]
+//	NUL-terminated package names
+//	number of languages [4]
+//	NUL-terminated language names
+//
+// There is one record per file, in file ID order. mtime is in seconds since
+// the Unix epoch, package and language are indexes into the respective name
+// lists. The package of a file is the first component of its name, the depth
+// is the number of slashes in its name.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// SectionFileMeta holds the metadata of all files.
+const SectionFileMeta SectionID = 2
+
+const metaRecordSize = 4 + 4 + 4 + 2 + 2
+
+// FileMeta is the metadata of an indexed file.
+type FileMeta struct {
+	Size     int64
+	ModTime  time.Time
+	Language string
+	Package  string
+	Depth    int
+}
+
+func packageAndDepth(name string) (string, int) {
+	pkg := name
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		pkg = name[:i]
+	}
+	return pkg, strings.Count(name, "/")
+}
+
+// metaTableWriter writes the records of the metadata section and collects
+// the package and language names they refer to.
+type metaTableWriter struct {
+	packages  []string
+	packageID map[string]uint32
+	languages []string
+	langID    map[string]uint16
+}
+
+func newMetaTableWriter() *metaTableWriter {
+	return &metaTableWriter{
+		packageID: make(map[string]uint32),
+		langID:    make(map[string]uint16),
+	}
+}
+
+func (w *metaTableWriter) writeRecord(out *bufWriter, size, mtime uint32, pkg, language string, depth int) {
+	pid, ok := w.packageID[pkg]
+	if !ok {
+		pid = uint32(len(w.packages))
+		w.packageID[pkg] = pid
+		w.packages = append(w.packages, pkg)
+	}
+	lid, ok := w.langID[language]
+	if !ok {
+		lid = uint16(len(w.languages))
+		w.langID[language] = lid
+		w.languages = append(w.languages, language)
+	}
+	if depth > 0xFFFF {
+		depth = 0xFFFF
+	}
+	out.writeUint32(size)
+	out.writeUint32(mtime)
+	out.writeUint32(pid)
+	out.write([]byte{byte(lid >> 8), byte(lid), byte(depth >> 8), byte(depth)})
+}
+
+// writeTables writes the package and language names.
+func (w *metaTableWriter) writeTables(out *bufWriter) {
+	for _, list := range [][]string{w.packages, w.languages} {
+		out.writeUint32(uint32(len(list)))
+		for _, name := range list {
+			out.writeString(name)
+			out.writeString("\x00")
+		}
+	}
+}
+
+// initMeta creates the temporary file for the metadata records.
+func (ix *IndexWriter) initMeta() {
+	if ix.meta == nil {
+		ix.meta = bufCreate("")
+		ix.metaTab = newMetaTableWriter()
+	}
+}
+
+// writeMeta writes the metadata section for all files added to ix.
+func (ix *IndexWriter) writeMeta(t *trailer) {
+	ix.initMeta()
+	t.beginSection(ix.main, SectionFileMeta)
+	ix.main.writeUint32(uint32(ix.meta.offset() / metaRecordSize))
+	copyFile(ix.main, ix.meta)
+	ix.metaTab.writeTables(ix.main)
+	t.endSection(ix.main)
+}
+
+// AddFileMeta is like AddFile, but additionally records metadata about the
+// file. Size, ModTime, Package and Depth are determined automatically, so
+// callers only need to fill in Language.
+func (ix *IndexWriter) AddFileMeta(name string, indexname string, meta FileMeta) error {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err == nil {
+		meta.ModTime = st.ModTime()
+	}
+	ix.hasMeta = true
+	ix.nextMeta = &meta
+	defer func() { ix.nextMeta = nil }()
+	return ix.Add(indexname, f)
+}
+
+// addMeta records the metadata of the file which was just added. The
+// records are written to a temporary file right away, only the package and
+// language names are kept in memory.
+func (ix *IndexWriter) addMeta(name string, size int64) {
+	ix.initMeta()
+	var mtime uint32
+	var language string
+	if ix.nextMeta != nil {
+		if !ix.nextMeta.ModTime.IsZero() {
+			mtime = uint32(ix.nextMeta.ModTime.Unix())
+		}
+		language = ix.nextMeta.Language
+	}
+	pkg, depth := packageAndDepth(name)
+	ix.metaTab.writeRecord(ix.meta, uint32(size), mtime, pkg, language, depth)
+}
+
+// concatMeta writes the metadata of the files of ixes which are covered by
+// idmaps (see concatN) to out if all of ixes have metadata.
+func concatMeta(out *bufWriter, t *trailer, ixes []*Index, idmaps [][]idrange) {
+	for _, ix := range ixes {
+		if !ix.HasFileMeta() {
+			return
+		}
+	}
+	t.beginSection(out, SectionFileMeta)
+	n := uint32(0)
+	for _, idmap := range idmaps {
+		for _, r := range idmap {
+			n += r.hi - r.lo
+		}
+	}
+	out.writeUint32(n)
+	w := newMetaTableWriter()
+	for i, ix := range ixes {
+		s := ix.Section(SectionFileMeta)
+		tables := ix.metaTables()
+		for _, r := range idmaps[i] {
+			for j := r.lo; j < r.hi; j++ {
+				rec := s[4+j*metaRecordSize:]
+				w.writeRecord(out,
+					binary.BigEndian.Uint32(rec),
+					binary.BigEndian.Uint32(rec[4:]),
+					tables.packages[binary.BigEndian.Uint32(rec[8:])],
+					tables.languages[binary.BigEndian.Uint16(rec[12:])],
+					int(binary.BigEndian.Uint16(rec[14:])))
+			}
+		}
+	}
+	w.writeTables(out)
+	t.endSection(out)
+}
+
+// metaTables are the decoded name lists of the metadata section.
+type metaTables struct {
+	packages  []string
+	languages []string
+}
+
+// readNames reads a list of count NUL-terminated names from the start of d
+// and returns the rest of d.
+func readNames(file string, d []byte) ([]string, []byte) {
+	if len(d) < 4 {
+		corrupt(file)
+	}
+	count := binary.BigEndian.Uint32(d)
+	d = d[4:]
+	names := make([]string, count)
+	for i := range names {
+		end := bytes.IndexByte(d, 0)
+		if end < 0 {
+			corrupt(file)
+		}
+		names[i] = string(d[:end])
+		d = d[end+1:]
+	}
+	return names, d
+}
+
+// metaTables returns the name lists of the metadata section, which are
+// decoded on first use.
+func (ix *Index) metaTables() *metaTables {
+	ix.metaOnce.Do(func() {
+		s := ix.Section(SectionFileMeta)
+		if s == nil {
+			return
+		}
+		if len(s) < 4 || binary.BigEndian.Uint32(s) != uint32(ix.numName) || len(s) < 4+ix.numName*metaRecordSize {
+			corrupt(ix.File)
+		}
+		t := &metaTables{}
+		rest := s[4+ix.numName*metaRecordSize:]
+		t.packages, rest = readNames(ix.File, rest)
+		t.languages, _ = readNames(ix.File, rest)
+		ix.meta = t
+	})
+	return ix.meta
+}
+
+// HasFileMeta returns true if the index contains file metadata.
+func (ix *Index) HasFileMeta() bool {
+	return ix.metaTables() != nil
+}
+
+// FileMeta returns the metadata of the given file. The second return value
+// is false if the index does not contain metadata.
+func (ix *Index) FileMeta(fileid uint32) (FileMeta, bool) {
+	tables := ix.metaTables()
+	if tables == nil {
+		return FileMeta{}, false
+	}
+	if int(fileid) >= ix.numName {
+		corrupt(ix.File)
+	}
+	r := ix.Section(SectionFileMeta)[4+int(fileid)*metaRecordSize:]
+	pkg := binary.BigEndian.Uint32(r[8:])
+	language := binary.BigEndian.Uint16(r[12:])
+	if int(pkg) >= len(tables.packages) || int(language) >= len(tables.languages) {
+		corrupt(ix.File)
+	}
+	meta := FileMeta{
+		Size:     int64(binary.BigEndian.Uint32(r)),
+		Language: tables.languages[language],
+		Package:  tables.packages[pkg],
+		Depth:    int(binary.BigEndian.Uint16(r[14:])),
+	}
+	if mtime := binary.BigEndian.Uint32(r[4:]); mtime != 0 {
+		meta.ModTime = time.Unix(int64(mtime), 0)
+	}
+	return meta, true
+}
@@ -0,0 +1,75 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-meta-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Unix(1400000000, 0)
+	add := func(ix *IndexWriter, name, contents, language string) {
+		path := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := ix.AddFileMeta(path, name, FileMeta{Language: language}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := filepath.Join(dir, "first.idx")
+	ix := Create(first)
+	add(ix, "i3-wm_4.7.2-1/src/main.c", "int main() {}\n", "c")
+	add(ix, "i3-wm_4.7.2-1/README", "i3 is a tiling window manager\n", "unknown")
+	ix.Flush()
+
+	second := filepath.Join(dir, "second.idx")
+	ix = Create(second)
+	add(ix, "zsh_5.0.7-5/Src/main.c", "int main() {}\n", "c")
+	ix.Flush()
+
+	all := filepath.Join(dir, "all.idx")
+	ConcatN(all, first, second)
+
+	want := map[string]FileMeta{
+		"i3-wm_4.7.2-1/src/main.c": {14, mtime, "c", "i3-wm_4.7.2-1", 2},
+		"i3-wm_4.7.2-1/README":     {30, mtime, "unknown", "i3-wm_4.7.2-1", 1},
+		"zsh_5.0.7-5/Src/main.c":   {14, mtime, "c", "zsh_5.0.7-5", 2},
+	}
+	for _, path := range []string{first, second, all} {
+		r := Open(path)
+		for i := 0; i < r.numName; i++ {
+			name := r.Name(uint32(i))
+			got, ok := r.FileMeta(uint32(i))
+			if !ok {
+				t.Fatalf("%s: FileMeta(%s) not found", path, name)
+			}
+			if !reflect.DeepEqual(got, want[name]) {
+				t.Errorf("%s: FileMeta(%s) = %+v, want %+v", path, name, got, want[name])
+			}
+		}
+		r.Close()
+	}
+
+	// Indexes written without AddFileMeta do not have metadata.
+	plain := filepath.Join(dir, "plain.idx")
+	buildIndex(plain, nil, postFiles)
+	r := Open(plain)
+	defer r.Close()
+	if _, ok := r.FileMeta(0); ok || r.HasFileMeta() {
+		t.Errorf("index without metadata claims to have it")
+	}
+}
@@ -37,3 +37,14 @@ func mmapFile(f *os.File) mmapData {
 	}
 	return mmapData{f, data[:n]}
 }
+
+// willNeed asks the kernel to read d (which must start at a page boundary)
+// into the page cache ahead of time.
+func willNeed(d []byte) {
+	if len(d) == 0 {
+		return
+	}
+	if err := syscall.Madvise(d, syscall.MADV_WILLNEED); err != nil {
+		log.Printf("madvise: %v", err)
+	}
+}
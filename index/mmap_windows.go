@@ -35,3 +35,6 @@ func mmapFile(f *os.File) mmapData {
 	data := (*[1 << 30]byte)(unsafe.Pointer(addr))
 	return mmapData{f, data[:size]}
 }
+
+// willNeed is a no-op on Windows, the pages are faulted in on first access.
+func willNeed(d []byte) {}
@@ -0,0 +1,147 @@
+package index
+
+// Normalized trigrams.
+//
+// The same identifier can be written in different ways in non-ASCII text:
+// "é" is either U+00E9 or "e" followed by U+0301, and case folding is not
+// limited to ASCII letters. An IndexWriter with Normalize set additionally
+// records the trigrams of each file after converting it to Unicode
+// normalization form C (NFC) and lowercasing it using the Unicode rules (see
+// lowerRune), so that NormalizedRegexpQuery can look up all spellings of a
+// literal at once.
+// Indexes written this way have FeatureNormalize set in their trailer.
+//
+// As with FoldCase, the original trigrams are still recorded, so line
+// offsets and Bloom filters refer to the unmodified file and the index can be
+// used for all other queries, too.
+
+import (
+	"io"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// lowerRune returns the lowercase form of r. Unlike unicode.ToLower, it maps
+// all runes which are equal under case folding to the same rune, e.g. both σ
+// and the final sigma ς to σ.
+func lowerRune(r rune) rune {
+	return unicode.ToLower(unicode.ToUpper(r))
+}
+
+// normalizer collects the trigrams of the normalized text of a file. The
+// text is written to it NFC-normalized, see newNormalizer.
+type normalizer struct {
+	trigrams map[uint32]bool
+	tv       uint32
+	n        int
+	pending  []byte // incomplete UTF-8 sequence at the end of the last write
+}
+
+// newNormalizer returns a normalizer and the writer which NFC-normalizes the
+// original text for it.
+func newNormalizer() (*normalizer, io.WriteCloser) {
+	nz := &normalizer{trigrams: make(map[uint32]bool)}
+	return nz, norm.NFC.Writer(nz)
+}
+
+func (nz *normalizer) addByte(c byte) {
+	nz.tv = (nz.tv<<8 | uint32(c)) & (1<<24 - 1)
+	if nz.n++; nz.n >= 3 {
+		nz.trigrams[nz.tv] = true
+	}
+}
+
+// Write lowercases the NFC-normalized text p and records its trigrams.
+func (nz *normalizer) Write(p []byte) (int, error) {
+	nz.pending = append(nz.pending, p...)
+	b := nz.pending
+	var enc [utf8.UTFMax]byte
+	for len(b) > 0 && utf8.FullRune(b) {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			// Files which are not valid UTF-8 are not indexed anyway.
+			nz.addByte(b[0])
+		} else {
+			for _, c := range enc[:utf8.EncodeRune(enc[:], lowerRune(r))] {
+				nz.addByte(c)
+			}
+		}
+		b = b[size:]
+	}
+	nz.pending = append(nz.pending[:0], b...)
+	return len(p), nil
+}
+
+// Normalizes returns true if the index contains normalized trigrams, i.e. if
+// it was written with Normalize set.
+func (ix *Index) Normalizes() bool {
+	return ix.features&FeatureNormalize != 0
+}
+
+// NormalizedRegexpQuery is like RegexpQuery, but looks up the trigrams of
+// the NFC-normalized, lowercased literals of re. Since all letters are
+// lowercased, the query matches regardless of whether re is case-sensitive.
+// The returned query must only be used with indexes for which Normalizes
+// returns true.
+func NormalizedRegexpQuery(re *syntax.Regexp) *Query {
+	return RegexpQuery(normalizeRegexp(re))
+}
+
+// CaseInsensitive returns true if any part of re is case-insensitive, i.e.
+// if NormalizedRegexpQuery (or FoldedRegexpQuery) is worth using.
+func CaseInsensitive(re *syntax.Regexp) bool {
+	if re.Flags&syntax.FoldCase != 0 {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if CaseInsensitive(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxNormalizedRange is the size of the largest character class range whose
+// runes are lowercased individually. Classes with more than 100 runes make
+// RegexpQuery match any character anyway.
+const maxNormalizedRange = 100
+
+// normalizeRegexp returns a copy of re in which literals are NFC-normalized
+// and lowercased and character classes also contain the lowercase variants
+// of their runes.
+func normalizeRegexp(re *syntax.Regexp) *syntax.Regexp {
+	re1 := *re
+	re1.Flags &^= syntax.FoldCase
+	switch re.Op {
+	case syntax.OpLiteral:
+		re1.Rune = []rune(strings.Map(lowerRune, norm.NFC.String(string(re.Rune))))
+		return &re1
+
+	case syntax.OpCharClass:
+		re1.Rune = append([]rune{}, re.Rune...)
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if hi-lo >= maxNormalizedRange {
+				continue
+			}
+			for r := lo; r <= hi; r++ {
+				if l := lowerRune(r); l != r {
+					re1.Rune = append(re1.Rune, l, l)
+				}
+			}
+		}
+		return &re1
+	}
+
+	if len(re.Sub) > 0 {
+		re1.Sub = make([]*syntax.Regexp, len(re.Sub))
+		for i, sub := range re.Sub {
+			re1.Sub[i] = normalizeRegexp(sub)
+		}
+	}
+	return &re1
+}
@@ -0,0 +1,96 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp/syntax"
+	"strings"
+	"testing"
+)
+
+var normalizeFiles = map[string]string{
+	"file0": "\u00e9tat := 1",                     // é as a single rune
+	"file1": "E\u0301TAT = 2",                     // É as E followed by a combining accent
+	"file2": "etat = 3",                           // no accent at all
+	"file3": "\u03a3\u039f\u03a6\u0399\u0391 = 4", // ΣΟΦΙΑ
+}
+
+func normalizedQuery(t *testing.T, expr string) *Query {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NormalizedRegexpQuery(re)
+}
+
+func TestNormalizedRegexpQuery(t *testing.T) {
+	for _, test := range []struct {
+		expr string
+		want string
+	}{
+		{"ABCD", `"abc" "bcd"`},
+		{"(?i)abcd", `"abc" "bcd"`},
+		// The decomposed É is composed and lowercased.
+		{"E\u0301t", `"ét"`},
+		// Parsing (?i) turns ι into U+0345, which has no lowercase form.
+		{"(?i)\u03b9\u03b1b", `"\xb9α" "αb" "ι\xce"`},
+		// Final sigma is the same letter as σ.
+		{"\u03c2ab", `"\x83ab" "σa"`},
+		{"[A-C]bc", `("Abc"|"Bbc"|"Cbc"|"abc"|"bbc"|"cbc")`},
+	} {
+		if got := normalizedQuery(t, test.expr).String(); got != test.want {
+			t.Errorf("NormalizedRegexpQuery(%q) = %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+
+	ix := Create(out)
+	ix.Normalize = true
+	for _, name := range []string{"file0", "file1", "file2", "file3"} {
+		ix.Add(name, strings.NewReader(normalizeFiles[name]))
+	}
+	ix.Flush()
+
+	h, err := ReadHeader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Features&FeatureNormalize == 0 {
+		t.Errorf("Features = %#x, want FeatureNormalize set", h.Features)
+	}
+	r := Open(out)
+	defer r.Close()
+	if !r.Normalizes() {
+		t.Fatalf("Normalizes() = false, want true")
+	}
+	for _, test := range []struct {
+		expr string
+		want []uint32
+	}{
+		{"(?i)état", []uint32{0, 1}},
+		{"état", []uint32{0, 1}},
+		{"(?i)etat", []uint32{2}},
+		{"(?i)\u03c3\u03bf\u03c6\u03b9\u03b1", []uint32{3}}, // σοφια
+		{"\u03c3\u03bf\u03c6\u03b9\u03b1", []uint32{3}},
+	} {
+		if l := r.PostingQuery(normalizedQuery(t, test.expr)); !equalList(l, test.want) {
+			t.Errorf("PostingQuery(%q) = %v, want %v", test.expr, l, test.want)
+		}
+	}
+	// The original trigrams are still there for other queries.
+	re, err := syntax.Parse("ETAT", syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := r.PostingQuery(RegexpQuery(re)); !equalList(l, []uint32{}) {
+		t.Errorf("PostingQuery(ETAT) = %v, want []", l)
+	}
+	if l := r.PostingQuery(normalizedQuery(t, "ETAT")); !equalList(l, []uint32{2}) {
+		t.Errorf("normalized PostingQuery(ETAT) = %v, want [2]", l)
+	}
+}
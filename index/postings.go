@@ -0,0 +1,125 @@
+package index
+
+// Operations on posting lists.
+//
+// The functions in this file combine decoded posting lists, i.e. lists of
+// file IDs sorted in ascending order without duplicates, as returned by
+// PostingList and PostingQuery. They never modify their arguments.
+//
+// The inner loops only compare and advance, without calls or allocations, so
+// that the compiler can keep everything in registers. When one list is much
+// shorter than the other, PostingAnd and PostingAndNot skip through the
+// longer list with exponential search instead of looking at every entry.
+
+import "sort"
+
+// gallopRatio is the length ratio from which on the longer list is searched
+// instead of scanned. Scanning is cheaper per entry, so searching only pays
+// off when it skips many entries.
+const gallopRatio = 32
+
+// gallop returns the index of the first entry of list which is >= x,
+// starting the search at i.
+func gallop(list []uint32, i int, x uint32) int {
+	step := 1
+	for i+step < len(list) && list[i+step] < x {
+		i += step
+		step *= 2
+	}
+	end := i + step + 1
+	if end > len(list) {
+		end = len(list)
+	}
+	return i + sort.Search(end-i, func(k int) bool { return list[i+k] >= x })
+}
+
+// PostingAnd returns the IDs which are contained in both a and b.
+func PostingAnd(a, b []uint32) []uint32 {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	result := make([]uint32, 0, len(a))
+	if len(b)/len(a) >= gallopRatio {
+		j := 0
+		for _, x := range a {
+			if j = gallop(b, j, x); j == len(b) {
+				break
+			}
+			if b[j] == x {
+				result = append(result, x)
+			}
+		}
+		return result
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		x, y := a[i], b[j]
+		if x == y {
+			result = append(result, x)
+		}
+		if x <= y {
+			i++
+		}
+		if x >= y {
+			j++
+		}
+	}
+	return result
+}
+
+// PostingOr returns the IDs which are contained in a, b or both.
+func PostingOr(a, b []uint32) []uint32 {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	result := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		x, y := a[i], b[j]
+		if x <= y {
+			result = append(result, x)
+			i++
+		} else {
+			result = append(result, y)
+		}
+		if x >= y {
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// PostingAndNot returns the IDs which are contained in a, but not in b.
+func PostingAndNot(a, b []uint32) []uint32 {
+	if len(a) == 0 {
+		return nil
+	}
+	result := make([]uint32, 0, len(a))
+	if len(b)/len(a) >= gallopRatio {
+		j := 0
+		for _, x := range a {
+			if j = gallop(b, j, x); j == len(b) || b[j] != x {
+				result = append(result, x)
+			}
+		}
+		return result
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		x, y := a[i], b[j]
+		if x < y {
+			result = append(result, x)
+		}
+		if x <= y {
+			i++
+		}
+		if x >= y {
+			j++
+		}
+	}
+	return append(result, a[i:]...)
+}
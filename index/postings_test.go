@@ -0,0 +1,102 @@
+package index
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// naivePostings combines a and b element by element using op.
+func naivePostings(a, b []uint32, op func(inA, inB bool) bool) []uint32 {
+	inA := make(map[uint32]bool)
+	inB := make(map[uint32]bool)
+	max := uint32(0)
+	for _, x := range a {
+		inA[x] = true
+		if x > max {
+			max = x
+		}
+	}
+	for _, x := range b {
+		inB[x] = true
+		if x > max {
+			max = x
+		}
+	}
+	var result []uint32
+	for x := uint32(0); x <= max; x++ {
+		if op(inA[x], inB[x]) {
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+// randomPostings returns n sorted IDs with random gaps, about max/n apart.
+func randomPostings(r *rand.Rand, n, max int) []uint32 {
+	list := make([]uint32, n)
+	id := uint32(0)
+	for i := range list {
+		id += 1 + uint32(r.Intn(2*max/(n+1)+1))
+		list[i] = id
+	}
+	return list
+}
+
+func TestPostingOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sizes := []int{0, 1, 2, 10, 100, 1000}
+	for _, n := range sizes {
+		for _, m := range sizes {
+			a := randomPostings(r, n, 2000)
+			b := randomPostings(r, m, 2000)
+			for _, test := range []struct {
+				name string
+				f    func(a, b []uint32) []uint32
+				op   func(inA, inB bool) bool
+			}{
+				{"PostingAnd", PostingAnd, func(inA, inB bool) bool { return inA && inB }},
+				{"PostingOr", PostingOr, func(inA, inB bool) bool { return inA || inB }},
+				{"PostingAndNot", PostingAndNot, func(inA, inB bool) bool { return inA && !inB }},
+			} {
+				got := test.f(a, b)
+				want := naivePostings(a, b, test.op)
+				if len(got) != 0 || len(want) != 0 {
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%s(%d IDs, %d IDs) = %v, want %v", test.name, n, m, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func benchmarkPostings(b *testing.B, f func(a, b []uint32) []uint32, n, m int) {
+	r := rand.New(rand.NewSource(1))
+	x := randomPostings(r, n, 1<<20)
+	y := randomPostings(r, m, 1<<20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f(x, y)
+	}
+}
+
+func BenchmarkPostingAnd(b *testing.B) {
+	benchmarkPostings(b, PostingAnd, 100000, 100000)
+}
+
+func BenchmarkPostingAndSkewed(b *testing.B) {
+	benchmarkPostings(b, PostingAnd, 100, 100000)
+}
+
+func BenchmarkPostingOr(b *testing.B) {
+	benchmarkPostings(b, PostingOr, 100000, 100000)
+}
+
+func BenchmarkPostingAndNot(b *testing.B) {
+	benchmarkPostings(b, PostingAndNot, 100000, 100000)
+}
+
+func BenchmarkPostingAndNotSkewed(b *testing.B) {
+	benchmarkPostings(b, PostingAndNot, 100, 100000)
+}
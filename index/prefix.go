@@ -0,0 +1,68 @@
+package index
+
+// Listing files by name, e.g. to browse the files of a package.
+
+import (
+	"sort"
+	"strings"
+)
+
+// NamesWithPrefix returns the names of the files whose name starts with prefix
+// (e.g. all files of a package, "i3-wm_4.7.2-1/"), in lexical order. As the
+// files are sorted by name, they are found without looking at all names.
+func (ix *Index) NamesWithPrefix(prefix string) []string {
+	first := sort.Search(ix.numName, func(i int) bool {
+		return string(ix.NameBytes(uint32(i))) >= prefix
+	})
+	var names []string
+	for fileid := first; fileid < ix.numName; fileid++ {
+		name := ix.Name(uint32(fileid))
+		if !strings.HasPrefix(name, prefix) {
+			break
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// NamesWithPrefix is like Index.NamesWithPrefix, but returns the names of all
+// segments, except for tombstoned files.
+func (s *Segments) NamesWithPrefix(prefix string) []string {
+	var names []string
+	for i, ix := range s.ixes {
+		for _, name := range ix.NamesWithPrefix(prefix) {
+			if !s.isDead(i, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FileID returns the ID of the file with the given name. The second return
+// value is false if the index does not contain the file.
+func (ix *Index) FileID(name string) (uint32, bool) {
+	fileid := sort.Search(ix.numName, func(i int) bool {
+		return string(ix.NameBytes(uint32(i))) >= name
+	})
+	if fileid == ix.numName || ix.Name(uint32(fileid)) != name {
+		return 0, false
+	}
+	return uint32(fileid), true
+}
+
+// Lookup returns the segment which contains the file with the given name and
+// the ID of the file within it, ignoring tombstoned files. The last return
+// value is false if no segment contains the file.
+func (s *Segments) Lookup(name string) (*Index, uint32, bool) {
+	for i, ix := range s.ixes {
+		if s.isDead(i, name) {
+			continue
+		}
+		if fileid, ok := ix.FileID(name); ok {
+			return ix, fileid, true
+		}
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,81 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNamesWithPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-prefix-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.idx")
+	buildIndex(first, nil, map[string]string{
+		"a_1/main.c":     "\nabc\n",
+		"a_1/src/util.c": "\nabc\n",
+		"ab_1/main.c":    "\nabc\n",
+		"b_1/main.c":     "\nabc\n",
+	})
+	ix := Open(first)
+	for _, test := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"a_1/", []string{"a_1/main.c", "a_1/src/util.c"}},
+		{"a_1/src/", []string{"a_1/src/util.c"}},
+		{"b_1/", []string{"b_1/main.c"}},
+		{"c_1/", nil},
+		{"0_1/", nil},
+	} {
+		if got := ix.NamesWithPrefix(test.prefix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("NamesWithPrefix(%q) = %v, want %v", test.prefix, got, test.want)
+		}
+	}
+	for fileid, name := range []string{"a_1/main.c", "a_1/src/util.c", "ab_1/main.c", "b_1/main.c"} {
+		if got, ok := ix.FileID(name); !ok || got != uint32(fileid) {
+			t.Errorf("FileID(%q) = %d, %v, want %d", name, got, ok, fileid)
+		}
+	}
+	for _, name := range []string{"a_1/", "a_1/main", "c_1/main.c"} {
+		if got, ok := ix.FileID(name); ok {
+			t.Errorf("FileID(%q) = %d, want no file", name, got)
+		}
+	}
+	ix.Close()
+
+	// Replace a_1 in a new segment, which hides the files of the old one.
+	second := filepath.Join(dir, "second.idx")
+	buildIndex(second, nil, map[string]string{
+		"a_1/other.c": "\nabc\n",
+	})
+	seg := filepath.Join(dir, "seg")
+	if err := AppendSegment(seg, first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendSegment(seg, second, []string{"a_1/"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSegments(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, want := s.NamesWithPrefix("a_1/"), []string{"a_1/other.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Segments.NamesWithPrefix(%q) = %v, want %v", "a_1/", got, want)
+	}
+	if ix, fileid, ok := s.Lookup("a_1/other.c"); !ok || ix.Name(fileid) != "a_1/other.c" {
+		t.Errorf("Segments.Lookup(%q) = %d, %v, want the file of the second segment", "a_1/other.c", fileid, ok)
+	}
+	if _, _, ok := s.Lookup("a_1/main.c"); ok {
+		t.Errorf("Segments.Lookup(%q) found a tombstoned file", "a_1/main.c")
+	}
+	if ix, fileid, ok := s.Lookup("b_1/main.c"); !ok || ix.Name(fileid) != "b_1/main.c" {
+		t.Errorf("Segments.Lookup(%q) = %d, %v, want the file of the first segment", "b_1/main.c", fileid, ok)
+	}
+}
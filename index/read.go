@@ -63,14 +63,18 @@ package index
 //	offset of name index [4]
 //	offset of posting list index [4]
 //	"\ncsearch trailr\n"
+//
+// This is version 1 of the format, see version.go for later versions.
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"log"
 	"os"
 	"runtime"
 	"sort"
+	"sync"
 	"syscall"
 )
 
@@ -84,47 +88,123 @@ type Index struct {
 	File      string
 	Verbose   bool
 	data      mmapData
-	pathData  uint32
-	nameData  uint32
-	postData  uint32
-	nameIndex uint32
-	postIndex uint32
+	pathData  uint64
+	nameData  uint64
+	postData  uint64
+	nameIndex uint64
+	postIndex uint64
 	numName   int
 	numPost   int
-}
+	version   int
+	features  Features
+	postEnd   uint64
+
+	// Size of the offsets and of the posting list index entries, which
+	// depend on the version.
+	offSize   uint64
+	entrySize uint64
+
+	metaOnce sync.Once
+	meta     *metaTables
 
-const postEntrySize = 3 + 4 + 4
+	// Original file of each duplicate, see dedup.go.
+	dupOnce   sync.Once
+	originals map[uint32]uint32
+
+	// Block tables of the name list and the posting lists if the index is
+	// compressed, see compress.go.
+	blocks []blockTable
+
+	// ID of the key the index file is encrypted with, see encrypt.go.
+	keyID string
+}
 
+// Open opens the index in file, which can use any supported format version.
+// It exits the program if the index cannot be read, use ReadHeader to check
+// for that beforehand.
 func Open(file string) *Index {
-	mm := mmap(file)
-	if len(mm.d) < 4*4+len(trailerMagic) || string(mm.d[len(mm.d)-len(trailerMagic):]) != trailerMagic {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return openFile(f)
+}
+
+// openFile is like Open, but uses the already opened index file f, which it
+// takes ownership of.
+func openFile(f *os.File) *Index {
+	file := f.Name()
+	mm := mmapFile(f)
+	var keyID string
+	if encrypted(mm.d) {
+		plain, id, err := decryptIndex(mm.d)
+		if err != nil {
+			log.Fatalf("%s: %v", file, err)
+		}
+		mm.unmap()
+		mm = mmapData{d: plain}
+		keyID = id
+	}
+	h, err := parseHeader(int64(len(mm.d)), mm.d, tail(mm.d))
+	if err == ErrCorrupt {
 		corrupt(file)
 	}
-	n := uint32(len(mm.d) - len(trailerMagic) - 5*4)
-	ix := &Index{data: mm}
+	if err != nil {
+		log.Fatalf("%s: %v", file, err)
+	}
+	ix := &Index{data: mm, keyID: keyID}
 	ix.File = file
-	ix.pathData = ix.uint32(n)
-	ix.nameData = ix.uint32(n + 4)
-	ix.postData = ix.uint32(n + 8)
-	ix.nameIndex = ix.uint32(n + 12)
-	ix.postIndex = ix.uint32(n + 16)
-	ix.numName = int((ix.postIndex-ix.nameIndex)/4) - 1
-	ix.numPost = int((n - ix.postIndex) / postEntrySize)
+	ix.version = h.Version
+	ix.features = h.Features
+	ix.pathData = h.off[0]
+	ix.nameData = h.off[1]
+	ix.postData = h.off[2]
+	ix.nameIndex = h.off[3]
+	ix.postIndex = h.off[4]
+	ix.postEnd = h.postEnd
+	ix.offSize = offsetSize(h.Version)
+	ix.entrySize = postEntrySize(h.Version)
+	ix.numName = int((ix.postIndex-ix.nameIndex)/ix.offSize) - 1
+	ix.numPost = int((ix.postEnd - ix.postIndex) / ix.entrySize)
+	if ix.Compressed() {
+		ix.initBlocks()
+	}
 	return ix
 }
 
+// OpenMmap is like Open, but additionally reads the name index and the posting
+// list index, which every query needs, into the page cache right away. This
+// avoids slow first queries after starting to serve a cold shard. As with
+// Open, the file is mapped read-only and shared, so all goroutines (and
+// processes) using the same shard share its pages.
+func OpenMmap(file string) *Index {
+	ix := Open(file)
+	ix.advise(ix.nameIndex, int(ix.postEnd-ix.nameIndex))
+	return ix
+}
+
+// advise calls willNeed for the n bytes at off, extended to the page boundary.
+func (ix *Index) advise(off uint64, n int) {
+	start := int(off) &^ 4095
+	end := int(off) + n
+	if n <= 0 || end > len(ix.data.orig) {
+		return
+	}
+	willNeed(ix.data.orig[start:end])
+}
+
 func (ix *Index) Close() {
-	if err := syscall.Munmap(ix.data.orig); err != nil {
-		log.Fatalf("munmap: %v", err)
+	if ix.blocks != nil {
+		blocks.drop(ix)
 	}
-	ix.data.f.Close()
+	ix.data.unmap()
 }
 
 // slice returns the slice of index data starting at the given byte offset.
 // If n >= 0, the slice must have length at least n and is truncated to length n.
-func (ix *Index) slice(off uint32, n int) []byte {
+func (ix *Index) slice(off uint64, n int) []byte {
 	o := int(off)
-	if uint32(o) != off || n >= 0 && o+n > len(ix.data.d) {
+	if uint64(o) != off || o > len(ix.data.d) || n >= 0 && o+n > len(ix.data.d) {
 		corrupt(ix.File)
 	}
 	if n < 0 {
@@ -134,12 +214,18 @@ func (ix *Index) slice(off uint32, n int) []byte {
 }
 
 // uint32 returns the uint32 value at the given offset in the index data.
-func (ix *Index) uint32(off uint32) uint32 {
+func (ix *Index) uint32(off uint64) uint32 {
 	return binary.BigEndian.Uint32(ix.slice(off, 4))
 }
 
+// offset returns the offset (whose size depends on the version) at the given
+// offset in the index data.
+func (ix *Index) offset(off uint64) uint64 {
+	return getOffset(ix.slice(off, int(ix.offSize)), ix.offSize)
+}
+
 // uvarint returns the varint value at the given offset in the index data.
-func (ix *Index) uvarint(off uint32) uint32 {
+func (ix *Index) uvarint(off uint64) uint32 {
 	v, n := binary.Uvarint(ix.slice(off, -1))
 	if n <= 0 {
 		corrupt(ix.File)
@@ -157,18 +243,17 @@ func (ix *Index) Paths() []string {
 			break
 		}
 		x = append(x, string(s))
-		off += uint32(len(s) + 1)
+		off += uint64(len(s) + 1)
 	}
 	return x
 }
 
 // NameBytes returns the name corresponding to the given fileid.
 func (ix *Index) NameBytes(fileid uint32) []byte {
-	off := ix.uint32(ix.nameIndex + 4*fileid)
-	return ix.str(ix.nameData + off)
+	return ix.nameAt(ix.offset(ix.nameIndex + ix.offSize*uint64(fileid)))
 }
 
-func (ix *Index) str(off uint32) []byte {
+func (ix *Index) str(off uint64) []byte {
 	str := ix.slice(off, -1)
 	i := bytes.IndexByte(str, '\x00')
 	if i < 0 {
@@ -182,51 +267,45 @@ func (ix *Index) Name(fileid uint32) string {
 	return string(ix.NameBytes(fileid))
 }
 
-// listAt returns the index list entry at the given offset.
-func (ix *Index) listAt(off uint32) (trigram, count, offset uint32) {
-	d := ix.slice(ix.postIndex+off, postEntrySize)
+// listAt returns the i-th entry of the posting list index.
+func (ix *Index) listAt(i int) (trigram, count uint32, offset uint64) {
+	d := ix.slice(ix.postIndex+uint64(i)*ix.entrySize, int(ix.entrySize))
 	trigram = uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2])
 	count = binary.BigEndian.Uint32(d[3:])
-	offset = binary.BigEndian.Uint32(d[3+4:])
+	offset = getOffset(d[3+4:], ix.offSize)
 	return
 }
 
 func (ix *Index) dumpPosting() {
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
 	for i := 0; i < ix.numPost; i++ {
-		j := i * postEntrySize
-		t := uint32(d[j])<<16 | uint32(d[j+1])<<8 | uint32(d[j+2])
-		count := int(binary.BigEndian.Uint32(d[j+3:]))
-		offset := binary.BigEndian.Uint32(d[j+3+4:])
+		t, count, offset := ix.listAt(i)
 		log.Printf("%#x: %d at %d", t, count, offset)
 	}
 }
 
-func (ix *Index) findList(trigram uint32) (count int, offset uint32) {
+func (ix *Index) findList(trigram uint32) (count int, offset uint64) {
 	// binary search
-	d := ix.slice(ix.postIndex, postEntrySize*ix.numPost)
+	size := int(ix.entrySize)
+	d := ix.slice(ix.postIndex, size*ix.numPost)
 	i := sort.Search(ix.numPost, func(i int) bool {
-		i *= postEntrySize
+		i *= size
 		t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
 		return t >= trigram
 	})
 	if i >= ix.numPost {
 		return 0, 0
 	}
-	i *= postEntrySize
-	t := uint32(d[i])<<16 | uint32(d[i+1])<<8 | uint32(d[i+2])
+	t, n, offset := ix.listAt(i)
 	if t != trigram {
 		return 0, 0
 	}
-	count = int(binary.BigEndian.Uint32(d[i+3:]))
-	offset = binary.BigEndian.Uint32(d[i+3+4:])
-	return
+	return int(n), offset
 }
 
 type postReader struct {
 	ix       *Index
 	count    int
-	offset   uint32
+	offset   uint64
 	fileid   uint32
 	d        []byte
 	restrict []uint32
@@ -234,15 +313,21 @@ type postReader struct {
 
 func (r *postReader) init(ix *Index, trigram uint32, restrict []uint32) {
 	count, offset := ix.findList(trigram)
+	r.initAt(ix, uint32(count), offset)
+	r.restrict = restrict
+}
+
+// initAt is like init, but takes the entry of the posting list index instead
+// of looking up a trigram.
+func (r *postReader) initAt(ix *Index, count uint32, offset uint64) {
 	if count == 0 {
 		return
 	}
 	r.ix = ix
-	r.count = count
+	r.count = int(count)
 	r.offset = offset
 	r.fileid = ^uint32(0)
-	r.d = ix.slice(ix.postData+offset+3, -1)
-	r.restrict = restrict
+	r.d = ix.postingData(offset, count)
 }
 
 func (r *postReader) max() int {
@@ -309,8 +394,22 @@ func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) []u
 	return myPostingOr(r.d, r.max(), list, restrict)
 }
 
+// PostingQuery returns the files which may match q, including the
+// duplicates of matching files (see dedup.go).
 func (ix *Index) PostingQuery(q *Query) []uint32 {
-	return ix.postingQuery(q, nil)
+	post, _ := ix.PostingQueryContext(context.Background(), q)
+	return post
+}
+
+// PostingQueryContext is like PostingQuery, but stops reading posting lists
+// and returns ctx.Err() once ctx is done, e.g. because the query was
+// cancelled.
+func (ix *Index) PostingQueryContext(ctx context.Context, q *Query) ([]uint32, error) {
+	list := ix.postingQuery(ctx, q, nil)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return ix.withDuplicates(list), nil
 }
 
 // Implements sort.Interface
@@ -334,7 +433,45 @@ func (t trigramCnts) Swap(i, j int) {
 	t[i], t[j] = t[j], t[i]
 }
 
-func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
+// A TrigramEstimate is the number of files whose posting list contains a
+// trigram.
+type TrigramEstimate struct {
+	Trigram string
+	Files   int
+}
+
+// Plan returns how many files contain each of trigrams according to the
+// posting list index, ordered from the rarest to the most common trigram.
+// This is the order in which PostingQuery intersects the posting lists of a
+// QAnd query: starting with the shortest list keeps the intermediate results
+// (and the data read for them) small.
+func (ix *Index) Plan(trigrams []string) []TrigramEstimate {
+	withCount := ix.plan(trigrams)
+	estimates := make([]TrigramEstimate, len(withCount))
+	for i, t := range withCount {
+		estimates[i] = TrigramEstimate{
+			Trigram: string([]byte{byte(t.trigram >> 16), byte(t.trigram >> 8), byte(t.trigram)}),
+			Files:   t.count,
+		}
+	}
+	return estimates
+}
+
+// "Query planner": we sort the posting lists by their length (ascending).
+// Only the posting list index is read, not the lists themselves.
+func (ix *Index) plan(trigrams []string) trigramCnts {
+	withCount := make(trigramCnts, len(trigrams))
+	for idx, t := range trigrams {
+		tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
+		count, _ := ix.findList(tri)
+		withCount[idx] = trigramCnt{tri, count, 0}
+	}
+	sort.Stable(withCount)
+	return withCount
+}
+
+// postingQuery returns nil once ctx is done, see PostingQueryContext.
+func (ix *Index) postingQuery(ctx context.Context, q *Query, restrict []uint32) (ret []uint32) {
 	var list []uint32
 	switch q.Op {
 	case QNone:
@@ -349,18 +486,13 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 		}
 		return list
 	case QAnd:
-		// "Query planner": we first sort the posting lists by their
-		// length (ascending)
-		withCount := make(trigramCnts, len(q.Trigram))
-		for idx, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
-			count, _ := ix.findList(tri)
-			withCount[idx] = trigramCnt{tri, count, 0}
-		}
-		sort.Sort(withCount)
+		withCount := ix.plan(q.Trigram)
 
 		stoppedAt := 0
 		for idx, t := range withCount {
+			if ctx.Err() != nil {
+				return nil
+			}
 			previous := len(list)
 			if list == nil {
 				list = ix.postingList(t.trigram, restrict)
@@ -387,13 +519,16 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 			if list == nil {
 				list = restrict
 			}
-			list = ix.postingQuery(sub, list)
+			list = ix.postingQuery(ctx, sub, list)
 			if len(list) == 0 {
 				return nil
 			}
 		}
 	case QOr:
 		for _, t := range q.Trigram {
+			if ctx.Err() != nil {
+				return nil
+			}
 			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
 			if list == nil {
 				list = ix.postingList(tri, restrict)
@@ -402,34 +537,13 @@ func (ix *Index) postingQuery(q *Query, restrict []uint32) (ret []uint32) {
 			}
 		}
 		for _, sub := range q.Sub {
-			list1 := ix.postingQuery(sub, restrict)
-			list = mergeOr(list, list1)
+			list1 := ix.postingQuery(ctx, sub, restrict)
+			list = PostingOr(list, list1)
 		}
 	}
 	return list
 }
 
-func mergeOr(l1, l2 []uint32) []uint32 {
-	var l []uint32
-	i := 0
-	j := 0
-	for i < len(l1) || j < len(l2) {
-		switch {
-		case j == len(l2) || (i < len(l1) && l1[i] < l2[j]):
-			l = append(l, l1[i])
-			i++
-		case i == len(l1) || (j < len(l2) && l1[i] > l2[j]):
-			l = append(l, l2[j])
-			j++
-		case l1[i] == l2[j]:
-			l = append(l, l1[i])
-			i++
-			j++
-		}
-	}
-	return l
-}
-
 func corrupt(file string) {
 	log.Fatal("corrupt index: remove " + file)
 }
@@ -441,13 +555,18 @@ type mmapData struct {
 	orig []byte
 }
 
-// mmap maps the given file into memory.
-func mmap(file string) mmapData {
-	f, err := os.Open(file)
-	if err != nil {
-		log.Fatal(err)
+// unmap unmaps the data and closes the file. Data which was not mapped
+// (e.g. a decrypted index) is left to the garbage collector.
+func (m mmapData) unmap() {
+	if m.f == nil {
+		return
+	}
+	if m.orig != nil {
+		if err := syscall.Munmap(m.orig); err != nil {
+			log.Fatalf("munmap: %v", err)
+		}
 	}
-	return mmapFile(f)
+	m.f.Close()
 }
 
 // File returns the name of the index file to use.
@@ -5,8 +5,10 @@
 package index
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -47,6 +49,21 @@ func TestTrivialPosting(t *testing.T) {
 	}
 }
 
+func TestOpenMmap(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, postFiles)
+	ix := OpenMmap(out)
+	defer ix.Close()
+	if l := ix.PostingList(tri('S', 'e', 'a')); !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingList(Sea) = %v, want [1 3]", l)
+	}
+	if name := ix.Name(2); name != "file2" {
+		t.Errorf("Name(2) = %q, want file2", name)
+	}
+}
+
 func equalList(x, y []uint32) bool {
 	if len(x) != len(y) {
 		return false
@@ -58,3 +75,40 @@ func equalList(x, y []uint32) bool {
 	}
 	return true
 }
+
+func TestPlan(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, postFiles)
+	ix := Open(out)
+	defer ix.Close()
+	got := ix.Plan([]string{"Goo", "Sea", "xyz", "Web"})
+	want := []TrigramEstimate{
+		{"xyz", 0},
+		{"Web", 1},
+		{"Sea", 2},
+		{"Goo", 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Plan() = %v, want %v", got, want)
+	}
+}
+
+func TestPostingQueryContext(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	buildIndex(out, nil, postFiles)
+	ix := Open(out)
+	q := &Query{Op: QAnd, Trigram: []string{"Goo", "Sea"}}
+	post, err := ix.PostingQueryContext(context.Background(), q)
+	if err != nil || !equalList(post, []uint32{1, 3}) {
+		t.Errorf("PostingQueryContext(Goo&Sea) = %v, %v, want [1 3]", post, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if post, err := ix.PostingQueryContext(ctx, q); err != context.Canceled || post != nil {
+		t.Errorf("cancelled PostingQueryContext(Goo&Sea) = %v, %v, want nil, %v", post, err, context.Canceled)
+	}
+}
@@ -0,0 +1,404 @@
+package index
+
+// Segmented indexes.
+//
+// Instead of rebuilding one big index with ConcatN whenever packages change,
+// a directory can hold several index files (segments) plus a manifest:
+//
+//	<dir>/MANIFEST          JSON, see Manifest
+//	<dir>/segment.<n>.idx   regular index files
+//
+// New packages are added by writing them into a new segment and appending it
+// to the manifest. Removed or replaced packages are tombstoned: the manifest
+// records their name prefix (e.g. "i3-wm_4.7.2-1/") together with the number
+// of segments that existed at the time, so that files in older segments are
+// hidden while a newer segment can contain the package again.
+//
+// Once in a while, all segments are replaced by a single, freshly merged index
+// (see ResetSegments), which gets rid of the tombstoned files for good. Runs
+// of consecutive segments can also be merged on their own (see
+// ReplaceSegments and TieredPolicy), which keeps the number of segments small
+// without rewriting the large ones over and over.
+//
+// Within a process, the functions which modify the manifest (AppendSegment,
+// AddTombstones, ResetSegments and ReplaceSegments) serialize their
+// read-modify-write of it per directory, so that e.g. a tombstone added while
+// a new segment is appended is not lost. There must only be a single writing
+// process per directory. Readers see either the old or the new manifest,
+// since it is replaced atomically.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const ManifestName = "MANIFEST"
+
+type Tombstone struct {
+	// Name prefix of the hidden files, typically "<package>/".
+	Prefix string
+
+	// The tombstone applies to the first Segments segments.
+	Segments int
+}
+
+type Manifest struct {
+	// File names of the segments (relative to the directory), oldest first.
+	Segments   []string
+	Tombstones []Tombstone
+}
+
+// ReadManifest reads the manifest in dir. A missing manifest is treated as an
+// empty one.
+func ReadManifest(dir string) (*Manifest, error) {
+	var m Manifest
+	b, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return &m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, ManifestName), err)
+	}
+	return &m, nil
+}
+
+var (
+	manifestLocksMu sync.Mutex
+	// Serializes the modifications of the manifest of each directory.
+	manifestLocks = make(map[string]*sync.Mutex)
+)
+
+// Locks the manifest of dir against concurrent modifications and returns the
+// function which unlocks it.
+func lockManifest(dir string) func() {
+	dir = filepath.Clean(dir)
+	manifestLocksMu.Lock()
+	mu, ok := manifestLocks[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		manifestLocks[dir] = mu
+	}
+	manifestLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (m *Manifest) write(dir string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ManifestName+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestName))
+}
+
+func (m *Manifest) tombstone(prefixes []string) {
+	for _, prefix := range prefixes {
+		m.Tombstones = append(m.Tombstones, Tombstone{
+			Prefix:   prefix,
+			Segments: len(m.Segments),
+		})
+	}
+}
+
+// Moves idxPath (which must be on the same file system) into dir under a new
+// segment name and returns that name.
+func moveSegment(dir, idxPath string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("segment.%d.idx", time.Now().UnixNano())
+	if err := os.Rename(idxPath, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// AppendSegment adds the index in idxPath as a new segment to the segmented
+// index in dir. Files whose names start with any of replaces are hidden in all
+// existing segments, which is how packages are updated.
+func AppendSegment(dir, idxPath string, replaces []string) error {
+	defer lockManifest(dir)()
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	name, err := moveSegment(dir, idxPath)
+	if err != nil {
+		return err
+	}
+	m.tombstone(replaces)
+	m.Segments = append(m.Segments, name)
+	return m.write(dir)
+}
+
+// AddTombstones hides all files whose names start with any of prefixes in the
+// segmented index in dir.
+func AddTombstones(dir string, prefixes ...string) error {
+	defer lockManifest(dir)()
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	m.tombstone(prefixes)
+	return m.write(dir)
+}
+
+// ResetSegments replaces all segments and tombstones of the segmented index in
+// dir with the single index in idxPath, e.g. after a full merge.
+func ResetSegments(dir, idxPath string) error {
+	defer lockManifest(dir)()
+	old, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	name, err := moveSegment(dir, idxPath)
+	if err != nil {
+		return err
+	}
+	m := Manifest{Segments: []string{name}}
+	if err := m.write(dir); err != nil {
+		return err
+	}
+	// Readers which still have the old segments open keep working, the data
+	// is only freed once they close them.
+	for _, segment := range old.Segments {
+		os.Remove(filepath.Join(dir, segment))
+	}
+	return nil
+}
+
+// ReplaceSegments replaces the consecutive segments replaced (file names, as
+// in Manifest.Segments) of the segmented index in dir with the index in
+// idxPath, which must contain their files without the tombstoned ones (see
+// Segments.CompactRange). It returns an error without touching the index if
+// the segments are no longer part of the manifest, e.g. because all segments
+// were reset in the meantime.
+func ReplaceSegments(dir string, replaced []string, idxPath string) error {
+	defer lockManifest(dir)()
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	lo := -1
+	for i, segment := range m.Segments {
+		if len(replaced) > 0 && segment == replaced[0] {
+			lo = i
+			break
+		}
+	}
+	hi := lo + len(replaced)
+	if lo == -1 || hi > len(m.Segments) {
+		return fmt.Errorf("%s: segments %v are not in the manifest", dir, replaced)
+	}
+	for i, segment := range replaced {
+		if m.Segments[lo+i] != segment {
+			return fmt.Errorf("%s: segments %v are not consecutive in the manifest", dir, replaced)
+		}
+	}
+	name, err := moveSegment(dir, idxPath)
+	if err != nil {
+		return err
+	}
+	segments := append([]string{}, m.Segments[:lo]...)
+	segments = append(segments, name)
+	m.Segments = append(segments, m.Segments[hi:]...)
+
+	// Tombstones which end within the replaced segments were applied when
+	// merging them and only need to cover the older segments now. Those
+	// without any segments left can be dropped. Tombstones covering all
+	// replaced segments may have been added after the merge started, so they
+	// keep covering the new segment.
+	var tombstones []Tombstone
+	for _, t := range m.Tombstones {
+		switch {
+		case t.Segments >= hi:
+			t.Segments -= len(replaced) - 1
+		case t.Segments > lo:
+			t.Segments = lo
+		}
+		if t.Segments > 0 {
+			tombstones = append(tombstones, t)
+		}
+	}
+	m.Tombstones = tombstones
+	if err := m.write(dir); err != nil {
+		return err
+	}
+	for _, segment := range replaced {
+		os.Remove(filepath.Join(dir, segment))
+	}
+	return nil
+}
+
+// Segments is an opened segmented index.
+type Segments struct {
+	Dir      string
+	Manifest *Manifest
+
+	ixes []*Index
+
+	// Sorted tombstoned prefixes per segment.
+	dead [][]string
+}
+
+// OpenSegments opens all segments of the segmented index in dir. Segments
+// which are removed while opening them, e.g. by a concurrent compaction, make
+// it start over with the new manifest instead of failing.
+func OpenSegments(dir string) (*Segments, error) {
+	var err error
+	for attempt := 0; attempt < openSegmentsAttempts; attempt++ {
+		var s *Segments
+		s, err = openSegments(dir)
+		if !os.IsNotExist(err) {
+			return s, err
+		}
+		// A segment was removed by ReplaceSegments or ResetSegments after
+		// reading the manifest, so the new manifest is already in place.
+	}
+	return nil, err
+}
+
+// The number of times OpenSegments reads the manifest before giving up on
+// segments disappearing concurrently.
+const openSegmentsAttempts = 5
+
+func openSegments(dir string) (*Segments, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Open all segment files before mapping any of them, so that they stay
+	// readable even if they are removed in the meantime.
+	files := make([]*os.File, 0, len(m.Segments))
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, segment := range m.Segments {
+		f, err := os.Open(filepath.Join(dir, segment))
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		files = append(files, f)
+		if _, err := readHeader(f); err != nil {
+			closeFiles()
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+	}
+	s := &Segments{
+		Dir:      dir,
+		Manifest: m,
+		ixes:     make([]*Index, len(m.Segments)),
+		dead:     make([][]string, len(m.Segments)),
+	}
+	for i, f := range files {
+		s.ixes[i] = openFile(f)
+	}
+	for _, t := range m.Tombstones {
+		for i := 0; i < t.Segments && i < len(s.dead); i++ {
+			s.dead[i] = append(s.dead[i], t.Prefix)
+		}
+	}
+	for _, prefixes := range s.dead {
+		sort.Strings(prefixes)
+	}
+	return s, nil
+}
+
+func (s *Segments) Close() {
+	for _, ix := range s.ixes {
+		ix.Close()
+	}
+}
+
+// NumSegments returns the number of segments.
+func (s *Segments) NumSegments() int {
+	return len(s.ixes)
+}
+
+// Segment returns the index of segment i, e.g. to use its file metadata.
+// Files which are hidden by tombstones are still part of it, see Live.
+func (s *Segments) Segment(i int) *Index {
+	return s.ixes[i]
+}
+
+// Live returns the files in post, which are IDs of files in segment i, which
+// are not hidden by a tombstone. post is modified in place.
+func (s *Segments) Live(i int, post []uint32) []uint32 {
+	if len(s.dead[i]) == 0 {
+		return post
+	}
+	live := post[:0]
+	for _, fileid := range post {
+		if !s.isDead(i, s.ixes[i].Name(fileid)) {
+			live = append(live, fileid)
+		}
+	}
+	return live
+}
+
+// isDead returns true if name is hidden by a tombstone in segment i.
+func (s *Segments) isDead(i int, name string) bool {
+	return hasPrefixIn(s.dead[i], name)
+}
+
+// SegmentSize returns the size of segment i in bytes.
+func (s *Segments) SegmentSize(i int) int64 {
+	return s.ixes[i].Size()
+}
+
+// Compact writes all segments into a single index at dst, leaving out
+// tombstoned files. Use ResetSegments to replace the segments with it.
+func (s *Segments) Compact(dst string) {
+	s.CompactRange(dst, 0, len(s.ixes))
+}
+
+// CompactRange writes the segments lo to hi-1 into a single index at dst,
+// leaving out tombstoned files. Use ReplaceSegments to replace the segments
+// with it.
+func (s *Segments) CompactRange(dst string, lo, hi int) {
+	paths := make([]string, hi-lo)
+	for i, ix := range s.ixes[lo:hi] {
+		paths[i] = ix.File
+	}
+	concatN(dst, s.dead[lo:hi], paths)
+}
+
+// Names returns the names of all files matching q in all segments, except for
+// tombstoned files.
+func (s *Segments) Names(q *Query) []string {
+	names, _ := s.NamesContext(context.Background(), q)
+	return names
+}
+
+// NamesContext is like Names, but stops and returns ctx.Err() once ctx is
+// done, see Index.PostingQueryContext.
+func (s *Segments) NamesContext(ctx context.Context, q *Query) ([]string, error) {
+	var names []string
+	for i, ix := range s.ixes {
+		post, err := ix.PostingQueryContext(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileid := range s.Live(i, post) {
+			names = append(names, ix.Name(fileid))
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,274 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func segmentNames(t *testing.T, dir string, trigram string) []string {
+	s, err := OpenSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	names := s.Names(&Query{Op: QAnd, Trigram: []string{trigram}})
+	sort.Strings(names)
+	return names
+}
+
+func TestSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-segments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.idx")
+	buildIndex(first, nil, map[string]string{
+		"a_1/main.c": "\nabc\n",
+		"b_1/main.c": "\nabc\n",
+	})
+	if err := AppendSegment(filepath.Join(dir, "seg"), first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := segmentNames(t, filepath.Join(dir, "seg"), "abc"), []string{"a_1/main.c", "b_1/main.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after first segment: got %v, want %v", got, want)
+	}
+
+	// Update a_1 (e.g. re-indexed with different rules) and remove b_1.
+	second := filepath.Join(dir, "second.idx")
+	buildIndex(second, nil, map[string]string{
+		"a_1/main.c":  "\nabc\n",
+		"a_1/other.c": "\nabc\n",
+	})
+	if err := AppendSegment(filepath.Join(dir, "seg"), second, []string{"a_1/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddTombstones(filepath.Join(dir, "seg"), "b_1/"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := segmentNames(t, filepath.Join(dir, "seg"), "abc"), []string{"a_1/main.c", "a_1/other.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after second segment: got %v, want %v", got, want)
+	}
+
+	compacted := filepath.Join(dir, "compacted.idx")
+	s, err := OpenSegments(filepath.Join(dir, "seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first segment only has tombstoned files left.
+	for i, want := range []int{0, 2} {
+		ix := s.Segment(i)
+		post := s.Live(i, ix.PostingQuery(&Query{Op: QAll}))
+		if len(post) != want {
+			t.Errorf("segment %d has %d live files, want %d", i, len(post), want)
+		}
+	}
+	s.Compact(compacted)
+	s.Close()
+	ix := Open(compacted)
+	var names []string
+	for i := 0; i < ix.numName; i++ {
+		names = append(names, ix.Name(uint32(i)))
+	}
+	ix.Close()
+	if want := []string{"a_1/main.c", "a_1/other.c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("after compaction: got %v, want %v", names, want)
+	}
+
+	full := filepath.Join(dir, "full.idx")
+	buildIndex(full, nil, map[string]string{
+		"c_1/main.c": "\nabc\n",
+	})
+	if err := ResetSegments(filepath.Join(dir, "seg"), full); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(filepath.Join(dir, "seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 1 || len(m.Tombstones) != 0 {
+		t.Errorf("after reset: got manifest %+v, want one segment without tombstones", m)
+	}
+	if got, want := segmentNames(t, filepath.Join(dir, "seg"), "abc"), []string{"c_1/main.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after reset: got %v, want %v", got, want)
+	}
+}
+
+func TestReplaceSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-segments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seg := filepath.Join(dir, "seg")
+
+	for i, files := range []map[string]string{
+		{"a_1/main.c": "\nabc\n", "b_1/main.c": "\nabc\n"},
+		{"a_1/main.c": "\nabc\n", "c_1/main.c": "\nabc\n"},
+		{"d_1/main.c": "\nabc\n"},
+	} {
+		path := filepath.Join(dir, "new.idx")
+		buildIndex(path, nil, files)
+		var replaces []string
+		if i == 1 {
+			replaces = []string{"a_1/"}
+		}
+		if err := AppendSegment(seg, path, replaces); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			// Covers the first two segments.
+			if err := AddTombstones(seg, "c_1/"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	want := []string{"a_1/main.c", "b_1/main.c", "d_1/main.c"}
+	if got := segmentNames(t, seg, "abc"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("before compaction: got %v, want %v", got, want)
+	}
+
+	s, err := OpenSegments(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted := filepath.Join(dir, "compacted.idx")
+	s.CompactRange(compacted, 0, 2)
+	replaced := s.Manifest.Segments[:2]
+	s.Close()
+	if err := ReplaceSegments(seg, replaced, compacted); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tombstone of a_1 only covered merged segments and is gone. The one
+	// of c_1 might have been added during the merge, so it is kept.
+	if want := []Tombstone{{Prefix: "c_1/", Segments: 1}}; len(m.Segments) != 2 || !reflect.DeepEqual(m.Tombstones, want) {
+		t.Errorf("after compaction: got manifest %+v, want two segments with tombstones %+v", m, want)
+	}
+	if got := segmentNames(t, seg, "abc"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after compaction: got %v, want %v", got, want)
+	}
+
+	// The replaced segments are gone now.
+	if err := ReplaceSegments(seg, replaced, compacted); err == nil {
+		t.Errorf("ReplaceSegments succeeded with segments which are not in the manifest")
+	}
+}
+
+func TestConcurrentManifestUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-segments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seg := filepath.Join(dir, "seg")
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, strconv.Itoa(i)+".idx")
+		buildIndex(path, nil, map[string]string{
+			"p" + strconv.Itoa(i) + "_1/main.c": "\nabc\n",
+		})
+		wg.Add(2)
+		go func(path string) {
+			defer wg.Done()
+			if err := AppendSegment(seg, path, nil); err != nil {
+				t.Error(err)
+			}
+		}(path)
+		go func(i int) {
+			defer wg.Done()
+			if err := AddTombstones(seg, "gone"+strconv.Itoa(i)+"_1/"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	m, err := ReadManifest(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != n || len(m.Tombstones) != n {
+		t.Errorf("manifest has %d segments and %d tombstones, want %d each", len(m.Segments), len(m.Tombstones), n)
+	}
+}
+
+func TestOpenSegmentsWhileCompacting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-segments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seg := filepath.Join(dir, "seg")
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(dir, "new.idx")
+		buildIndex(path, nil, map[string]string{
+			"p" + strconv.Itoa(i) + "_1/main.c": "\nabc\n",
+		})
+		if err := AppendSegment(seg, path, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s, err := OpenSegments(seg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.Close()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		m, err := ReadManifest(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := OpenSegments(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compacted := filepath.Join(dir, "compacted.idx")
+		s.CompactRange(compacted, 0, len(m.Segments))
+		s.Close()
+		if err := ReplaceSegments(seg, m.Segments, compacted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// A segment which is missing for good is reported, not fatal.
+	m, err := ReadManifest(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(seg, m.Segments[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSegments(seg); !os.IsNotExist(err) {
+		t.Errorf("OpenSegments with a missing segment: got error %v, want a not-exist error", err)
+	}
+}
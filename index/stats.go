@@ -0,0 +1,180 @@
+package index
+
+// Statistics.
+//
+// Stats summarizes an index for capacity planning (how large are the parts of
+// a shard, how many posting entries does it hold) and for tuning the ignore
+// lists of the importer: the most frequent trigrams have the longest posting
+// lists and are therefore the least useful ones for narrowing down a query.
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// SectionStats is the size of one part of an index.
+type SectionStats struct {
+	Name  string
+	Bytes int64
+}
+
+// Stats describes the contents of an index, see (*Index).Stats.
+type Stats struct {
+	Version  int
+	Features Features
+	Bytes    int64
+
+	// Number of files and of trigrams with a posting list.
+	Files    int
+	Trigrams int
+
+	// Sum of the lengths of all posting lists.
+	PostingEntries int64
+
+	// The most frequent trigrams, most frequent first.
+	TopTrigrams []TrigramEstimate
+
+	// Sizes of the parts of the index in file order. The parts cover the
+	// whole file.
+	Sections []SectionStats
+}
+
+func (id SectionID) String() string {
+	switch id {
+	case SectionLineOffsets:
+		return "line offsets"
+	case SectionFileMeta:
+		return "file metadata"
+	case SectionChecksums:
+		return "checksums"
+	case SectionBloom:
+		return "bloom filters"
+	case SectionBlocks:
+		return "block tables"
+	case SectionLongLines:
+		return "long lines"
+	case SectionContentHashes:
+		return "content hashes"
+	case SectionDuplicates:
+		return "duplicates"
+	}
+	return fmt.Sprintf("section %d", uint32(id))
+}
+
+// sectionEntries returns the entries of the section table.
+func (ix *Index) sectionEntries() []sectionEntry {
+	if ix.version < 2 {
+		return nil
+	}
+	n := uint64(ix.uint32(ix.postEnd))
+	size := sectionEntrySize(ix.version)
+	entries := make([]sectionEntry, n)
+	for i := range entries {
+		e := ix.postEnd + 4 + size*uint64(i)
+		entries[i] = sectionEntry{
+			id:     SectionID(ix.uint32(e)),
+			off:    ix.offset(e + 4),
+			length: ix.offset(e + 4 + ix.offSize),
+		}
+	}
+	return entries
+}
+
+// trigramHeap is a min-heap of trigrams by their number of files.
+type trigramHeap []trigramCnt
+
+func (h trigramHeap) Len() int            { return len(h) }
+func (h trigramHeap) Less(i, j int) bool  { return h[i].count < h[j].count }
+func (h trigramHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *trigramHeap) Push(x interface{}) { *h = append(*h, x.(trigramCnt)) }
+func (h *trigramHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Stats returns statistics about the index, including its top most frequent
+// trigrams. It reads the whole posting list index, but none of the posting
+// lists.
+func (ix *Index) Stats(top int) Stats {
+	st := Stats{
+		Version:  ix.version,
+		Features: ix.features,
+		Bytes:    ix.Size(),
+		Files:    ix.NumFiles(),
+		Trigrams: ix.NumTrigrams(),
+	}
+
+	var h trigramHeap
+	for i := 0; i < st.Trigrams; i++ {
+		trigram, count, _ := ix.listAt(i)
+		st.PostingEntries += int64(count)
+		if top <= 0 {
+			continue
+		}
+		if len(h) < top {
+			heap.Push(&h, trigramCnt{trigram, int(count), 0})
+		} else if int(count) > h[0].count {
+			h[0] = trigramCnt{trigram, int(count), 0}
+			heap.Fix(&h, 0)
+		}
+	}
+	st.TopTrigrams = make([]TrigramEstimate, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		t := heap.Pop(&h).(trigramCnt)
+		st.TopTrigrams[i] = TrigramEstimate{
+			Trigram: string([]byte{byte(t.trigram >> 16), byte(t.trigram >> 8), byte(t.trigram)}),
+			Files:   t.count,
+		}
+	}
+
+	// Sections are stored between the posting lists and the name index,
+	// except for the checksums, which follow the section table.
+	entries := ix.sectionEntries()
+	postEnd, tableEnd := ix.nameIndex, uint64(ix.Size())
+	for _, s := range entries {
+		if s.off >= ix.postData && s.off < postEnd {
+			postEnd = s.off
+		}
+		if s.off >= ix.postEnd && s.off < tableEnd {
+			tableEnd = s.off
+		}
+	}
+	add := func(name string, from, to uint64) {
+		st.Sections = append(st.Sections, SectionStats{name, int64(to - from)})
+	}
+	add("header", 0, ix.pathData)
+	add("paths", ix.pathData, ix.nameData)
+	add("names", ix.nameData, ix.postData)
+	add("posting lists", ix.postData, postEnd)
+	for _, s := range entries {
+		if s.off < ix.nameIndex {
+			add(s.id.String(), s.off, s.off+s.length)
+		}
+	}
+	add("name index", ix.nameIndex, ix.postIndex)
+	add("posting index", ix.postIndex, ix.postEnd)
+	if ix.version < 2 {
+		tableEnd = ix.postEnd
+	}
+	add("section table", ix.postEnd, tableEnd)
+	trailerStart := tableEnd
+	for _, s := range entries {
+		if s.off >= ix.postEnd {
+			add(s.id.String(), s.off, s.off+s.length)
+			trailerStart = s.off + s.length
+		}
+	}
+	add("trailer", trailerStart, uint64(ix.Size()))
+	return st
+}
+
+// Stats returns the statistics of each segment.
+func (s *Segments) Stats(top int) []Stats {
+	stats := make([]Stats, len(s.ixes))
+	for i, ix := range s.ixes {
+		stats[i] = ix.Stats(top)
+	}
+	return stats
+}
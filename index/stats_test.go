@@ -0,0 +1,66 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-stats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "stats.idx")
+	ix := Create(out)
+	ix.Bloom = true
+	ix.Add("a", strings.NewReader("aaa"))
+	ix.Add("b", strings.NewReader("aaa\nbbb"))
+	ix.Add("c", strings.NewReader("aaa\nbbb\nccc"))
+	ix.Flush()
+	concat := filepath.Join(dir, "concat.idx")
+	ConcatN(concat, out)
+
+	for _, path := range []string{out, concat} {
+		st := Open(path).Stats(1)
+		if st.Version != CurrentVersion || st.Files != 3 || st.Trigrams != 9 || st.PostingEntries != 1+5+9 {
+			t.Errorf("%s: Stats() = %+v, want version %d, 3 files, 9 trigrams, 15 posting entries", path, st, CurrentVersion)
+		}
+		if want := []TrigramEstimate{{"aaa", 3}}; !reflect.DeepEqual(st.TopTrigrams, want) {
+			t.Errorf("%s: TopTrigrams = %v, want %v", path, st.TopTrigrams, want)
+		}
+
+		var total int64
+		names := make(map[string]bool)
+		for _, s := range st.Sections {
+			if s.Bytes < 0 {
+				t.Errorf("%s: section %q has %d bytes", path, s.Name, s.Bytes)
+			}
+			total += s.Bytes
+			names[s.Name] = true
+		}
+		if total != st.Bytes {
+			t.Errorf("%s: sections add up to %d bytes, want %d", path, total, st.Bytes)
+		}
+		for _, name := range []string{"posting lists", "bloom filters", "checksums", "trailer"} {
+			if !names[name] {
+				t.Errorf("%s: no %q in Sections %v", path, name, st.Sections)
+			}
+		}
+	}
+
+	st := Open(out).Stats(100)
+	if len(st.TopTrigrams) != st.Trigrams {
+		t.Fatalf("Stats(100) returned %d trigrams, want %d", len(st.TopTrigrams), st.Trigrams)
+	}
+	for i := 1; i < len(st.TopTrigrams); i++ {
+		if st.TopTrigrams[i].Files > st.TopTrigrams[i-1].Files {
+			t.Errorf("TopTrigrams not sorted: %v", st.TopTrigrams)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package index
+
+// Checksums and verification.
+//
+// All writers store CRC-32C checksums of the parts of an index in the
+// SectionChecksums section, which is placed after the section table:
+//
+//	offset [8], length [8], checksum [4]
+//	...
+//
+// In version 2 indexes, offset and length are 4 bytes wide.
+//
+// The checksummed regions cover the file from its start up to the section
+// table, split at the boundaries of the path list, name list, posting lists,
+// sections, name index and posting list index, so that a mismatch can be
+// attributed to one of them.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"sort"
+)
+
+// SectionChecksums holds the checksums of all other parts of the index.
+const SectionChecksums SectionID = 3
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// A region is a checksummed part of an index.
+type region struct {
+	off, length uint64
+}
+
+// regions splits [0, end) at the boundaries of the parts described by t.
+func (t *trailer) regions(end uint64) []region {
+	bounds := []uint64{0, end}
+	bounds = append(bounds, t.off[:]...)
+	for _, s := range t.sections {
+		bounds = append(bounds, s.off, s.off+s.length)
+	}
+	sort.Sort(uint64Slice(bounds))
+	var regions []region
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] > bounds[i-1] {
+			regions = append(regions, region{bounds[i-1], bounds[i] - bounds[i-1]})
+		}
+	}
+	return regions
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// checksums returns the checksum section contents for the regions of out,
+// which is flushed and read back for that.
+func checksums(out *bufWriter, regions []region) []byte {
+	out.flush()
+	buf := make([]byte, 1<<20)
+	var d []byte
+	for _, r := range regions {
+		h := crc32.New(castagnoli)
+		if _, err := io.CopyBuffer(h, io.NewSectionReader(out.file, int64(r.off), int64(r.length)), buf); err != nil {
+			log.Fatalf("reading back %s: %v", out.name, err)
+		}
+		var e [20]byte
+		binary.BigEndian.PutUint64(e[0:], r.off)
+		binary.BigEndian.PutUint64(e[8:], r.length)
+		binary.BigEndian.PutUint32(e[16:], h.Sum32())
+		d = append(d, e[:]...)
+	}
+	return d
+}
+
+// A Problem is a corruption found by Verify.
+type Problem struct {
+	Offset      uint64
+	Description string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("offset %d: %s", p.Offset, p.Description)
+}
+
+// verifier collects problems while checking an index.
+type verifier struct {
+	ix       *Index
+	d        []byte
+	problems []Problem
+
+	// The name list and the posting lists (up to the name index), which are
+	// decompressed for compressed indexes. Offsets of problems within them
+	// are reported as if they were stored uncompressed.
+	names, posts []byte
+}
+
+func (v *verifier) problem(off uint64, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{off, fmt.Sprintf(format, args...)})
+}
+
+// part returns the name of the part of the index which contains off.
+func (v *verifier) part(off uint64) string {
+	ix := v.ix
+	switch {
+	case off < ix.pathData:
+		return "header"
+	case off < ix.nameData:
+		return "path list"
+	case off < ix.postData:
+		return "name list"
+	case off >= ix.postIndex && off < ix.postEnd:
+		return "posting list index"
+	case off >= ix.nameIndex && off < ix.postIndex:
+		return "name index"
+	}
+	for _, s := range v.sections() {
+		if off >= s.off && off < s.off+s.length {
+			return fmt.Sprintf("section %d", s.id)
+		}
+	}
+	return "posting lists"
+}
+
+// sections returns the entries of the section table, or nil if it is broken
+// (which is reported by Verify).
+func (v *verifier) sections() []sectionEntry {
+	ix := v.ix
+	if ix.version < 2 {
+		return nil
+	}
+	end := uint64(len(v.d))
+	if ix.postEnd+4 > end {
+		return nil
+	}
+	n := uint64(binary.BigEndian.Uint32(v.d[ix.postEnd:]))
+	size := sectionEntrySize(ix.version)
+	if ix.postEnd+4+size*n > end {
+		return nil
+	}
+	entries := make([]sectionEntry, n)
+	for i := range entries {
+		e := v.d[ix.postEnd+4+size*uint64(i):]
+		entries[i] = sectionEntry{
+			id:     SectionID(binary.BigEndian.Uint32(e)),
+			off:    getOffset(e[4:], ix.offSize),
+			length: getOffset(e[4+ix.offSize:], ix.offSize),
+		}
+	}
+	return entries
+}
+
+func (v *verifier) verifySections() {
+	ix := v.ix
+	if ix.version < 2 {
+		return
+	}
+	entries := v.sections()
+	if entries == nil {
+		v.problem(ix.postEnd, "section table exceeds the file")
+		return
+	}
+	for _, s := range entries {
+		if s.off+s.length > uint64(len(v.d)) {
+			v.problem(s.off, "section %d (%d bytes) exceeds the file", s.id, s.length)
+		}
+	}
+}
+
+func (v *verifier) verifyChecksums() {
+	var sum []byte
+	for _, s := range v.sections() {
+		if s.id == SectionChecksums && s.off+s.length <= uint64(len(v.d)) {
+			sum = v.d[s.off : s.off+s.length]
+		}
+	}
+	n := v.ix.offSize
+	size := 2*n + 4
+	if uint64(len(sum))%size != 0 {
+		v.problem(0, "checksum section has invalid length %d", len(sum))
+		return
+	}
+	for ; len(sum) > 0; sum = sum[size:] {
+		off := getOffset(sum, n)
+		length := getOffset(sum[n:], n)
+		want := binary.BigEndian.Uint32(sum[2*n:])
+		if off+length > uint64(len(v.d)) {
+			v.problem(off, "checksummed region of %d bytes exceeds the file", length)
+			continue
+		}
+		if got := crc32.Checksum(v.d[off:off+length], castagnoli); got != want {
+			v.problem(off, "%s: checksum mismatch over %d bytes (got %08x, want %08x)", v.part(off), length, got, want)
+		}
+	}
+}
+
+func (v *verifier) verifyNames() {
+	ix := v.ix
+	if v.names == nil {
+		return
+	}
+	if ix.nameIndex+ix.offSize*uint64(ix.numName) > ix.postIndex {
+		v.problem(ix.nameIndex, "name index: too short for %d names", ix.numName)
+		return
+	}
+	last := uint64(0)
+	for i := 0; i < ix.numName; i++ {
+		entry := ix.nameIndex + ix.offSize*uint64(i)
+		off := getOffset(v.d[entry:], ix.offSize)
+		if i > 0 && off <= last {
+			v.problem(entry, "name index: entry %d (%d) does not follow entry %d (%d)", i, off, i-1, last)
+		}
+		last = off
+		end := uint64(len(v.names))
+		if off >= end {
+			v.problem(entry, "name index: name %d starts at %d, beyond the name list", i, ix.nameData+off)
+			continue
+		}
+		j := off
+		for j < end && v.names[j] != 0 {
+			j++
+		}
+		if j == end {
+			v.problem(ix.nameData+off, "name list: name %d is not NUL-terminated", i)
+		} else if j == off {
+			v.problem(ix.nameData+off, "name list: name %d is empty", i)
+		}
+	}
+}
+
+func (v *verifier) verifyPostings() {
+	ix := v.ix
+	if v.posts == nil {
+		return
+	}
+	if ix.postIndex+uint64(ix.numPost)*ix.entrySize > ix.postEnd {
+		v.problem(ix.postIndex, "posting list index: too short for %d entries", ix.numPost)
+		return
+	}
+	lastTrigram := int64(-1)
+	for i := 0; i < ix.numPost; i++ {
+		entry := ix.postIndex + uint64(i)*ix.entrySize
+		e := v.d[entry:]
+		trigram := uint32(e[0])<<16 | uint32(e[1])<<8 | uint32(e[2])
+		count := binary.BigEndian.Uint32(e[3:])
+		offset := getOffset(e[3+4:], ix.offSize)
+		if int64(trigram) <= lastTrigram {
+			v.problem(entry, "posting list index: trigram %#06x is out of order", trigram)
+		}
+		lastTrigram = int64(trigram)
+		// IndexWriter ends the posting lists with an empty list for trigram
+		// 0xffffff, ConcatN does not.
+		if trigram == 1<<24-1 {
+			if i != ix.numPost-1 || count != 0 {
+				v.problem(entry, "posting list index: misplaced end marker")
+			}
+			continue
+		}
+		v.verifyPostingList(entry, trigram, count, offset)
+	}
+}
+
+func (v *verifier) verifyPostingList(entry uint64, trigram, count uint32, offset uint64) {
+	ix := v.ix
+	start := ix.postData + offset
+	if offset+3 > uint64(len(v.posts)) {
+		v.problem(entry, "posting list index: list for trigram %#06x starts at %d, beyond the posting lists", trigram, start)
+		return
+	}
+	d := v.posts[offset:]
+	if t := uint32(d[0])<<16 | uint32(d[1])<<8 | uint32(d[2]); t != trigram {
+		v.problem(start, "posting lists: list for trigram %#06x starts with trigram %#06x", trigram, t)
+		return
+	}
+	d = d[3:]
+	fileid := ^uint32(0)
+	for n := uint32(0); ; n++ {
+		delta, l := binary.Uvarint(d)
+		if l <= 0 {
+			v.problem(start, "posting lists: list for trigram %#06x is truncated", trigram)
+			return
+		}
+		d = d[l:]
+		if delta == 0 {
+			if n != count {
+				v.problem(start, "posting lists: list for trigram %#06x has %d entries, index says %d", trigram, n, count)
+			}
+			return
+		}
+		fileid += uint32(delta)
+		if fileid >= uint32(ix.numName) {
+			v.problem(start, "posting lists: list for trigram %#06x refers to file %d, but there are only %d files", trigram, fileid, ix.numName)
+			return
+		}
+	}
+}
+
+// Verify checks the checksums (if present) and the structure of the name
+// index, name list, posting list index and posting lists, and returns all
+// problems it finds. Unlike the other methods of Index, it does not exit the
+// program when encountering corrupt data.
+func (ix *Index) Verify() []Problem {
+	v := &verifier{ix: ix, d: ix.data.d}
+	v.verifySections()
+	v.verifyChecksums()
+	if ix.blocks != nil {
+		v.names, v.posts = v.compressedRegions()
+	} else {
+		v.names, v.posts = v.d[ix.nameData:ix.postData], v.d[ix.postData:ix.nameIndex]
+	}
+	v.verifyNames()
+	v.verifyPostings()
+	return v.problems
+}
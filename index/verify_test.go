@@ -0,0 +1,55 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"v3.idx", trivialIndex, nil},
+		{"v2.idx", trivialIndexV2, nil},
+		{"v1.idx", trivialIndexV1, nil},
+		// Flip the trigram of the first posting list.
+		{"posting.idx", strings.Replace(trivialIndex, "\na\n\x03\x00", "\nA\n\x03\x00", 1), []string{
+			"offset 55: posting lists: checksum mismatch",
+			"offset 55: posting lists: list for trigram 0x0a610a starts with trigram 0x0a410a",
+		}},
+		// Point the name index entry of file1 into the middle of f0.
+		{"names.idx", strings.Replace(trivialIndex, u64(6+1+2+1), u64(6+1+1), 1), []string{
+			"offset 117: name index: checksum mismatch",
+		}},
+	} {
+		path := writeTestIndex(t, dir, test.name, test.data)
+		if test.name == "v3.idx" {
+			// Indexes written by ConcatN are fine, too.
+			path = filepath.Join(dir, "concat.idx")
+			ConcatN(path, writeTestIndex(t, dir, test.name, test.data))
+		}
+		ix := Open(path)
+		problems := ix.Verify()
+		ix.Close()
+		if len(problems) != len(test.want) {
+			t.Errorf("%s: Verify() = %v, want %d problems", test.name, problems, len(test.want))
+			continue
+		}
+		for i, p := range problems {
+			if !strings.HasPrefix(p.String(), test.want[i]) {
+				t.Errorf("%s: problem %d = %q, want prefix %q", test.name, i, p, test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package index
+
+// Format versions.
+//
+// Version 1 is the original csearch format described in read.go. Version 2
+// has the same layout, but starts with "csearch index 2\n" and allows for
+// additional sections between the posting lists and the name index:
+//
+//	"csearch index 2\n"
+//	list of paths
+//	list of names
+//	list of posting lists
+//	sections
+//	name index
+//	posting list index
+//	section table
+//	checksums
+//	trailer
+//
+// The section table lists the sections, whose contents depend on the feature
+// that uses them:
+//
+//	number of sections [4]
+//	id [4], offset [4], length [4]
+//	...
+//
+// The version 2 trailer has the form:
+//
+//	offset of path list [4]
+//	offset of name list [4]
+//	offset of posting lists [4]
+//	offset of name index [4]
+//	offset of posting list index [4]
+//	offset of section table [4]
+//	features [4]
+//	"\ncsearch trlr 2\n"
+//
+// The features are a bit mask of format changes which readers must know
+// about to interpret the index correctly. Readers refuse indexes with
+// features they do not know instead of returning wrong results. Sections
+// with unknown ids are ignored, so adding a section which readers may
+// safely ignore does not need a feature bit.
+//
+// The trailer magic differs from version 1 so that readers which only know
+// about version 1 consider version 2 indexes corrupt instead of silently
+// misinterpreting them.
+//
+// Version 3 has the same layout as version 2, but all offsets and lengths
+// are 64 bits wide, so that shards can grow beyond 4 GiB:
+//
+//	"csearch index 3\n"
+//	...
+//	name index: offset [8]...
+//	posting list index: trigram [3], file count [4], offset [8]...
+//	section table: number of sections [4], then id [4], offset [8], length [8]...
+//	checksums: offset [8], length [8], checksum [4]...
+//	trailer: six offsets [8], features [4], "\ncsearch trlr 3\n"
+//
+// The line offsets section also uses 64-bit entries in its file index. File
+// IDs, file counts and the offsets within a single file remain 32 bits wide.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	magicV2        = "csearch index 2\n"
+	trailerMagicV2 = "\ncsearch trlr 2\n"
+	magicV3        = "csearch index 3\n"
+	trailerMagicV3 = "\ncsearch trlr 3\n"
+
+	// Prefix of the header of all versions.
+	magicPrefix = "csearch index "
+
+	// Version which Create, ConcatN, Merge and Concat write.
+	CurrentVersion = 3
+)
+
+// Features is a bit mask of optional format changes, see version.go.
+type Features uint32
+
+const (
+	// The index contains case-folded trigrams, see fold.go.
+	FeatureFoldCase Features = 1 << iota
+
+	// The index contains trigrams of the NFC-normalized, lowercased text,
+	// see normalize.go.
+	FeatureNormalize
+
+	// The name list and the posting lists are stored in compressed blocks,
+	// see compress.go.
+	FeatureCompressed
+)
+
+// knownFeatures are the features this package can read.
+const knownFeatures = FeatureFoldCase | FeatureNormalize | FeatureCompressed
+
+// SectionID identifies a section of a version 2 or 3 index.
+type SectionID uint32
+
+var (
+	ErrCorrupt             = errors.New("corrupt index")
+	ErrUnsupportedVersion  = errors.New("unsupported index format version, run dcs-index-migrate")
+	ErrUnsupportedFeatures = errors.New("index uses unsupported features, upgrade the reader")
+)
+
+// Header describes the format of an index file.
+type Header struct {
+	Version  int
+	Features Features
+
+	// Offsets of the path list, name list, posting lists, name index and
+	// posting list index.
+	off [5]uint64
+
+	// Offset of the section table (version 2 and 3) or trailer (version 1),
+	// i.e. the end of the posting list index.
+	postEnd uint64
+
+	// ID of the key the file is encrypted with, or "" if the file is not
+	// encrypted, see encrypt.go.
+	KeyID string
+}
+
+const (
+	trailerSizeV1 = 5*4 + len(trailerMagic)
+	trailerSizeV2 = 7*4 + len(trailerMagicV2)
+	trailerSizeV3 = 6*8 + 4 + len(trailerMagicV3)
+
+	// The largest trailer of all versions.
+	maxTrailerSize = trailerSizeV3
+)
+
+// offsetSize returns the size of the offsets in the name index, posting list
+// index, section table and checksums of an index of the given version.
+func offsetSize(version int) uint64 {
+	if version >= 3 {
+		return 8
+	}
+	return 4
+}
+
+// postEntrySize returns the size of a posting list index entry.
+func postEntrySize(version int) uint64 {
+	return 3 + 4 + offsetSize(version)
+}
+
+// sectionEntrySize returns the size of an entry of the section table.
+func sectionEntrySize(version int) uint64 {
+	return 4 + 2*offsetSize(version)
+}
+
+// getOffset decodes an offset of the given size from the start of d.
+func getOffset(d []byte, size uint64) uint64 {
+	if size == 8 {
+		return binary.BigEndian.Uint64(d)
+	}
+	return uint64(binary.BigEndian.Uint32(d))
+}
+
+// parseHeader parses the header and trailer of an index file of size bytes,
+// given its first len(magic) bytes and its last maxTrailerSize (or fewer, for
+// small files) bytes.
+func parseHeader(size int64, head, tail []byte) (*Header, error) {
+	if len(head) < len(magic) || string(head[:len(magicPrefix)]) != magicPrefix {
+		return nil, ErrCorrupt
+	}
+	h := &Header{}
+	switch string(head[:len(magic)]) {
+	case magic:
+		h.Version = 1
+		if len(tail) < trailerSizeV1 || string(tail[len(tail)-len(trailerMagic):]) != trailerMagic {
+			return nil, ErrCorrupt
+		}
+		t := tail[len(tail)-trailerSizeV1:]
+		for i := range h.off {
+			h.off[i] = uint64(binary.BigEndian.Uint32(t[4*i:]))
+		}
+		h.postEnd = uint64(size) - uint64(trailerSizeV1)
+	case magicV2, magicV3:
+		h.Version = 2
+		tmagic, tsize := trailerMagicV2, trailerSizeV2
+		if string(head[:len(magic)]) == magicV3 {
+			h.Version = 3
+			tmagic, tsize = trailerMagicV3, trailerSizeV3
+		}
+		if len(tail) < tsize || string(tail[len(tail)-len(tmagic):]) != tmagic {
+			return nil, ErrCorrupt
+		}
+		t := tail[len(tail)-tsize:]
+		n := offsetSize(h.Version)
+		for i := range h.off {
+			h.off[i] = getOffset(t[n*uint64(i):], n)
+		}
+		h.postEnd = getOffset(t[5*n:], n)
+		h.Features = Features(binary.BigEndian.Uint32(t[6*n:]))
+		if h.Features&^knownFeatures != 0 {
+			return h, ErrUnsupportedFeatures
+		}
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	for i := 1; i < len(h.off); i++ {
+		if h.off[i] < h.off[i-1] {
+			return nil, ErrCorrupt
+		}
+	}
+	if h.postEnd < h.off[4] || h.postEnd > uint64(size) {
+		return nil, ErrCorrupt
+	}
+	return h, nil
+}
+
+// ReadHeader reads the header and trailer of the index file without mapping
+// it into memory. Callers can use it to check whether Open will succeed: the
+// returned error is ErrCorrupt, ErrUnsupportedVersion or
+// ErrUnsupportedFeatures if the index cannot be read. Encrypted indexes are
+// decrypted completely (which verifies them), failing with ErrNoKey or
+// ErrDecrypt if that is not possible.
+func ReadHeader(file string) (*Header, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+// readHeader is like ReadHeader, but reads the already opened index file f.
+func readHeader(f *os.File) (*Header, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	head := make([]byte, len(magic))
+	if _, err := f.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if encrypted(head) {
+		return readEncryptedHeader(io.NewSectionReader(f, 0, size))
+	}
+	n := int64(maxTrailerSize)
+	if n > size {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := f.ReadAt(tail, size-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseHeader(size, head, tail)
+}
+
+// Version returns the format version of the index.
+func (ix *Index) Version() int {
+	return ix.version
+}
+
+// Features returns the features used by the index.
+func (ix *Index) Features() Features {
+	return ix.features
+}
+
+// Section returns the contents of the section with the given id, or nil if
+// the index does not contain such a section.
+func (ix *Index) Section(id SectionID) []byte {
+	if ix.version < 2 {
+		return nil
+	}
+	n := uint64(ix.uint32(ix.postEnd))
+	size := sectionEntrySize(ix.version)
+	for i := uint64(0); i < n; i++ {
+		e := ix.postEnd + 4 + size*i
+		if SectionID(ix.uint32(e)) == id {
+			return ix.slice(ix.offset(e+4), int(ix.offset(e+4+ix.offSize)))
+		}
+	}
+	return nil
+}
+
+// A sectionEntry describes a section in the section table.
+type sectionEntry struct {
+	id     SectionID
+	off    uint64
+	length uint64
+}
+
+// A trailer collects the offsets of the parts of an index while it is
+// written, so that they can be written at the end in the current format.
+type trailer struct {
+	off      [5]uint64
+	features Features
+	sections []sectionEntry
+}
+
+// beginSection starts the section id at the current offset of out. The
+// section ends with the next call to endSection.
+func (t *trailer) beginSection(out *bufWriter, id SectionID) {
+	t.sections = append(t.sections, sectionEntry{id: id, off: out.offset()})
+}
+
+func (t *trailer) endSection(out *bufWriter) {
+	s := &t.sections[len(t.sections)-1]
+	s.length = out.offset() - s.off
+}
+
+// commonFeatures returns the features which all of ixes use, i.e. the
+// features of an index combining them. Indexes are combined uncompressed.
+func commonFeatures(ixes ...*Index) Features {
+	if len(ixes) == 0 {
+		return 0
+	}
+	f := ixes[0].features
+	for _, ix := range ixes[1:] {
+		f &= ix.features
+	}
+	return f &^ FeatureCompressed
+}
+
+// write writes the section table, the checksums (see verify.go) and the
+// trailer to out, which must be positioned right after the posting list
+// index.
+func (t *trailer) write(out *bufWriter) {
+	table := out.offset()
+	sum := checksums(out, t.regions(table))
+	t.sections = append(t.sections, sectionEntry{
+		id:     SectionChecksums,
+		off:    table + 4 + sectionEntrySize(CurrentVersion)*uint64(len(t.sections)+1),
+		length: uint64(len(sum)),
+	})
+	out.writeUint32(uint32(len(t.sections)))
+	for _, s := range t.sections {
+		out.writeUint32(uint32(s.id))
+		out.writeUint64(s.off)
+		out.writeUint64(s.length)
+	}
+	out.write(sum)
+	for _, v := range t.off {
+		out.writeUint64(v)
+	}
+	out.writeUint64(table)
+	out.writeUint32(uint32(t.features))
+	out.writeString(trailerMagicV3)
+}
+
+func (f Features) String() string {
+	return fmt.Sprintf("%#x", uint32(f))
+}
@@ -0,0 +1,223 @@
+package index
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestIndex(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadVersion1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-version-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v1 := writeTestIndex(t, dir, "v1.idx", trivialIndexV1)
+	ix := Open(v1)
+	defer ix.Close()
+	if got, want := ix.Version(), 1; got != want {
+		t.Errorf("Version() = %d, want %d", got, want)
+	}
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if name := ix.Name(5); name != "thefile2" {
+		t.Errorf("Name(5) = %q, want thefile2", name)
+	}
+
+	// Concatenating (which is what dcs-index-migrate does) upgrades the index.
+	v2 := filepath.Join(dir, "v2.idx")
+	ConcatN(v2, v1)
+	h, err := ReadHeader(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != CurrentVersion {
+		t.Errorf("after ConcatN: got version %d, want %d", h.Version, CurrentVersion)
+	}
+	ix2 := Open(v2)
+	defer ix2.Close()
+	if l := ix2.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("after ConcatN: PostingList(abc) = %v, want [0 3]", l)
+	}
+}
+
+func TestReadVersion2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-version-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v2 := writeTestIndex(t, dir, "v2.idx", trivialIndexV2)
+	ix := Open(v2)
+	defer ix.Close()
+	if got, want := ix.Version(), 2; got != want {
+		t.Errorf("Version() = %d, want %d", got, want)
+	}
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if name := ix.Name(5); name != "thefile2" {
+		t.Errorf("Name(5) = %q, want thefile2", name)
+	}
+
+	// Version 2 indexes are rewritten with 64-bit offsets, yielding the same
+	// index as when concatenating the version 3 index.
+	fromV2 := filepath.Join(dir, "from-v2.idx")
+	ConcatN(fromV2, v2)
+	fromV3 := filepath.Join(dir, "from-v3.idx")
+	ConcatN(fromV3, writeTestIndex(t, dir, "v3.idx", trivialIndex))
+	got, err := ioutil.ReadFile(fromV2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(fromV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("after ConcatN: got %q, want %q", got, want)
+	}
+}
+
+func TestParseHeaderLargeOffsets(t *testing.T) {
+	const (
+		gib  = 1 << 30
+		size = 6*gib + 1000
+	)
+	off := []uint64{16, 17, 5 * gib, 5*gib + 100, 5*gib + 200, 6 * gib}
+	tail := make([]byte, trailerSizeV3)
+	for i, o := range off {
+		binary.BigEndian.PutUint64(tail[8*i:], o)
+	}
+	copy(tail[6*8+4:], trailerMagicV3)
+	h, err := parseHeader(size, []byte(magicV3), tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range off[:5] {
+		if h.off[i] != want {
+			t.Errorf("offset %d = %d, want %d", i, h.off[i], want)
+		}
+	}
+	if h.postEnd != off[5] {
+		t.Errorf("postEnd = %d, want %d", h.postEnd, off[5])
+	}
+
+	// The same offsets cannot be stored in a version 2 trailer.
+	if _, err := parseHeader(size, []byte(magicV2), tail); err != ErrCorrupt {
+		t.Errorf("parseHeader(v2) = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+// TestBeyond4GiB moves the name list and everything following it of the
+// trivial index beyond 4 GiB by growing the path list with a hole of NUL
+// bytes. The file is sparse, so this needs little disk space.
+func TestBeyond4GiB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	if ^uint(0) == 1<<32-1 {
+		t.Skip("cannot map files larger than 4 GiB on 32-bit platforms")
+	}
+	dir, err := ioutil.TempDir("", "index-version-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const hole = 1 << 32
+	data := trivialIndexData(u64)
+	var tail []byte
+	tail = append(tail, data[1:]...) // everything after the path list
+	tail = append(tail, u32(0)...)   // empty section table
+	for _, o := range []uint64{16, 16 + 1 + hole, 16 + 1 + hole + 38, 16 + 1 + hole + 38 + 62, 16 + 1 + hole + 38 + 62 + 56, 16 + 1 + hole + 38 + 62 + 56 + 180} {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], o)
+		tail = append(tail, b[:]...)
+	}
+	tail = append(tail, u32(0)...)
+	tail = append(tail, trailerMagicV3...)
+
+	path := filepath.Join(dir, "large.idx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(magicV3 + data[:1])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(tail, 16+1+hole); err != nil {
+		f.Close()
+		t.Skipf("cannot write a sparse file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix := Open(path)
+	defer ix.Close()
+	if l := ix.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("PostingList(abc) = %v, want [0 3]", l)
+	}
+	if name := ix.Name(5); name != "thefile2" {
+		t.Errorf("Name(5) = %q, want thefile2", name)
+	}
+	if problems := ix.Verify(); len(problems) != 0 {
+		t.Errorf("Verify() = %v", problems)
+	}
+
+	small := filepath.Join(dir, "small.idx")
+	ConcatN(small, path)
+	ix2 := Open(small)
+	defer ix2.Close()
+	if l := ix2.PostingList(tri('a', 'b', 'c')); !equalList(l, []uint32{0, 3}) {
+		t.Errorf("after ConcatN: PostingList(abc) = %v, want [0 3]", l)
+	}
+	if name := ix2.Name(5); name != "thefile2" {
+		t.Errorf("after ConcatN: Name(5) = %q, want thefile2", name)
+	}
+}
+
+func TestReadHeaderRefuses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-version-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Set an unknown feature bit in the trailer.
+	features := []byte(trivialIndex)
+	features[len(features)-len(trailerMagicV3)-1] = 0x80
+
+	for _, test := range []struct {
+		name string
+		data string
+		want error
+	}{
+		{"v3.idx", trivialIndex, nil},
+		{"v2.idx", trivialIndexV2, nil},
+		{"v1.idx", trivialIndexV1, nil},
+		{"v4.idx", "csearch index 4\n" + trivialIndex[len(magic):], ErrUnsupportedVersion},
+		{"features.idx", string(features), ErrUnsupportedFeatures},
+		{"truncated.idx", trivialIndex[:len(trivialIndex)-1], ErrCorrupt},
+		{"empty.idx", "", ErrCorrupt},
+	} {
+		_, err := ReadHeader(writeTestIndex(t, dir, test.name, test.data))
+		if err != test.want {
+			t.Errorf("ReadHeader(%s) = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
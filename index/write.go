@@ -5,7 +5,9 @@
 package index
 
 import (
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -40,8 +42,36 @@ const sortK = 12
 
 // An IndexWriter creates an on-disk index corresponding to a set of files.
 type IndexWriter struct {
-	LogSkip bool // log information about skipped files
-	Verbose bool // log status using package log
+	LogSkip  bool // log information about skipped files
+	Verbose  bool // log status using package log
+	FoldCase bool // also record case-folded trigrams, see fold.go
+
+	// Also record the trigrams of the NFC-normalized, lowercased text, see
+	// normalize.go.
+	Normalize bool
+
+	// Record line offsets, see lines.go. Must be set before adding files.
+	LineOffsets bool
+
+	// Record a Bloom filter of 4-grams per file, see bloom.go. Must be set
+	// before adding files.
+	Bloom bool
+
+	// MaxMemory bounds the memory (in bytes) used for buffering (trigram,
+	// file) pairs, including the scratch space for sorting them. Once the
+	// buffer is full, it is sorted and spilled to a temporary file; Flush
+	// merges the spilled runs. 0 means defaultMaxMemory. Must be set before
+	// adding files.
+	MaxMemory int64
+
+	// LongLines decides what happens to files with lines longer than
+	// MaxLineLen bytes, see longlines.go. MaxLineLen 0 means maxLineLen.
+	LongLines  LongLinePolicy
+	MaxLineLen int
+
+	// Index files with the same contents only once, see dedup.go. Must be
+	// set before adding files.
+	Dedup bool
 
 	trigram *sparse.Set // trigrams for the current file
 	buf     [8]byte     // scratch buffer
@@ -61,11 +91,28 @@ type IndexWriter struct {
 	inbuf []byte     // input buffer
 	main  *bufWriter // main index file
 
+	lines *lineOffsetsWriter // nil unless LineOffsets is set
+	bloom *bloomWriter       // nil unless Bloom is set
+
+	meta     *bufWriter       // temp file holding metadata records, see meta.go
+	metaTab  *metaTableWriter // package and language names of the records
+	hasMeta  bool             // AddFileMeta was called
+	nextMeta *FileMeta        // metadata for the file being added
+
+	longLines []longLineRecord // files with long lines, see longlines.go
+
+	hashes    []byte                 // content hashes, see dedup.go
+	hashOwner map[contentHash]uint32 // first file with the given contents
+	dups      []duplicate
+
 	sortTmp []postEntry
 	sortN   [1 << sortK]int
 }
 
-const npost = 64 << 20 / 8 // 64 MB worth of post entries
+const defaultMaxMemory = 128 << 20 // 64 MB worth of post entries plus scratch space
+
+// maxPost is the largest number of post entries a spilled run can hold.
+const maxPost = 1 << 31 / 8
 
 // Create returns a new IndexWriter that will write the index to file.
 func Create(file string) *IndexWriter {
@@ -76,7 +123,6 @@ func Create(file string) *IndexWriter {
 		nameIndex: bufCreate(""),
 		postIndex: bufCreate(""),
 		main:      bufCreate(file),
-		post:      make([]postEntry, 0, npost),
 		inbuf:     make([]byte, 16384),
 	}
 }
@@ -99,14 +145,23 @@ func makePostEntry(trigram, fileid uint32) postEntry {
 // Tuning constants for detecting text files.
 // A file is assumed not to be text files (and thus not indexed)
 // if it contains an invalid UTF-8 sequences, if it is longer than maxFileLength
-// bytes, if it contains a line longer than maxLineLen bytes,
-// or if it contains more than maxTextTrigrams distinct trigrams.
+// bytes, if it contains a line longer than maxLineLen bytes (unless
+// IndexWriter.LongLines says otherwise), or if it contains more than maxTextTrigrams distinct trigrams.
 const (
 	maxFileLen      = 1 << 30
 	maxLineLen      = 2000
 	maxTextTrigrams = 20000
 )
 
+// Errors returned by Add for files which are not indexed. Callers can compare
+// against these to find out why a file was skipped.
+var (
+	ErrInvalidUTF8     = errors.New("invalid UTF-8, ignoring")
+	ErrTooLong         = errors.New("too long, ignoring")
+	ErrLongLines       = errors.New("very long lines, ignoring")
+	ErrTooManyTrigrams = errors.New("too many trigrams, probably not text, ignoring")
+)
+
 // AddPaths adds the given paths to the index's list of paths.
 func (ix *IndexWriter) AddPaths(paths []string) {
 	ix.paths = append(ix.paths, paths...)
@@ -128,14 +183,44 @@ func (ix *IndexWriter) AddFile(name string, indexname string) error {
 // It logs errors using package log.
 func (ix *IndexWriter) Add(name string, f io.Reader) error {
 	ix.trigram.Reset()
+	if ix.LineOffsets && ix.lines == nil {
+		ix.lines = newLineOffsetsWriter()
+	}
+	if ix.lines != nil {
+		ix.lines.lines = ix.lines.lines[:0]
+	}
+	if ix.Bloom && ix.bloom == nil {
+		ix.bloom = newBloomWriter()
+	}
+	if ix.bloom != nil {
+		ix.bloom.reset()
+	}
+	var (
+		nz *normalizer
+		nw io.WriteCloser
+		h  hash.Hash
+	)
+	if ix.Dedup {
+		h = sha256.New()
+	}
+	if ix.Normalize {
+		nz, nw = newNormalizer()
+		f = io.TeeReader(f, nw)
+	}
 	var (
 		c       = byte(0)
 		i       = 0
 		buf     = ix.inbuf[:0]
 		tv      = uint32(0)
+		gram    = uint32(0)
 		n       = int64(0)
 		linelen = 0
+		longest = 0
+		maxLen  = ix.MaxLineLen
 	)
+	if maxLen <= 0 {
+		maxLen = maxLineLen
+	}
 	for {
 		tv = (tv << 8) & (1<<24 - 1)
 		if i >= len(buf) {
@@ -153,40 +238,61 @@ func (ix *IndexWriter) Add(name string, f io.Reader) error {
 			}
 			buf = buf[:n]
 			i = 0
+			if h != nil {
+				h.Write(buf)
+			}
 		}
 		c = buf[i]
 		i++
 		tv |= uint32(c)
-		if n++; n >= 3 {
+		// Beyond MaxLineLen, the rest of the line is not indexed.
+		skipping := linelen >= maxLen && ix.LongLines == LongLinesSkipLines
+		if n++; n >= 3 && !skipping {
 			ix.trigram.Add(tv)
 		}
+		if ix.bloom != nil {
+			if gram = gram<<8 | uint32(c); n >= 4 && !skipping {
+				ix.bloom.add(gram)
+			}
+		}
 		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
 			if ix.LogSkip {
 				log.Printf("%s: invalid UTF-8, ignoring\n", name)
 			}
-			return errors.New("invalid UTF-8, ignoring")
+			return ErrInvalidUTF8
 		}
 		if n > maxFileLen {
 			if ix.LogSkip {
 				log.Printf("%s: too long, ignoring\n", name)
 			}
-			return errors.New("too long, ignoring")
+			return ErrTooLong
 		}
-		if linelen++; linelen > maxLineLen {
-			if ix.LogSkip {
-				log.Printf("%s: very long lines, ignoring\n", name)
+		if linelen++; linelen > maxLen {
+			if ix.LongLines == LongLinesSkipFile {
+				if ix.LogSkip {
+					log.Printf("%s: very long lines, ignoring\n", name)
+				}
+				return ErrLongLines
+			}
+			if linelen > longest {
+				longest = linelen
 			}
-			return errors.New("very long lines, ignoring")
 		}
 		if c == '\n' {
 			linelen = 0
+			if ix.lines != nil {
+				ix.lines.lines = append(ix.lines.lines, uint32(n))
+			}
 		}
 	}
+	if nw != nil {
+		nw.Close()
+	}
 	if ix.trigram.Len() > maxTextTrigrams {
 		if ix.LogSkip {
 			log.Printf("%s: too many trigrams, probably not text, ignoring\n", name)
 		}
-		return errors.New("too many trigrams, probably not text, ignoring")
+		return ErrTooManyTrigrams
 	}
 	ix.totalBytes += n
 
@@ -195,6 +301,36 @@ func (ix *IndexWriter) Add(name string, f io.Reader) error {
 	}
 
 	fileid := ix.addName(name)
+	if longest > 0 {
+		ix.longLines = append(ix.longLines, longLineRecord{
+			fileid:    fileid,
+			LongLines: LongLines{Longest: longest, Policy: ix.LongLines},
+		})
+	}
+	if ix.lines != nil {
+		ix.lines.addFile()
+	}
+	if ix.bloom != nil {
+		ix.bloom.addFile()
+	}
+	ix.addMeta(name, n)
+	if h != nil && ix.duplicate(fileid, h.Sum(nil)) {
+		// The contents are indexed already.
+		return nil
+	}
+	if ix.FoldCase {
+		for _, trigram := range ix.trigram.Dense() {
+			ix.trigram.Add(foldTrigram(trigram))
+		}
+	}
+	if nz != nil {
+		for trigram := range nz.trigrams {
+			ix.trigram.Add(trigram)
+		}
+	}
+	if ix.post == nil {
+		ix.post = make([]postEntry, 0, ix.postCap())
+	}
 	for _, trigram := range ix.trigram.Dense() {
 		if len(ix.post) >= cap(ix.post) {
 			ix.flushPost()
@@ -209,26 +345,40 @@ func (ix *IndexWriter) Add(name string, f io.Reader) error {
 func (ix *IndexWriter) Flush() {
 	ix.addName("")
 
-	var off [5]uint32
-	ix.main.writeString(magic)
-	off[0] = ix.main.offset()
+	var t trailer
+	if ix.FoldCase {
+		t.features |= FeatureFoldCase
+	}
+	if ix.Normalize {
+		t.features |= FeatureNormalize
+	}
+	ix.main.writeString(magicV3)
+	t.off[0] = ix.main.offset()
 	for _, p := range ix.paths {
 		ix.main.writeString(p)
 		ix.main.writeString("\x00")
 	}
 	ix.main.writeString("\x00")
-	off[1] = ix.main.offset()
+	t.off[1] = ix.main.offset()
 	copyFile(ix.main, ix.nameData)
-	off[2] = ix.main.offset()
+	t.off[2] = ix.main.offset()
 	ix.mergePost(ix.main)
-	off[3] = ix.main.offset()
+	if ix.lines != nil {
+		ix.lines.flush(ix.main, &t)
+	}
+	if ix.bloom != nil {
+		ix.bloom.flush(ix.main, &t)
+	}
+	if ix.hasMeta {
+		ix.writeMeta(&t)
+	}
+	ix.writeLongLines(&t)
+	ix.writeDedup(&t)
+	t.off[3] = ix.main.offset()
 	copyFile(ix.main, ix.nameIndex)
-	off[4] = ix.main.offset()
+	t.off[4] = ix.main.offset()
 	copyFile(ix.main, ix.postIndex)
-	for _, v := range off {
-		ix.main.writeUint32(v)
-	}
-	ix.main.writeString(trailerMagic)
+	t.write(ix.main)
 
 	os.Remove(ix.nameData.name)
 	for _, f := range ix.postFile {
@@ -236,6 +386,9 @@ func (ix *IndexWriter) Flush() {
 	}
 	os.Remove(ix.nameIndex.name)
 	os.Remove(ix.postIndex.name)
+	if ix.meta != nil {
+		os.Remove(ix.meta.name)
+	}
 
 	log.Printf("%d data bytes, %d index bytes", ix.totalBytes, ix.main.offset())
 
@@ -257,7 +410,7 @@ func (ix *IndexWriter) addName(name string) uint32 {
 		log.Fatalf("%q: file has NUL byte in name", name)
 	}
 
-	ix.nameIndex.writeUint32(ix.nameData.offset())
+	ix.nameIndex.writeUint64(ix.nameData.offset())
 	ix.nameData.writeString(name)
 	ix.nameData.writeByte(0)
 	id := ix.numName
@@ -265,6 +418,23 @@ func (ix *IndexWriter) addName(name string) uint32 {
 	return uint32(id)
 }
 
+// postCap returns how many post entries fit into ix.MaxMemory. Half of it is
+// reserved for sortPost.
+func (ix *IndexWriter) postCap() int {
+	limit := ix.MaxMemory
+	if limit <= 0 {
+		limit = defaultMaxMemory
+	}
+	n := limit / 2 / 8
+	if n < 1 {
+		n = 1
+	}
+	if n > maxPost {
+		n = maxPost
+	}
+	return int(n)
+}
+
 // flushPost writes ix.post to a new temporary file and
 // clears the slice.
 func (ix *IndexWriter) flushPost() {
@@ -279,7 +449,7 @@ func (ix *IndexWriter) flushPost() {
 
 	// Write the raw ix.post array to disk as is.
 	// This process is the one reading it back in, so byte order is not a concern.
-	data := (*[npost * 8]byte)(unsafe.Pointer(&ix.post[0]))[:len(ix.post)*8]
+	data := (*[maxPost * 8]byte)(unsafe.Pointer(&ix.post[0]))[:len(ix.post)*8]
 	if n, err := w.Write(data); err != nil || n < len(data) {
 		if err != nil {
 			log.Fatal(err)
@@ -329,7 +499,7 @@ func (ix *IndexWriter) mergePost(out *bufWriter) {
 		// index entry
 		ix.postIndex.write(ix.buf[:3])
 		ix.postIndex.writeUint32(nfile)
-		ix.postIndex.writeUint32(offset)
+		ix.postIndex.writeUint64(offset)
 
 		if trigram == 1<<24-1 {
 			break
@@ -353,7 +523,7 @@ type postHeap struct {
 
 func (h *postHeap) addFile(f *os.File) {
 	data := mmapFile(f).d
-	m := (*[npost]postEntry)(unsafe.Pointer(&data[0]))[:len(data)/8]
+	m := (*[maxPost]postEntry)(unsafe.Pointer(&data[0]))[:len(data)/8]
 	h.addMem(m)
 }
 
@@ -528,13 +698,9 @@ func (b *bufWriter) writeString(s string) {
 }
 
 // offset returns the current write offset.
-func (b *bufWriter) offset() uint32 {
+func (b *bufWriter) offset() uint64 {
 	off, _ := b.file.Seek(0, 1)
-	off += int64(len(b.buf))
-	if int64(uint32(off)) != off {
-		log.Fatalf("index is larger than 4GB")
-	}
-	return uint32(off)
+	return uint64(off) + uint64(len(b.buf))
 }
 
 func (b *bufWriter) flush() {
@@ -570,6 +736,14 @@ func (b *bufWriter) writeUint32(x uint32) {
 	b.buf = append(b.buf, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
 }
 
+func (b *bufWriter) writeUint64(x uint64) {
+	if cap(b.buf)-len(b.buf) < 8 {
+		b.flush()
+	}
+	b.buf = append(b.buf, byte(x>>56), byte(x>>48), byte(x>>40), byte(x>>32),
+		byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
 func (b *bufWriter) writeUvarint(x uint32) {
 	if cap(b.buf)-len(b.buf) < 5 {
 		b.flush()
@@ -6,6 +6,8 @@ package index
 
 import (
 	"bytes"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
 	"sort"
@@ -24,56 +26,61 @@ var trivialFiles = map[string]string{
 
 var trivialIndex = join(
 	// header
-	"csearch index 1\n",
+	"csearch index 3\n",
+
+	trivialIndexData(u64),
+
+	// section table
+	u32(1),
+	u32(uint32(SectionChecksums)), u64(16+1+38+62+56+180+4+20), u64(6*20),
 
-	// list of paths
-	"\x00",
-
-	// list of names
-	"afile4\x00",
-	"f0\x00",
-	"file1\x00",
-	"file3\x00",
-	"file5\x00",
-	"thefile2\x00",
-	"\x00",
-
-	// list of posting lists
-	"\na\n", fileList(2), // file1
-	"\nab", fileList(3, 5), // file3, thefile2
-	"\nda", fileList(0), // afile4
-	"\nxy", fileList(4), // file5
-	"ab\n", fileList(5), // thefile2
-	"abc", fileList(0, 3), // afile4, file3
-	"bc\n", fileList(0, 3), // afile4, file3
-	"dab", fileList(0), // afile4
-	"xyz", fileList(4), // file5
-	"yzw", fileList(4), // file5
-	"zw\n", fileList(4), // file5
-	"\xff\xff\xff", fileList(),
-
-	// name index
+	// checksums
+	regionChecksums(u64, "csearch index 3\n"+trivialIndexData(u64), 16, 1, 38, 62, 56, 180),
+
+	// trailer
+	u64(16),
+	u64(16+1),
+	u64(16+1+38),
+	u64(16+1+38+62),
+	u64(16+1+38+62+56),
+	u64(16+1+38+62+56+180),
 	u32(0),
-	u32(6+1),
-	u32(6+1+2+1),
-	u32(6+1+2+1+5+1),
-	u32(6+1+2+1+5+1+5+1),
-	u32(6+1+2+1+5+1+5+1+5+1),
-	u32(6+1+2+1+5+1+5+1+5+1+8+1),
-
-	// posting list index,
-	"\na\n", u32(1), u32(0),
-	"\nab", u32(2), u32(5),
-	"\nda", u32(1), u32(5+6),
-	"\nxy", u32(1), u32(5+6+5),
-	"ab\n", u32(1), u32(5+6+5+5),
-	"abc", u32(2), u32(5+6+5+5+5),
-	"bc\n", u32(2), u32(5+6+5+5+5+6),
-	"dab", u32(1), u32(5+6+5+5+5+6+6),
-	"xyz", u32(1), u32(5+6+5+5+5+6+6+5),
-	"yzw", u32(1), u32(5+6+5+5+5+6+6+5+5),
-	"zw\n", u32(1), u32(5+6+5+5+5+6+6+5+5+5),
-	"\xff\xff\xff", u32(0), u32(5+6+5+5+5+6+6+5+5+5+5),
+
+	"\ncsearch trlr 3\n",
+)
+
+// trivialIndexV2 is trivialIndex in format version 2.
+var trivialIndexV2 = join(
+	// header
+	"csearch index 2\n",
+
+	trivialIndexData(u32),
+
+	// section table
+	u32(1),
+	u32(uint32(SectionChecksums)), u32(16+1+38+62+28+132+4+12), u32(6*12),
+
+	// checksums
+	regionChecksums(u32, "csearch index 2\n"+trivialIndexData(u32), 16, 1, 38, 62, 28, 132),
+
+	// trailer
+	u32(16),
+	u32(16+1),
+	u32(16+1+38),
+	u32(16+1+38+62),
+	u32(16+1+38+62+28),
+	u32(16+1+38+62+28+132),
+	u32(0),
+
+	"\ncsearch trlr 2\n",
+)
+
+// trivialIndexV1 is trivialIndex in format version 1.
+var trivialIndexV1 = join(
+	// header
+	"csearch index 1\n",
+
+	trivialIndexData(u32),
 
 	// trailer
 	u32(16),
@@ -85,6 +92,62 @@ var trivialIndex = join(
 	"\ncsearch trailr\n",
 )
 
+// trivialIndexData returns everything between header and section table of
+// the trivial index, with the offsets in the name index and posting list
+// index encoded by off.
+func trivialIndexData(off func(uint32) string) string {
+	return join(
+		// list of paths
+		"\x00",
+
+		// list of names
+		"afile4\x00",
+		"f0\x00",
+		"file1\x00",
+		"file3\x00",
+		"file5\x00",
+		"thefile2\x00",
+		"\x00",
+
+		// list of posting lists
+		"\na\n", fileList(2), // file1
+		"\nab", fileList(3, 5), // file3, thefile2
+		"\nda", fileList(0), // afile4
+		"\nxy", fileList(4), // file5
+		"ab\n", fileList(5), // thefile2
+		"abc", fileList(0, 3), // afile4, file3
+		"bc\n", fileList(0, 3), // afile4, file3
+		"dab", fileList(0), // afile4
+		"xyz", fileList(4), // file5
+		"yzw", fileList(4), // file5
+		"zw\n", fileList(4), // file5
+		"\xff\xff\xff", fileList(),
+
+		// name index
+		off(0),
+		off(6+1),
+		off(6+1+2+1),
+		off(6+1+2+1+5+1),
+		off(6+1+2+1+5+1+5+1),
+		off(6+1+2+1+5+1+5+1+5+1),
+		off(6+1+2+1+5+1+5+1+5+1+8+1),
+
+		// posting list index,
+		"\na\n", u32(1), off(0),
+		"\nab", u32(2), off(5),
+		"\nda", u32(1), off(5+6),
+		"\nxy", u32(1), off(5+6+5),
+		"ab\n", u32(1), off(5+6+5+5),
+		"abc", u32(2), off(5+6+5+5+5),
+		"bc\n", u32(2), off(5+6+5+5+5+6),
+		"dab", u32(1), off(5+6+5+5+5+6+6),
+		"xyz", u32(1), off(5+6+5+5+5+6+6+5),
+		"yzw", u32(1), off(5+6+5+5+5+6+6+5+5),
+		"zw\n", u32(1), off(5+6+5+5+5+6+6+5+5+5),
+		"\xff\xff\xff", u32(0), off(5+6+5+5+5+6+6+5+5+5+5),
+	)
+}
+
 func join(s ...string) string {
 	return strings.Join(s, "")
 }
@@ -98,6 +161,22 @@ func u32(x uint32) string {
 	return string(buf[:])
 }
 
+func u64(x uint32) string {
+	return u32(0) + u32(x)
+}
+
+// regionChecksums returns the checksum entries for the consecutive regions of
+// data with the given lengths, with offsets and lengths encoded by enc.
+func regionChecksums(enc func(uint32) string, data string, lengths ...uint32) string {
+	var s string
+	off := uint32(0)
+	for _, l := range lengths {
+		s += enc(off) + enc(l) + u32(crc32.Checksum([]byte(data[off:off+l]), castagnoli))
+		off += l
+	}
+	return s
+}
+
 func fileList(list ...uint32) string {
 	var buf []byte
 
@@ -132,6 +211,23 @@ func buildFlushIndex(out string, paths []string, doFlush bool, fileData map[stri
 	ix.Flush()
 }
 
+// buildSpillIndex is like buildIndex, but with a memory limit so small that
+// the writer spills every few post entries.
+func buildSpillIndex(out string, fileData map[string]string) *IndexWriter {
+	ix := Create(out)
+	ix.MaxMemory = 64
+	var files []string
+	for name := range fileData {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		ix.Add(name, strings.NewReader(fileData[name]))
+	}
+	ix.Flush()
+	return ix
+}
+
 func buildIndex(name string, paths []string, fileData map[string]string) {
 	buildFlushIndex(name, paths, false, fileData)
 }
@@ -163,3 +259,48 @@ func TestTrivialWrite(t *testing.T) {
 func TestTrivialWriteDisk(t *testing.T) {
 	testTrivialWrite(t, true)
 }
+
+func TestWriteMaxMemory(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+	ix := buildSpillIndex(out, trivialFiles)
+	if len(ix.postFile) < 2 {
+		t.Fatalf("writer spilled %d runs, want at least 2", len(ix.postFile))
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != trivialIndex {
+		t.Fatalf("index written with MaxMemory = %d differs from the trivial index", ix.MaxMemory)
+	}
+}
+
+// Posting lists are stored as varint-encoded deltas between file IDs (see
+// the format description in read.go), so a trigram which occurs in many
+// consecutive files costs about one byte per file.
+func TestPostingListsAreDeltaEncoded(t *testing.T) {
+	f, _ := ioutil.TempFile("", "index-test")
+	defer os.Remove(f.Name())
+	out := f.Name()
+
+	files := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		files[fmt.Sprintf("file%04d", i)] = "\nabc\n"
+	}
+	buildIndex(out, nil, files)
+
+	ix := Open(out)
+	defer ix.Close()
+	count, offset := ix.findList(tri('a', 'b', 'c'))
+	if count != 1000 {
+		t.Fatalf("posting list for abc has %d entries, want 1000", count)
+	}
+	_, nextOffset := ix.findList(tri('b', 'c', '\n'))
+	// trigram [3] + 1000 deltas of 1 + terminating zero delta
+	if got, want := nextOffset-offset, uint64(3+1000+1); got != want {
+		t.Errorf("posting list for abc takes %d bytes, want %d", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+// Detects the programming language of source files.
+//
+// Language names match the filetype: keywords understood by the ranking
+// package (e.g. “c”, “c++”, “perl”), so that they can be used
+// interchangeably.
+package lang
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// Returned by Detect when the language could not be determined.
+const Unknown = ""
+
+var byExtension = map[string]string{
+	".adb":    "ada",
+	".ads":    "ada",
+	".asm":    "asm",
+	".s":      "asm",
+	".S":      "asm",
+	".awk":    "awk",
+	".c":      "c",
+	".cc":     "c++",
+	".cpp":    "c++",
+	".cxx":    "c++",
+	".c++":    "c++",
+	".hh":     "c++",
+	".hpp":    "c++",
+	".hxx":    "c++",
+	".cs":     "c#",
+	".cmake":  "cmake",
+	".clj":    "clojure",
+	".coffee": "coffeescript",
+	".d":      "d",
+	".el":     "emacs-lisp",
+	".erl":    "erlang",
+	".hrl":    "erlang",
+	".f":      "fortran",
+	".f77":    "fortran",
+	".f90":    "fortran",
+	".f95":    "fortran",
+	".go":     "go",
+	".groovy": "groovy",
+	".hs":     "haskell",
+	".lhs":    "haskell",
+	".java":   "java",
+	".js":     "javascript",
+	".json":   "json",
+	".l":      "lex",
+	".lisp":   "lisp",
+	".lsp":    "lisp",
+	".lua":    "lua",
+	".m4":     "m4",
+	".mk":     "makefile",
+	".ml":     "ocaml",
+	".mli":    "ocaml",
+	".mm":     "objective-c",
+	".pas":    "pascal",
+	".pp":     "pascal",
+	".php":    "php",
+	".pl":     "perl",
+	".pm":     "perl",
+	".t":      "perl",
+	".py":     "python",
+	".r":      "r",
+	".R":      "r",
+	".rb":     "ruby",
+	".rs":     "rust",
+	".scala":  "scala",
+	".scm":    "scheme",
+	".ss":     "scheme",
+	".sh":     "shell",
+	".bash":   "shell",
+	".zsh":    "shell",
+	".sql":    "sql",
+	".tcl":    "tcl",
+	".vala":   "vala",
+	".vapi":   "vala",
+	".vim":    "vim",
+	".y":      "yacc",
+	".yy":     "yacc",
+}
+
+var byFilename = map[string]string{
+	"CMakeLists.txt": "cmake",
+	"GNUmakefile":    "makefile",
+	"Makefile":       "makefile",
+	"makefile":       "makefile",
+	"Makefile.am":    "makefile",
+	"configure.ac":   "m4",
+	"configure.in":   "m4",
+	"Rakefile":       "ruby",
+	"SConstruct":     "python",
+	"SConscript":     "python",
+}
+
+// Interpreter names (as found in the #! line) to language.
+var byInterpreter = map[string]string{
+	"sh":      "shell",
+	"bash":    "shell",
+	"dash":    "shell",
+	"ksh":     "shell",
+	"zsh":     "shell",
+	"awk":     "awk",
+	"gawk":    "awk",
+	"mawk":    "awk",
+	"make":    "makefile",
+	"lua":     "lua",
+	"node":    "javascript",
+	"nodejs":  "javascript",
+	"perl":    "perl",
+	"php":     "php",
+	"python":  "python",
+	"python2": "python",
+	"python3": "python",
+	"ruby":    "ruby",
+	"tclsh":   "tcl",
+	"wish":    "tcl",
+	"guile":   "scheme",
+	"Rscript": "r",
+}
+
+// Returns the language for a #! line, e.g. “#!/usr/bin/env python3”.
+func fromShebang(content []byte) string {
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return Unknown
+	}
+	line := content[2:]
+	if idx := bytes.IndexByte(line, '\n'); idx > -1 {
+		line = line[:idx]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return Unknown
+	}
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = fields[1]
+	}
+	if result, ok := byInterpreter[interpreter]; ok {
+		return result
+	}
+	// Versioned interpreters such as python2.7 or perl5.18.
+	if idx := strings.IndexAny(interpreter, "0123456789"); idx > 0 {
+		return byInterpreter[interpreter[:idx]]
+	}
+	return Unknown
+}
+
+// Looks for C++-only constructs in a header file.
+func looksLikeCPlusPlus(content []byte) bool {
+	for _, marker := range []string{"namespace ", "template <", "template<", "class ", "public:", "private:", "std::"} {
+		if bytes.Contains(content, []byte(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect returns the language of the file at path (which is only used for
+// its name) with the given content. content does not need to be complete, the
+// first few kilobytes are sufficient.
+func Detect(path string, content []byte) string {
+	base := filepath.Base(path)
+	if result, ok := byFilename[base]; ok {
+		return result
+	}
+	if strings.HasSuffix(path, "/debian/rules") {
+		return "makefile"
+	}
+
+	ext := filepath.Ext(base)
+	switch ext {
+	case ".h":
+		if looksLikeCPlusPlus(content) {
+			return "c++"
+		}
+		return "c"
+	case ".m":
+		if bytes.Contains(content, []byte("@interface")) ||
+			bytes.Contains(content, []byte("@implementation")) ||
+			bytes.Contains(content, []byte("#import")) {
+			return "objective-c"
+		}
+		return "matlab"
+	}
+	if result, ok := byExtension[ext]; ok {
+		return result
+	}
+	if result, ok := byExtension[strings.ToLower(ext)]; ok {
+		return result
+	}
+
+	return fromShebang(content)
+}
+
+// FromName returns the languages a file could be in, judging by its path
+// only, e.g. “c” and “c++” for .h files. It is meant for files whose
+// contents are not at hand.
+func FromName(path string) []string {
+	switch filepath.Ext(path) {
+	case ".h":
+		return []string{"c", "c++"}
+	case ".m":
+		return []string{"objective-c", "matlab"}
+	}
+	if result := Detect(path, nil); result != Unknown {
+		return []string{result}
+	}
+	return nil
+}
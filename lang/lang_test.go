@@ -0,0 +1,47 @@
+package lang
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	for _, entry := range []struct {
+		path, content, want string
+	}{
+		{"i3-wm_4.8-1/src/main.c", "int main() {}", "c"},
+		{"i3-wm_4.8-1/include/i3.h", "#include <stdbool.h>\nextern bool foo;", "c"},
+		{"qt_5-1/src/widget.h", "namespace Qt {\nclass Widget;\n}", "c++"},
+		{"foo_1-1/foo.cpp", "", "c++"},
+		{"foo_1-1/debian/rules", "#!/usr/bin/make -f\n%:\n\tdh $@", "makefile"},
+		{"foo_1-1/Makefile", "all:\n", "makefile"},
+		{"foo_1-1/bin/foo", "#!/usr/bin/env python3\nprint(1)", "python"},
+		{"foo_1-1/bin/foo", "#!/usr/bin/perl5.18 -w\n", "perl"},
+		{"foo_1-1/bin/foo", "#!/bin/sh\nset -e\n", "shell"},
+		{"foo_1-1/bin/foo", "just text", Unknown},
+		{"foo_1-1/Foo.m", "#import <Foundation/Foundation.h>", "objective-c"},
+		{"foo_1-1/foo.m", "function y = f(x)", "matlab"},
+		{"foo_1-1/Foo.JAVA", "class Foo {}", "java"},
+	} {
+		if got := Detect(entry.path, []byte(entry.content)); got != entry.want {
+			t.Errorf("Detect(%q, %q) = %q, want %q", entry.path, entry.content, got, entry.want)
+		}
+	}
+}
+
+func TestFromName(t *testing.T) {
+	for _, entry := range []struct {
+		path string
+		want []string
+	}{
+		{"i3-wm_4.8-1/src/main.c", []string{"c"}},
+		{"i3-wm_4.8-1/include/i3.h", []string{"c", "c++"}},
+		{"foo_1-1/debian/rules", []string{"makefile"}},
+		{"foo_1-1/bin/foo", nil},
+	} {
+		got := FromName(entry.path)
+		if strings.Join(got, ",") != strings.Join(entry.want, ",") {
+			t.Errorf("FromName(%q) = %q, want %q", entry.path, got, entry.want)
+		}
+	}
+}
@@ -14,30 +14,48 @@ import (
 
 type Match C.Struct
 
-func NewMatch(s *C.Segment) Match      { return Match(s.NewStruct(16, 7)) }
-func NewRootMatch(s *C.Segment) Match  { return Match(s.NewRootStruct(16, 7)) }
-func AutoNewMatch(s *C.Segment) Match  { return Match(s.NewStructAR(16, 7)) }
-func ReadRootMatch(s *C.Segment) Match { return Match(s.Root(0).ToStruct()) }
-func (s Match) Path() string           { return C.Struct(s).GetObject(0).ToText() }
-func (s Match) SetPath(v string)       { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
-func (s Match) Line() uint32           { return C.Struct(s).Get32(0) }
-func (s Match) SetLine(v uint32)       { C.Struct(s).Set32(0, v) }
-func (s Match) Ctxp2() string          { return C.Struct(s).GetObject(1).ToText() }
-func (s Match) SetCtxp2(v string)      { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
-func (s Match) Ctxp1() string          { return C.Struct(s).GetObject(2).ToText() }
-func (s Match) SetCtxp1(v string)      { C.Struct(s).SetObject(2, s.Segment.NewText(v)) }
-func (s Match) Context() string        { return C.Struct(s).GetObject(3).ToText() }
-func (s Match) SetContext(v string)    { C.Struct(s).SetObject(3, s.Segment.NewText(v)) }
-func (s Match) Ctxn1() string          { return C.Struct(s).GetObject(4).ToText() }
-func (s Match) SetCtxn1(v string)      { C.Struct(s).SetObject(4, s.Segment.NewText(v)) }
-func (s Match) Ctxn2() string          { return C.Struct(s).GetObject(5).ToText() }
-func (s Match) SetCtxn2(v string)      { C.Struct(s).SetObject(5, s.Segment.NewText(v)) }
-func (s Match) Pathrank() float32      { return math.Float32frombits(C.Struct(s).Get32(4)) }
-func (s Match) SetPathrank(v float32)  { C.Struct(s).Set32(4, math.Float32bits(v)) }
-func (s Match) Ranking() float32       { return math.Float32frombits(C.Struct(s).Get32(8)) }
-func (s Match) SetRanking(v float32)   { C.Struct(s).Set32(8, math.Float32bits(v)) }
-func (s Match) Package() string        { return C.Struct(s).GetObject(6).ToText() }
-func (s Match) SetPackage(v string)    { C.Struct(s).SetObject(6, s.Segment.NewText(v)) }
+func NewMatch(s *C.Segment) Match          { return Match(s.NewStruct(40, 10)) }
+func NewRootMatch(s *C.Segment) Match      { return Match(s.NewRootStruct(40, 10)) }
+func AutoNewMatch(s *C.Segment) Match      { return Match(s.NewStructAR(40, 10)) }
+func ReadRootMatch(s *C.Segment) Match     { return Match(s.Root(0).ToStruct()) }
+func (s Match) Path() string               { return C.Struct(s).GetObject(0).ToText() }
+func (s Match) SetPath(v string)           { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s Match) Line() uint32               { return C.Struct(s).Get32(0) }
+func (s Match) SetLine(v uint32)           { C.Struct(s).Set32(0, v) }
+func (s Match) Ctxp2() string              { return C.Struct(s).GetObject(1).ToText() }
+func (s Match) SetCtxp2(v string)          { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+func (s Match) Ctxp1() string              { return C.Struct(s).GetObject(2).ToText() }
+func (s Match) SetCtxp1(v string)          { C.Struct(s).SetObject(2, s.Segment.NewText(v)) }
+func (s Match) Context() string            { return C.Struct(s).GetObject(3).ToText() }
+func (s Match) SetContext(v string)        { C.Struct(s).SetObject(3, s.Segment.NewText(v)) }
+func (s Match) Ctxn1() string              { return C.Struct(s).GetObject(4).ToText() }
+func (s Match) SetCtxn1(v string)          { C.Struct(s).SetObject(4, s.Segment.NewText(v)) }
+func (s Match) Ctxn2() string              { return C.Struct(s).GetObject(5).ToText() }
+func (s Match) SetCtxn2(v string)          { C.Struct(s).SetObject(5, s.Segment.NewText(v)) }
+func (s Match) Pathrank() float32          { return math.Float32frombits(C.Struct(s).Get32(4)) }
+func (s Match) SetPathrank(v float32)      { C.Struct(s).Set32(4, math.Float32bits(v)) }
+func (s Match) Ranking() float32           { return math.Float32frombits(C.Struct(s).Get32(8)) }
+func (s Match) SetRanking(v float32)       { C.Struct(s).Set32(8, math.Float32bits(v)) }
+func (s Match) Package() string            { return C.Struct(s).GetObject(6).ToText() }
+func (s Match) SetPackage(v string)        { C.Struct(s).SetObject(6, s.Segment.NewText(v)) }
+func (s Match) Wholeword() bool            { return C.Struct(s).Get1(96) }
+func (s Match) SetWholeword(v bool)        { C.Struct(s).Set1(96, v) }
+func (s Match) Before() C.TextList         { return C.TextList(C.Struct(s).GetObject(7)) }
+func (s Match) SetBefore(v C.TextList)     { C.Struct(s).SetObject(7, C.Object(v)) }
+func (s Match) After() C.TextList          { return C.TextList(C.Struct(s).GetObject(8)) }
+func (s Match) SetAfter(v C.TextList)      { C.Struct(s).SetObject(8, C.Object(v)) }
+func (s Match) Filematches() uint32        { return C.Struct(s).Get32(16) }
+func (s Match) SetFilematches(v uint32)    { C.Struct(s).Set32(16, v) }
+func (s Match) Offsets() Offset_List       { return Offset_List(C.Struct(s).GetObject(9)) }
+func (s Match) SetOffsets(v Offset_List)   { C.Struct(s).SetObject(9, C.Object(v)) }
+func (s Match) Packagematches() uint32     { return C.Struct(s).Get32(20) }
+func (s Match) SetPackagematches(v uint32) { C.Struct(s).Set32(20, v) }
+func (s Match) Packagefiles() uint32       { return C.Struct(s).Get32(24) }
+func (s Match) SetPackagefiles(v uint32)   { C.Struct(s).Set32(24, v) }
+func (s Match) Popularity() float32        { return math.Float32frombits(C.Struct(s).Get32(28)) }
+func (s Match) SetPopularity(v float32)    { C.Struct(s).Set32(28, math.Float32bits(v)) }
+func (s Match) Modtime() uint64            { return C.Struct(s).Get64(32) }
+func (s Match) SetModtime(v uint64)        { C.Struct(s).Set64(32, v) }
 func (s Match) WriteJSON(w io.Writer) error {
 	b := bufio.NewWriter(w)
 	var err error
@@ -239,6 +257,141 @@ func (s Match) WriteJSON(w io.Writer) error {
 			return err
 		}
 	}
+	err = b.WriteByte(',')
+	if err != nil {
+		return err
+	}
+	_, err = b.WriteString("\"WholeWord\":")
+	if err != nil {
+		return err
+	}
+	{
+		s := s.Wholeword()
+		buf, err = json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Only present when only some matches of the file are returned.
+	if n := s.Filematches(); n > 0 {
+		_, err = b.WriteString(",\"FileMatches\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Only present when the results are grouped by package.
+	if n := s.Packagematches(); n > 0 {
+		_, err = b.WriteString(",\"PackageMatches\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+		_, err = b.WriteString(",\"PackageFiles\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(s.Packagefiles())
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Only present when the results are sorted by popularity.
+	if p := s.Popularity(); p > 0 {
+		_, err = b.WriteString(",\"Popularity\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Only present when the results are sorted by modification time.
+	if t := s.Modtime(); t > 0 {
+		_, err = b.WriteString(",\"ModTime\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Only present when the positions of the matches are known.
+	if offsets := s.Offsets(); offsets.Len() > 0 {
+		_, err = b.WriteString(",\"Offsets\":")
+		if err != nil {
+			return err
+		}
+		type offset struct {
+			Start, End, Column       uint32
+			ContextStart, ContextEnd uint32
+		}
+		list := make([]offset, offsets.Len())
+		for i, o := range offsets.ToArray() {
+			list[i] = offset{o.Start(), o.End(), o.Column(), o.Contextstart(), o.Contextend()}
+		}
+		buf, err = json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	// Only present when more context was requested.
+	for _, field := range []struct {
+		name  string
+		lines C.TextList
+	}{{"Before", s.Before()}, {"After", s.After()}} {
+		if field.lines.Len() == 0 {
+			continue
+		}
+		_, err = b.WriteString(",\"" + field.name + "\":")
+		if err != nil {
+			return err
+		}
+		buf, err = json.Marshal(field.lines.ToArray())
+		if err != nil {
+			return err
+		}
+		_, err = b.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
 	err = b.WriteByte('}')
 	if err != nil {
 		return err
@@ -254,8 +407,40 @@ func (s Match) MarshalJSON() ([]byte, error) {
 
 type Match_List C.PointerList
 
-func NewMatchList(s *C.Segment, sz int) Match_List { return Match_List(s.NewCompositeList(16, 7, sz)) }
+func NewMatchList(s *C.Segment, sz int) Match_List { return Match_List(s.NewCompositeList(40, 10, sz)) }
 func (s Match_List) Len() int                      { return C.PointerList(s).Len() }
 func (s Match_List) At(i int) Match                { return Match(C.PointerList(s).At(i).ToStruct()) }
 func (s Match_List) ToArray() []Match              { return *(*[]Match)(unsafe.Pointer(C.PointerList(s).ToArray())) }
 func (s Match_List) Set(i int, item Match)         { C.PointerList(s).Set(i, C.Object(item)) }
+
+type Offset C.Struct
+
+func NewOffset(s *C.Segment) Offset       { return Offset(s.NewStruct(24, 0)) }
+func NewRootOffset(s *C.Segment) Offset   { return Offset(s.NewRootStruct(24, 0)) }
+func AutoNewOffset(s *C.Segment) Offset   { return Offset(s.NewStructAR(24, 0)) }
+func ReadRootOffset(s *C.Segment) Offset  { return Offset(s.Root(0).ToStruct()) }
+func (s Offset) Start() uint32            { return C.Struct(s).Get32(0) }
+func (s Offset) SetStart(v uint32)        { C.Struct(s).Set32(0, v) }
+func (s Offset) End() uint32              { return C.Struct(s).Get32(4) }
+func (s Offset) SetEnd(v uint32)          { C.Struct(s).Set32(4, v) }
+func (s Offset) Column() uint32           { return C.Struct(s).Get32(8) }
+func (s Offset) SetColumn(v uint32)       { C.Struct(s).Set32(8, v) }
+func (s Offset) Contextstart() uint32     { return C.Struct(s).Get32(12) }
+func (s Offset) SetContextstart(v uint32) { C.Struct(s).Set32(12, v) }
+func (s Offset) Contextend() uint32       { return C.Struct(s).Get32(16) }
+func (s Offset) SetContextend(v uint32)   { C.Struct(s).Set32(16, v) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s Offset) MarshalJSON() (bs []byte, err error) { return }
+
+type Offset_List C.PointerList
+
+func NewOffsetList(s *C.Segment, sz int) Offset_List {
+	return Offset_List(s.NewCompositeList(24, 0, sz))
+}
+func (s Offset_List) Len() int        { return C.PointerList(s).Len() }
+func (s Offset_List) At(i int) Offset { return Offset(C.PointerList(s).At(i).ToStruct()) }
+func (s Offset_List) ToArray() []Offset {
+	return *(*[]Offset)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s Offset_List) Set(i int, item Offset) { C.PointerList(s).Set(i, C.Object(item)) }
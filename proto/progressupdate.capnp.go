@@ -9,14 +9,18 @@ import (
 
 type ProgressUpdate C.Struct
 
-func NewProgressUpdate(s *C.Segment) ProgressUpdate      { return ProgressUpdate(s.NewStruct(16, 0)) }
-func NewRootProgressUpdate(s *C.Segment) ProgressUpdate  { return ProgressUpdate(s.NewRootStruct(16, 0)) }
-func AutoNewProgressUpdate(s *C.Segment) ProgressUpdate  { return ProgressUpdate(s.NewStructAR(16, 0)) }
+func NewProgressUpdate(s *C.Segment) ProgressUpdate      { return ProgressUpdate(s.NewStruct(16, 2)) }
+func NewRootProgressUpdate(s *C.Segment) ProgressUpdate  { return ProgressUpdate(s.NewRootStruct(16, 2)) }
+func AutoNewProgressUpdate(s *C.Segment) ProgressUpdate  { return ProgressUpdate(s.NewStructAR(16, 2)) }
 func ReadRootProgressUpdate(s *C.Segment) ProgressUpdate { return ProgressUpdate(s.Root(0).ToStruct()) }
 func (s ProgressUpdate) Filesprocessed() uint64          { return C.Struct(s).Get64(0) }
 func (s ProgressUpdate) SetFilesprocessed(v uint64)      { C.Struct(s).Set64(0, v) }
 func (s ProgressUpdate) Filestotal() uint64              { return C.Struct(s).Get64(8) }
 func (s ProgressUpdate) SetFilestotal(v uint64)          { C.Struct(s).Set64(8, v) }
+func (s ProgressUpdate) Limitshit() string               { return C.Struct(s).GetObject(0).ToText() }
+func (s ProgressUpdate) SetLimitshit(v string)           { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s ProgressUpdate) Facets() Facet_List              { return Facet_List(C.Struct(s).GetObject(1)) }
+func (s ProgressUpdate) SetFacets(v Facet_List)          { C.Struct(s).SetObject(1, C.Object(v)) }
 
 // capn.JSON_enabled == false so we stub MarshallJSON().
 func (s ProgressUpdate) MarshalJSON() (bs []byte, err error) { return }
@@ -24,7 +28,7 @@ func (s ProgressUpdate) MarshalJSON() (bs []byte, err error) { return }
 type ProgressUpdate_List C.PointerList
 
 func NewProgressUpdateList(s *C.Segment, sz int) ProgressUpdate_List {
-	return ProgressUpdate_List(s.NewCompositeList(16, 0, sz))
+	return ProgressUpdate_List(s.NewCompositeList(16, 2, sz))
 }
 func (s ProgressUpdate_List) Len() int { return C.PointerList(s).Len() }
 func (s ProgressUpdate_List) At(i int) ProgressUpdate {
@@ -34,3 +38,27 @@ func (s ProgressUpdate_List) ToArray() []ProgressUpdate {
 	return *(*[]ProgressUpdate)(unsafe.Pointer(C.PointerList(s).ToArray()))
 }
 func (s ProgressUpdate_List) Set(i int, item ProgressUpdate) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type Facet C.Struct
+
+func NewFacet(s *C.Segment) Facet      { return Facet(s.NewStruct(8, 2)) }
+func NewRootFacet(s *C.Segment) Facet  { return Facet(s.NewRootStruct(8, 2)) }
+func AutoNewFacet(s *C.Segment) Facet  { return Facet(s.NewStructAR(8, 2)) }
+func ReadRootFacet(s *C.Segment) Facet { return Facet(s.Root(0).ToStruct()) }
+func (s Facet) Kind() string           { return C.Struct(s).GetObject(0).ToText() }
+func (s Facet) SetKind(v string)       { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s Facet) Value() string          { return C.Struct(s).GetObject(1).ToText() }
+func (s Facet) SetValue(v string)      { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+func (s Facet) Count() uint64          { return C.Struct(s).Get64(0) }
+func (s Facet) SetCount(v uint64)      { C.Struct(s).Set64(0, v) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s Facet) MarshalJSON() (bs []byte, err error) { return }
+
+type Facet_List C.PointerList
+
+func NewFacetList(s *C.Segment, sz int) Facet_List { return Facet_List(s.NewCompositeList(8, 2, sz)) }
+func (s Facet_List) Len() int                      { return C.PointerList(s).Len() }
+func (s Facet_List) At(i int) Facet                { return Facet(C.PointerList(s).At(i).ToStruct()) }
+func (s Facet_List) ToArray() []Facet              { return *(*[]Facet)(unsafe.Pointer(C.PointerList(s).ToArray())) }
+func (s Facet_List) Set(i int, item Facet)         { C.PointerList(s).Set(i, C.Object(item)) }
@@ -0,0 +1,284 @@
+package proto
+
+// The SourceBackend gRPC service, which dcs-web uses to query the
+// source-backends:
+//
+//	service SourceBackend {
+//	    // Returns all matches at once.
+//	    rpc Search(SearchRequest) returns (SearchReply);
+//	    // Returns progress updates and matches as they are found.
+//	    rpc Stream(SearchRequest) returns (stream Z);
+//	    // Returns all matches of several queries at once.
+//	    rpc BatchSearch(BatchSearchRequest) returns (BatchSearchReply);
+//	    rpc Health(HealthRequest) returns (HealthReply);
+//	    // Makes the index-backend load a new shard.
+//	    rpc ReloadShard(ReloadShardRequest) returns (ReloadShardReply);
+//	}
+//
+// The messages are the Cap’n Proto structs from sourcebackend.capnp, which
+// are sent in packed encoding (see capnpCodec), so this file contains by hand
+// what protoc would generate for protobuf messages. Every message is the root
+// of its own segment.
+//
+// Deadlines and cancellation of the context passed to the client methods are
+// propagated to the server, where they end up in the context of the call
+// (or the stream).
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+
+	C "github.com/glycerine/go-capnproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+)
+
+const capnpCodecName = "capnp"
+
+// capnpCodec (un)marshals *C.Segment values, i.e. Cap’n Proto messages.
+type capnpCodec struct{}
+
+func (capnpCodec) Marshal(v interface{}) ([]byte, error) {
+	seg, ok := v.(*C.Segment)
+	if !ok {
+		return nil, fmt.Errorf("capnp codec: cannot marshal %T", v)
+	}
+	var buf bytes.Buffer
+	if _, err := seg.WriteToPacked(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (capnpCodec) Unmarshal(data []byte, v interface{}) error {
+	seg, ok := v.(**C.Segment)
+	if !ok {
+		return fmt.Errorf("capnp codec: cannot unmarshal into %T", v)
+	}
+	s, err := C.ReadFromPackedStream(bufio.NewReader(bytes.NewReader(data)), new(bytes.Buffer))
+	if err != nil {
+		return err
+	}
+	*seg = s
+	return nil
+}
+
+func (capnpCodec) Name() string {
+	return capnpCodecName
+}
+
+func init() {
+	encoding.RegisterCodec(capnpCodec{})
+}
+
+// SourceBackendServer is implemented by dcs-source-backend.
+type SourceBackendServer interface {
+	Search(context.Context, SearchRequest) (SearchReply, error)
+	Stream(SearchRequest, SourceBackend_StreamServer) error
+	BatchSearch(context.Context, BatchSearchRequest) (BatchSearchReply, error)
+	Health(context.Context, HealthRequest) (HealthReply, error)
+	ReloadShard(context.Context, ReloadShardRequest) (ReloadShardReply, error)
+}
+
+// SourceBackend_StreamServer sends the replies of a Stream call.
+type SourceBackend_StreamServer interface {
+	Send(Z) error
+	Context() context.Context
+}
+
+type sourceBackendStreamServer struct {
+	grpc.ServerStream
+}
+
+func (s *sourceBackendStreamServer) Send(z Z) error {
+	return s.SendMsg(C.Struct(z).Segment)
+}
+
+// RegisterSourceBackendServer makes s serve the SourceBackend service using
+// srv.
+func RegisterSourceBackendServer(s *grpc.Server, srv SourceBackendServer) {
+	s.RegisterService(&sourceBackendServiceDesc, srv)
+}
+
+// unaryHandler returns the handler of a unary method, which calls call with
+// the decoded request and returns the segment of its reply.
+func unaryHandler(method string, call func(srv SourceBackendServer, ctx context.Context, req *C.Segment) (C.Struct, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		var req *C.Segment
+		if err := dec(&req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			reply, err := call(srv.(SourceBackendServer), ctx, req.(*C.Segment))
+			if err != nil {
+				return nil, err
+			}
+			return reply.Segment, nil
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/dcs.SourceBackend/" + method,
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+func streamHandler(srv interface{}, stream grpc.ServerStream) error {
+	var req *C.Segment
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	return srv.(SourceBackendServer).Stream(ReadRootSearchRequest(req), &sourceBackendStreamServer{stream})
+}
+
+var sourceBackendServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dcs.SourceBackend",
+	HandlerType: (*SourceBackendServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Search",
+			Handler: unaryHandler("Search", func(srv SourceBackendServer, ctx context.Context, req *C.Segment) (C.Struct, error) {
+				reply, err := srv.Search(ctx, ReadRootSearchRequest(req))
+				return C.Struct(reply), err
+			}),
+		},
+		{
+			MethodName: "BatchSearch",
+			Handler: unaryHandler("BatchSearch", func(srv SourceBackendServer, ctx context.Context, req *C.Segment) (C.Struct, error) {
+				reply, err := srv.BatchSearch(ctx, ReadRootBatchSearchRequest(req))
+				return C.Struct(reply), err
+			}),
+		},
+		{
+			MethodName: "Health",
+			Handler: unaryHandler("Health", func(srv SourceBackendServer, ctx context.Context, req *C.Segment) (C.Struct, error) {
+				reply, err := srv.Health(ctx, ReadRootHealthRequest(req))
+				return C.Struct(reply), err
+			}),
+		},
+		{
+			MethodName: "ReloadShard",
+			Handler: unaryHandler("ReloadShard", func(srv SourceBackendServer, ctx context.Context, req *C.Segment) (C.Struct, error) {
+				reply, err := srv.ReloadShard(ctx, ReadRootReloadShardRequest(req))
+				return C.Struct(reply), err
+			}),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       streamHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sourcebackend.capnp",
+}
+
+// SourceBackendClient is the client side of the SourceBackend service.
+type SourceBackendClient interface {
+	Search(ctx context.Context, req SearchRequest) (SearchReply, error)
+	Stream(ctx context.Context, req SearchRequest) (SourceBackend_StreamClient, error)
+	BatchSearch(ctx context.Context, req BatchSearchRequest) (BatchSearchReply, error)
+	Health(ctx context.Context, req HealthRequest) (HealthReply, error)
+	ReloadShard(ctx context.Context, req ReloadShardRequest) (ReloadShardReply, error)
+	Close() error
+}
+
+// SourceBackend_StreamClient receives the replies of a Stream call. Recv
+// returns io.EOF after the last one.
+type SourceBackend_StreamClient interface {
+	Recv() (Z, error)
+}
+
+type sourceBackendClient struct {
+	conn *grpc.ClientConn
+}
+
+// DialSourceBackend returns a client for the SourceBackend service at addr
+// (host:port). The connection is established lazily and re-used for all
+// calls, so a single client should be kept per backend.
+func DialSourceBackend(addr string) (SourceBackendClient, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(capnpCodecName)))
+	if err != nil {
+		return nil, err
+	}
+	return &sourceBackendClient{conn}, nil
+}
+
+func (c *sourceBackendClient) invoke(ctx context.Context, method string, req C.Struct) (*C.Segment, error) {
+	var reply *C.Segment
+	if err := c.conn.Invoke(ctx, "/dcs.SourceBackend/"+method, req.Segment, &reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *sourceBackendClient) Search(ctx context.Context, req SearchRequest) (SearchReply, error) {
+	reply, err := c.invoke(ctx, "Search", C.Struct(req))
+	if err != nil {
+		return SearchReply{}, err
+	}
+	return ReadRootSearchReply(reply), nil
+}
+
+func (c *sourceBackendClient) BatchSearch(ctx context.Context, req BatchSearchRequest) (BatchSearchReply, error) {
+	reply, err := c.invoke(ctx, "BatchSearch", C.Struct(req))
+	if err != nil {
+		return BatchSearchReply{}, err
+	}
+	return ReadRootBatchSearchReply(reply), nil
+}
+
+func (c *sourceBackendClient) Health(ctx context.Context, req HealthRequest) (HealthReply, error) {
+	reply, err := c.invoke(ctx, "Health", C.Struct(req))
+	if err != nil {
+		return HealthReply{}, err
+	}
+	return ReadRootHealthReply(reply), nil
+}
+
+func (c *sourceBackendClient) ReloadShard(ctx context.Context, req ReloadShardRequest) (ReloadShardReply, error) {
+	reply, err := c.invoke(ctx, "ReloadShard", C.Struct(req))
+	if err != nil {
+		return ReloadShardReply{}, err
+	}
+	return ReadRootReloadShardReply(reply), nil
+}
+
+type sourceBackendStreamClient struct {
+	grpc.ClientStream
+}
+
+func (c *sourceBackendClient) Stream(ctx context.Context, req SearchRequest) (SourceBackend_StreamClient, error) {
+	stream, err := c.conn.NewStream(ctx, &sourceBackendServiceDesc.Streams[0], "/dcs.SourceBackend/Stream")
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(C.Struct(req).Segment); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &sourceBackendStreamClient{stream}, nil
+}
+
+func (c *sourceBackendStreamClient) Recv() (Z, error) {
+	var reply *C.Segment
+	if err := c.RecvMsg(&reply); err != nil {
+		return Z{}, err
+	}
+	return ReadRootZ(reply), nil
+}
+
+func (c *sourceBackendClient) Close() error {
+	return c.conn.Close()
+}
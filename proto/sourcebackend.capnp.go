@@ -15,12 +15,14 @@ const (
 	Z_MATCH          Z_Which = 1
 )
 
-func NewZ(s *C.Segment) Z                  { return Z(s.NewStruct(8, 1)) }
-func NewRootZ(s *C.Segment) Z              { return Z(s.NewRootStruct(8, 1)) }
-func AutoNewZ(s *C.Segment) Z              { return Z(s.NewStructAR(8, 1)) }
-func ReadRootZ(s *C.Segment) Z             { return Z(s.Root(0).ToStruct()) }
-func (s Z) Which() Z_Which                 { return Z_Which(C.Struct(s).Get16(0)) }
-func (s Z) Progressupdate() ProgressUpdate { return ProgressUpdate(C.Struct(s).GetObject(0).ToStruct()) }
+func NewZ(s *C.Segment) Z      { return Z(s.NewStruct(8, 1)) }
+func NewRootZ(s *C.Segment) Z  { return Z(s.NewRootStruct(8, 1)) }
+func AutoNewZ(s *C.Segment) Z  { return Z(s.NewStructAR(8, 1)) }
+func ReadRootZ(s *C.Segment) Z { return Z(s.Root(0).ToStruct()) }
+func (s Z) Which() Z_Which     { return Z_Which(C.Struct(s).Get16(0)) }
+func (s Z) Progressupdate() ProgressUpdate {
+	return ProgressUpdate(C.Struct(s).GetObject(0).ToStruct())
+}
 func (s Z) SetProgressupdate(v ProgressUpdate) {
 	C.Struct(s).Set16(0, 0)
 	C.Struct(s).SetObject(0, C.Object(v))
@@ -38,3 +40,269 @@ func (s Z_List) Len() int                  { return C.PointerList(s).Len() }
 func (s Z_List) At(i int) Z                { return Z(C.PointerList(s).At(i).ToStruct()) }
 func (s Z_List) ToArray() []Z              { return *(*[]Z)(unsafe.Pointer(C.PointerList(s).ToArray())) }
 func (s Z_List) Set(i int, item Z)         { C.PointerList(s).Set(i, C.Object(item)) }
+
+type SearchRequest C.Struct
+
+func NewSearchRequest(s *C.Segment) SearchRequest      { return SearchRequest(s.NewStruct(32, 3)) }
+func NewRootSearchRequest(s *C.Segment) SearchRequest  { return SearchRequest(s.NewRootStruct(32, 3)) }
+func AutoNewSearchRequest(s *C.Segment) SearchRequest  { return SearchRequest(s.NewStructAR(32, 3)) }
+func ReadRootSearchRequest(s *C.Segment) SearchRequest { return SearchRequest(s.Root(0).ToStruct()) }
+func (s SearchRequest) Query() string                  { return C.Struct(s).GetObject(0).ToText() }
+func (s SearchRequest) SetQuery(v string)              { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s SearchRequest) Url() string                    { return C.Struct(s).GetObject(1).ToText() }
+func (s SearchRequest) SetUrl(v string)                { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+func (s SearchRequest) Maxfiles() uint64               { return C.Struct(s).Get64(0) }
+func (s SearchRequest) SetMaxfiles(v uint64)           { C.Struct(s).Set64(0, v) }
+func (s SearchRequest) Maxbytes() uint64               { return C.Struct(s).Get64(8) }
+func (s SearchRequest) SetMaxbytes(v uint64)           { C.Struct(s).Set64(8, v) }
+func (s SearchRequest) Maxmatches() uint64             { return C.Struct(s).Get64(16) }
+func (s SearchRequest) SetMaxmatches(v uint64)         { C.Struct(s).Set64(16, v) }
+func (s SearchRequest) Timeoutms() uint64              { return C.Struct(s).Get64(24) }
+func (s SearchRequest) SetTimeoutms(v uint64)          { C.Struct(s).Set64(24, v) }
+func (s SearchRequest) Files() C.TextList              { return C.TextList(C.Struct(s).GetObject(2)) }
+func (s SearchRequest) SetFiles(v C.TextList)          { C.Struct(s).SetObject(2, C.Object(v)) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s SearchRequest) MarshalJSON() (bs []byte, err error) { return }
+
+type SearchRequest_List C.PointerList
+
+func NewSearchRequestList(s *C.Segment, sz int) SearchRequest_List {
+	return SearchRequest_List(s.NewCompositeList(32, 3, sz))
+}
+func (s SearchRequest_List) Len() int { return C.PointerList(s).Len() }
+func (s SearchRequest_List) At(i int) SearchRequest {
+	return SearchRequest(C.PointerList(s).At(i).ToStruct())
+}
+func (s SearchRequest_List) ToArray() []SearchRequest {
+	return *(*[]SearchRequest)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s SearchRequest_List) Set(i int, item SearchRequest) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type SearchReply C.Struct
+
+func NewSearchReply(s *C.Segment) SearchReply      { return SearchReply(s.NewStruct(8, 2)) }
+func NewRootSearchReply(s *C.Segment) SearchReply  { return SearchReply(s.NewRootStruct(8, 2)) }
+func AutoNewSearchReply(s *C.Segment) SearchReply  { return SearchReply(s.NewStructAR(8, 2)) }
+func ReadRootSearchReply(s *C.Segment) SearchReply { return SearchReply(s.Root(0).ToStruct()) }
+func (s SearchReply) Matches() Match_List          { return Match_List(C.Struct(s).GetObject(0)) }
+func (s SearchReply) SetMatches(v Match_List)      { C.Struct(s).SetObject(0, C.Object(v)) }
+func (s SearchReply) Filestotal() uint64           { return C.Struct(s).Get64(0) }
+func (s SearchReply) SetFilestotal(v uint64)       { C.Struct(s).Set64(0, v) }
+func (s SearchReply) Limitshit() string            { return C.Struct(s).GetObject(1).ToText() }
+func (s SearchReply) SetLimitshit(v string)        { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s SearchReply) MarshalJSON() (bs []byte, err error) { return }
+
+type SearchReply_List C.PointerList
+
+func NewSearchReplyList(s *C.Segment, sz int) SearchReply_List {
+	return SearchReply_List(s.NewCompositeList(8, 2, sz))
+}
+func (s SearchReply_List) Len() int { return C.PointerList(s).Len() }
+func (s SearchReply_List) At(i int) SearchReply {
+	return SearchReply(C.PointerList(s).At(i).ToStruct())
+}
+func (s SearchReply_List) ToArray() []SearchReply {
+	return *(*[]SearchReply)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s SearchReply_List) Set(i int, item SearchReply) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type HealthRequest C.Struct
+
+func NewHealthRequest(s *C.Segment) HealthRequest      { return HealthRequest(s.NewStruct(0, 0)) }
+func NewRootHealthRequest(s *C.Segment) HealthRequest  { return HealthRequest(s.NewRootStruct(0, 0)) }
+func AutoNewHealthRequest(s *C.Segment) HealthRequest  { return HealthRequest(s.NewStructAR(0, 0)) }
+func ReadRootHealthRequest(s *C.Segment) HealthRequest { return HealthRequest(s.Root(0).ToStruct()) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s HealthRequest) MarshalJSON() (bs []byte, err error) { return }
+
+type HealthRequest_List C.PointerList
+
+func NewHealthRequestList(s *C.Segment, sz int) HealthRequest_List {
+	return HealthRequest_List(s.NewCompositeList(0, 0, sz))
+}
+func (s HealthRequest_List) Len() int { return C.PointerList(s).Len() }
+func (s HealthRequest_List) At(i int) HealthRequest {
+	return HealthRequest(C.PointerList(s).At(i).ToStruct())
+}
+func (s HealthRequest_List) ToArray() []HealthRequest {
+	return *(*[]HealthRequest)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s HealthRequest_List) Set(i int, item HealthRequest) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type HealthReply C.Struct
+
+func NewHealthReply(s *C.Segment) HealthReply      { return HealthReply(s.NewStruct(16, 2)) }
+func NewRootHealthReply(s *C.Segment) HealthReply  { return HealthReply(s.NewRootStruct(16, 2)) }
+func AutoNewHealthReply(s *C.Segment) HealthReply  { return HealthReply(s.NewStructAR(16, 2)) }
+func ReadRootHealthReply(s *C.Segment) HealthReply { return HealthReply(s.Root(0).ToStruct()) }
+func (s HealthReply) Healthy() bool                { return C.Struct(s).Get1(0) }
+func (s HealthReply) SetHealthy(v bool)            { C.Struct(s).Set1(0, v) }
+func (s HealthReply) Status() string               { return C.Struct(s).GetObject(0).ToText() }
+func (s HealthReply) SetStatus(v string)           { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+func (s HealthReply) Shardstate() string           { return C.Struct(s).GetObject(1).ToText() }
+func (s HealthReply) SetShardstate(v string)       { C.Struct(s).SetObject(1, s.Segment.NewText(v)) }
+func (s HealthReply) Generation() uint64           { return C.Struct(s).Get64(8) }
+func (s HealthReply) SetGeneration(v uint64)       { C.Struct(s).Set64(8, v) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s HealthReply) MarshalJSON() (bs []byte, err error) { return }
+
+type HealthReply_List C.PointerList
+
+func NewHealthReplyList(s *C.Segment, sz int) HealthReply_List {
+	return HealthReply_List(s.NewCompositeList(16, 2, sz))
+}
+func (s HealthReply_List) Len() int { return C.PointerList(s).Len() }
+func (s HealthReply_List) At(i int) HealthReply {
+	return HealthReply(C.PointerList(s).At(i).ToStruct())
+}
+func (s HealthReply_List) ToArray() []HealthReply {
+	return *(*[]HealthReply)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s HealthReply_List) Set(i int, item HealthReply) { C.PointerList(s).Set(i, C.Object(item)) }
+
+type ReloadShardRequest C.Struct
+
+func NewReloadShardRequest(s *C.Segment) ReloadShardRequest {
+	return ReloadShardRequest(s.NewStruct(0, 1))
+}
+func NewRootReloadShardRequest(s *C.Segment) ReloadShardRequest {
+	return ReloadShardRequest(s.NewRootStruct(0, 1))
+}
+func AutoNewReloadShardRequest(s *C.Segment) ReloadShardRequest {
+	return ReloadShardRequest(s.NewStructAR(0, 1))
+}
+func ReadRootReloadShardRequest(s *C.Segment) ReloadShardRequest {
+	return ReloadShardRequest(s.Root(0).ToStruct())
+}
+func (s ReloadShardRequest) Shard() string     { return C.Struct(s).GetObject(0).ToText() }
+func (s ReloadShardRequest) SetShard(v string) { C.Struct(s).SetObject(0, s.Segment.NewText(v)) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s ReloadShardRequest) MarshalJSON() (bs []byte, err error) { return }
+
+type ReloadShardRequest_List C.PointerList
+
+func NewReloadShardRequestList(s *C.Segment, sz int) ReloadShardRequest_List {
+	return ReloadShardRequest_List(s.NewCompositeList(0, 1, sz))
+}
+func (s ReloadShardRequest_List) Len() int { return C.PointerList(s).Len() }
+func (s ReloadShardRequest_List) At(i int) ReloadShardRequest {
+	return ReloadShardRequest(C.PointerList(s).At(i).ToStruct())
+}
+func (s ReloadShardRequest_List) ToArray() []ReloadShardRequest {
+	return *(*[]ReloadShardRequest)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s ReloadShardRequest_List) Set(i int, item ReloadShardRequest) {
+	C.PointerList(s).Set(i, C.Object(item))
+}
+
+type ReloadShardReply C.Struct
+
+func NewReloadShardReply(s *C.Segment) ReloadShardReply { return ReloadShardReply(s.NewStruct(0, 0)) }
+func NewRootReloadShardReply(s *C.Segment) ReloadShardReply {
+	return ReloadShardReply(s.NewRootStruct(0, 0))
+}
+func AutoNewReloadShardReply(s *C.Segment) ReloadShardReply {
+	return ReloadShardReply(s.NewStructAR(0, 0))
+}
+func ReadRootReloadShardReply(s *C.Segment) ReloadShardReply {
+	return ReloadShardReply(s.Root(0).ToStruct())
+}
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s ReloadShardReply) MarshalJSON() (bs []byte, err error) { return }
+
+type ReloadShardReply_List C.PointerList
+
+func NewReloadShardReplyList(s *C.Segment, sz int) ReloadShardReply_List {
+	return ReloadShardReply_List(s.NewCompositeList(0, 0, sz))
+}
+func (s ReloadShardReply_List) Len() int { return C.PointerList(s).Len() }
+func (s ReloadShardReply_List) At(i int) ReloadShardReply {
+	return ReloadShardReply(C.PointerList(s).At(i).ToStruct())
+}
+func (s ReloadShardReply_List) ToArray() []ReloadShardReply {
+	return *(*[]ReloadShardReply)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s ReloadShardReply_List) Set(i int, item ReloadShardReply) {
+	C.PointerList(s).Set(i, C.Object(item))
+}
+
+type BatchSearchRequest C.Struct
+
+func NewBatchSearchRequest(s *C.Segment) BatchSearchRequest {
+	return BatchSearchRequest(s.NewStruct(0, 1))
+}
+func NewRootBatchSearchRequest(s *C.Segment) BatchSearchRequest {
+	return BatchSearchRequest(s.NewRootStruct(0, 1))
+}
+func AutoNewBatchSearchRequest(s *C.Segment) BatchSearchRequest {
+	return BatchSearchRequest(s.NewStructAR(0, 1))
+}
+func ReadRootBatchSearchRequest(s *C.Segment) BatchSearchRequest {
+	return BatchSearchRequest(s.Root(0).ToStruct())
+}
+func (s BatchSearchRequest) Queries() SearchRequest_List {
+	return SearchRequest_List(C.Struct(s).GetObject(0))
+}
+func (s BatchSearchRequest) SetQueries(v SearchRequest_List) { C.Struct(s).SetObject(0, C.Object(v)) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s BatchSearchRequest) MarshalJSON() (bs []byte, err error) { return }
+
+type BatchSearchRequest_List C.PointerList
+
+func NewBatchSearchRequestList(s *C.Segment, sz int) BatchSearchRequest_List {
+	return BatchSearchRequest_List(s.NewCompositeList(0, 1, sz))
+}
+func (s BatchSearchRequest_List) Len() int { return C.PointerList(s).Len() }
+func (s BatchSearchRequest_List) At(i int) BatchSearchRequest {
+	return BatchSearchRequest(C.PointerList(s).At(i).ToStruct())
+}
+func (s BatchSearchRequest_List) ToArray() []BatchSearchRequest {
+	return *(*[]BatchSearchRequest)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s BatchSearchRequest_List) Set(i int, item BatchSearchRequest) {
+	C.PointerList(s).Set(i, C.Object(item))
+}
+
+type BatchSearchReply C.Struct
+
+func NewBatchSearchReply(s *C.Segment) BatchSearchReply { return BatchSearchReply(s.NewStruct(0, 1)) }
+func NewRootBatchSearchReply(s *C.Segment) BatchSearchReply {
+	return BatchSearchReply(s.NewRootStruct(0, 1))
+}
+func AutoNewBatchSearchReply(s *C.Segment) BatchSearchReply {
+	return BatchSearchReply(s.NewStructAR(0, 1))
+}
+func ReadRootBatchSearchReply(s *C.Segment) BatchSearchReply {
+	return BatchSearchReply(s.Root(0).ToStruct())
+}
+func (s BatchSearchReply) Replies() SearchReply_List {
+	return SearchReply_List(C.Struct(s).GetObject(0))
+}
+func (s BatchSearchReply) SetReplies(v SearchReply_List) { C.Struct(s).SetObject(0, C.Object(v)) }
+
+// capn.JSON_enabled == false so we stub MarshallJSON().
+func (s BatchSearchReply) MarshalJSON() (bs []byte, err error) { return }
+
+type BatchSearchReply_List C.PointerList
+
+func NewBatchSearchReplyList(s *C.Segment, sz int) BatchSearchReply_List {
+	return BatchSearchReply_List(s.NewCompositeList(0, 1, sz))
+}
+func (s BatchSearchReply_List) Len() int { return C.PointerList(s).Len() }
+func (s BatchSearchReply_List) At(i int) BatchSearchReply {
+	return BatchSearchReply(C.PointerList(s).At(i).ToStruct())
+}
+func (s BatchSearchReply_List) ToArray() []BatchSearchReply {
+	return *(*[]BatchSearchReply)(unsafe.Pointer(C.PointerList(s).ToArray()))
+}
+func (s BatchSearchReply_List) Set(i int, item BatchSearchReply) {
+	C.PointerList(s).Set(i, C.Object(item))
+}
@@ -0,0 +1,263 @@
+package query
+
+import (
+	"fmt"
+	"github.com/Debian/dcs/index"
+	"regexp/syntax"
+	"strings"
+)
+
+// Queries can combine regular expressions (terms) with the operators AND, OR
+// and NOT, e.g. “foo AND bar NOT baz”, in which case a file matches if its
+// matching terms satisfy the expression. Terms which follow each other
+// without an operator are combined with AND. NOT binds strongest, OR weakest,
+// and “a NOT b” means “a AND NOT b”.
+//
+// The operators need to be upper-case and separated by spaces. Queries
+// without operators are a single regular expression, spaces included, just
+// like before operators were introduced.
+
+// ExprOp is the type of an Expr node.
+type ExprOp int
+
+const (
+	ExprTerm ExprOp = iota // A regular expression
+	ExprAnd                // All of Sub must match
+	ExprOr                 // At least one of Sub must match
+	ExprNot                // Sub[0] must not match
+)
+
+// An Expr is a parsed query with operators, see ParseExpr.
+type Expr struct {
+	Op ExprOp
+
+	// For ExprTerm: the regular expression and its number, i.e. the index
+	// into the slice returned by Terms.
+	Regexp string
+	Term   int
+
+	Sub []*Expr
+}
+
+func isOperator(word string) bool {
+	return word == "AND" || word == "OR" || word == "NOT"
+}
+
+// ParseExpr parses re (the Regexp of a Query). It returns nil if re does not
+// contain any operators, i.e. if it is a single regular expression. A
+// leading (?i) (see Query.Case) applies to all terms. Queries with the
+// line:full keyword are always a single regular expression.
+func ParseExpr(re string) (*Expr, error) {
+	if strings.HasPrefix(strings.TrimPrefix(re, "(?i)"), FullLinePrefix) {
+		return nil, nil
+	}
+	words := strings.Fields(re)
+	hasOperator := false
+	for _, word := range words {
+		if isOperator(word) {
+			hasOperator = true
+			break
+		}
+	}
+	if !hasOperator {
+		return nil, nil
+	}
+	prefix := ""
+	if strings.HasPrefix(words[0], "(?i)") {
+		prefix = "(?i)"
+		words[0] = words[0][len(prefix):]
+		if words[0] == "" {
+			words = words[1:]
+		}
+	}
+	p := exprParser{words: words, prefix: prefix}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.words) > 0 {
+		return nil, fmt.Errorf("unexpected %q", p.words[0])
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	words  []string
+	prefix string
+	terms  int
+}
+
+func (p *exprParser) peek() string {
+	if len(p.words) == 0 {
+		return ""
+	}
+	return p.words[0]
+}
+
+func (p *exprParser) or() (*Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.words = p.words[1:]
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if e.Op != ExprOr {
+			e = &Expr{Op: ExprOr, Sub: []*Expr{e}}
+		}
+		e.Sub = append(e.Sub, r)
+	}
+	return e, nil
+}
+
+func (p *exprParser) and() (*Expr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for next := p.peek(); next != "" && next != "OR"; next = p.peek() {
+		if next == "AND" {
+			p.words = p.words[1:]
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if e.Op != ExprAnd {
+			e = &Expr{Op: ExprAnd, Sub: []*Expr{e}}
+		}
+		e.Sub = append(e.Sub, r)
+	}
+	return e, nil
+}
+
+func (p *exprParser) unary() (*Expr, error) {
+	word := p.peek()
+	if word == "NOT" {
+		p.words = p.words[1:]
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Op: ExprNot, Sub: []*Expr{e}}, nil
+	}
+	if word == "" || isOperator(word) {
+		return nil, fmt.Errorf("missing search term before %q", word)
+	}
+	p.words = p.words[1:]
+	e := &Expr{Op: ExprTerm, Regexp: p.prefix + word, Term: p.terms}
+	p.terms++
+	return e, nil
+}
+
+// Terms returns all terms of e, ordered by their number.
+func (e *Expr) Terms() []*Expr {
+	if e.Op == ExprTerm {
+		return []*Expr{e}
+	}
+	var terms []*Expr
+	for _, sub := range e.Sub {
+		terms = append(terms, sub.Terms()...)
+	}
+	return terms
+}
+
+// PositiveTerms returns the terms of e which are not negated. Their matches
+// are the results of the query.
+func (e *Expr) PositiveTerms() []*Expr {
+	switch e.Op {
+	case ExprTerm:
+		return []*Expr{e}
+	case ExprNot:
+		return nil
+	}
+	var terms []*Expr
+	for _, sub := range e.Sub {
+		terms = append(terms, sub.PositiveTerms()...)
+	}
+	return terms
+}
+
+// RequiredTerms returns the terms of e which every matching file matches.
+func (e *Expr) RequiredTerms() []*Expr {
+	switch e.Op {
+	case ExprTerm:
+		return []*Expr{e}
+	case ExprAnd:
+		var terms []*Expr
+		for _, sub := range e.Sub {
+			terms = append(terms, sub.RequiredTerms()...)
+		}
+		return terms
+	}
+	return nil
+}
+
+// Eval returns whether a file matches e, given which terms it matches
+// (indexed by Expr.Term).
+func (e *Expr) Eval(matches []bool) bool {
+	switch e.Op {
+	case ExprTerm:
+		return matches[e.Term]
+	case ExprNot:
+		return !e.Sub[0].Eval(matches)
+	case ExprAnd:
+		for _, sub := range e.Sub {
+			if !sub.Eval(matches) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, sub := range e.Sub {
+		if sub.Eval(matches) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexQuery returns the trigram query for the files which possibly match e,
+// combining the queries which termQuery (e.g. index.RegexpQuery) returns for
+// the terms. Negated terms do not restrict the files: a file which contains
+// all trigrams of a term does not necessarily match it, so only searching
+// the file tells.
+func (e *Expr) IndexQuery(termQuery func(re *syntax.Regexp) *index.Query) (*index.Query, error) {
+	switch e.Op {
+	case ExprTerm:
+		re, err := syntax.Parse(e.Regexp, syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		return termQuery(re), nil
+	case ExprNot:
+		if _, err := e.Sub[0].IndexQuery(termQuery); err != nil {
+			return nil, err
+		}
+		return &index.Query{Op: index.QAll}, nil
+	}
+	q := &index.Query{Op: index.QAnd}
+	if e.Op == ExprOr {
+		q.Op = index.QOr
+	}
+	for _, sub := range e.Sub {
+		subq, err := sub.IndexQuery(termQuery)
+		if err != nil {
+			return nil, err
+		}
+		if subq.Op == index.QAll {
+			if q.Op == index.QOr {
+				return subq, nil
+			}
+			continue
+		}
+		q.Sub = append(q.Sub, subq)
+	}
+	if len(q.Sub) == 0 {
+		return &index.Query{Op: index.QAll}, nil
+	}
+	return q, nil
+}
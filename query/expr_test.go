@@ -0,0 +1,117 @@
+package query
+
+import (
+	"github.com/Debian/dcs/index"
+	"strings"
+	"testing"
+)
+
+// format returns e in prefix notation, e.g. “(and foo (not bar))”.
+func format(e *Expr) string {
+	switch e.Op {
+	case ExprTerm:
+		return e.Regexp
+	case ExprNot:
+		return "(not " + format(e.Sub[0]) + ")"
+	}
+	op := "and"
+	if e.Op == ExprOr {
+		op = "or"
+	}
+	parts := []string{op}
+	for _, sub := range e.Sub {
+		parts = append(parts, format(sub))
+	}
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+func TestParseExpr(t *testing.T) {
+	for _, test := range []struct {
+		re   string
+		want string
+	}{
+		{"int main", ""},
+		{"and or not", ""},
+		{"foo AND bar", "(and foo bar)"},
+		{"foo bar NOT baz", "(and foo bar (not baz))"},
+		{"foo OR bar baz", "(or foo (and bar baz))"},
+		{"NOT foo OR NOT NOT bar", "(or (not foo) (not (not bar)))"},
+		{"(?i)foo AND bar", "(and (?i)foo (?i)bar)"},
+		{"(?i) foo OR bar", "(or (?i)foo (?i)bar)"},
+		{"(?m)^(?:errors NOT found)\\r?$", ""},
+	} {
+		e, err := ParseExpr(test.re)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", test.re, err)
+			continue
+		}
+		got := ""
+		if e != nil {
+			got = format(e)
+		}
+		if got != test.want {
+			t.Errorf("ParseExpr(%q) = %q, want %q", test.re, got, test.want)
+		}
+	}
+
+	for _, re := range []string{"AND foo", "foo OR", "foo NOT", "foo AND OR bar"} {
+		if _, err := ParseExpr(re); err == nil {
+			t.Errorf("ParseExpr(%q) did not return an error", re)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	e, err := ParseExpr("foo AND bar NOT baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		matches []bool
+		want    bool
+	}{
+		{[]bool{true, true, false}, true},
+		{[]bool{true, true, true}, false},
+		{[]bool{true, false, false}, false},
+	} {
+		if got := e.Eval(test.matches); got != test.want {
+			t.Errorf("Eval(%v) = %v, want %v", test.matches, got, test.want)
+		}
+	}
+	if got, want := len(e.PositiveTerms()), 2; got != want {
+		t.Errorf("len(PositiveTerms()) = %d, want %d", got, want)
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	for _, test := range []struct {
+		re   string
+		want string
+	}{
+		{"hello AND world", `"ell" "hel" "llo" "orl" "rld" "wor"`},
+		{"hello OR world", `("ell" "hel" "llo")|("orl" "rld" "wor")`},
+		// Negated terms do not rule out any files.
+		{"hello NOT world", `"ell" "hel" "llo"`},
+		{"hello OR NOT world", `+`},
+	} {
+		e, err := ParseExpr(test.re)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := e.IndexQuery(index.RegexpQuery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.String(); got != test.want {
+			t.Errorf("IndexQuery(%q) = %s, want %s", test.re, got, test.want)
+		}
+	}
+
+	e, err := ParseExpr("foo AND (")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.IndexQuery(index.RegexpQuery); err == nil {
+		t.Errorf("IndexQuery did not return an error for an invalid term")
+	}
+}
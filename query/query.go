@@ -0,0 +1,401 @@
+// Package query implements the query language of Debian Code Search: a
+// regular expression plus keywords which restrict the files to search, e.g.
+// “memcpy filetype:c -package:linux”.
+//
+// dcs-web parses queries (see Parse) and passes the keywords on to the
+// backends as separate URL parameters (see Query.Encode and FromValues).
+package query
+
+import (
+	"bytes"
+	"github.com/Debian/dcs/lang"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// A Query is a parsed query.
+type Query struct {
+	// The regular expression to search for, i.e. the query without the
+	// keywords.
+	Regexp string
+
+	// Languages (see the lang package) of the filetype: or lang: keywords.
+	// Files in other languages are not searched.
+	Filetypes []string
+
+	// Languages of the -filetype: or -lang: keywords, which are not
+	// searched.
+	NFiletypes []string
+
+	// The package: (or pkg:) keyword. If set, only this package is searched.
+	Package string
+
+	// The -package: (or -pkg:) keywords, which are not searched.
+	NPackages []string
+
+	// Regular expressions of the path: (or file:) keywords, which the paths
+	// of the searched files must match. Glob patterns are converted, see
+	// pathPattern.
+	Paths []string
+
+	// Regular expressions of the -path: (or -file:) keywords, which the
+	// paths of the searched files must not match.
+	NPaths []string
+
+	// The case: keyword, one of CaseSensitive, CaseInsensitive or CaseAuto.
+	// Regexp is already made case-insensitive accordingly.
+	Case string
+
+	// The matches:all keyword, which lifts the limits on the number of
+	// matches shown per file and per package, e.g. to see all matches of a
+	// file whose matches were cut short.
+	AllMatches bool
+
+	// The line:full keyword, which makes the regular expression match whole
+	// lines only, e.g. to find a pasted #define. Regexp is already anchored
+	// accordingly (see FullLinePrefix).
+	FullLine bool
+
+	// The within: keyword, which is the identifier of an earlier query (as
+	// used in the URLs of its results). Only the files which have results of
+	// that query are searched, so that its results can be narrowed down
+	// without searching everything again.
+	Within string
+
+	// The sort= parameter (not a keyword), one of the SortOrders. Empty
+	// means SortRanking.
+	Sort string
+}
+
+// Values of the case: keyword.
+const (
+	// The query matches case-sensitively (the default).
+	CaseSensitive = "yes"
+
+	// The query matches case-insensitively.
+	CaseInsensitive = "no"
+
+	// The query matches case-insensitively unless it contains upper-case
+	// letters (“smart case”).
+	CaseAuto = "auto"
+)
+
+// Values of the sort= parameter, which orders the results.
+const (
+	// Best results first (the default), see the ranking package.
+	SortRanking = "ranking"
+
+	// By the path of the file (including the source package), ascending.
+	SortPath = "path"
+
+	// Results in popular source packages first (by popcon installations,
+	// see ranking.Popularity).
+	SortPopularity = "popularity"
+
+	// Recently modified files first, according to the file metadata of the
+	// index.
+	SortModTime = "modtime"
+)
+
+// SortOrders are the valid values of the sort= parameter.
+var SortOrders = []string{SortRanking, SortPath, SortPopularity, SortModTime}
+
+// ValidSort returns true if order is empty or one of the SortOrders.
+func ValidSort(order string) bool {
+	if order == "" {
+		return true
+	}
+	for _, o := range SortOrders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// The beginning of the Regexp of queries with the line:full keyword (after
+// the (?i) of case-insensitive queries). The query must match everything from
+// the beginning of a line up to its end (apart from a carriage return).
+const FullLinePrefix = `(?m)^(?:`
+
+const fullLineSuffix = `)\r?$`
+
+// Alternative names for languages, e.g. filetype:cpp is the same as
+// filetype:c++.
+var languageAliases = map[string]string{
+	"cpp":    "c++",
+	"cxx":    "c++",
+	"golang": "go",
+	"js":     "javascript",
+	"py":     "python",
+	"sh":     "shell",
+}
+
+func language(name string) string {
+	name = strings.ToLower(name)
+	if alias, ok := languageAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// Returns the value of word if it starts with one of the given keywords
+// (which must be lower-case and include the colon).
+func keyword(word string, keywords ...string) (string, bool) {
+	lower := strings.ToLower(word)
+	for _, k := range keywords {
+		if strings.HasPrefix(lower, k) {
+			return word[len(k):], true
+		}
+	}
+	return "", false
+}
+
+// isGlob returns true if the value of a path: keyword is a glob pattern
+// rather than a regular expression: it contains a * which does not repeat
+// what precedes it in a regular expression, i.e. it is not preceded by ., ),
+// ] or \. For example, *.min.js and */tests/* are glob patterns, while
+// src/.*_test.go is a regular expression.
+func isGlob(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] != '*' {
+			continue
+		}
+		if i == 0 || !strings.ContainsRune(`.)]\`, rune(value[i-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathPattern returns the regular expression for the value of a path:
+// keyword. Glob patterns (see isGlob) are matched against the whole path of
+// a file (e.g. “i3-wm_4.7-1/src/main.c”), with * matching any sequence of
+// characters (including slashes) and ? matching any character but a slash.
+func pathPattern(value string) string {
+	if !isGlob(value) {
+		return value
+	}
+	var re bytes.Buffer
+	re.WriteString("^")
+	for _, r := range value {
+		switch r {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// hasUpper returns true if the regular expression re contains upper-case
+// literal characters. Escapes such as \S and character classes such as [A-Z]
+// are not taken into account.
+func hasUpper(re string) bool {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		// The query will be refused anyway.
+		return true
+	}
+	var walk func(re *syntax.Regexp) bool
+	walk = func(re *syntax.Regexp) bool {
+		if re.Op == syntax.OpLiteral {
+			for _, r := range re.Rune {
+				if unicode.IsUpper(r) {
+					return true
+				}
+			}
+		}
+		for _, sub := range re.Sub {
+			if walk(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(parsed)
+}
+
+// Parse splits q into the regular expression and the keywords. Keywords are
+// recognized case-insensitively, their values are case-sensitive except for
+// languages.
+func Parse(q string) Query {
+	return ParseDefaultCase(q, CaseSensitive)
+}
+
+// ParseDefaultCase is like Parse, but matches case-insensitively according
+// to defaultCase (see Query.Case) if q does not contain a case: keyword.
+func ParseDefaultCase(q, defaultCase string) Query {
+	var (
+		result Query
+		words  []string
+	)
+	for _, word := range strings.Split(q, " ") {
+		if value, ok := keyword(word, "filetype:", "lang:"); ok {
+			result.Filetypes = append(result.Filetypes, language(value))
+		} else if value, ok := keyword(word, "-filetype:", "-lang:"); ok {
+			result.NFiletypes = append(result.NFiletypes, language(value))
+		} else if value, ok := keyword(word, "package:", "pkg:"); ok {
+			result.Package = value
+		} else if value, ok := keyword(word, "-package:", "-pkg:"); ok {
+			result.NPackages = append(result.NPackages, value)
+		} else if value, ok := keyword(word, "path:", "file:"); ok {
+			result.Paths = append(result.Paths, pathPattern(value))
+		} else if value, ok := keyword(word, "-path:", "-file:"); ok {
+			result.NPaths = append(result.NPaths, pathPattern(value))
+		} else if value, ok := keyword(word, "case:"); ok {
+			result.Case = strings.ToLower(value)
+		} else if value, ok := keyword(word, "matches:"); ok && strings.ToLower(value) == "all" {
+			result.AllMatches = true
+		} else if value, ok := keyword(word, "line:"); ok && strings.ToLower(value) == "full" {
+			result.FullLine = true
+		} else if value, ok := keyword(word, "within:"); ok {
+			result.Within = value
+		} else {
+			words = append(words, word)
+		}
+	}
+	result.Regexp = strings.Join(words, " ")
+	if result.FullLine {
+		result.Regexp = FullLinePrefix + result.Regexp + fullLineSuffix
+	}
+	switch result.Case {
+	case CaseSensitive, CaseInsensitive, CaseAuto:
+	default:
+		result.Case = defaultCase
+	}
+	if !strings.HasPrefix(result.Regexp, "(?i)") &&
+		(result.Case == CaseInsensitive ||
+			result.Case == CaseAuto && !hasUpper(result.Regexp)) {
+		result.Regexp = "(?i)" + result.Regexp
+	}
+	return result
+}
+
+// Encode stores q in values: the regular expression in q=, the keywords in
+// filetype=, nfiletype=, package=, npackage=, path=, npath=, case=,
+// matches=, line=, within= and sort=.
+func (q Query) Encode(values url.Values) {
+	values.Set("q", q.Regexp)
+	if q.Case != "" {
+		values.Set("case", q.Case)
+	}
+	for _, filetype := range q.Filetypes {
+		values.Add("filetype", filetype)
+	}
+	for _, filetype := range q.NFiletypes {
+		values.Add("nfiletype", filetype)
+	}
+	if q.Package != "" {
+		values.Set("package", q.Package)
+	}
+	for _, pkg := range q.NPackages {
+		values.Add("npackage", pkg)
+	}
+	for _, path := range q.Paths {
+		values.Add("path", path)
+	}
+	for _, path := range q.NPaths {
+		values.Add("npath", path)
+	}
+	if q.AllMatches {
+		values.Set("matches", "all")
+	}
+	if q.FullLine {
+		values.Set("line", "full")
+	}
+	if q.Within != "" {
+		values.Set("within", q.Within)
+	}
+	if q.Sort != "" {
+		values.Set("sort", q.Sort)
+	}
+}
+
+// FromValues returns the query stored in values by Encode.
+func FromValues(values url.Values) Query {
+	return Query{
+		Regexp:     values.Get("q"),
+		Filetypes:  values["filetype"],
+		NFiletypes: values["nfiletype"],
+		Package:    values.Get("package"),
+		NPackages:  values["npackage"],
+		Paths:      values["path"],
+		NPaths:     values["npath"],
+		Case:       values.Get("case"),
+		AllMatches: values.Get("matches") == "all",
+		FullLine:   values.Get("line") == "full",
+		Within:     values.Get("within"),
+		Sort:       values.Get("sort"),
+	}
+}
+
+// FiltersPackages returns true if q restricts the packages to search.
+func (q Query) FiltersPackages() bool {
+	return q.Package != "" || len(q.NPackages) > 0
+}
+
+// MatchesPackage returns true if the file at path (e.g.
+// “i3-wm_4.7-1/src/main.c”) is in a package which needs to be searched.
+func (q Query) MatchesPackage(path string) bool {
+	pkg := path
+	if i := strings.IndexByte(path, '_'); i >= 0 {
+		pkg = path[:i]
+	}
+	if q.Package != "" && pkg != q.Package {
+		return false
+	}
+	for _, npkg := range q.NPackages {
+		if pkg == npkg {
+			return false
+		}
+	}
+	return true
+}
+
+// FiltersLanguages returns true if q restricts the languages of the files
+// to search.
+func (q Query) FiltersLanguages() bool {
+	return len(q.Filetypes) > 0 || len(q.NFiletypes) > 0
+}
+
+// MatchesLanguage returns true if a file in the given language (see
+// lang.Detect) needs to be searched.
+func (q Query) MatchesLanguage(language string) bool {
+	for _, filetype := range q.NFiletypes {
+		if filetype == language {
+			return false
+		}
+	}
+	if len(q.Filetypes) == 0 {
+		return true
+	}
+	for _, filetype := range q.Filetypes {
+		if filetype == language {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesName is like MatchesLanguage, but for files whose language is not
+// known, so it is guessed from the file name (see lang.FromName).
+func (q Query) MatchesName(path string) bool {
+	languages := lang.FromName(path)
+	if len(languages) == 0 {
+		return len(q.Filetypes) == 0
+	}
+	for _, language := range languages {
+		if q.MatchesLanguage(language) {
+			return true
+		}
+	}
+	return false
+}
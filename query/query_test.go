@@ -0,0 +1,155 @@
+package query
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		q    string
+		want Query
+	}{
+		{"memcpy", Query{Regexp: "memcpy", Case: CaseSensitive}},
+		{"memcpy filetype:c", Query{Regexp: "memcpy", Filetypes: []string{"c"}, Case: CaseSensitive}},
+		{"Lang:CPP memcpy -lang:golang", Query{Regexp: "memcpy", Filetypes: []string{"c++"}, NFiletypes: []string{"go"}, Case: CaseSensitive}},
+		{"a b pkg:i3-WM -package:linux", Query{Regexp: "a b", Package: "i3-WM", NPackages: []string{"linux"}, Case: CaseSensitive}},
+		{"x path:^src/ -file:test", Query{Regexp: "x", Paths: []string{"^src/"}, NPaths: []string{"test"}, Case: CaseSensitive}},
+		{"x matches:all", Query{Regexp: "x", Case: CaseSensitive, AllMatches: true}},
+		{"#define FOO 1 line:full", Query{Regexp: `(?m)^(?:#define FOO 1)\r?$`, Case: CaseSensitive, FullLine: true}},
+		{"foo NOT bar line:full case:no", Query{Regexp: `(?i)(?m)^(?:foo NOT bar)\r?$`, Case: CaseInsensitive, FullLine: true}},
+		{"x within:3f2a9c", Query{Regexp: "x", Case: CaseSensitive, Within: "3f2a9c"}},
+	} {
+		got := Parse(test.q)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.q, got, test.want)
+		}
+		values := url.Values{}
+		got.Encode(values)
+		if roundtrip := FromValues(values); !reflect.DeepEqual(roundtrip, got) {
+			t.Errorf("FromValues(%v) = %+v, want %+v", values, roundtrip, got)
+		}
+	}
+}
+
+func TestMatchesLanguage(t *testing.T) {
+	q := Parse("memcpy filetype:c filetype:c++")
+	for language, want := range map[string]bool{"c": true, "c++": true, "perl": false, "": false} {
+		if got := q.MatchesLanguage(language); got != want {
+			t.Errorf("MatchesLanguage(%q) = %v, want %v", language, got, want)
+		}
+	}
+	q = Parse("memcpy -filetype:c")
+	for language, want := range map[string]bool{"c": false, "c++": true, "": true} {
+		if got := q.MatchesLanguage(language); got != want {
+			t.Errorf("MatchesLanguage(%q) = %v, want %v", language, got, want)
+		}
+	}
+}
+
+func TestMatchesName(t *testing.T) {
+	q := Parse("memcpy filetype:c++")
+	for path, want := range map[string]bool{
+		"i3-wm_4.7/src/main.c":    false,
+		"i3-wm_4.7/src/main.cpp":  true,
+		"i3-wm_4.7/include/all.h": true,
+		"i3-wm_4.7/debian/rules":  false,
+	} {
+		if got := q.MatchesName(path); got != want {
+			t.Errorf("MatchesName(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMatchesPackage(t *testing.T) {
+	for _, test := range []struct {
+		q    string
+		path string
+		want bool
+	}{
+		{"x", "linux_3.16-1/init/main.c", true},
+		{"x package:openssl", "openssl_1.0.1-1/ssl/ssl.h", true},
+		{"x package:openssl", "openssl-blacklist_0.5-3/README", false},
+		{"x -package:linux", "linux_3.16-1/init/main.c", false},
+		{"x -package:linux", "linux-tools_3.16-1/perf/perf.c", true},
+	} {
+		if got := Parse(test.q).MatchesPackage(test.path); got != test.want {
+			t.Errorf("Parse(%q).MatchesPackage(%q) = %v, want %v", test.q, test.path, got, test.want)
+		}
+	}
+}
+
+func TestPathPattern(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		path  string
+		want  bool
+	}{
+		{"*/tests/*", "foo_1.0-1/src/tests/main.c", true},
+		{"*/tests/*", "foo_1.0-1/src/tests.c", false},
+		{"*.min.js", "jquery_1.7-1/dist/jquery.min.js", true},
+		{"*.min.js", "jquery_1.7-1/dist/jquery.min.json", false},
+		{"*/src/?.c", "foo_1.0-1/src/a.c", true},
+		{"*/src/?.c", "foo_1.0-1/src/ab.c", false},
+		// Regular expressions are not converted.
+		{"src/.*_test.go", "foo_1.0-1/src/foo_test.go", true},
+		{"^foo_", "foo_1.0-1/src/foo_test.go", true},
+	} {
+		re, err := regexp.Compile(pathPattern(test.value))
+		if err != nil {
+			t.Fatalf("pathPattern(%q) = %q: %v", test.value, pathPattern(test.value), err)
+		}
+		if got := re.MatchString(test.path); got != test.want {
+			t.Errorf("pathPattern(%q) = %q matches %q = %v, want %v", test.value, pathPattern(test.value), test.path, got, test.want)
+		}
+	}
+}
+
+func TestCase(t *testing.T) {
+	for _, test := range []struct {
+		q           string
+		defaultCase string
+		want        string
+	}{
+		{"memcpy", CaseSensitive, "memcpy"},
+		{"memcpy", CaseInsensitive, "(?i)memcpy"},
+		{"memcpy case:no", CaseSensitive, "(?i)memcpy"},
+		{"memcpy case:yes", CaseInsensitive, "memcpy"},
+		{"memcpy case:auto", CaseSensitive, "(?i)memcpy"},
+		{"MemCpy case:auto", CaseSensitive, "MemCpy"},
+		{`mem\Scpy case:auto`, CaseSensitive, `(?i)mem\Scpy`},
+		{"(?i)memcpy case:no", CaseSensitive, "(?i)memcpy"},
+	} {
+		if got := ParseDefaultCase(test.q, test.defaultCase).Regexp; got != test.want {
+			t.Errorf("ParseDefaultCase(%q, %q).Regexp = %q, want %q", test.q, test.defaultCase, got, test.want)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	for order, want := range map[string]bool{
+		"":           true,
+		"ranking":    true,
+		"path":       true,
+		"popularity": true,
+		"modtime":    true,
+		"Path":       false,
+		"size":       false,
+	} {
+		if got := ValidSort(order); got != want {
+			t.Errorf("ValidSort(%q) = %v, want %v", order, got, want)
+		}
+	}
+	values := url.Values{"q": []string{"memcpy"}, "sort": []string{SortPath}}
+	q := FromValues(values)
+	if q.Sort != SortPath {
+		t.Fatalf("FromValues(%v).Sort = %q, want %q", values, q.Sort, SortPath)
+	}
+	encoded := url.Values{}
+	q.Encode(encoded)
+	if got := encoded.Get("sort"); got != SortPath {
+		t.Errorf("Encode: sort = %q, want %q", got, SortPath)
+	}
+}
@@ -11,9 +11,6 @@ type RankingOpts struct {
 	// Map of file suffix (e.g. ".c") ranking. This is filled in based on the
 	// filetype= parameter (which is extracted from the query string).
 	Suffixes map[string]float32
-	// Same thing, but for the nfiletype parameter (from the -filetype:
-	// keywords in the query).
-	Nsuffixes map[string]float32
 
 	// pre-ranking
 
@@ -109,15 +106,10 @@ func addSuffixesForFiletype(suffixes *map[string]float32, filetype string) {
 func RankingOptsFromQuery(query url.Values) RankingOpts {
 	var result RankingOpts
 	result.Suffixes = make(map[string]float32)
-	result.Nsuffixes = make(map[string]float32)
 	types := query["filetype"]
 	for _, t := range types {
 		addSuffixesForFiletype(&result.Suffixes, t)
 	}
-	excludetypes := query["nfiletype"]
-	for _, t := range excludetypes {
-		addSuffixesForFiletype(&result.Nsuffixes, t)
-	}
 	result.Rdep = boolFromQuery(query, "rdep")
 	result.Inst = boolFromQuery(query, "inst")
 	result.Filetype = boolFromQuery(query, "filetype")
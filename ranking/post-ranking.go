@@ -11,6 +11,10 @@ import (
 	"unicode"
 )
 
+// Added to the final ranking of whole-word matches (see QueryStr.WholeWord),
+// so that they are ordered before all substring matches of the same query.
+const WholeWordBonus = 100
+
 //var packageLocation *regexp.Regexp = regexp.MustCompile(`debian-source-mirror/unpacked/([^/]+)_`)
 
 func countSpaces(line string) int32 {
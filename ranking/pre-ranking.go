@@ -73,21 +73,13 @@ func (rp *ResultPath) Rank(opts *RankingOpts) {
 	if opts.Rdep {
 		rp.Ranking += ranking.rdep
 	}
+	// Files in other languages were already filtered out by the
+	// index-backend (see the query package), which also knows about files
+	// without the typical suffix, e.g. scripts.
 	if (opts.Filetype || opts.Weighted) && len(opts.Suffixes) > 0 {
 		suffix := strings.ToLower(path.Ext(rp.Path))
 		if val, exists := opts.Suffixes[suffix]; exists {
 			rp.Ranking += val
-		} else {
-			// With a ranking of -1, the result will be thrown away.
-			rp.Ranking = -1
-			return
-		}
-	}
-	if (opts.Filetype || opts.Weighted) && len(opts.Nsuffixes) > 0 {
-		suffix := strings.ToLower(path.Ext(rp.Path))
-		if _, exists := opts.Nsuffixes[suffix]; exists {
-			rp.Ranking = -1
-			return
 		}
 	}
 	if opts.Weighted {
@@ -96,6 +88,12 @@ func (rp *ResultPath) Rank(opts *RankingOpts) {
 	}
 }
 
+// Popularity returns the share of popcon installations (in ‰) of the given
+// source package, e.g. “i3-wm”, or 0 if it is not in the ranking database.
+func Popularity(sourcePackage string) float32 {
+	return storedRanking[sourcePackage].inst
+}
+
 type ResultPaths []ResultPath
 
 func (r ResultPaths) Len() int {
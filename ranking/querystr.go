@@ -13,8 +13,14 @@ type QueryStr struct {
 	query string
 	boundaryRegexp *regexp.Regexp
 	anywhereRegexp *regexp.Regexp
+
+	// Whether the query is a literal identifier (e.g. “memcpy”) as opposed to
+	// a regular expression.
+	literal bool
 }
 
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 func NewQueryStr(query string) QueryStr {
 	var result QueryStr
 	result.query = query
@@ -26,9 +32,17 @@ func NewQueryStr(query string) QueryStr {
 	fmt.Printf("quoted query: %s\n", quotedQuery)
 	result.boundaryRegexp = regexp.MustCompile(`(?i)\b` + quotedQuery + `\b`)
 	result.anywhereRegexp = regexp.MustCompile(`(?i)` + quotedQuery)
+	result.literal = identifierRegexp.MatchString(strippedQuery)
 	return result
 }
 
+// WholeWord returns true if the query is a literal identifier and occurs in
+// line delimited by identifier boundaries (e.g. “memcpy” in “memcpy(dst”, but
+// not in “__memcpy_chk(”).
+func (qs *QueryStr) WholeWord(line string) bool {
+	return qs.literal && qs.boundaryRegexp.MatchString(line)
+}
+
 func (qs *QueryStr) Match(path *string) float32 {
 	// XXX: These values might need to be tweaked.
 
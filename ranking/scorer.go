@@ -0,0 +1,101 @@
+// vim:ts=4:sw=4:noexpandtab
+package ranking
+
+import (
+	"github.com/Debian/dcs/regexp"
+)
+
+// The final ranking of a match is computed on the source backend (which has
+// the file contents at hand) by a Ranker, which combines the signals of
+// several Scorers. New signals are added by implementing a Scorer and adding
+// it in NewRanker, without changing the code which searches files and sends
+// the results.
+
+// Everything a Scorer knows about a match.
+type Candidate struct {
+	// The file containing the match: its path (e.g.
+	// “i3-wm_4.7-1/src/main.c”), source package (see SourcePkgIdx) and its
+	// ranking (see ResultPath.Rank), which does not depend on the contents.
+	File *ResultPath
+
+	// The match itself: the line number, the contents of the line and the
+	// lines around it. WholeWord needs to be set already.
+	Match *regexp.Match
+}
+
+// Package returns the name of the source package of the match, e.g.
+// “i3-wm”.
+func (c *Candidate) Package() string {
+	return c.File.Path[c.File.SourcePkgIdx[0]:c.File.SourcePkgIdx[1]]
+}
+
+// A Scorer computes one ranking signal of a match. Higher scores are better.
+type Scorer interface {
+	Score(c *Candidate) float32
+}
+
+// ScorerFunc is a Scorer which calls the function.
+type ScorerFunc func(c *Candidate) float32
+
+func (f ScorerFunc) Score(c *Candidate) float32 {
+	return f(c)
+}
+
+type weightedScorer struct {
+	Scorer
+	weight float32
+}
+
+// A Ranker ranks matches by the weighted sum of the scores of its Scorers.
+type Ranker struct {
+	scorers []weightedScorer
+}
+
+// Add makes r take the score of s into account, multiplied by weight.
+func (r *Ranker) Add(s Scorer, weight float32) {
+	r.scorers = append(r.scorers, weightedScorer{s, weight})
+}
+
+// Rank returns the ranking of c. Matches with a higher ranking are better.
+func (r *Ranker) Rank(c *Candidate) float32 {
+	var ranking float32
+	for _, s := range r.scorers {
+		ranking += s.weight * s.Score(c)
+	}
+	return ranking
+}
+
+// The ranking of the file (see ResultPath.Rank and the path signals the
+// source backend adds to it).
+func pathScore(c *Candidate) float32 {
+	return c.File.Ranking
+}
+
+// Where in the file and in the line the match is, see PostRank.
+type lineScorer struct {
+	opts     RankingOpts
+	querystr *QueryStr
+}
+
+func (s *lineScorer) Score(c *Candidate) float32 {
+	return PostRank(s.opts, c.Match, s.querystr)
+}
+
+// For literal queries, whole-word matches come before substring matches.
+func wholeWordScore(c *Candidate) float32 {
+	if c.Match.WholeWord {
+		return WholeWordBonus
+	}
+	return 0
+}
+
+// NewRanker returns the Ranker for a query. bestPathRank is the ranking of
+// the best file which is searched: the contents of a file are only a tenth as
+// important as the file itself, so the line signals are scaled accordingly.
+func NewRanker(opts RankingOpts, querystr *QueryStr, bestPathRank float32) *Ranker {
+	r := &Ranker{}
+	r.Add(ScorerFunc(pathScore), 1)
+	r.Add(&lineScorer{opts, querystr}, 0.1*bestPathRank)
+	r.Add(ScorerFunc(wholeWordScore), 1)
+	return r
+}
@@ -0,0 +1,126 @@
+package regexp
+
+import (
+	"bytes"
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// Most queries are plain strings, which are found much faster by searching
+// for the string than by running the DFA over every byte.
+
+// literal returns the string re matches if re is a literal suitable for the
+// fast path, i.e. it does not span lines and, if it is case-insensitive,
+// consists of ASCII only. The case-insensitive string is returned in lower
+// case.
+func literal(re *syntax.Regexp) (lit []byte, fold bool, ok bool) {
+	if re.Op != syntax.OpLiteral {
+		return nil, false, false
+	}
+	fold = re.Flags&syntax.FoldCase != 0
+	for _, r := range re.Rune {
+		if r == '\n' || fold && r >= utf8.RuneSelf {
+			return nil, false, false
+		}
+		if fold && 'A' <= r && r <= 'Z' {
+			r += 'a' - 'A'
+		}
+		lit = append(lit, string(r)...)
+	}
+	return lit, fold, true
+}
+
+// unicodeFolds returns true if lit contains a byte which case-insensitively
+// also matches a non-ASCII character: K (Kelvin sign, U+212A) and ſ (long s,
+// U+017F).
+func unicodeFolds(lit []byte) bool {
+	return bytes.IndexByte(lit, 'k') >= 0 || bytes.IndexByte(lit, 's') >= 0
+}
+
+// maybeUnicodeFolds returns true if b might contain the Kelvin sign or long
+// s, judging by the first byte of their UTF-8 encoding.
+func maybeUnicodeFolds(b []byte) bool {
+	return bytes.IndexByte(b, 0xE2) >= 0 || bytes.IndexByte(b, 0xC5) >= 0
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+// equalFold returns true if b equals lit, which is in lower case, ignoring
+// ASCII case.
+func equalFold(b, lit []byte) bool {
+	for i, c := range lit {
+		if lower(b[i]) != c {
+			return false
+		}
+	}
+	return true
+}
+
+// indexFold returns the index of the first occurrence of lit, which is in
+// lower case, in b, ignoring ASCII case, or -1.
+func indexFold(b, lit []byte) int {
+	c0, c1 := lit[0], upper(lit[0])
+	last := len(b) - len(lit)
+	// Positions of the next occurrence of c0 and c1 at or after i (or -1 if
+	// there is none), so that b is scanned for each of them only once.
+	next0, next1 := -2, -2
+	for i := 0; i <= last; {
+		if next0 != -1 && next0 < i {
+			if next0 = bytes.IndexByte(b[i:last+1], c0); next0 >= 0 {
+				next0 += i
+			}
+		}
+		if c1 == c0 {
+			next1 = next0
+		} else if next1 != -1 && next1 < i {
+			if next1 = bytes.IndexByte(b[i:last+1], c1); next1 >= 0 {
+				next1 += i
+			}
+		}
+		j := next0
+		if j == -1 || next1 != -1 && next1 < j {
+			j = next1
+		}
+		if j == -1 {
+			return -1
+		}
+		if equalFold(b[j+1:j+len(lit)], lit[1:]) {
+			return j
+		}
+		i = j + 1
+	}
+	return -1
+}
+
+// matchLiteral is like matcher.match (i.e. it returns the end of the first
+// line containing a match, or -1), but for Regexps which are literals.
+func (r *Regexp) matchLiteral(b []byte, beginText, endText bool) (end int) {
+	var i int
+	if r.fold {
+		if r.unicodeFolds && maybeUnicodeFolds(b) {
+			return r.m.match(b, beginText, endText)
+		}
+		i = indexFold(b, r.literal)
+	} else {
+		i = bytes.Index(b, r.literal)
+	}
+	if i < 0 {
+		return -1
+	}
+	if nl := bytes.IndexByte(b[i+len(r.literal):], '\n'); nl >= 0 {
+		return i + len(r.literal) + nl
+	}
+	return len(b)
+}
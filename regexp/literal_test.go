@@ -0,0 +1,85 @@
+package regexp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLiteral(t *testing.T) {
+	for _, test := range []struct {
+		re      string
+		literal bool
+	}{
+		{`fnord`, true},
+		{`foo\.bar`, true},
+		{`(?i)FooBar`, true},
+		{`ünïcode`, true},
+		{`(?i)ünïcode`, false},
+		{`foo.bar`, false},
+		{`^fnord`, false},
+		{`foo\nbar`, false},
+	} {
+		re, err := Compile(test.re)
+		if err != nil {
+			t.Fatalf("Compile(%#q): %v", test.re, err)
+		}
+		if got := re.literal != nil; got != test.literal {
+			t.Errorf("Compile(%#q) literal = %v, want %v", test.re, got, test.literal)
+		}
+	}
+}
+
+// Verifies that the literal fast path returns the same as the DFA.
+func TestMatchLiteral(t *testing.T) {
+	inputs := []string{
+		"",
+		"fnord",
+		"fnord\n",
+		"x\nfnord\ny\n",
+		"xfnorfnordx\nnext\n",
+		"FNORD\n",
+		"fNoRd",
+		"no match\nat all\n",
+		"fnor\nd\n",
+		"class\n",
+		"CLASS\n",
+		"claſs\n",
+		"Kitten\n",
+		"kitten\nKITTEN\n",
+		"sssss\nfnordfnord\n",
+	}
+	for _, expr := range []string{`fnord`, `(?i)fnord`, `(?i)class`, `(?i)kitten`, `ss`, `(?i)SS`, `d`} {
+		re, err := Compile(expr)
+		if err != nil {
+			t.Fatalf("Compile(%#q): %v", expr, err)
+		}
+		if re.literal == nil {
+			t.Fatalf("Compile(%#q) is not a literal", expr)
+		}
+		for _, input := range inputs {
+			for _, endText := range []bool{false, true} {
+				b := []byte(input)
+				want := re.m.match(b, true, endText)
+				if got := re.Match(b, true, endText); got != want {
+					t.Errorf("%#q.Match(%q, endText=%v) = %d, want %d", expr, input, endText, got, want)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkMatchLiteral(b *testing.B) {
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog\n", 10000) + "fnord\n")
+	for _, expr := range []string{`fnord`, `(?i)FNORD`, `fnor[dx]`} {
+		re, err := Compile(expr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(expr, func(b *testing.B) {
+			b.SetBytes(int64(len(text)))
+			for i := 0; i < b.N; i++ {
+				re.Match(text, true, true)
+			}
+		})
+	}
+}
@@ -5,14 +5,17 @@
 package regexp
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	goregexp "regexp"
 	"regexp/syntax"
 	"sort"
+	"unicode/utf8"
 
 	"code.google.com/p/codesearch/sparse"
 	"html"
@@ -339,9 +342,9 @@ func (m *matcher) matchString(b string, beginText, endText bool) (end int) {
 
 // isWordByte reports whether the byte c is a word character: ASCII only.
 // This is used to implement \b and \B.  This is not right for Unicode, but:
-//	- it's hard to get right in a byte-at-a-time matching world
-//	  (the DFA has only one-byte lookahead)
-//	- this crude approximation is the same one PCRE uses
+//   - it's hard to get right in a byte-at-a-time matching world
+//     (the DFA has only one-byte lookahead)
+//   - this crude approximation is the same one PCRE uses
 func isWordByte(c int) bool {
 	return 'A' <= c && c <= 'Z' ||
 		'a' <= c && c <= 'z' ||
@@ -362,7 +365,25 @@ type Grep struct {
 
 	Match bool
 
+	// MaxLineLen, if non-zero, is the length (in bytes) above which lines
+	// are considered long. Snippets of long lines are cut down to MaxLineLen
+	// bytes around the match, see index.LongLinePolicy.
+	MaxLineLen int
+
+	// SkipLongLines makes Reader ignore matches in long lines instead of
+	// truncating their snippets.
+	SkipLongLines bool
+
+	// Done, if not nil, makes Reader stop once it is closed (e.g. set it to
+	// ctx.Done() of a cancellable query). Matches found before are returned.
+	Done <-chan struct{}
+
+	// ContextLines, if non-zero, is the number of lines before and after
+	// each match which AddContext stores in Match.Before and Match.After.
+	ContextLines int
+
 	buf []byte
+	std *goregexp.Regexp // locates matches within long lines
 }
 
 func (g *Grep) AddFlags() {
@@ -397,6 +418,128 @@ func countNL(b []byte) int {
 	return n
 }
 
+// long returns true if line is longer than g.MaxLineLen.
+func (g *Grep) long(line []byte) bool {
+	return g.MaxLineLen > 0 && len(line) > g.MaxLineLen
+}
+
+// stdRegexp returns g.Regexp compiled by the standard library, which (unlike
+// g.Regexp) locates matches within a line. It returns nil if the expression is
+// not understood by the standard library.
+func (g *Grep) stdRegexp() *goregexp.Regexp {
+	if g.std == nil {
+		g.std, _ = goregexp.Compile(g.Regexp.Syntax.String())
+	}
+	return g.std
+}
+
+// snippetBounds returns the part of line which snippet returns: line, or, if
+// the line is long, the MaxLineLen bytes around the first match (or the
+// beginning of the line if match is false).
+func (g *Grep) snippetBounds(line []byte, match bool) (start, end int) {
+	if !g.long(line) {
+		return 0, len(line)
+	}
+	if match {
+		// Falls back to the beginning of the line if the expression is not
+		// understood by the standard library.
+		if std := g.stdRegexp(); std != nil {
+			if loc := std.FindIndex(line); loc != nil {
+				start = loc[0] - g.MaxLineLen/2
+			}
+		}
+	}
+	if start > len(line)-g.MaxLineLen {
+		start = len(line) - g.MaxLineLen
+	}
+	if start < 0 {
+		start = 0
+	}
+	end = start + g.MaxLineLen
+	// Do not cut UTF-8 sequences in half.
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start++
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end--
+	}
+	return start, end
+}
+
+// snippet returns line, or, if the line is long, the MaxLineLen bytes around
+// the first match (or the beginning of the line if match is false), with
+// ellipses marking what was cut off.
+func (g *Grep) snippet(line []byte, match bool) []byte {
+	start, end := g.snippetBounds(line, match)
+	return cut(line, start, end)
+}
+
+// cut returns line[start:end], with ellipses marking what was cut off.
+func cut(line []byte, start, end int) []byte {
+	if start == 0 && end == len(line) {
+		return line
+	}
+	var result []byte
+	if start > 0 {
+		result = append(result, "…"...)
+	}
+	result = append(result, line[start:end]...)
+	if end < len(line) {
+		result = append(result, "…"...)
+	}
+	return result
+}
+
+// Maximum number of Offsets per Match, so that e.g. minified files do not
+// blow up the results.
+const maxOffsets = 64
+
+// offsets returns the positions of (at most maxOffsets) matches of g.Regexp in
+// line, whose snippet (see snippetBounds) is line[start:end].
+func (g *Grep) offsets(line []byte, start, end int) []Offset {
+	std := g.stdRegexp()
+	if std == nil {
+		return nil
+	}
+	locs := std.FindAllIndex(line, maxOffsets)
+	if len(locs) == 0 {
+		return nil
+	}
+	prefix := 0
+	if start > 0 {
+		prefix = len("…")
+	}
+	// Returns the offset in Match.Context of the byte at pos in line.
+	contextPos := func(pos int) int {
+		if pos < start {
+			pos = start
+		}
+		if pos > end {
+			pos = end
+		}
+		return prefix + len(html.EscapeString(string(line[start:pos])))
+	}
+	offsets := make([]Offset, len(locs))
+	column, last := 1, 0
+	for i, loc := range locs {
+		column += utf8.RuneCount(line[last:loc[0]])
+		last = loc[0]
+		offsets[i] = Offset{
+			Start:        loc[0],
+			End:          loc[1],
+			Column:       column,
+			ContextStart: contextPos(loc[0]),
+			ContextEnd:   contextPos(loc[1]),
+		}
+	}
+	return offsets
+}
+
+// context returns the snippet of a context line, HTML-escaped.
+func (g *Grep) context(line []byte) string {
+	return html.EscapeString(string(g.snippet(line, false)))
+}
+
 type Match struct {
 	Path string
 	Line int
@@ -413,9 +556,54 @@ type Match struct {
 	// contents of line (Line + 2)
 	Ctxn2 string
 
+	// Contents of the Grep.ContextLines lines before and after the match (or
+	// fewer at the beginning and end of the file), see Grep.AddContext.
+	Before []string `json:",omitempty"`
+	After  []string `json:",omitempty"`
+
+	// Positions of the matches of the query within the line, in the order in
+	// which they appear. Empty if the query is not understood by the standard
+	// library’s regexp package.
+	Offsets []Offset `json:",omitempty"`
+
+	// Number of matches in the file, filled in by the source backend when it
+	// returns only some of them.
+	FileMatches int `json:",omitempty"`
+
+	// Number of matches and of files with matches in the source package,
+	// filled in by the source backend when the results are grouped by
+	// package.
+	PackageMatches int `json:",omitempty"`
+	PackageFiles   int `json:",omitempty"`
+
+	// The popularity of the source package (see ranking.Popularity) and the
+	// modification time of the file (in seconds since the Unix epoch), filled
+	// in by the source backend when the results are sorted by them.
+	Popularity float32 `json:",omitempty"`
+	ModTime    int64   `json:",omitempty"`
+
 	// This will be filled in by the source backend
 	PathRank float32
 	Ranking  float32
+
+	// Whether the (literal) query matched a whole identifier, i.e. the match
+	// is delimited by identifier boundaries. Filled in by the source backend.
+	WholeWord bool
+}
+
+// An Offset is the position of one match of the query within its line.
+type Offset struct {
+	// Byte offsets of the beginning and the end of the match within the line
+	// as it is in the file.
+	Start, End int
+
+	// Column (1-based, counting characters) at which the match begins.
+	Column int
+
+	// Byte offsets of the match within Match.Context, which is HTML-escaped
+	// and shortened for long lines, e.g. for highlighting the match. They are
+	// equal if the match was cut off.
+	ContextStart, ContextEnd int
 }
 
 func (g *Grep) Reader(r io.Reader, name string) []Match {
@@ -435,6 +623,11 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 		lastp2      = ""
 	)
 	for {
+		select {
+		case <-g.Done:
+			return result
+		default:
+		}
 		n, err := io.ReadFull(r, buf[len(buf):cap(buf)])
 		buf = buf[:len(buf)+n]
 		end := len(buf)
@@ -444,18 +637,26 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 		} else {
 			endText = true
 		}
+		if end == 0 && !endText {
+			// The buffer does not even hold one complete line, so make
+			// room for the rest of it.
+			grown := make([]byte, len(buf), 2*cap(buf))
+			copy(grown, buf)
+			buf = grown
+			continue
+		}
 		chunkStart := 0
 		bufLineNo = 0
 		//fmt.Printf("need to add %d context lines to the last match\n", needContext)
 		if needContext > 0 {
 			lineEnd := bytes.Index(buf[:end], nl)
 			if lineEnd != -1 {
-				result[len(result)-1].Ctxn1 = string(buf[:lineEnd])
+				result[len(result)-1].Ctxn1 = string(g.snippet(buf[:lineEnd], false))
 				//fmt.Printf("afterwards: ctxn1 = *%s*\n", result[len(result)-1].Ctxn1)
 				if needContext > 1 {
 					nextLineEnd := bytes.Index(buf[lineEnd+1:end], nl)
 					if nextLineEnd != -1 {
-						result[len(result)-1].Ctxn2 = string(buf[lineEnd+1 : lineEnd+1+nextLineEnd])
+						result[len(result)-1].Ctxn2 = string(g.snippet(buf[lineEnd+1:lineEnd+1+nextLineEnd], false))
 						//fmt.Printf("afterwards: ctxn2 = *%s*\n", result[len(result)-1].Ctxn2)
 					}
 				}
@@ -470,7 +671,6 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 			if m1 < chunkStart {
 				break
 			}
-			g.Match = true
 			lineStart := bytes.LastIndex(buf[chunkStart:m1], nl) + 1 + chunkStart
 			lineEnd := m1 + 1
 			if lineEnd > end {
@@ -479,20 +679,28 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 			//fmt.Printf("matching line: %s", buf[lineStart:lineEnd])
 
 			lineno += countNL(buf[chunkStart:lineStart])
-			line := html.EscapeString(string(buf[lineStart : lineEnd-1]))
+			if g.SkipLongLines && g.long(buf[lineStart:lineEnd-1]) {
+				lineno++
+				chunkStart = lineEnd
+				continue
+			}
+			g.Match = true
+			raw := buf[lineStart : lineEnd-1]
+			snippetStart, snippetEnd := g.snippetBounds(raw, true)
 			match := Match{
 				Path:    name,
 				Line:    lineno,
-				Context: string(line),
+				Context: html.EscapeString(string(cut(raw, snippetStart, snippetEnd))),
+				Offsets: g.offsets(raw, snippetStart, snippetEnd),
 			}
 			// Let’s find the previous two lines, if possible.
 			bufLineNo = countNL(buf[:lineStart])
 			if bufLineNo >= 1 {
 				prev1Start := bytes.LastIndex(buf[:lineStart-1], nl) + 1
-				match.Ctxp1 = html.EscapeString(string(buf[prev1Start : lineStart-1]))
+				match.Ctxp1 = g.context(buf[prev1Start : lineStart-1])
 				if bufLineNo >= 2 {
 					prev2Start := bytes.LastIndex(buf[:prev1Start-1], nl) + 1
-					match.Ctxp2 = html.EscapeString(string(buf[prev2Start : prev1Start-1]))
+					match.Ctxp2 = g.context(buf[prev2Start : prev1Start-1])
 				} else {
 					match.Ctxp2 = lastp1
 				}
@@ -507,11 +715,11 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 				//fmt.Printf("next1Start = %d\n", next1Start)
 				if next1Start != -1 {
 					next1Start = next1Start + lineEnd + 1
-					match.Ctxn1 = html.EscapeString(string(buf[lineEnd : next1Start-1]))
+					match.Ctxn1 = g.context(buf[lineEnd : next1Start-1])
 					if next1Start < end {
 						next2Start := bytes.Index(buf[next1Start:end], nl)
 						if next2Start != -1 {
-							match.Ctxn2 = html.EscapeString(string(buf[next1Start : next1Start+next2Start]))
+							match.Ctxn2 = g.context(buf[next1Start : next1Start+next2Start])
 						}
 					} else {
 						needContext = 1
@@ -540,10 +748,10 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 		}
 		if bufLineNo > 1 {
 			prev1Start := bytes.LastIndex(buf[:end-1], nl) + 1
-			lastp1 = html.EscapeString(string(buf[prev1Start : end-1]))
+			lastp1 = g.context(buf[prev1Start : end-1])
 			if bufLineNo > 2 {
 				prev2Start := bytes.LastIndex(buf[:prev1Start-1], nl) + 1
-				lastp2 = html.EscapeString(string(buf[prev2Start : prev1Start-1]))
+				lastp2 = g.context(buf[prev2Start : prev1Start-1])
 			}
 		}
 
@@ -559,3 +767,59 @@ func (g *Grep) Reader(r io.Reader, name string) []Match {
 	}
 	return result
 }
+
+// AddContext reads the file in which matches (as returned by Reader, i.e.
+// ordered by line) were found from r and stores the g.ContextLines lines
+// around each match in its Before and After fields.
+func (g *Grep) AddContext(r io.Reader, matches []Match) error {
+	n := g.ContextLines
+	if n <= 0 || len(matches) == 0 {
+		return nil
+	}
+	br := bufio.NewReader(r)
+	// The last n lines, the oldest at index (lineno-1) % n.
+	last := make([][]byte, n)
+	next := 0  // the next match whose Before needs to be filled in
+	after := 0 // the first match whose After may be incomplete
+	for lineno := 1; after < len(matches); lineno++ {
+		select {
+		case <-g.Done:
+			return nil
+		default:
+		}
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Long lines do not fit into the buffer.
+			rest, restErr := br.ReadBytes('\n')
+			line, err = append(append([]byte(nil), line...), rest...), restErr
+		}
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = bytes.TrimSuffix(line, nl)
+
+		for after < len(matches) && matches[after].Line+n < lineno {
+			after++
+		}
+		for i := after; i < next; i++ {
+			if lineno > matches[i].Line {
+				matches[i].After = append(matches[i].After, g.context(line))
+			}
+		}
+		for next < len(matches) && matches[next].Line == lineno {
+			before := make([]string, 0, n)
+			for l := lineno - n; l < lineno; l++ {
+				if l >= 1 {
+					before = append(before, g.context(last[(l-1)%n]))
+				}
+			}
+			matches[next].Before = before
+			next++
+		}
+		last[(lineno-1)%n] = append(last[(lineno-1)%n][:0], line...)
+	}
+	return nil
+}
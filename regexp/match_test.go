@@ -1,6 +1,7 @@
 package regexp
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -110,3 +111,132 @@ func TestMatchContextBefore(t *testing.T) {
 		t.Errorf("Context -2 wrong: %s", matches[0].Ctxp2)
 	}
 }
+
+func TestMatchLongLines(t *testing.T) {
+	// A single line which does not fit into the buffer, followed by a short
+	// line.
+	long := strings.Repeat("x", 3<<20) + "fnord" + strings.Repeat("y", 1<<20)
+	input := long + "\nctx fnord\n"
+	re, err := Compile("fnord")
+	if err != nil {
+		t.Fatalf("Compile(%#q): %v", "fnord", err)
+	}
+
+	g := Grep{Regexp: re}
+	matches := g.Reader(strings.NewReader(input), "input")
+	if len(matches) != 2 {
+		t.Fatalf("Expected two matches, got %d", len(matches))
+	}
+	if matches[0].Context != long {
+		t.Errorf("Context of the long line has %d bytes, want %d", len(matches[0].Context), len(long))
+	}
+
+	g = Grep{Regexp: re, MaxLineLen: 100}
+	matches = g.Reader(strings.NewReader(input), "input")
+	if len(matches) != 2 {
+		t.Fatalf("Expected two matches, got %d", len(matches))
+	}
+	want := "…" + strings.Repeat("x", 50) + "fnord" + strings.Repeat("y", 45) + "…"
+	if matches[0].Context != want {
+		t.Errorf("Context of the long line wrong: got %q, want %q", matches[0].Context, want)
+	}
+	if want := strings.Repeat("x", 100) + "…"; matches[1].Ctxp1 != want {
+		t.Errorf("Context -1 wrong: got %q, want %q", matches[1].Ctxp1, want)
+	}
+	if matches[1].Line != 2 {
+		t.Errorf("Line of the second match: got %d, want 2", matches[1].Line)
+	}
+
+	g = Grep{Regexp: re, MaxLineLen: 100, SkipLongLines: true}
+	matches = g.Reader(strings.NewReader(input), "input")
+	if len(matches) != 1 {
+		t.Fatalf("Expected precisely one match, got %d", len(matches))
+	}
+	if matches[0].Line != 2 || matches[0].Context != "ctx fnord" {
+		t.Errorf("Unexpected match in line %d: %q", matches[0].Line, matches[0].Context)
+	}
+}
+
+func TestMatchDone(t *testing.T) {
+	re, err := Compile("fnord")
+	if err != nil {
+		t.Fatalf("Compile(%#q): %v", "fnord", err)
+	}
+	done := make(chan struct{})
+	g := Grep{Regexp: re, Done: done}
+	if matches := g.Reader(strings.NewReader("fnord\n"), "input"); len(matches) != 1 {
+		t.Fatalf("Expected one match, got %d", len(matches))
+	}
+	close(done)
+	if matches := g.Reader(strings.NewReader("fnord\n"), "input"); len(matches) != 0 {
+		t.Errorf("Expected no matches after Done was closed, got %d", len(matches))
+	}
+}
+
+func TestAddContext(t *testing.T) {
+	re, err := Compile("fnord")
+	if err != nil {
+		t.Fatalf("Compile(%#q): %v", "fnord", err)
+	}
+	input := "l1\nfnord 2\nl3\nl4\nfnord 5\nl6\n<l7>\nl8\nl9"
+	g := Grep{Regexp: re, ContextLines: 3}
+	matches := g.Reader(strings.NewReader(input), "input")
+	if len(matches) != 2 {
+		t.Fatalf("Expected two matches, got %d", len(matches))
+	}
+	if err := g.AddContext(strings.NewReader(input), matches); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		before, after []string
+	}{
+		{[]string{"l1"}, []string{"l3", "l4", "fnord 5"}},
+		{[]string{"fnord 2", "l3", "l4"}, []string{"l6", "&lt;l7&gt;", "l8"}},
+	} {
+		if !reflect.DeepEqual(matches[i].Before, want.before) {
+			t.Errorf("matches[%d].Before = %q, want %q", i, matches[i].Before, want.before)
+		}
+		if !reflect.DeepEqual(matches[i].After, want.after) {
+			t.Errorf("matches[%d].After = %q, want %q", i, matches[i].After, want.after)
+		}
+	}
+}
+
+func TestMatchOffsets(t *testing.T) {
+	re, err := Compile("fn?o")
+	if err != nil {
+		t.Fatalf("Compile(%#q): %v", "fn?o", err)
+	}
+	g := Grep{Regexp: re}
+	matches := g.Reader(strings.NewReader("l1\n<ä> fnord fo\n"), "input")
+	if len(matches) != 1 {
+		t.Fatalf("Expected one match, got %d", len(matches))
+	}
+	want := []Offset{
+		{Start: 5, End: 8, Column: 5, ContextStart: 11, ContextEnd: 14},
+		{Start: 11, End: 13, Column: 11, ContextStart: 17, ContextEnd: 19},
+	}
+	if got := matches[0].Offsets; !reflect.DeepEqual(got, want) {
+		t.Errorf("Offsets = %+v, want %+v", got, want)
+	}
+	for _, o := range want {
+		if got := matches[0].Context[o.ContextStart:o.ContextEnd]; !strings.HasPrefix(got, "f") {
+			t.Errorf("Context[%d:%d] = %q, want a match", o.ContextStart, o.ContextEnd, got)
+		}
+	}
+
+	// In long lines, the offsets within the snippet differ.
+	line := strings.Repeat("x", 200) + "fno" + strings.Repeat("y", 200)
+	g = Grep{Regexp: re, MaxLineLen: 100}
+	matches = g.Reader(strings.NewReader(line+"\n"), "input")
+	if len(matches) != 1 || len(matches[0].Offsets) != 1 {
+		t.Fatalf("Expected one match with one offset, got %+v", matches)
+	}
+	o := matches[0].Offsets[0]
+	if o.Start != 200 || o.End != 203 || o.Column != 201 {
+		t.Errorf("Offset within the line = %+v, want 200-203 in column 201", o)
+	}
+	if got := matches[0].Context[o.ContextStart:o.ContextEnd]; got != "fno" {
+		t.Errorf("Context[%d:%d] = %q, want %q", o.ContextStart, o.ContextEnd, got, "fno")
+	}
+}
@@ -18,6 +18,11 @@ type Regexp struct {
 	Syntax *syntax.Regexp
 	expr   string // original expression
 	m      matcher
+
+	// Set if the expression is a plain string, see literal.go.
+	literal      []byte
+	fold         bool // whether literal is matched case-insensitively
+	unicodeFolds bool // whether literal matches non-ASCII characters if fold
 }
 
 // String returns the source text used to compile the regular expression.
@@ -47,13 +52,24 @@ func Compile(expr string) (*Regexp, error) {
 	if err := r.m.init(prog); err != nil {
 		return nil, err
 	}
+	if lit, fold, ok := literal(sre); ok {
+		r.literal = lit
+		r.fold = fold
+		r.unicodeFolds = fold && unicodeFolds(lit)
+	}
 	return r, nil
 }
 
 func (r *Regexp) Match(b []byte, beginText, endText bool) (end int) {
+	if r.literal != nil {
+		return r.matchLiteral(b, beginText, endText)
+	}
 	return r.m.match(b, beginText, endText)
 }
 
 func (r *Regexp) MatchString(s string, beginText, endText bool) (end int) {
+	if r.literal != nil {
+		return r.matchLiteral([]byte(s), beginText, endText)
+	}
 	return r.m.matchString(s, beginText, endText)
 }
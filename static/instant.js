@@ -15,6 +15,9 @@ var connection = new ReconnectingWebSocket(websocket_url);
 var searchterm;
 var queryDone = false;
 var queryStarted = false;
+// The sort= parameter of the query (see the #sortorder dropdown), empty for
+// the default order (best results first).
+var sortorder = '';
 
 // fatal (bool): Whether all ongoing operations should be cancelled.
 //
@@ -104,6 +107,7 @@ function showResultsPage() {
     $('#packageshint').hide();
     $('#pagination').text('');
     $('#perpackage-pagination').text('');
+    $('#truncated').hide();
 }
 
 function sendQuery() {
@@ -117,9 +121,10 @@ function sendQuery() {
 
     showResultsPage();
     $('#packages').text('');
+    $('#facets').text('');
     $('#errors div.alert-danger').remove();
     var query = {
-        "Query": "q=" + encodeURIComponent(searchterm)
+        "Query": "q=" + encodeURIComponent(searchterm) + (sortorder === '' ? '' : '&sort=' + encodeURIComponent(sortorder))
     };
     connection.send(JSON.stringify(query));
     document.title = searchterm + ' · Debian Code Search';
@@ -150,23 +155,54 @@ connection.onopen = function() {
          window.location.pathname.lastIndexOf('/perpackage-results/', 0) === 0)) {
         var parts = new RegExp("results/([^/]+)").exec(window.location.pathname);
         searchterm = decodeURIComponent(parts[1]);
+        var sortparam = new RegExp("[?&]sort=([a-z]+)").exec(window.location.search);
+        if (sortparam !== null) {
+            sortorder = sortparam[1];
+            $('#sortorder').val(sortorder);
+        }
         sendQuery();
     }
 
+    // Changing the order runs the query again, as the results are sorted
+    // on the server.
+    $('#sortorder').off('change').on('change', function(ev) {
+        sortorder = $(this).val();
+        sendQuery();
+        history.pushState({ searchterm: searchterm, nr: 0, perpkg: false }, 'page ' + 0, pageUrl(0, false));
+    });
+
     $('#searchform').off('submit').on('submit', function(ev) {
         searchterm = $('#searchform input[name=q]').val();
+        if ($('#searchform input[name=case]').is(':checked') &&
+            !/(^| )case:/i.test(searchterm)) {
+            searchterm += ' case:no';
+        }
         sendQuery();
-        history.pushState({ searchterm: searchterm, nr: 0, perpkg: false }, 'page ' + 0, '/results/' + encodeURIComponent(searchterm) + '/page_0');
+        history.pushState({ searchterm: searchterm, nr: 0, perpkg: false }, 'page ' + 0, pageUrl(0, false));
         ev.preventDefault();
     });
 
+    // Narrowing down the results searches only the files which have results
+    // of the current query (see the within: keyword).
+    $('#refineform').off('submit').on('submit', function(ev) {
+        var refinement = $('#refineform input[name=refine]').val();
+        ev.preventDefault();
+        if (refinement === '' || !queryDone) {
+            return;
+        }
+        searchterm = refinement + ' within:' + queryid;
+        $('#refineform input[name=refine]').val('');
+        sendQuery();
+        history.pushState({ searchterm: searchterm, nr: 0, perpkg: false }, 'page ' + 0, pageUrl(0, false));
+    });
+
     // This is triggered when the user navigates (e.g. via back button) between
     // pages that were created using history.pushState().
     $(window).off('popstate').on('popstate', function(ev) {
         var state = ev.originalEvent.state;
         if (state == null) {
             // Restore the original page.
-            $('#normalresults, #perpackage, #progressbar, #errors, #packages, #options').hide();
+            $('#normalresults, #perpackage, #progressbar, #errors, #packages, #facets, #options').hide();
             $('#searchdiv').show();
             $('#searchdiv .formplaceholder').after($('#searchform'));
             $('#searchform').css('position', 'static');
@@ -179,7 +215,7 @@ connection.onopen = function() {
                 // The following are necessary because we don’t send the query
                 // anew and don’t get any progress messages (the final progress
                 // message triggers displaying certain elements).
-                $('#packages, #errors, #options').show();
+                $('#packages, #facets, #errors, #options').show();
             }
             $('#enable-perpackage').prop('checked', state.perpkg);
             changeGrouping();
@@ -228,14 +264,53 @@ var currentpage;
 var currentpage_pkg;
 var packages = [];
 
+// Converts a byte offset into the UTF-8 encoding of str into an index of str.
+function byteToIndex(str, offset) {
+    var bytes = 0;
+    for (var i = 0; i < str.length; i++) {
+        if (bytes >= offset) {
+            return i;
+        }
+        var c = str.charCodeAt(i);
+        if (c < 0x80) {
+            bytes += 1;
+        } else if (c < 0x800) {
+            bytes += 2;
+        } else if (c >= 0xD800 && c <= 0xDBFF) {
+            // A surrogate pair, i.e. 4 bytes in UTF-8.
+            bytes += 4;
+            i++;
+        } else {
+            bytes += 3;
+        }
+    }
+    return str.length;
+}
+
+// Wraps the matches within the (already HTML-escaped) context of result in
+// <mark>, see regexp.Offset on the server.
+function markMatches(result) {
+    var context = result.Context;
+    var marked = '';
+    var last = 0;
+    $.each(result.Offsets || [], function(idx, o) {
+        var start = byteToIndex(context, o.ContextStart);
+        var end = byteToIndex(context, o.ContextEnd);
+        if (start >= end || start < last) {
+            return;
+        }
+        marked += context.substring(last, start) + '<mark>' + context.substring(start, end) + '</mark>';
+        last = end;
+    });
+    return marked + context.substring(last);
+}
+
 function addSearchResult(results, result) {
-    var context = [];
     // NB: All of the following context lines are already HTML-escaped by the server.
-    context.push(result.Ctxp2);
-    context.push(result.Ctxp1);
-    context.push('<strong>' + result.Context + '</strong>');
-    context.push(result.Ctxn1);
-    context.push(result.Ctxn2);
+    // Before and After are only set when more context lines were requested.
+    var before = result.Before || [result.Ctxp2, result.Ctxp1];
+    var after = result.After || [result.Ctxn1, result.Ctxn2];
+    var context = before.concat(['<strong>' + markMatches(result) + '</strong>'], after);
     // Remove any empty context lines (e.g. when the match is close to the
     // beginning or end of the file).
     context = $.grep(context, function(elm, idx) { return $.trim(elm) != ""; });
@@ -246,8 +321,25 @@ function addSearchResult(results, result) {
     var sourcePackage = result.Path.substring(0, delimiter);
     var rest = result.Path.substring(delimiter);
 
+    // Badge matches of a whole identifier (for literal queries).
+    var badge = '';
+    if (result.WholeWord) {
+        badge = ' <span class="wholeword" title="The query matched a whole identifier">exact</span>';
+    }
+    // Only some matches of the file are returned, link to all of them.
+    if (result.FileMatches) {
+        badge += ' <small><a href="' + allMatchesUrl('path:^' + escapeForRegExp(result.Path) + '$') + '">all ' + result.FileMatches + ' matches in this file</a></small>';
+    }
+    // Outbound links to the line on sources.debian.org and in the packaging
+    // repository (looked up by /vcs when followed).
+    var slash = result.Path.indexOf('/');
+    var version = result.Path.substring(delimiter + 1, slash);
+    var sourcesUrl = 'https://sources.debian.org/src/' + encodeURIComponent(sourcePackage) + '/' + encodeURIComponent(version) + '/' + encodeURI(result.Path.substring(slash + 1)) + '/#L' + result.Line;
+    var vcsUrl = '/vcs?file=' + encodeURIComponent(result.Path) + '&line=' + result.Line;
+    badge += ' <small class="outbound"><a href="' + escapeForHTML(sourcesUrl) + '" title="Show this line on sources.debian.org">sources</a> &middot; <a href="' + escapeForHTML(vcsUrl) + '" rel="nofollow" title="Show this line in the packaging repository (Vcs-Git) of the package">vcs</a></small>';
+
     // Append the new search result, then sort the results.
-    results.append('<li data-ranking="' + result.Ranking + '"><a href="/show?file=' + encodeURIComponent(result.Path) + '&line=' + result.Line + '"><code><strong>' + sourcePackage + '</strong>' + escapeForHTML(rest) + '</code></a><br><pre>' + context + '</pre><small>PathRank: ' + result.PathRank + ', Final: ' + result.Ranking + '</small></li>');
+    results.append('<li data-ranking="' + result.Ranking + '"><a href="/show?file=' + encodeURIComponent(result.Path) + '&line=' + result.Line + '&q=' + encodeURIComponent(searchterm) + '#L' + result.Line + '"><code><strong>' + sourcePackage + '</strong>' + escapeForHTML(rest) + '</code></a>' + badge + '<br><pre>' + context + '</pre><small>PathRank: ' + result.PathRank + ', Final: ' + result.Ranking + '</small></li>');
     $('ul#results').append($('ul#results>li').detach().sort(function(a, b) {
         return b.getAttribute('data-ranking') - a.getAttribute('data-ranking');
     }));
@@ -272,8 +364,8 @@ function loadPage(nr) {
         progress(0, true, 'Loading search result page ' + (nr+1) + '…');
     }, 200);
 
-    var pathname = '/results/' + encodeURIComponent(searchterm) + '/page_' + nr;
-    if (location.pathname != pathname) {
+    var pathname = pageUrl(nr, false);
+    if (location.pathname + location.search != pathname) {
         history.pushState({ searchterm: searchterm, nr: nr, perpkg: false }, 'page ' + nr, pathname);
     }
     $.ajax('/results/' + queryid + '/page_' + nr + '.json')
@@ -308,8 +400,8 @@ function loadPerPkgPage(nr, preload) {
         progress_bar_start = setTimeout(function() {
             progress(0, true, 'Loading per-package search result page ' + (nr+1) + '…');
         }, 20);
-        var pathname = '/perpackage-results/' + encodeURIComponent(searchterm) + '/2/page_' + nr;
-        if (location.pathname != pathname) {
+        var pathname = pageUrl(nr, true);
+        if (location.pathname + location.search != pathname) {
             history.pushState({ searchterm: searchterm, nr: nr, perpkg: true }, 'page ' + nr, pathname);
         }
     }
@@ -342,10 +434,11 @@ function loadPerPkgPage(nr, preload) {
 }
 
 function pageUrl(page, perpackage) {
+    var sort = (sortorder === '' ? '' : '?sort=' + encodeURIComponent(sortorder));
     if (perpackage) {
-        return '/perpackage-results/' + encodeURIComponent(searchterm) + '/2/page_' + page;
+        return '/perpackage-results/' + encodeURIComponent(searchterm) + '/2/page_' + page + sort;
     } else {
-        return '/results/' + encodeURIComponent(searchterm) + '/page_' + page;
+        return '/results/' + encodeURIComponent(searchterm) + '/page_' + page + sort;
     }
 }
 
@@ -390,6 +483,73 @@ function escapeForHTML(input) {
     return $('<div/>').text(input).html();
 }
 
+function escapeForRegExp(input) {
+    return input.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+}
+
+// Returns the URL of a search for all matches (see the matches:all keyword)
+// of the current query which also have the given keywords.
+function allMatchesUrl(keywords) {
+    return '/results/' + encodeURIComponent(searchterm + ' ' + keywords + ' matches:all') + '/page_0';
+}
+
+// Lists the packages of which only the best matches are on the result pages.
+function showTruncatedPackages(packages) {
+    var div = $('#truncated');
+    if (!packages) {
+        div.hide();
+        return;
+    }
+    var links = $.map(packages, function(pkg) {
+        return '<a href="' + allMatchesUrl('package:' + pkg.Package) + '">' + escapeForHTML(pkg.Package) + '</a> (' + pkg.Matches + ')';
+    });
+    div.html('Only the best matches of some packages are shown. All matches: ' + links.join(', '));
+    div.show();
+}
+
+// Formats large numbers compactly, e.g. 1234567 becomes “1.2M”.
+function formatCount(n) {
+    if (n >= 1000000) {
+        return (n / 1000000).toFixed(1) + 'M';
+    }
+    if (n >= 10000) {
+        return Math.round(n / 1000) + 'k';
+    }
+    return '' + n;
+}
+
+// Renders the facets of a progress message (the number of matches per
+// package, language and top-level directory) as links which narrow down the
+// query. Kinds with only one value are left out, as they would not narrow
+// anything down.
+function updateFacets(facets) {
+    var f = $('#facets');
+    f.text('');
+    $.each(['package', 'language', 'directory'], function(idx, kind) {
+        var values = facets[kind];
+        if (!values || values.length < 2) {
+            return;
+        }
+        var links = values.map(function(facet) {
+            return $('<a href="#"></a>')
+                .text(facet.Value)
+                .attr('title', facet.Count + ' matches')
+                .attr('data-keyword', facet.Keyword);
+        });
+        var p = $('<p></p>').append($('<strong></strong>').text('By ' + kind + ':'));
+        $.each(links, function(idx, link) {
+            p.append(' ', link, ' (' + formatCount(values[idx].Count) + ')');
+        });
+        f.append(p);
+    });
+    f.find('a').on('click', function(ev) {
+        ev.preventDefault();
+        searchterm = searchterm + ' ' + $(this).attr('data-keyword');
+        sendQuery();
+        history.pushState({ searchterm: searchterm, nr: 0, perpkg: false }, 'page ' + 0, pageUrl(0, false));
+    });
+}
+
 connection.onmessage = function(e) {
     var msg = JSON.parse(e.data);
     switch (msg.Type) {
@@ -398,7 +558,11 @@ connection.onmessage = function(e) {
 
         progress(((msg.FilesProcessed / msg.FilesTotal) * 90) + 10,
                  false,
-                 msg.FilesProcessed + ' / ' + msg.FilesTotal + ' files grepped (' + msg.Results + ' results)');
+                 'searched ' + msg.BackendsDone + ' / ' + msg.BackendsTotal + ' shards, ' +
+                 formatCount(msg.FilesProcessed) + ' / ' + formatCount(msg.FilesTotal) + ' files (' + msg.Results + ' results in ' + msg.Packages + ' packages)');
+        if (msg.Facets) {
+            updateFacets(msg.Facets);
+        }
         if (msg.FilesProcessed == msg.FilesTotal) {
             queryDone = true;
             if (msg.Results === 0) {
@@ -467,6 +631,7 @@ connection.onmessage = function(e) {
         currentpage = 0;
         currentpage_pkg = 0;
         updatePagination(currentpage, resultpages, false);
+        showTruncatedPackages(msg.TruncatedPackages);
 
         if (window.location.pathname.lastIndexOf('/results/', 0) === 0) {
             var parts = new RegExp("/results/([^/]+)/page_([0-9]+)").exec(window.location.pathname);
@@ -485,8 +650,14 @@ connection.onmessage = function(e) {
             error(false, true, msg.ErrorType, "This query has been cancelled by the server administrator (to preserve overall service health).");
         } else if (msg.ErrorType == "failed") {
             error(false, true, msg.ErrorType, "This query failed due to an unexpected internal server error.");
+        } else if (msg.ErrorType == "limitshit") {
+            error(false, true, msg.ErrorType, "The results are incomplete, because this query is too expensive (it exceeded the " + msg.Message + " limit). Try making it more specific.");
         } else if (msg.ErrorType == "invalidquery") {
-            error(false, true, msg.ErrorType, "This query was refused by the server, because it is too short or malformed.");
+            if (msg.Message) {
+                error(false, true, msg.ErrorType, "This query was refused by the server: " + msg.Message + ".");
+            } else {
+                error(false, true, msg.ErrorType, "This query was refused by the server, because it is too short or malformed.");
+            }
         } else {
             error(false, true, msg.ErrorType, msg.ErrorType);
         }
@@ -548,8 +719,8 @@ function changeGrouping() {
 
     if (shouldPerPkg) {
         ppelements.removeClass('animation-reverse');
-        var pathname = '/perpackage-results/' + encodeURIComponent(searchterm) + '/2/page_' + currentpage_pkg;
-        if (location.pathname != pathname) {
+        var pathname = pageUrl(currentpage_pkg, true);
+        if (location.pathname + location.search != pathname) {
             history.pushState(
                 { searchterm: searchterm, nr: currentpage_pkg, perpkg: true },
                 'page ' + currentpage_pkg,
@@ -561,8 +732,8 @@ function changeGrouping() {
         $('#perpackage').show();
     } else {
         ppelements.addClass('animation-reverse');
-        var pathname = '/results/' + encodeURIComponent(searchterm) + '/page_' + currentpage;
-        if (location.pathname != pathname) {
+        var pathname = pageUrl(currentpage, false);
+        if (location.pathname + location.search != pathname) {
             history.pushState(
                 { searchterm: searchterm, nr: currentpage, perpkg: false },
                 'page ' + currentpage,
@@ -588,19 +759,43 @@ function changeGrouping() {
 
 // Restore autocomplete from localstorage. This is necessary because the form
 // never gets submitted (we intercept the submit event). All the alternatives
-// are worse and have side-effects.
-function restoreAutocomplete() {
+// are worse and have side-effects. The suggestions of the server (see
+// suggestCompletions) are listed first.
+function restoreAutocomplete(suggestions) {
     var entries = localStorage.getItem("autocomplete");
-    if (entries !== null) {
-        entries = JSON.parse(entries);
-        var dataList = document.getElementById('autocomplete');
-        $('datalist').empty();
-        $.each(entries, function() {
-            var option = document.createElement('option');
-            option.value = this;
-            dataList.appendChild(option);
-        });
+    entries = (entries === null ? [] : JSON.parse(entries));
+    if (suggestions !== undefined) {
+        entries = suggestions.concat($.grep(entries, function(entry) {
+            return suggestions.indexOf(entry) === -1;
+        }));
+    }
+    var dataList = document.getElementById('autocomplete');
+    $('datalist').empty();
+    $.each(entries, function() {
+        var option = document.createElement('option');
+        option.value = this;
+        dataList.appendChild(option);
+    });
+}
+
+// Asks the server for completions (popular search terms and package names) of
+// what was typed into the search box so far. Requests are delayed until the
+// user stops typing for a moment, so that not every keystroke leads to one.
+var suggestTimeout;
+function suggestCompletions() {
+    clearTimeout(suggestTimeout);
+    var prefix = $('#searchform input[name=q]').val();
+    if (prefix.trim() === '') {
+        restoreAutocomplete();
+        return;
     }
+    suggestTimeout = setTimeout(function() {
+        $.getJSON('/suggest', { q: prefix }, function(response) {
+            if ($('#searchform input[name=q]').val() === response[0]) {
+                restoreAutocomplete(response[1]);
+            }
+        });
+    }, 200);
 }
 
 // This function needs to be called every time a scrollbar can appear (any DOM
@@ -618,6 +813,8 @@ $(window).load(function() {
     // instant search at least once, so chances are she’ll use it again.
     restoreAutocomplete();
 
+    $('#searchform input[name=q]').on('input', suggestCompletions);
+
     // Pressing “/” anywhere on the page focuses the search field.
     $(document).keydown(function(e) {
         if (e.which == 191) {
@@ -0,0 +1,64 @@
+package symbols
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Returns the source package and the package tree (“<package>_<version>”) of
+// path.
+func packageOf(p string) (pkg, tree string) {
+	tree = p
+	if idx := strings.Index(p, "/"); idx > -1 {
+		tree = p[:idx]
+	}
+	pkg = tree
+	if idx := strings.Index(tree, "_"); idx > -1 {
+		pkg = tree[:idx]
+	}
+	return pkg, tree
+}
+
+// Returns the part of a package name which related packages share, e.g.
+// “xcb” for “libxcb” and “xcb-util”.
+func stem(pkg string) string {
+	pkg = strings.TrimPrefix(pkg, "lib")
+	if idx := strings.Index(pkg, "-"); idx > 0 {
+		pkg = pkg[:idx]
+	}
+	return pkg
+}
+
+// Relatedness returns how closely the file defining a symbol (path) is related
+// to the file in which the symbol is used (from), lower is closer: 0 for the
+// same file, 1 for the same directory, 2 for the same package tree, 3 for
+// another version of the same source package, 4 for a package with a related
+// name (see stem) and 5 otherwise.
+func Relatedness(p, from string) int {
+	if p == from {
+		return 0
+	}
+	if path.Dir(p) == path.Dir(from) {
+		return 1
+	}
+	pkg, tree := packageOf(p)
+	fromPkg, fromTree := packageOf(from)
+	switch {
+	case tree == fromTree:
+		return 2
+	case pkg == fromPkg:
+		return 3
+	case stem(pkg) == stem(fromPkg):
+		return 4
+	}
+	return 5
+}
+
+// SortByRelatedness sorts defs by the Relatedness of their files to from, the
+// closest first. Definitions which are equally related keep their order.
+func SortByRelatedness(defs []Symbol, from string) {
+	sort.SliceStable(defs, func(i, j int) bool {
+		return Relatedness(defs[i].Path, from) < Relatedness(defs[j].Path, from)
+	})
+}
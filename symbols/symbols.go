@@ -0,0 +1,366 @@
+// Package symbols implements an index of the symbols (functions, types,
+// macros, …) defined in source files, as extracted by universal-ctags. It
+// answers “where is X defined” questions, which a trigram index can only
+// approximate.
+//
+// A symbol file is stored next to the trigram index it belongs to (see
+// FileFor) and contains one symbol per line:
+//
+//	name \t kind \t path \t line \n
+//
+// The lines are sorted byte-wise, i.e. by name first. Names and paths must
+// not contain control characters, symbols with such names are dropped.
+package symbols
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Symbol is the definition of an identifier.
+type Symbol struct {
+	Name string
+	Kind string // ctags kind, e.g. “function” or “macro”
+	Path string // path of the file, relative to the unpacked sources
+	Line int    // counting from 1
+}
+
+func (s Symbol) line() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%d\n", s.Name, s.Kind, s.Path, s.Line)
+}
+
+func parseLine(line string) (Symbol, error) {
+	parts := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	if len(parts) != 4 {
+		return Symbol{}, fmt.Errorf("malformed symbol line %q", line)
+	}
+	n, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return Symbol{}, fmt.Errorf("malformed symbol line %q: %v", line, err)
+	}
+	return Symbol{Name: parts[0], Kind: parts[1], Path: parts[2], Line: n}, nil
+}
+
+func valid(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// definitionKinds are the ctags kinds (across the languages we care about)
+// which define something worth looking up. Local variables, parameters,
+// struct members and the like are left out to keep the index small.
+var definitionKinds = map[string]bool{
+	"class":      true,
+	"enum":       true,
+	"func":       true,
+	"function":   true,
+	"interface":  true,
+	"macro":      true,
+	"method":     true,
+	"module":     true,
+	"namespace":  true,
+	"package":    true,
+	"procedure":  true,
+	"struct":     true,
+	"subroutine": true,
+	"trait":      true,
+	"type":       true,
+	"typedef":    true,
+	"union":      true,
+}
+
+// FileFor returns the path of the symbol file belonging to the trigram index
+// at indexPath, e.g. full.sym for full.idx.
+func FileFor(indexPath string) string {
+	return strings.TrimSuffix(indexPath, ".idx") + ".sym"
+}
+
+// Extract runs the universal-ctags binary ctags on files (relative to dir)
+// and returns the definitions it finds.
+func Extract(ctx context.Context, ctags, dir string, files []string) ([]Symbol, error) {
+	cmd := exec.CommandContext(ctx, ctags,
+		"--excmd=number",
+		"--fields=K",
+		"--sort=no",
+		"-f", "-",
+		"-L", "-")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(strings.Join(files, "\n") + "\n")
+	cmd.Stderr = ioutil.Discard
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	symbols, parseErr := parseTags(stdout)
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("%s: %v", ctags, err)
+	}
+	return symbols, parseErr
+}
+
+// parseTags parses the output of ctags --excmd=number --fields=K, e.g.:
+//
+//	main	src/main.c	1234;"	function
+func parseTags(r io.Reader) ([]Symbol, error) {
+	var symbols []Symbol
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "!_TAG_") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) < 4 {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(parts[2], `;"`))
+		if err != nil {
+			continue
+		}
+		kind := ""
+		for _, field := range parts[3:] {
+			if strings.HasPrefix(field, "kind:") {
+				kind = strings.TrimPrefix(field, "kind:")
+			} else if !strings.Contains(field, ":") {
+				kind = field
+			}
+		}
+		s := Symbol{Name: parts[0], Kind: kind, Path: parts[1], Line: n}
+		if !definitionKinds[kind] || !valid(s.Name) || !valid(s.Path) {
+			continue
+		}
+		symbols = append(symbols, s)
+	}
+	return symbols, scanner.Err()
+}
+
+// Write writes symbols to a new symbol file at path.
+func Write(path string, symbols []Symbol) error {
+	lines := make([]string, 0, len(symbols))
+	for _, s := range symbols {
+		if valid(s.Name) && valid(s.Kind) && valid(s.Path) {
+			lines = append(lines, s.line())
+		}
+	}
+	sort.Strings(lines)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		w.WriteString(line)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// maxOpen is the number of symbol files which Merge reads at the same time.
+const maxOpen = 256
+
+// A source is an open symbol file during Merge.
+type source struct {
+	r    *bufio.Reader
+	f    *os.File
+	line string
+}
+
+func (s *source) next() bool {
+	line, err := s.r.ReadString('\n')
+	s.line = line
+	return err == nil
+}
+
+type sourceHeap []*source
+
+func (h sourceHeap) Len() int            { return len(h) }
+func (h sourceHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h sourceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sourceHeap) Push(x interface{}) { *h = append(*h, x.(*source)) }
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// Merge writes the symbols of all sources into a new symbol file at dst.
+// Sources which do not exist are skipped, so that callers can pass the
+// symbol files of all package indexes, regardless of whether they were
+// built with ctags.
+func Merge(dst string, sources ...string) error {
+	var existing []string
+	for _, path := range sources {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	// Merge in rounds to stay within the limit of open files.
+	var tmps []string
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for len(existing) > maxOpen {
+		var next []string
+		for i := 0; i < len(existing); i += maxOpen {
+			end := i + maxOpen
+			if end > len(existing) {
+				end = len(existing)
+			}
+			tmp, err := ioutil.TempFile(filepath.Dir(dst), "symbols")
+			if err != nil {
+				return err
+			}
+			tmp.Close()
+			tmps = append(tmps, tmp.Name())
+			if err := merge(tmp.Name(), existing[i:end]); err != nil {
+				return err
+			}
+			next = append(next, tmp.Name())
+		}
+		existing = next
+	}
+	return merge(dst, existing)
+}
+
+func merge(dst string, sources []string) error {
+	var h sourceHeap
+	defer func() {
+		for _, s := range h {
+			s.f.Close()
+		}
+	}()
+	for _, path := range sources {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		s := &source{r: bufio.NewReader(f), f: f}
+		if s.next() {
+			h = append(h, s)
+		} else {
+			f.Close()
+		}
+	}
+	heap.Init(&h)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	last := ""
+	for h.Len() > 0 {
+		s := h[0]
+		// The same file can be indexed in more than one source (e.g. an old
+		// and a new segment), write it only once.
+		if s.line != last {
+			w.WriteString(s.line)
+			last = s.line
+		}
+		if s.next() {
+			heap.Fix(&h, 0)
+		} else {
+			s.f.Close()
+			heap.Pop(&h)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// A File is an open symbol file.
+type File struct {
+	data   []byte
+	starts []int // offsets at which the lines start
+}
+
+// Open reads the symbol file at path into memory.
+func Open(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{data: data}
+	for off := 0; off < len(data); {
+		f.starts = append(f.starts, off)
+		end := bytes.IndexByte(data[off:], '\n')
+		if end < 0 {
+			return nil, fmt.Errorf("%s: last line is not terminated", path)
+		}
+		off += end + 1
+	}
+	return f, nil
+}
+
+// Len returns the number of symbols in f.
+func (f *File) Len() int {
+	return len(f.starts)
+}
+
+func (f *File) lineAt(i int) []byte {
+	end := len(f.data)
+	if i+1 < len(f.starts) {
+		end = f.starts[i+1]
+	}
+	return f.data[f.starts[i]:end]
+}
+
+// Lookup returns up to limit definitions of name (all of them if limit is
+// 0 or less), ordered by path.
+func (f *File) Lookup(name string, limit int) ([]Symbol, error) {
+	prefix := []byte(name + "\t")
+	i := sort.Search(len(f.starts), func(i int) bool {
+		return bytes.Compare(f.lineAt(i), prefix) >= 0
+	})
+	var result []Symbol
+	for ; i < len(f.starts) && (limit <= 0 || len(result) < limit); i++ {
+		line := f.lineAt(i)
+		if !bytes.HasPrefix(line, prefix) {
+			break
+		}
+		s, err := parseLine(string(line))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	sort.Stable(byPath(result))
+	return result, nil
+}
+
+type byPath []Symbol
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
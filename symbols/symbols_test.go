@@ -0,0 +1,105 @@
+package symbols
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	const tags = "!_TAG_FILE_FORMAT\t2\t/extended format/\n" +
+		"main\ti3-wm_4.7.2-1/src/main.c\t243;\"\tfunction\n" +
+		"argc\ti3-wm_4.7.2-1/src/main.c\t243;\"\tparameter\n" +
+		"DLOG\ti3-wm_4.7.2-1/include/log.h\t42;\"\tkind:macro\n" +
+		"broken\ti3-wm_4.7.2-1/src/main.c\t/^broken$/;\"\tfunction\n"
+	got, err := parseTags(strings.NewReader(tags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Symbol{
+		{Name: "main", Kind: "function", Path: "i3-wm_4.7.2-1/src/main.c", Line: 243},
+		{Name: "DLOG", Kind: "macro", Path: "i3-wm_4.7.2-1/include/log.h", Line: 42},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTags() = %v, want %v", got, want)
+	}
+}
+
+func TestMergeLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "symbols-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i3 := []Symbol{
+		{Name: "main", Kind: "function", Path: "i3-wm_4.7.2-1/src/main.c", Line: 243},
+		{Name: "DLOG", Kind: "macro", Path: "i3-wm_4.7.2-1/include/log.h", Line: 42},
+	}
+	zsh := []Symbol{
+		{Name: "main", Kind: "function", Path: "zsh_5.0.7-3/Src/main.c", Line: 91},
+		{Name: "mainloop", Kind: "function", Path: "zsh_5.0.7-3/Src/init.c", Line: 100},
+	}
+	for name, symbols := range map[string][]Symbol{"i3-wm.idx": i3, "zsh.idx": zsh} {
+		if err := Write(FileFor(filepath.Join(dir, name)), symbols); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := filepath.Join(dir, "full.sym")
+	if err := Merge(full,
+		filepath.Join(dir, "i3-wm.sym"),
+		filepath.Join(dir, "zsh.sym"),
+		filepath.Join(dir, "nonexistent.sym")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Open(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.Len(), 4; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	for _, test := range []struct {
+		name  string
+		limit int
+		want  []Symbol
+	}{
+		{"main", 0, []Symbol{i3[0], zsh[0]}},
+		{"main", 1, []Symbol{i3[0]}},
+		{"mainloop", 0, []Symbol{zsh[1]}},
+		{"DLOG", 0, []Symbol{i3[1]}},
+		{"mai", 0, nil},
+	} {
+		got, err := f.Lookup(test.name, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Lookup(%q, %d) = %v, want %v", test.name, test.limit, got, test.want)
+		}
+	}
+}
+
+func TestSortByRelatedness(t *testing.T) {
+	defs := []Symbol{
+		{Name: "xcb_connect", Path: "glibc_2.19/xcb.h", Line: 1},
+		{Name: "xcb_connect", Path: "xcb-util_0.3.8/src/xcb.c", Line: 2},
+		{Name: "xcb_connect", Path: "libxcb_1.9/include/xcb.h", Line: 3},
+		{Name: "xcb_connect", Path: "libxcb_1.10/src/xcb_conn.c", Line: 4},
+		{Name: "xcb_connect", Path: "libxcb_1.10/src/xcb.c", Line: 5},
+		{Name: "xcb_connect", Path: "libxcb_1.10/include/xcb.h", Line: 6},
+		{Name: "xcb_connect", Path: "libxcb_1.10/src/main.c", Line: 7},
+	}
+	SortByRelatedness(defs, "libxcb_1.10/src/main.c")
+	var got []int
+	for _, def := range defs {
+		got = append(got, def.Line)
+	}
+	if want := []int{7, 4, 5, 6, 3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SortByRelatedness: got lines %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,307 @@
+package varz
+
+// Histograms and summaries, which record the distribution of observed values
+// (e.g. the durations of queries), so that percentiles can be monitored
+// instead of only counts.
+//
+// In /varz, a histogram or summary with the key “query-duration-seconds” is
+// exported as query-duration-seconds-count, -sum, -p50, -p90 and -p99. The
+// percentiles of histograms are estimated from their buckets, while
+// summaries compute them from their most recent observations. In the
+// Prometheus format, histograms are exported as histograms (so that
+// Prometheus can aggregate them across daemons) and summaries as summaries
+// with the quantiles 0.5, 0.9 and 0.99.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DurationBuckets are the upper bounds of buckets for durations in seconds,
+// from 5 milliseconds to 10 minutes.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 600}
+
+// The quantiles which are exported.
+var quantiles = []float64{0.5, 0.9, 0.99}
+
+var (
+	distributionsMu sync.Mutex
+	histograms      = make(map[string]*Histogram)
+	summaries       = make(map[string]*Summary)
+)
+
+// A Histogram counts observations in buckets with configurable upper bounds.
+// It is safe to use from multiple goroutines.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// One count per bucket, the last one for the values above all bounds.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram returns the histogram key, creating it with buckets with the
+// given upper bounds (in ascending order) if it does not exist yet.
+func NewHistogram(key string, bounds []float64) *Histogram {
+	distributionsMu.Lock()
+	defer distributionsMu.Unlock()
+	if h, ok := histograms[key]; ok {
+		return h
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		panic(fmt.Sprintf("varz: buckets of histogram %q are not sorted", key))
+	}
+	h := &Histogram{
+		bounds: append([]float64(nil), bounds...),
+		counts: make([]uint64, len(bounds)+1),
+	}
+	histograms[key] = h
+	return h
+}
+
+// Observe records the value v.
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[idx]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// ObserveDuration records d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// ObserveSince records the time which passed since started, e.g.
+// “defer h.ObserveSince(time.Now())”.
+func (h *Histogram) ObserveSince(started time.Time) {
+	h.ObserveDuration(time.Since(started))
+}
+
+// Quantile estimates the q-quantile (e.g. 0.99 for the 99th percentile) of
+// the observations like Prometheus does: by interpolating linearly within
+// the bucket which contains it. Values above all bounds are estimated as the
+// highest bound. Returns 0 if there are no observations.
+func (h *Histogram) Quantile(q float64) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cumulative uint64
+	for idx, n := range h.counts {
+		if float64(cumulative+n) < rank || n == 0 {
+			cumulative += n
+			continue
+		}
+		if idx == len(h.bounds) {
+			break
+		}
+		lower := 0.0
+		if idx > 0 {
+			lower = h.bounds[idx-1]
+		}
+		return lower + (h.bounds[idx]-lower)*(rank-float64(cumulative))/float64(n)
+	}
+	if len(h.bounds) == 0 {
+		return 0
+	}
+	return h.bounds[len(h.bounds)-1]
+}
+
+// Returns the number and the sum of the observations.
+func (h *Histogram) totals() (uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+// Returns the samples of h in the Prometheus format, named after name.
+func (h *Histogram) samples(name, help string) []sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var samples []sample
+	var cumulative uint64
+	for idx, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if idx < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[idx], 'g', -1, 64)
+		}
+		samples = append(samples, sample{
+			family: name,
+			name:   name + "_bucket",
+			labels: fmt.Sprintf("le=%q", le),
+			value:  cumulative,
+		})
+	}
+	samples = append(samples,
+		sample{family: name, name: name + "_sum", float: true, floatValue: h.sum},
+		sample{family: name, name: name + "_count", value: h.count})
+	samples[0].help = help
+	samples[0].kind = "histogram"
+	return samples
+}
+
+// WritePrometheus writes h as the histogram name in the Prometheus text
+// format, for daemons which export metrics other than via /varz.
+func (h *Histogram) WritePrometheus(w io.Writer, name, help string) error {
+	return writePrometheus(w, h.samples(name, help))
+}
+
+// A Summary computes quantiles over its most recent observations. It is safe
+// to use from multiple goroutines.
+type Summary struct {
+	mu sync.Mutex
+	// Ring buffer of the most recent observations.
+	window []float64
+	next   int
+	count  uint64
+	sum    float64
+}
+
+// NewSummary returns the summary key, creating it with a window of the given
+// number of most recent observations if it does not exist yet.
+func NewSummary(key string, window int) *Summary {
+	distributionsMu.Lock()
+	defer distributionsMu.Unlock()
+	if s, ok := summaries[key]; ok {
+		return s
+	}
+	s := &Summary{window: make([]float64, 0, window)}
+	summaries[key] = s
+	return s
+}
+
+// Observe records the value v.
+func (s *Summary) Observe(v float64) {
+	s.mu.Lock()
+	if len(s.window) < cap(s.window) {
+		s.window = append(s.window, v)
+	} else if len(s.window) > 0 {
+		s.window[s.next] = v
+		s.next = (s.next + 1) % len(s.window)
+	}
+	s.count++
+	s.sum += v
+	s.mu.Unlock()
+}
+
+// ObserveDuration records d in seconds.
+func (s *Summary) ObserveDuration(d time.Duration) {
+	s.Observe(d.Seconds())
+}
+
+// ObserveSince records the time which passed since started.
+func (s *Summary) ObserveSince(started time.Time) {
+	s.ObserveDuration(time.Since(started))
+}
+
+// Quantile returns the q-quantile (e.g. 0.99 for the 99th percentile) of the
+// observations in the window, or 0 if there are none.
+func (s *Summary) Quantile(q float64) float64 {
+	s.mu.Lock()
+	sorted := append([]float64(nil), s.window...)
+	s.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Float64s(sorted)
+	idx := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// Returns the number and the sum of all observations, including the ones
+// which left the window.
+func (s *Summary) totals() (uint64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.sum
+}
+
+// Returns the samples of s in the Prometheus format, named after name.
+func (s *Summary) samples(name, help string) []sample {
+	var samples []sample
+	for _, q := range quantiles {
+		samples = append(samples, sample{
+			family:     name,
+			name:       name,
+			labels:     fmt.Sprintf("quantile=%q", strconv.FormatFloat(q, 'g', -1, 64)),
+			float:      true,
+			floatValue: s.Quantile(q),
+		})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples = append(samples,
+		sample{family: name, name: name + "_sum", float: true, floatValue: s.sum},
+		sample{family: name, name: name + "_count", value: s.count})
+	samples[0].help = help
+	samples[0].kind = "summary"
+	return samples
+}
+
+// ObserveDuration records d in the histogram key, which is created with
+// DurationBuckets if it does not exist yet.
+func ObserveDuration(key string, d time.Duration) {
+	NewHistogram(key, DurationBuckets).ObserveDuration(d)
+}
+
+// A histogram or a summary.
+type distribution interface {
+	Quantile(q float64) float64
+	totals() (count uint64, sum float64)
+	samples(name, help string) []sample
+}
+
+// Returns all histograms and summaries by key.
+func distributions() map[string]distribution {
+	distributionsMu.Lock()
+	defer distributionsMu.Unlock()
+	all := make(map[string]distribution, len(histograms)+len(summaries))
+	for key, h := range histograms {
+		all[key] = h
+	}
+	for key, s := range summaries {
+		all[key] = s
+	}
+	return all
+}
+
+// Writes the count, sum and percentiles of all histograms and summaries in
+// the format of /varz.
+func writeDistributions(w io.Writer) {
+	for key, d := range distributions() {
+		count, sum := d.totals()
+		fmt.Fprintf(w, "%s-count %d\n", key, count)
+		fmt.Fprintf(w, "%s-sum %g\n", key, sum)
+		for _, q := range quantiles {
+			fmt.Fprintf(w, "%s-p%d %g\n", key, int(q*100), d.Quantile(q))
+		}
+	}
+}
+
+// Returns the samples of all histograms and summaries in the Prometheus
+// format.
+func distributionSamples() []sample {
+	var samples []sample
+	for key, d := range distributions() {
+		samples = append(samples, d.samples(prometheusName(key, true),
+			fmt.Sprintf("The distribution %s of /varz.", key))...)
+	}
+	return samples
+}
+
+// vim:ts=4:sw=4:noexpandtab
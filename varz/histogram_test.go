@@ -0,0 +1,92 @@
+package varz
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewHistogram("varz-test-histogram", []float64{1, 2, 4})
+	if got := h.Quantile(0.5); got != 0 {
+		t.Errorf("Quantile(0.5) = %v without observations, want 0", got)
+	}
+	for _, v := range []float64{0.5, 1.5, 1.5, 3} {
+		h.Observe(v)
+	}
+	for _, test := range []struct {
+		q, want float64
+	}{
+		// Two of four observations are in the bucket (1, 2].
+		{0.5, 1.5},
+		{0.25, 1},
+		{0.75, 2},
+		{1, 4},
+	} {
+		if got := h.Quantile(test.q); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("Quantile(%v) = %v, want %v", test.q, got, test.want)
+		}
+	}
+	h.Observe(100)
+	if got := h.Quantile(1); got != 4 {
+		t.Errorf("Quantile(1) = %v with a value above all buckets, want the highest bound 4", got)
+	}
+
+	if NewHistogram("varz-test-histogram", DurationBuckets) != h {
+		t.Errorf("NewHistogram returned a new histogram for an existing key")
+	}
+}
+
+func TestHistogramPrometheus(t *testing.T) {
+	h := NewHistogram("varz-test-durations", []float64{0.1, 1})
+	h.ObserveDuration(50 * time.Millisecond)
+	h.ObserveDuration(2 * time.Second)
+	var buf bytes.Buffer
+	if err := h.WritePrometheus(&buf, "dcs_test_duration_seconds", "Time spent testing."); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP dcs_test_duration_seconds Time spent testing.
+# TYPE dcs_test_duration_seconds histogram
+dcs_test_duration_seconds_bucket{le="0.1"} 1
+dcs_test_duration_seconds_bucket{le="1"} 1
+dcs_test_duration_seconds_bucket{le="+Inf"} 2
+dcs_test_duration_seconds_sum 2.05
+dcs_test_duration_seconds_count 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WritePrometheus wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	s := NewSummary("varz-test-summary", 10)
+	for i := 1; i <= 20; i++ {
+		s.Observe(float64(i))
+	}
+	// Only the last 10 observations (11 to 20) are in the window.
+	if got := s.Quantile(0.5); got != 15 {
+		t.Errorf("Quantile(0.5) = %v, want 15", got)
+	}
+	if got := s.Quantile(0.99); got != 20 {
+		t.Errorf("Quantile(0.99) = %v, want 20", got)
+	}
+	if count, sum := s.totals(); count != 20 || sum != 210 {
+		t.Errorf("totals() = %d, %v, want 20, 210", count, sum)
+	}
+
+	var buf bytes.Buffer
+	writeDistributions(&buf)
+	for _, line := range []string{
+		"varz-test-summary-count 20\n",
+		"varz-test-summary-sum 210\n",
+		"varz-test-summary-p50 15\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("/varz does not contain %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+// vim:ts=4:sw=4:noexpandtab
@@ -0,0 +1,119 @@
+package varz
+
+// Labeled counters, whose dimensions (e.g. the filter which excluded a file)
+// are labels instead of being encoded into their keys, e.g.
+//
+//	varz.IncrementLabeled("http-requests", map[string]string{"handler": "search", "code": "200"})
+//
+// /varz lists each combination of labels of a key as
+// “http-requests{code="200",handler="search"} 5”, and the Prometheus format
+// exports them as the samples of one metric with these labels.
+//
+// The counters of a key are stored by their labels in canonical form (sorted
+// by name, as in the example), so that looking up a counter costs one map
+// lookup per level once the labels are formatted.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	labeledMu sync.RWMutex
+	// By key, then by labels in canonical form.
+	labeled = make(map[string]map[string]*counter)
+)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Returns labels in canonical form, e.g. `code="200",handler="search"`.
+// Characters which Prometheus does not allow in label names are replaced by
+// underscores.
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for idx, name := range names {
+		if idx > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(sanitizeName(name))
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// Returns the counter of key with the given labels, creating it if it does
+// not exist yet.
+func labeledCounter(key string, labels map[string]string) *counter {
+	formatted := formatLabels(labels)
+	labeledMu.RLock()
+	c, ok := labeled[key][formatted]
+	labeledMu.RUnlock()
+	if ok {
+		return c
+	}
+	labeledMu.Lock()
+	defer labeledMu.Unlock()
+	series, ok := labeled[key]
+	if !ok {
+		series = make(map[string]*counter)
+		labeled[key] = series
+	}
+	if c, ok := series[formatted]; ok {
+		return c
+	}
+	c = &counter{}
+	series[formatted] = c
+	return c
+}
+
+// IncrementLabeled increments the counter key with the given labels.
+func IncrementLabeled(key string, labels map[string]string) {
+	labeledCounter(key, labels).Add()
+}
+
+// IncrementByLabeled adds n to the counter key with the given labels.
+func IncrementByLabeled(key string, labels map[string]string, n uint64) {
+	labeledCounter(key, labels).AddN(n)
+}
+
+// SetLabeled sets the counter key with the given labels to value, see Set.
+func SetLabeled(key string, labels map[string]string, value uint64) {
+	labeledCounter(key, labels).Set(value)
+}
+
+// A counter with labels, see labeledSeries.
+type labeledSample struct {
+	key    string
+	labels string
+	value  uint64
+	gauge  bool
+}
+
+// Returns all labeled counters, sorted by key and labels.
+func labeledSeries() []labeledSample {
+	labeledMu.RLock()
+	defer labeledMu.RUnlock()
+	var samples []labeledSample
+	for key, series := range labeled {
+		for labels, c := range series {
+			samples = append(samples, labeledSample{key, labels, c.Value(), c.IsGauge()})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].key != samples[j].key {
+			return samples[i].key < samples[j].key
+		}
+		return samples[i].labels < samples[j].labels
+	})
+	return samples
+}
+
+// vim:ts=4:sw=4:noexpandtab
@@ -0,0 +1,57 @@
+package varz
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels map[string]string
+		want   string
+	}{
+		{nil, ``},
+		{map[string]string{"handler": "search", "code": "200"}, `code="200",handler="search"`},
+		{map[string]string{"file-name": `a "b"\c`}, `file_name="a \"b\"\\c"`},
+	} {
+		if got := formatLabels(test.labels); got != test.want {
+			t.Errorf("formatLabels(%v) = %s, want %s", test.labels, got, test.want)
+		}
+	}
+}
+
+func TestLabeled(t *testing.T) {
+	IncrementLabeled("varz-test-requests", map[string]string{"handler": "search", "code": "200"})
+	IncrementLabeled("varz-test-requests", map[string]string{"code": "200", "handler": "search"})
+	IncrementByLabeled("varz-test-requests", map[string]string{"handler": "show", "code": "404"}, 3)
+	SetLabeled("varz-test-files", map[string]string{"shard": "1"}, 42)
+
+	w := httptest.NewRecorder()
+	Varz(w, httptest.NewRequest("GET", "/varz", nil))
+	for _, line := range []string{
+		"\nvarz-test-requests{code=\"200\",handler=\"search\"} 2\n",
+		"\nvarz-test-requests{code=\"404\",handler=\"show\"} 3\n",
+		"\nvarz-test-files{shard=\"1\"} 42\n",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("/varz does not contain %q:\n%s", line, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	Varz(w, httptest.NewRequest("GET", "/varz?format=prometheus", nil))
+	want := `# HELP dcs_varz_test_requests_total The variable varz-test-requests of /varz.
+# TYPE dcs_varz_test_requests_total counter
+dcs_varz_test_requests_total{code="200",handler="search"} 2
+dcs_varz_test_requests_total{code="404",handler="show"} 3
+`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Prometheus format does not contain\n%s\n%s", want, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "# TYPE dcs_varz_test_files gauge\ndcs_varz_test_files{shard=\"1\"} 42\n") {
+		t.Errorf("Prometheus format does not contain the labeled gauge:\n%s", w.Body.String())
+	}
+}
+
+// vim:ts=4:sw=4:noexpandtab
@@ -0,0 +1,155 @@
+package varz
+
+// Exporting the variables in the Prometheus text format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/), so that
+// standard monitoring systems can scrape the /varz of every dcs daemon.
+//
+// Counters are named after their key, e.g. “failed-queries” is exported as
+// dcs_failed_queries_total, with the usual _total suffix unless they are
+// gauges (see Set). The built-in metrics use the names of the Go client
+// library of Prometheus where there is one (e.g. go_goroutines), and labels
+// like labeled counters do (e.g. dcs_dev_reads_total{device="sda"}).
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Returns whether r asks for the Prometheus format, either with
+// format=prometheus or with an Accept header like the one of Prometheus.
+func wantsPrometheus(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "prometheus" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "version=0.0.4") ||
+		strings.Contains(accept, "application/openmetrics-text")
+}
+
+// Replaces the characters which Prometheus does not allow in the names of
+// metrics and labels with underscores.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Returns the Prometheus metric name of the counter key.
+func prometheusName(key string, gauge bool) string {
+	name := "dcs_" + sanitizeName(key)
+	if !gauge && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	return name
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Returns the name of the metric family of s.
+func (s sample) familyName() string {
+	if s.family != "" {
+		return s.family
+	}
+	return s.name
+}
+
+// Writes samples in the Prometheus text format. Each metric family gets HELP
+// and TYPE lines, followed by its samples, which are grouped by family.
+func writePrometheus(w io.Writer, samples []sample) error {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].familyName() < samples[j].familyName() })
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool)
+	for idx, s := range samples {
+		series := s.name + "{" + s.labels + "}"
+		if seen[series] {
+			// Another counter whose key maps to the same name.
+			continue
+		}
+		seen[series] = true
+		if idx == 0 || samples[idx-1].familyName() != s.familyName() {
+			fmt.Fprintf(bw, "# HELP %s %s\n", s.familyName(), helpEscaper.Replace(s.help))
+			fmt.Fprintf(bw, "# TYPE %s %s\n", s.familyName(), s.kind)
+		}
+		value := strconv.FormatUint(s.value, 10)
+		if s.float {
+			value = strconv.FormatFloat(s.floatValue, 'g', -1, 64)
+		} else if s.scale != 0 {
+			value = strconv.FormatFloat(float64(s.value)*s.scale, 'g', -1, 64)
+		}
+		if s.labels != "" {
+			fmt.Fprintf(bw, "%s{%s} %s\n", s.name, s.labels, value)
+		} else {
+			fmt.Fprintf(bw, "%s %s\n", s.name, value)
+		}
+	}
+	return bw.Flush()
+}
+
+// Returns the samples of the labeled counters. All counters of a key are
+// gauges if one of them is.
+func labeledSamples() []sample {
+	series := labeledSeries()
+	gauges := make(map[string]bool)
+	for _, s := range series {
+		gauges[s.key] = gauges[s.key] || s.gauge
+	}
+	var samples []sample
+	for _, s := range series {
+		kind := "counter"
+		if gauges[s.key] {
+			kind = "gauge"
+		}
+		samples = append(samples, sample{
+			key:    s.key,
+			name:   prometheusName(s.key, gauges[s.key]),
+			help:   fmt.Sprintf("The variable %s of /varz.", s.key),
+			kind:   kind,
+			labels: s.labels,
+			value:  s.value,
+		})
+	}
+	return samples
+}
+
+// PrometheusHandler exports the counters, the labeled counters, the
+// histograms and summaries (see histogram.go) and the built-in metrics in the
+// Prometheus text format. /varz does the same for clients which ask for it,
+// so that it suffices to scrape /varz.
+func PrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	samples := append(builtinSamples(), sample{
+		name:  "process_start_time_seconds",
+		help:  "Start time of the process since unix epoch in seconds.",
+		kind:  "gauge",
+		value: uint64(started.Unix()),
+	})
+	for _, key := range counterKeys() {
+		c := getCounter(key)
+		kind := "counter"
+		if c.IsGauge() {
+			kind = "gauge"
+		}
+		samples = append(samples, sample{
+			key:   key,
+			name:  prometheusName(key, c.IsGauge()),
+			help:  fmt.Sprintf("The variable %s of /varz.", key),
+			kind:  kind,
+			value: c.Value(),
+		})
+	}
+	samples = append(samples, labeledSamples()...)
+	samples = append(samples, distributionSamples()...)
+	w.Header().Set("Content-Type", prometheusContentType)
+	writePrometheus(w, samples)
+}
+
+// vim:ts=4:sw=4:noexpandtab
@@ -0,0 +1,87 @@
+package varz
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusName(t *testing.T) {
+	for _, test := range []struct {
+		key   string
+		gauge bool
+		want  string
+	}{
+		{"failed-queries", false, "dcs_failed_queries_total"},
+		{"active-queries", true, "dcs_active_queries"},
+		{"manifest-packages", true, "dcs_manifest_packages"},
+		{"requests_total", false, "dcs_requests_total"},
+	} {
+		if got := prometheusName(test.key, test.gauge); got != test.want {
+			t.Errorf("prometheusName(%q, %v) = %q, want %q", test.key, test.gauge, got, test.want)
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	err := writePrometheus(&buf, []sample{
+		{name: "dcs_dev_reads_total", help: "Reads completed by the disk.", kind: "counter", labels: `device="sda"`, value: 3},
+		{name: "go_goroutines", help: "Number of goroutines that currently exist.", kind: "gauge", value: 12},
+		{name: "dcs_dev_reads_total", help: "Reads completed by the disk.", kind: "counter", labels: `device="xvda"`, value: 5},
+		{name: "process_cpu_user_seconds_total", help: "User CPU time spent in seconds.", kind: "counter", value: 1500000000, scale: 1e-9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP dcs_dev_reads_total Reads completed by the disk.
+# TYPE dcs_dev_reads_total counter
+dcs_dev_reads_total{device="sda"} 3
+dcs_dev_reads_total{device="xvda"} 5
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 12
+# HELP process_cpu_user_seconds_total User CPU time spent in seconds.
+# TYPE process_cpu_user_seconds_total counter
+process_cpu_user_seconds_total 1.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("writePrometheus wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVarzNegotiatesPrometheus(t *testing.T) {
+	Set("varz-test-gauge", 42)
+	Set("varz-test-counter", 0)
+	Increment("varz-test-counter")
+
+	r := httptest.NewRequest("GET", "/varz", nil)
+	r.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	w := httptest.NewRecorder()
+	Varz(w, r)
+	if got := w.Header().Get("Content-Type"); got != prometheusContentType {
+		t.Errorf("Content-Type = %q, want %q", got, prometheusContentType)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE dcs_varz_test_gauge gauge\n",
+		"\ndcs_varz_test_gauge 42\n",
+		"# TYPE dcs_varz_test_counter_total counter\n",
+		"\ndcs_varz_test_counter_total 1\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Prometheus format does not contain %q:\n%s", line, body)
+		}
+	}
+
+	// Other clients still get the plain format.
+	w = httptest.NewRecorder()
+	Varz(w, httptest.NewRequest("GET", "/varz", nil))
+	if body := w.Body.String(); !strings.Contains(body, "\nvarz-test-gauge 42\n") {
+		t.Errorf("/varz does not contain the gauge:\n%s", body)
+	}
+}
+
+// vim:ts=4:sw=4:noexpandtab
@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,7 +21,10 @@ var (
 	availFS = flag.String("varz_avail_fs",
 		"/dcs-ssd",
 		"If non-empty, /varz will contain the amount of available bytes on the specified filesystem")
-	counters = make(map[string]*counter)
+	// Maps keys to *counter. Counters are created once and updated
+	// atomically, which suits a sync.Map: lookups of existing keys do not
+	// lock at all.
+	counters sync.Map
 
 	started = time.Now()
 )
@@ -28,56 +33,138 @@ const (
 	bytesPerSector = 512
 )
 
-// A counter which is safe to use from multiple goroutines.
+// A counter which is safe to use from multiple goroutines without locking.
 type counter struct {
-	lock  sync.Mutex
+	// Accessed atomically. First in the struct, so that it is 64-bit aligned
+	// on 32-bit platforms.
 	value uint64
+
+	// Set to 1 (atomically) once the counter was decremented or set to a
+	// value other than zero, i.e. does not only count up but is a gauge.
+	gauge uint32
 }
 
 func (c *counter) Add() {
-	c.lock.Lock()
-	c.value += 1
-	c.lock.Unlock()
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) AddN(n uint64) {
+	atomic.AddUint64(&c.value, n)
 }
 
+// Subtract subtracts one, unless the counter is zero already, as counters
+// cannot become negative.
 func (c *counter) Subtract() {
-	c.lock.Lock()
-	c.value -= 1
-	c.lock.Unlock()
+	atomic.StoreUint32(&c.gauge, 1)
+	for {
+		value := atomic.LoadUint64(&c.value)
+		if value == 0 || atomic.CompareAndSwapUint64(&c.value, value, value-1) {
+			return
+		}
+	}
+}
+
+func (c *counter) Set(value uint64) {
+	atomic.StoreUint64(&c.value, value)
+	if value != 0 {
+		atomic.StoreUint32(&c.gauge, 1)
+	}
 }
 
 func (c *counter) Value() uint64 {
-	return c.value
+	return atomic.LoadUint64(&c.value)
 }
 
-func Varz(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("X-Uptime", fmt.Sprintf("%d", time.Since(started)))
+func (c *counter) IsGauge() bool {
+	return atomic.LoadUint32(&c.gauge) == 1
+}
+
+// Returns the counter key, creating it (with value zero) if it does not
+// exist yet.
+func getCounter(key string) *counter {
+	if c, ok := counters.Load(key); ok {
+		return c.(*counter)
+	}
+	c, _ := counters.LoadOrStore(key, &counter{})
+	return c.(*counter)
+}
+
+// Returns the keys of all counters in lexical order.
+func counterKeys() []string {
+	var keys []string
+	counters.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// A sample of one of the built-in metrics about the process and the machine,
+// which are exported along with the counters.
+type sample struct {
+	// The name in /varz, e.g. “dev-reads”.
+	key string
+
+	// The name, help text, type (“counter” or “gauge”) and labels (e.g.
+	// `device="sda"`) in the Prometheus format, see prometheus.go. Samples of
+	// histograms and summaries have names like <family>_sum and share the
+	// help text and type of their family, which only their first sample
+	// carries.
+	name   string
+	family string
+	help   string
+	kind   string
+	labels string
+
+	value uint64
+
+	// Set for the samples of histograms and summaries which are not
+	// integral, e.g. sums of durations in seconds.
+	float      bool
+	floatValue float64
+
+	// What value is multiplied with in the Prometheus format, which uses
+	// base units such as seconds. 0 stands for 1.
+	scale float64
+}
+
+// Returns the built-in metrics: runtime statistics, the available bytes of
+// -varz_avail_fs, CPU time and disk statistics.
+func builtinSamples() []sample {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
-	fmt.Fprintf(w, "num-goroutine %d\n", runtime.NumGoroutine())
-	fmt.Fprintf(w, "mem-alloc-bytes %d\n", m.Alloc)
-	fmt.Fprintf(w, "last-gc-absolute-ns %d\n", m.LastGC)
-	for key, counter := range counters {
-		fmt.Fprintf(w, "%s %d\n", key, counter.Value())
+	samples := []sample{
+		{key: "num-goroutine", name: "go_goroutines", help: "Number of goroutines that currently exist.", kind: "gauge", value: uint64(runtime.NumGoroutine())},
+		{key: "mem-alloc-bytes", name: "go_memstats_alloc_bytes", help: "Number of bytes allocated and still in use.", kind: "gauge", value: m.Alloc},
+		{key: "last-gc-absolute-ns", name: "go_memstats_last_gc_time_seconds", help: "Number of seconds since 1970 of last garbage collection.", kind: "gauge", value: m.LastGC, scale: 1e-9},
 	}
 	if *availFS != "" {
 		var stat syscall.Statfs_t
 		if err := syscall.Statfs(*availFS, &stat); err != nil {
 			log.Printf("Could not stat filesystem for %q: %v\n", *availFS, err)
 		} else {
-			fmt.Fprintf(w, "available-bytes %d\n", stat.Bavail*uint64(stat.Bsize))
+			samples = append(samples, sample{
+				key:    "available-bytes",
+				name:   "dcs_filesystem_avail_bytes",
+				help:   "Bytes available to unprivileged users on the filesystem of -varz_avail_fs.",
+				kind:   "gauge",
+				labels: fmt.Sprintf("path=%q", *availFS),
+				value:  stat.Bavail * uint64(stat.Bsize),
+			})
 		}
 	}
 
 	var rusage syscall.Rusage
 	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &rusage); err == nil {
-		fmt.Fprintf(w, "cpu-time-user-ns %d\n", syscall.TimevalToNsec(rusage.Utime))
-		fmt.Fprintf(w, "cpu-time-system-ns %d\n", syscall.TimevalToNsec(rusage.Stime))
+		samples = append(samples,
+			sample{key: "cpu-time-user-ns", name: "process_cpu_user_seconds_total", help: "User CPU time spent in seconds.", kind: "counter", value: uint64(syscall.TimevalToNsec(rusage.Utime)), scale: 1e-9},
+			sample{key: "cpu-time-system-ns", name: "process_cpu_system_seconds_total", help: "System CPU time spent in seconds.", kind: "counter", value: uint64(syscall.TimevalToNsec(rusage.Stime)), scale: 1e-9})
 	}
 
 	diskstats, err := os.Open("/proc/diskstats")
 	if err != nil {
-		return
+		return samples
 	}
 	defer diskstats.Close()
 
@@ -99,35 +186,72 @@ func Varz(w http.ResponseWriter, r *http.Request) {
 		if !strings.HasSuffix(device, "da") {
 			continue
 		}
-		fmt.Fprintf(w, "dev-reads.%s %d\n", device, reads)
-		fmt.Fprintf(w, "dev-bytes-read.%s %d\n", device, readsectors*bytesPerSector)
-		fmt.Fprintf(w, "dev-writes.%s %d\n", device, writes)
-		fmt.Fprintf(w, "dev-bytes-written.%s %d\n", device, writtensectors*bytesPerSector)
+		labels := fmt.Sprintf("device=%q", device)
+		samples = append(samples,
+			sample{key: "dev-reads", name: "dcs_dev_reads_total", help: "Reads completed by the disk.", kind: "counter", labels: labels, value: reads},
+			sample{key: "dev-bytes-read", name: "dcs_dev_read_bytes_total", help: "Bytes read from the disk.", kind: "counter", labels: labels, value: readsectors * bytesPerSector},
+			sample{key: "dev-writes", name: "dcs_dev_writes_total", help: "Writes completed by the disk.", kind: "counter", labels: labels, value: writes},
+			sample{key: "dev-bytes-written", name: "dcs_dev_written_bytes_total", help: "Bytes written to the disk.", kind: "counter", labels: labels, value: writtensectors * bytesPerSector})
 	}
+	return samples
 }
 
-func Increment(key string) {
-	if c, ok := counters[key]; ok {
-		c.Add()
-	} else {
-		counters[key] = &counter{value: 1}
+// Varz handles /varz by listing the counters (including the labeled ones,
+// see labels.go), the built-in metrics and the histograms and summaries (see
+// histogram.go), one “name value” line each. Prometheus (and clients which ask for its format
+// like Prometheus does) get the Prometheus format instead, see
+// PrometheusHandler.
+func Varz(w http.ResponseWriter, r *http.Request) {
+	if wantsPrometheus(r) {
+		PrometheusHandler(w, r)
+		return
+	}
+	w.Header().Set("X-Uptime", fmt.Sprintf("%d", time.Since(started)))
+	for _, s := range builtinSamples() {
+		if s.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %d\n", s.key, s.labels, s.value)
+		} else {
+			fmt.Fprintf(w, "%s %d\n", s.key, s.value)
+		}
+	}
+	for _, key := range counterKeys() {
+		fmt.Fprintf(w, "%s %d\n", key, getCounter(key).Value())
 	}
+	for _, s := range labeledSeries() {
+		fmt.Fprintf(w, "%s{%s} %d\n", s.key, s.labels, s.value)
+	}
+	writeDistributions(w)
+}
+
+// Increment adds one to the counter key.
+func Increment(key string) {
+	getCounter(key).Add()
+}
+
+// IncrementBy adds n to the counter key, e.g. for counting bytes.
+func IncrementBy(key string, n uint64) {
+	getCounter(key).AddN(n)
 }
 
+// Decrement subtracts one from the counter key, which does not go below zero.
+// A key which does not exist yet is created with value zero.
 func Decrement(key string) {
-	if c, ok := counters[key]; ok {
-		c.Subtract()
-	} else {
-		counters[key] = &counter{value: 1}
-	}
+	getCounter(key).Subtract()
 }
 
+// Set sets the counter key to value. Counters which are set to values other
+// than zero are exported as gauges, while counters which are only set to zero
+// (to export them before they are first incremented) stay counters.
 func Set(key string, value uint64) {
-	if c, ok := counters[key]; ok {
-		c.value = value
-	} else {
-		counters[key] = &counter{value: value}
-	}
+	getCounter(key).Set(value)
+}
+
+// SetGauge is like Set, but key is exported as a gauge even while it is zero,
+// e.g. the length of a queue which starts out empty.
+func SetGauge(key string, value uint64) {
+	c := getCounter(key)
+	atomic.StoreUint32(&c.gauge, 1)
+	c.Set(value)
 }
 
 // vim:ts=4:sw=4:noexpandtab
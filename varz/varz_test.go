@@ -0,0 +1,86 @@
+package varz
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDecrement(t *testing.T) {
+	Decrement("varz-test-missing")
+	if got := getCounter("varz-test-missing").Value(); got != 0 {
+		t.Errorf("Decrement of a missing key set it to %d, want 0", got)
+	}
+
+	Set("varz-test-active", 2)
+	Decrement("varz-test-active")
+	if got := getCounter("varz-test-active").Value(); got != 1 {
+		t.Errorf("value after Decrement = %d, want 1", got)
+	}
+	Decrement("varz-test-active")
+	Decrement("varz-test-active")
+	if got := getCounter("varz-test-active").Value(); got != 0 {
+		t.Errorf("value after decrementing below zero = %d, want 0", got)
+	}
+	if !getCounter("varz-test-active").IsGauge() {
+		t.Errorf("decremented counter is not a gauge")
+	}
+}
+
+func TestSetGauge(t *testing.T) {
+	Set("varz-test-counter", 0)
+	SetGauge("varz-test-gauge", 0)
+	if getCounter("varz-test-counter").IsGauge() {
+		t.Errorf("counter set to zero is a gauge")
+	}
+	if !getCounter("varz-test-gauge").IsGauge() {
+		t.Errorf("SetGauge did not make a gauge")
+	}
+}
+
+func TestConcurrentCounters(t *testing.T) {
+	const goroutines, increments = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				Increment("varz-test-concurrent")
+				IncrementBy("varz-test-concurrent-by", 2)
+				// New keys are created while /varz lists the counters.
+				Set("varz-test-concurrent-"+strconv.Itoa(i), uint64(j))
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		Varz(httptest.NewRecorder(), httptest.NewRequest("GET", "/varz", nil))
+	}
+	wg.Wait()
+	if got, want := getCounter("varz-test-concurrent").Value(), uint64(goroutines*increments); got != want {
+		t.Errorf("varz-test-concurrent = %d, want %d", got, want)
+	}
+	if got, want := getCounter("varz-test-concurrent-by").Value(), uint64(2*goroutines*increments); got != want {
+		t.Errorf("varz-test-concurrent-by = %d, want %d", got, want)
+	}
+}
+
+func BenchmarkIncrementParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Increment("varz-bench-requests")
+		}
+	})
+}
+
+func BenchmarkIncrementParallelKeys(b *testing.B) {
+	keys := []string{"varz-bench-a", "varz-bench-b", "varz-bench-c", "varz-bench-d"}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			Increment(keys[i%len(keys)])
+		}
+	})
+}
+
+// vim:ts=4:sw=4:noexpandtab